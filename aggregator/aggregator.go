@@ -25,6 +25,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"math"
 	"sort"
 	"time"
@@ -42,13 +43,37 @@ const (
 	aggKindValue aggKind = iota
 	aggKindGauge
 	aggKindList
+	aggKindSet
 )
 
+// SetExactLimit is the number of distinct members of a set (per
+// flush) which are counted exactly. Beyond it the set is replaced by a
+// HyperLogLog estimate, which uses a constant 16K of memory but is
+// off by about 0.8% on average. Zero means always exact.
+var SetExactLimit = 10000
+
+// What to do with a negative value appended (CmdAppend), e.g. a statsd
+// timer, which is a duration and can only be negative because of a
+// clock adjustment.
+type NegativePolicy int
+
+const (
+	NegativeKeep  NegativePolicy = iota // append it as is
+	NegativeDrop                        // ignore it
+	NegativeClamp                       // append 0 instead
+)
+
+// NegativeAppend is the policy for all aggregators, whichever it is,
+// the negative values are counted, see Negatives().
+var NegativeAppend = NegativeKeep
+
 type aggregation struct {
 	ident serde.Ident
 	kind  aggKind
 	value float64
 	list  []float64
+	set   map[string]bool
+	hll   *hll
 }
 
 // The Aggregator keeps the intermediate state for all data that is
@@ -67,6 +92,7 @@ type State struct {
 	lastFlush  time.Time
 	Thresholds []int // List of percentiles for CmdAppend
 	AppendAttr string
+	negatives  int // negative values appended, see NegativeAppend
 }
 
 // Returns a new aggregator. The only argument needs to provide a
@@ -117,6 +143,15 @@ func (a *State) setGauge(ident serde.Ident, value float64) {
 // Append to values at key ident, created as aggKindList if not
 // existing.
 func (a *State) append(ident serde.Ident, value float64) {
+	if value < 0 {
+		a.negatives++
+		switch NegativeAppend {
+		case NegativeDrop:
+			return
+		case NegativeClamp:
+			value = 0
+		}
+	}
 	key := ident.String()
 	if a.m[key] == nil {
 		a.m[key] = &aggregation{ident: ident, kind: aggKindList, list: make([]float64, 0, 2)}
@@ -126,6 +161,32 @@ func (a *State) append(ident serde.Ident, value float64) {
 	}
 }
 
+// Add member to the set at key ident, created as aggKindSet if not
+// existing.
+func (a *State) addToSet(ident serde.Ident, member string) {
+	key := ident.String()
+	agg := a.m[key]
+	if agg == nil {
+		agg = &aggregation{ident: ident, kind: aggKindSet, set: make(map[string]bool)}
+		a.m[key] = agg
+	}
+	if agg.kind != aggKindSet {
+		return
+	}
+	if agg.hll != nil {
+		agg.hll.add(member)
+		return
+	}
+	agg.set[member] = true
+	if SetExactLimit > 0 && len(agg.set) > SetExactLimit {
+		agg.hll = newHll()
+		for m := range agg.set {
+			agg.hll.add(m)
+		}
+		agg.set = nil
+	}
+}
+
 func (a *State) ProcessCmd(cmd *Command) {
 	if !cmd.ts.IsZero() && cmd.ts.Before(a.lastFlush) {
 		return // this command is too old for this aggregator, ignore it
@@ -139,6 +200,8 @@ func (a *State) ProcessCmd(cmd *Command) {
 		a.setGauge(cmd.ident, cmd.value)
 	case CmdAppend:
 		a.append(cmd.ident, cmd.value)
+	case CmdAddToSet:
+		a.addToSet(cmd.ident, cmd.member)
 	}
 }
 
@@ -182,7 +245,10 @@ func (a *State) Flush(now time.Time) {
 
 				cumul := make([]float64, len(list))
 				for n, v := range list {
-					cumul[n] += v
+					cumul[n] = v
+					if n > 0 {
+						cumul[n] += cumul[n-1]
+					}
 				}
 
 				a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, ".lower"), now, list[0])
@@ -198,11 +264,23 @@ func (a *State) Flush(now time.Time) {
 				// TODO may be add "median" and "std"?
 				for _, threshold := range a.Thresholds {
 					idx := round(float64(threshold)/100*float64(len(list))) - 1
+					if idx < 0 {
+						idx = 0 // too few values, the lowest one
+					}
 					a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, fmt.Sprintf(".sum_%02d", threshold)), now, cumul[idx])
 					a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, fmt.Sprintf(".mean_%02d", threshold)), now, cumul[idx]/float64(idx+1))
 					a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, fmt.Sprintf(".upper_%02d", threshold)), now, list[idx])
 				}
 			}
+
+		case aggKindSet:
+			// count of distinct members, as is like a gauge (not
+			// .count, which [[consolidation]] rules may sum up)
+			count := float64(len(agg.set))
+			if agg.hll != nil {
+				count = agg.hll.count()
+			}
+			a.t.QueueDataPoint(appendIdent(agg.ident, a.AppendAttr, ".distinct"), now, count)
 		}
 	}
 
@@ -211,6 +289,14 @@ func (a *State) Flush(now time.Time) {
 	a.lastFlush = now
 }
 
+// Negatives returns the number of negative values appended since
+// the last call, whether they were kept, dropped or clamped.
+func (a *State) Negatives() int {
+	n := a.negatives
+	a.negatives = 0
+	return n
+}
+
 type AggCmd int
 
 const (
@@ -218,15 +304,18 @@ const (
 	CmdAddGauge               // Add the value, the flushed value is the sum as is (e.g. total traffic for all routers).
 	CmdSetGauge               // Overwrite the value, the flushed value is the last value as is.
 	CmdAppend                 // Append the value to a slice. The flushed values will be upper/lower/sum/mean and Threshold percentiles.
+	CmdAddToSet               // Add the member to a set. The flushed value is the count of distinct members, see SetExactLimit.
 )
 
-// An aggregator command. Use NewCommand() to create one.
+// An aggregator command. Use NewCommand() or NewSetCommand() to create
+// one.
 type Command struct {
-	cmd   AggCmd
-	ident serde.Ident
-	value float64
-	ts    time.Time
-	Hops  int // For cluster forwarding
+	cmd    AggCmd
+	ident  serde.Ident
+	value  float64
+	member string // CmdAddToSet only
+	ts     time.Time
+	Hops   int // For cluster forwarding
 }
 
 func (ac *Command) GobEncode() ([]byte, error) {
@@ -243,6 +332,7 @@ func (ac *Command) GobEncode() ([]byte, error) {
 	check(enc.Encode(ac.value))
 	check(enc.Encode(ac.ts))
 	check(enc.Encode(ac.Hops))
+	check(enc.Encode(ac.member))
 	if err != nil {
 		return nil, err
 	}
@@ -262,6 +352,12 @@ func (ac *Command) GobDecode(b []byte) error {
 	check(dec.Decode(&ac.value))
 	check(dec.Decode(&ac.ts))
 	check(dec.Decode(&ac.Hops))
+	if err == nil {
+		// not sent by nodes which predate sets
+		if er := dec.Decode(&ac.member); er != nil && er != io.EOF {
+			err = er
+		}
+	}
 	return err
 }
 
@@ -270,3 +366,8 @@ func (ac *Command) GobDecode(b []byte) error {
 func NewCommand(cmd AggCmd, ident serde.Ident, value float64) *Command {
 	return &Command{cmd: cmd, ident: ident, value: value, ts: time.Now()}
 }
+
+// Create a CmdAddToSet aggregator command.
+func NewSetCommand(ident serde.Ident, member string) *Command {
+	return &Command{cmd: CmdAddToSet, ident: ident, member: member, ts: time.Now()}
+}
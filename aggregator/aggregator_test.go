@@ -0,0 +1,181 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregator
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+type dpMap map[string]float64
+
+func (m dpMap) QueueDataPoint(ident serde.Ident, _ time.Time, v float64) {
+	m[ident["name"]] = v
+}
+
+func flushTimer(values ...float64) (dpMap, int) {
+	dps := make(dpMap)
+	a := NewAggregator(dps)
+	a.AppendAttr = "name"
+	a.Thresholds = []int{50, 90}
+	for _, v := range values {
+		a.ProcessCmd(NewCommand(CmdAppend, serde.Ident{"name": "t"}, v))
+	}
+	a.Flush(time.Now().Add(time.Second))
+	return dps, a.Negatives()
+}
+
+func Test_State_flushList(t *testing.T) {
+	dps, _ := flushTimer(0.5, 2.25, 0.125, 1.5, 3.75, 0.25, 1.125, 2.5, 0.75, 5.25)
+
+	// sorted: .125 .25 .5 .75 1.125 1.5 2.25 2.5 3.75 5.25
+	for name, exp := range map[string]float64{
+		"t.count":    10,
+		"t.lower":    0.125,
+		"t.upper":    5.25,
+		"t.sum":      18,
+		"t.mean":     1.8,
+		"t.sum_50":   2.75,
+		"t.mean_50":  0.55,
+		"t.upper_50": 1.125,
+		"t.sum_90":   12.75,
+		"t.mean_90":  12.75 / 9,
+		"t.upper_90": 3.75,
+	} {
+		if v, ok := dps[name]; !ok || math.Abs(v-exp) > 1e-9 {
+			t.Errorf("%s: expected %v, got %v (%v)", name, exp, v, ok)
+		}
+	}
+
+	// too few values for the 50th percentile, it's the lowest one
+	dps, _ = flushTimer(0.5)
+	if dps["t.upper_50"] != 0.5 || dps["t.sum_50"] != 0.5 {
+		t.Errorf("Expected the percentiles of a single value to be it, got %v", dps)
+	}
+}
+
+func Test_State_negativeAppend(t *testing.T) {
+	defer func() { NegativeAppend = NegativeKeep }()
+
+	for policy, exp := range map[NegativePolicy]struct{ count, lower, sum float64 }{
+		NegativeKeep:  {3, -1.5, 1},
+		NegativeDrop:  {2, 0.5, 2.5},
+		NegativeClamp: {3, 0, 2.5},
+	} {
+		NegativeAppend = policy
+		dps, negatives := flushTimer(0.5, -1.5, 2)
+		if negatives != 1 {
+			t.Errorf("policy %d: expected 1 negative, got %d", policy, negatives)
+		}
+		if dps["t.count"] != exp.count || dps["t.lower"] != exp.lower || dps["t.sum"] != exp.sum {
+			t.Errorf("policy %d: expected count %v, lower %v and sum %v, got %v", policy, exp.count, exp.lower, exp.sum, dps)
+		}
+	}
+}
+
+func flushSet(members ...string) dpMap {
+	dps := make(dpMap)
+	a := NewAggregator(dps)
+	a.AppendAttr = "name"
+	for _, m := range members {
+		a.ProcessCmd(NewSetCommand(serde.Ident{"name": "s"}, m))
+	}
+	a.Flush(time.Now().Add(time.Second))
+	return dps
+}
+
+func Test_State_flushSet(t *testing.T) {
+	defer func(limit int) { SetExactLimit = limit }(SetExactLimit)
+
+	dps := flushSet("a", "b", "a", "c", "b")
+	if len(dps) != 1 || dps["s.distinct"] != 3 {
+		t.Errorf("Expected 3 distinct members as s.distinct, got %v", dps)
+	}
+
+	// Beyond the limit the count is an estimate
+	SetExactLimit = 100
+	members := make([]string, 0, 5000)
+	for i := 0; i < 5000; i++ {
+		members = append(members, fmt.Sprintf("user%d", i%2500))
+	}
+	if v := flushSet(members...)["s.distinct"]; math.Abs(v-2500)/2500 > 0.03 {
+		t.Errorf("Expected about 2500 distinct members, got %v", v)
+	}
+}
+
+func Test_hll_count(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000, 1000000} {
+		h := newHll()
+		for i := 0; i < n; i++ {
+			h.add(fmt.Sprintf("user%d", i))
+			h.add(fmt.Sprintf("user%d", i)) // duplicates do not count
+		}
+		// a few standard errors (0.8%), and exact for small counts
+		if est := h.count(); math.Abs(est-float64(n)) > 0.03*float64(n) {
+			t.Errorf("%d distinct: estimated %v", n, est)
+		}
+	}
+}
+
+// The encoding of a Command by nodes which predate sets, without the
+// member.
+func gobEncodeOld(ac *Command) []byte {
+	buf := bytes.Buffer{}
+	enc := gob.NewEncoder(&buf)
+	enc.Encode(ac.cmd)
+	enc.Encode(ac.ident)
+	enc.Encode(ac.value)
+	enc.Encode(ac.ts)
+	enc.Encode(ac.Hops)
+	return buf.Bytes()
+}
+
+func Test_Command_gob(t *testing.T) {
+	cmd := NewSetCommand(serde.Ident{"name": "foo"}, "alice")
+	cmd.Hops = 2
+	b, err := cmd.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dec Command
+	if err := dec.GobDecode(b); err != nil {
+		t.Fatal(err)
+	}
+	if dec.cmd != CmdAddToSet || dec.ident["name"] != "foo" || dec.member != "alice" || dec.Hops != 2 || !dec.ts.Equal(cmd.ts) {
+		t.Errorf("Expected %+v, got %+v", cmd, dec)
+	}
+
+	// from an older node
+	old := NewCommand(CmdAdd, serde.Ident{"name": "bar"}, 1.5)
+	dec = Command{}
+	if err := dec.GobDecode(gobEncodeOld(old)); err != nil {
+		t.Fatal(err)
+	}
+	if dec.cmd != CmdAdd || dec.ident["name"] != "bar" || dec.value != 1.5 || dec.member != "" {
+		t.Errorf("Expected %+v, got %+v", old, dec)
+	}
+
+	// and a garbled one is an error
+	if err := dec.GobDecode(b[:len(b)-3]); err == nil {
+		t.Errorf("Expected an error decoding a truncated command")
+	}
+}
@@ -0,0 +1,82 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggregator
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// 2^14 registers, for a standard error of about 0.8%, in 16K of
+// memory regardless of the cardinality.
+const hllPrecision = 14
+
+// A HyperLogLog estimate of the number of distinct strings added to
+// it, see Flajolet et al, "HyperLogLog: the analysis of a
+// near-optimal cardinality estimation algorithm".
+type hll struct {
+	registers []uint8
+}
+
+func newHll() *hll {
+	return &hll{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hll) add(s string) {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := mix64(f.Sum64())
+
+	// The first hllPrecision bits are the register, the position of
+	// the first 1 bit in the rest is the value.
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(1)
+	for w := x << hllPrecision; w&(1<<63) == 0 && rank <= 64-hllPrecision; w <<= 1 {
+		rank++
+	}
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hll) count() float64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// linear counting is more accurate for small cardinalities
+		est = m * math.Log(m/float64(zeros))
+	}
+	return math.Floor(est + .5)
+}
+
+// FNV does not spread similar strings (e.g. user1, user2) well enough
+// over all the bits, this is the MurmurHash3 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -43,6 +43,7 @@ import (
 	"net"
 	"net/rpc"
 	"os"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -83,6 +84,7 @@ type Cluster struct {
 	rpc       net.Listener
 	joined    bool
 	ncache    map[*memberlist.Node]*Node
+	pins      []Pin
 }
 
 // NewCluster creates a new Cluster with reasonable defaults.
@@ -217,6 +219,77 @@ func selectNodes(nodes []*Node, id int64, n int) []*Node {
 	return result
 }
 
+// A Pin places the PinnableDistDatums whose PinName() matches Regexp
+// on the node named Node rather than where the id would put them,
+// e.g. to put a few busy ones on a bigger node. If that node is not
+// ready, they go where the id puts them, until it is (i.e. the next
+// Transition()). Every node must have the same pins, otherwise they
+// disagree about where the data belongs.
+type Pin struct {
+	Regexp *regexp.Regexp
+	Node   string
+}
+
+// A PinnableDistDatum is a DistDatum which pins apply to, this is
+// optional, a DistDatum may or may not implement it.
+type PinnableDistDatum interface {
+	DistDatum
+	// The name which the Pin Regexp is matched against.
+	PinName() string
+}
+
+// SetPins sets the pins, checked in order, the first one which
+// matches applies. They only affect the DistDatums loaded and the
+// transitions after, so they should be set before LoadDistData().
+func (c *Cluster) SetPins(pins []Pin) {
+	c.Lock()
+	defer c.Unlock()
+	c.pins = pins
+}
+
+// nodesFor is selectNodes for dd, with the pinned node, if any and
+// if it is among nodes, first and the other copies after it.
+func (c *Cluster) nodesFor(nodes []*Node, dd DistDatum) []*Node {
+	selected := selectNodes(nodes, dd.Id(), c.copies)
+	pinned := pinnedNode(c.pins, nodes, dd)
+	if pinned == nil {
+		return selected
+	}
+	result := make([]*Node, 0, len(selected))
+	result = append(result, pinned)
+	for _, node := range selected {
+		if len(result) == cap(result) {
+			break
+		}
+		if node != pinned {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// The node of the first of pins matching dd, or nil if none of them
+// does, dd is not a PinnableDistDatum or the node is not among nodes.
+func pinnedNode(pins []Pin, nodes []*Node, dd DistDatum) *Node {
+	pdd, ok := dd.(PinnableDistDatum)
+	if !ok || len(pins) == 0 {
+		return nil
+	}
+	name := pdd.PinName()
+	for _, pin := range pins {
+		if !pin.Regexp.MatchString(name) {
+			continue
+		}
+		for _, node := range nodes {
+			if node.Name() == pin.Node {
+				return node
+			}
+		}
+		return nil // the first match only
+	}
+	return nil
+}
+
 // LoadDistData will trigger a load of DistDatum's. Its argument is a
 // function which performs the actual load and returns the list, while
 // also providing the data to the application in whatever way is
@@ -243,7 +316,7 @@ func (c *Cluster) LoadDistData(f func() ([]DistDatum, error)) error {
 
 	for _, dd := range dds {
 		key := fmt.Sprintf("%s:%d", dd.Type(), dd.Id())
-		c.dds[key] = &ddEntry{dd: dd, nodes: selectNodes(readyNodes, dd.Id(), c.copies)}
+		c.dds[key] = &ddEntry{dd: dd, nodes: c.nodesFor(readyNodes, dd)}
 	}
 
 	return nil
@@ -697,7 +770,7 @@ func (c *Cluster) Transition(timeout time.Duration) error {
 			// "lead" responsible for saving the data. What happens
 			// with the rest is up to the userland to deal with.
 			var newNode, oldNode *Node
-			newNodes := selectNodes(readyNodes, dde.dd.Id(), c.copies)
+			newNodes := c.nodesFor(readyNodes, dde.dd)
 			if len(newNodes) > 0 {
 				newNode = newNodes[0]
 			}
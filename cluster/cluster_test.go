@@ -2,8 +2,12 @@ package cluster
 
 import (
 	"fmt"
+	"regexp"
 	"sync"
+	"testing"
 	"time"
+
+	"github.com/hashicorp/memberlist"
 )
 
 // This example joins a sole node cluster, and shows how to watch
@@ -48,3 +52,54 @@ func ExampleCluster_output() {
 
 	// Output: A cluster change occurred, running a transition.
 }
+
+type testDd struct {
+	id   int64
+	name string
+}
+
+func (d *testDd) Id() int64         { return d.id }
+func (d *testDd) Type() string      { return "test" }
+func (d *testDd) Relinquish() error { return nil }
+func (d *testDd) Acquire() error    { return nil }
+func (d *testDd) GetName() string   { return d.name }
+
+type testPinnableDd struct{ testDd }
+
+func (d *testPinnableDd) PinName() string { return d.name }
+
+func Test_Cluster_nodesFor(t *testing.T) {
+	nodes := []*Node{
+		&Node{Node: &memberlist.Node{Name: "a"}},
+		&Node{Node: &memberlist.Node{Name: "b"}},
+		&Node{Node: &memberlist.Node{Name: "c"}},
+	}
+	c := &Cluster{copies: 2}
+	c.SetPins([]Pin{
+		{Regexp: regexp.MustCompile(`^hot\.`), Node: "c"},
+		{Regexp: regexp.MustCompile(`^hot\.too`), Node: "a"}, // never, the first match wins
+		{Regexp: regexp.MustCompile(`^gone\.`), Node: "x"},
+	})
+	names := func(nodes []*Node) (s []string) {
+		for _, n := range nodes {
+			s = append(s, n.Name())
+		}
+		return s
+	}
+
+	for _, tc := range []struct {
+		dd  DistDatum
+		exp string
+	}{
+		{&testPinnableDd{testDd{0, "cold.foo"}}, "[a b]"},
+		{&testPinnableDd{testDd{0, "hot.foo"}}, "[c a]"},
+		{&testPinnableDd{testDd{1, "hot.too"}}, "[c b]"},
+		{&testPinnableDd{testDd{2, "hot.foo"}}, "[c a]"}, // c already selected
+		{&testPinnableDd{testDd{1, "gone.foo"}}, "[b c]"},
+		{&testDd{0, "hot.foo"}, "[a b]"}, // not pinnable
+	} {
+		if got := fmt.Sprint(names(c.nodesFor(nodes, tc.dd))); got != tc.exp {
+			t.Errorf("%s (id %d): expected %s, got %s", tc.dd.GetName(), tc.dd.Id(), tc.exp, got)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// import loads data points from CSV or newline-delimited JSON files
+// into the Tgres database, e.g. to backfill series from something
+// other than Graphite. Like whisper_import it talks to the database
+// directly and does not involve the Tgres daemon.
+//
+// Usage:
+//
+//   import -dbconnect <connect string> [-format csv|json] [-step 10s] [-spec ...] file ...
+//
+// A CSV line (an optional first line starting with "name" is a
+// header, lines starting with # are comments) is
+//
+//   name,timestamp,value
+//
+// and a JSON line
+//
+//   {"name": "foo.bar", "timestamp": 1500000000, "value": 1.5}
+//
+// Timestamps are unix seconds (with an optional fraction) or RFC3339,
+// a blank, NaN or null value is NaN. gzipped files are decompressed,
+// "-" (or no files) is stdin. The format, unless given, is json for
+// files ending with .json, .jsonl or .ndjson (and .gz) and csv
+// otherwise.
+//
+// All the points are read into memory first, then every series is
+// consolidated into its DS (created with -step and -spec if it does
+// not exist, an existing DS keeps its spec), and written to the
+// database -batch series at a time. Points do not have to be in
+// order, of several with the same timestamp the last one wins. As
+// with any DS, the first point of a series only marks its start, its
+// value is the rate up to the next one.
+//
+// Slots of an existing DS which are after the latest of the imported
+// data (the database is ahead of it) are not written, they would
+// overwrite the newest data with the oldest of the import. Such slots
+// are counted and reported.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/tgres/tgres/cmd/internal/vcache"
+	"github.com/tgres/tgres/daemon"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type Config struct {
+	dbConnect    string
+	format       string // csv, json or blank (by the file name)
+	specStr      string
+	step         time.Duration
+	heartbeat    time.Duration
+	dsSpec       *rrd.DSSpec
+	batch        int // series per vcache flush
+	segmentConns int // connections to flush the rows of one segment with
+	splitRows    int // only segments with more rows than this are split
+	stripes      int // flush segments in this many sorted stripes (0 = all at once)
+	width        int
+}
+
+func main() {
+
+	var cfg Config
+
+	flag.StringVar(&cfg.dbConnect, "dbconnect", "host=/var/run/postgresql dbname=tgres sslmode=disable", "db connect string")
+	flag.StringVar(&cfg.format, "format", "", "Input format, csv or json (Blank = by file extension)")
+	flag.StringVar(&cfg.specStr, "spec", "10s:6h,1m:24h,10m:93d,1d:5y:1", "Spec (config file format, comma-separated) to use for new DSs")
+	flag.DurationVar(&cfg.step, "step", 10*time.Second, "Step of new DSs, the points of a series are consolidated into slots of this size")
+	flag.DurationVar(&cfg.heartbeat, "hb", 2*time.Hour, "Heartbeat of new DSs, gaps between points longer than this are NaN")
+	flag.IntVar(&cfg.batch, "batch", serde.PgSegmentWidth, "Number of series to write to the database at a time")
+	flag.IntVar(&cfg.stripes, "flush-stripes", 0, "Flush the segments sorted by bundle and segment, in this many concurrent stripes of adjacent segments, for less lock contention in the database (0 = all at once, in random order)")
+	flag.IntVar(&cfg.segmentConns, "segment-conns", 1, "Number of concurrent db connections to flush the rows of a single segment with (1 = no splitting)")
+	flag.IntVar(&cfg.splitRows, "split-rows", 1000, "Only split the rows of segments with more rows than this across -segment-conns connections")
+	flag.IntVar(&cfg.width, "width", serde.PgSegmentWidth, "Segment width (experimental/advanced)")
+
+	flag.Parse()
+
+	if cfg.format != "" && cfg.format != "csv" && cfg.format != "json" {
+		fmt.Printf("-format must be csv or json\n")
+		os.Exit(2)
+	}
+
+	var err error
+	if cfg.dsSpec, err = specFromStr(cfg.specStr, cfg.step, cfg.heartbeat); err != nil {
+		fmt.Printf("Error parsing spec: %v\n", err)
+		os.Exit(2)
+	}
+
+	if cfg.batch < 1 || cfg.segmentConns < 1 {
+		fmt.Printf("-batch and -segment-conns must be at least 1\n")
+		os.Exit(2)
+	}
+
+	if cfg.width != serde.PgSegmentWidth {
+		fmt.Printf("Setting segment width to %d\n", cfg.width)
+		serde.PgSegmentWidth = cfg.width
+	}
+
+	paths := flag.Args()
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+
+	byName := make(map[string]points)
+	var total, bad int
+	for _, path := range paths {
+		n, b, err := readFile(path, cfg.format, byName)
+		if err != nil {
+			fmt.Printf("Error reading %v: %v\n", path, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Read %d points from %v (%d bad lines skipped).\n", n, path, b)
+		total, bad = total+n, bad+b
+	}
+	sortPoints(byName)
+
+	db, err := serde.InitDb(cfg.dbConnect, os.Getenv("TGRES_DB_PREFIX"))
+	if err != nil {
+		fmt.Printf("Error connecting to database: %v\n", err)
+		os.Exit(1)
+	}
+
+	written, sqlOps, dropped, failed := importAll(db, byName, &cfg)
+
+	fmt.Printf("DONE: %d points read (%d bad) across %d series, %d RRA points written in %d SQL ops.\n",
+		total, bad, len(byName), written, sqlOps)
+	if dropped > 0 {
+		fmt.Printf("WARNING: %d RRA points dropped for being after the latest of the imported data (the database is ahead).\n", dropped)
+	}
+	if failed > 0 {
+		fmt.Printf("ERROR: %d series could not be loaded or created.\n", failed)
+		os.Exit(1)
+	}
+}
+
+// importAll consolidates the points of every series into its DS and
+// writes them cfg.batch series at a time. Returns the RRA points
+// written, the SQL ops, the RRA points dropped for being in the
+// future and the number of series which failed.
+func importAll(db serde.SerDe, byName map[string]points, cfg *Config) (written, sqlOps, dropped, failed int) {
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for start := 0; start < len(names); start += cfg.batch {
+		end := start + cfg.batch
+		if end > len(names) {
+			end = len(names)
+		}
+
+		vc := vcache.New(start / cfg.batch)
+		vc.Stripes = cfg.stripes
+		for _, name := range names[start:end] {
+			if err := importSeries(db, vc, name, byName[name], cfg.dsSpec); err != nil {
+				fmt.Printf("Skipping %q: %v\n", name, err)
+				failed++
+			}
+		}
+		dropped += vc.FutureDropped()
+		p, so := vc.Flush(db.Flusher(), cfg.segmentConns, cfg.splitRows)
+		written, sqlOps = written+p, sqlOps+so
+	}
+	return written, sqlOps, dropped, failed
+}
+
+// importSeries processes the (sorted) points into the DS of name,
+// creating it with spec if necessary, and adds the result to vc.
+func importSeries(db serde.SerDe, vc *vcache.VerticalCache, name string, pts points, spec *rrd.DSSpec) error {
+
+	// NB: If the DS exists, spec is ignored
+	ds, err := db.Fetcher().FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+	if err != nil {
+		return err
+	}
+	dbds, ok := ds.(*serde.DbDataSource)
+	if !ok {
+		return fmt.Errorf("ds must be a *serde.DbDataSource")
+	}
+
+	// As in whisper_import, the DS and its RRAs are replaced with
+	// fresh copies without a last update or latest, so that points
+	// in the past can be processed, the original latests make sure
+	// that newer data in the database is not overwritten.
+	rras := dbds.RRAs()
+	latests := make([]time.Time, len(rras))
+	for i, rra := range rras {
+		latests[i] = rra.Latest()
+	}
+	oldDs := dbds.DataSourcer
+
+	newDs := rrd.NewDataSource(dbds.Spec())
+	for i, rra := range newDs.RRAs() {
+		rras[i].(*serde.DbRoundRobinArchive).RoundRobinArchiver = rra
+	}
+	dbds.DataSourcer = newDs
+	dbds.SetRRAs(rras)
+
+	for _, p := range pts {
+		if err := dbds.ProcessDataPoint(p.v, p.t); err != nil {
+			fmt.Printf("  %v: skipping point %v at %v: %v\n", name, p.v, p.t, err)
+		}
+	}
+
+	dbds.RollUp()
+
+	for i, rra := range dbds.RRAs() {
+		vc.UpdateDps(rra.(serde.DbRoundRobinArchiver), latests[i], time.Time{})
+	}
+	if dbds.Created() || dbds.LastUpdate().After(oldDs.LastUpdate()) {
+		vc.UpdateDss(dbds)
+	}
+	return nil
+}
+
+func specFromStr(text string, step, hb time.Duration) (*rrd.DSSpec, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("invalid step: %v", step)
+	}
+	spec := &rrd.DSSpec{
+		Step:      step,
+		Heartbeat: hb,
+	}
+	for _, part := range strings.Split(text, ",") {
+		r := &daemon.ConfigRRASpec{}
+		if err := r.UnmarshalText([]byte(part)); err != nil {
+			return nil, err
+		}
+		if r.Step%step != 0 {
+			return nil, fmt.Errorf("RRA step %v is not a multiple of -step %v", r.Step, step)
+		}
+		spec.RRAs = append(spec.RRAs, rrd.RRASpec{
+			Function: r.Function,
+			Step:     r.Step,
+			Span:     r.Span,
+			Xff:      float32(r.Xff),
+			RollUp:   r.RollUp,
+		})
+	}
+	return spec, nil
+}
@@ -0,0 +1,120 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_readPoints(t *testing.T) {
+	csv := `name,timestamp,value
+# a comment
+foo.bar,1500000000,1.5
+foo.bar, 1500000010.25, 2
+foo.baz,2017-07-14T02:40:00Z,
+foo.baz,yesterday,3
+,1500000000,1
+foo.bar,1500000020
+`
+	json := `{"name": "foo.bar", "timestamp": 1500000000, "value": 1.5}
+{"name": "foo.bar", "timestamp": "1500000010.25", "value": 2}
+{"name": "foo.baz", "timestamp": "2017-07-14T02:40:00Z", "value": null}
+{"name": "foo.baz", "timestamp": 1500000000, "value": "x"}
+`
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(csv))
+	w.Close()
+
+	for _, c := range []struct {
+		format, in string
+		bad        int
+	}{
+		{"csv", csv, 3},
+		{"csv", gz.String(), 3},
+		{"json", json, 1},
+	} {
+		byName := make(map[string]points)
+		n, bad, err := readPoints(strings.NewReader(c.in), c.format, byName)
+		if err != nil {
+			t.Fatalf("%s: %v", c.format, err)
+		}
+		if n != 3 || bad != c.bad {
+			t.Errorf("%s: expected 3 points and %d bad, got %d and %d", c.format, c.bad, n, bad)
+		}
+		foo := byName["foo.bar"]
+		if len(foo) != 2 || foo[0].v != 1.5 || !foo[1].t.Equal(time.Unix(1500000010, 250000000)) {
+			t.Errorf("%s: unexpected foo.bar points: %v", c.format, foo)
+		}
+		if baz := byName["foo.baz"]; len(baz) != 1 || !math.IsNaN(baz[0].v) || !baz[0].t.Equal(time.Unix(1500000000, 0)) {
+			t.Errorf("%s: unexpected foo.baz points: %v", c.format, baz)
+		}
+	}
+
+	if _, _, err := readPoints(strings.NewReader("{"), "json", make(map[string]points)); err == nil {
+		t.Errorf("Expected an error for invalid JSON")
+	}
+	if _, _, err := readPoints(strings.NewReader(""), "xml", make(map[string]points)); err == nil {
+		t.Errorf("Expected an error for an invalid format")
+	}
+}
+
+func Test_sortPoints(t *testing.T) {
+	byName := map[string]points{
+		"foo": {{time.Unix(30, 0), 3}, {time.Unix(10, 0), 1}, {time.Unix(20, 0), 2}, {time.Unix(10, 0), 4}},
+	}
+	sortPoints(byName)
+	foo := byName["foo"]
+	if len(foo) != 3 || foo[0].v != 4 || foo[1].v != 2 || foo[2].v != 3 {
+		t.Errorf("Expected sorted points without duplicates, the last one winning, got %v", foo)
+	}
+}
+
+func Test_formatFromPath(t *testing.T) {
+	for path, exp := range map[string]string{
+		"foo.csv":       "csv",
+		"foo.csv.gz":    "csv",
+		"foo":           "csv",
+		"-":             "csv",
+		"foo.json":      "json",
+		"foo.ndjson.gz": "json",
+	} {
+		if got := formatFromPath(path); got != exp {
+			t.Errorf("%s: expected %s, got %s", path, exp, got)
+		}
+	}
+}
+
+func Test_specFromStr(t *testing.T) {
+	spec, err := specFromStr("10s:6h,max:1m:24h", 10*time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Step != 10*time.Second || len(spec.RRAs) != 2 || spec.RRAs[1].Span != 24*time.Hour {
+		t.Errorf("Unexpected spec: %v", spec)
+	}
+	if _, err := specFromStr("15s:6h", 10*time.Second, time.Hour); err == nil {
+		t.Errorf("Expected an error for an RRA step which is not a multiple of the step")
+	}
+	if _, err := specFromStr("10s:6h", 0, time.Hour); err == nil {
+		t.Errorf("Expected an error for a zero step")
+	}
+}
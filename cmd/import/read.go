@@ -0,0 +1,213 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type point struct {
+	t time.Time
+	v float64
+}
+
+// The points of a series, sorted by time with sortPoints().
+type points []point
+
+func (p points) Len() int           { return len(p) }
+func (p points) Less(i, j int) bool { return p[i].t.Before(p[j].t) }
+func (p points) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// sortPoints sorts the points of every series, of several points
+// with the same timestamp only the last one read is kept.
+func sortPoints(byName map[string]points) {
+	for name, pts := range byName {
+		sort.Stable(pts)
+		j := 0
+		for i := range pts {
+			if j > 0 && pts[i].t.Equal(pts[j-1].t) {
+				pts[j-1] = pts[i]
+				continue
+			}
+			pts[j] = pts[i]
+			j++
+		}
+		byName[name] = pts[:j]
+	}
+}
+
+// The format of path, by its extension (ignoring .gz), csv unless
+// it is .json, .jsonl or .ndjson.
+func formatFromPath(path string) string {
+	path = strings.TrimSuffix(path, ".gz")
+	for _, ext := range []string{".json", ".jsonl", ".ndjson"} {
+		if strings.HasSuffix(path, ext) {
+			return "json"
+		}
+	}
+	return "csv"
+}
+
+// readFile reads the points in path ("-" is stdin) into byName.
+func readFile(path, format string, byName map[string]points) (n, bad int, err error) {
+	var f io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer file.Close()
+		f = file
+	}
+	if format == "" {
+		format = formatFromPath(path)
+	}
+	return readPoints(f, format, byName)
+}
+
+// readPoints reads the points in r, which can be gzipped, into
+// byName. Lines which cannot be parsed are reported and counted as
+// bad, an error is only returned if r cannot be read.
+func readPoints(r io.Reader, format string, byName map[string]points) (n, bad int, err error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	add := func(line int, name string, ts interface{}, value float64, err error) {
+		var t time.Time
+		if err == nil {
+			if name == "" {
+				err = fmt.Errorf("empty name")
+			} else {
+				t, err = parseTimestamp(ts)
+			}
+		}
+		if err != nil {
+			fmt.Printf("Skipping record %d: %v\n", line, err)
+			bad++
+			return
+		}
+		byName[name] = append(byName[name], point{t: t, v: value})
+		n++
+	}
+
+	switch format {
+	case "csv":
+		cr := csv.NewReader(br)
+		cr.Comment = '#'
+		cr.FieldsPerRecord = 3
+		cr.TrimLeadingSpace = true
+		for line := 1; ; line++ {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if perr, ok := err.(*csv.ParseError); ok {
+				fmt.Printf("Skipping line %d: %v\n", perr.Line, perr.Err)
+				bad++
+				continue
+			}
+			if err != nil {
+				return n, bad, err
+			}
+			if line == 1 && strings.ToLower(rec[0]) == "name" {
+				continue // header
+			}
+			value, err := parseValue(rec[2])
+			add(line, rec[0], rec[1], value, err)
+		}
+	case "json":
+		dec := json.NewDecoder(br)
+		dec.UseNumber()
+		for line := 1; ; line++ {
+			var rec struct {
+				Name      string
+				Timestamp interface{}
+				Value     *float64 // null means NaN
+			}
+			err := dec.Decode(&rec)
+			if err == io.EOF {
+				break
+			}
+			if _, ok := err.(*json.UnmarshalTypeError); err != nil && !ok {
+				// the decoder cannot continue past invalid JSON
+				return n, bad, fmt.Errorf("record %d: %v", line, err)
+			}
+			value := math.NaN()
+			if rec.Value != nil {
+				value = *rec.Value
+			}
+			add(line, rec.Name, rec.Timestamp, value, err)
+		}
+	default:
+		return 0, 0, fmt.Errorf("invalid format: %q (must be csv or json)", format)
+	}
+	return n, bad, nil
+}
+
+// A value, NaN, blank or null is NaN (unknown).
+func parseValue(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case "", "nan", "null":
+		return math.NaN(), nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value: %q", s)
+	}
+	return v, nil
+}
+
+// A timestamp is unix seconds (with an optional fraction), as a
+// string or a JSON number, or RFC3339.
+func parseTimestamp(ts interface{}) (time.Time, error) {
+	var s string
+	switch v := ts.(type) {
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp: %v", ts)
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		// rounded to the microsecond, a float64 is not precise
+		// enough for nanoseconds
+		return time.Unix(int64(sec), int64(math.Floor(frac*1e6+0.5))*1e3), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp: %q", s)
+}
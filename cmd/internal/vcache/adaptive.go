@@ -0,0 +1,79 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vcache
+
+import "time"
+
+// The limits of the number of segments flushed at the same time (in
+// a batch) by Flush() when not striped.
+const (
+	flushConcStart    = 64
+	flushConcMin      = 4
+	flushConcMax      = 256
+	flushConcIncrease = 8
+	// How many times the baseline latency is still "low".
+	flushLatencyTolerance = 2
+)
+
+// flushController picks the size of the next batch of segment
+// flushes AIMD-style (additive increase, multiplicative decrease, as
+// in TCP congestion control): while the mean latency of the row
+// flushes of a batch stays within flushLatencyTolerance of the
+// baseline, the next batch is flushConcIncrease larger, otherwise it
+// is half the size.
+//
+// The baseline is the lowest latency seen, but it creeps up towards
+// the latencies above it, so that a database which is slower for a
+// while (e.g. a checkpoint) doesn't keep the batches at the minimum
+// for the rest of the flush.
+type flushController struct {
+	limit    int
+	peak     int // the largest limit used
+	baseline time.Duration
+}
+
+func newFlushController() *flushController {
+	return &flushController{limit: flushConcStart, peak: flushConcStart}
+}
+
+// update adjusts the limit given the mean latency of the last batch,
+// 0 if it had no row flushes, and returns it.
+func (fc *flushController) update(latency time.Duration) int {
+	if latency <= 0 {
+		return fc.limit
+	}
+	if fc.baseline == 0 || latency < fc.baseline {
+		fc.baseline = latency
+	} else {
+		fc.baseline += (latency - fc.baseline) / 16
+	}
+
+	if latency <= fc.baseline*flushLatencyTolerance {
+		fc.limit += flushConcIncrease
+		if fc.limit > flushConcMax {
+			fc.limit = flushConcMax
+		}
+	} else {
+		fc.limit /= 2
+		if fc.limit < flushConcMin {
+			fc.limit = flushConcMin
+		}
+	}
+	if fc.limit > fc.peak {
+		fc.peak = fc.limit
+	}
+	return fc.limit
+}
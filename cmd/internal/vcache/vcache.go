@@ -0,0 +1,436 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vcache is the vertical cache of the import tools: data
+// points of many RRAs are collected by segment and slot, so that they
+// can be written to the database one row (rather than one data point)
+// at a time, after which the RRA and DS states are written.
+package vcache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type crossRRAPoints map[int64]float64
+
+type verticalCacheSegment struct {
+	*sync.Mutex
+	rows map[int64]crossRRAPoints
+	// The latest timestamp for RRAs, keyed by RRA.pos.
+	latests       map[int64]interface{} // rra.latest
+	maxLatest     time.Time
+	latestIndex   int64
+	step          time.Duration
+	size          int64
+	futureDropped int // slots after the latest of the data
+}
+
+// The update methods are safe for concurrent use, Flush() is not and
+// must only be called once all updates are done.
+type VerticalCache struct {
+	*sync.Mutex
+	Ts  int   // just some number for identification
+	Seg int64 // which segment this was for
+	// If not 0, Flush() sorts the segments by bundle and segment
+	// and writes them in this many goroutines, each a contiguous
+	// range, see flushStriped().
+	Stripes int
+	// What happens to the slots which already have a data point,
+	// ConflictSkip requires a serde.ConflictFlusher.
+	OnConflict serde.ConflictStrategy
+	dps        map[bundleKey]*verticalCacheSegment
+	dss        map[int64]map[int64]interface{}
+}
+
+// New returns an empty VerticalCache identified by ts in messages.
+func New(ts int) *VerticalCache {
+	return &VerticalCache{
+		Mutex: &sync.Mutex{},
+		Ts:    ts,
+		dps:   make(map[bundleKey]*verticalCacheSegment),
+		dss:   make(map[int64]map[int64]interface{}),
+	}
+}
+
+// FutureDropped returns the number of slots dropped for being after
+// the latest of the data, see UpdateDps().
+func (vc *VerticalCache) FutureDropped() int {
+	vc.Lock()
+	defer vc.Unlock()
+	n := 0
+	for _, segment := range vc.dps {
+		segment.Lock()
+		n += segment.futureDropped
+		segment.Unlock()
+	}
+	return n
+}
+
+type bundleKey struct {
+	bundleId, seg int64
+}
+
+// UpdateDps adds the data points of rra, whose latest in the
+// database is origLatest. Slots not after since (which can be zero)
+// are ignored, as are slots after the latest of rra, which are
+// counted in FutureDropped().
+func (vc *VerticalCache) UpdateDps(rra serde.DbRoundRobinArchiver, origLatest, since time.Time) {
+
+	seg, idx := rra.Seg(), rra.Idx()
+	key := bundleKey{rra.BundleId(), seg}
+
+	vc.Lock()
+	segment := vc.dps[key]
+	if segment == nil {
+		segment = &verticalCacheSegment{
+			Mutex:   &sync.Mutex{},
+			rows:    make(map[int64]crossRRAPoints),
+			latests: make(map[int64]interface{}),
+			step:    rra.Step(),
+			size:    rra.Size(),
+		}
+		vc.dps[key] = segment
+	}
+	vc.Unlock()
+
+	segment.Lock()
+	defer segment.Unlock()
+
+	latest := rra.Latest()
+
+	for i, v := range rra.DPs() {
+		// It is possible for the actual (i.e. what was in the
+		// database) latest to be ahead of us. If that is the case, we
+		// need to make sure not to update "future" slots by accident:
+		// such a slot holds the oldest data of ours (the round before
+		// our latest), writing it would overwrite the newest data in
+		// the database.
+		slotTime := rrd.SlotTime(i, origLatest, rra.Step(), rra.Size())
+		if !since.IsZero() && !slotTime.After(since) {
+			continue
+		}
+		if slotTime.After(latest) {
+			segment.futureDropped++
+			continue
+		}
+		if len(segment.rows[i]) == 0 {
+			segment.rows[i] = map[int64]float64{idx: v}
+		}
+		segment.rows[i][idx] = v
+	}
+
+	// Only update latests if our latest is later than actual latest
+	if latest.After(origLatest) {
+		if segment.maxLatest.Before(latest) {
+			segment.maxLatest = latest
+			segment.latestIndex = rrd.SlotIndex(latest, rra.Step(), rra.Size())
+		}
+		segment.latests[idx] = latest
+	} else {
+		segment.latests[idx] = origLatest
+	}
+
+}
+
+// UpdateDss adds the DS state (last update) of ds.
+func (vc *VerticalCache) UpdateDss(ds serde.DbDataSourcer) {
+
+	seg, idx := ds.Seg(), ds.Idx()
+
+	vc.Lock()
+	defer vc.Unlock()
+
+	segment := vc.dss[seg]
+	if segment == nil {
+		segment = make(map[int64]interface{})
+		vc.dss[seg] = segment
+	}
+
+	segment[idx] = ds.LastUpdate()
+}
+
+type vstats struct {
+	*sync.Mutex
+	pointCount, sqlOps int
+	// The total time spent in and the number of the row flushes, the
+	// mean latency of a batch is from their change, see
+	// latencySince().
+	flushTime time.Duration
+	flushes   int
+}
+
+// Returns the mean latency of the row flushes since the since
+// snapshot of st and a snapshot for the next time.
+func (st *vstats) latencySince(since vstats) (time.Duration, vstats) {
+	st.Lock()
+	defer st.Unlock()
+	now := vstats{flushTime: st.flushTime, flushes: st.flushes}
+	if n := now.flushes - since.flushes; n > 0 {
+		return (now.flushTime - since.flushTime) / time.Duration(n), now
+	}
+	return 0, now
+}
+
+// Flush writes everything to db and returns the number of data
+// points and SQL operations. The rows of a segment with more than
+// splitRows rows are flushed by conns goroutines (and thus database
+// connections) in parallel. Unless Stripes is set, the segments are
+// flushed in batches sized by the latency of the previous ones, see
+// flushController.
+func (vc *VerticalCache) Flush(db serde.Flusher, conns, splitRows int) (points, sqlOps int) {
+	var (
+		wg          sync.WaitGroup
+		st          = vstats{Mutex: &sync.Mutex{}}
+		concurrency string
+	)
+
+	if dropped := vc.FutureDropped(); dropped > 0 {
+		fmt.Printf("[db] [%v] WARNING: %d slots dropped for being after the latest of the data (the database is ahead).\n", vc.Ts, dropped)
+	}
+
+	if len(vc.dps) > 0 && vc.Stripes > 0 {
+		fmt.Printf("[db] [%v] Starting vcache flush (%d segments in %d stripes)...\n", vc.Ts, len(vc.dps), vc.Stripes)
+		vc.flushStriped(db, &st, conns, splitRows)
+		concurrency = fmt.Sprintf(" (%d stripes)", vc.Stripes)
+	} else if len(vc.dps) > 0 {
+		fmt.Printf("[db] [%v] Starting vcache flush (%d segments)...\n", vc.Ts, len(vc.dps))
+
+		fc := newFlushController()
+		n, vl := 0, len(vc.dps)
+		var snap vstats
+		for k, segment := range vc.dps {
+
+			wg.Add(1)
+			go flushSegment(db, &wg, &st, k, segment, vc.Ts, conns, splitRows, vc.OnConflict)
+			delete(vc.dps, k)
+			n++
+
+			if n >= fc.limit {
+				fmt.Printf("[db] [%v] ... ... waiting on %d of %d segment flushes ...\n", vc.Ts, n, vl)
+				wg.Wait()
+				var latency time.Duration
+				latency, snap = st.latencySince(snap)
+				fc.update(latency)
+				n = 0
+			}
+
+		}
+		fmt.Printf("[db] [%v] ... ... waiting on remaining %d segment flushes ...\n", vc.Ts, n)
+		wg.Wait() // final wait
+		concurrency = fmt.Sprintf(" (concurrency %d, peak %d, baseline row latency %v)", fc.limit, fc.peak, fc.baseline)
+	}
+
+	fmt.Printf("[db] [%v] Flushing %d DS states ...\n", vc.Ts, len(vc.dss))
+	for k, lu := range vc.dss {
+		ops, err := db.FlushDSStates(k, lu, nil, nil)
+		if err != nil {
+			fmt.Printf("[db] [%v] EROR flushing DS state: %v\n", vc.Ts, err)
+		}
+		st.sqlOps += ops
+	}
+	fmt.Printf("[db] [%v] Flushed %d DS states.\n", vc.Ts, len(vc.dss))
+
+	fmt.Printf("[db] [%v] Vcache flush complete, %d points in %d SQL ops%s.\n", vc.Ts, st.pointCount, st.sqlOps, concurrency)
+	st.Lock()
+	defer st.Unlock()
+	return st.pointCount, st.sqlOps
+}
+
+// Segments of adjacent bundles and segments have their rows next to
+// each other in the ts table (and its index), flushing them at the
+// same time from different connections makes those contend for the
+// same pages. This sorts the segments and splits them into
+// contiguous ranges, one per goroutine, which only meet at their
+// boundaries.
+func (vc *VerticalCache) flushStriped(db serde.Flusher, st *vstats, conns, splitRows int) {
+	keys := make([]bundleKey, 0, len(vc.dps))
+	for k := range vc.dps {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].bundleId != keys[j].bundleId {
+			return keys[i].bundleId < keys[j].bundleId
+		}
+		return keys[i].seg < keys[j].seg
+	})
+
+	stripes := vc.Stripes
+	if stripes > len(keys) {
+		stripes = len(keys)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(keys)) // flushSegment() is Done() with every one
+	for n := 0; n < stripes; n++ {
+		go func(keys []bundleKey) {
+			for _, k := range keys {
+				flushSegment(db, &wg, st, k, vc.dps[k], vc.Ts, conns, splitRows, vc.OnConflict)
+			}
+		}(keys[n*len(keys)/stripes : (n+1)*len(keys)/stripes])
+	}
+	wg.Wait()
+
+	for _, k := range keys {
+		delete(vc.dps, k)
+	}
+}
+
+func flushSegment(db serde.Flusher, wg *sync.WaitGroup, st *vstats, k bundleKey, segment *verticalCacheSegment, ts, conns, splitRows int, strategy serde.ConflictStrategy) {
+	defer wg.Done()
+
+	if len(segment.rows) == 0 {
+		return
+	}
+
+	fmt.Printf("[db] [%v] flushing %d rows for segment %v:%v...\n", ts, len(segment.rows), k.bundleId, k.seg)
+
+	// Build a map of latest i and version according to flushLatests
+	ivers := latestIVers(segment.latests, segment.step, segment.size)
+
+	is := make([]int64, 0, len(segment.rows))
+	for i := range segment.rows {
+		is = append(is, i)
+	}
+
+	// Every row is a separate UPDATE and the rows are independent of
+	// each other, so they can be written in any order and in
+	// parallel. Only the RRA state must wait until all of them are
+	// in, otherwise latest could refer to data that isn't there.
+	parts := 1
+	if conns > 1 && len(is) > splitRows {
+		parts = conns
+		fmt.Printf("[db] [%v] splitting the %d rows for segment %v:%v over %d connections...\n", ts, len(is), k.bundleId, k.seg, parts)
+	}
+
+	var (
+		pwg              sync.WaitGroup
+		mu               sync.Mutex
+		maxWidth, maxIdx int
+		failed           bool
+	)
+	for n := 0; n < parts; n++ {
+		pwg.Add(1)
+		go func(is []int64) {
+			defer pwg.Done()
+			width, idx, err := flushRows(db, st, k, segment.rows, is, ivers, strategy)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Printf("[db] [%v] Error flushing DP segment %v:%v: %v\n", ts, k.bundleId, k.seg, err)
+				failed = true
+			}
+			if width > maxWidth {
+				maxWidth = width
+			}
+			if idx > maxIdx {
+				maxIdx = idx
+			}
+		}(is[n*len(is)/parts : (n+1)*len(is)/parts])
+	}
+	pwg.Wait()
+	if failed {
+		return
+	}
+
+	if len(segment.latests) > 0 {
+		fmt.Printf("[db] [%v] flushing RRA state for segment %v:%v...\n", ts, k.bundleId, k.seg)
+		so, err := db.FlushRRAStates(k.bundleId, k.seg, segment.latests, nil, nil)
+		if err != nil {
+			fmt.Printf("[db] [%v] Error flushing RRA segment %v:%v: %v\n", ts, k.bundleId, k.seg, err)
+			return
+		}
+		st.Lock()
+		st.sqlOps += so
+		st.Unlock()
+	} else {
+		fmt.Printf("[db] [%v] no latests to flush for segment %v:%v...\n", ts, k.bundleId, k.seg)
+	}
+
+	fmt.Printf("[db] [%v] DONE     %d rows (%d wide, max idx: %d) for segment %v:%v...\n", ts, len(segment.rows), maxWidth, maxIdx, k.bundleId, k.seg)
+}
+
+// Flushes the rows is of a segment, returning the widest row and the
+// highest idx, stopping at the first error.
+func flushRows(db serde.Flusher, st *vstats, k bundleKey, rows map[int64]crossRRAPoints, is []int64, ivers map[int64]*iVer, strategy serde.ConflictStrategy) (maxWidth, maxIdx int, err error) {
+	flush := db.FlushDataPoints
+	if strategy != serde.ConflictOverwrite {
+		cf, ok := db.(serde.ConflictFlusher)
+		if !ok {
+			return 0, 0, fmt.Errorf("the flusher does not support the %v conflict strategy", strategy)
+		}
+		flush = func(bundleId, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+			return cf.FlushDataPointsConflict(bundleId, seg, i, dps, vers, strategy)
+		}
+	}
+	for _, i := range is {
+		row := rows[i]
+		idps, vers := dataPointsWithVersions(row, i, ivers)
+		start := time.Now()
+		so, err := flush(k.bundleId, k.seg, i, idps, vers)
+		if err != nil {
+			return maxWidth, maxIdx, err
+		}
+		st.Lock()
+		st.sqlOps += so
+		st.pointCount += len(row)
+		st.flushTime += time.Since(start)
+		st.flushes++
+		st.Unlock()
+
+		for j, _ := range row {
+			if int(j) > maxIdx {
+				maxIdx = int(j)
+			}
+		}
+		if len(row) > maxWidth {
+			maxWidth = len(row)
+		}
+	}
+	return maxWidth, maxIdx, nil
+}
+
+type iVer struct {
+	i   int64
+	ver int
+}
+
+func (iv *iVer) version(i int64) int {
+	return serde.SlotVersion(i, iv.i, iv.ver)
+}
+
+func latestIVers(latests map[int64]interface{}, step time.Duration, size int64) map[int64]*iVer {
+	result := make(map[int64]*iVer, len(latests))
+	for idx, ilatest := range latests {
+		i, ver := serde.LatestVersion(ilatest.(time.Time), step, size)
+		result[idx] = &iVer{i: i, ver: ver}
+	}
+	return result
+}
+
+func dataPointsWithVersions(in crossRRAPoints, i int64, ivs map[int64]*iVer) (dps, vers map[int64]interface{}) {
+	dps = make(map[int64]interface{}, len(in))
+	vers = make(map[int64]interface{}, len(in))
+	for idx, dp := range in {
+		dps[idx] = dp
+		vers[idx] = ivs[idx].version(i)
+	}
+	return dps, vers
+}
@@ -0,0 +1,514 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeDbRRA struct {
+	rrd.RoundRobinArchiver
+	bundleId, seg, idx int64
+}
+
+func (r *fakeDbRRA) Id() int64                { return r.idx }
+func (r *fakeDbRRA) Width() int64             { return 10 }
+func (r *fakeDbRRA) SlotRow(slot int64) int64 { return slot / 10 }
+func (r *fakeDbRRA) Seg() int64               { return r.seg }
+func (r *fakeDbRRA) Idx() int64               { return r.idx }
+func (r *fakeDbRRA) BundleId() int64          { return r.bundleId }
+
+func Test_verticalCache_concurrentUpdate(t *testing.T) {
+
+	vc := New(0)
+
+	latest := time.Unix(1000000, 0)
+	newRRA := func(bundleId, seg, idx int64) serde.DbRoundRobinArchiver {
+		dps := make(map[int64]float64)
+		for i := int64(0); i < 10; i++ {
+			dps[i] = float64(idx)
+		}
+		spec := rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 100 * time.Second, Latest: latest, DPs: dps}
+		return &fakeDbRRA{RoundRobinArchiver: rrd.NewRoundRobinArchive(spec), bundleId: bundleId, seg: seg, idx: idx}
+	}
+
+	// Several goroutines updating the same and different segments
+	var wg sync.WaitGroup
+	for g := int64(0); g < 8; g++ {
+		wg.Add(1)
+		go func(g int64) {
+			defer wg.Done()
+			for idx := int64(1); idx <= 50; idx++ {
+				vc.UpdateDps(newRRA(g%2, g%3, g*100+idx), time.Time{}, time.Time{})
+				vc.UpdateDss(serde.NewDbDataSource(idx, serde.Ident{"name": "foo"}, g%3, g*100+idx, rrd.NewDataSource(rrd.DSSpec{Step: 10 * time.Second})))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if len(vc.dps) != 6 {
+		t.Errorf("Expected 6 segments, got %d", len(vc.dps))
+	}
+	n := 0
+	for _, segment := range vc.dps {
+		for _, row := range segment.rows {
+			for idx, v := range row {
+				if v != float64(idx) {
+					t.Errorf("Unexpected value %v for idx %d", v, idx)
+				}
+			}
+			n += len(row)
+		}
+	}
+	if n != 8*50*10 {
+		t.Errorf("Expected %d points, got %d", 8*50*10, n)
+	}
+	m := 0
+	for _, segment := range vc.dss {
+		m += len(segment)
+	}
+	if m != 8*50 {
+		t.Errorf("Expected %d DS states, got %d", 8*50, m)
+	}
+}
+
+func Test_verticalCache_updateDpsSince(t *testing.T) {
+
+	vc := New(0)
+
+	latest := time.Unix(1000000, 0)
+	dps := make(map[int64]float64)
+	for i := int64(0); i < 10; i++ {
+		dps[i] = 1
+	}
+	spec := rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 100 * time.Second, Latest: latest, DPs: dps}
+	rra := &fakeDbRRA{RoundRobinArchiver: rrd.NewRoundRobinArchive(spec), idx: 1}
+
+	since := latest.Add(-50 * time.Second)
+	vc.UpdateDps(rra, latest, since)
+
+	segment := vc.dps[bundleKey{0, 0}]
+	if len(segment.rows) != 5 {
+		t.Errorf("Expected 5 slots after %v, got %d", since, len(segment.rows))
+	}
+	for i, _ := range segment.rows {
+		if st := rrd.SlotTime(i, latest, rra.Step(), rra.Size()); !st.After(since) {
+			t.Errorf("Slot %d (%v) is not after %v", i, st, since)
+		}
+	}
+}
+
+func Test_verticalCache_updateDpsFuture(t *testing.T) {
+
+	// The database is 20s ahead of the data, e.g. because of clock
+	// skew. The two slots after our latest hold the oldest data of
+	// ours, they must not overwrite the newest in the database.
+	latest := time.Unix(1000000, 0)
+	dps := make(map[int64]float64)
+	for i := int64(0); i < 10; i++ {
+		dps[i] = 1
+	}
+	spec := rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 100 * time.Second, Latest: latest, DPs: dps}
+	rra := &fakeDbRRA{RoundRobinArchiver: rrd.NewRoundRobinArchive(spec), idx: 1}
+	origLatest := latest.Add(20 * time.Second)
+
+	vc := New(0)
+	vc.UpdateDps(rra, origLatest, time.Time{})
+	rows := vc.dps[bundleKey{0, 0}].rows
+	if len(rows) != 8 || vc.FutureDropped() != 2 {
+		t.Errorf("expected 8 slots and 2 dropped, got %d and %d", len(rows), vc.FutureDropped())
+	}
+	for _, ahead := range []time.Time{origLatest, origLatest.Add(-10 * time.Second)} {
+		i := rrd.SlotIndex(ahead, rra.Step(), rra.Size())
+		if _, ok := rows[i]; ok {
+			t.Errorf("slot %d (%v) is after our latest %v and was written", i, ahead, latest)
+		}
+	}
+}
+
+// recordingFlusher remembers the rows flushed and whether the RRA
+// state came after all of them, failing row fail (if not -1).
+type recordingFlusher struct {
+	sync.Mutex
+	rows, concurrent, maxConcurrent int
+	stateAfterRows                  bool
+	fail                            int64
+}
+
+func (f *recordingFlusher) FlushDataPoints(bundleId, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	f.Lock()
+	f.concurrent++
+	if f.concurrent > f.maxConcurrent {
+		f.maxConcurrent = f.concurrent
+	}
+	f.Unlock()
+	time.Sleep(time.Millisecond) // let the others catch up
+	f.Lock()
+	defer f.Unlock()
+	f.concurrent--
+	if i == f.fail {
+		return 0, fmt.Errorf("row %d failed", i)
+	}
+	f.rows++
+	return 1, nil
+}
+
+func (f *recordingFlusher) FlushRRAStates(bundleId, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.stateAfterRows = f.rows == 20
+	return 1, nil
+}
+
+func (f *recordingFlusher) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error) {
+	return 0, nil
+}
+
+func Test_flushSegment_split(t *testing.T) {
+	latest := time.Unix(1000000, 0)
+	newSegment := func() *verticalCacheSegment {
+		segment := &verticalCacheSegment{
+			Mutex:   &sync.Mutex{},
+			rows:    make(map[int64]crossRRAPoints),
+			latests: map[int64]interface{}{1: latest},
+			step:    10 * time.Second,
+			size:    20,
+		}
+		for i := int64(0); i < 20; i++ {
+			segment.rows[i] = crossRRAPoints{1: float64(i)}
+		}
+		return segment
+	}
+
+	for _, c := range []struct {
+		conns, splitRows int
+		split            bool
+	}{
+		{1, 0, false},
+		{4, 100, false}, // too few rows to split
+		{4, 10, true},
+	} {
+		f := &recordingFlusher{fail: -1}
+		st := &vstats{Mutex: &sync.Mutex{}}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		flushSegment(f, &wg, st, bundleKey{1, 0}, newSegment(), 0, c.conns, c.splitRows, serde.ConflictOverwrite)
+
+		if f.rows != 20 || st.pointCount != 20 || st.sqlOps != 21 {
+			t.Errorf("%+v: expected 20 rows, 20 points and 21 SQL ops, got %d, %d, %d", c, f.rows, st.pointCount, st.sqlOps)
+		}
+		if !f.stateAfterRows {
+			t.Errorf("%+v: the RRA state must be flushed after all the rows", c)
+		}
+		if split := f.maxConcurrent > 1; split != c.split || f.maxConcurrent > c.conns {
+			t.Errorf("%+v: unexpected %d concurrent flushes", c, f.maxConcurrent)
+		}
+	}
+
+	// A failed row means the RRA state isn't flushed
+	f := &recordingFlusher{fail: 7}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	flushSegment(f, &wg, &vstats{Mutex: &sync.Mutex{}}, bundleKey{1, 0}, newSegment(), 0, 4, 10, serde.ConflictOverwrite)
+	if f.stateAfterRows || f.rows == 20 {
+		t.Errorf("Expected no RRA state after a failed row, got %d rows", f.rows)
+	}
+}
+
+// slotFlusher keeps the data points and versions by row and idx the
+// way the ts table does.
+type slotFlusher struct {
+	sync.Mutex
+	dps, vers map[int64]map[int64]interface{}
+}
+
+func (f *slotFlusher) FlushDataPoints(bundleId, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return f.FlushDataPointsConflict(bundleId, seg, i, dps, vers, serde.ConflictOverwrite)
+}
+
+func (f *slotFlusher) FlushDataPointsConflict(bundleId, seg, i int64, dps, vers map[int64]interface{}, strategy serde.ConflictStrategy) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.dps[i] == nil {
+		f.dps[i], f.vers[i] = make(map[int64]interface{}), make(map[int64]interface{})
+	}
+	for idx, dp := range dps {
+		if strategy == serde.ConflictSkip && f.dps[i][idx] != nil && f.vers[i][idx] == vers[idx] {
+			continue
+		}
+		f.dps[i][idx], f.vers[i][idx] = dp, vers[idx]
+	}
+	return 1, nil
+}
+
+func (f *slotFlusher) FlushRRAStates(bundleId, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return 1, nil
+}
+
+func (f *slotFlusher) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error) {
+	return 0, nil
+}
+
+func Test_flushSegment_conflict(t *testing.T) {
+	step, size := 10*time.Second, int64(20)
+	latest := time.Unix(1000000, 0)
+	ivers := latestIVers(map[int64]interface{}{1: latest}, step, size)
+
+	newSegment := func() *verticalCacheSegment {
+		segment := &verticalCacheSegment{
+			Mutex:   &sync.Mutex{},
+			rows:    make(map[int64]crossRRAPoints),
+			latests: map[int64]interface{}{1: latest},
+			step:    step,
+			size:    size,
+		}
+		for i := int64(0); i < 10; i++ {
+			segment.rows[i] = crossRRAPoints{1: float64(i)}
+		}
+		return segment
+	}
+
+	// Slots 0-3 have a data point, 4 has one from the previous round
+	// and 5 is NULL, the rest have never been written.
+	newFlusher := func() *slotFlusher {
+		f := &slotFlusher{dps: make(map[int64]map[int64]interface{}), vers: make(map[int64]map[int64]interface{})}
+		for i := int64(0); i < 6; i++ {
+			ver := ivers[1].version(i)
+			var dp interface{} = 100.0
+			if i == 4 {
+				ver = (ver + serde.MaxVersion) % (serde.MaxVersion + 1)
+			} else if i == 5 {
+				dp = nil
+			}
+			f.dps[i] = map[int64]interface{}{1: dp}
+			f.vers[i] = map[int64]interface{}{1: ver}
+		}
+		return f
+	}
+
+	for _, c := range []struct {
+		strategy serde.ConflictStrategy
+		kept     int64 // slots below this keep 100
+	}{
+		{serde.ConflictOverwrite, 0},
+		{serde.ConflictSkip, 4},
+	} {
+		f := newFlusher()
+		var wg sync.WaitGroup
+		wg.Add(1)
+		flushSegment(f, &wg, &vstats{Mutex: &sync.Mutex{}}, bundleKey{1, 0}, newSegment(), 0, 1, 0, c.strategy)
+		for i := int64(0); i < 10; i++ {
+			exp := float64(i)
+			if i < c.kept {
+				exp = 100
+			}
+			if dp := f.dps[i][1]; dp != exp || f.vers[i][1] != ivers[1].version(i) {
+				t.Errorf("%v: slot %d: expected %v (version %v), got %v (version %v)", c.strategy, i, exp, ivers[1].version(i), dp, f.vers[i][1])
+			}
+		}
+	}
+
+	// Skipping needs a ConflictFlusher
+	f := &recordingFlusher{fail: -1}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	flushSegment(f, &wg, &vstats{Mutex: &sync.Mutex{}}, bundleKey{1, 0}, newSegment(), 0, 1, 0, serde.ConflictSkip)
+	if f.rows != 0 || f.stateAfterRows {
+		t.Errorf("Expected nothing flushed without a ConflictFlusher, got %d rows", f.rows)
+	}
+}
+
+// pageFlusher simulates the ts table pages: the rows of pageSegs
+// adjacent segments of a bundle share a page, which only one write
+// can hold at a time. Writes which find their page held by another
+// are counted as conflicts, and wait.
+type pageFlusher struct {
+	sync.Mutex
+	pages     map[bundleKey]*sync.Mutex
+	busy      map[bundleKey]bool
+	rows      int
+	conflicts int
+	delay     time.Duration
+}
+
+const pageSegs = 4
+
+func newPageFlusher(delay time.Duration) *pageFlusher {
+	return &pageFlusher{pages: make(map[bundleKey]*sync.Mutex), busy: make(map[bundleKey]bool), delay: delay}
+}
+
+func (f *pageFlusher) FlushDataPoints(bundleId, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	key := bundleKey{bundleId, seg / pageSegs}
+	f.Lock()
+	page := f.pages[key]
+	if page == nil {
+		page = &sync.Mutex{}
+		f.pages[key] = page
+	}
+	if f.busy[key] {
+		f.conflicts++
+	}
+	f.Unlock()
+
+	page.Lock()
+	f.Lock()
+	f.busy[key] = true
+	f.Unlock()
+	time.Sleep(f.delay)
+	f.Lock()
+	f.busy[key] = false
+	f.rows++
+	f.Unlock()
+	page.Unlock()
+	return 1, nil
+}
+
+func (f *pageFlusher) FlushRRAStates(bundleId, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return 1, nil
+}
+
+func (f *pageFlusher) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error) {
+	return 0, nil
+}
+
+// A vcache of nSegs segments of bundle 1 with nRows rows each.
+func newSegmentsCache(nSegs, nRows int) *VerticalCache {
+	vc := New(0)
+	latest := time.Unix(1000000, 0)
+	for s := int64(0); s < int64(nSegs); s++ {
+		segment := &verticalCacheSegment{
+			Mutex:   &sync.Mutex{},
+			rows:    make(map[int64]crossRRAPoints),
+			latests: map[int64]interface{}{1: latest},
+			step:    10 * time.Second,
+			size:    int64(nRows),
+		}
+		for i := int64(0); i < int64(nRows); i++ {
+			segment.rows[i] = crossRRAPoints{1: float64(i)}
+		}
+		vc.dps[bundleKey{1, s}] = segment
+	}
+	return vc
+}
+
+func Test_VerticalCache_flushStriped(t *testing.T) {
+	vc := newSegmentsCache(16, 5)
+	vc.Stripes = 16 / pageSegs // every stripe is exactly one page
+	f := newPageFlusher(100 * time.Microsecond)
+	points, sqlOps := vc.Flush(f, 1, 1000)
+	if points != 16*5 || sqlOps != 16*5+16 || f.rows != 16*5 {
+		t.Errorf("Expected %d points and %d SQL ops, got %d and %d", 16*5, 16*5+16, points, sqlOps)
+	}
+	if f.conflicts != 0 {
+		t.Errorf("Expected no page conflicts between stripes, got %d", f.conflicts)
+	}
+	if len(vc.dps) != 0 {
+		t.Errorf("Expected all segments to be flushed, %d left", len(vc.dps))
+	}
+
+	// more stripes than segments
+	vc = newSegmentsCache(3, 5)
+	vc.Stripes = 8
+	if points, _ := vc.Flush(newPageFlusher(0), 1, 1000); points != 3*5 {
+		t.Errorf("Expected %d points, got %d", 3*5, points)
+	}
+}
+
+func Test_flushController(t *testing.T) {
+	fc := newFlushController()
+
+	// While the latency stays low, the limit grows up to the max
+	ms := time.Millisecond
+	if limit := fc.update(ms); limit != flushConcStart+flushConcIncrease {
+		t.Errorf("Expected %d, got %d", flushConcStart+flushConcIncrease, limit)
+	}
+	fc.update(0) // no row flushes
+	fc.update(flushLatencyTolerance * ms)
+	if fc.limit != flushConcStart+2*flushConcIncrease || fc.baseline <= ms {
+		t.Errorf("Expected %d and a baseline above the lowest latency, got %d, %v", flushConcStart+2*flushConcIncrease, fc.limit, fc.baseline)
+	}
+	for i := 0; i < flushConcMax; i++ {
+		fc.update(ms)
+	}
+	if fc.limit != flushConcMax || fc.peak != flushConcMax || fc.baseline != ms {
+		t.Errorf("Expected the max %d, got %d (peak %d, baseline %v)", flushConcMax, fc.limit, fc.peak, fc.baseline)
+	}
+
+	// When it climbs, the limit halves down to the min
+	if limit := fc.update(10 * ms); limit != flushConcMax/2 {
+		t.Errorf("Expected %d, got %d", flushConcMax/2, limit)
+	}
+	for i := 0; i < 5; i++ {
+		fc.update(10 * ms)
+	}
+	if fc.limit != flushConcMin || fc.peak != flushConcMax {
+		t.Errorf("Expected the min %d, got %d (peak %d)", flushConcMin, fc.limit, fc.peak)
+	}
+
+	// A database which stays slower becomes the new baseline
+	for i := 0; fc.limit == flushConcMin; i++ {
+		if i > 1000 {
+			t.Fatalf("Expected the limit to grow again, baseline: %v", fc.baseline)
+		}
+		fc.update(10 * ms)
+	}
+}
+
+func Test_VerticalCache_Flush(t *testing.T) {
+	vc := newSegmentsCache(flushConcStart*4, 2)
+	f := newPageFlusher(0)
+	points, sqlOps := vc.Flush(f, 1, 1000)
+	if n := flushConcStart * 4; points != n*2 || sqlOps != n*2+n || f.rows != n*2 {
+		t.Errorf("Expected %d points and %d SQL ops, got %d and %d", n*2, n*2+n, points, sqlOps)
+	}
+	if len(vc.dps) != 0 {
+		t.Errorf("Expected all segments to be flushed, %d left", len(vc.dps))
+	}
+}
+
+// Compares the random order flush (in batches, see flushController)
+// with the striped one at the same concurrency, against simulated
+// page contention (see pageFlusher), e.g.:
+//
+//   go test -run none -bench Benchmark_Flush ./cmd/internal/vcache
+func Benchmark_Flush(b *testing.B) {
+	const nSegs, nRows = 256, 4
+	for _, stripes := range []int{0, 64} {
+		name := "random"
+		if stripes > 0 {
+			name = fmt.Sprintf("striped=%d", stripes)
+		}
+		b.Run(name, func(b *testing.B) {
+			conflicts := 0
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				vc := newSegmentsCache(nSegs, nRows)
+				vc.Stripes = stripes
+				f := newPageFlusher(50 * time.Microsecond)
+				b.StartTimer()
+				vc.Flush(f, 1, 1000)
+				conflicts += f.conflicts
+			}
+			b.Logf("%d page conflicts per flush", conflicts/b.N)
+		})
+	}
+}
@@ -0,0 +1,281 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// tgres-admin is a collection of maintenance commands which operate
+// directly on the Tgres database, without the Tgres daemon.
+//
+// Usage:
+//
+//   tgres-admin [flags] <command>
+//
+// Commands:
+//
+//   repair-latests  recompute the latest of every RRA from the data
+//                   actually stored and rewrite it where it differs
+//   compact-bundles re-pack sparsely populated RRA bundles so that
+//                   their RRAs occupy as few segments as possible,
+//                   optionally changing the bundle width (-width)
+//   vacuum          report the dead tuples of the tables the data
+//                   points are written to and vacuum them, optionally
+//                   rebuilding their indexes (-reindex)
+//
+// The Tgres daemon should not be running while compact-bundles runs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type Config struct {
+	dbConnect string
+	dryRun    bool
+	width     int64
+	reindex   bool
+}
+
+var commands = map[string]func(*Config) error{
+	"repair-latests":  repairLatests,
+	"compact-bundles": compactBundles,
+	"vacuum":          vacuum,
+}
+
+func main() {
+
+	var cfg Config
+
+	flag.StringVar(&cfg.dbConnect, "dbconnect", "host=/var/run/postgresql dbname=tgres sslmode=disable", "db connect string")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "report what would be done, but do not change anything")
+	flag.Int64Var(&cfg.width, "width", 0, "compact-bundles: new segment width of every bundle (0 - keep the current width)")
+	flag.BoolVar(&cfg.reindex, "reindex", false, "vacuum: also rebuild the indexes (blocks writes to each table while it runs)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command>\n\nCommands:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  repair-latests\trecompute RRA latests from the stored data\n")
+		fmt.Fprintf(os.Stderr, "  compact-bundles\tre-pack sparse RRA bundles (Tgres must not be running)\n")
+		fmt.Fprintf(os.Stderr, "  vacuum\tvacuum the tables the data points are written to\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := cmd(&cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type latestRepairer interface {
+	FetchDataSources() ([]rrd.DataSourcer, error)
+	LatestFromData(rra serde.DbRoundRobinArchiver, now time.Time) (time.Time, error)
+	FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error)
+}
+
+type bundleSeg struct {
+	bundleId, seg int64
+}
+
+type rraStates struct {
+	latests, value, duration map[int64]interface{}
+}
+
+func repairLatests(cfg *Config) error {
+
+	db, err := serde.InitDb(cfg.dbConnect, os.Getenv("TGRES_DB_PREFIX"))
+	if err != nil {
+		return fmt.Errorf("Error connecting to database: %v", err)
+	}
+
+	return doRepairLatests(db, cfg.dryRun, time.Now())
+}
+
+func doRepairLatests(db latestRepairer, dryRun bool, now time.Time) error {
+
+	dss, err := db.FetchDataSources()
+	if err != nil {
+		return err
+	}
+
+	// Fixes are grouped by bundle and segment, which is how
+	// rra_state is stored.
+	fixes := make(map[bundleSeg]*rraStates)
+	var checked, fixed int
+
+	for _, ds := range dss {
+		dbds, ok := ds.(serde.DbDataSourcer)
+		if !ok {
+			continue
+		}
+		for _, rra := range ds.RRAs() {
+			dbrra, ok := rra.(serde.DbRoundRobinArchiver)
+			if !ok {
+				continue
+			}
+			checked++
+
+			latest, err := db.LatestFromData(dbrra, now)
+			if err != nil {
+				return fmt.Errorf("ds %d rra %d: %v", dbds.Id(), dbrra.Id(), err)
+			}
+			if latest.IsZero() || latest.Equal(rra.Latest()) {
+				continue
+			}
+
+			fmt.Printf("ds %d %v rra %d (step %v size %d): latest %v -> %v\n",
+				dbds.Id(), dbds.Ident(), dbrra.Id(), rra.Step(), rra.Size(), rra.Latest(), latest)
+			fixed++
+
+			key := bundleSeg{dbrra.BundleId(), dbrra.Seg()}
+			st := fixes[key]
+			if st == nil {
+				st = &rraStates{make(map[int64]interface{}), make(map[int64]interface{}), make(map[int64]interface{})}
+				fixes[key] = st
+			}
+			st.latests[dbrra.Idx()] = latest
+			st.value[dbrra.Idx()] = rra.Value()
+			st.duration[dbrra.Idx()] = rra.Duration().Nanoseconds() / 1e6
+		}
+	}
+
+	if !dryRun {
+		for key, st := range fixes {
+			if _, err := db.FlushRRAStates(key.bundleId, key.seg, st.latests, st.value, st.duration); err != nil {
+				return fmt.Errorf("Error saving RRA states (bundle %d seg %d): %v", key.bundleId, key.seg, err)
+			}
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("DONE (dry run): %d of %d RRAs would be repaired.\n", fixed, checked)
+	} else {
+		fmt.Printf("DONE: %d of %d RRAs repaired.\n", fixed, checked)
+	}
+	return nil
+}
+
+type bundleCompacter interface {
+	RRABundleUsage() ([]*serde.RRABundleUsage, error)
+	CompactRRABundle(bundleId, width int64) error
+}
+
+func compactBundles(cfg *Config) error {
+
+	if cfg.width < 0 {
+		return fmt.Errorf("Invalid width: %d", cfg.width)
+	}
+
+	db, err := serde.InitDb(cfg.dbConnect, os.Getenv("TGRES_DB_PREFIX"))
+	if err != nil {
+		return fmt.Errorf("Error connecting to database: %v", err)
+	}
+
+	return doCompactBundles(db, cfg.width, cfg.dryRun)
+}
+
+func doCompactBundles(db bundleCompacter, width int64, dryRun bool) error {
+
+	usage, err := db.RRABundleUsage()
+	if err != nil {
+		return err
+	}
+
+	var compacted int
+	for _, u := range usage {
+		w := width
+		if w == 0 {
+			w = u.Width
+		}
+		min := u.MinSegments(w)
+		if w == u.Width && u.Segments <= min {
+			continue // nothing to gain
+		}
+
+		fmt.Printf("bundle %d (step %dms size %d): %d RRAs in %d segments of %d -> %d segments of %d\n",
+			u.Id, u.StepMs, u.Size, u.RRAs, u.Segments, u.Width, min, w)
+		compacted++
+
+		if !dryRun {
+			if err := db.CompactRRABundle(u.Id, w); err != nil {
+				return fmt.Errorf("Error compacting bundle %d: %v", u.Id, err)
+			}
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("DONE (dry run): %d of %d bundles would be compacted.\n", compacted, len(usage))
+	} else {
+		fmt.Printf("DONE: %d of %d bundles compacted.\n", compacted, len(usage))
+	}
+	return nil
+}
+
+func vacuum(cfg *Config) error {
+
+	db, err := serde.InitDb(cfg.dbConnect, os.Getenv("TGRES_DB_PREFIX"))
+	if err != nil {
+		return fmt.Errorf("Error connecting to database: %v", err)
+	}
+
+	return doVacuum(db, cfg.reindex, cfg.dryRun)
+}
+
+func doVacuum(db serde.Vacuumer, reindex, dryRun bool) error {
+
+	report := func() error {
+		stats, err := db.TableStats()
+		if err != nil {
+			return err
+		}
+		for _, st := range stats {
+			fmt.Printf("table %s: %d live, %d dead tuples (%.1f%%), last vacuum %v, last autovacuum %v\n",
+				st.Name, st.LiveTuples, st.DeadTuples, st.DeadRatio()*100, st.LastVacuum, st.LastAutoVacuum)
+		}
+		return nil
+	}
+
+	if err := report(); err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Printf("DONE (dry run): nothing vacuumed.\n")
+		return nil
+	}
+
+	start := time.Now()
+	if err := db.VacuumTables(reindex); err != nil {
+		return err
+	}
+	if err := report(); err != nil {
+		return err
+	}
+	fmt.Printf("DONE: vacuumed in %v.\n", time.Since(start))
+	return nil
+}
@@ -0,0 +1,156 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type fakeRRA struct {
+	rrd.RoundRobinArchiver
+	id, bundleId, seg, idx int64
+}
+
+func (r *fakeRRA) Id() int64                { return r.id }
+func (r *fakeRRA) Width() int64             { return 200 }
+func (r *fakeRRA) SlotRow(slot int64) int64 { return slot }
+func (r *fakeRRA) Seg() int64               { return r.seg }
+func (r *fakeRRA) Idx() int64               { return r.idx }
+func (r *fakeRRA) BundleId() int64          { return r.bundleId }
+
+type fakeRepairer struct {
+	dss     []rrd.DataSourcer
+	latests map[int64]time.Time // from the data, by RRA id
+	flushed map[[2]int64]map[int64]interface{}
+	fail    bool
+}
+
+func (f *fakeRepairer) FetchDataSources() ([]rrd.DataSourcer, error) {
+	return f.dss, nil
+}
+
+func (f *fakeRepairer) LatestFromData(rra serde.DbRoundRobinArchiver, now time.Time) (time.Time, error) {
+	if f.fail {
+		return time.Time{}, fmt.Errorf("failed")
+	}
+	return f.latests[rra.Id()], nil
+}
+
+func (f *fakeRepairer) FlushRRAStates(bundleId, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	f.flushed[[2]int64{bundleId, seg}] = latests
+	return 1, nil
+}
+
+func Test_doRepairLatests(t *testing.T) {
+	stored := time.Unix(1500000000, 0)
+	behind, ahead := stored.Add(-time.Minute), stored.Add(time.Minute)
+
+	// RRA 1 is fine, 2 and 3 (same segment) and 4 differ from the
+	// data, 5 has no data at all.
+	rra := func(id, bundleId, seg, idx int64) rrd.RoundRobinArchiver {
+		spec := rrd.RRASpec{Step: time.Minute, Span: time.Hour, Latest: stored}
+		return &fakeRRA{rrd.NewRoundRobinArchive(spec), id, bundleId, seg, idx}
+	}
+	ds := func(id int64, rras ...rrd.RoundRobinArchiver) rrd.DataSourcer {
+		ds := rrd.NewDataSource(rrd.DSSpec{Step: time.Minute, Heartbeat: time.Hour})
+		ds.SetRRAs(rras)
+		return serde.NewDbDataSource(id, serde.Ident{"name": fmt.Sprintf("ds%d", id)}, 0, 0, ds)
+	}
+	dss := []rrd.DataSourcer{
+		ds(1, rra(1, 1, 0, 1), rra(2, 1, 0, 2)),
+		ds(2, rra(3, 1, 0, 3), rra(4, 1, 1, 1), rra(5, 2, 0, 1)),
+	}
+	latests := map[int64]time.Time{1: stored, 2: behind, 3: ahead, 4: behind}
+
+	db := &fakeRepairer{dss: dss, latests: latests, flushed: make(map[[2]int64]map[int64]interface{})}
+	if err := doRepairLatests(db, true, ahead); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.flushed) != 0 {
+		t.Errorf("Expected nothing flushed in a dry run, got %v", db.flushed)
+	}
+
+	if err := doRepairLatests(db, false, ahead); err != nil {
+		t.Fatal(err)
+	}
+	exp := map[[2]int64]map[int64]interface{}{
+		{1, 0}: {2: behind, 3: ahead},
+		{1, 1}: {1: behind},
+	}
+	if !reflect.DeepEqual(db.flushed, exp) {
+		t.Errorf("Expected the latests of RRAs 2, 3 and 4 by segment %v, got %v", exp, db.flushed)
+	}
+
+	db.fail = true
+	if err := doRepairLatests(db, false, ahead); err == nil {
+		t.Errorf("Expected an error from LatestFromData")
+	}
+}
+
+type fakeCompacter struct {
+	usage     []*serde.RRABundleUsage
+	compacted [][2]int64 // bundle id, width
+	fail      bool
+}
+
+func (f *fakeCompacter) RRABundleUsage() ([]*serde.RRABundleUsage, error) {
+	return f.usage, nil
+}
+
+func (f *fakeCompacter) CompactRRABundle(bundleId, width int64) error {
+	if f.fail {
+		return fmt.Errorf("failed")
+	}
+	f.compacted = append(f.compacted, [2]int64{bundleId, width})
+	return nil
+}
+
+func Test_doCompactBundles(t *testing.T) {
+	usage := []*serde.RRABundleUsage{
+		{Id: 1, StepMs: 60000, Size: 1440, Width: 200, RRAs: 300, Segments: 2}, // as compact as it gets
+		{Id: 2, StepMs: 60000, Size: 1440, Width: 200, RRAs: 300, Segments: 5}, // sparse
+		{Id: 3, StepMs: 3600000, Size: 720, Width: 100, RRAs: 0, Segments: 0},  // empty
+	}
+
+	for _, c := range []struct {
+		width     int64
+		dryRun    bool
+		compacted [][2]int64
+	}{
+		{0, false, [][2]int64{{2, 200}}},             // sparse only, at their width
+		{0, true, nil},                               // nothing done
+		{200, false, [][2]int64{{2, 200}, {3, 200}}}, // and the width of 3 changes
+		{400, false, [][2]int64{{1, 400}, {2, 400}, {3, 400}}},
+	} {
+		db := &fakeCompacter{usage: usage}
+		if err := doCompactBundles(db, c.width, c.dryRun); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(db.compacted, c.compacted) {
+			t.Errorf("width %d dry run %v: expected %v compacted, got %v", c.width, c.dryRun, c.compacted, db.compacted)
+		}
+	}
+
+	if err := doCompactBundles(&fakeCompacter{usage: usage, fail: true}, 0, false); err == nil {
+		t.Errorf("Expected an error from CompactRRABundle")
+	}
+}
@@ -0,0 +1,166 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// tgres-diff compares the series of two Tgres databases, e.g. to
+// verify that a migration is complete.
+//
+// Usage:
+//
+//   tgres-diff -a <connect string> -b <connect string> [-latest [-tolerance 1m]]
+//
+// Every series present in only one of the two is printed as
+//
+//   < ident      (only in a)
+//   > ident      (only in b)
+//
+// and with -latest every series present in both whose last update
+// differs by more than -tolerance as
+//
+//   ~ ident a_last_update b_last_update
+//
+// followed by a summary line with the number of series in each and
+// of differences. Like diff, it exits with 1 if there are differences
+// and 0 if there are none.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type Config struct {
+	aConnect, bConnect string
+	aPrefix, bPrefix   string
+	latest             bool
+	tolerance          time.Duration
+}
+
+func main() {
+
+	var cfg Config
+
+	flag.StringVar(&cfg.aConnect, "a", "", "db connect string of the first database")
+	flag.StringVar(&cfg.bConnect, "b", "", "db connect string of the second database")
+	flag.StringVar(&cfg.aPrefix, "a-prefix", os.Getenv("TGRES_DB_PREFIX"), "table prefix of the first database")
+	flag.StringVar(&cfg.bPrefix, "b-prefix", os.Getenv("TGRES_DB_PREFIX"), "table prefix of the second database")
+	flag.BoolVar(&cfg.latest, "latest", false, "also compare the last update of series present in both")
+	flag.DurationVar(&cfg.tolerance, "tolerance", 0, "with -latest, ignore last update differences up to this much")
+
+	flag.Parse()
+
+	if cfg.aConnect == "" || cfg.bConnect == "" {
+		fmt.Fprintf(os.Stderr, "Both -a and -b are required.\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	serde.PgMigrate = false // read only, never create or migrate a schema
+	a, err := serde.InitDb(cfg.aConnect, cfg.aPrefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to database a: %v\n", err)
+		os.Exit(2)
+	}
+	b, err := serde.InitDb(cfg.bConnect, cfg.bPrefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to database b: %v\n", err)
+		os.Exit(2)
+	}
+
+	n, err := diff(os.Stdout, a, b, cfg.latest, cfg.tolerance)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if n > 0 {
+		os.Exit(1)
+	}
+}
+
+type dsFetcher interface {
+	FetchDataSources() ([]rrd.DataSourcer, error)
+}
+
+// Returns all the DSs keyed by the string of their ident.
+func catalog(db dsFetcher) (map[string]rrd.DataSourcer, error) {
+	dss, err := db.FetchDataSources()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]rrd.DataSourcer, len(dss))
+	for _, ds := range dss {
+		if dbds, ok := ds.(serde.DbDataSourcer); ok {
+			result[dbds.Ident().String()] = ds
+		}
+	}
+	return result, nil
+}
+
+// Writes the differences between a and b to w in ident order,
+// followed by a summary line, and returns their number.
+func diff(w io.Writer, a, b dsFetcher, latest bool, tolerance time.Duration) (int, error) {
+
+	aDss, err := catalog(a)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading database a: %v", err)
+	}
+	bDss, err := catalog(b)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading database b: %v", err)
+	}
+
+	idents := make([]string, 0, len(aDss)+len(bDss))
+	for ident := range aDss {
+		idents = append(idents, ident)
+	}
+	for ident := range bDss {
+		if _, ok := aDss[ident]; !ok {
+			idents = append(idents, ident)
+		}
+	}
+	sort.Strings(idents)
+
+	var n int
+	for _, ident := range idents {
+		ads, bds := aDss[ident], bDss[ident]
+		switch {
+		case bds == nil:
+			fmt.Fprintf(w, "< %s\n", ident)
+		case ads == nil:
+			fmt.Fprintf(w, "> %s\n", ident)
+		case latest:
+			d := ads.LastUpdate().Sub(bds.LastUpdate())
+			if d < 0 {
+				d = -d
+			}
+			if d <= tolerance {
+				continue
+			}
+			fmt.Fprintf(w, "~ %s %v %v\n", ident, ads.LastUpdate().UTC().Format(time.RFC3339), bds.LastUpdate().UTC().Format(time.RFC3339))
+		default:
+			continue
+		}
+		n++
+	}
+
+	fmt.Fprintf(w, "%d series in a, %d in b, %d differences.\n", len(aDss), len(bDss), n)
+	return n, nil
+}
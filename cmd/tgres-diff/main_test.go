@@ -0,0 +1,68 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_diff(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	db := func(lastUpdates map[string]time.Time) dsFetcher {
+		m := serde.NewMemSerDe()
+		for name, lu := range lastUpdates {
+			spec := &rrd.DSSpec{Step: time.Minute, LastUpdate: lu}
+			if _, err := m.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return m
+	}
+	a := db(map[string]time.Time{"both": when, "late": when, "close": when, "only.a": when})
+	b := db(map[string]time.Time{"both": when, "late": when.Add(-time.Hour), "close": when.Add(-time.Second), "only.b": when})
+
+	for _, c := range []struct {
+		latest bool
+		expect string
+	}{
+		{false, `< {"name": "only.a"}
+> {"name": "only.b"}
+4 series in a, 4 in b, 2 differences.
+`},
+		{true, `~ {"name": "late"} 2017-07-14T02:40:00Z 2017-07-14T01:40:00Z
+< {"name": "only.a"}
+> {"name": "only.b"}
+4 series in a, 4 in b, 3 differences.
+`},
+	} {
+		var buf bytes.Buffer
+		n, err := diff(&buf, a, b, c.latest, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != c.expect {
+			t.Errorf("latest=%v: expected:\n%s\ngot:\n%s", c.latest, c.expect, buf.String())
+		}
+		if expect := bytes.Count([]byte(c.expect), []byte("\n")) - 1; n != expect {
+			t.Errorf("latest=%v: expected %d differences, got %d", c.latest, expect, n)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// tgres-export-parquet exports the series whose names match a
+// Graphite pattern to a Parquet file, for analysis with e.g. Spark or
+// DuckDB.
+//
+// Usage:
+//
+//   tgres-export-parquet -name 'servers.*.cpu.{user,system}' -from 7d [-to 1d] -o cpu.parquet
+//
+// -from and -to are either RFC3339 or how long before now. The rows
+// are
+//
+//   timestamp  TIMESTAMP_MILLIS  the end of the slot
+//   name       UTF8              the name of the series
+//   step       INT64             the step of the series, in seconds
+//   value      DOUBLE
+//
+// of every slot of each series in turn, of the highest resolution
+// RRA covering the range (series without one, or whose step is not a
+// whole number of seconds, are skipped), empty (NaN) slots are not
+// exported unless -nan. The series are read from the database one at
+// a time and the rows are written a row group (-row-group) at a time,
+// so that large ranges do not need much memory. The pattern and range are in the
+// file metadata as tgres.name, tgres.from and tgres.to.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/serde"
+)
+
+type Config struct {
+	dbConnect string
+	name      string
+	from, to  string
+	output    string
+	rowGroup  int
+	nan       bool
+}
+
+func main() {
+
+	var cfg Config
+
+	flag.StringVar(&cfg.dbConnect, "dbconnect", "host=/var/run/postgresql dbname=tgres sslmode=disable", "db connect string")
+	flag.StringVar(&cfg.name, "name", "", "Graphite pattern of the names of the series to export")
+	flag.StringVar(&cfg.from, "from", "24h", "start of the range, RFC3339 or how long before now")
+	flag.StringVar(&cfg.to, "to", "0s", "end of the range, RFC3339 or how long before now")
+	flag.StringVar(&cfg.output, "o", "", "output file (- for stdout)")
+	flag.IntVar(&cfg.rowGroup, "row-group", 100000, "number of rows per Parquet row group, which are kept in memory")
+	flag.BoolVar(&cfg.nan, "nan", false, "also export empty (NaN) slots")
+
+	flag.Parse()
+
+	if cfg.name == "" || cfg.output == "" || cfg.rowGroup < 1 {
+		fmt.Fprintf(os.Stderr, "-name and -o are required.\n")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	now := time.Now()
+	from, err := parseTime(cfg.from, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -from: %v\n", err)
+		os.Exit(2)
+	}
+	to, err := parseTime(cfg.to, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -to: %v\n", err)
+		os.Exit(2)
+	}
+	if !from.Before(to) {
+		fmt.Fprintf(os.Stderr, "-from must be before -to.\n")
+		os.Exit(2)
+	}
+
+	serde.PgMigrate = false // read only, never create or migrate a schema
+	db, err := serde.InitDb(cfg.dbConnect, os.Getenv("TGRES_DB_PREFIX"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to database: %v\n", err)
+		os.Exit(2)
+	}
+
+	out := os.Stdout
+	if cfg.output != "-" {
+		if out, err = os.Create(cfg.output); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	w := bufio.NewWriter(out)
+	nSeries, nRows, err := export(w, os.Stderr, db.Fetcher(), cfg.name, from, to, cfg.rowGroup, cfg.nan)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d rows of %d series from %v to %v.\n", nRows, nSeries, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339))
+}
+
+// Parses s as RFC3339 or as a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := misc.BetterParseDuration(strings.TrimPrefix(s, "-"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC3339 nor a duration", s)
+	}
+	return now.Add(-d), nil
+}
+
+// Translates a Graphite pattern (*, ?, [...] and {a,b}, not crossing
+// dots) to an anchored regular expression.
+func patternRegexp(pattern string) (*regexp.Regexp, error) {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	inBraces := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			buf.WriteString("[^.]*")
+		case '?':
+			buf.WriteString("[^.]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated [ in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if len(class) > 0 && class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		case '{':
+			if inBraces {
+				return nil, fmt.Errorf("nested { in %q", pattern)
+			}
+			inBraces = true
+			buf.WriteString("(?:")
+		case '}':
+			if !inBraces {
+				return nil, fmt.Errorf("unexpected } in %q", pattern)
+			}
+			inBraces = false
+			buf.WriteString(")")
+		case ',':
+			if inBraces {
+				buf.WriteString("|")
+			} else {
+				buf.WriteString(",")
+			}
+		default:
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	if inBraces {
+		return nil, fmt.Errorf("unterminated { in %q", pattern)
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+// Writes the slots between from and to of the series whose names
+// match pattern to w as Parquet, in name order, and returns the
+// number of series and rows. The series skipped are reported to
+// logw.
+func export(w, logw io.Writer, db serde.Fetcher, pattern string, from, to time.Time, rowGroup int, nan bool) (nSeries, nRows int, err error) {
+
+	re, err := patternRegexp(pattern)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The db may return more than what matches, or ignore the query.
+	sr, err := db.Search(serde.SearchQuery{"name": re.String()})
+	if err != nil {
+		return 0, 0, err
+	}
+	idents := make(map[string]serde.Ident)
+	for sr.Next() {
+		if ident := sr.Ident(); re.MatchString(ident["name"]) {
+			idents[ident["name"]] = ident
+		}
+	}
+	sr.Close()
+
+	names := make([]string, 0, len(idents))
+	for name := range idents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pw, err := newParquetWriter(w, rowGroup,
+		parquetColumn{"timestamp", parquetTimestampMillis},
+		parquetColumn{"name", parquetString},
+		parquetColumn{"step", parquetInt64},
+		parquetColumn{"value", parquetDouble},
+	)
+	if err != nil {
+		return 0, 0, err
+	}
+	pw.setMetadata("tgres.name", pattern)
+	pw.setMetadata("tgres.from", from.UTC().Format(time.RFC3339))
+	pw.setMetadata("tgres.to", to.UTC().Format(time.RFC3339))
+
+	for _, name := range names {
+		ds, err := db.FetchOrCreateDataSource(idents[name], nil)
+		if err != nil {
+			return nSeries, nRows, fmt.Errorf("Error fetching %q: %v", name, err)
+		}
+		s, err := db.FetchSeries(ds, from, to, 0)
+		if err != nil {
+			fmt.Fprintf(logw, "Skipping %q: %v\n", name, err)
+			continue
+		}
+		if s.Step()%time.Second != 0 {
+			// the step column is in seconds
+			fmt.Fprintf(logw, "Skipping %q: its step of %v is not a whole number of seconds\n", name, s.Step())
+			s.Close()
+			continue
+		}
+		step := int64(s.Step() / time.Second)
+		for s.Next() {
+			v := s.CurrentValue()
+			if math.IsNaN(v) && !nan {
+				continue
+			}
+			ms := s.CurrentTime().UnixNano() / int64(time.Millisecond)
+			if err := pw.writeRow(ms, name, step, v); err != nil {
+				s.Close()
+				return nSeries, nRows, err
+			}
+			nRows++
+		}
+		s.Close()
+		nSeries++
+	}
+
+	return nSeries, nRows, pw.Close()
+}
@@ -0,0 +1,244 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// thriftReader decodes the Thrift compact protocol into maps of
+// field id to int64, string, []interface{} or (structs) thriftFields.
+type thriftReader struct {
+	*bytes.Reader
+}
+
+type thriftFields map[int16]interface{}
+
+func (r thriftReader) zigzag() int64 {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		panic(err)
+	}
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n, _ := binary.ReadUvarint(r)
+		b := make([]byte, n)
+		r.Read(b)
+		return string(b)
+	case thriftList:
+		h, _ := r.ReadByte()
+		n := int(h >> 4)
+		if n == 15 {
+			un, _ := binary.ReadUvarint(r)
+			n = int(un)
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		s := make(thriftFields)
+		var id int16
+		for {
+			h, _ := r.ReadByte()
+			if h == 0 {
+				return s
+			}
+			if d := int16(h >> 4); d > 0 {
+				id += d
+			} else {
+				id = int16(r.zigzag())
+			}
+			s[id] = r.value(h & 0x0f)
+		}
+	}
+	panic(fmt.Sprintf("unsupported thrift type %d", typ))
+}
+
+func Test_export(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	db := serde.NewMemSerDe()
+	for i, name := range []string{"foo.a.cpu", "foo.b.cpu", "foo.b.mem", "bar.a.cpu"} {
+		spec := &rrd.DSSpec{
+			Step:      time.Minute,
+			Heartbeat: 90 * time.Second,
+			RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour}},
+		}
+		ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+		for n := 0; n <= 10; n++ {
+			if n != 5 || i != 0 { // leave a gap
+				ds.ProcessDataPoint(float64(i*100+n), when.Add(time.Duration(n)*time.Minute))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	from, to := when.Add(time.Minute), when.Add(10*time.Minute)
+	nSeries, nRows, err := export(&buf, ioutil.Discard, db.Fetcher(), "foo.*.{cpu,disk}", from, to, 4, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nSeries != 2 || nRows != 18 {
+		t.Errorf("Expected 18 rows of 2 series, got %d rows of %d", nRows, nSeries)
+	}
+
+	b := buf.Bytes()
+	if string(b[:4]) != "PAR1" || string(b[len(b)-4:]) != "PAR1" {
+		t.Fatalf("Missing magic numbers")
+	}
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := thriftReader{bytes.NewReader(b[len(b)-8-size : len(b)-8])}.value(thriftStruct).(thriftFields)
+
+	if meta[3].(int64) != 18 {
+		t.Errorf("Expected num_rows 18, got %v", meta[3])
+	}
+	var cols []string
+	for _, el := range meta[2].([]interface{})[1:] {
+		cols = append(cols, el.(thriftFields)[4].(string))
+	}
+	if fmt.Sprint(cols) != "[timestamp name step value]" {
+		t.Errorf("Unexpected schema: %v", cols)
+	}
+	if kv := meta[5].([]interface{})[0].(thriftFields); kv[1] != "tgres.name" || kv[2] != "foo.*.{cpu,disk}" {
+		t.Errorf("Unexpected metadata: %v", kv)
+	}
+
+	// Read the rows back from the pages of every row group
+	groups := meta[4].([]interface{})
+	if len(groups) != 5 {
+		t.Errorf("Expected 5 row groups of up to 4 rows, got %d", len(groups))
+	}
+	var (
+		names  []string
+		values []float64
+		times  []int64
+	)
+	for _, g := range groups {
+		chunks := g.(thriftFields)[1].([]interface{})
+		for i, c := range chunks {
+			offset := c.(thriftFields)[3].(thriftFields)[9].(int64)
+			r := thriftReader{bytes.NewReader(b[offset:])}
+			ph := r.value(thriftStruct).(thriftFields)
+			n := int(ph[5].(thriftFields)[1].(int64))
+			page := make([]byte, ph[2].(int64))
+			r.Read(page)
+			for j := 0; j < n; j++ {
+				switch i {
+				case 0:
+					times = append(times, int64(binary.LittleEndian.Uint64(page)))
+					page = page[8:]
+				case 1:
+					l := binary.LittleEndian.Uint32(page)
+					names = append(names, string(page[4:4+l]))
+					page = page[4+l:]
+				case 2:
+					if step := binary.LittleEndian.Uint64(page); step != 60 {
+						t.Errorf("Expected step 60, got %d", step)
+					}
+					page = page[8:]
+				case 3:
+					values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(page)))
+					page = page[8:]
+				}
+			}
+		}
+	}
+
+	// The gap in foo.a.cpu exceeds the heartbeat, leaving the slots
+	// ending at 5 and 6 minutes empty.
+	if len(names) != 18 || names[0] != "foo.a.cpu" || names[7] != "foo.a.cpu" || names[8] != "foo.b.cpu" || names[17] != "foo.b.cpu" {
+		t.Errorf("Unexpected names: %v", names)
+	}
+	if len(values) != 18 || values[0] != 1 || values[4] != 7 || values[8] != 101 || values[17] != 110 {
+		t.Errorf("Unexpected values: %v", values)
+	}
+	if len(times) != 18 || times[0] != when.Add(time.Minute).Unix()*1000 || times[4] != when.Add(7*time.Minute).Unix()*1000 {
+		t.Errorf("Unexpected timestamps: %v", times)
+	}
+
+	buf.Reset()
+	if _, nRows, _ = export(&buf, ioutil.Discard, db.Fetcher(), "foo.*.{cpu,disk}", from, to, 4, true); nRows != 20 {
+		t.Errorf("Expected the empty slots too with nan, got %d rows", nRows)
+	}
+}
+
+func Test_export_skipped(t *testing.T) {
+	when := time.Unix(1500000000, 0)
+	db := serde.NewMemSerDe()
+	for name, step := range map[string]time.Duration{"foo.fast": 500 * time.Millisecond, "foo.slow": time.Second} {
+		spec := &rrd.DSSpec{
+			Step:      step,
+			Heartbeat: time.Minute,
+			RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: step, Span: time.Hour}},
+		}
+		ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+		for n := 0; n <= 10; n++ {
+			ds.ProcessDataPoint(float64(n), when.Add(time.Duration(n)*time.Second))
+		}
+	}
+
+	var buf, logw bytes.Buffer
+	nSeries, nRows, err := export(&buf, &logw, db.Fetcher(), "foo.*", when.Add(time.Second), when.Add(10*time.Second), 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nSeries != 1 || nRows != 10 {
+		t.Errorf("Expected 10 rows of foo.slow only, got %d rows of %d series", nRows, nSeries)
+	}
+	if msg := logw.String(); !strings.Contains(msg, `Skipping "foo.fast"`) || strings.Contains(msg, "foo.slow") {
+		t.Errorf("Expected foo.fast to be reported as skipped, got %q", msg)
+	}
+}
+
+func Test_patternRegexp(t *testing.T) {
+	re, err := patternRegexp("foo.*.{a,b?}.[!x]z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, exp := range map[string]bool{
+		"foo.bar.a.yz":   true,
+		"foo.bar.bc.yz":  true,
+		"foo.bar.a.xz":   false,
+		"foo.b.r.a.yz":   false,
+		"foo.bar.a.yz.x": false,
+	} {
+		if re.MatchString(name) != exp {
+			t.Errorf("%q: expected %v", name, exp)
+		}
+	}
+	for _, bad := range []string{"foo.{a", "foo.a}", "foo.{a,{b}}", "foo.[a"} {
+		if _, err := patternRegexp(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// This is a minimal Parquet writer, just enough for what we export:
+// required (never null) columns, PLAIN encoded and uncompressed, one
+// data page per column chunk. The rows are buffered a row group at a
+// time, only the metadata of the row groups is kept until Close()
+// writes it in the footer. The format is described in
+// https://github.com/apache/parquet-format, the metadata is Thrift
+// in the compact protocol.
+
+type parquetType int
+
+const (
+	parquetInt64 parquetType = iota
+	parquetDouble
+	parquetString          // UTF8 BYTE_ARRAY
+	parquetTimestampMillis // INT64
+)
+
+// Parquet physical types, converted types, encodings, etc.
+const (
+	ptInt64     = 2
+	ptDouble    = 5
+	ptByteArray = 6
+
+	ctNone            = -1
+	ctUTF8            = 0
+	ctTimestampMillis = 9
+
+	encPlain = 0
+	encRLE   = 3
+
+	repRequired = 0
+	pageData    = 0
+	codecNone   = 0
+)
+
+func (t parquetType) physical() int32 {
+	switch t {
+	case parquetDouble:
+		return ptDouble
+	case parquetString:
+		return ptByteArray
+	}
+	return ptInt64
+}
+
+func (t parquetType) converted() int32 {
+	switch t {
+	case parquetString:
+		return ctUTF8
+	case parquetTimestampMillis:
+		return ctTimestampMillis
+	}
+	return ctNone
+}
+
+type parquetColumn struct {
+	Name string
+	Type parquetType
+}
+
+type columnChunk struct {
+	offset, size int64
+}
+
+type rowGroup struct {
+	rows, size int64
+	chunks     []columnChunk
+}
+
+type parquetWriter struct {
+	w         io.Writer
+	offset    int64
+	cols      []parquetColumn
+	bufs      []bytes.Buffer
+	rows      int // in the current row group
+	groupSize int
+	groups    []rowGroup
+	total     int64
+	meta      [][2]string
+}
+
+// newParquetWriter writes the magic number to w and returns a writer
+// of rows of cols, flushed to w every groupSize rows.
+func newParquetWriter(w io.Writer, groupSize int, cols ...parquetColumn) (*parquetWriter, error) {
+	pw := &parquetWriter{w: w, cols: cols, bufs: make([]bytes.Buffer, len(cols)), groupSize: groupSize}
+	if err := pw.write([]byte("PAR1")); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// setMetadata adds a key/value to the file metadata.
+func (pw *parquetWriter) setMetadata(key, value string) {
+	pw.meta = append(pw.meta, [2]string{key, value})
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// writeRow appends a row, vals must be in the order of the columns,
+// int64 for parquetInt64 and parquetTimestampMillis, float64 for
+// parquetDouble and string for parquetString.
+func (pw *parquetWriter) writeRow(vals ...interface{}) error {
+	if len(vals) != len(pw.cols) {
+		return fmt.Errorf("writeRow: expected %d values, got %d", len(pw.cols), len(vals))
+	}
+	var b [8]byte
+	for i, v := range vals {
+		buf := &pw.bufs[i]
+		switch x := v.(type) {
+		case int64:
+			binary.LittleEndian.PutUint64(b[:], uint64(x))
+			buf.Write(b[:])
+		case float64:
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(x))
+			buf.Write(b[:])
+		case string:
+			binary.LittleEndian.PutUint32(b[:4], uint32(len(x)))
+			buf.Write(b[:4])
+			buf.WriteString(x)
+		default:
+			return fmt.Errorf("writeRow: unsupported value %v (%T) of column %s", v, v, pw.cols[i].Name)
+		}
+	}
+	pw.rows++
+	if pw.rows >= pw.groupSize {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// Writes the buffered rows as a row group.
+func (pw *parquetWriter) flushRowGroup() error {
+	if pw.rows == 0 {
+		return nil
+	}
+	rg := rowGroup{rows: int64(pw.rows)}
+	for i := range pw.cols {
+		buf := &pw.bufs[i]
+
+		var t thriftWriter
+		t.beginStruct() // PageHeader
+		t.fieldI32(1, pageData)
+		t.fieldI32(2, int32(buf.Len())) // uncompressed_page_size
+		t.fieldI32(3, int32(buf.Len())) // compressed_page_size
+		t.fieldStruct(5)                // data_page_header
+		t.fieldI32(1, int32(pw.rows))
+		t.fieldI32(2, encPlain)
+		t.fieldI32(3, encRLE) // definition levels, there are none
+		t.fieldI32(4, encRLE) // repetition levels, ditto
+		t.endStruct()
+		t.endStruct()
+
+		chunk := columnChunk{offset: pw.offset, size: int64(t.buf.Len() + buf.Len())}
+		if err := pw.write(t.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+		rg.chunks = append(rg.chunks, chunk)
+		rg.size += chunk.size
+	}
+	pw.groups = append(pw.groups, rg)
+	pw.total += rg.rows
+	pw.rows = 0
+	return nil
+}
+
+// Close writes the remaining rows and the footer, it does not close
+// the underlying writer.
+func (pw *parquetWriter) Close() error {
+	if err := pw.flushRowGroup(); err != nil {
+		return err
+	}
+
+	var t thriftWriter
+	t.beginStruct() // FileMetaData
+	t.fieldI32(1, 1)
+	t.fieldList(2, thriftStruct, len(pw.cols)+1) // schema
+	t.beginStruct()
+	t.fieldString(4, "schema")
+	t.fieldI32(5, int32(len(pw.cols)))
+	t.endStruct()
+	for _, col := range pw.cols {
+		t.beginStruct()
+		t.fieldI32(1, col.Type.physical())
+		t.fieldI32(3, repRequired)
+		t.fieldString(4, col.Name)
+		if ct := col.Type.converted(); ct != ctNone {
+			t.fieldI32(6, ct)
+		}
+		t.endStruct()
+	}
+	t.fieldI64(3, pw.total)
+	t.fieldList(4, thriftStruct, len(pw.groups))
+	for _, rg := range pw.groups {
+		t.beginStruct()
+		t.fieldList(1, thriftStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			t.beginStruct() // ColumnChunk
+			t.fieldI64(2, chunk.offset)
+			t.fieldStruct(3) // ColumnMetaData
+			t.fieldI32(1, pw.cols[i].Type.physical())
+			t.fieldList(2, thriftI32, 1)
+			t.i32(encPlain)
+			t.fieldList(3, thriftBinary, 1)
+			t.str(pw.cols[i].Name)
+			t.fieldI32(4, codecNone)
+			t.fieldI64(5, rg.rows)
+			t.fieldI64(6, chunk.size)
+			t.fieldI64(7, chunk.size)
+			t.fieldI64(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.fieldI64(2, rg.size)
+		t.fieldI64(3, rg.rows)
+		t.endStruct()
+	}
+	if len(pw.meta) > 0 {
+		t.fieldList(5, thriftStruct, len(pw.meta))
+		for _, kv := range pw.meta {
+			t.beginStruct()
+			t.fieldString(1, kv[0])
+			t.fieldString(2, kv[1])
+			t.endStruct()
+		}
+	}
+	t.fieldString(6, "tgres-export-parquet")
+	t.endStruct()
+
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(t.buf.Len()))
+	if err := pw.write(t.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := pw.write(size[:]); err != nil {
+		return err
+	}
+	return pw.write([]byte("PAR1"))
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the Thrift compact protocol, the
+// fields of a struct must be written in the order of their ids.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16 // the id of the last field of every struct being written
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if d := id - *last; d > 0 && d <= 15 {
+		t.buf.WriteByte(byte(d)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) beginStruct() { t.last = append(t.last, 0) }
+
+func (t *thriftWriter) endStruct() {
+	t.buf.WriteByte(0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) i32(v int32) { t.zigzag(int64(v)) }
+
+func (t *thriftWriter) str(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.i32(v)
+}
+
+func (t *thriftWriter) fieldI64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) fieldString(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.str(s)
+}
+
+// fieldStruct begins a struct field, to be ended with endStruct().
+func (t *thriftWriter) fieldStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginStruct()
+}
+
+// fieldList begins a list field of n elements, which are to follow.
+func (t *thriftWriter) fieldList(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.buf.WriteByte(0xf0 | elem)
+		t.varint(uint64(n))
+	}
+}
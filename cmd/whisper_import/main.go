@@ -19,8 +19,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/tgres/tgres/cmd/internal/vcache"
+	"github.com/tgres/tgres/misc"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
@@ -53,22 +58,36 @@ import (
 var stats struct {
 	sync.Mutex
 	totalSqlOps, totalCount, totalPoints int
+	filesDone, filesTotal                int // for progress
 }
 
 type Config struct {
-	mode        string // create or populate
-	dbConnect   string
-	root        string
-	whisperDir  string
-	namePrefix  string
-	specStr     string
-	rraSpecStep int
-	staleDays   int
-	heartbeat   int
-	dsSpec      *rrd.DSSpec
-	workers     int
-	width       int
-	sdb         *statusDb
+	mode         string // create or populate
+	dbConnect    string
+	root         string
+	whisperDir   string
+	namePrefix   string
+	nameSep      string // path separators become this
+	stripPrefix  string // removed from the path before it becomes a name
+	specStr      string
+	archiveRRAs  bool               // each whisper archive is an RRA
+	importCF     *rrd.Consolidation // of finer archives into RRAs, nil = that of the RRA
+	overlap      overlapRule        // which archive wins where they overlap, without archiveRRAs
+	rraSpecStep  int
+	staleDays    int
+	since        time.Time // only import data after this
+	heartbeat    int
+	dsSpec       *rrd.DSSpec
+	workers      int
+	parsers      int
+	segmentConns int  // connections to flush the rows of one segment with
+	splitRows    int  // only segments with more rows than this are split
+	stripes      int  // flush segments in this many sorted stripes (0 = all at once)
+	progress     int  // seconds between progress reports
+	quiet        bool // no progress reports
+	width        int
+	onConflict   serde.ConflictStrategy // of the whisper data with the existing data points
+	sdb          *statusDb
 }
 
 func main() {
@@ -79,13 +98,26 @@ func main() {
 	flag.StringVar(&cfg.root, "root", "", "location of files to be imported, should be subdirectory of whisperDir, defaults to whisperDir")
 	flag.StringVar(&cfg.dbConnect, "dbconnect", "host=/var/run/postgresql dbname=tgres sslmode=disable", "db connect string")
 	flag.StringVar(&cfg.namePrefix, "prefix", "", "series name prefix (no trailing dot)")
+	flag.StringVar(&cfg.nameSep, "name-sep", ".", "what the / in file paths (relative to whisper-dir) becomes in series names")
+	flag.StringVar(&cfg.stripPrefix, "strip-prefix", "", "path prefix (relative to whisper-dir) to remove from file paths before they become series names")
 	flag.IntVar(&cfg.staleDays, "stale-days", 0, "Max days since last update before we ignore this DS (0 = process all)")
+	sinceStr := flag.String("since", "", "Only import data newer than this: RFC3339 time, YYYY-MM-DD, unix seconds or a duration ago, e.g. 720h (blank = all)")
 	flag.StringVar(&cfg.specStr, "spec", "", "Spec (config file format, comma-separated) to use for new DSs (Blank = infer from whisper file)")
 	flag.IntVar(&cfg.rraSpecStep, "step", 10, "Step to be used with spec parameter (seconds)")
+	flag.BoolVar(&cfg.archiveRRAs, "archive-rras", false, "Copy every whisper archive as is into the RRA of the same step and span (which new DSs are created with), instead of consolidating all points through the DS")
+	importCFStr := flag.String("import-consolidation", "", "With -archive-rras, how the points of a finer archive are consolidated into an RRA without an archive of the same step and span: avg, max, min, sum or last (blank = the function of the RRA)")
+	overlapStr := flag.String("archive-overlap", "finest", "Without -archive-rras, which archive's points the DS gets where archives cover the same time: finest (the finest archive that has data there) or span (the finer archive wherever its span reaches, even without data)")
 	flag.StringVar(&cfg.mode, "mode", "", "Must be create or populate")
 	flag.IntVar(&cfg.heartbeat, "hb", 1800, "Heartbeat (seconds)")
 	flag.IntVar(&cfg.workers, "workers", 4, "Number of concurrent db workers")
+	flag.IntVar(&cfg.parsers, "parsers", 4, "Number of concurrent whisper file parsers (per segment)")
+	flag.IntVar(&cfg.stripes, "flush-stripes", 0, "Flush the segments sorted by bundle and segment, in this many concurrent stripes of adjacent segments, for less lock contention in the database (0 = all at once, in random order)")
+	onConflictStr := flag.String("on-conflict", "overwrite", "What to do with the slots which already have a data point: overwrite (with the whisper data) or skip (keep the existing one, e.g. to backfill only the missing data)")
+	flag.IntVar(&cfg.segmentConns, "segment-conns", 1, "Number of concurrent db connections to flush the rows of a single segment with (1 = no splitting)")
+	flag.IntVar(&cfg.splitRows, "split-rows", 1000, "Only split the rows of segments with more rows than this across -segment-conns connections")
 	flag.IntVar(&cfg.width, "width", serde.PgSegmentWidth, "Segment width (experimental/advanced)")
+	flag.IntVar(&cfg.progress, "progress", 30, "Seconds between progress reports")
+	flag.BoolVar(&cfg.quiet, "quiet", false, "Do not report progress")
 
 	flag.Parse()
 
@@ -98,6 +130,41 @@ func main() {
 		cfg.root = cfg.whisperDir
 	}
 
+	if *sinceStr != "" {
+		var err error
+		if cfg.since, err = parseSince(*sinceStr, time.Now()); err != nil {
+			fmt.Printf("Error parsing -since: %v\n", err)
+			return
+		}
+		fmt.Printf("Only importing data after %v\n", cfg.since)
+	}
+
+	if cfg.nameSep == "" {
+		fmt.Printf("-name-sep cannot be blank\n")
+		return
+	}
+
+	if cfg.archiveRRAs && cfg.specStr != "" {
+		fmt.Printf("-archive-rras and -spec cannot be used together, RRAs are derived from the whisper archives\n")
+		return
+	}
+
+	if *importCFStr != "" {
+		cf, err := parseImportConsolidation(*importCFStr)
+		if err != nil {
+			fmt.Printf("Error parsing -import-consolidation: %v\n", err)
+			return
+		}
+		cfg.importCF = &cf
+	}
+
+	if o, err := parseOverlapRule(*overlapStr); err != nil {
+		fmt.Printf("Error parsing -archive-overlap: %v\n", err)
+		return
+	} else {
+		cfg.overlap = o
+	}
+
 	if cfg.specStr != "" {
 		var err error
 		if cfg.dsSpec, err = specFromStr(cfg.specStr, cfg.rraSpecStep, cfg.heartbeat); err != nil {
@@ -107,6 +174,19 @@ func main() {
 		fmt.Printf("All newly created DSs will follow this spec (step %ds) : %q\n", cfg.rraSpecStep, cfg.specStr)
 	}
 
+	if cs, err := serde.ParseConflictStrategy(*onConflictStr); err != nil {
+		fmt.Printf("Error parsing -on-conflict: %v\n", err)
+		return
+	} else if cs != serde.ConflictOverwrite {
+		fmt.Printf("Keeping the existing data points (-on-conflict %v)\n", cs)
+		cfg.onConflict = cs
+	}
+
+	if cfg.segmentConns < 1 {
+		fmt.Printf("-segment-conns must be at least 1\n")
+		return
+	}
+
 	if cfg.width != serde.PgSegmentWidth {
 		fmt.Printf("Setting segment width to %d\n", cfg.width)
 		serde.PgSegmentWidth = cfg.width
@@ -130,13 +210,17 @@ func main() {
 	bySeg := mapFilesToDSs(db, &cfg)
 
 	var wg sync.WaitGroup
-	ch := make(chan *verticalCache)
+	ch := make(chan *vcache.VerticalCache)
 
 	for i := 0; i < cfg.workers; i++ {
 		wg.Add(1)
 		go vcacheFlusher(ch, db.Flusher(), &wg, &cfg)
 	}
 
+	if !cfg.quiet && cfg.progress > 0 {
+		go reportProgress(time.Duration(cfg.progress) * time.Second)
+	}
+
 	processSegments(db, ch, bySeg, &cfg)
 
 	close(ch)
@@ -144,3 +228,38 @@ func main() {
 
 	fmt.Printf("DONE: GRAND TOTAL %d points across %d series in %d SQL ops.\n", stats.totalPoints, stats.totalCount, stats.totalSqlOps)
 }
+
+// parseSince parses the -since value, which is either a timestamp
+// (RFC3339, YYYY-MM-DD or unix seconds) or a duration relative to now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if d, err := misc.BetterParseDuration(s); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time or duration: %q", s)
+}
+
+// parseImportConsolidation parses the -import-consolidation value.
+func parseImportConsolidation(s string) (rrd.Consolidation, error) {
+	switch strings.ToLower(s) {
+	case "avg", "wmean":
+		return rrd.WMEAN, nil
+	case "max":
+		return rrd.MAX, nil
+	case "min":
+		return rrd.MIN, nil
+	case "sum":
+		return rrd.SUM, nil
+	case "last":
+		return rrd.LAST, nil
+	}
+	return rrd.WMEAN, fmt.Errorf("invalid consolidation: %q (valid: avg, max, min, sum, last)", s)
+}
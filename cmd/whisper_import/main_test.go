@@ -0,0 +1,198 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_parseSince(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	for in, exp := range map[string]time.Time{
+		"2017-03-16T09:41:00Z": time.Date(2017, 3, 16, 9, 41, 0, 0, time.UTC),
+		"2017-03-16":           time.Date(2017, 3, 16, 0, 0, 0, 0, time.UTC),
+		"1489657260":           time.Unix(1489657260, 0),
+		"2h":                   now.Add(-2 * time.Hour),
+	} {
+		got, err := parseSince(in, now)
+		if err != nil || !got.Equal(exp) {
+			t.Errorf("parseSince(%q): expected %v, got %v (err: %v)", in, exp, got, err)
+		}
+	}
+	if _, err := parseSince("foo", now); err == nil {
+		t.Errorf("parseSince(foo): expected an error")
+	}
+}
+
+func Test_consolidateArchive(t *testing.T) {
+	// 10s points, whisper timestamps are the beginnings of slots
+	t0 := uint32(1500000000)
+	points := archive{{TimeStamp: t0 - 3600, Value: 1000}} // a ghost
+	for i := uint32(0); i < 30; i++ {
+		if i != 7 {
+			points = append(points, point{TimeStamp: t0 + 10*i, Value: float64(i)})
+		}
+	}
+
+	for cf, exp := range map[rrd.Consolidation][2]float64{
+		rrd.WMEAN: {2.5, 8.8},
+		rrd.MAX:   {5, 11},
+		rrd.MIN:   {0, 6},
+		rrd.SUM:   {15, 44},
+		rrd.LAST:  {5, 11},
+	} {
+		latest, dps := consolidateArchive(points, 10*time.Second, 60, time.Minute, 5, cf)
+		if end := time.Unix(int64(t0+300), 0); !latest.Equal(end) {
+			t.Errorf("cf %v: expected latest %v, got %v", cf, end, latest)
+		}
+		if len(dps) != 5 {
+			t.Errorf("cf %v: expected 5 slots, got %v", cf, dps)
+		}
+		for i, v := range exp {
+			n := rrd.SlotIndex(time.Unix(int64(t0)+60*int64(i+1), 0), time.Minute, 5)
+			if dps[n] != v {
+				t.Errorf("cf %v: slot %d: expected %v, got %v", cf, i, v, dps[n])
+			}
+		}
+	}
+
+	h := &header{archives: []archiveInfo{{Step: 10, Size: 60}, {Step: 30, Size: 60}, {Step: 60, Size: 60}}}
+	if n := consolidatingArchive(h, 90*time.Second); n != 1 {
+		t.Errorf("Expected the 30s archive to be the coarsest dividing 90s, got %d", n)
+	}
+	if n := consolidatingArchive(h, 25*time.Second); n != -1 {
+		t.Errorf("Expected no archive dividing 25s, got %d", n)
+	}
+}
+
+func Test_parseImportConsolidation(t *testing.T) {
+	for in, exp := range map[string]rrd.Consolidation{"avg": rrd.WMEAN, "MAX": rrd.MAX, "sum": rrd.SUM, "last": rrd.LAST} {
+		if cf, err := parseImportConsolidation(in); err != nil || cf != exp {
+			t.Errorf("parseImportConsolidation(%q): expected %v, got %v (err: %v)", in, exp, cf, err)
+		}
+	}
+	if _, err := parseImportConsolidation("median"); err == nil {
+		t.Errorf("parseImportConsolidation(median): expected an error")
+	}
+}
+
+func Test_mergeArchives(t *testing.T) {
+	// 10s for 3 minutes and 1m for 10 minutes, whisper timestamps
+	// are the beginnings of slots, the merged ones the ends.
+	t0 := uint32(1500000000) // divisible by 60
+	archs := []archiveInfo{{Step: 10, Size: 18}, {Step: 60, Size: 10}}
+	fine := archive{{TimeStamp: t0 - 3600, Value: -1}} // a ghost
+	for i := uint32(0); i < 18; i++ {
+		switch {
+		case i < 5:
+			fine = append(fine, point{TimeStamp: t0 + 10*i, Value: float64(i)})
+		case i == 5:
+			fine = append(fine, point{TimeStamp: t0 + 10*i, Value: math.NaN()})
+		case i >= 12: // none in the second minute
+			fine = append(fine, point{TimeStamp: t0 + 10*i, Value: float64(i)})
+		}
+	}
+	var coarse archive
+	for i := uint32(0); i < 10; i++ {
+		coarse = append(coarse, point{TimeStamp: t0 + 120 - 60*i, Value: 100 + float64(i)})
+	}
+	points := []archive{fine, coarse}
+
+	merge := func(overlap overlapRule) map[int64]float64 {
+		m := make(map[int64]float64)
+		for _, p := range mergeArchives(archs, points, overlap) {
+			if _, ok := m[int64(p.TimeStamp)-int64(t0)]; ok {
+				t.Errorf("%v: more than one point at t0%+d", overlap, int64(p.TimeStamp)-int64(t0))
+			}
+			m[int64(p.TimeStamp)-int64(t0)] = p.Value
+		}
+		return m
+	}
+	check := func(overlap overlapRule, got, exp map[int64]float64) {
+		for ts, v := range exp {
+			if gv, ok := got[ts]; !ok || (gv != v && !(math.IsNaN(gv) && math.IsNaN(v))) {
+				t.Errorf("%v: expected %v at t0%+d, got %v (%v)", overlap, v, ts, gv, ok)
+			}
+		}
+		for ts, v := range got {
+			if _, ok := exp[ts]; !ok {
+				t.Errorf("%v: unexpected %v at t0%+d", overlap, v, ts)
+			}
+		}
+	}
+
+	exp := map[int64]float64{
+		10: 0, 20: 1, 30: 2, 40: 3, 50: 4, // fine, NaN at 60 dropped
+		120: 101, // coarse, no fine data in its slot
+		130: 12, 140: 13, 150: 14, 160: 15, 170: 16, 180: 17,
+	}
+	for i := int64(3); i < 10; i++ {
+		exp[180-60*i] = 100 + float64(i) // coarse before the fine span
+	}
+	check(overlapFinest, merge(overlapFinest), exp)
+
+	// The NaN is kept and the coarse point in the fine span is not
+	delete(exp, 120)
+	exp[60] = math.NaN()
+	check(overlapSpan, merge(overlapSpan), exp)
+}
+
+func Test_parseOverlapRule(t *testing.T) {
+	for in, exp := range map[string]overlapRule{"finest": overlapFinest, "Span": overlapSpan} {
+		if o, err := parseOverlapRule(in); err != nil || o != exp {
+			t.Errorf("parseOverlapRule(%q): expected %v, got %v (err: %v)", in, exp, o, err)
+		}
+	}
+	if _, err := parseOverlapRule("coarsest"); err == nil {
+		t.Errorf("parseOverlapRule(coarsest): expected an error")
+	}
+}
+
+type fakeUsageDb struct {
+	serde.SerDe
+	usage []*serde.RRABundleUsage
+	err   error
+}
+
+func (f *fakeUsageDb) RRABundleUsage() ([]*serde.RRABundleUsage, error) { return f.usage, f.err }
+
+func Test_newDSChunkWidth(t *testing.T) {
+	if w := newDSChunkWidth(struct{ serde.SerDe }{}, 200); w != 200 {
+		t.Errorf("Expected the default without bundles, got %d", w)
+	}
+	db := &fakeUsageDb{}
+	if w := newDSChunkWidth(db, 200); w != 200 {
+		t.Errorf("Expected the default with no bundles yet, got %d", w)
+	}
+	db.usage = []*serde.RRABundleUsage{{Id: 1, Width: 400}, {Id: 2, Width: 50}, {Id: 3, Width: 100}}
+	if w := newDSChunkWidth(db, 200); w != 50 {
+		t.Errorf("Expected the narrowest bundle width, got %d", w)
+	}
+	db.usage = []*serde.RRABundleUsage{{Id: 1, Width: 400}}
+	if w := newDSChunkWidth(db, 200); w != 400 {
+		t.Errorf("Expected the width of the existing bundle, got %d", w)
+	}
+	db.err = fmt.Errorf("fake error")
+	if w := newDSChunkWidth(db, 200); w != 200 {
+		t.Errorf("Expected the default on error, got %d", w)
+	}
+}
@@ -19,14 +19,17 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/tgres/tgres/cmd/internal/vcache"
 	"github.com/tgres/tgres/daemon"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
@@ -63,7 +66,7 @@ func mapFilesToDSs(db serde.SerDe, cfg *Config) map[int64]map[string]int64 {
 		return nil
 	}
 
-	start, count := time.Now(), 0
+	start, count, bad := time.Now(), 0, 0
 	bySeg := make(map[int64]map[string]int64)
 
 	fmt.Printf("Cross-referencing with files in %v\n", cfg.root)
@@ -76,11 +79,22 @@ func mapFilesToDSs(db serde.SerDe, cfg *Config) map[int64]map[string]int64 {
 
 			count++
 
-			name := nameFromPath(path, cfg.whisperDir, cfg.namePrefix)
+			name, err := nameFromPath(path, cfg)
+			if err != nil {
+				fmt.Printf("Skipping %v: %v\n", path, err)
+				bad++
+				return nil
+			}
 			if _, err := os.Stat(path); err != nil {
 				return nil // file does not exist
 			}
 
+			// A sample, so that an unexpected mapping is obvious
+			// before any damage is done
+			if count <= 5 {
+				fmt.Printf("  %v -> %q\n", path, name)
+			}
+
 			if count%1000 == 0 {
 				fmt.Printf("Checked %d files, currently on: %v\n", count, path)
 			}
@@ -94,18 +108,17 @@ func mapFilesToDSs(db serde.SerDe, cfg *Config) map[int64]map[string]int64 {
 					bySeg[-1] = make(map[string]int64)
 				}
 				bySeg[-1][path] = 0
-			} else {
-				dbds := ds.(*serde.DbDataSource)
-				for _, rra := range dbds.RRAs() {
-					dbrra := rra.(*serde.DbRoundRobinArchive)
-					seg := dbrra.Seg()
-					id := dbds.Id()
-
-					if bySeg[seg] == nil {
-						bySeg[seg] = make(map[string]int64)
-					}
-					bySeg[seg][path] = id
+			} else if rras := ds.RRAs(); len(rras) > 0 {
+				// The RRAs of a DS are usually in different bundles
+				// and therefore segments, but processing a file
+				// updates all of them, so it must only be assigned
+				// to one segment, or it would be processed (and
+				// written) once for every segment.
+				seg := rras[0].(*serde.DbRoundRobinArchive).Seg()
+				if bySeg[seg] == nil {
+					bySeg[seg] = make(map[string]int64)
 				}
+				bySeg[seg][path] = ds.Id()
 			}
 
 			return nil
@@ -113,11 +126,14 @@ func mapFilesToDSs(db serde.SerDe, cfg *Config) map[int64]map[string]int64 {
 	)
 
 	fmt.Printf("Checked a total of %d files in %v.\n", count, time.Now().Sub(start))
+	if bad > 0 {
+		fmt.Printf("WARNING: %d files skipped because a series name could not be derived from their path.\n", bad)
+	}
 
 	return bySeg
 }
 
-func processSegments(db serde.SerDe, ch chan *verticalCache, bySeg map[int64]map[string]int64, cfg *Config) {
+func processSegments(db serde.SerDe, ch chan *vcache.VerticalCache, bySeg map[int64]map[string]int64, cfg *Config) {
 
 	var wg sync.WaitGroup
 
@@ -127,6 +143,21 @@ func processSegments(db serde.SerDe, ch chan *verticalCache, bySeg map[int64]map
 		return
 	}
 
+	// Count the files up front, so that progress is meaningful
+	total := 0
+	for seg, paths := range bySeg {
+		if cfg.mode == "populate" {
+			if _, ok := finished[seg]; seg != -1 && !ok {
+				total += len(paths)
+			}
+		} else if seg == -1 {
+			total += len(paths)
+		}
+	}
+	stats.Lock()
+	stats.filesTotal = total
+	stats.Unlock()
+
 	if cfg.mode == "populate" {
 		fmt.Printf("Processing whisper files by segments.\n")
 
@@ -169,6 +200,8 @@ func processSegments(db serde.SerDe, ch chan *verticalCache, bySeg map[int64]map
 	// Now process all new DSs in chunks of width If all we're doing
 	// is creating them, we can process this in parallel to make it
 	// faster.
+	width := newDSChunkWidth(db, serde.PgSegmentWidth)
+	parts := (len(bySeg[-1]) + width - 1) / width
 	toProcess, n := make(map[string]int64), 0
 	fn, submitted, maxProc := 1, 0, 1
 	if cfg.mode == "create" {
@@ -177,8 +210,8 @@ func processSegments(db serde.SerDe, ch chan *verticalCache, bySeg map[int64]map
 	for k, v := range bySeg[-1] {
 		toProcess[k] = v
 		n++
-		if n > serde.PgSegmentWidth {
-			fmt.Printf("Segment: -1 flush (part %d of %d)\n", fn, len(bySeg[-1])/serde.PgSegmentWidth)
+		if n >= width {
+			fmt.Printf("Segment: -1 flush (part %d of %d)\n", fn, parts)
 			wg.Add(1)
 			submitted++
 			go processSegment(db, ch, -1, toProcess, cfg, &wg)
@@ -190,75 +223,192 @@ func processSegments(db serde.SerDe, ch chan *verticalCache, bySeg map[int64]map
 		}
 	}
 	if len(toProcess) > 0 {
-		fmt.Printf("Segment: -1 flush (part %d of %d)\n", fn, len(bySeg[-1])/serde.PgSegmentWidth)
+		fmt.Printf("Segment: -1 flush (part %d of %d)\n", fn, parts)
 		wg.Add(1)
 		processSegment(db, ch, -1, toProcess, cfg, &wg)
 	}
 }
 
+type bundleUsager interface {
+	RRABundleUsage() ([]*serde.RRABundleUsage, error)
+}
+
+// The number of new DSs to process together, so that their RRAs
+// share segments. RRAs go into the existing bundles, which keep their
+// own width, and a bundle created for them gets def. With bundles of
+// different widths the narrowest is used, a chunk then spans at most
+// two segments of any bundle.
+func newDSChunkWidth(db serde.SerDe, def int) int {
+	width := 0
+	if bu, ok := db.(bundleUsager); ok {
+		usage, err := bu.RRABundleUsage()
+		if err != nil {
+			fmt.Printf("Error getting RRA bundles, using a width of %d: %v\n", def, err)
+			return def
+		}
+		for _, u := range usage {
+			if u.Width > 0 && (width == 0 || int(u.Width) < width) {
+				width = int(u.Width)
+			}
+		}
+	}
+	if width == 0 {
+		return def
+	}
+	return width
+}
+
 var seq int
 
-func processSegment(db serde.SerDe, ch chan *verticalCache, seg int64, paths map[string]int64, cfg *Config, wg *sync.WaitGroup) {
+// A whisper file read into its DS, ready for the vcache.
+type parsedFile struct {
+	ds      *serde.DbDataSource
+	oldDs   rrd.DataSourcer // before the trickery in parseFile()
+	latests []time.Time     // original RRA latests
+}
+
+func processSegment(db serde.SerDe, ch chan *vcache.VerticalCache, seg int64, paths map[string]int64, cfg *Config, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	vcache := &verticalCache{
-		ts:  seq,
-		dps: make(map[bundleKey]*verticalCacheSegment),
-		dss: make(map[int64]map[int64]interface{}),
-	}
+	vc := vcache.New(seq)
+	vc.Stripes = cfg.stripes
+	vc.OnConflict = cfg.onConflict
 	seq++
 
-	stale := 0
-	for path, _ := range paths {
+	// Files are read and their points consolidated by a pool of
+	// parsers, while the vcache is updated from this goroutine only,
+	// so that file I/O overlaps with the vcache work.
+	var (
+		pathCh   = make(chan string)
+		parsedCh = make(chan *parsedFile, cfg.parsers)
+		pwg      sync.WaitGroup
+		stale    int32
+	)
 
-		name := nameFromPath(path, cfg.whisperDir, cfg.namePrefix)
+	nParsers := cfg.parsers
+	if nParsers < 1 {
+		nParsers = 1
+	}
+	for i := 0; i < nParsers; i++ {
+		pwg.Add(1)
+		go func() {
+			defer pwg.Done()
+			for path := range pathCh {
+				pf, isStale := parseFile(db, path, cfg)
+				stats.Lock()
+				stats.filesDone++
+				stats.Unlock()
+				if isStale {
+					atomic.AddInt32(&stale, 1)
+				} else if pf != nil {
+					parsedCh <- pf
+				}
+			}
+		}()
+	}
 
-		wsp, err := newWhisper(path)
-		if err != nil {
-			fmt.Printf("Skipping %v due to error: %v\n", path, err)
-			continue
+	go func() {
+		for path, _ := range paths {
+			pathCh <- path
 		}
-
-		if cfg.staleDays > 0 {
-			ts := findMostRecentTS(wsp)
-			if time.Now().Sub(ts) > time.Duration(cfg.staleDays*24)*time.Hour {
-				stale++
-				continue
-			}
+		close(pathCh)
+		pwg.Wait()
+		close(parsedCh)
+	}()
+
+	for pf := range parsedCh {
+		for i, rra := range pf.ds.RRAs() {
+			vc.UpdateDps(rra.(serde.DbRoundRobinArchiver), pf.latests[i], cfg.since)
 		}
 
-		// We need a spec
-		var spec *rrd.DSSpec
-		if cfg.dsSpec != nil {
-			spec = cfg.dsSpec
-		} else {
-			spec = specFromHeader(wsp.header, cfg.heartbeat)
+		// Only flush the DS if LastUpdate has advanced,
+		// otherwise leave as is.
+		if pf.ds.Created() || pf.ds.LastUpdate().After(pf.oldDs.LastUpdate()) {
+			vc.UpdateDss(pf.ds)
 		}
+	}
 
-		// NB: If the DS exists, our spec is ignored
-		ds, err := db.Fetcher().FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
-		if err != nil {
-			fmt.Printf("Database error: %v\n", err)
-			wsp.Close()
-			continue
-		}
+	if cfg.mode == "populate" {
+		fmt.Printf("+++ Sending vcache [%v] to flusher.\n", vc.Ts)
+		vc.Seg = seg
+		ch <- vc
+	} else {
+		// NB: We still skip when creating, we just keep it quiet
+		fmt.Printf("  -- skipped %d series older than %v days\n", atomic.LoadInt32(&stale), cfg.staleDays)
+	}
 
-		stats.Lock()
-		stats.totalSqlOps++ // sort of right
-		stats.Unlock()
+	stats.Lock()
+	stats.totalCount += len(paths)
+	stats.Unlock()
+}
 
-		if cfg.mode == "create" {
-			wsp.Close()
-			continue
+// parseFile reads the whisper file at path and processes its points
+// into its DS (creating it if necessary). The second return value is
+// true if the file was skipped for being stale. Nil is returned in
+// create mode and when the file is skipped for any reason.
+func parseFile(db serde.SerDe, path string, cfg *Config) (*parsedFile, bool) {
+
+	name, err := nameFromPath(path, cfg)
+	if err != nil {
+		return nil, false // already reported by mapFilesToDSs()
+	}
+
+	wsp, err := newWhisper(path)
+	if err != nil {
+		fmt.Printf("Skipping %v due to error: %v\n", path, err)
+		return nil, false
+	}
+	defer wsp.Close()
+
+	if cfg.staleDays > 0 {
+		ts := findMostRecentTS(wsp)
+		if time.Now().Sub(ts) > time.Duration(cfg.staleDays*24)*time.Hour {
+			return nil, true
 		}
+	}
 
-		// This trickery replaces the internal DataSource and
-		// RoundRobinArchive's with a fresh copy, which does
-		// not have a LastUpdated or Latest, thereby
-		// permitting us to update points in the past.
-		// We need to save the original latest
-		var latests []time.Time
+	// We need a spec
+	var spec *rrd.DSSpec
+	if cfg.dsSpec != nil {
+		spec = cfg.dsSpec
+	} else {
+		spec = specFromHeader(wsp.header, cfg.heartbeat)
+	}
+
+	// NB: If the DS exists, our spec is ignored
+	ds, err := db.Fetcher().FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+	if err != nil {
+		fmt.Printf("Database error: %v\n", err)
+		return nil, false
+	}
 
+	stats.Lock()
+	stats.totalSqlOps++ // sort of right
+	stats.Unlock()
+
+	if cfg.mode == "create" {
+		return nil, false
+	}
+
+	// This trickery replaces the internal DataSource and
+	// RoundRobinArchive's with a fresh copy, which does
+	// not have a LastUpdated or Latest, thereby
+	// permitting us to update points in the past.
+	// We need to save the original latest
+	var latests []time.Time
+
+	rras := ds.RRAs()
+	for _, rra := range rras {
+		latests = append(latests, rra.Latest())
+	}
+	dbds := ds.(*serde.DbDataSource)
+	oldDs := dbds.DataSourcer
+
+	if cfg.archiveRRAs {
+		if missing := archivesToRRAs(dbds, wsp, cfg.importCF); missing > 0 {
+			fmt.Printf("  %v: %d RRA(s) have no whisper archive of the same or a finer step dividing theirs, left as is.\n", name, missing)
+		}
+	} else {
 		// NB: We must match the ds spec, not ours, but we don't want XFF
 		dssp := ds.Spec()
 		for i, _ := range dssp.RRAs {
@@ -266,71 +416,59 @@ func processSegment(db serde.SerDe, ch chan *verticalCache, seg int64, paths map
 		}
 
 		newDs := rrd.NewDataSource(dssp)
-		rras := ds.RRAs()
 		for i, rra := range newDs.RRAs() {
-			latests = append(latests, rras[i].Latest())
 			dbrra := rras[i].(*serde.DbRoundRobinArchive)
 			dbrra.RoundRobinArchiver = rra
 		}
-		dbds := ds.(*serde.DbDataSource)
-		oldDs := dbds.DataSourcer
 		dbds.DataSourcer = newDs
 		dbds.SetRRAs(rras)
 
-		processAllPoints(ds, wsp)
-		wsp.Close()
-
-		for i, rra := range ds.RRAs() {
-			vcache.updateDps(rra.(serde.DbRoundRobinArchiver), latests[i])
-		}
-
-		// Only flush the DS if LastUpdate has advanced,
-		// otherwise leave as is.
-		if dbds.Created() || dbds.LastUpdate().After(oldDs.LastUpdate()) {
-			vcache.updateDss(dbds)
-		}
-	}
-
-	if cfg.mode == "populate" {
-		fmt.Printf("+++ Sending vcache [%v] to flusher.\n", vcache.ts)
-		vcache.seg = seg
-		ch <- vcache
-	} else {
-		// NB: We still skip when creating, we just keep it quiet
-		fmt.Printf("  -- skipped %d series older than %v days\n", stale, cfg.staleDays)
+		processAllPoints(ds, wsp, cfg.since, cfg.overlap)
 	}
 
-	stats.Lock()
-	stats.totalCount += len(paths)
-	stats.Unlock()
+	return &parsedFile{ds: dbds, oldDs: oldDs, latests: latests}, false
 }
 
-func vcacheFlusher(ch chan *verticalCache, db serde.Flusher, wg *sync.WaitGroup, cfg *Config) {
+func vcacheFlusher(ch chan *vcache.VerticalCache, db serde.Flusher, wg *sync.WaitGroup, cfg *Config) {
 	defer wg.Done()
 	for {
-		vcache, ok := <-ch
+		vc, ok := <-ch
 		if !ok {
 			fmt.Printf("Flusher channel closed, exiting.\n")
 			return
 		}
-		vcache.flush(db)
-		cfg.sdb.setSegmentFinished(vcache.seg)
+		points, sqlOps := vc.Flush(db, cfg.segmentConns, cfg.splitRows)
+		stats.Lock()
+		stats.totalPoints += points
+		stats.totalSqlOps += sqlOps
+		stats.Unlock()
+		cfg.sdb.setSegmentFinished(vc.Seg)
 	}
 }
 
-func nameFromPath(path, whisperDir, prefix string) string {
+// nameFromPath derives the series name from the whisper file path
+// relative to whisper-dir: strip-prefix is removed, path separators
+// are replaced with name-sep, and prefix is prepended.
+func nameFromPath(path string, cfg *Config) (string, error) {
 
-	withSlash := whisperDir
+	withSlash := cfg.whisperDir
 	if !strings.HasSuffix(withSlash, "/") {
 		withSlash += "/"
 	}
+	if !strings.HasPrefix(path, withSlash) {
+		return "", fmt.Errorf("not in whisper-dir %v", cfg.whisperDir)
+	}
 
 	basename := strings.TrimSuffix(path[len(withSlash):], ".wsp")
-	name := strings.Replace(basename, "/", ".", -1)
-	if prefix != "" {
-		name = prefix + "." + name
+	basename = strings.TrimPrefix(basename, cfg.stripPrefix)
+	name := strings.Replace(strings.Trim(basename, "/"), "/", cfg.nameSep, -1)
+	if name == "" {
+		return "", fmt.Errorf("empty series name")
+	}
+	if cfg.namePrefix != "" {
+		name = cfg.namePrefix + "." + name
 	}
-	return name
+	return name, nil
 }
 
 func findMostRecentTS(wsp *whisper) time.Time {
@@ -352,62 +490,322 @@ func findMostRecentTS(wsp *whisper) time.Time {
 	return time.Unix(int64(latest), 0)
 }
 
-func processAllPoints(ds rrd.DataSourcer, wsp *whisper) {
+func processAllPoints(ds rrd.DataSourcer, wsp *whisper, since time.Time, overlap overlapRule) {
 
-	var allPoints archive
 	archs := wsp.header.archives
+	points := make([]archive, len(archs))
+	for i, _ := range archs {
+		points[i], _ = wsp.dumpArchive(i)
+	}
 
-	start, end := uint32(0), uint32(0)
+	processArchivePoints(ds, mergeArchives(archs, points, overlap), since)
+}
 
-	var msgs []string
-	for i, arch := range archs {
+// How the points of whisper archives which overlap, i.e. cover the
+// same time at different resolutions, are merged when they are fed to
+// the DS (without -archive-rras).
+type overlapRule int
+
+const (
+	// A point of an archive is used only if no finer archive has
+	// data within its slot. NaN points are not data, they are
+	// dropped.
+	overlapFinest overlapRule = iota
+	// A point of an archive is used only if it is before the span
+	// of every finer archive, even where those have no data.
+	overlapSpan
+)
 
-		step := time.Duration(arch.Step) * time.Second
-		span := time.Duration(arch.Size) * step
+func (o overlapRule) String() string {
+	if o == overlapSpan {
+		return "span"
+	}
+	return "finest"
+}
 
-		msgs = append(msgs, fmt.Sprintf("(%d) step: %v span: %v CF: %d", i, step, span, wsp.header.metadata.CF))
+// parseOverlapRule parses the -archive-overlap value.
+func parseOverlapRule(s string) (overlapRule, error) {
+	switch strings.ToLower(s) {
+	case "finest":
+		return overlapFinest, nil
+	case "span":
+		return overlapSpan, nil
+	}
+	return overlapFinest, fmt.Errorf("invalid archive overlap: %q (valid: finest, span)", s)
+}
 
-		points, _ := wsp.dumpArchive(i)
+// mergeArchives returns the points of the archives, which are in
+// order of precision as in the whisper header, that the DS should
+// get where they overlap according to overlap, with the time stamps
+// moved to the end of the slot (Tgres tracks end of slots). Ghosts
+// are dropped. The result is not sorted.
+func mergeArchives(archs []archiveInfo, points []archive, overlap overlapRule) archive {
+	var result archive
 
-		if len(points) > 0 {
+	var used []usedSlot // the points with data so far
+	var maxStep uint32
 
-			sort.Sort(archive(points))
+	spanEnd := uint32(0)
+	for i, arch := range archs {
+		var last uint32
+		for _, p := range points[i] {
+			if p.TimeStamp > last {
+				last = p.TimeStamp
+			}
+		}
+		if last == 0 {
+			continue // empty archive
+		}
+		last += arch.Step
+		start := last - arch.Step*arch.Size
 
-			last := points[len(points)-1].TimeStamp
-			if last == 0 {
-				continue // empty archive
+		var kept []usedSlot
+		for _, p := range points[i] {
+			if p.TimeStamp == 0 {
+				continue
+			}
+			end := p.TimeStamp + arch.Step
+			if end <= start || end > last {
+				continue // a ghost
+			}
+			switch overlap {
+			case overlapSpan:
+				if spanEnd != 0 && end > spanEnd {
+					continue
+				}
+			case overlapFinest:
+				if finerData(used, maxStep, end-arch.Step, end) {
+					continue
+				}
+			}
+			if math.IsNaN(p.Value) {
+				if overlap == overlapFinest {
+					continue // as if missing, a coarser archive may have it
+				}
+			} else {
+				kept = append(kept, usedSlot{end, arch.Step})
 			}
+			result = append(result, point{TimeStamp: end, Value: p.Value})
+		}
 
-			last += arch.Step // Tgres tracks end of slots
+		// Only add now, the points of an archive do not overlap
+		// each other.
+		used = append(used, kept...)
+		sort.Slice(used, func(i, j int) bool { return used[i].end < used[j].end })
+		if arch.Step > maxStep {
+			maxStep = arch.Step
+		}
+		spanEnd = start
+	}
+	return result
+}
 
-			start = last - uint32(span.Seconds())
+// A slot of a whisper archive by its end, for mergeArchives.
+type usedSlot struct{ end, step uint32 }
 
-			if end == 0 {
-				end = last
-			} // else end is the last start
+// Whether any of used (sorted by end) covers some of the time after
+// from up to to. maxStep is the largest step among them.
+func finerData(used []usedSlot, maxStep, from, to uint32) bool {
+	n := sort.Search(len(used), func(i int) bool { return used[i].end > from })
+	for ; n < len(used) && used[n].end < to+maxStep; n++ {
+		if used[n].end-used[n].step < to {
+			return true
+		}
+	}
+	return false
+}
 
-			// select points > start
-			for _, p := range points {
-				p.TimeStamp += arch.Step // Tgres tracks end of slots
-				if p.TimeStamp >= start && p.TimeStamp < end {
-					allPoints = append(allPoints, p)
-				}
+// archivesToRRAs replaces the data of every RRA of ds with that of
+// the whisper archive of the same step and size, without any
+// consolidation. An RRA without one gets the points of the coarsest
+// archive whose step divides its own, consolidated with cf (nil
+// means the function of the RRA). Like in processSegment, the DS and
+// the RRAs are fresh copies, except that latest and last update are
+// those of the whisper data. Returns the number of RRAs without a
+// usable archive, these are left empty (and thus unchanged in the
+// db).
+func archivesToRRAs(ds *serde.DbDataSource, wsp *whisper, cf *rrd.Consolidation) int {
+	var lastUpdate time.Time
+	missing := 0
+
+	rras := ds.RRAs()
+	for _, rra := range rras {
+		dbrra := rra.(*serde.DbRoundRobinArchive)
+
+		spec := dbrra.Spec() // has no latest or data
+		spec.Xff = 0
+
+		if n := matchingArchive(wsp.header, rra.Step(), rra.Size()); n >= 0 {
+			points, _ := wsp.dumpArchive(n)
+			spec.Latest, spec.DPs = archiveToDps(points, rra.Step(), rra.Size())
+		} else if n = consolidatingArchive(wsp.header, rra.Step()); n >= 0 {
+			points, _ := wsp.dumpArchive(n)
+			arch := wsp.header.archives[n]
+			fn := spec.Function
+			if cf != nil {
+				fn = *cf
 			}
-			end = start
+			spec.Latest, spec.DPs = consolidateArchive(points, time.Duration(arch.Step)*time.Second, int64(arch.Size), rra.Step(), rra.Size(), fn)
+		} else {
+			missing++
 		}
+		if spec.Latest.After(lastUpdate) {
+			lastUpdate = spec.Latest
+		}
+
+		dbrra.RoundRobinArchiver = rrd.NewRoundRobinArchive(spec)
 	}
 
-	processArchivePoints(ds, allPoints)
+	dssp := ds.Spec()
+	dssp.RRAs = nil
+	dssp.LastUpdate = lastUpdate
+	ds.DataSourcer = rrd.NewDataSource(dssp)
+	ds.SetRRAs(rras)
+
+	return missing
+}
+
+// Index of the archive with the given step and size or -1.
+func matchingArchive(h *header, step time.Duration, size int64) int {
+	for i, arch := range h.archives {
+		if time.Duration(arch.Step)*time.Second == step && int64(arch.Size) == size {
+			return i
+		}
+	}
+	return -1
+}
+
+// Index of the coarsest archive whose step divides step, i.e. which
+// can be consolidated into it, or -1.
+func consolidatingArchive(h *header, step time.Duration) int {
+	n := -1
+	for i, arch := range h.archives {
+		s := time.Duration(arch.Step) * time.Second
+		if s > 0 && step%s == 0 && (n == -1 || arch.Step > h.archives[n].Step) {
+			n = i
+		}
+	}
+	return n
+}
+
+// Like archiveToDps, but the points of an archive of step fine and
+// size fineSize are consolidated into the slots of step with cf,
+// using the PDP arithmetic of the RRAs. Sum adds up the values (which
+// in whisper are per slot, not per second). Partially known slots
+// are consolidated from the points they have.
+func consolidateArchive(points archive, fine time.Duration, fineSize int64, step time.Duration, size int64, cf rrd.Consolidation) (time.Time, map[int64]float64) {
+	dps := make(map[int64]float64)
+
+	var last uint32
+	for _, p := range points {
+		if p.TimeStamp > last {
+			last = p.TimeStamp
+		}
+	}
+	if last == 0 {
+		return time.Time{}, dps // empty archive
+	}
+
+	// Tgres tracks end of slots, a fine slot is in the slot
+	// ending at or after its end.
+	slotEnd := func(ts time.Time) time.Time {
+		end := ts.Truncate(step)
+		if end.Before(ts) {
+			end = end.Add(step)
+		}
+		return end
+	}
+	fineLatest := time.Unix(int64(last), 0).Add(fine)
+	fineBegin := fineLatest.Add(-time.Duration(fineSize) * fine)
+	latest := slotEnd(fineLatest)
+	begin := latest.Add(-time.Duration(size) * step)
+
+	sorted := make(archive, len(points))
+	copy(sorted, points)
+	sort.Sort(sorted) // for last
+
+	pdps := make(map[int64]*rrd.Pdp)
+	for _, p := range sorted {
+		if p.TimeStamp == 0 {
+			continue
+		}
+		ts := time.Unix(int64(p.TimeStamp), 0).Add(fine)
+		if !ts.After(fineBegin) || ts.After(fineLatest) {
+			continue // a ghost
+		}
+		end := slotEnd(ts)
+		if !end.After(begin) {
+			continue
+		}
+		i := rrd.SlotIndex(end, step, size)
+		pdp := pdps[i]
+		if pdp == nil {
+			pdp = &rrd.Pdp{}
+			pdps[i] = pdp
+		}
+		switch cf {
+		case rrd.WMEAN:
+			pdp.AddValue(p.Value, fine)
+		case rrd.MAX:
+			pdp.AddValueMax(p.Value, fine)
+		case rrd.MIN:
+			pdp.AddValueMin(p.Value, fine)
+		case rrd.LAST:
+			pdp.AddValueLast(p.Value, fine)
+		case rrd.SUM:
+			pdp.AddValueSum(p.Value/fine.Seconds(), fine)
+		}
+	}
+	for i, pdp := range pdps {
+		if v := pdp.Value(); !math.IsNaN(v) {
+			dps[i] = v
+		}
+	}
+	return latest, dps
+}
+
+// Converts whisper archive points to RRA data points keyed by slot
+// index, along with the RRA latest. Ghost points (from a previous
+// round) are those outside of the span ending with the most recent
+// point.
+func archiveToDps(points archive, step time.Duration, size int64) (time.Time, map[int64]float64) {
+	dps := make(map[int64]float64)
+
+	var last uint32
+	for _, p := range points {
+		if p.TimeStamp > last {
+			last = p.TimeStamp
+		}
+	}
+	if last == 0 {
+		return time.Time{}, dps // empty archive
+	}
+
+	// Tgres tracks end of slots
+	latest := time.Unix(int64(last), 0).Add(step)
+	begin := latest.Add(-time.Duration(size) * step)
+
+	for _, p := range points {
+		if p.TimeStamp == 0 {
+			continue
+		}
+		ts := time.Unix(int64(p.TimeStamp), 0).Add(step)
+		if ts.After(begin) && !ts.After(latest) {
+			dps[rrd.SlotIndex(ts, step, size)] = p.Value
+		}
+	}
+	return latest, dps
 }
 
-func processArchivePoints(ds rrd.DataSourcer, points archive) {
+// Points not after since are skipped (since can be zero).
+func processArchivePoints(ds rrd.DataSourcer, points archive, since time.Time) {
 	n := 0
 	sort.Sort(points)
 	var begin, end time.Time
 	for _, p := range points {
 		if p.TimeStamp != 0 {
 			ts := time.Unix(int64(p.TimeStamp), 0)
-			if ts.After(ds.LastUpdate()) {
+			if ts.After(ds.LastUpdate()) && ts.After(since) {
 				ds.ProcessDataPoint(p.Value, ts)
 				n++
 
@@ -470,6 +868,7 @@ func specFromStr(text string, step, hb int) (*rrd.DSSpec, error) {
 			Step:     r.Step,
 			Span:     r.Span,
 			Xff:      float32(r.Xff),
+			RollUp:   r.RollUp,
 		}
 	}
 	return spec, nil
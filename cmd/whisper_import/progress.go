@@ -0,0 +1,62 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// reportProgress periodically prints how many files have been
+// processed, the points written so far and the current throughput,
+// along with an ETA. Because the files vary greatly in size, the rate
+// is smoothed (exponentially weighted) across reports.
+func reportProgress(interval time.Duration) {
+	var (
+		lastFiles, lastPoints int
+		fileRate, pointRate   float64
+		last                  = time.Now()
+	)
+
+	for range time.NewTicker(interval).C {
+		stats.Lock()
+		files, total, points := stats.filesDone, stats.filesTotal, stats.totalPoints
+		stats.Unlock()
+
+		now := time.Now()
+		secs := now.Sub(last).Seconds()
+		fr, pr := float64(files-lastFiles)/secs, float64(points-lastPoints)/secs
+		if fileRate == 0 && pointRate == 0 {
+			fileRate, pointRate = fr, pr // first report
+		} else {
+			fileRate, pointRate = 0.3*fr+0.7*fileRate, 0.3*pr+0.7*pointRate
+		}
+		lastFiles, lastPoints, last = files, points, now
+
+		pct, eta := float64(0), "unknown"
+		if total > 0 {
+			pct = float64(files) * 100 / float64(total)
+		}
+		if files >= total {
+			eta = "n/a"
+		} else if fileRate > 0 {
+			eta = (time.Duration(float64(total-files)/fileRate) * time.Second).String()
+		}
+
+		fmt.Printf("PROGRESS: %d of %d files (%.1f%%), %d points written, %.1f files/s, %.0f points/s, ETA: %s\n",
+			files, total, pct, points, fileRate, pointRate, eta)
+	}
+}
@@ -16,18 +16,29 @@
 package daemon
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
@@ -37,22 +48,81 @@ type Config struct { // Needs to be exported for TOML to work
 	LogPath                  string   `toml:"log-file"`
 	LogCycle                 duration `toml:"log-cycle-interval"`
 	DbConnectString          string   `toml:"db-connect-string"`
+	DbReplicaConnectString   string   `toml:"db-read-replica-connect-string"`
 	PgSegmentWidth           int      `toml:"pg-segment-width"`
+	PgPlacement              string   `toml:"pg-placement"`
+	PgPlacementSegments      int      `toml:"pg-placement-segments"`
+	PgFlushRetries           int      `toml:"pg-flush-retries"`
+	PgFlushRetryDelay        duration `toml:"pg-flush-retry-delay"`
+	PgNaNValue               string   `toml:"pg-nan-value"`
+	PgRejectInf              bool     `toml:"pg-reject-inf"`
 	MinStep                  duration `toml:"min-step"`
 	MaxReceiverQueueSize     int      `toml:"max-receiver-queue-size"`
 	MaxMemoryBytes           int      `toml:"max-memory-bytes"`
+	MaxFlushBacklog          int      `toml:"max-flush-backlog"`
+	WALDir                   string   `toml:"wal-dir"`
+	WALCheckpoint            duration `toml:"wal-checkpoint-interval"`
+	WALRetain                duration `toml:"wal-retain"`
+	TeeGraphiteAddr          string   `toml:"tee-graphite-addr"`
+	TeeGraphiteBuffer        int      `toml:"tee-graphite-buffer"`
+	MaxFutureSkew            duration `toml:"max-future-skew"`
+	DedupWindow              duration `toml:"dedup-window"`
+	DedupMaxPoints           int      `toml:"dedup-max-points"`
 	GraphiteTextListenSpec   string   `toml:"graphite-text-listen-spec"`
 	GraphiteUdpListenSpec    string   `toml:"graphite-udp-listen-spec"`
 	GraphitePickleListenSpec string   `toml:"graphite-pickle-listen-spec"`
+	GraphiteTextTags         bool     `toml:"graphite-text-tags"`
+	GraphiteTextIdleTimeout  duration `toml:"graphite-text-idle-timeout"`
+	GraphiteTextMaxLine      int      `toml:"graphite-text-max-line-length"`
 	StatsdTextListenSpec     string   `toml:"statsd-text-listen-spec"`
 	StatsdUdpListenSpec      string   `toml:"statsd-udp-listen-spec"`
+	UdpReadBuffer            int      `toml:"udp-read-buffer"`
+	UdpReaders               int      `toml:"udp-readers"`
 	HttpListenSpec           string   `toml:"http-listen-spec"`
 	HttpAllowOrigin          string   `toml:"http-allow-origin"`
+	HttpCorsOrigins          []string `toml:"http-cors-origins"`
+	HttpInternalToken        string   `toml:"http-internal-token"`
+	HttpServerTiming         bool     `toml:"http-server-timing"`
 	QueryCacheSize           int      `toml:"query-cache-size"`
+	MaxQueryDepth            int      `toml:"max-query-depth"`
+	MaxQuerySeries           int      `toml:"max-query-series"`
+	MaxSeriesPerRequest      int      `toml:"max-series-per-request"`
+	RenderDefaultRange       duration `toml:"render-default-range"`
+	RenderDefaultMaxPoints   int      `toml:"render-default-max-points"`
+	Timezone                 location `toml:"timezone"`
+	FindIndexRefresh         duration `toml:"find-index-refresh-interval"`
+	FindIndexMaxSize         int      `toml:"find-index-max-size"`
 	Workers                  int
-	DSs                      []ConfigDSSpec `toml:"ds"`
-	StatFlush                duration       `toml:"stat-flush-interval"`
-	StatsNamePrefix          string         `toml:"stats-name-prefix"`
+	Flushers                 int
+	DSs                      []ConfigDSSpec        `toml:"ds"`
+	RRATemplates             map[string]string     `toml:"rra-templates"`
+	Consolidations           []ConfigConsolidation `toml:"consolidation"`
+	StatFlush                duration              `toml:"stat-flush-interval"`
+	StatFlushAlign           duration              `toml:"stat-flush-align"`
+	StatsNamePrefix          string                `toml:"stats-name-prefix"`
+	StatSetExactLimit        int                   `toml:"stat-set-exact-limit"`
+	StatNegativeTimers       string                `toml:"stat-negative-timers"`
+	NameMunging              []string              `toml:"name-munging"`
+	NameMaxLength            int                   `toml:"name-max-length"`
+	NameAllowedChars         string                `toml:"name-allowed-chars"`
+	NameRejectLog            bool                  `toml:"name-reject-log"`
+	Cluster                  ConfigCluster         `toml:"cluster"`
+
+	rraTemplates     map[string][]ConfigRRASpec // parsed RRATemplates
+	rraTemplateLines map[string]int             // in the config file, for errors
+	clusterPins      []cluster.Pin              // parsed Cluster.Pins
+}
+
+// Needs to be exported for TOML
+type ConfigCluster struct {
+	Pins []ConfigClusterPin `toml:"pin"`
+}
+
+// The series whose name matches Regexp belong to the cluster node
+// named Node, see cluster.Pin.
+type ConfigClusterPin struct {
+	Regexp regex
+	Node   string
 }
 
 type regex struct{ *regexp.Regexp }
@@ -62,6 +132,13 @@ func (r *regex) UnmarshalText(text []byte) (err error) {
 	return err
 }
 
+type location struct{ *time.Location }
+
+func (l *location) UnmarshalText(text []byte) (err error) {
+	l.Location, err = time.LoadLocation(string(text))
+	return err
+}
+
 type duration struct{ time.Duration }
 
 func (d *duration) UnmarshalText(text []byte) (err error) {
@@ -71,21 +148,141 @@ func (d *duration) UnmarshalText(text []byte) (err error) {
 
 // Needs to be exported for TOML
 type ConfigDSSpec struct {
-	Regexp    regex
-	Step      duration
-	Heartbeat duration
-	RRAs      []ConfigRRASpec
+	Regexp       regex
+	Tags         map[string]regex
+	Step         duration
+	Heartbeat    duration
+	RRAs         []ConfigRRASpec
+	Template     string // the name of an rra-templates entry, instead of RRAs
+	Round        rounding
+	Coalesce     consolidation
+	Audit        int  // data points to keep for /internal/audit
+	WriteThrough bool `toml:"write-through"`
+}
+
+// Whether a DS named name (without tags) with tags matches: the
+// regexp, if any, must match the name and every tag regexp the value
+// of that tag, which must be present.
+func (ds *ConfigDSSpec) matches(name string, tags map[string]string) bool {
+	if ds.Regexp.Regexp != nil && !ds.Regexp.MatchString(name) {
+		return false
+	}
+	for k, re := range ds.Tags {
+		v, ok := tags[k]
+		if !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// For messages, e.g. ".*" or "^foo\. host=canary".
+func (ds *ConfigDSSpec) String() string {
+	var parts []string
+	if ds.Regexp.Regexp != nil {
+		parts = append(parts, fmt.Sprintf("%q", ds.Regexp.String()))
+	}
+	keys := make([]string, 0, len(ds.Tags))
+	for k := range ds.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", k, ds.Tags[k].String()))
+	}
+	return strings.Join(parts, " ")
+}
+
+// The name without tags and the tags of ident, which are its
+// (Graphite) name tags along with the other keys of the ident.
+func identNameTags(ident serde.Ident) (string, map[string]string) {
+	name, tags := misc.SplitTaggedName(ident["name"])
+	for k, v := range ident {
+		if k == "name" {
+			continue
+		}
+		if tags == nil {
+			tags = make(map[string]string, len(ident))
+		}
+		tags[k] = v
+	}
+	return name, tags
 }
+
 type ConfigRRASpec struct {
-	Function rrd.Consolidation
-	Step     time.Duration
-	Span     time.Duration
-	Xff      float64
+	Function   rrd.Consolidation
+	Step       time.Duration
+	Span       time.Duration
+	Xff        float64
+	RollUp     bool // consolidated from the finest RRA, see rrd.DataSource.RollUp()
+	explicitCF bool // false if Function is the default
+}
+
+// A rule for the consolidation of the RRAs of new DSs whose name
+// matches Regexp, unless the RRA spec states it.
+type ConfigConsolidation struct {
+	Regexp   regex
+	Function consolidation
+}
+
+type consolidation struct {
+	rrd.Consolidation
+	name string
+}
+
+func (c *consolidation) UnmarshalText(text []byte) (err error) {
+	c.Consolidation, err = parseConsolidation(string(text))
+	c.name = strings.ToLower(string(text))
+	return err
+}
+
+func parseConsolidation(s string) (rrd.Consolidation, error) {
+	switch strings.ToUpper(s) {
+	case "WMEAN":
+		return rrd.WMEAN, nil
+	case "MIN":
+		return rrd.MIN, nil
+	case "MAX":
+		return rrd.MAX, nil
+	case "LAST":
+		return rrd.LAST, nil
+	case "SUM":
+		return rrd.SUM, nil
+	}
+	return rrd.WMEAN, fmt.Errorf("Invalid consolidation: %q (valid funcs: wmean, min, max, last, sum)", s)
+}
+
+// Rounding of incoming values, "N" is to N decimal places, "Nsig" to
+// N significant figures.
+type rounding struct {
+	*rrd.Rounding
+}
+
+func (r *rounding) UnmarshalText(text []byte) error {
+	s := strings.ToLower(strings.TrimSpace(string(text)))
+	if s == "" {
+		return nil
+	}
+	rnd := &rrd.Rounding{}
+	if strings.HasSuffix(s, "sig") {
+		rnd.Significant = true
+		s = s[:len(s)-3]
+	}
+	var err error
+	if rnd.Digits, err = strconv.Atoi(s); err != nil || rnd.Digits < 0 || (rnd.Significant && rnd.Digits < 1) {
+		return fmt.Errorf("Invalid round: %q (must be decimal places, e.g. \"2\", or significant figures, e.g. \"3sig\")", string(text))
+	}
+	r.Rounding = rnd
+	return nil
 }
 
 func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
 	r.Xff = 0.5
-	parts := strings.SplitN(string(text), ":", 4)
+	parts := strings.Split(string(text), ":")
+	if len(parts) > 2 && strings.ToLower(parts[len(parts)-1]) == "rollup" {
+		r.RollUp = true
+		parts = parts[:len(parts)-1]
+	}
 	if len(parts) < 2 || len(parts) > 4 {
 		return fmt.Errorf("Invalid RRA specification (not enough or too many elements): %q", string(text))
 	}
@@ -94,22 +291,15 @@ func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
 	// skipping CF and default to WMEAN.
 	if len(parts[0]) > 0 && strings.Contains("0123456789", string(parts[0][0])) {
 		parts = append([]string{"WMEAN"}, parts...)
+	} else {
+		r.explicitCF = true
 	}
 
-	switch strings.ToUpper(parts[0]) {
-	case "WMEAN":
-		r.Function = rrd.WMEAN
-	case "MIN":
-		r.Function = rrd.MIN
-	case "MAX":
-		r.Function = rrd.MAX
-	case "LAST":
-		r.Function = rrd.LAST
-	default:
-		return fmt.Errorf("Invalid consolidation: %q (valid funcs: wmean, min, max, last)", parts[0])
+	var err error
+	if r.Function, err = parseConsolidation(parts[0]); err != nil {
+		return err
 	}
 
-	var err error
 	if r.Step, err = misc.BetterParseDuration(parts[1]); err != nil {
 		return fmt.Errorf("Invalid Step: %q (%v)", parts[1], err)
 	}
@@ -134,14 +324,39 @@ func (r *ConfigRRASpec) UnmarshalText(text []byte) error {
 }
 
 var readConfig = func(cfgPath string) (*Config, error) {
-	cfg := &Config{}
-	_, err := toml.DecodeFile(cfgPath, cfg)
+	text, err := ioutil.ReadFile(cfgPath)
 	if err != nil {
 		return nil, err
 	}
+	cfg := &Config{GraphiteTextTags: true}
+	if err := cfg.decode(string(text)); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// Decodes the TOML text into c, noting the lines of the rra-templates
+// entries (TOML does not keep track of those).
+func (c *Config) decode(text string) error {
+	if _, err := toml.Decode(text, c); err != nil {
+		return err
+	}
+	c.rraTemplateLines = make(map[string]int)
+	inTemplates := false
+	for n, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inTemplates = strings.Trim(line, "[] \t") == "rra-templates"
+			continue
+		}
+		if i := strings.Index(line, "="); inTemplates && i > 0 {
+			key := strings.Trim(strings.TrimSpace(line[:i]), `"'`)
+			c.rraTemplateLines[key] = n + 1
+		}
+	}
+	return nil
+}
+
 func (c *Config) processConfigPidFile(wd string) error {
 	if c.PidPath == "" {
 		return fmt.Errorf("pid-file setting empty")
@@ -202,6 +417,13 @@ func (c *Config) processDbConnectString() error {
 	if c.DbConnectString == "" {
 		return fmt.Errorf("db-connect-string empty")
 	}
+	if os.Getenv("TGRES_DB_READ_REPLICA_CONNECT") != "" {
+		c.DbReplicaConnectString = os.Getenv("TGRES_DB_READ_REPLICA_CONNECT")
+	}
+	if c.DbReplicaConnectString != "" {
+		log.Printf("Series data is queried from a read replica (db-read-replica-connect-string).")
+	}
+	serde.PgReadReplica = c.DbReplicaConnectString
 	return nil
 }
 
@@ -225,6 +447,84 @@ func (c *Config) processMaxReceiverQueueSize() error {
 	return nil
 }
 
+func (c *Config) processMaxFlushBacklog() error {
+	if c.MaxFlushBacklog == 0 {
+		log.Printf("max-flush-backlog unspecified, defaults to 0 (unlimited)")
+	} else if c.MaxFlushBacklog <= 0 {
+		log.Printf("Flush backlog is unlimited (%d) (max-flush-backlog).", c.MaxFlushBacklog)
+	} else {
+		log.Printf("Flush backlog is limited to %d data points (max-flush-backlog).", c.MaxFlushBacklog)
+	}
+	return nil
+}
+
+func (c *Config) processWAL(wd string) error {
+	if c.WALDir == "" {
+		log.Printf("wal-dir is blank, data points not yet flushed are lost on a crash.")
+		return nil
+	}
+	if !filepath.IsAbs(c.WALDir) {
+		if wd == "" {
+			return fmt.Errorf("wal-dir must be absolute path if working directory cannot be determined")
+		}
+		c.WALDir = filepath.Join(wd, c.WALDir)
+	}
+	if c.WALCheckpoint.Duration == 0 {
+		c.WALCheckpoint.Duration = time.Minute
+	}
+	if c.WALRetain.Duration == 0 {
+		c.WALRetain.Duration = 5 * time.Minute
+	}
+	if c.WALCheckpoint.Duration < 0 || c.WALRetain.Duration < 0 {
+		return fmt.Errorf("wal-checkpoint-interval and wal-retain must not be negative")
+	}
+	log.Printf("Incoming data points will be written to the WAL in '%s', a new segment every %v (wal-checkpoint-interval), kept for %v (wal-retain).",
+		c.WALDir, c.WALCheckpoint.Duration, c.WALRetain.Duration)
+	return nil
+}
+
+func (c *Config) processTee() error {
+	if c.TeeGraphiteAddr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.TeeGraphiteAddr); err != nil {
+		return fmt.Errorf("Invalid tee-graphite-addr: %v", err)
+	}
+	if c.TeeGraphiteBuffer < 0 {
+		return fmt.Errorf("Invalid tee-graphite-buffer: %d", c.TeeGraphiteBuffer)
+	} else if c.TeeGraphiteBuffer == 0 {
+		c.TeeGraphiteBuffer = 100000
+	}
+	log.Printf("Incoming data points will also be sent to %s, up to %d buffered (tee-graphite-addr, tee-graphite-buffer).",
+		c.TeeGraphiteAddr, c.TeeGraphiteBuffer)
+	return nil
+}
+
+func (c *Config) processMaxFutureSkew() error {
+	if c.MaxFutureSkew.Duration < 0 {
+		return fmt.Errorf("Invalid max-future-skew: %v", c.MaxFutureSkew.Duration)
+	} else if c.MaxFutureSkew.Duration > 0 {
+		log.Printf("Data points more than %v in the future will be discarded (max-future-skew).", c.MaxFutureSkew.Duration)
+	}
+	return nil
+}
+
+func (c *Config) processDedup() error {
+	if c.DedupWindow.Duration < 0 {
+		return fmt.Errorf("Invalid dedup-window: %v", c.DedupWindow.Duration)
+	}
+	if c.DedupMaxPoints < 0 {
+		return fmt.Errorf("Invalid dedup-max-points: %d", c.DedupMaxPoints)
+	} else if c.DedupMaxPoints == 0 {
+		c.DedupMaxPoints = 100000
+	}
+	if c.DedupWindow.Duration > 0 {
+		log.Printf("Data points repeated within %v will be discarded, remembering up to %d (dedup-window, dedup-max-points).",
+			c.DedupWindow.Duration, c.DedupMaxPoints)
+	}
+	return nil
+}
+
 func (c *Config) processMaxMemoryBytes() error {
 	if c.MaxMemoryBytes == 0 {
 		log.Printf("max-memory-bytes unspecified, defaults to 0 (unlimited)")
@@ -236,6 +536,108 @@ func (c *Config) processMaxMemoryBytes() error {
 	return nil
 }
 
+func (c *Config) processUdpReadBuffer() error {
+	if c.UdpReadBuffer < 0 {
+		return fmt.Errorf("Invalid udp-read-buffer: %d", c.UdpReadBuffer)
+	} else if c.UdpReadBuffer > 0 {
+		log.Printf("UDP read buffer (SO_RCVBUF) is %d bytes (udp-read-buffer).", c.UdpReadBuffer)
+	}
+	return nil
+}
+
+func (c *Config) processUdpReaders() error {
+	if c.UdpReaders < 0 {
+		return fmt.Errorf("Invalid udp-readers: %d", c.UdpReaders)
+	} else if c.UdpReaders == 0 {
+		c.UdpReaders = 1
+	}
+	log.Printf("Each UDP listener will be read by %d goroutine(s) (udp-readers).", c.UdpReaders)
+	return nil
+}
+
+func (c *Config) processGraphiteText() error {
+	if c.GraphiteTextIdleTimeout.Duration < 0 {
+		return fmt.Errorf("Invalid graphite-text-idle-timeout: %v", c.GraphiteTextIdleTimeout.Duration)
+	} else if c.GraphiteTextIdleTimeout.Duration == 0 {
+		c.GraphiteTextIdleTimeout.Duration = 30 * time.Second
+	}
+	if c.GraphiteTextMaxLine < 0 {
+		return fmt.Errorf("Invalid graphite-text-max-line-length: %d", c.GraphiteTextMaxLine)
+	} else if c.GraphiteTextMaxLine == 0 {
+		c.GraphiteTextMaxLine = bufio.MaxScanTokenSize
+	}
+	log.Printf("Graphite text connections will be closed after %v without a line or on a line longer than %d bytes (graphite-text-idle-timeout, graphite-text-max-line-length).",
+		c.GraphiteTextIdleTimeout.Duration, c.GraphiteTextMaxLine)
+	return nil
+}
+
+func (c *Config) processHttpInternalToken() error {
+	if os.Getenv("TGRES_HTTP_INTERNAL_TOKEN") != "" {
+		c.HttpInternalToken = os.Getenv("TGRES_HTTP_INTERNAL_TOKEN")
+	}
+	if c.HttpInternalToken != "" {
+		log.Printf("Internal HTTP endpoints (/internal/) are enabled (http-internal-token).")
+	}
+	return nil
+}
+
+func (c *Config) processHttpCorsOrigins() error {
+	for n, origin := range c.HttpCorsOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("Invalid http-cors-origins entry %q, must be * or scheme://host[:port]", origin)
+		}
+		c.HttpCorsOrigins[n] = u.Scheme + "://" + u.Host
+	}
+	if len(c.HttpCorsOrigins) > 0 {
+		log.Printf("CORS is enabled for /render and /metrics/find from: %v (http-cors-origins).", c.HttpCorsOrigins)
+	}
+	return nil
+}
+
+func (c *Config) processMaxQueryDepth() error {
+	if c.MaxQueryDepth < 0 {
+		return fmt.Errorf("Invalid max-query-depth: %d", c.MaxQueryDepth)
+	} else if c.MaxQueryDepth == 0 {
+		c.MaxQueryDepth = dsl.MaxDepth
+	}
+	log.Printf("Queries can nest function calls at most %d deep (max-query-depth).", c.MaxQueryDepth)
+	return nil
+}
+
+func (c *Config) processMaxQuerySeries() error {
+	if c.MaxQuerySeries < 0 {
+		return fmt.Errorf("Invalid max-query-series: %d", c.MaxQuerySeries)
+	} else if c.MaxQuerySeries > 0 {
+		log.Printf("A query can match at most %d series (max-query-series).", c.MaxQuerySeries)
+	}
+	return nil
+}
+
+func (c *Config) processMaxSeriesPerRequest() error {
+	if c.MaxSeriesPerRequest < 0 {
+		return fmt.Errorf("Invalid max-series-per-request: %d", c.MaxSeriesPerRequest)
+	} else if c.MaxSeriesPerRequest > 0 {
+		log.Printf("A render request can match at most %d series (max-series-per-request).", c.MaxSeriesPerRequest)
+	}
+	return nil
+}
+
+func (c *Config) processRenderDefaults() error {
+	if c.RenderDefaultRange.Duration < 0 {
+		return fmt.Errorf("Invalid render-default-range: %v", c.RenderDefaultRange.Duration)
+	} else if c.RenderDefaultRange.Duration == 0 {
+		c.RenderDefaultRange.Duration = 24 * time.Hour
+	}
+	if c.RenderDefaultMaxPoints < 0 {
+		return fmt.Errorf("Invalid render-default-max-points: %d", c.RenderDefaultMaxPoints)
+	}
+	return nil
+}
+
 func (c *Config) processPgSegmentWidth() error {
 	if c.PgSegmentWidth == 0 {
 		// do nothing and keep quiet about it since this is an "advanced" setting
@@ -248,12 +650,115 @@ func (c *Config) processPgSegmentWidth() error {
 	return nil
 }
 
+func (c *Config) processPgPlacement() error {
+	if c.PgPlacement == "" {
+		c.PgPlacement = "sequential"
+	}
+	placement, err := serde.ParsePlacement(c.PgPlacement)
+	if err != nil {
+		return fmt.Errorf("pg-placement: %v", err)
+	}
+	if c.PgPlacementSegments < 0 {
+		return fmt.Errorf("Invalid pg-placement-segments: %d", c.PgPlacementSegments)
+	} else if c.PgPlacementSegments == 0 {
+		c.PgPlacementSegments = int(serde.PgPlacementSegments)
+	}
+	serde.PgPlacement, serde.PgPlacementSegments = placement, int64(c.PgPlacementSegments)
+	if placement != serde.PlaceSequential {
+		log.Printf("New RRAs are placed %s in %d segments (pg-placement, pg-placement-segments).", c.PgPlacement, c.PgPlacementSegments)
+	}
+	return nil
+}
+
+func (c *Config) processPgFlushRetries() error {
+	if c.PgFlushRetries < -1 {
+		return fmt.Errorf("Invalid pg-flush-retries: %d", c.PgFlushRetries)
+	} else if c.PgFlushRetries == 0 {
+		c.PgFlushRetries = serde.PgFlushRetries
+	} else if c.PgFlushRetries == -1 {
+		c.PgFlushRetries = 0 // disabled
+	}
+	if c.PgFlushRetryDelay.Duration < 0 {
+		return fmt.Errorf("Invalid pg-flush-retry-delay: %v", c.PgFlushRetryDelay.Duration)
+	} else if c.PgFlushRetryDelay.Duration == 0 {
+		c.PgFlushRetryDelay.Duration = serde.PgFlushRetryDelay
+	}
+	serde.PgFlushRetries, serde.PgFlushRetryDelay = c.PgFlushRetries, c.PgFlushRetryDelay.Duration
+	log.Printf("Flushes are retried %d times starting %v apart when the database is unavailable (pg-flush-retries, pg-flush-retry-delay).",
+		c.PgFlushRetries, c.PgFlushRetryDelay.Duration)
+	return nil
+}
+
+func (c *Config) processPgNaNValue() error {
+	switch strings.ToLower(c.PgNaNValue) {
+	case "", "null":
+		serde.NaNSentinel = nil
+	default:
+		v, err := strconv.ParseFloat(c.PgNaNValue, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("Invalid pg-nan-value: %q, must be null or a finite number", c.PgNaNValue)
+		}
+		serde.NaNSentinel = &v
+		log.Printf("NaN data points are stored as %v (pg-nan-value).", v)
+	}
+	serde.RejectInf = c.PgRejectInf
+	if c.PgRejectInf {
+		log.Printf("Flushes of infinite values fail (pg-reject-inf).")
+	}
+	return nil
+}
+
+func (c *Config) processTimezone() error {
+	if c.Timezone.Location == nil {
+		c.Timezone.Location = time.UTC
+	}
+	return nil
+}
+
+func (c *Config) processFindIndexRefreshInterval() error {
+	if c.FindIndexRefresh.Duration < 0 {
+		return fmt.Errorf("Invalid find-index-refresh-interval: %v", c.FindIndexRefresh.Duration)
+	} else if c.FindIndexRefresh.Duration == 0 {
+		c.FindIndexRefresh.Duration = time.Minute
+	}
+	log.Printf("Series names will be re-read every %v (find-index-refresh-interval).", c.FindIndexRefresh.Duration)
+	return nil
+}
+
+func (c *Config) processFindIndexMaxSize() error {
+	if c.FindIndexMaxSize < 0 {
+		return fmt.Errorf("Invalid find-index-max-size: %d", c.FindIndexMaxSize)
+	} else if c.FindIndexMaxSize == 0 {
+		c.FindIndexMaxSize = 1000000
+	}
+	log.Printf("At most %d series names will be kept in memory (find-index-max-size).", c.FindIndexMaxSize)
+	return nil
+}
+
+// There are no default rules, without any [[consolidation]] all RRAs
+// not stating it are WMEAN, as they always have been.
+func (c *Config) processConsolidations() error {
+	for _, cc := range c.Consolidations {
+		if cc.Regexp.Regexp == nil {
+			return fmt.Errorf("consolidation regexp missing")
+		}
+		log.Printf("New DSs matching %q default to %s consolidation (consolidation).", cc.Regexp.String(), cc.Function.name)
+	}
+	return nil
+}
+
 func (c *Config) processStatFlushInterval() error {
 	if c.StatFlush.Duration == 0 {
 		return fmt.Errorf("stat-flush-interval is missing")
 	} else {
 		log.Printf("Stats (a la statsd) will be flushed every %v (stat-flush-interval).", c.StatFlush.Duration)
 	}
+	if c.StatFlushAlign.Duration != 0 {
+		if c.StatFlushAlign.Duration < c.StatFlush.Duration {
+			return fmt.Errorf("stat-flush-align (%v) must not be less than stat-flush-interval (%v)", c.StatFlushAlign.Duration, c.StatFlush.Duration)
+		}
+		log.Printf("Stat flushes will be aligned to every %v (stat-flush-align).", c.StatFlushAlign.Duration)
+	}
 	return nil
 }
 
@@ -266,50 +771,238 @@ func (c *Config) processStatsNamePrefix() error {
 	return nil
 }
 
+func (c *Config) processStatSetExactLimit() error {
+	switch {
+	case c.StatSetExactLimit < -1:
+		return fmt.Errorf("Invalid stat-set-exact-limit: %d", c.StatSetExactLimit)
+	case c.StatSetExactLimit == -1:
+		aggregator.SetExactLimit = 0
+	case c.StatSetExactLimit > 0:
+		aggregator.SetExactLimit = c.StatSetExactLimit
+	}
+	if aggregator.SetExactLimit > 0 {
+		log.Printf("Sets with more than %d members will be counted approximately (stat-set-exact-limit).", aggregator.SetExactLimit)
+	}
+	return nil
+}
+
+func (c *Config) processStatNegativeTimers() error {
+	switch c.StatNegativeTimers {
+	case "", "keep":
+		aggregator.NegativeAppend = aggregator.NegativeKeep
+	case "drop":
+		aggregator.NegativeAppend = aggregator.NegativeDrop
+		log.Printf("Negative timer values will be dropped (stat-negative-timers).")
+	case "clamp":
+		aggregator.NegativeAppend = aggregator.NegativeClamp
+		log.Printf("Negative timer values will be clamped to 0 (stat-negative-timers).")
+	default:
+		return fmt.Errorf("Invalid stat-negative-timers: %q (must be keep, drop or clamp)", c.StatNegativeTimers)
+	}
+	return nil
+}
+
 func (c *Config) processWorkers() error {
-	if c.Workers == 0 {
-		return fmt.Errorf("workers missing, must be an integer")
+	if c.Workers < 0 {
+		return fmt.Errorf("Invalid workers: %d", c.Workers)
+	} else if c.Workers == 0 {
+		c.Workers = runtime.NumCPU()
+		log.Printf("workers not set, defaulting to the number of CPUs.")
+	}
+	if c.Flushers < 0 {
+		return fmt.Errorf("Invalid flushers: %d", c.Flushers)
+	} else if c.Flushers == 0 {
+		c.Flushers = c.Workers * 2
+	}
+	log.Printf("Number of workers will be %d, flushers %d.", c.Workers, c.Flushers)
+	return nil
+}
+
+func (c *Config) processNameMunging() error {
+	if _, err := receiver.NameMungerChain(c.NameMunging...); err != nil {
+		return fmt.Errorf("name-munging: %v", err)
+	}
+	if len(c.NameMunging) > 0 {
+		log.Printf("Incoming names will be munged with: %s (name-munging).", strings.Join(c.NameMunging, ", "))
+	}
+	return nil
+}
+
+func (c *Config) processNameValidation() error {
+	if c.NameMaxLength < -1 {
+		return fmt.Errorf("Invalid name-max-length: %d", c.NameMaxLength)
+	} else if c.NameMaxLength == 0 {
+		c.NameMaxLength = receiver.DftNameMaxLength
+	}
+	if c.NameAllowedChars == "" {
+		c.NameAllowedChars = receiver.DftNameChars
+	}
+	if _, err := receiver.NewNameValidator(c.NameMaxLength, c.NameAllowedChars, c.NameRejectLog); err != nil {
+		return fmt.Errorf("name-allowed-chars: %v", err)
+	}
+	if c.NameMaxLength > 0 {
+		log.Printf("The names of new DSs must be at most %d long and of characters [%s] (name-max-length, name-allowed-chars).", c.NameMaxLength, c.NameAllowedChars)
+	} else {
+		log.Printf("The names of new DSs must be of characters [%s] (name-allowed-chars).", c.NameAllowedChars)
 	}
-	log.Printf("Number of workers (and flushers) will be %d.", c.Workers)
 	return nil
 }
 
+func (c *Config) processClusterPins() error {
+	c.clusterPins = nil
+	for n, pin := range c.Cluster.Pins {
+		if pin.Regexp.Regexp == nil || pin.Node == "" {
+			return fmt.Errorf("[[cluster.pin]] #%d: both regexp and node are required", n+1)
+		}
+		c.clusterPins = append(c.clusterPins, cluster.Pin{Regexp: pin.Regexp.Regexp, Node: pin.Node})
+		log.Printf("Series matching %q will be placed on cluster node %q ([[cluster.pin]]).", pin.Regexp.String(), pin.Node)
+	}
+	return nil
+}
+
+// Templates are lists of RRA specs, e.g. "10s:6h, 1m:7d, 1h:1y",
+// which DS specs can refer to by name.
+func (c *Config) processRRATemplates() error {
+	c.rraTemplates = make(map[string][]ConfigRRASpec, len(c.RRATemplates))
+	names := make([]string, 0, len(c.RRATemplates))
+	for name := range c.RRATemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var where string
+		if line, ok := c.rraTemplateLines[name]; ok {
+			where = fmt.Sprintf(" (line %d)", line)
+		}
+		var rras []ConfigRRASpec
+		for _, part := range strings.Split(c.RRATemplates[name], ",") {
+			var rra ConfigRRASpec
+			if err := rra.UnmarshalText([]byte(strings.TrimSpace(part))); err != nil {
+				return fmt.Errorf("rra-templates %q%s: %v", name, where, err)
+			}
+			rras = append(rras, rra)
+		}
+		c.rraTemplates[name] = rras
+		log.Printf("RRA template %q: %s (rra-templates).", name, c.RRATemplates[name])
+	}
+	return nil
+}
+
+// The RRAs of ds, those of its template if it has one.
+func (c *Config) dsRRAs(ds *ConfigDSSpec) []ConfigRRASpec {
+	if ds.Template != "" {
+		return c.rraTemplates[ds.Template]
+	}
+	return ds.RRAs
+}
+
 func (c *Config) processDSSpec() error {
 	// TODO validate function, regular expression, all that
 	for _, ds := range c.DSs {
+		if ds.Regexp.Regexp == nil && len(ds.Tags) == 0 {
+			return fmt.Errorf("DS spec without regexp or tags, use regexp = \".*\" to match all.")
+		}
+		if ds.Template != "" {
+			if len(ds.RRAs) > 0 {
+				return fmt.Errorf("DS %v: either rras or template %q, not both.", &ds, ds.Template)
+			}
+			if _, ok := c.rraTemplates[ds.Template]; !ok {
+				return fmt.Errorf("DS %v: no such RRA template: %q (rra-templates).", &ds, ds.Template)
+			}
+			ds.RRAs = c.dsRRAs(&ds) // of the copy, for the checks below
+		}
 		for _, rra := range ds.RRAs {
 			if (rra.Step.Nanoseconds() % c.MinStep.Nanoseconds()) != 0 {
-				return fmt.Errorf("DS %q: invalid Step (%v), must be one or multiple min-step (%v).", ds.Regexp.String(), rra.Step, c.MinStep)
+				return fmt.Errorf("DS %v: invalid Step (%v), must be one or multiple min-step (%v).", &ds, rra.Step, c.MinStep)
 			}
 			if (rra.Step.Nanoseconds() % ds.Step.Duration.Nanoseconds()) != 0 {
 				newStep := time.Duration(rra.Step.Nanoseconds()/ds.Step.Duration.Nanoseconds()*ds.Step.Duration.Nanoseconds()) * time.Nanosecond
-				log.Printf("DS %q: RRA step (%v) is not a multiple of DS Step (%v), auto adjusting Step to %v.", ds.Regexp.String(), rra.Step, ds.Step.Duration, newStep)
+				log.Printf("DS %v: RRA step (%v) is not a multiple of DS Step (%v), auto adjusting Step to %v.", &ds, rra.Step, ds.Step.Duration, newStep)
 				if newStep.Nanoseconds() == 0 {
-					return fmt.Errorf("DS %q: invalid Step (%v)", ds.Regexp.String(), newStep)
+					return fmt.Errorf("DS %v: invalid Step (%v)", &ds, newStep)
 				}
 				rra.Step = newStep
 			}
 		}
+		if err := checkRollUps(&ds); err != nil {
+			return err
+		}
+		if ds.Coalesce.Consolidation == rrd.SUM {
+			return fmt.Errorf("DS %v: invalid coalesce: sum (valid: wmean, min, max, last)", &ds)
+		}
+		if ds.Audit < 0 {
+			return fmt.Errorf("DS %v: invalid audit: %d", &ds, ds.Audit)
+		}
 	}
 	// TODO xff?
 	return nil
 }
 
+// A roll-up RRA is consolidated from the RRA with the smallest step of
+// those which are not, its step must be a (greater) multiple of it.
+func checkRollUps(ds *ConfigDSSpec) error {
+	var src *ConfigRRASpec
+	for i, rra := range ds.RRAs {
+		if !rra.RollUp && (src == nil || rra.Step < src.Step) {
+			src = &ds.RRAs[i]
+		}
+	}
+	for _, rra := range ds.RRAs {
+		if !rra.RollUp {
+			continue
+		}
+		if src == nil {
+			return fmt.Errorf("DS %v: a rollup RRA needs an RRA which is not to roll up from.", ds)
+		}
+		if rra.Step <= src.Step || rra.Step%src.Step != 0 {
+			return fmt.Errorf("DS %v: rollup RRA step (%v) must be a multiple of the finest RRA step (%v).", ds, rra.Step, src.Step)
+		}
+	}
+	return nil
+}
+
+// FindMatchingDSSpec returns the spec of the first [[ds]] rule
+// matching ident, in the order of the config file, regardless of
+// whether it matches the name or the tags (or both), which means that
+// more specific rules must come first.
 func (c *Config) FindMatchingDSSpec(ident serde.Ident) *rrd.DSSpec {
+	name, tags := identNameTags(ident)
 	for _, dsSpec := range c.DSs {
-		name := ident["name"]
-		if dsSpec.Regexp.Regexp.MatchString(name) {
-			return convertDSSpec(&dsSpec)
+		if dsSpec.matches(name, tags) {
+			dsSpec.RRAs = c.dsRRAs(&dsSpec) // the template, if any
+			spec := convertDSSpec(&dsSpec)
+			if cf, ok := c.consolidationFor(name); ok {
+				for i, r := range dsSpec.RRAs {
+					if !r.explicitCF {
+						spec.RRAs[i].Function = cf
+					}
+				}
+			}
+			return spec
 		}
 	}
 	return nil
 }
 
+// The consolidation of the first rule matching name.
+func (c *Config) consolidationFor(name string) (rrd.Consolidation, bool) {
+	for _, cc := range c.Consolidations {
+		if cc.Regexp.Regexp.MatchString(name) {
+			return cc.Function.Consolidation, true
+		}
+	}
+	return rrd.WMEAN, false
+}
+
 func convertDSSpec(dsSpec *ConfigDSSpec) *rrd.DSSpec {
 	serdeDSSpec := &rrd.DSSpec{
-		Step:      dsSpec.Step.Duration,
-		Heartbeat: dsSpec.Heartbeat.Duration,
-		RRAs:      make([]rrd.RRASpec, len(dsSpec.RRAs)),
+		Step:         dsSpec.Step.Duration,
+		Heartbeat:    dsSpec.Heartbeat.Duration,
+		RRAs:         make([]rrd.RRASpec, len(dsSpec.RRAs)),
+		Round:        dsSpec.Round.Rounding,
+		Coalesce:     dsSpec.Coalesce.Consolidation,
+		Audit:        dsSpec.Audit,
+		WriteThrough: dsSpec.WriteThrough,
 	}
 	for i, r := range dsSpec.RRAs {
 		serdeDSSpec.RRAs[i] = rrd.RRASpec{
@@ -317,6 +1010,7 @@ func convertDSSpec(dsSpec *ConfigDSSpec) *rrd.DSSpec {
 			Step:     r.Step,
 			Span:     r.Span,
 			Xff:      float32(r.Xff),
+			RollUp:   r.RollUp,
 		}
 	}
 	return serdeDSSpec
@@ -330,10 +1024,37 @@ type configer interface {
 	processMinStep() error
 	processMaxReceiverQueueSize() error
 	processMaxMemoryBytes() error
+	processMaxFlushBacklog() error
+	processWAL(wd string) error
+	processTee() error
+	processMaxFutureSkew() error
+	processDedup() error
+	processUdpReadBuffer() error
+	processUdpReaders() error
+	processGraphiteText() error
+	processHttpInternalToken() error
+	processHttpCorsOrigins() error
+	processMaxQueryDepth() error
+	processMaxQuerySeries() error
+	processMaxSeriesPerRequest() error
+	processRenderDefaults() error
+	processTimezone() error
+	processFindIndexRefreshInterval() error
+	processFindIndexMaxSize() error
+	processConsolidations() error
 	processPgSegmentWidth() error
+	processPgPlacement() error
+	processPgFlushRetries() error
+	processPgNaNValue() error
 	processStatFlushInterval() error
 	processStatsNamePrefix() error
+	processStatSetExactLimit() error
+	processStatNegativeTimers() error
 	processWorkers() error
+	processNameMunging() error
+	processNameValidation() error
+	processClusterPins() error
+	processRRATemplates() error
 	processDSSpec() error
 }
 
@@ -357,21 +1078,102 @@ var processConfig = func(c configer, wd string) error {
 	if err := c.processMaxReceiverQueueSize(); err != nil {
 		return err
 	}
+	if err := c.processMaxFlushBacklog(); err != nil {
+		return err
+	}
+	if err := c.processWAL(wd); err != nil {
+		return err
+	}
+	if err := c.processTee(); err != nil {
+		return err
+	}
+	if err := c.processMaxFutureSkew(); err != nil {
+		return err
+	}
+	if err := c.processDedup(); err != nil {
+		return err
+	}
 	if err := c.processMaxMemoryBytes(); err != nil {
 		return err
 	}
+	if err := c.processUdpReadBuffer(); err != nil {
+		return err
+	}
+	if err := c.processUdpReaders(); err != nil {
+		return err
+	}
+	if err := c.processGraphiteText(); err != nil {
+		return err
+	}
+	if err := c.processHttpInternalToken(); err != nil {
+		return err
+	}
+	if err := c.processHttpCorsOrigins(); err != nil {
+		return err
+	}
+	if err := c.processMaxQueryDepth(); err != nil {
+		return err
+	}
+	if err := c.processMaxQuerySeries(); err != nil {
+		return err
+	}
+	if err := c.processMaxSeriesPerRequest(); err != nil {
+		return err
+	}
+	if err := c.processRenderDefaults(); err != nil {
+		return err
+	}
+	if err := c.processTimezone(); err != nil {
+		return err
+	}
+	if err := c.processFindIndexRefreshInterval(); err != nil {
+		return err
+	}
+	if err := c.processFindIndexMaxSize(); err != nil {
+		return err
+	}
+	if err := c.processConsolidations(); err != nil {
+		return err
+	}
 	if err := c.processPgSegmentWidth(); err != nil {
 		return err
 	}
+	if err := c.processPgPlacement(); err != nil {
+		return err
+	}
+	if err := c.processPgFlushRetries(); err != nil {
+		return err
+	}
+	if err := c.processPgNaNValue(); err != nil {
+		return err
+	}
 	if err := c.processStatFlushInterval(); err != nil {
 		return err
 	}
 	if err := c.processStatsNamePrefix(); err != nil {
 		return err
 	}
+	if err := c.processStatSetExactLimit(); err != nil {
+		return err
+	}
+	if err := c.processStatNegativeTimers(); err != nil {
+		return err
+	}
 	if err := c.processWorkers(); err != nil {
 		return err
 	}
+	if err := c.processNameMunging(); err != nil {
+		return err
+	}
+	if err := c.processNameValidation(); err != nil {
+		return err
+	}
+	if err := c.processClusterPins(); err != nil {
+		return err
+	}
+	if err := c.processRRATemplates(); err != nil {
+		return err
+	}
 	if err := c.processDSSpec(); err != nil {
 		return err
 	}
@@ -0,0 +1,441 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_Config_consolidation(t *testing.T) {
+	cfg := &Config{}
+	if _, err := toml.Decode(`
+[[ds]]
+regexp = ".*"
+step = "10s"
+heartbeat = "2h"
+rras = ["10s:6h", "max:1m:24h"]
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processConsolidations(); err != nil {
+		t.Fatal(err)
+	}
+	if spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "foo.bar.count"}); spec.RRAs[0].Function != rrd.WMEAN {
+		t.Errorf("Expected no default rules, got %v", spec.RRAs[0].Function)
+	}
+
+	if _, err := toml.Decode(`
+[[consolidation]]
+regexp = '\.count$'
+function = "sum"
+[[consolidation]]
+regexp = '\.lower$'
+function = "min"
+[[consolidation]]
+regexp = '\.upper(_\d+)?$'
+function = "max"
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processConsolidations(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, exp := range map[string][]rrd.Consolidation{
+		"foo.bar":          {rrd.WMEAN, rrd.MAX},
+		"foo.bar.count":    {rrd.SUM, rrd.MAX}, // max is explicit
+		"foo.bar.lower":    {rrd.MIN, rrd.MAX},
+		"foo.bar.upper_90": {rrd.MAX, rrd.MAX},
+	} {
+		spec := cfg.FindMatchingDSSpec(serde.Ident{"name": name})
+		for i, rra := range spec.RRAs {
+			if rra.Function != exp[i] {
+				t.Errorf("%s: RRA %d: expected consolidation %v, got %v", name, i, exp[i], rra.Function)
+			}
+		}
+	}
+
+	cfg.Consolidations = nil
+	if _, err := toml.Decode(`
+[[consolidation]]
+regexp = "^gauges\\."
+function = "last"
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processConsolidations(); err != nil {
+		t.Fatal(err)
+	}
+	if spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "gauges.foo"}); spec.RRAs[0].Function != rrd.LAST {
+		t.Errorf("Expected the configured rule to apply, got %v", spec.RRAs[0].Function)
+	}
+	if spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "foo.count"}); spec.RRAs[0].Function != rrd.WMEAN {
+		t.Errorf("Expected only the configured rules to apply, got %v", spec.RRAs[0].Function)
+	}
+
+	if _, err := toml.Decode(`
+[[consolidation]]
+regexp = "x"
+function = "median"
+`, &Config{}); err == nil {
+		t.Errorf("Expected an error for an invalid function")
+	}
+}
+
+func Test_Config_tagSpecs(t *testing.T) {
+	cfg := &Config{MinStep: duration{time.Second}}
+	if _, err := toml.Decode(`
+[[ds]]
+tags = { host = "^canary" }
+step = "1s"
+rras = ["1s:1h"]
+[[ds]]
+regexp = "^foo\\."
+tags = { dc = "east" }
+step = "5s"
+rras = ["5s:1h"]
+[[ds]]
+regexp = ".*"
+step = "10s"
+rras = ["10s:6h"]
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		ident serde.Ident
+		step  time.Duration
+	}{
+		{serde.Ident{"name": "foo.cpu"}, 10 * time.Second},
+		{serde.Ident{"name": "foo.cpu;host=canary1"}, time.Second},
+		{serde.Ident{"name": "foo.cpu", "host": "canary2"}, time.Second},
+		{serde.Ident{"name": "bar.cpu;host=web1"}, 10 * time.Second},
+		{serde.Ident{"name": "foo.cpu;dc=east"}, 5 * time.Second},
+		{serde.Ident{"name": "foo.cpu;dc=east;host=canary1"}, time.Second}, // first rule wins
+		{serde.Ident{"name": "bar.cpu;dc=east"}, 10 * time.Second},
+	} {
+		if spec := cfg.FindMatchingDSSpec(c.ident); spec == nil || spec.Step != c.step {
+			t.Errorf("%v: expected step %v, got %v", c.ident, c.step, spec)
+		}
+	}
+
+	cfg = &Config{MinStep: duration{time.Second}}
+	if _, err := toml.Decode(`
+[[ds]]
+step = "10s"
+rras = ["10s:6h"]
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processDSSpec(); err == nil {
+		t.Errorf("Expected an error for a DS spec without regexp or tags")
+	}
+}
+
+func Test_Config_rollUp(t *testing.T) {
+	cfg := &Config{MinStep: duration{10 * time.Second}}
+	if _, err := toml.Decode(`
+[[ds]]
+regexp = ".*"
+step = "10s"
+heartbeat = "2h"
+rras = ["10s:6h", "max:1m:24h:rollup", "24h:8760h:1:rollup"]
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		t.Fatal(err)
+	}
+	spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "foo"})
+	if spec.RRAs[0].RollUp || !spec.RRAs[1].RollUp || !spec.RRAs[2].RollUp {
+		t.Errorf("Expected the last two RRAs to roll up, got %v", spec.RRAs)
+	}
+	if spec.RRAs[1].Function != rrd.MAX || spec.RRAs[2].Xff != 1 || spec.RRAs[2].Step != 24*time.Hour {
+		t.Errorf("Unexpected rollup RRA specs: %v", spec.RRAs)
+	}
+
+	for _, rras := range []string{`["1m:24h:rollup"]`, `["1m:6h", "90s:24h:rollup"]`} {
+		cfg := &Config{MinStep: duration{10 * time.Second}}
+		if _, err := toml.Decode("[[ds]]\nregexp = \".*\"\nstep = \"10s\"\nrras = "+rras, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.processDSSpec(); err == nil {
+			t.Errorf("Expected an error for rras %s", rras)
+		}
+	}
+}
+
+func Test_Config_round(t *testing.T) {
+	cfg := &Config{MinStep: duration{10 * time.Second}}
+	if _, err := toml.Decode(`
+[[ds]]
+regexp = "^sensors\\."
+step = "10s"
+rras = ["10s:6h"]
+round = "3sig"
+[[ds]]
+regexp = "^temp\\."
+step = "10s"
+rras = ["10s:6h"]
+round = "1"
+[[ds]]
+regexp = ".*"
+step = "10s"
+rras = ["10s:6h"]
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		t.Fatal(err)
+	}
+	for name, exp := range map[string]*rrd.Rounding{
+		"sensors.foo": {Digits: 3, Significant: true},
+		"temp.foo":    {Digits: 1},
+		"foo":         nil,
+	} {
+		spec := cfg.FindMatchingDSSpec(serde.Ident{"name": name})
+		if (exp == nil) != (spec.Round == nil) || (exp != nil && *exp != *spec.Round) {
+			t.Errorf("%s: expected rounding %v, got %v", name, exp, spec.Round)
+		}
+	}
+
+	for _, round := range []string{"x", "-1", "0sig", "2.5"} {
+		if _, err := toml.Decode("[[ds]]\nregexp = \".*\"\nround = \""+round+"\"", &Config{}); err == nil {
+			t.Errorf("Expected an error for round %q", round)
+		}
+	}
+}
+
+func Test_Config_coalesce(t *testing.T) {
+	cfg := &Config{MinStep: duration{10 * time.Second}}
+	if _, err := toml.Decode(`
+[[ds]]
+regexp = "^gauges\\."
+step = "10s"
+rras = ["10s:6h"]
+coalesce = "last"
+[[ds]]
+regexp = ".*"
+step = "10s"
+rras = ["10s:6h"]
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		t.Fatal(err)
+	}
+	if spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "gauges.foo"}); spec.Coalesce != rrd.LAST {
+		t.Errorf("Expected LAST, got %v", spec.Coalesce)
+	}
+	if spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "foo"}); spec.Coalesce != rrd.WMEAN {
+		t.Errorf("Expected WMEAN, got %v", spec.Coalesce)
+	}
+
+	cfg = &Config{MinStep: duration{10 * time.Second}}
+	if _, err := toml.Decode("[[ds]]\nregexp = \".*\"\nstep = \"10s\"\ncoalesce = \"sum\"", cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processDSSpec(); err == nil {
+		t.Errorf("Expected an error for coalesce sum")
+	}
+}
+
+func Test_Config_writeThrough(t *testing.T) {
+	cfg := &Config{MinStep: duration{10 * time.Second}}
+	if _, err := toml.Decode(`
+[[ds]]
+regexp = "^billing\\."
+step = "10s"
+rras = ["10s:6h"]
+write-through = true
+[[ds]]
+regexp = ".*"
+step = "10s"
+rras = ["10s:6h"]
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		t.Fatal(err)
+	}
+	if spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "billing.foo"}); !spec.WriteThrough {
+		t.Errorf("Expected write-through")
+	}
+	if spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "foo"}); spec.WriteThrough {
+		t.Errorf("Expected no write-through by default")
+	}
+}
+
+func Test_Config_rraTemplates(t *testing.T) {
+	cfg := &Config{MinStep: duration{10 * time.Second}}
+	if err := cfg.decode(`
+[rra-templates]
+default = "10s:6h, 1m:168h, 1h:8760h"
+gauges = "max:10s:6h"
+
+[[ds]]
+regexp = "^gauges\\."
+step = "10s"
+template = "gauges"
+[[ds]]
+regexp = ".*"
+step = "10s"
+template = "default"
+`); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processRRATemplates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		t.Fatal(err)
+	}
+	spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "foo.bar"})
+	if len(spec.RRAs) != 3 || spec.RRAs[1].Step != time.Minute || spec.RRAs[2].Span != 365*24*time.Hour {
+		t.Errorf("Expected the default template, got %+v", spec.RRAs)
+	}
+	if spec := cfg.FindMatchingDSSpec(serde.Ident{"name": "gauges.foo"}); len(spec.RRAs) != 1 || spec.RRAs[0].Function != rrd.MAX {
+		t.Errorf("Expected the gauges template, got %+v", spec.RRAs)
+	}
+	if len(cfg.DSs[1].RRAs) != 0 {
+		t.Errorf("The template must not be expanded into the DS spec")
+	}
+
+	// Syntax errors have line numbers
+	cfg = &Config{MinStep: duration{10 * time.Second}}
+	if err := cfg.decode("[rra-templates]\ndefault = \"10s:6h\"\n\nbad = \"10s:6h, 1m\"\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processRRATemplates(); err == nil || !strings.Contains(err.Error(), `"bad" (line 4)`) {
+		t.Errorf("Expected an error on line 4, got: %v", err)
+	}
+
+	// Unknown and ambiguous templates
+	for _, ds := range []string{
+		"[[ds]]\nregexp = \".*\"\nstep = \"10s\"\ntemplate = \"nope\"",
+		"[[ds]]\nregexp = \".*\"\nstep = \"10s\"\nrras = [\"10s:6h\"]\ntemplate = \"default\"",
+	} {
+		cfg = &Config{MinStep: duration{10 * time.Second}}
+		if err := cfg.decode("[rra-templates]\ndefault = \"10s:6h\"\n" + ds); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.processRRATemplates(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.processDSSpec(); err == nil {
+			t.Errorf("Expected an error for %q", ds)
+		}
+	}
+}
+
+func Test_Config_httpCorsOrigins(t *testing.T) {
+	cfg := &Config{HttpCorsOrigins: []string{"*", "https://a.example.com/", "http://b.example.com:3000"}}
+	if err := cfg.processHttpCorsOrigins(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HttpCorsOrigins[1] != "https://a.example.com" || cfg.HttpCorsOrigins[2] != "http://b.example.com:3000" {
+		t.Errorf("Unexpected origins: %v", cfg.HttpCorsOrigins)
+	}
+	for _, origin := range []string{"a.example.com", "ftp://a.example.com", "https://a.example.com/grafana", "https://"} {
+		cfg := &Config{HttpCorsOrigins: []string{origin}}
+		if err := cfg.processHttpCorsOrigins(); err == nil {
+			t.Errorf("%s: expected an error", origin)
+		}
+	}
+}
+
+func Test_Config_graphiteText(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.processGraphiteText(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GraphiteTextIdleTimeout.Duration != 30*time.Second || cfg.GraphiteTextMaxLine != 65536 {
+		t.Errorf("Unexpected defaults: %v %d", cfg.GraphiteTextIdleTimeout.Duration, cfg.GraphiteTextMaxLine)
+	}
+	if err := (&Config{GraphiteTextMaxLine: -1}).processGraphiteText(); err == nil {
+		t.Errorf("Expected an error for a negative graphite-text-max-line-length")
+	}
+}
+
+func Test_Config_dedup(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.processDedup(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DedupWindow.Duration != 0 || cfg.DedupMaxPoints != 100000 {
+		t.Errorf("Unexpected defaults: %v %d", cfg.DedupWindow.Duration, cfg.DedupMaxPoints)
+	}
+	if err := (&Config{DedupWindow: duration{-time.Second}}).processDedup(); err == nil {
+		t.Errorf("Expected an error for a negative dedup-window")
+	}
+}
+
+func Test_Config_renderDefaults(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.processRenderDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RenderDefaultRange.Duration != 24*time.Hour || cfg.RenderDefaultMaxPoints != 0 {
+		t.Errorf("Unexpected defaults: %v %d", cfg.RenderDefaultRange.Duration, cfg.RenderDefaultMaxPoints)
+	}
+	if err := (&Config{RenderDefaultMaxPoints: -1}).processRenderDefaults(); err == nil {
+		t.Errorf("Expected an error for a negative render-default-max-points")
+	}
+}
+
+func Test_Config_timezone(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.processTimezone(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Timezone.Location != time.UTC {
+		t.Errorf("Unexpected default: %v", cfg.Timezone.Location)
+	}
+	if _, err := toml.Decode(`timezone = "Nowhere/Special"`, &Config{}); err == nil {
+		t.Errorf("Expected an error for an unknown timezone")
+	}
+}
+
+func Test_Config_clusterPins(t *testing.T) {
+	cfg := &Config{}
+	if _, err := toml.Decode(`
+[[cluster.pin]]
+regexp = '^hot\.'
+node = "10.0.0.5"
+`, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.processClusterPins(); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.clusterPins) != 1 || cfg.clusterPins[0].Node != "10.0.0.5" || !cfg.clusterPins[0].Regexp.MatchString("hot.foo") {
+		t.Errorf("Unexpected pins: %v", cfg.clusterPins)
+	}
+
+	cfg = &Config{Cluster: ConfigCluster{Pins: []ConfigClusterPin{{Node: "10.0.0.5"}}}}
+	if err := cfg.processClusterPins(); err == nil {
+		t.Errorf("Expected an error for a pin without a regexp")
+	}
+}
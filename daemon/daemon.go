@@ -32,6 +32,7 @@ import (
 	"github.com/tgres/tgres/blaster"
 	"github.com/tgres/tgres/cluster"
 	"github.com/tgres/tgres/dsl"
+	h "github.com/tgres/tgres/http"
 	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/serde"
 )
@@ -94,11 +95,12 @@ var determineClusterJoinAddress = func(join string, db serde.DbAddresser) (ips [
 	return ips, err
 }
 
-var initCluster = func(bindAddr, advAddr string, joinIps []string) (c *cluster.Cluster, err error) {
+var initCluster = func(bindAddr, advAddr string, joinIps []string, pins []cluster.Pin) (c *cluster.Cluster, err error) {
 	c, err = cluster.NewClusterBind(bindAddr, 0, advAddr, 0, 0, bindAddr)
 	if err != nil {
 		return nil, err
 	}
+	c.SetPins(pins)
 
 	if err := c.Join(joinIps); err != nil {
 		return nil, fmt.Errorf("Unable to join cluster members: %q, %v", strings.Join(joinIps, ","), err)
@@ -111,11 +113,24 @@ var createReceiver = func(cfg *Config, c *cluster.Cluster, db serde.SerDe) *rece
 	r := receiver.NewWithMaxQueue(db, receiver.MatchingDSSpecFinder(cfg), cfg.MaxReceiverQueueSize)
 	r.MinStep = cfg.MinStep.Duration
 	r.StatFlushDuration = cfg.StatFlush.Duration
+	r.StatFlushAlign = cfg.StatFlushAlign.Duration
 	r.StatsNamePrefix = cfg.StatsNamePrefix
 	r.MaxReceiverQueueSize = cfg.MaxReceiverQueueSize
 	r.MaxMemoryBytes = uint64(cfg.MaxMemoryBytes)
+	r.MaxFlushBacklog = cfg.MaxFlushBacklog
+	r.MaxFutureSkew = cfg.MaxFutureSkew.Duration
+	r.DedupWindow, r.DedupMaxPoints = cfg.DedupWindow.Duration, cfg.DedupMaxPoints
+	r.WALDir = cfg.WALDir
+	r.WALCheckpointInterval = cfg.WALCheckpoint.Duration
+	r.WALRetain = cfg.WALRetain.Duration
+	r.TeeAddr = cfg.TeeGraphiteAddr
+	r.TeeBufferSize = cfg.TeeGraphiteBuffer
 	r.ReportStats = true
 	r.NWorkers = cfg.Workers
+	r.NFlushers = cfg.Flushers
+	r.NameMunger, _ = receiver.NameMungerChain(cfg.NameMunging...) // validated in processNameMunging()
+	// validated in processNameValidation()
+	r.NameValidator, _ = receiver.NewNameValidator(cfg.NameMaxLength, cfg.NameAllowedChars, cfg.NameRejectLog)
 	r.SetCluster(c)
 	return r
 }
@@ -205,7 +220,13 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 	}
 
 	// Create and run the Service Manager
+	dsl.MaxDepth, dsl.MaxSeries = cfg.MaxQueryDepth, cfg.MaxQuerySeries
+	h.MaxSeriesPerRequest = cfg.MaxSeriesPerRequest
+	h.ServerTiming = cfg.HttpServerTiming
+	h.DefaultRenderRange, h.DefaultRenderMaxPoints = cfg.RenderDefaultRange.Duration, cfg.RenderDefaultMaxPoints
+	h.Timezone, dsl.Timezone = cfg.Timezone.Location, cfg.Timezone.Location
 	rcache := dsl.NewNamedDSFetcher(db.Fetcher(), rcvr.DsCache(), cfg.QueryCacheSize)
+	rcache.SetFindIndexMaxSize(cfg.FindIndexMaxSize)
 	serviceMgr := newServiceManager(rcvr, rcache, cfg)
 	if err := serviceMgr.run(gracefulProtos); err != nil {
 		log.Printf("Could not run the service manager: %v", err)
@@ -220,6 +241,7 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 		log.Printf("Pre-populating Named DS Fetcher...")
 		rcache.Preload()
 		log.Printf("Pre-populating Named DS Fetcher DONE.")
+		rcache.StartFindIndexRefresher(cfg.FindIndexRefresh.Duration)
 	}
 
 	// Handle graceful file descriptors
@@ -250,7 +272,7 @@ func Init(cfgPath, gracefulProtos, join string) (cfg *Config) { // not to be con
 		attempts     = 30
 	)
 	for i := 0; i < attempts; i++ {
-		c, err = initCluster(bindAddr, advAddr, joinIps)
+		c, err = initCluster(bindAddr, advAddr, joinIps, cfg.clusterPins)
 		if err != nil {
 			if i > 1 { // silence the first message
 				log.Printf("Error initializing cluster, will try again in %v (up to %v times): %v", clusterPause, attempts, err)
@@ -353,6 +375,9 @@ func gracefulRestart(rcvr *receiver.Receiver, serviceMgr *serviceManager, cfgPat
 	if join != "" {
 		args = append(args, "-join", join)
 	}
+	if !serde.PgMigrate {
+		args = append(args, "-no-migrate")
+	}
 
 	os.Unsetenv("TGRES_PROTOS")
 	env := append(os.Environ(), fmt.Sprintf("TGRES_PROTOS=%s", protos))
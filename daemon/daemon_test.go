@@ -17,14 +17,23 @@ package daemon
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/receiver"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 	"github.com/tgres/tgres/series"
+	"github.com/tgres/tgres/statsd"
 )
 
 func Test_Init(t *testing.T) {
@@ -67,7 +76,7 @@ func Test_Init(t *testing.T) {
 
 	// initCluster
 	save_initCluster := initCluster
-	initCluster = func(bindAddr, advAddr string, joinIps []string) (c *cluster.Cluster, err error) {
+	initCluster = func(bindAddr, advAddr string, joinIps []string, pins []cluster.Pin) (c *cluster.Cluster, err error) {
 		return nil, nil
 	}
 
@@ -146,3 +155,230 @@ func (f *fakeSerde) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpe
 		return serde.NewDbDataSource(0, serde.Ident{"name": "foo"}, 0, 0, rrd.NewDataSource(*receiver.DftDSSPec)), nil
 	}
 }
+
+func Test_parseProcNetUDP(t *testing.T) {
+	procNetUDP := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  103: 00000000:07D3 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 21839 2 0000000000000000 17
+  104: 0100007F:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 21840 2 0000000000000000 5
+  105: 0100007F:07D3 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 21841 2 0000000000000000 3
+`
+	drops, err := parseProcNetUDP(strings.NewReader(procNetUDP), 2003)
+	if err != nil {
+		t.Error(err)
+	}
+	if drops != 20 {
+		t.Errorf("Expected 20 drops for port 2003, got %d", drops)
+	}
+	if drops, _ := parseProcNetUDP(strings.NewReader(procNetUDP), 9999); drops != 0 {
+		t.Errorf("Expected 0 drops for port 9999, got %d", drops)
+	}
+}
+
+func Test_processDatagram(t *testing.T) {
+	var got []string
+	handle := func(line string) error {
+		stat, err := statsd.ParseStatsdPacket(line)
+		if err != nil {
+			return err
+		}
+		got = append(got, stat.Name)
+		return nil
+	}
+
+	datagram := "foo:1|c\nbad:x|c\r\nbar:2|ms\n\nbaz:3|bogus\nqux:4|g"
+	if errs := processDatagram([]byte(datagram), handle); errs != 2 {
+		t.Errorf("Expected 2 errors, got %d", errs)
+	}
+	if strings.Join(got, ",") != "foo,bar,qux" {
+		t.Errorf("Expected foo,bar,qux to be processed, got %v", got)
+	}
+}
+
+func Test_graphiteIdent(t *testing.T) {
+	name, _, _, err := parseGraphitePacket("disk.used;env=prod;dc=east;name=x 1.5 1500000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident := graphiteIdent(name, false); len(ident) != 1 || ident["name"] != name {
+		t.Errorf("Expected only the name without tags, got %v", ident)
+	}
+	ident := graphiteIdent(name, true)
+	exp := serde.Ident{"name": "disk.used;dc=east;env=prod;name=x", "dc": "east", "env": "prod"}
+	if ident.String() != exp.String() {
+		t.Errorf("Expected %v, got %v", exp, ident)
+	}
+	if ident := graphiteIdent("disk.used", true); len(ident) != 1 {
+		t.Errorf("Expected only the name of an untagged name, got %v", ident)
+	}
+}
+
+// Tagged names as received by the text listener, stored the way the
+// receiver creates their DSs, are found by seriesByTag().
+func Test_graphiteIdent_seriesByTag(t *testing.T) {
+	cfg, err := readConfigText(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.GraphiteTextTags {
+		t.Errorf("Expected graphite-text-tags to default to true")
+	}
+
+	when := time.Unix(1500000000, 0)
+	db := serde.NewMemSerDe()
+	for _, line := range []string{
+		"disk.used;dc=east;env=prod;host=db1 1 1500000000",
+		"disk.used;dc=east;env=dev;host=db2 2 1500000000",
+		"disk.used;dc=west;env=prod;host=db3 3 1500000000",
+		"disk.used 4 1500000000",
+	} {
+		name, ts, v, err := parseGraphitePacket(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds, err := db.FetchOrCreateDataSource(graphiteIdent(name, cfg.GraphiteTextTags), &rrd.DSSpec{
+			Step:      time.Minute,
+			Heartbeat: time.Hour,
+			RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.ProcessDataPoint(v, ts)
+	}
+
+	f := dsl.NewNamedDSFetcher(db, nil, 0)
+	sm, err := dsl.ParseDsl(f, `seriesByTag("name=disk.used", "env=prod", "host=~db[13]")`, when.Add(-time.Hour), when, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range sm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if exp := "[disk.used;dc=east;env=prod;host=db1 disk.used;dc=west;env=prod;host=db3]"; fmt.Sprint(names) != exp {
+		t.Errorf("Expected %s, got %v", exp, names)
+	}
+}
+
+// The config of the TOML text, read the way Init does.
+func readConfigText(t *testing.T, text string) (*Config, error) {
+	f, err := ioutil.TempFile("", "tgres-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(text)
+	f.Close()
+	return readConfig(f.Name())
+}
+
+func Test_readUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skipf("Cannot listen on UDP: %v", err)
+	}
+	linesCh := make(chan string, 10)
+	go readUDP(nil, "test_udp", conn, func() bool { return false }, func(line string) error {
+		linesCh <- line
+		return nil
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// neither ends with a newline, they must not be joined
+	client.Write([]byte("a 1 -1\nb 2 -1"))
+	client.Write([]byte("c 3 -1"))
+
+	var lines []string
+	for len(lines) < 3 {
+		select {
+		case line := <-linesCh:
+			lines = append(lines, line)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out, got %v", lines)
+		}
+	}
+	if strings.Join(lines, ",") != "a 1 -1,b 2 -1,c 3 -1" {
+		t.Errorf("Unexpected lines: %q", lines)
+	}
+	conn.Close()
+}
+
+func Test_allowCors(t *testing.T) {
+	handler := allowCors(func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK") }, []string{"https://a.example.com"})
+
+	for _, c := range []struct {
+		method, origin string
+		allowed        string
+		code           int
+	}{
+		{"GET", "", "", 200},
+		{"GET", "https://b.example.com", "", 200},
+		{"GET", "https://a.example.com", "https://a.example.com", 200},
+		{"OPTIONS", "https://a.example.com", "https://a.example.com", 204},
+	} {
+		r := httptest.NewRequest(c.method, "/render", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != c.code || w.Header().Get("Access-Control-Allow-Origin") != c.allowed {
+			t.Errorf("%+v: unexpected %d %q", c, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if c.code == 204 && (w.Body.Len() != 0 || w.Header().Get("Access-Control-Allow-Methods") == "") {
+			t.Errorf("%+v: expected a preflight response", c)
+		}
+	}
+
+	// Disabled by default
+	r := httptest.NewRequest("GET", "/render", nil)
+	r.Header.Set("Origin", "https://a.example.com")
+	w := httptest.NewRecorder()
+	allowCors(func(w http.ResponseWriter, r *http.Request) {}, nil)(w, r)
+	if len(w.Header()) != 0 {
+		t.Errorf("Expected no CORS headers, got %v", w.Header())
+	}
+}
+
+func Test_handleGraphiteTextProtocol_limits(t *testing.T) {
+	handle := func(g *graphiteTextServiceManager, input string) (time.Duration, error) {
+		client, server := net.Pipe()
+		defer client.Close()
+		done := make(chan struct{})
+		start := time.Now()
+		go func() {
+			g.handleGraphiteTextProtocol(server)
+			close(done)
+		}()
+		var err error
+		if input != "" {
+			_, err = client.Write([]byte(input))
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the connection to be closed")
+		}
+		return time.Since(start), err
+	}
+
+	// A line too long, the write fails part of the way
+	g := &graphiteTextServiceManager{timeout: time.Minute, maxLine: 100}
+	if _, err := handle(g, strings.Repeat("x", 1000)+" 1 1500000000\n"); err == nil {
+		t.Errorf("Expected the write to fail")
+	}
+
+	// Idle
+	g = &graphiteTextServiceManager{timeout: 50 * time.Millisecond}
+	if d, _ := handle(g, ""); d < 50*time.Millisecond {
+		t.Errorf("Expected the connection to be closed after the timeout, not %v", d)
+	}
+}
@@ -35,14 +35,18 @@ type graphiteTextServiceManager struct {
 	rcvr       *receiver.Receiver
 	listenSpec string
 	udp        bool
+	tags       bool // tags of tagged names go in the ident too
 	stop       int32
 
 	// TCP
 	listener *graceful.Listener
-	timeout  time.Duration
+	timeout  time.Duration // from one line to the end of the next
+	maxLine  int           // longest line in bytes, 0 is bufio.MaxScanTokenSize
 
 	// UDP
-	conn net.Conn
+	conn       net.Conn
+	readBuffer int // SO_RCVBUF, 0 is OS default
+	readers    int // number of goroutines reading conn
 }
 
 func (g *graphiteTextServiceManager) Stop() {
@@ -108,8 +112,17 @@ func (g *graphiteTextServiceManager) startUDP(file *os.File) error {
 
 	fmt.Printf("Graphite UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
 
-	// UDP only has one connection, unlike TCP
-	go g.handleGraphiteTextProtocol(g.conn)
+	setUDPReadBuffer(g.conn, g.readBuffer)
+
+	readers := g.readers
+	if readers < 1 {
+		readers = 1
+	}
+	// UDP only has one connection, unlike TCP, which several goroutines can read
+	for i := 0; i < readers; i++ {
+		go readUDP(g.rcvr, "graphite_udp", g.conn, g.stopped, g.handleGraphiteLine)
+	}
+	go reportUDPDrops(g.rcvr, "graphite_udp", g.conn, g.stopped)
 
 	return nil
 }
@@ -176,7 +189,39 @@ func (g *graphiteTextServiceManager) graphiteTCPTextServer() error {
 	}
 }
 
-// Handles incoming requests for both TCP and UDP
+func (g *graphiteTextServiceManager) handleGraphiteLine(packetStr string) error {
+	name, ts, v, err := parseGraphitePacket(packetStr)
+	if err != nil {
+		log.Printf("handleGraphiteTextProtocol(): bad packet: %v", packetStr)
+		return err
+	}
+	g.rcvr.QueueDataPoint(graphiteIdent(name, g.tags), ts, v)
+	return nil
+}
+
+// The ident of a (sanitized) Graphite name. With tags, the tags of a
+// tagged name such as a.b;dc=east;env=prod are also keys of the
+// ident, which is what seriesByTag() searches, the name stays as is,
+// it is what Graphite calls the series. A tag called name is ignored,
+// it would clash with the name.
+func graphiteIdent(name string, tags bool) serde.Ident {
+	ident := serde.Ident{"name": name}
+	if tags {
+		_, nameTags := misc.SplitTaggedName(name)
+		for k, v := range nameTags {
+			if k != "name" {
+				ident[k] = v
+			}
+		}
+	}
+	return ident
+}
+
+// Handles incoming TCP connections. A connection is closed if the
+// next line does not arrive (all of it) within the timeout, whether it
+// is idle or sending very slowly, or if a line is longer than maxLine,
+// these are counted as the daemon.graphite_text.timeouts and
+// daemon.graphite_text.too_long stats.
 func (g *graphiteTextServiceManager) handleGraphiteTextProtocol(conn net.Conn) {
 	defer conn.Close() // decrements graceful.TcpWg
 
@@ -184,17 +229,19 @@ func (g *graphiteTextServiceManager) handleGraphiteTextProtocol(conn net.Conn) {
 		conn.SetDeadline(time.Now().Add(g.timeout))
 	}
 
-	// We use Scanner, becase it has a MaxScanTokenSize of 64K
 	connbuf := bufio.NewScanner(conn)
+	if g.maxLine > 0 {
+		// +1 for the newline, which must fit in the buffer too. A
+		// buffer with a larger capacity would raise the max.
+		max, initial := g.maxLine+1, 4096
+		if initial > max {
+			initial = max
+		}
+		connbuf.Buffer(make([]byte, 0, initial), max)
+	}
 
 	for connbuf.Scan() {
-		packetStr := connbuf.Text()
-
-		if name, ts, v, err := parseGraphitePacket(packetStr); err != nil {
-			log.Printf("handleGraphiteTextProtocol(): bad packet: %v", packetStr)
-		} else {
-			g.rcvr.QueueDataPoint(serde.Ident{"name": name}, ts, v)
-		}
+		g.handleGraphiteLine(connbuf.Text())
 
 		if g.timeout != 0 {
 			conn.SetDeadline(time.Now().Add(g.timeout))
@@ -206,12 +253,24 @@ func (g *graphiteTextServiceManager) handleGraphiteTextProtocol(conn net.Conn) {
 	}
 
 	if err := connbuf.Err(); err != nil {
-		if !strings.Contains(err.Error(), "use of closed") {
+		if err == bufio.ErrTooLong {
+			log.Printf("handleGraphiteTextProtocol(): closing connection from %v: line longer than %d bytes", conn.RemoteAddr(), g.maxLine)
+			g.countClosed("too_long")
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			g.countClosed("timeouts")
+		} else if !strings.Contains(err.Error(), "use of closed") {
 			log.Printf("handleGraphiteTextProtocol(): Error reading: %v", err)
 		}
 	}
 }
 
+// Counts a connection closed for the reason what.
+func (g *graphiteTextServiceManager) countClosed(what string) {
+	if g.rcvr != nil && g.rcvr.ReportStats {
+		g.rcvr.QueueSum(serde.Ident{"name": g.rcvr.ReportStatsPrefix + ".daemon.graphite_text." + what}, 1)
+	}
+}
+
 func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
 
 	var (
@@ -230,5 +289,5 @@ func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
 	} else {
 		t = time.Unix(tstamp, 0)
 	}
-	return misc.SanitizeName(name), t, value, nil
+	return misc.SanitizeTaggedName(name), t, value, nil
 }
@@ -21,6 +21,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"runtime"
 	"sync/atomic"
 	"time"
 
@@ -29,20 +30,34 @@ import (
 	"github.com/tgres/tgres/graceful"
 	h "github.com/tgres/tgres/http"
 	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
 )
 
-func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, origHdr string) {
+// The version of Tgres, the time it was built and the git revision
+// it was built from, set by the main package before Init(), see
+// /version.
+var Version, BuildTime, GitRevision string
+
+func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, origHdr, internalToken string, corsOrigins []string) {
 
 	// Not sure why, but we need both trailing slash and not versions. It has
 	// something to do with whether you use Grafana direct or proxy modes.
-	http.HandleFunc("/metrics/find", setOriginHdr(h.GraphiteMetricsFindHandler(rcache), origHdr))
-	http.HandleFunc("/metrics/find/", setOriginHdr(h.GraphiteMetricsFindHandler(rcache), origHdr))
-	http.HandleFunc("/render", setOriginHdr(h.GraphiteRenderHandler(rcache), origHdr))
-	http.HandleFunc("/render/", setOriginHdr(h.GraphiteRenderHandler(rcache), origHdr))
+	http.HandleFunc("/metrics/find", setOriginHdr(allowCors(h.GraphiteMetricsFindHandler(rcache), corsOrigins), origHdr))
+	http.HandleFunc("/metrics/find/", setOriginHdr(allowCors(h.GraphiteMetricsFindHandler(rcache), corsOrigins), origHdr))
+	http.HandleFunc("/render", setOriginHdr(allowCors(h.GraphiteRenderHandler(rcache), corsOrigins), origHdr))
+	http.HandleFunc("/render/", setOriginHdr(allowCors(h.GraphiteRenderHandler(rcache), corsOrigins), origHdr))
 	http.HandleFunc("/events/get_data", setOriginHdr(h.GraphiteAnnotationsHandler(rcache), origHdr))
 	http.HandleFunc("/events/get_data/", setOriginHdr(h.GraphiteAnnotationsHandler(rcache), origHdr))
+	http.HandleFunc("/events", setOriginHdr(h.GraphiteEventsHandler(rcache), origHdr))
+	http.HandleFunc("/events/", setOriginHdr(h.GraphiteEventsHandler(rcache), origHdr))
+	http.HandleFunc("/ds", setOriginHdr(h.DataSourceHandler(rcache), origHdr))
+	http.HandleFunc("/functions", setOriginHdr(h.GraphiteFunctionsHandler(), origHdr))
+	http.HandleFunc("/functions/", setOriginHdr(h.GraphiteFunctionsHandler(), origHdr))
+	http.HandleFunc("/check", setOriginHdr(h.CheckHandler(rcache), origHdr))
+	http.HandleFunc("/sparkline", setOriginHdr(h.SparklineHandler(rcache), origHdr))
 
 	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
+	http.HandleFunc("/version", setOriginHdr(h.VersionHandler(buildInfo(), rcache), origHdr))
 
 	http.HandleFunc("/pixel", h.PixelHandler(rcvr))
 	http.HandleFunc("/pixel/add", h.PixelAddHandler(rcvr))
@@ -50,6 +65,14 @@ func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl
 	http.HandleFunc("/pixel/setgauge", h.PixelSetGaugeHandler(rcvr))
 	http.HandleFunc("/pixel/append", h.PixelAppendHandler(rcvr))
 
+	if internalToken != "" {
+		http.HandleFunc("/internal/cache", h.InternalCacheHandler(rcvr, internalToken))
+		http.HandleFunc("/internal/flush", h.InternalFlushHandler(rcvr, internalToken))
+		http.HandleFunc("/internal/delete", h.InternalDeleteHandler(rcache, internalToken))
+		http.HandleFunc("/internal/ds-events", h.InternalDSEventsHandler(rcvr, internalToken))
+		http.HandleFunc("/internal/audit", h.InternalAuditHandler(rcvr, internalToken))
+	}
+
 	if rcvr.Blaster != nil {
 		http.HandleFunc("/blaster/set", h.BlasterSetHandler(rcvr.Blaster))
 	}
@@ -63,13 +86,15 @@ func httpServer(addr string, l net.Listener, rcvr *receiver.Receiver, rcache dsl
 }
 
 type wwwServer struct {
-	rcvr       *receiver.Receiver
-	rcache     dsl.NamedDSFetcher
-	blstr      *blaster.Blaster
-	listener   *graceful.Listener
-	listenSpec string
-	originHdr  string
-	stop       int32
+	rcvr          *receiver.Receiver
+	rcache        dsl.NamedDSFetcher
+	blstr         *blaster.Blaster
+	listener      *graceful.Listener
+	listenSpec    string
+	originHdr     string
+	stop          int32
+	internalToken string
+	corsOrigins   []string
 }
 
 func (g *wwwServer) File() *os.File {
@@ -120,11 +145,22 @@ func (g *wwwServer) Start(file *os.File) error {
 
 	log.Printf("HTTP protocol Listening on %s\n", processListenSpec(g.listenSpec))
 
-	go httpServer(g.listenSpec, g.listener, g.rcvr, g.rcache, g.originHdr)
+	go httpServer(g.listenSpec, g.listener, g.rcvr, g.rcache, g.originHdr, g.internalToken, g.corsOrigins)
 
 	return nil
 }
 
+func buildInfo() h.BuildInfo {
+	return h.BuildInfo{
+		Version:               Version,
+		GitRevision:           GitRevision,
+		BuildTime:             BuildTime,
+		GoVersion:             runtime.Version(),
+		ExpectedSchemaVersion: serde.SchemaVersion(),
+		Backend:               "postgres", // the only one there is, see initDb
+	}
+}
+
 func setOriginHdr(h http.HandlerFunc, hdr string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if hdr != "" {
@@ -133,3 +169,42 @@ func setOriginHdr(h http.HandlerFunc, hdr string) http.HandlerFunc {
 		h(w, r)
 	}
 }
+
+// allowCors sets the CORS headers of the requests from the origins
+// (which can include "*" for any), replacing http-allow-origin, and
+// answers their preflight (OPTIONS) requests itself. Without origins
+// it does nothing.
+func allowCors(h http.HandlerFunc, origins []string) http.HandlerFunc {
+	if len(origins) == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !corsAllowed(origin, origins) {
+			h(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			if hdrs := r.Header.Get("Access-Control-Request-Headers"); hdrs != "" {
+				w.Header().Set("Access-Control-Allow-Headers", hdrs)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "X-Tgres-DSL-Error, Server-Timing")
+		h(w, r)
+	}
+}
+
+func corsAllowed(origin string, origins []string) bool {
+	for _, o := range origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
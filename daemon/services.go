@@ -41,12 +41,12 @@ type serviceManager struct {
 func newServiceManager(rcvr *receiver.Receiver, rcache dsl.NamedDSFetcher, cfg *Config) *serviceManager {
 	return &serviceManager{rcvr: rcvr,
 		services: serviceMap{
-			"gt":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec, timeout: 30 * time.Second},
-			"gu":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec, udp: true},
+			"gt":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteTextListenSpec, timeout: cfg.GraphiteTextIdleTimeout.Duration, maxLine: cfg.GraphiteTextMaxLine, tags: cfg.GraphiteTextTags},
+			"gu":  &graphiteTextServiceManager{rcvr: rcvr, listenSpec: cfg.GraphiteUdpListenSpec, udp: true, readBuffer: cfg.UdpReadBuffer, readers: cfg.UdpReaders, tags: cfg.GraphiteTextTags},
 			"gp":  &graphitePickleServiceManager{rcvr: rcvr, listenSpec: cfg.GraphitePickleListenSpec},
 			"st":  &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdTextListenSpec, timeout: 30 * time.Second},
-			"su":  &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec, udp: true},
-			"www": &wwwServer{rcvr: rcvr, rcache: rcache, listenSpec: cfg.HttpListenSpec, originHdr: cfg.HttpAllowOrigin},
+			"su":  &statsdTextServiceManager{rcvr: rcvr, listenSpec: cfg.StatsdUdpListenSpec, udp: true, readBuffer: cfg.UdpReadBuffer, readers: cfg.UdpReaders},
+			"www": &wwwServer{rcvr: rcvr, rcache: rcache, listenSpec: cfg.HttpListenSpec, originHdr: cfg.HttpAllowOrigin, internalToken: cfg.HttpInternalToken, corsOrigins: cfg.HttpCorsOrigins},
 		},
 	}
 }
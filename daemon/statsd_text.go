@@ -41,7 +41,9 @@ type statsdTextServiceManager struct {
 	timeout  time.Duration
 
 	// UDP
-	conn net.Conn
+	conn       net.Conn
+	readBuffer int // SO_RCVBUF, 0 is OS default
+	readers    int // number of goroutines reading conn
 }
 
 func (g *statsdTextServiceManager) Stop() {
@@ -107,8 +109,17 @@ func (g *statsdTextServiceManager) startUDP(file *os.File) error {
 
 	log.Printf("Statsd UDP protocol Listening on %s\n", processListenSpec(g.listenSpec))
 
-	// for UDP timeout must be 0
-	go g.handleStatsdTextProtocol(g.conn)
+	setUDPReadBuffer(g.conn, g.readBuffer)
+
+	readers := g.readers
+	if readers < 1 {
+		readers = 1
+	}
+	// several goroutines can read the same conn
+	for i := 0; i < readers; i++ {
+		go readUDP(g.rcvr, "statsd_udp", g.conn, g.stopped, g.handleStatsdLine)
+	}
+	go reportUDPDrops(g.rcvr, "statsd_udp", g.conn, g.stopped)
 
 	return nil
 }
@@ -172,6 +183,16 @@ func (g *statsdTextServiceManager) statsdTCPTextServer() error {
 	}
 }
 
+func (g *statsdTextServiceManager) handleStatsdLine(line string) error {
+	stat, err := statsd.ParseStatsdPacket(line)
+	if err != nil {
+		log.Printf("parseStatsdPacket(): %v", err)
+		return err
+	}
+	g.rcvr.QueueAggregatorCommand(stat.AggregatorCmd())
+	return nil
+}
+
 func (g *statsdTextServiceManager) handleStatsdTextProtocol(conn net.Conn) {
 	defer conn.Close() // decrements graceful.TcpWg
 
@@ -183,11 +204,7 @@ func (g *statsdTextServiceManager) handleStatsdTextProtocol(conn net.Conn) {
 	connbuf := bufio.NewScanner(conn)
 
 	for connbuf.Scan() {
-		if stat, err := statsd.ParseStatsdPacket(connbuf.Text()); err == nil {
-			g.rcvr.QueueAggregatorCommand(stat.AggregatorCmd())
-		} else {
-			log.Printf("parseStatsdPacket(): %v", err)
-		}
+		g.handleStatsdLine(connbuf.Text())
 
 		if g.timeout != 0 {
 			conn.SetDeadline(time.Now().Add(g.timeout))
@@ -0,0 +1,176 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+// Applies udp-read-buffer (SO_RCVBUF) to a UDP listener. The kernel
+// may silently cap it (net.core.rmem_max on Linux).
+func setUDPReadBuffer(conn net.Conn, size int) {
+	if size <= 0 {
+		return
+	}
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	if err := uc.SetReadBuffer(size); err != nil {
+		log.Printf("Unable to set UDP read buffer to %d: %v", size, err)
+	}
+}
+
+// The largest possible UDP payload.
+const maxDatagramSize = 65507
+
+// Reads conn one datagram at a time until it is closed, passing every
+// line of every datagram to handle. Unlike a bufio.Scanner over conn
+// this never joins the last line of a datagram with the first of the
+// next one when there is no trailing newline. Lines handle returns an
+// error for are counted as the daemon.<name>.parse_errors stat, the
+// rest of the datagram is still processed.
+func readUDP(rcvr *receiver.Receiver, name string, conn net.Conn, stopped func() bool, handle func(string) error) {
+	defer conn.Close()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed") {
+				log.Printf("readUDP(): %s: Error reading: %v", name, err)
+			}
+			return
+		}
+		if errs := processDatagram(buf[:n], handle); errs > 0 && rcvr != nil && rcvr.ReportStats {
+			rcvr.QueueSum(serde.Ident{"name": rcvr.ReportStatsPrefix + ".daemon." + name + ".parse_errors"}, float64(errs))
+		}
+		if stopped() {
+			return
+		}
+	}
+}
+
+// Calls handle for every non-blank line of datagram and returns the
+// number of errors.
+func processDatagram(datagram []byte, handle func(string) error) (errs int) {
+	for _, line := range strings.Split(string(datagram), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if err := handle(line); err != nil {
+			errs++
+		}
+	}
+	return errs
+}
+
+// Every stat-flush-interval report the number of datagrams dropped
+// by the kernel for the port of conn since the last time as the
+// daemon.<name>.drops stat. This only works on Linux, elsewhere it
+// does nothing.
+func reportUDPDrops(rcvr *receiver.Receiver, name string, conn net.Conn, stopped func() bool) {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || rcvr == nil || !rcvr.ReportStats || rcvr.StatFlushDuration == 0 {
+		return
+	}
+
+	last, err := udpDrops(addr.Port)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Not reporting UDP drops for %s: %v", name, err)
+		}
+		return
+	}
+
+	for {
+		time.Sleep(rcvr.StatFlushDuration)
+		if stopped() {
+			return
+		}
+		drops, err := udpDrops(addr.Port)
+		if err != nil {
+			log.Printf("reportUDPDrops(): %v", err)
+			continue
+		}
+		if drops >= last { // the counter resets if the socket is recreated
+			rcvr.QueueSum(serde.Ident{"name": rcvr.ReportStatsPrefix + ".daemon." + name + ".drops"}, float64(drops-last))
+		}
+		last = drops
+	}
+}
+
+// Returns the total drops of all UDP sockets bound to port, IPv4 and
+// IPv6, as reported in /proc/net/udp[6].
+func udpDrops(port int) (int64, error) {
+	var total int64
+	for n, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if err != nil {
+			if n > 0 && os.IsNotExist(err) {
+				continue // no IPv6
+			}
+			return 0, err
+		}
+		drops, err := parseProcNetUDP(f, port)
+		f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", path, err)
+		}
+		total += drops
+	}
+	return total, nil
+}
+
+// Every line after the header describes a socket, the second field
+// is the local address as hex IP:port and the 13th is the drops.
+func parseProcNetUDP(r io.Reader, port int) (int64, error) {
+	var total int64
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		local := strings.Split(fields[1], ":")
+		if len(local) != 2 {
+			continue
+		}
+		p, err := strconv.ParseInt(local[1], 16, 32)
+		if err != nil || int(p) != port {
+			continue
+		}
+		drops, err := strconv.ParseInt(fields[12], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid drops %q: %v", fields[12], err)
+		}
+		total += drops
+	}
+	return total, scanner.Err()
+}
@@ -15,7 +15,10 @@
 
 package dsl
 
-import "github.com/tgres/tgres/series"
+import (
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
+)
 
 // A Series which supports Alias()
 type AliasSeries interface {
@@ -36,6 +39,34 @@ func (as *aliasSeries) Alias(s ...string) string {
 	return as.alias
 }
 
+func (as *aliasSeries) Consolidation(cf ...rrd.Consolidation) rrd.Consolidation {
+	return seriesConsolidation(as.Series, cf...)
+}
+
+// The consolidation of s if it is a series.Consolidator, otherwise
+// it is always the average.
+func seriesConsolidation(s series.Series, cf ...rrd.Consolidation) rrd.Consolidation {
+	if c, ok := s.(series.Consolidator); ok {
+		return c.Consolidation(cf...)
+	}
+	return rrd.WMEAN
+}
+
+// Sets the consolidation of the series in sl which still have the
+// default (the average) to the natural one of a reducer, e.g. so that
+// the points of maxSeries() are the max of the maxes rather than of
+// the averages. An explicit consolidateBy() always wins, it cannot be
+// changed from outside, and neither can that of a nested reducer.
+// (sumSeries() needs none: the points are rates, the average of the
+// sums is the sum of the averages.)
+func setNaturalConsolidation(sl *aliasSeriesSlice, cf rrd.Consolidation) {
+	for _, s := range sl.SeriesSlice {
+		if c, ok := s.(series.Consolidator); ok && c.Consolidation() == rrd.WMEAN {
+			c.Consolidation(cf)
+		}
+	}
+}
+
 type aliasSeriesSlice struct {
 	series.SeriesSlice
 	alias string
@@ -17,6 +17,7 @@ package dsl
 
 import (
 	"fmt"
+	"log"
 	"sync"
 	"time"
 
@@ -31,6 +32,7 @@ type dsLRU struct {
 	*sync.Mutex
 	db        dsFetcher
 	dl        rraDataLoader
+	rl        serde.RRALister // nil if db cannot list the RRAs of a DS
 	ch        chan DataPoint
 	dsc       watcher
 	cap       int
@@ -49,9 +51,11 @@ type DataPoint struct {
 func newDsLRU(db dsFetcher, dsc watcher, cap int) *dsLRU {
 	// If db does not provide rraDataLoader none of this is possible.
 	dl, _ := db.(rraDataLoader)
+	rl, _ := db.(serde.RRALister)
 	d := &dsLRU{
 		db:    db,
 		dl:    dl,
+		rl:    rl,
 		ch:    make(chan DataPoint, 256),
 		dsc:   dsc,
 		Mutex: &sync.Mutex{},
@@ -262,13 +266,13 @@ func (d *dsLRU) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints in
 	var wds *watchedDs
 	if wds, _ = ds.(*watchedDs); wds == nil {
 		// Not a watchedDs, fallback to non-cache behavior
-		return d.db.FetchSeries(ds, from, to, maxPoints)
+		return d.db.FetchSeries(d.planned(ds, from, to, maxPoints), from, to, maxPoints)
 	}
 
 	wds.RLock()
 	defer wds.RUnlock()
 
-	rra := wds.BestRRA(from, to, maxPoints)
+	rra := planRRA(wds.RRAs(), from, to, maxPoints)
 	if rra == nil {
 		return nil, fmt.Errorf("FetchSeries (ds_lru.go): No adequate RRA found for DS from: %v to: %v maxPoints: %v", from, to, maxPoints)
 	}
@@ -284,6 +288,123 @@ func (d *dsLRU) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints in
 	return s, nil
 }
 
+// FetchSeriesBulk serves the DSs in the LRU from memory, just like
+// FetchSeries, the rest is fetched from the db in bulk if it supports
+// it, otherwise one by one.
+func (d *dsLRU) FetchSeriesBulk(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	result := make([]series.Series, len(dss))
+	var (
+		uncached []rrd.DataSourcer
+		pos      []int
+	)
+	for n, ds := range dss {
+		if _, ok := ds.(*watchedDs); ok {
+			s, err := d.FetchSeries(ds, from, to, maxPoints)
+			if err != nil {
+				return nil, err
+			}
+			result[n] = s
+			continue
+		}
+		uncached = append(uncached, ds)
+		pos = append(pos, n)
+	}
+
+	bf, ok := d.db.(serde.BulkSeriesFetcher)
+	if !ok || len(uncached) < 2 {
+		for n, ds := range uncached {
+			s, err := d.db.FetchSeries(d.planned(ds, from, to, maxPoints), from, to, maxPoints)
+			if err != nil {
+				return nil, err
+			}
+			result[pos[n]] = s
+		}
+		return result, nil
+	}
+
+	for n, ds := range uncached {
+		uncached[n] = d.planned(ds, from, to, maxPoints)
+	}
+	sl, err := bf.FetchSeriesBulk(uncached, from, to, maxPoints)
+	if err != nil {
+		return nil, err
+	}
+	for n, s := range sl {
+		result[pos[n]] = s
+	}
+	return result, nil
+}
+
+// Returns a copy of ds with only the RRA chosen by planRRA() from the
+// RRAs as currently stored in the db, so that the choice is not based
+// on the possibly stale latest of the RRAs of a DS fetched earlier. If
+// there is nothing to choose from or db cannot list the RRAs, ds is
+// returned as is and the db chooses the RRA itself.
+func (d *dsLRU) planned(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) rrd.DataSourcer {
+	dbds, ok := ds.(serde.DbDataSourcer)
+	if d.rl == nil || !ok || len(ds.RRAs()) < 2 {
+		return ds
+	}
+	rras, err := d.rl.DataSourceRRAs(dbds.Id())
+	if err != nil {
+		log.Printf("planned(): Error listing RRAs of DS %d: %v", dbds.Id(), err)
+		return ds
+	}
+	rra := planRRA(rras, from, to, maxPoints)
+	if rra == nil {
+		return ds
+	}
+	result := ds.Copy()
+	result.SetRRAs([]rrd.RoundRobinArchiver{rra})
+	return result
+}
+
+// planRRA chooses which of rras to use for the series from..to of at
+// most maxPoints points using only the RRA metadata. Of the RRAs which
+// go back as far as from, it is the coarsest whose step still provides
+// maxPoints points, so that no more is read than can be shown, or the
+// finest if none does (or maxPoints is 0). If no RRA goes back far
+// enough, it is the one which goes back the furthest.
+func planRRA(rras []rrd.RoundRobinArchiver, from, to time.Time, maxPoints int64) rrd.RoundRobinArchiver {
+	var covering []rrd.RoundRobinArchiver
+	for _, rra := range rras {
+		// An RRA last updated before from has nothing to show, but
+		// neither has any other, so it qualifies
+		if !from.IsZero() && !from.Before(rra.Begins(rra.Latest())) || rra.Latest().Before(from) {
+			covering = append(covering, rra)
+		}
+	}
+
+	if len(covering) == 0 {
+		var longest rrd.RoundRobinArchiver
+		for _, rra := range rras {
+			if longest == nil || longest.Size()*int64(longest.Step()) < rra.Size()*int64(rra.Step()) {
+				longest = rra
+			}
+		}
+		return longest
+	}
+
+	var want time.Duration
+	if maxPoints > 0 {
+		want = to.Sub(from) / time.Duration(maxPoints)
+	}
+	var best rrd.RoundRobinArchiver
+	for _, rra := range covering {
+		switch {
+		case best == nil:
+			best = rra
+		case rra.Step() <= want:
+			if best.Step() > want || rra.Step() > best.Step() {
+				best = rra // coarser, but still fine enough
+			}
+		case best.Step() > want && rra.Step() < best.Step():
+			best = rra // too coarse, but less so
+		}
+	}
+	return best
+}
+
 type watchedDs struct {
 	rrd.DataSourcer
 	*sync.RWMutex
@@ -0,0 +1,115 @@
+package dsl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_planRRA(t *testing.T) {
+	now := time.Unix(1500000000, 0).Truncate(time.Hour)
+	rras := []rrd.RoundRobinArchiver{
+		rrd.NewRoundRobinArchive(rrd.RRASpec{Step: 10 * time.Second, Span: time.Hour, Latest: now}),
+		rrd.NewRoundRobinArchive(rrd.RRASpec{Step: time.Minute, Span: 24 * time.Hour, Latest: now}),
+		rrd.NewRoundRobinArchive(rrd.RRASpec{Step: time.Hour, Span: 30 * 24 * time.Hour, Latest: now}),
+	}
+
+	for _, c := range []struct {
+		from      time.Time
+		maxPoints int64
+		step      time.Duration
+	}{
+		{now.Add(-30 * time.Minute), 100, 10 * time.Second}, // 18s wanted
+		{now.Add(-30 * time.Minute), 10, time.Minute},       // 3m wanted, 10s would be over-fetching
+		{now.Add(-50 * time.Minute), 1, time.Minute},        // BestRRA would pick the closer 1h
+		{now.Add(-30 * time.Minute), 0, 10 * time.Second},   // finest
+		{now.Add(-2 * time.Hour), 1000, time.Minute},        // 10s does not go back far enough
+		{now.Add(-10 * 24 * time.Hour), 10, time.Hour},      // 1m does not either
+		{now.Add(-60 * 24 * time.Hour), 10, time.Hour},      // none does, the longest
+		{time.Time{}, 100, time.Hour},                       // the longest
+		{now.Add(time.Hour), 0, 10 * time.Second},           // all latest before from
+	} {
+		rra := planRRA(rras, c.from, now, c.maxPoints)
+		if rra == nil || rra.Step() != c.step {
+			t.Errorf("from %v maxPoints %d: expected step %v, got %v", now.Sub(c.from), c.maxPoints, c.step, rra)
+		}
+	}
+
+	if rra := planRRA(nil, now, now, 10); rra != nil {
+		t.Errorf("Expected nil without RRAs, got %v", rra)
+	}
+}
+
+type listingFetcher struct {
+	dsFetcherSearcher
+	rras   []rrd.RoundRobinArchiver
+	listed int
+}
+
+func (f *listingFetcher) DataSourceRRAs(id int64) ([]rrd.RoundRobinArchiver, error) {
+	f.listed++
+	return f.rras, nil
+}
+
+func Test_dsLRU_planned(t *testing.T) {
+	now := time.Unix(1500000000, 0).Truncate(time.Hour)
+	specs := []rrd.RRASpec{
+		{Step: 10 * time.Second, Span: time.Hour},
+		{Step: time.Minute, Span: 24 * time.Hour},
+	}
+	db := serde.NewMemSerDe()
+	ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "foo"}, &rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      specs,
+	})
+	one, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "bar"}, &rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      specs[:1],
+	})
+
+	// The RRAs of ds have never been updated, as far as the db
+	// knows they have been updated just now.
+	var fresh []rrd.RoundRobinArchiver
+	for _, spec := range specs {
+		spec.Latest = now
+		fresh = append(fresh, rrd.NewRoundRobinArchive(spec))
+	}
+	lf := &listingFetcher{dsFetcherSearcher: db, rras: fresh}
+	d := newDsLRU(lf, nil, 0)
+
+	// 2h ago is further back than 10s go, which the stale latest
+	// would not tell.
+	from := now.Add(-2 * time.Hour)
+	if rra := ds.BestRRA(from, now, 0); rra.Step() != 10*time.Second {
+		t.Fatalf("Expected BestRRA to pick 10s from its own metadata, got %v", rra.Step())
+	}
+	planned := d.planned(ds, from, now, 0)
+	if planned == ds || len(planned.RRAs()) != 1 || planned.RRAs()[0].Step() != time.Minute {
+		t.Errorf("Expected a copy with only the 1m RRA, got %v", planned.RRAs())
+	}
+	if planned.(serde.DbDataSourcer).Id() != ds.(serde.DbDataSourcer).Id() || len(ds.RRAs()) != 2 {
+		t.Errorf("Expected the copy to be of the same DS and ds to be unchanged")
+	}
+	if s, err := d.FetchSeries(ds, from, now, 0); err != nil || s.Step() != time.Minute {
+		t.Errorf("Expected FetchSeries to use the planned RRA, got %v %v", s, err)
+	}
+	if sl, err := d.FetchSeriesBulk([]rrd.DataSourcer{ds, ds}, from, now, 0); err != nil || len(sl) != 2 || sl[1].Step() != time.Minute {
+		t.Errorf("Expected FetchSeriesBulk to use the planned RRA, got %v %v", sl, err)
+	}
+
+	// Nothing to choose from, no need to ask
+	lf.listed = 0
+	if planned := d.planned(one, from, now, 0); planned != one || lf.listed != 0 {
+		t.Errorf("Expected a single RRA DS as is without listing, listed %d", lf.listed)
+	}
+
+	// Without a lister, as is
+	d = newDsLRU(&countingFetcher{dsFetcherSearcher: db}, nil, 0)
+	if planned := d.planned(ds, from, now, 0); planned != ds {
+		t.Errorf("Expected ds as is without an RRALister")
+	}
+}
@@ -48,6 +48,7 @@
 package dsl
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
 	"go/parser"
@@ -55,19 +56,63 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// Limits which protect the evaluator from pathological queries, such
+// as thousands of nested calls or a pattern matching every series,
+// zero means no limit. The daemon sets them from the config.
+var (
+	MaxDepth  = 64 // of nested function calls
+	MaxSeries = 0  // matched by the patterns of a single query
 )
 
+// A LimitError is returned by ParseDsl when the query exceeds
+// MaxDepth or MaxSeries.
+type LimitError struct {
+	msg string
+}
+
+func (e *LimitError) Error() string { return e.msg }
+
+// Timezone is the location of ParseDsl, in which summarize() aligns
+// its intervals (unless alignToFrom) so that e.g. days begin at the
+// local midnight. The daemon sets it from the config, the default is
+// UTC.
+var Timezone = time.UTC
+
 type dslCtx struct {
 	src       string
 	escSrc    string
 	from, to  time.Time
 	maxPoints int64
+	loc       *time.Location
+	matched   int   // series matched so far, see MaxSeries
+	limitErr  error // do not let function errors hide it
 	ctxDSFetcher
 }
 
-// Parse a DSL expression given by src and other params.
+// Parse a DSL expression given by src and other params. Any
+// template() calls in it are expanded first, see ExpandTemplates().
 func ParseDsl(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64) (SeriesMap, error) {
-	return newDslCtx(db, src, from, to, maxPoints).parse()
+	return ParseDslIn(db, src, from, to, maxPoints, Timezone)
+}
+
+// ParseDslIn is ParseDsl in the location loc instead of Timezone,
+// e.g. that of the user.
+func ParseDslIn(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64, loc *time.Location) (SeriesMap, error) {
+	src, err := ExpandTemplates(src, nil)
+	if err != nil {
+		return nil, err
+	}
+	dc := newDslCtx(db, src, from, to, maxPoints)
+	if loc != nil {
+		dc.loc = loc
+	}
+	return dc.parse()
 }
 
 func newDslCtx(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64) *dslCtx {
@@ -77,23 +122,42 @@ func newDslCtx(db ctxDSFetcher, src string, from, to time.Time, maxPoints int64)
 		from:         from,
 		to:           to,
 		maxPoints:    maxPoints,
+		loc:          Timezone,
 		ctxDSFetcher: db}
 }
 
+// A parseTimer (e.g. the sharedFetcher) is told how long parsing an
+// expression (not evaluating it) took, see sharedFetcher.Timings().
+type parseTimer interface {
+	parsedSince(start time.Time)
+}
+
 // Parse a DSL context. Returns a SeriesMap or error.
 func (dc *dslCtx) parse() (SeriesMap, error) {
 
 	// parser.ParseExpr produces an AST in accordance with Go syntax,
 	// which is just fine in our case.
+	start := time.Now()
 	tr, err := parser.ParseExpr(dc.escSrc)
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing %q: %v", dc.src, err)
 	}
 
+	depth := callDepth(tr)
+	if pt, ok := dc.ctxDSFetcher.(parseTimer); ok {
+		pt.parsedSince(start)
+	}
+	if MaxDepth > 0 && depth > MaxDepth {
+		return nil, &LimitError{fmt.Sprintf("ParseDsl(): function calls nested %d deep, the limit is %d", depth, MaxDepth)}
+	}
+
 	fv := &funcVisitor{dc, &callStack{}, nil, 0, -1, nil}
 
 	ast.Walk(fv, tr)
 
+	if dc.limitErr != nil {
+		return nil, dc.limitErr
+	}
 	if fv.err != nil {
 		return nil, fmt.Errorf("ParseDsl(): %v", fv.err)
 	}
@@ -101,6 +165,57 @@ func (dc *dslCtx) parse() (SeriesMap, error) {
 	return fv.ret, nil
 }
 
+// Returns how deep function calls are nested in the expression,
+// including chained calls.
+func callDepth(tr ast.Expr) int {
+	var (
+		depth, max int
+		calls      []bool // for every node being visited, is it a call
+	)
+	ast.Inspect(tr, func(node ast.Node) bool {
+		if node == nil { // done with the last node
+			if calls[len(calls)-1] {
+				depth--
+			}
+			calls = calls[:len(calls)-1]
+			return true
+		}
+		_, isCall := node.(*ast.CallExpr)
+		if isCall {
+			if depth++; depth > max {
+				max = depth
+			}
+		}
+		calls = append(calls, isCall)
+		return true
+	})
+	return max
+}
+
+// A seriesCounter counts the DSs matched by all the queries using it
+// (e.g. those of a single /render request), returning a LimitError
+// once there are too many, see sharedFetcher.SetMaxSeries().
+type seriesCounter interface {
+	countSeries(idents map[string]serde.Ident) error
+}
+
+// Counts n more matched series (of idents) against MaxSeries, and
+// idents against the limit of the fetcher, if it is a seriesCounter.
+func (dc *dslCtx) countSeries(idents map[string]serde.Ident, n int) error {
+	dc.matched += n
+	if MaxSeries > 0 && dc.matched > MaxSeries {
+		dc.limitErr = &LimitError{fmt.Sprintf("ParseDsl(): the query matches more than %d series", MaxSeries)}
+		return dc.limitErr
+	}
+	if sc, ok := dc.ctxDSFetcher.(seriesCounter); ok {
+		if err := sc.countSeries(idents); err != nil {
+			dc.limitErr = err
+			return err
+		}
+	}
+	return nil
+}
+
 func (dc *dslCtx) seriesFromSeriesOrIdent(what interface{}) (SeriesMap, error) {
 	switch obj := what.(type) {
 	case SeriesMap:
@@ -112,8 +227,18 @@ func (dc *dslCtx) seriesFromSeriesOrIdent(what interface{}) (SeriesMap, error) {
 }
 
 func (dc *dslCtx) seriesFromPattern(pattern string, from, to time.Time) (SeriesMap, error) {
-	idents := dc.identsFromPattern(pattern)
-	result := make(SeriesMap)
+	return dc.seriesFromIdents(dc.identsFromPattern(pattern), from, to)
+}
+
+// The series of idents, by name, see identsFromPattern().
+func (dc *dslCtx) seriesFromIdents(idents map[string]serde.Ident, from, to time.Time) (SeriesMap, error) {
+	if err := dc.countSeries(idents, len(idents)); err != nil {
+		return nil, err
+	}
+	var (
+		names []string
+		dss   []rrd.DataSourcer
+	)
 	for name, ident := range idents {
 		ds, err := dc.FetchOrCreateDataSource(ident, nil)
 		if err != nil {
@@ -124,11 +249,36 @@ func (dc *dslCtx) seriesFromPattern(pattern string, from, to time.Time) (SeriesM
 			// TODO: The DSL should support warnings, this is a good case for it
 			continue
 		}
-		dps, err := dc.FetchSeries(ds, from, to, dc.maxPoints)
+		names = append(names, name)
+		dss = append(dss, ds)
+	}
+
+	sl, err := dc.fetchSeriesList(dss, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("seriesFromPattern(): Error %v", err)
+	}
+
+	result := make(SeriesMap)
+	for n, name := range names {
+		result[name] = &aliasSeries{Series: sl[n]}
+	}
+	return result, nil
+}
+
+// Fetches the series of all of dss at once if the fetcher supports
+// it, which avoids a database query per DS for patterns matching
+// many series, otherwise one by one.
+func (dc *dslCtx) fetchSeriesList(dss []rrd.DataSourcer, from, to time.Time) ([]series.Series, error) {
+	if bf, ok := dc.ctxDSFetcher.(serde.BulkSeriesFetcher); ok && len(dss) > 1 {
+		return bf.FetchSeriesBulk(dss, from, to, dc.maxPoints)
+	}
+	result := make([]series.Series, len(dss))
+	for n, ds := range dss {
+		s, err := dc.FetchSeries(ds, from, to, dc.maxPoints)
 		if err != nil {
-			return nil, fmt.Errorf("seriesFromPattern(): Error %v", err)
+			return nil, err
 		}
-		result[name] = &aliasSeries{Series: dps}
+		result[n] = s
 	}
 	return result, nil
 }
@@ -268,15 +418,59 @@ func (v *funcVisitor) Visit(node ast.Node) ast.Visitor {
 func escapeBadChars(target string) string {
 	s := strings.Replace(target, "*", "__ASTERISK__", -1)
 	s = strings.Replace(s, "=", "__ASSIGN__", -1)
+	s = escapeGlobs(s)
 	return strings.Replace(s, "-", "__DASH__", -1)
 }
 
 func unEscapeBadChars(target string) string {
 	s := strings.Replace(target, "__ASTERISK__", "*", -1)
 	s = strings.Replace(s, "__ASSIGN__", "=", -1)
+	s = strings.Replace(s, "__LBRACE__", "{", -1)
+	s = strings.Replace(s, "__RBRACE__", "}", -1)
+	s = strings.Replace(s, "__COMMA__", ",", -1)
+	s = strings.Replace(s, "__LBRACKET__", "[", -1)
+	s = strings.Replace(s, "__RBRACKET__", "]", -1)
+	s = strings.Replace(s, "__BANG__", "!", -1)
+	s = strings.Replace(s, "__CARET__", "^", -1)
 	return strings.Replace(s, "__DASH__", "-", -1)
 }
 
+// Same for curly braces and character classes in unquoted series
+// names, e.g. {web,db}.host[!0-9].cpu. Only the commas within braces
+// are escaped, the rest separate arguments.
+func escapeGlobs(target string) string {
+	var (
+		b       bytes.Buffer
+		depth   int
+		inClass bool
+	)
+	for i := 0; i < len(target); i++ {
+		switch c := target[i]; {
+		case c == '{':
+			depth++
+			b.WriteString("__LBRACE__")
+		case c == '}' && depth > 0:
+			depth--
+			b.WriteString("__RBRACE__")
+		case c == ',' && depth > 0:
+			b.WriteString("__COMMA__")
+		case c == '[':
+			inClass = true
+			b.WriteString("__LBRACKET__")
+		case c == ']' && inClass:
+			inClass = false
+			b.WriteString("__RBRACKET__")
+		case c == '!' && inClass:
+			b.WriteString("__BANG__")
+		case c == '^' && inClass:
+			b.WriteString("__CARET__")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
 // Also - there are no single quoted strings in Go grammar
 func fixQuotes(target string) string {
 	// TODO if the string contains double quotes, they should be escaped
@@ -0,0 +1,240 @@
+package dsl
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// queryCountingDb pretends that every FetchSeries() is a database
+// query.
+type queryCountingDb struct {
+	dsFetcherSearcher
+	queries int
+}
+
+func (db *queryCountingDb) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	db.queries++
+	return db.dsFetcherSearcher.FetchSeries(ds, from, to, maxPoints)
+}
+
+// bulkQueryCountingDb can also fetch many series in one query.
+type bulkQueryCountingDb struct {
+	*queryCountingDb
+}
+
+func (db *bulkQueryCountingDb) FetchSeriesBulk(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	db.queries++
+	result := make([]series.Series, len(dss))
+	for n, ds := range dss {
+		s, err := db.dsFetcherSearcher.FetchSeries(ds, from, to, maxPoints)
+		if err != nil {
+			return nil, err
+		}
+		result[n] = s
+	}
+	return result, nil
+}
+
+func setupBulkTestDb(n int) dsFetcherSearcher {
+	td := setupTestData()
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: td.when},
+		},
+	}
+	db := serde.NewMemSerDe()
+	for i := 0; i < n; i++ {
+		db.FetchOrCreateDataSource(serde.Ident{"name": fmt.Sprintf("foo.bulk.%d", i)}, spec)
+	}
+	return db
+}
+
+func Test_dsl_seriesFromPatternBulk(t *testing.T) {
+	td := setupTestData()
+	mem := setupBulkTestDb(20)
+
+	perDs := &queryCountingDb{dsFetcherSearcher: mem}
+	bulk := &bulkQueryCountingDb{&queryCountingDb{dsFetcherSearcher: mem}}
+
+	for _, c := range []struct {
+		db      dsFetcherSearcher
+		counter *queryCountingDb
+		queries int
+	}{
+		{perDs, perDs, 20},
+		{bulk, bulk.queryCountingDb, 1},
+	} {
+		for _, f := range []ctxDSFetcher{NewNamedDSFetcher(c.db, nil, 0), NewSharedFetcher(NewNamedDSFetcher(c.db, nil, 0))} {
+			c.counter.queries = 0
+			sm, err := ParseDsl(f, `group("foo.bulk.*")`, td.from, td.to, 60)
+			if err != nil {
+				t.Error(err)
+			}
+			if len(sm) != 20 {
+				t.Errorf("Expected 20 series, got %d", len(sm))
+			}
+			for name, s := range sm {
+				if s == nil {
+					t.Errorf("nil series for %q", name)
+				}
+			}
+			if c.counter.queries != c.queries {
+				t.Errorf("%T: expected %d queries, got %d", f, c.queries, c.counter.queries)
+			}
+		}
+	}
+}
+
+// maxPoints 0 means no consolidation: every slot of the highest
+// resolution RRA that covers the range.
+func Test_dsl_nativeResolution(t *testing.T) {
+	td := setupTestData()
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: 24 * time.Hour, Latest: td.when},
+			rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour, Latest: td.when},
+		},
+	}
+	db := serde.NewMemSerDe()
+	db.FetchOrCreateDataSource(serde.Ident{"name": "foo.native"}, spec)
+	f := NewNamedDSFetcher(db, nil, 0)
+
+	// the slot ending at from is included, hence the +1
+	from, to := td.to.Add(-30*time.Minute), td.to
+	for _, c := range []struct {
+		maxPoints int64
+		expect    int
+	}{
+		{0, int(to.Sub(from)/(10*time.Second)) + 1},
+		{30, 30 + 1},
+	} {
+		for _, expr := range []string{`group("foo.native")`, `scale("foo.native", 2)`} {
+			sm, err := ParseDsl(f, expr, from, to, c.maxPoints)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			for _, s := range sm {
+				for s.Next() {
+					n++
+				}
+			}
+			if n != c.expect {
+				t.Errorf("%s maxPoints=%d: expected %d points, got %d", expr, c.maxPoints, c.expect, n)
+			}
+		}
+	}
+
+	// generators have no native resolution and must not divide by zero
+	for _, expr := range []string{`sinusoid()`, `sin("x")`} {
+		if _, err := ParseDsl(f, expr, from, to, 0); err != nil {
+			t.Errorf("%s: %v", expr, err)
+		}
+	}
+}
+
+// Shows the number of queries it takes to fetch a pattern matching
+// 100 series, run with -v to see it.
+func Benchmark_dsl_seriesFromPattern(b *testing.B) {
+	td := setupTestData()
+	mem := setupBulkTestDb(100)
+
+	perDs := &queryCountingDb{dsFetcherSearcher: mem}
+	bulk := &bulkQueryCountingDb{&queryCountingDb{dsFetcherSearcher: mem}}
+
+	for _, c := range []struct {
+		name    string
+		db      dsFetcherSearcher
+		counter *queryCountingDb
+	}{
+		{"per-ds", perDs, perDs},
+		{"bulk", bulk, bulk.queryCountingDb},
+	} {
+		f := NewNamedDSFetcher(c.db, nil, 0)
+		b.Run(c.name, func(b *testing.B) {
+			c.counter.queries = 0
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseDsl(f, `group("foo.bulk.*")`, td.from, td.to, 60); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.Logf("%d queries/op", c.counter.queries/b.N)
+		})
+	}
+}
+
+func Test_dsl_globTargets(t *testing.T) {
+	td := setupTestData()
+	f := newGlobTestFetcher("web.cpu", "db1.cpu", "db2.cpu", "host1.load", "host2.load", "hostx.load")
+
+	for target, exp := range map[string]int{
+		`group("{web,db{1,2}}.cpu")`:            3,
+		`group({web,db{1,2}}.cpu)`:              3,
+		`group({web,db1}.cpu, host[0-9].load)`:  4,
+		`group(host[!0-9].load)`:                1,
+		`group(host[^0-9].load, "db{1,2}.cpu")`: 3,
+		`sumSeries(db{1,2}.cpu).alias("a,{b}")`: 1,
+	} {
+		sm, err := ParseDsl(f, target, td.from, td.to, 60)
+		if err != nil {
+			t.Errorf("%s: %v", target, err)
+			continue
+		}
+		if len(sm) != exp {
+			t.Errorf("%s: expected %d series, got %d", target, exp, len(sm))
+		}
+	}
+
+	sm, _ := ParseDsl(f, `alias(sumSeries(db{1,2}.cpu), "a,{b}")`, td.from, td.to, 60)
+	for _, s := range sm {
+		if name := s.Alias(); name != "a,{b}" {
+			t.Errorf("Expected alias %q, got %q", "a,{b}", name)
+		}
+	}
+}
+
+func Test_dsl_limits(t *testing.T) {
+	td := setupTestData()
+	f := newGlobTestFetcher("web.cpu", "db1.cpu", "db2.cpu")
+
+	defer func(depth, series int) { MaxDepth, MaxSeries = depth, series }(MaxDepth, MaxSeries)
+	MaxDepth, MaxSeries = 3, 2
+
+	for target, limited := range map[string]bool{
+		`group(sumSeries(constantLine(1)))`:            false,
+		`group(sumSeries(sumSeries(constantLine(1))))`: true,
+		`group(constantLine(1)).scale(2).offset(1)`:    true, // chained
+		`group("db*.cpu")`:                             false,
+		`group("*.cpu")`:                               true,
+		`group("db*.cpu", "web.cpu")`:                  true,
+		`sumSeries(group("*.cpu"))`:                    true, // not hidden by sumSeries errors
+	} {
+		_, err := ParseDsl(f, target, td.from, td.to, 60)
+		_, isLimit := err.(*LimitError)
+		if isLimit != limited {
+			t.Errorf("%s: expected a LimitError: %v, got: %v", target, limited, err)
+		}
+	}
+
+	if depth := callDepth(mustParseExpr(t, strings.Repeat("sumSeries(", 1000)+"x"+strings.Repeat(")", 1000))); depth != 1000 {
+		t.Errorf("Expected depth 1000, got %d", depth)
+	}
+}
+
+func mustParseExpr(t *testing.T, src string) ast.Expr {
+	tr, err := parser.ParseExpr(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
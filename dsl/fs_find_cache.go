@@ -16,7 +16,9 @@
 package dsl
 
 import (
+	"bytes"
 	"fmt"
+	"log"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -27,13 +29,20 @@ import (
 )
 
 // fsFindCache provides a way of searching dot-separated ident
-// elements using same rules as filepath.Match, as well as
-// comma-separated values in curly braces such as "foo.{bar,baz}".
+// elements using same rules as filepath.Match (including character
+// classes such as "host[0-9]"), as well as comma-separated values in
+// curly braces such as "foo.{bar,baz}", which can be nested.
+//
+// All the names are kept in memory in a trie, unless there are more
+// than maxSize of them, in which case every search goes to the db.
 type fsFindCache struct {
 	*sync.RWMutex
 	db  serde.DataSourceSearcher
 	key string // name of the ident key, required
 	*fsFindNode
+	size     int  // number of names in the trie
+	maxSize  int  // 0 means no limit
+	complete bool // false if maxSize was exceeded and the trie is empty
 }
 
 type fsFindNode struct {
@@ -42,9 +51,10 @@ type fsFindNode struct {
 	names map[string]*fsFindNode
 }
 
-func (n *fsFindNode) insert(parts []string, pos int, ident serde.Ident) {
+// insert returns true if the name was not there yet.
+func (n *fsFindNode) insert(parts []string, pos int, ident serde.Ident) bool {
 	if pos >= len(parts) {
-		return
+		return false
 	}
 
 	if n.names == nil {
@@ -61,10 +71,11 @@ func (n *fsFindNode) insert(parts []string, pos int, ident serde.Ident) {
 	// in theory there shouldn't be anyhting wrong with that, though
 	// Grafana doesn't deal with it very well..
 	if pos < len(parts)-1 {
-		node.insert(parts, pos+1, ident)
-	} else {
-		node.ident = ident
+		return node.insert(parts, pos+1, ident)
 	}
+	added := node.ident == nil
+	node.ident = ident
+	return added
 }
 
 func (n *fsFindNode) empty() bool {
@@ -97,14 +108,12 @@ func (n *fsFindNode) search(pattern, key string, result map[string]*FsFindNode)
 	}
 }
 
-func (f *fsFindCache) insert(ident serde.Ident) error {
+func (f *fsFindCache) insert(root *fsFindNode, ident serde.Ident) (bool, error) {
 	if name := ident[f.key]; name != "" {
 		parts := strings.Split(name, ".")
-		f.fsFindNode.insert(parts, 0, ident)
-	} else {
-		return fmt.Errorf("insert: '%s' tag missing for DS ident: %s", f.key, ident.String())
+		return root.insert(parts, 0, ident), nil
 	}
-	return nil
+	return false, fmt.Errorf("insert: '%s' tag missing for DS ident: %s", f.key, ident.String())
 }
 
 type FsFindNode struct {
@@ -114,6 +123,11 @@ type FsFindNode struct {
 	ident      serde.Ident
 }
 
+// Ident returns the ident of the DS for a leaf node, nil otherwise.
+func (n *FsFindNode) Ident() serde.Ident {
+	return n.ident
+}
+
 type fsNodes []*FsFindNode
 
 // sort.Interface
@@ -133,9 +147,18 @@ func newFsFindCache(db serde.DataSourceSearcher, key string) *fsFindCache {
 		db:         db,
 		key:        key,
 		fsFindNode: &fsFindNode{},
+		complete:   true,
 	}
 }
 
+func (dsns *fsFindCache) setMaxSize(n int) {
+	dsns.Lock()
+	defer dsns.Unlock()
+	dsns.maxSize = n
+}
+
+// reload reads all the names from the db into a new trie, which then
+// replaces the current one, so that deleted names disappear.
 func (dsns *fsFindCache) reload() error {
 	sr, err := dsns.db.Search(map[string]string{dsns.key: ".*"})
 	if err != nil {
@@ -146,39 +169,104 @@ func (dsns *fsFindCache) reload() error {
 	}
 	defer sr.Close()
 
-	dsns.Lock()
-	defer dsns.Unlock()
+	dsns.RLock()
+	maxSize := dsns.maxSize
+	dsns.RUnlock()
 
+	root, size, complete := &fsFindNode{}, 0, true
 	for sr.Next() {
-		if err := dsns.insert(sr.Ident()); err != nil {
+		added, err := dsns.insert(root, sr.Ident())
+		if err != nil {
 			return err
 		}
+		if added {
+			size++
+		}
+		if maxSize > 0 && size > maxSize {
+			// no point in keeping any of it
+			root, size, complete = &fsFindNode{}, 0, false
+			break
+		}
 	}
 
+	dsns.Lock()
+	defer dsns.Unlock()
+	if !complete && dsns.complete {
+		log.Printf("fsFindCache: more than %d names, names will be searched in the database.", maxSize)
+	}
+	dsns.fsFindNode, dsns.size, dsns.complete = root, size, complete
 	return nil
 }
 
-func (dsns *fsFindCache) fsFind(pattern string) []*FsFindNode {
-	if strings.Count(pattern, ",") > 0 {
-		subres := make(fsNodes, 0)
+// add inserts a single new name, e.g. of a DS just created by the
+// receiver.
+func (dsns *fsFindCache) add(ident serde.Ident) {
+	dsns.Lock()
+	defer dsns.Unlock()
 
-		parts := regexp.MustCompile("{[^{}]*}").FindAllString(pattern, -1) // TODO pre-compile me
-		for _, part := range parts {
-			subs := strings.Split(strings.Trim(part, "{}"), ",")
+	if !dsns.complete {
+		return // the db is searched anyway
+	}
+	added, err := dsns.insert(dsns.fsFindNode, ident)
+	if err != nil {
+		log.Printf("fsFindCache: add: %v", err)
+		return
+	}
+	if added {
+		dsns.size++
+	}
+	if dsns.maxSize > 0 && dsns.size > dsns.maxSize {
+		log.Printf("fsFindCache: more than %d names, names will be searched in the database.", dsns.maxSize)
+		dsns.fsFindNode, dsns.size, dsns.complete = &fsFindNode{}, 0, false
+	}
+}
 
-			for _, sub := range subs {
-				subres = append(subres, dsns.fsFind(strings.Replace(pattern, part, sub, -1))...)
-			}
-		}
+// empty is true if there are no names, as opposed to there being too
+// many to keep in memory.
+func (dsns *fsFindCache) empty() bool {
+	dsns.RLock()
+	defer dsns.RUnlock()
+	return dsns.complete && dsns.fsFindNode.empty()
+}
 
-		return subres
+func (dsns *fsFindCache) len() int {
+	dsns.RLock()
+	defer dsns.RUnlock()
+	return dsns.size
+}
+
+func (dsns *fsFindCache) fsFind(pattern string) []*FsFindNode {
+	patterns := expandBraces(pattern)
+	for n, p := range patterns {
+		// Graphite negates a character class with "[!...]",
+		// filepath.Match with "[^...]"
+		patterns[n] = strings.Replace(p, "[!", "[^", -1)
 	}
 
 	dsns.RLock()
-	defer dsns.RUnlock()
+	if dsns.complete {
+		defer dsns.RUnlock()
+		return dsns.findNodes(dsns.fsFindNode, patterns)
+	}
+	dsns.RUnlock()
+
+	// Only the matches come from the db, the trie built from them
+	// is searched the same way as the whole one would be.
+	root := &fsFindNode{}
+	for _, p := range patterns {
+		if err := dsns.searchDb(root, p); err != nil {
+			log.Printf("fsFindCache: error searching for %q: %v", p, err)
+		}
+	}
+	return dsns.findNodes(root, patterns)
+}
 
+func (dsns *fsFindCache) findNodes(root *fsFindNode, patterns []string) []*FsFindNode {
+	// the set also takes care of duplicates from overlapping alternatives
 	set := make(map[string]*FsFindNode)
-	dsns.search(pattern, dsns.key, set)
+	for _, p := range patterns {
+		root.search(p, dsns.key, set)
+	}
 
 	// convert to array
 	result := make(fsNodes, 0, len(set))
@@ -192,6 +280,101 @@ func (dsns *fsFindCache) fsFind(pattern string) []*FsFindNode {
 	return result
 }
 
+// searchDb inserts into root the names matching (a prefix of) pattern
+// according to the db. The db may return more than that, e.g. if it
+// matches case-insensitively.
+func (dsns *fsFindCache) searchDb(root *fsFindNode, pattern string) error {
+	sr, err := dsns.db.Search(map[string]string{dsns.key: globToRegex(pattern)})
+	if err != nil {
+		return err
+	}
+	if sr == nil {
+		return nil
+	}
+	defer sr.Close()
+
+	for sr.Next() {
+		if _, err := dsns.insert(root, sr.Ident()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globToRegex translates a pattern without braces into a regular
+// expression matching the names it matches as well as the names it
+// is a prefix of, e.g. "foo.b?r" becomes ^foo\.b[^.]r(\.|$).
+func globToRegex(pattern string) string {
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			buf.WriteString("[^.]*")
+		case '?':
+			buf.WriteString("[^.]")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if len(class) > 0 && class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	buf.WriteString(`(\.|$)`)
+	return buf.String()
+}
+
+// expandBraces expands comma-separated alternatives in curly braces,
+// which can be nested, e.g. "{web,db{1,2}}.cpu" becomes "web.cpu",
+// "db1.cpu" and "db2.cpu". Unbalanced braces are left as is.
+func expandBraces(pattern string) []string {
+	start := strings.IndexByte(pattern, '{')
+	if start == -1 {
+		return []string{pattern}
+	}
+
+	var alts []string
+	depth, last := 0, start+1
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alts = append(alts, pattern[last:i])
+				last = i + 1
+			}
+		case '}':
+			depth--
+			if depth == 0 {
+				alts = append(alts, pattern[last:i])
+				prefix, suffix := pattern[:start], pattern[i+1:]
+				var result []string
+				for _, alt := range alts {
+					// alt may have nested braces, suffix more braces
+					result = append(result, expandBraces(prefix+alt+suffix)...)
+				}
+				return result
+			}
+		}
+	}
+	return []string{pattern}
+}
+
 func (dsns *fsFindCache) identsFromPattern(pattern string) map[string]serde.Ident {
 	result := make(map[string]serde.Ident)
 	for _, node := range dsns.fsFind(pattern) {
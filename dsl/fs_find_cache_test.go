@@ -0,0 +1,238 @@
+package dsl
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func newGlobTestFetcher(names ...string) *namedDsFetcher {
+	db := serde.NewMemSerDe()
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour},
+		},
+	}
+	for _, name := range names {
+		db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec)
+	}
+	f := NewNamedDSFetcher(db, nil, 0)
+	f.Preload()
+	return f
+}
+
+func Test_expandBraces(t *testing.T) {
+	for in, exp := range map[string][]string{
+		"foo.bar":              {"foo.bar"},
+		"{web,db}.cpu":         {"web.cpu", "db.cpu"},
+		"{web,db{1,2}}.cpu":    {"web.cpu", "db1.cpu", "db2.cpu"},
+		"{a,b}.{c,d}":          {"a.c", "a.d", "b.c", "b.d"},
+		"{a,{b,{c,d}}}x":       {"ax", "bx", "cx", "dx"},
+		"{web.cpu,db.mem}.max": {"web.cpu.max", "db.mem.max"},
+		"foo.{bar":             {"foo.{bar"},
+		"foo.{}":               {"foo."},
+	} {
+		if got := expandBraces(in); !reflect.DeepEqual(got, exp) {
+			t.Errorf("expandBraces(%q): expected %v, got %v", in, exp, got)
+		}
+	}
+}
+
+func Test_fsFindCache_globs(t *testing.T) {
+	f := newGlobTestFetcher("web.cpu", "db1.cpu", "db2.cpu", "db2.mem", "host1.load", "host2.load", "hostx.load")
+
+	for pattern, exp := range map[string][]string{
+		"{web,db}*.cpu":         {"db1.cpu", "db2.cpu", "web.cpu"},
+		"{web,db{1,2}}.cpu":     {"db1.cpu", "db2.cpu", "web.cpu"},
+		"{db*,db2}.{cpu,mem}":   {"db1.cpu", "db2.cpu", "db2.mem"}, // no duplicates
+		"host[0-9].load":        {"host1.load", "host2.load"},
+		"host[!0-9].load":       {"hostx.load"},
+		"{host[12],web}.{load}": {"host1.load", "host2.load"},
+	} {
+		var got []string
+		for _, node := range f.FsFind(pattern) {
+			got = append(got, node.Name)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("FsFind(%q): expected %v, got %v", pattern, exp, got)
+		}
+
+		// the same names must come out of identsFromPattern (render)
+		got = got[:0]
+		for name, _ := range f.identsFromPattern(pattern) {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("identsFromPattern(%q): expected %v, got %v", pattern, exp, got)
+		}
+	}
+}
+
+// nameSearcher searches names the way the postgres serde does, by a
+// case-insensitive regular expression.
+type nameSearcher struct {
+	names    []string
+	searches []string
+}
+
+type nameSearchResult struct {
+	idents []serde.Ident
+	pos    int
+}
+
+func (sr *nameSearchResult) Next() bool         { sr.pos++; return sr.pos < len(sr.idents) }
+func (sr *nameSearchResult) Close() error       { return nil }
+func (sr *nameSearchResult) Ident() serde.Ident { return sr.idents[sr.pos] }
+
+func (s *nameSearcher) Search(query serde.SearchQuery) (serde.SearchResult, error) {
+	s.searches = append(s.searches, query["name"])
+	re, err := regexp.Compile("(?i)" + query["name"])
+	if err != nil {
+		return nil, err
+	}
+	sr := &nameSearchResult{pos: -1}
+	for _, name := range s.names {
+		if re.MatchString(name) {
+			sr.idents = append(sr.idents, serde.Ident{"name": name})
+		}
+	}
+	return sr, nil
+}
+
+func fsFindNames(dsns *fsFindCache, pattern string) []string {
+	var result []string
+	for _, node := range dsns.fsFind(pattern) {
+		result = append(result, node.Name)
+	}
+	return result
+}
+
+func Test_fsFindCache_index(t *testing.T) {
+	db := &nameSearcher{names: []string{"a.x", "b.x"}}
+	dsns := newFsFindCache(db, "name")
+	dsns.reload()
+
+	check := func(pattern string, exp []string, searches int) {
+		if got := fsFindNames(dsns, pattern); !reflect.DeepEqual(got, exp) {
+			t.Errorf("fsFind(%q): expected %v, got %v", pattern, exp, got)
+		}
+		if len(db.searches) != searches {
+			t.Errorf("fsFind(%q): expected %d db searches so far, got %d", pattern, searches, len(db.searches))
+		}
+	}
+	check("*.x", []string{"a.x", "b.x"}, 1)
+
+	// added names are found without a reload, reloading forgets deleted ones
+	db.names = []string{"a.x", "c.x"}
+	dsns.add(serde.Ident{"name": "d.x"})
+	dsns.add(serde.Ident{"name": "d.x"})
+	check("*.x", []string{"a.x", "b.x", "d.x"}, 1)
+	if dsns.len() != 3 {
+		t.Errorf("Expected 3 names, got %d", dsns.len())
+	}
+	dsns.reload()
+	check("*.x", []string{"a.x", "c.x"}, 2)
+
+	// too many names for memory, the db is searched instead
+	dsns.setMaxSize(1)
+	dsns.reload()
+	if dsns.complete || dsns.len() != 0 || dsns.empty() {
+		t.Errorf("Expected an incomplete empty index, got complete: %v, size: %d", dsns.complete, dsns.len())
+	}
+	check("a.*", []string{"a.x"}, 4)
+	check("{a,c}.x", []string{"a.x", "c.x"}, 6)
+	check("A.*", nil, 7) // the db is case-insensitive, but not fsFind
+	if db.searches[3] != `^a\.[^.]*(\.|$)` {
+		t.Errorf("Unexpected db search: %q", db.searches[3])
+	}
+	dsns.add(serde.Ident{"name": "d.x"})
+	check("d.x", nil, 8)
+
+	// adding beyond the limit also switches to the db
+	db.names = []string{"a.x"}
+	dsns.setMaxSize(2)
+	dsns.reload()
+	dsns.add(serde.Ident{"name": "b.x"})
+	if !dsns.complete || dsns.len() != 2 {
+		t.Errorf("Expected a complete index of 2, got complete: %v, size: %d", dsns.complete, dsns.len())
+	}
+	dsns.add(serde.Ident{"name": "c.x"})
+	if dsns.complete || dsns.len() != 0 {
+		t.Errorf("Expected an incomplete empty index, got complete: %v, size: %d", dsns.complete, dsns.len())
+	}
+}
+
+func Test_globToRegex(t *testing.T) {
+	for pattern, exp := range map[string]string{
+		"foo.bar":    `^foo\.bar(\.|$)`,
+		"foo.*":      `^foo\.[^.]*(\.|$)`,
+		"b?r":        `^b[^.]r(\.|$)`,
+		"host[0-9]":  `^host[0-9](\.|$)`,
+		"host[!0-9]": `^host[^0-9](\.|$)`,
+		"host[^0-9]": `^host[^0-9](\.|$)`,
+		"a[b":        `^a\[b(\.|$)`,
+		`a\*b`:       `^a\*b(\.|$)`,
+		"a+b(c)":     `^a\+b\(c\)(\.|$)`,
+	} {
+		if got := globToRegex(pattern); got != exp {
+			t.Errorf("globToRegex(%q): expected %q, got %q", pattern, exp, got)
+		}
+	}
+}
+
+// createWatcher is a watcher telling about new DSs like the receiver
+// DS cache.
+type createWatcher struct {
+	watcher
+	created func(serde.Ident)
+}
+
+func (w *createWatcher) NotifyCreate(f func(serde.Ident)) { w.created = f }
+
+func Test_namedDsFetcher_findIndex(t *testing.T) {
+	db := serde.NewMemSerDe()
+	w := &createWatcher{}
+	f := NewNamedDSFetcher(db, w, 0)
+	f.Preload()
+
+	w.created(serde.Ident{"name": "new.x"})
+	if nodes := f.FsFind("new.*"); len(nodes) != 1 {
+		t.Errorf("Expected the created DS to be found, got %v", nodes)
+	}
+
+	f.StartFindIndexRefresher(time.Millisecond)
+	db.FetchOrCreateDataSource(serde.Ident{"name": "db.x"}, &rrd.DSSpec{Step: time.Second})
+	for i := 0; i < 1000 && len(f.identsFromPattern("db.*")) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if len(f.identsFromPattern("db.*")) != 1 {
+		t.Errorf("Expected the refresher to find db.x")
+	}
+	if len(f.identsFromPattern("new.*")) != 0 {
+		t.Errorf("Expected new.x to be gone after a refresh, it is not in the db")
+	}
+	if st := f.Stats(); st.FindIndexSize != 1 {
+		t.Errorf("Expected a find index size of 1, got %d", st.FindIndexSize)
+	}
+
+	f.StopFindIndexRefresher()
+	f.StopFindIndexRefresher() // not running is fine
+	db.FetchOrCreateDataSource(serde.Ident{"name": "db.y"}, &rrd.DSSpec{Step: time.Second})
+	time.Sleep(20 * time.Millisecond)
+	if len(f.identsFromPattern("db.*")) != 1 {
+		t.Errorf("Expected no refreshes once stopped")
+	}
+	f.Lock()
+	refresher := f.refresher
+	f.Unlock()
+	if refresher {
+		t.Errorf("Expected FsFind to do the reloads again once stopped")
+	}
+}
@@ -0,0 +1,124 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"math"
+	"sort"
+)
+
+// FuncInfo describes a function of the DSL, e.g. so that a UI such as
+// Grafana can know which functions are supported.
+type FuncInfo struct {
+	Name   string
+	Group  string // same as Graphite, e.g. "Combine", "Transform"
+	Params []*FuncParam
+}
+
+// FuncParam describes a parameter of a DSL function.
+type FuncParam struct {
+	Name     string
+	Type     string // Graphite type: seriesList, float, integer, string, boolean or any
+	Required bool
+	Multiple bool        // can be repeated, only the last parameter
+	Default  interface{} // nil if there is no default
+}
+
+// The Graphite name of the type.
+func argTypeName(tp argType) string {
+	switch tp {
+	case argSeries:
+		return "seriesList"
+	case argNumber:
+		return "float"
+	case argInteger:
+		return "integer"
+	case argString:
+		return "string"
+	case argBool:
+		return "boolean"
+	}
+	return "any"
+}
+
+// Graphite groups the functions the same way as the list at the end
+// of preprocessArgFuncs, anything not listed here is "Special".
+var funcGroups = map[string][]string{
+	"Combine": {"averageSeries", "avg", "averageSeriesWithWildcards", "group", "isNonNull", "maxSeries", "max",
+		"minSeries", "min", "multiplySeries", "percentileOfSeries", "rangeOfSeries", "sumSeries", "sum",
+		"sumSeriesWithWildcards", "countSeries"},
+	"Transform": {"absolute", "delay", "derivative", "hitcount", "integral", "exp", "log", "logarithm", "nonNegativeDerivative",
+		"offset", "offsetToZero", "pow", "scale", "scaleToSeconds", "summarize", "timeShift", "timeStack",
+		"transformNull", "keepLastValue", "changed", "consolidateBy"},
+	"Calculate": {"aberration", "asPercent", "diffSeries", "divideSeries", "holtWintersAberration", "holtWintersConfidenceBands",
+		"holtWintersForecast", "nPercentile", "movingAverage", "movingMedian", "stdev"},
+	"Filter Series": {"averageAbove", "averageBelow", "exclude", "highestCurrent", "highestMax", "limit", "lowestAverage", "lowestCurrent",
+		"maximumAbove", "maximumBelow", "minimumAbove", "minimumBelow", "mostDeviant", "removeAbovePercentile",
+		"removeAboveValue", "removeBelowPercentile", "removeBelowValue", "removeEmptySeries", "useSeriesAbove"},
+	"Alias": {"alias", "aliasByMetric", "aliasByNode", "aliasByTags", "aliasSub"},
+}
+
+// Functions returns the descriptions of all the DSL functions,
+// sorted by name.
+func Functions() []*FuncInfo {
+	groups := make(map[string]string)
+	for group, names := range funcGroups {
+		for _, name := range names {
+			groups[name] = group
+		}
+	}
+
+	result := make([]*FuncInfo, 0, len(preprocessArgFuncs)+len(dslCtxFuncs))
+	add := func(name string, varArg bool, args []argDef) {
+		fi := &FuncInfo{Name: name, Group: groups[name], Params: make([]*FuncParam, 0, len(args))}
+		if fi.Group == "" {
+			fi.Group = "Special"
+		}
+		for n, arg := range args {
+			fi.Params = append(fi.Params, describeArg(arg, varArg && n == len(args)-1))
+		}
+		result = append(result, fi)
+	}
+	for name, fn := range preprocessArgFuncs {
+		add(name, fn.varArg, fn.args)
+	}
+	for name, fn := range dslCtxFuncs {
+		add(name, fn.varArg, fn.args)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func describeArg(arg argDef, multiple bool) *FuncParam {
+	p := &FuncParam{Name: arg.name, Type: argTypeName(arg.tp), Multiple: multiple, Required: arg.dft == nil}
+
+	switch dft := arg.dft.(type) {
+	case float64:
+		if !math.IsNaN(dft) { // NaN means "not given"
+			p.Default = dft
+		}
+	case string:
+		if arg.tp == argBool {
+			p.Default = dft == "true"
+		} else {
+			p.Default = dft
+		}
+	default:
+		p.Default = dft
+	}
+	return p
+}
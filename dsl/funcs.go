@@ -19,13 +19,17 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"math/rand"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
 	"github.com/tgres/tgres/series"
 )
 
@@ -37,6 +41,7 @@ const (
 	argString
 	argBool
 	argNumberOrSeries // see asPercent() total
+	argInteger        // a number which must be whole, still a float64
 )
 
 type argDef struct {
@@ -51,14 +56,42 @@ type dslFuncType struct {
 }
 type funcMap map[string]dslFuncType
 
-type dslCtxFuncType func(*dslCtx, []interface{}) (SeriesMap, error)
+// The args of a dslCtxFunc are not processed, the function gets them
+// as is, args only describe them (see Functions()).
+type dslCtxFuncType struct {
+	call   func(*dslCtx, []interface{}) (SeriesMap, error)
+	varArg bool
+	args   []argDef
+}
 type dslCtxFuncMap map[string]dslCtxFuncType
 
 var dslCtxFuncs = dslCtxFuncMap{ // functions that require the dslCtx to do their stuff
-	"sumSeriesWithWildcards":     dslSumSeriesWithWildcards,
-	"averageSeriesWithWildcards": dslAverageSeriesWithWildcards,
-	"groupByNode":                dslGroupByNode,
-	"timeStack":                  dslTimeStack,
+	"sumSeriesWithWildcards": dslCtxFuncType{dslSumSeriesWithWildcards, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"position", argNumber, nil}}},
+	"averageSeriesWithWildcards": dslCtxFuncType{dslAverageSeriesWithWildcards, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"position", argNumber, nil}}},
+	"groupByNode": dslCtxFuncType{dslGroupByNode, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"nodeNum", argNumber, nil},
+		argDef{"callback", argString, nil}}},
+	"timeStack": dslCtxFuncType{dslTimeStack, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"timeShiftUnit", argString, nil},
+		argDef{"timeShiftStart", argNumber, nil},
+		argDef{"timeShiftEnd", argNumber, nil}}},
+	"events": dslCtxFuncType{dslEvents, true, []argDef{
+		argDef{"tags", argString, "*"}}},
+	"seriesByTag": dslCtxFuncType{dslSeriesByTag, true, []argDef{
+		argDef{"tagExpressions", argString, nil}}},
+	"atResolution": dslCtxFuncType{dslAtResolution, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"resolution", argString, nil}}},
+	"aberration": dslCtxFuncType{dslAberration, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"refSeries", argSeries, nil},
+		argDef{"tolerance", argNumber, 0.0}}},
 }
 
 var preprocessArgFuncs = funcMap{
@@ -66,6 +99,16 @@ var preprocessArgFuncs = funcMap{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"factor", argNumber, nil}}},
 	"sinusoid": dslFuncType{dslSinusoid, false, []argDef{}},
+	"sin": dslFuncType{dslSin, false, []argDef{
+		argDef{"name", argString, nil},
+		argDef{"amplitude", argNumber, 1.0}}},
+	"sinFunction": dslFuncType{dslSin, false, []argDef{
+		argDef{"name", argString, nil},
+		argDef{"amplitude", argNumber, 1.0}}},
+	"randomWalk": dslFuncType{dslRandomWalk, false, []argDef{
+		argDef{"name", argString, nil}}},
+	"randomWalkFunction": dslFuncType{dslRandomWalk, false, []argDef{
+		argDef{"name", argString, nil}}},
 	"absolute": dslFuncType{dslAbsolute, false, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
 	"averageSeries": dslFuncType{dslAverageSeries, true, []argDef{
@@ -102,6 +145,9 @@ var preprocessArgFuncs = funcMap{
 	"alias": dslFuncType{dslAlias, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"newName", argString, nil}}},
+	"delay": dslFuncType{dslDelay, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"steps", argInteger, nil}}},
 	"derivative": dslFuncType{dslDerivative, false, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
 	"nonNegativeDerivative": dslFuncType{dslNonNegativeDerivative, false, []argDef{
@@ -115,6 +161,11 @@ var preprocessArgFuncs = funcMap{
 	"log": dslFuncType{dslLogarithm, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"base", argNumber, 10.0}}},
+	"pow": dslFuncType{dslPow, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"factor", argNumber, nil}}},
+	"exp": dslFuncType{dslExp, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
 	"offset": dslFuncType{dslOffset, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"factor", argNumber, nil}}},
@@ -136,19 +187,27 @@ var preprocessArgFuncs = funcMap{
 		argDef{"n", argNumber, nil}}},
 	"highestCurrent": dslFuncType{dslHighestCurrent, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"n", argNumber, 1}}},
+		argDef{"n", argInteger, 1}}},
 	"highestMax": dslFuncType{dslHighestMax, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"n", argNumber, 1}}},
+		argDef{"n", argInteger, 1}}},
 	"limit": dslFuncType{dslLimit, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"n", argNumber, nil}}},
+		argDef{"n", argInteger, nil}}},
+	"sortByName": dslFuncType{dslSortByName, false, []argDef{
+		argDef{"seriesList", argSeries, nil}}},
 	"lowestAverage": dslFuncType{dslLowestAverage, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"n", argNumber, 1}}},
+		argDef{"n", argInteger, 1}}},
 	"lowestCurrent": dslFuncType{dslLowestCurrent, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"n", argNumber, 1}}},
+		argDef{"n", argInteger, 1}}},
+	"averageAbove": dslFuncType{dslAverageAbove, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"n", argNumber, nil}}},
+	"averageBelow": dslFuncType{dslAverageBelow, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"n", argNumber, nil}}},
 	"maximumAbove": dslFuncType{dslMaximumAbove, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"n", argNumber, nil}}},
@@ -163,7 +222,7 @@ var preprocessArgFuncs = funcMap{
 		argDef{"n", argNumber, nil}}},
 	"mostDeviant": dslFuncType{dslMostDeviant, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"n", argNumber, nil}}},
+		argDef{"n", argInteger, nil}}},
 	"movingAverage": dslFuncType{dslMovingAverage, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"windowSize", argString, nil}}},
@@ -182,19 +241,29 @@ var preprocessArgFuncs = funcMap{
 	"removeBelowValue": dslFuncType{dslRemoveBelowValue, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"n", argNumber, nil}}},
+	"removeEmptySeries": dslFuncType{dslRemoveEmptySeries, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"xFilesFactor", argNumber, 0.0}}},
 	"stdev": dslFuncType{dslMovingStdDev, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"points", argNumber, nil},
+		argDef{"points", argInteger, nil},
 		argDef{"windowTolerance", argNumber, 0.1}}},
 	"weightedAverage": dslFuncType{dslWeightedAverage, false, []argDef{
 		argDef{"seriesListAvg", argSeries, nil},
 		argDef{"seriesListWeight", argSeries, nil},
-		argDef{"node", argNumber, nil}}},
+		argDef{"node", argInteger, nil}}},
 	"aliasByMetric": dslFuncType{dslAliasByMetric, true, []argDef{
 		argDef{"seriesList", argSeries, nil}}},
 	"aliasByNode": dslFuncType{dslAliasByNode, true, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"nodes", argNumber, nil}}},
+		argDef{"nodes", argInteger, nil}}},
+	"aliasByTags": dslFuncType{dslAliasByTags, true, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"tags", argString, nil}}},
+	"substr": dslFuncType{dslSubstr, false, []argDef{
+		argDef{"seriesList", argSeries, nil},
+		argDef{"start", argInteger, 0},
+		argDef{"stop", argInteger, 0}}},
 	"aliasSub": dslFuncType{dslAliasSub, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"search", argString, nil},
@@ -211,7 +280,7 @@ var preprocessArgFuncs = funcMap{
 		argDef{"alignToInterval", argBool, "false"}}},
 	"keepLastValue": dslFuncType{dslKeepLastValue, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
-		argDef{"limit", argNumber, 0.0}}},
+		argDef{"limit", argInteger, 0.0}}},
 	"color": dslFuncType{dslColor, true, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"color", argString, "green"}}},
@@ -229,7 +298,7 @@ var preprocessArgFuncs = funcMap{
 	"consolidateBy": dslFuncType{dslConsolidateBy, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"consolidationFunc", argString, nil}}},
-	"summarize": dslFuncType{dslSummarize, true, []argDef{
+	"summarize": dslFuncType{dslSummarize, false, []argDef{
 		argDef{"seriesList", argSeries, nil},
 		argDef{"intervalString", argString, nil},
 		argDef{"func", argString, "sum"},
@@ -269,13 +338,16 @@ var preprocessArgFuncs = funcMap{
 
 	// TRANSFORM
 	// ++ absolute()
+	// ++ delay()
 	// ++ derivative()
 	// ++ hitcount()
 	// ++ integral()
+	// ++ exp()
 	// ++ log()
 	// ++ nonNegativeDerivative
 	// ++ offset
 	// ++ offsetToZero // would require whole series min()
+	// ++ pow()
 	// -- perSecond // everything here is perSedond() already
 	// ++ scale()
 	// ++ scaleToSeconds()
@@ -296,8 +368,8 @@ var preprocessArgFuncs = funcMap{
 	// ?? stddevSeries
 
 	// FILTER
-	// ?? averageAbove
-	// ?? averageBelow
+	// ++ averageAbove
+	// ++ averageBelow
 	// ?? currentAbove
 	// ?? currentBelow
 	// ++ exclude
@@ -318,6 +390,7 @@ var preprocessArgFuncs = funcMap{
 	// ++ removeAboveValue
 	// ++ removeBelowPercentile
 	// ++ removeBelowValue
+	// ++ removeEmptySeries
 	// ++ stdev
 	// ++ useSeriesAbove
 	// ++ weightedAverage
@@ -327,24 +400,27 @@ var preprocessArgFuncs = funcMap{
 	// ++ aliasByMetric
 	// ++ aliasByNode
 	// ++ aliasSub
+	// ++ atResolution // not in Graphite
 	// ?? cactiStyle // TODO should be easy to do?
 	// ++ changed
 	// ++ consolidateBy
 	// ++ constantLine
+	// ++ events
 	// ++ countSeries
 	// -- cumulative // == consolidateBy
 	// ++ groupByNode
 	// ++ keepLastValue
-	// ?? randomWalk // later?
+	// ++ randomWalk
+	// ++ sin
 	// ?? sortByMaxima
 	// ?? sortByMinima
-	// ?? sortByName
+	// ++ sortByName
 	// ?? sortByTotal
 	// ?? stacked
-	// ?? substr
+	// ++ substr
 }
 
-func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]interface{}, []interface{}, error) {
+func processArgs(dc *dslCtx, name string, fn *dslFuncType, args []interface{}) (map[string]interface{}, []interface{}, error) {
 
 	result := make(map[string]interface{})
 	asSlice := make([]interface{}, 0)
@@ -354,7 +430,7 @@ func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 	kwargsStart := -1
 	for n, arg := range args {
 		if s, ok := arg.(string); ok {
-			if !strings.Contains(s, "=") {
+			if key, value, ok := parseKwarg(s); !ok {
 				if kwargsStart > -1 {
 					return nil, nil, fmt.Errorf("Positional values cannot follow keyword parameters: %v", arg)
 				}
@@ -362,20 +438,29 @@ func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 				if kwargsStart == -1 {
 					kwargsStart = n
 				}
-				parts := strings.SplitN(s, "=", 2)
-				kwargs[parts[0]] = parts[1]
+				kwargs[key] = value
 			}
 		}
 	}
 
+	positional := len(args)
+	if kwargsStart > -1 {
+		positional = kwargsStart
+	}
+	if !fn.varArg && positional > len(fn.args) {
+		return nil, nil, fmt.Errorf("%s: expects at most %d arguments, got %d", name, len(fn.args), positional)
+	}
+
 	// Now we need to be traversing
 	for n, fnarg := range fn.args {
 
 		if n >= len(args) {
-			if fnarg.dft != nil {
+			if _, ok := kwargs[fnarg.name]; ok {
+				args = append(args, nil) // a placeholder, the kwarg is used below
+			} else if fnarg.dft != nil {
 				args = append(args, fnarg.dft)
 			} else {
-				return nil, nil, fmt.Errorf("Expecting %dth argument, but there are only %d", n+1, len(args))
+				return nil, nil, fmt.Errorf("%s: argument %d (%s) is required", name, n+1, fnarg.name)
 			}
 		}
 
@@ -400,13 +485,17 @@ func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 					if fnarg.dft != nil {
 						arg = fnarg.dft
 					} else {
-						return nil, nil, fmt.Errorf("Missing argument: %s", fnarg.name)
+						return nil, nil, fmt.Errorf("%s: argument %d (%s) is required", name, n+1, fnarg.name)
 					}
 				}
 			} else {
 				arg = args[i]
 			}
 
+			if !argTypeOk(fnarg.tp, arg) {
+				return nil, nil, argError(name, i+1, fnarg.tp, arg)
+			}
+
 			switch fnarg.tp {
 			case argSeries:
 				if series, err := dc.seriesFromSeriesOrIdent(arg); err != nil {
@@ -414,18 +503,9 @@ func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 				} else {
 					value = append(value, series)
 				}
-			case argNumber:
-				if number, ok := arg.(float64); ok {
-					value = append(value, number)
-				} else if v, ok := arg.(string); ok {
-					if number, err := strconv.ParseFloat(v, 64); err == nil {
-						value = append(value, number)
-					} else {
-						return nil, nil, fmt.Errorf("argument %d (%s=%s) parsing error: %v", i+1, fnarg.name, v, err)
-					}
-				} else {
-					return nil, nil, fmt.Errorf("argument %d (%q) expecting a number, got: %v", i+1, fnarg.name, arg)
-				}
+			case argNumber, argInteger:
+				number, _ := argNumberValue(arg)
+				value = append(value, number)
 			case argString:
 				if str, ok := arg.(string); ok {
 					value = append(value, str)
@@ -433,35 +513,22 @@ func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 					value = append(value, fmt.Sprintf("%v", arg)) // anything can be a string
 				}
 			case argBool:
-				if str, ok := arg.(string); ok {
-					str := strings.ToLower(str)
-					if str == "true" {
-						value = append(value, true)
-					} else if str == "false" {
-						value = append(value, false)
-					} else {
-						return nil, nil, fmt.Errorf("argument %d (%q) invalid boolean, expecting true or false, got: %v", i+1, fnarg.name, arg)
-					}
-				} else {
-					return nil, nil, fmt.Errorf("argument %d (%q) invalid boolean, expecting true or false, got: %v", i+1, fnarg.name, arg)
-				}
+				value = append(value, strings.ToLower(arg.(string)) == "true")
 			case argNumberOrSeries:
-				if number, ok := arg.(float64); ok {
+				if number, ok := argNumberValue(arg); ok {
 					value = append(value, number)
-				} else if str, ok := arg.(string); ok {
-					if number, err := strconv.ParseFloat(str, 64); err == nil { // is it a kw arg float?
-						value = append(value, number)
-					} else if str == "None" || str == "NaN" {
-						value = append(value, math.NaN())
-					} else if series, err := dc.seriesFromSeriesOrIdent(str); err == nil {
-						if len(series) == 0 {
-							return nil, nil, fmt.Errorf("argument %d (%q) no such series: %v", i+1, fnarg.name, arg)
-						} else {
-							value = append(value, series)
-						}
+				} else if sm, ok := arg.(SeriesMap); ok {
+					value = append(value, sm)
+				} else if str := arg.(string); str == "None" || str == "NaN" {
+					value = append(value, math.NaN())
+				} else if series, err := dc.seriesFromSeriesOrIdent(str); err == nil {
+					if len(series) == 0 {
+						return nil, nil, fmt.Errorf("%s: argument %d (%s) no such series: %v", name, i+1, fnarg.name, arg)
 					} else {
-						return nil, nil, fmt.Errorf("argument %d (%q) expecting number or series, but got: %v", i+1, fnarg.name, arg)
+						value = append(value, series)
 					}
+				} else {
+					return nil, nil, err
 				}
 			default:
 				return nil, nil, fmt.Errorf("Invalid argType: %v", fnarg.tp)
@@ -499,6 +566,114 @@ func processArgs(dc *dslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 	return result, asSlice, nil
 }
 
+// A keyword argument is name=value where name is an identifier, so
+// that e.g. a tagged series name "foo;dc=east" is not one.
+func parseKwarg(s string) (string, string, bool) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", false
+	}
+	for _, c := range parts[0] {
+		if !(c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			return "", "", false
+		}
+	}
+	return parts[0], parts[1], true
+}
+
+// Returns the value of a number argument, which can also be a
+// string, e.g. a keyword argument, or an int default.
+func argNumberValue(arg interface{}) (float64, bool) {
+	switch v := arg.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case string:
+		if number, err := strconv.ParseFloat(v, 64); err == nil {
+			return number, true
+		}
+	}
+	return 0, false
+}
+
+func argTypeOk(tp argType, arg interface{}) bool {
+	switch tp {
+	case argSeries:
+		switch arg.(type) {
+		case string, SeriesMap:
+			return true
+		}
+		return false
+	case argNumber:
+		_, ok := argNumberValue(arg)
+		return ok
+	case argInteger:
+		number, ok := argNumberValue(arg)
+		return ok && number == math.Trunc(number)
+	case argString:
+		_, isSeries := arg.(SeriesMap)
+		return !isSeries
+	case argBool:
+		str, ok := arg.(string)
+		str = strings.ToLower(str)
+		return ok && (str == "true" || str == "false")
+	case argNumberOrSeries:
+		if _, ok := argNumberValue(arg); ok {
+			return true
+		}
+		return argTypeOk(argSeries, arg)
+	}
+	return true
+}
+
+// The error for an argument of the wrong type, n starts at 1.
+func argError(fnName string, n int, tp argType, arg interface{}) error {
+	expects := argTypeName(tp)
+	if tp == argNumberOrSeries {
+		expects = "float or seriesList"
+	}
+	var got string
+	switch v := arg.(type) {
+	case string:
+		got = fmt.Sprintf("%q", v)
+	case SeriesMap:
+		got = "seriesList"
+	default:
+		got = fmt.Sprintf("%v", v)
+	}
+	return fmt.Errorf("%s: argument %d expects %s, got %s", fnName, n, expects, got)
+}
+
+// The args of dslCtxFuncs are only checked for number and type, the
+// functions make sense of them.
+func checkCtxArgs(name string, fn *dslCtxFuncType, args []interface{}) error {
+	required := 0
+	for _, arg := range fn.args {
+		if arg.dft == nil {
+			required++
+		}
+	}
+	if len(args) < required || (!fn.varArg && len(args) > len(fn.args)) {
+		return fmt.Errorf("%s: expects %d arguments, got %d", name, len(fn.args), len(args))
+	}
+	for i, arg := range args {
+		n := i
+		if n >= len(fn.args) { // *arg
+			n = len(fn.args) - 1
+		}
+		tp := fn.args[n].tp
+		if tp == argString {
+			if _, ok := arg.(string); !ok {
+				return argError(name, i+1, tp, arg)
+			}
+		} else if !argTypeOk(tp, arg) {
+			return argError(name, i+1, tp, arg)
+		}
+	}
+	return nil
+}
+
 func callPreprocessArgFunc(dc *dslCtx, name string, argFunc *dslFuncType,
 	args []interface{}, argMap map[string]interface{}, argSlice []interface{}) (SeriesMap, error) {
 
@@ -507,6 +682,7 @@ func callPreprocessArgFunc(dc *dslCtx, name string, argFunc *dslFuncType,
 	argMap["_from_"] = dc.from
 	argMap["_to_"] = dc.to
 	argMap["_maxPoints_"] = dc.maxPoints
+	argMap["_tz_"] = dc.loc
 	if series, err := argFunc.call(argMap); err == nil {
 		return series, nil
 	} else {
@@ -518,9 +694,9 @@ func seriesFromFunction(dc *dslCtx, name string, args []interface{}) (SeriesMap,
 
 	argFunc, ok := preprocessArgFuncs[name]
 	if ok {
-		argMap, argSlice, err := processArgs(dc, &argFunc, args)
+		argMap, argSlice, err := processArgs(dc, name, &argFunc, args)
 		if err != nil {
-			return nil, fmt.Errorf("%v() reports an error: %v", name, err)
+			return nil, err
 		}
 		return callPreprocessArgFunc(dc, name, &argFunc, args, argMap, argSlice)
 	} else {
@@ -528,7 +704,10 @@ func seriesFromFunction(dc *dslCtx, name string, args []interface{}) (SeriesMap,
 		if dslCtxFunc, ok := dslCtxFuncs[name]; !ok {
 			return nil, fmt.Errorf("No such function: %v", name)
 		} else {
-			if series, err := dslCtxFunc(dc, args); err == nil {
+			if err := checkCtxArgs(name, &dslCtxFunc, args); err != nil {
+				return nil, err
+			}
+			if series, err := dslCtxFunc.call(dc, args); err == nil {
 				return series, nil
 			} else {
 				return nil, fmt.Errorf("%v() reports an error: %v", name, err)
@@ -559,6 +738,7 @@ func (sl *seriesMaxSeries) CurrentValue() float64 {
 
 func dslMaxSeries(args map[string]interface{}) (SeriesMap, error) {
 	series := args["seriesList"].(SeriesMap).toAliasSeriesSlice()
+	setNaturalConsolidation(series, rrd.MAX)
 	name := args["_legend_"].(string)
 	return SeriesMap{name: &seriesMaxSeries{series}}, nil
 }
@@ -575,6 +755,7 @@ func (sl *seriesMinSeries) CurrentValue() float64 {
 
 func dslMinSeries(args map[string]interface{}) (SeriesMap, error) {
 	series := args["seriesList"].(SeriesMap).toAliasSeriesSlice()
+	setNaturalConsolidation(series, rrd.MIN)
 	name := args["_legend_"].(string)
 	return SeriesMap{name: &seriesMinSeries{series}}, nil
 }
@@ -964,34 +1145,116 @@ func dslAliasByMetric(args map[string]interface{}) (SeriesMap, error) {
 	return result, nil
 }
 
+// Splits a series name into its dot-separated nodes and its tags, the
+// way Graphite does it: functions around the name are removed, e.g.
+// sumSeries(a.b.c,2) has nodes a, b and c, and a.b;dc=east;env=prod
+// has nodes a and b and tags dc, env and name (a.b).
+func parseSeriesName(name string) ([]string, map[string]string) {
+	if i := strings.LastIndex(name, "("); i > -1 {
+		name = name[i+1:]
+	}
+	if i := strings.IndexAny(name, "),"); i > -1 {
+		name = name[:i]
+	}
+	name, tags := misc.SplitTaggedName(name)
+	if tags == nil {
+		tags = make(map[string]string, 1)
+	}
+	tags["name"] = name
+	return strings.Split(name, "."), tags
+}
+
+// The node at index n, which counts from the end if negative, false if
+// it is out of range.
+func nameNode(nodes []string, n int) (string, bool) {
+	if n < 0 {
+		n = len(nodes) + n
+	}
+	if n >= len(nodes) || n < 0 {
+		return "", false
+	}
+	return nodes[n], true
+}
+
 // aliasByNode()
 func dslAliasByNode(args map[string]interface{}) (SeriesMap, error) {
 	result := args["seriesList"].(SeriesMap)
 	nodes := args["nodes"].([]interface{})
 	for name, series := range result {
-		// very crude fix for a case of sum(a.b.c.*.d)
-		if strings.Contains(name, "(") {
-			parts := strings.Split(name, "(")
-			name = strings.Replace(strings.Join(parts[1:], ""), ")", "", 1)
-		}
-		parts := strings.Split(name, ".")
+		parts, _ := parseSeriesName(name)
 		var alias_parts []string
 		for _, num := range nodes {
-			n := int(num.(float64))
-			if n < 0 {
-				n = len(parts) + n
-			}
-			if n >= len(parts) || n < 0 {
-				//return nil, fmt.Errorf("node index %v out of range for number of nodes: %v", int(num.(float64)), parts)
-				continue
+			if node, ok := nameNode(parts, int(num.(float64))); ok {
+				alias_parts = append(alias_parts, node)
 			}
-			alias_parts = append(alias_parts, parts[n])
 		}
 		series.Alias(strings.Join(alias_parts, "."))
 	}
 	return result, nil
 }
 
+// aliasByTags()
+
+// A tag is either a node index or the name of a tag, missing tags are
+// skipped.
+func dslAliasByTags(args map[string]interface{}) (SeriesMap, error) {
+	result := args["seriesList"].(SeriesMap)
+	tags := args["tags"].([]interface{})
+	for name, series := range result {
+		nodes, tagValues := parseSeriesName(name)
+		var aliasParts []string
+		for _, tag := range tags {
+			if n, err := strconv.Atoi(tag.(string)); err == nil {
+				if node, ok := nameNode(nodes, n); ok {
+					aliasParts = append(aliasParts, node)
+				}
+			} else if value, ok := tagValues[tag.(string)]; ok {
+				aliasParts = append(aliasParts, value)
+			}
+		}
+		series.Alias(strings.Join(aliasParts, "."))
+	}
+	return result, nil
+}
+
+// substr()
+
+// Like Graphite, start and stop are Python slice bounds: negative
+// counts from the end, out of range is clamped, stop 0 is the end.
+func dslSubstr(args map[string]interface{}) (SeriesMap, error) {
+	result := args["seriesList"].(SeriesMap)
+	start, stop := int(args["start"].(float64)), int(args["stop"].(float64))
+	for name, series := range result {
+		nodes, _ := parseSeriesName(name)
+		end := stop
+		if end == 0 {
+			end = len(nodes)
+		}
+		from, to := sliceBounds(len(nodes), start, end)
+		series.Alias(strings.Join(nodes[from:to], "."))
+	}
+	return result, nil
+}
+
+func sliceBounds(length, start, stop int) (int, int) {
+	clamp := func(i int) int {
+		if i < 0 {
+			i += length
+		}
+		if i < 0 {
+			return 0
+		} else if i > length {
+			return length
+		}
+		return i
+	}
+	start, stop = clamp(start), clamp(stop)
+	if stop < start {
+		stop = start
+	}
+	return start, stop
+}
+
 // aliasSub()
 // TODO regex groups don't work yet (they do with "$1" syntax, but not
 // graphite's "\1" syntax)
@@ -1160,6 +1423,9 @@ func dslSinusoid(args map[string]interface{}) (SeriesMap, error) {
 	from := args["_from_"].(time.Time)
 	to := args["_to_"].(time.Time)
 	maxPoints := args["_maxPoints_"].(int64)
+	if maxPoints <= 0 {
+		maxPoints = generatorPoints
+	}
 
 	span := to.Sub(from)
 	step := span / time.Duration(maxPoints)
@@ -1177,6 +1443,73 @@ func dslSinusoid(args map[string]interface{}) (SeriesMap, error) {
 	return SeriesMap{"sinusoid()": ss}, nil
 }
 
+// Generated data has no native resolution, without maxPoints (which
+// means every point as stored) generators make this many.
+const generatorPoints = 512
+
+// generatorSlots returns the beginning, step and number of points for
+// functions which generate data rather than read it, such as sin() or
+// randomWalk(). The step is derived from the requested range and
+// maxPoints, same as sinusoid().
+func generatorSlots(args map[string]interface{}) (time.Time, time.Duration, int) {
+	from := args["_from_"].(time.Time)
+	to := args["_to_"].(time.Time)
+	maxPoints := args["_maxPoints_"].(int64)
+	if maxPoints <= 0 {
+		maxPoints = generatorPoints
+	}
+
+	step := to.Sub(from) / time.Duration(maxPoints)
+	if step <= 0 {
+		step = time.Second
+	}
+	return from, step, int(to.Sub(from) / step)
+}
+
+// sin()
+
+func dslSin(args map[string]interface{}) (SeriesMap, error) {
+
+	name := args["name"].(string)
+	amplitude := args["amplitude"].(float64)
+	from, step, n := generatorSlots(args)
+
+	// Like Graphite, the value is the sine of the timestamp (in
+	// seconds) at which the slot begins.
+	dps := make([]float64, 0, n)
+	for i := 0; i < n; i++ {
+		t := from.Add(step * time.Duration(i))
+		dps = append(dps, amplitude*math.Sin(float64(t.UnixNano())/1e9))
+	}
+
+	ss := series.NewSliceSeries(dps, from.Add(step), step) // because _from_ is end of slot, not beginning
+	ss.Alias(name)
+
+	return SeriesMap{name: ss}, nil
+}
+
+// randomWalk()
+
+func dslRandomWalk(args map[string]interface{}) (SeriesMap, error) {
+
+	name := args["name"].(string)
+	from, step, n := generatorSlots(args)
+
+	// Starts at 0 and moves by a random amount in [-0.5, 0.5)
+	// every step.
+	dps := make([]float64, 0, n)
+	var value float64
+	for i := 0; i < n; i++ {
+		dps = append(dps, value)
+		value += rand.Float64() - 0.5
+	}
+
+	ss := series.NewSliceSeries(dps, from.Add(step), step) // because _from_ is end of slot, not beginning
+	ss.Alias(name)
+
+	return SeriesMap{name: ss}, nil
+}
+
 // derivative()
 
 type seriesDerivative struct {
@@ -1237,13 +1570,30 @@ type seriesLogarithm struct {
 	base float64
 }
 
+// Math functions return Inf (or NaN) when the result is out of
+// range, but as far as series are concerned there is no value.
+func finiteOrNaN(v float64) float64 {
+	if math.IsInf(v, 0) {
+		return math.NaN()
+	}
+	return v
+}
+
+// The log of zero or a negative value is NaN.
 func (f *seriesLogarithm) CurrentValue() float64 {
-	return math.Log(f.AliasSeries.CurrentValue()) / math.Log(f.base)
+	v := f.AliasSeries.CurrentValue()
+	if v <= 0 {
+		return math.NaN()
+	}
+	return finiteOrNaN(math.Log(v) / math.Log(f.base))
 }
 
 func dslLogarithm(args map[string]interface{}) (SeriesMap, error) {
 	series := args["seriesList"].(SeriesMap)
 	base := args["base"].(float64)
+	if base <= 0 || base == 1 {
+		return nil, fmt.Errorf("logarithm(): invalid base: %v", base)
+	}
 	for name, s := range series {
 		s.Alias(fmt.Sprintf("logarithm(%v,%v)", name, base))
 		series[name] = &seriesLogarithm{s, base}
@@ -1251,6 +1601,47 @@ func dslLogarithm(args map[string]interface{}) (SeriesMap, error) {
 	return series, nil
 }
 
+// pow()
+
+type seriesPow struct {
+	AliasSeries
+	factor float64
+}
+
+// A negative value to a non-integer power is NaN.
+func (f *seriesPow) CurrentValue() float64 {
+	return finiteOrNaN(math.Pow(f.AliasSeries.CurrentValue(), f.factor))
+}
+
+func dslPow(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	factor := args["factor"].(float64)
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("pow(%v,%v)", name, factor))
+		series[name] = &seriesPow{s, factor}
+	}
+	return series, nil
+}
+
+// exp()
+
+type seriesExp struct {
+	AliasSeries
+}
+
+func (f *seriesExp) CurrentValue() float64 {
+	return finiteOrNaN(math.Exp(f.AliasSeries.CurrentValue()))
+}
+
+func dslExp(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("exp(%v)", name))
+		series[name] = &seriesExp{s}
+	}
+	return series, nil
+}
+
 // nonNegativeDerivative()
 type seriesNonNegativeDerivative struct {
 	AliasSeries
@@ -1310,12 +1701,17 @@ func dslOffset(args map[string]interface{}) (SeriesMap, error) {
 type seriesOffsetToZero struct {
 	AliasSeries
 	offset float64
+	ready  bool
 }
 
 func (f *seriesOffsetToZero) Next() bool {
-	if math.IsNaN(f.offset) {
+	// The min (which ignores NaNs) may itself be NaN if there is no
+	// data, which is why we cannot use it to tell whether it has
+	// been computed.
+	if !f.ready {
 		summary := &aliasSummarySeries{SummarySeries: &series.SummarySeries{f.AliasSeries}}
 		f.offset = summary.Min()
+		f.ready = true
 	}
 	return f.AliasSeries.Next()
 }
@@ -1328,7 +1724,66 @@ func dslOffsetToZero(args map[string]interface{}) (SeriesMap, error) {
 	series := args["seriesList"].(SeriesMap)
 	for name, s := range series {
 		s.Alias(fmt.Sprintf("offsetToZero(%v)", name))
-		series[name] = &seriesOffsetToZero{s, math.NaN()}
+		series[name] = &seriesOffsetToZero{AliasSeries: s}
+	}
+	return series, nil
+}
+
+// delay()
+
+// Unlike timeShift(), which moves the times, delay() moves the values
+// forward by a number of steps, the first steps points are NaN.
+type seriesDelay struct {
+	AliasSeries
+	steps int
+	buf   []float64 // last steps+1 values, by position % (steps+1)
+	pos   int       // number of points so far
+}
+
+func (f *seriesDelay) Next() bool {
+	if !f.AliasSeries.Next() {
+		f.pos = 0
+		return false
+	}
+	// buf grows as points come, it is never more than the points of
+	// the series, however many steps there are.
+	if v := f.AliasSeries.CurrentValue(); len(f.buf) <= f.steps && f.pos == len(f.buf) {
+		f.buf = append(f.buf, v)
+	} else {
+		f.buf[f.pos%(f.steps+1)] = v
+	}
+	f.pos++
+	return true
+}
+
+func (f *seriesDelay) CurrentValue() float64 {
+	if f.pos <= f.steps {
+		return math.NaN()
+	}
+	return f.buf[(f.pos-1-f.steps)%(f.steps+1)]
+}
+
+func (f *seriesDelay) Close() error {
+	f.pos = 0
+	return f.AliasSeries.Close()
+}
+
+func dslDelay(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	fsteps := args["steps"].(float64)
+	if fsteps < 0 {
+		return nil, fmt.Errorf("delay: steps cannot be negative: %v", fsteps)
+	}
+	steps := math.MaxInt32
+	if fsteps < math.MaxInt32 {
+		steps = int(fsteps)
+	}
+	if steps == 0 {
+		return series, nil
+	}
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("delay(%s,%d)", name, steps))
+		series[name] = &seriesDelay{AliasSeries: s, steps: steps}
 	}
 	return series, nil
 }
@@ -1517,6 +1972,8 @@ func dslHighestMax(args map[string]interface{}) (SeriesMap, error) {
 
 // limit()
 
+// The first n series in the order of their names, which is the order
+// of sortByName() and the order in which /render returns them.
 func dslLimit(args map[string]interface{}) (SeriesMap, error) {
 	series := args["seriesList"].(SeriesMap)
 	n := int(args["n"].(float64))
@@ -1530,6 +1987,13 @@ func dslLimit(args map[string]interface{}) (SeriesMap, error) {
 	return result, nil
 }
 
+// sortByName()
+
+// A SeriesMap is always output sorted by name, there is nothing to do.
+func dslSortByName(args map[string]interface{}) (SeriesMap, error) {
+	return args["seriesList"].(SeriesMap), nil
+}
+
 // lowestAverage()
 
 func dslLowestAverage(args map[string]interface{}) (SeriesMap, error) {
@@ -1566,60 +2030,61 @@ func dslLowestCurrent(args map[string]interface{}) (SeriesMap, error) {
 	return series, nil
 }
 
-// maximumAbove()
-
-func dslMaximumAbove(args map[string]interface{}) (SeriesMap, error) {
+// Filtering by a statistic of every series, the statistics ignore
+// NaNs. A series that is all NaN has no statistic and never satisfies
+// the threshold, i.e. it is excluded by all of the filters below.
+func filterByStat(args map[string]interface{}, stat func(*aliasSummarySeries) float64, keep func(v, n float64) bool) (SeriesMap, error) {
 	series := args["seriesList"].(SeriesMap)
 	n := args["n"].(float64)
 	for name, s := range series {
-		shm := newAliasSummarySeries(s)
-		if shm.Max() <= n {
+		if v := stat(newAliasSummarySeries(s)); math.IsNaN(v) || !keep(v, n) {
 			delete(series, name)
 		}
 	}
 	return series, nil
 }
 
+func statAvg(s *aliasSummarySeries) float64 { return s.Avg() }
+func statMax(s *aliasSummarySeries) float64 { return s.Max() }
+func statMin(s *aliasSummarySeries) float64 { return s.Min() }
+
+func statAbove(v, n float64) bool { return v > n }
+func statBelow(v, n float64) bool { return v < n }
+
+// averageAbove()
+
+func dslAverageAbove(args map[string]interface{}) (SeriesMap, error) {
+	return filterByStat(args, statAvg, statAbove)
+}
+
+// averageBelow()
+
+func dslAverageBelow(args map[string]interface{}) (SeriesMap, error) {
+	return filterByStat(args, statAvg, statBelow)
+}
+
+// maximumAbove()
+
+func dslMaximumAbove(args map[string]interface{}) (SeriesMap, error) {
+	return filterByStat(args, statMax, statAbove)
+}
+
 // maximumBelow()
 
 func dslMaximumBelow(args map[string]interface{}) (SeriesMap, error) {
-	series := args["seriesList"].(SeriesMap)
-	n := args["n"].(float64)
-	for name, s := range series {
-		shm := newAliasSummarySeries(s)
-		if shm.Max() >= n {
-			delete(series, name)
-		}
-	}
-	return series, nil
+	return filterByStat(args, statMax, statBelow)
 }
 
 // minimumAbove()
 
 func dslMinimumAbove(args map[string]interface{}) (SeriesMap, error) {
-	series := args["seriesList"].(SeriesMap)
-	n := args["n"].(float64)
-	for name, s := range series {
-		shm := newAliasSummarySeries(s)
-		if shm.Min() <= n {
-			delete(series, name)
-		}
-	}
-	return series, nil
+	return filterByStat(args, statMin, statAbove)
 }
 
 // minimumBelow()
 
 func dslMinimumBelow(args map[string]interface{}) (SeriesMap, error) {
-	series := args["seriesList"].(SeriesMap)
-	n := args["n"].(float64)
-	for name, s := range series {
-		shm := newAliasSummarySeries(s)
-		if shm.Min() >= n {
-			delete(series, name)
-		}
-	}
-	return series, nil
+	return filterByStat(args, statMin, statBelow)
 }
 
 // mostDeviant()
@@ -1650,13 +2115,34 @@ type seriesMovingAverage struct {
 	dur       time.Duration
 }
 
+// windowPoints converts a moving window duration to a number of
+// points given the series step. This works because we outer join with
+// the time generate_series, and thus never skip a time period. When
+// the duration is not a multiple of the step, it is rounded to the
+// nearest number of points (halves round up), and a window shorter
+// than the step (or half of it) is still one point, i.e. the series
+// itself.
+func windowPoints(dur, step time.Duration) int {
+	if step <= 0 {
+		return 1
+	}
+	n := int((dur + step/2) / step)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
 func (f *seriesMovingAverage) Next() bool {
-	// if we're given a duration, then the number of points is simply
-	// the duration / group by period. this works because we outer
-	// join with the time generate_series, and thus never skip a time
-	// period
+	// if we're given a duration, the number of points depends on the
+	// group by period, which is only reliable after the first Next()
 	if f.dur != 0 && f.points == 0 {
-		f.points = int(f.dur/(f.GroupBy()+1)) + 1 // +1 to avoid div by 0
+		if !f.AliasSeries.Next() {
+			return false
+		}
+		f.points = windowPoints(f.dur, f.GroupBy())
+		f.window = append(f.window, f.AliasSeries.CurrentValue())
+		f.n++
 	}
 	// initial build up
 	for len(f.window) < f.points {
@@ -1717,12 +2203,14 @@ type seriesMovingMedian struct {
 }
 
 func (f *seriesMovingMedian) Next() bool {
-	// if we're given a duration, then the number of points is simply
-	// the duration / group by period. this works because we outer
-	// join with the time generate_series, and thus never skip a time
-	// period
+	// see seriesMovingAverage.Next()
 	if f.dur != 0 && f.points == 0 {
-		f.points = int(f.dur/f.GroupBy()) + 1 // +1 to avoid div by 0
+		if !f.AliasSeries.Next() {
+			return false
+		}
+		f.points = windowPoints(f.dur, f.GroupBy())
+		f.window = append(f.window, f.AliasSeries.CurrentValue())
+		f.n++
 	}
 	// initial build up
 	for len(f.window) < f.points {
@@ -1916,6 +2404,22 @@ func dslRemoveBelowValue(args map[string]interface{}) (SeriesMap, error) {
 	return series, nil
 }
 
+// removeEmptySeries()
+// Like an RRA slot with its XFF, a series is removed if the fraction
+// of its values which are not NaN is below xFilesFactor, and always if
+// they are all NaN.
+
+func dslRemoveEmptySeries(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	xff := args["xFilesFactor"].(float64)
+	for name, s := range series {
+		if known := newAliasSummarySeries(s).Known(); known == 0 || known < xff {
+			delete(series, name)
+		}
+	}
+	return series, nil
+}
+
 // stdev
 // TODO implement windowTolerance ?
 // average of []float64
@@ -2253,61 +2757,194 @@ func dslUseSeriesAbove(args map[string]interface{}) (SeriesMap, error) {
 }
 
 // consolidateBy()
-// this is fake
+//
+// Sets how the points are consolidated to satisfy maxDataPoints,
+// where the series supports it (see series.Consolidator), it then
+// cannot be changed by a reducer such as maxSeries() applied to it.
+// Otherwise sum is approximated by scaling the averages.
 type seriesConsolidateBy struct {
 	AliasSeries
 	factor float64
+	cf     rrd.Consolidation
 }
 
 func (sl *seriesConsolidateBy) CurrentValue() float64 {
 	return sl.AliasSeries.CurrentValue() * sl.factor
 }
 
+// Explicit, a reducer cannot change it.
+func (sl *seriesConsolidateBy) Consolidation(...rrd.Consolidation) rrd.Consolidation {
+	return sl.cf
+}
+
 func dslConsolidateBy(args map[string]interface{}) (SeriesMap, error) {
 
-	series := args["seriesList"].(SeriesMap)
+	sm := args["seriesList"].(SeriesMap)
 	fname := args["consolidationFunc"].(string)
 	maxPoints := args["_maxPoints_"].(int64)
 
-	var factor float64 = 1
-
-	if fname == "sum" && maxPoints > 0 {
-		from := args["_from_"].(time.Time)
-		to := args["_to_"].(time.Time)
-		// factor is seconds per point
-		factor = to.Sub(from).Seconds() / float64(maxPoints)
-	}
-
-	for name, s := range series {
+	cf, known := rrd.WMEAN, true
+	switch fname {
+	case "average", "avg":
+	case "max":
+		cf = rrd.MAX
+	case "min":
+		cf = rrd.MIN
+	case "last":
+		cf = rrd.LAST
+	case "sum":
+		cf = rrd.SUM
+	default:
+		known = false
+	}
+
+	for name, s := range sm {
+		var factor float64 = 1
+		supported := false
+		if c, ok := s.(series.Consolidator); ok && known {
+			c.Consolidation(cf)
+			supported = c.Consolidation() == cf
+		}
+		if !supported && fname == "sum" && maxPoints > 0 {
+			from := args["_from_"].(time.Time)
+			to := args["_to_"].(time.Time)
+			// factor is seconds per point
+			factor = to.Sub(from).Seconds() / float64(maxPoints)
+		}
 		s.Alias(fmt.Sprintf("consolidateBy(%v,%v)", name, fname))
-		series[name] = &seriesConsolidateBy{s, factor}
+		sm[name] = &seriesConsolidateBy{s, factor, cf}
 	}
-	return series, nil
+	return sm, nil
 }
 
 // summarize()
 //
+// The points are grouped into intervals and averaged, which for sum
+// (the data points being rates) is then multiplied by the interval,
+// i.e. it is the total. An interval shorter than the step gets the
+// value of the point whose slot it is in.
 type seriesSummarize struct {
 	AliasSeries
-	factor float64
+	interval time.Duration
+	origin   time.Time      // an interval boundary, with alignToFrom
+	loc      *time.Location // without alignToFrom, see intervalEnd()
+	factor   float64
+	end      time.Time // of the current interval
+	value    float64
+	pending  bool // the AliasSeries is at a point of the next interval
+	done     bool // the AliasSeries has no more points
+}
+
+// Where the interval of the point ending at t ends. In loc the
+// boundaries are multiples of the interval of the local (wall clock)
+// time, each converted by its own offset, so that e.g. "1d" intervals
+// begin at the local midnight also after a DST change, which makes
+// that day 23 or 25 hours long.
+func (sl *seriesSummarize) intervalEnd(t time.Time) time.Time {
+	if sl.loc == nil {
+		n := t.Sub(sl.origin) / sl.interval
+		end := sl.origin.Add(n * sl.interval)
+		if end.Before(t) {
+			end = end.Add(sl.interval)
+		}
+		return end
+	}
+	_, offset := t.In(sl.loc).Zone()
+	wall := t.Add(time.Duration(offset) * time.Second).UTC().Truncate(sl.interval)
+	end := wallIn(wall, sl.loc)
+	if end.Before(t) {
+		end = wallIn(wall.Add(sl.interval), sl.loc)
+	}
+	return end.In(t.Location())
+}
+
+// The end of the interval after the one ending at end.
+func (sl *seriesSummarize) nextEnd(end time.Time) time.Time {
+	return sl.intervalEnd(end.Add(time.Nanosecond))
+}
+
+// The time in loc of the wall clock time w, given in UTC.
+func wallIn(w time.Time, loc *time.Location) time.Time {
+	return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), w.Nanosecond(), loc)
+}
+
+func (sl *seriesSummarize) Next() bool {
+	if sl.done {
+		return false
+	}
+	if !sl.pending {
+		if !sl.AliasSeries.Next() {
+			sl.done = true
+			return false
+		}
+		sl.pending = true
+	}
+
+	end := sl.intervalEnd(sl.AliasSeries.CurrentTime())
+	if !sl.end.IsZero() && end.After(sl.nextEnd(sl.end)) {
+		// an interval without points, it is within the slot of the
+		// next point (the step is longer than the interval)
+		sl.end, sl.value = sl.nextEnd(sl.end), sl.AliasSeries.CurrentValue()
+		return true
+	}
+
+	var sum float64
+	var n int
+	for sl.pending && !sl.intervalEnd(sl.AliasSeries.CurrentTime()).After(end) {
+		if v := sl.AliasSeries.CurrentValue(); !math.IsNaN(v) {
+			sum += v
+			n++
+		}
+		if sl.pending = sl.AliasSeries.Next(); !sl.pending {
+			sl.done = true // but this interval is still returned
+		}
+	}
+	sl.end, sl.value = end, math.NaN()
+	if n > 0 {
+		sl.value = sum / float64(n)
+	}
+	return true
 }
 
 func (sl *seriesSummarize) CurrentValue() float64 {
-	return sl.AliasSeries.CurrentValue() * sl.factor
+	return sl.value * sl.factor
+}
+
+func (sl *seriesSummarize) CurrentTime() time.Time {
+	return sl.end
+}
+
+func (sl *seriesSummarize) GroupBy(td ...time.Duration) time.Duration {
+	if len(td) > 0 {
+		return sl.AliasSeries.GroupBy(td...)
+	}
+	return sl.interval
+}
+
+func (sl *seriesSummarize) Close() error {
+	sl.end, sl.value, sl.pending, sl.done = time.Time{}, math.NaN(), false, false
+	return sl.AliasSeries.Close()
 }
 
 func dslSummarize(args map[string]interface{}) (SeriesMap, error) {
 	series := args["seriesList"].(SeriesMap)
 	is := args["intervalString"].(string)
 	fname := args["func"].(string)
+	alignToFrom := args["alignToFrom"].(bool)
+	from := args["_from_"].(time.Time)
+	loc := args["_tz_"].(*time.Location)
+
+	interval, err := misc.BetterParseDuration(is)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval: %v", is)
+	}
 
 	var factor float64
 	if fname == "sum" {
-		dur, err := misc.BetterParseDuration(is)
-		if err != nil {
-			return nil, err
-		}
-		factor = dur.Seconds()
+		factor = interval.Seconds()
 	} else {
 		// assume avg
 		// max and min cannot really be supported
@@ -2315,9 +2952,17 @@ func dslSummarize(args map[string]interface{}) (SeriesMap, error) {
 		factor = 1
 	}
 
+	// The intervals begin at from with alignToFrom, otherwise
+	// they are aligned to the (local) time of day in loc
+	origin := from
+	if alignToFrom {
+		loc = nil
+	} else if loc == nil {
+		loc = time.UTC
+	}
 	for name, s := range series {
 		s.Alias(fmt.Sprintf("summarize(%v,%v,%v)", name, is, fname))
-		series[name] = &seriesSummarize{s, factor}
+		series[name] = &seriesSummarize{AliasSeries: s, interval: interval, origin: origin, loc: loc, factor: factor, value: math.NaN()}
 	}
 
 	return series, nil
@@ -2365,6 +3010,11 @@ func dslTimeStack(dc *dslCtx, args []interface{}) (SeriesMap, error) {
 
 	series := make(SeriesMap)
 	idents := dc.identsFromPattern(sspec)
+	if num >= begin {
+		if err := dc.countSeries(idents, len(idents)*(num-begin+1)); err != nil {
+			return nil, err
+		}
+	}
 	for name, ident := range idents {
 		ds, err := dc.FetchOrCreateDataSource(ident, nil)
 		if err != nil {
@@ -2392,6 +3042,181 @@ func dslTimeStack(dc *dslCtx, args []interface{}) (SeriesMap, error) {
 	return series, nil
 }
 
+// atResolution()
+
+// resolutionDs only has the RRA of the given step, so that whichever
+// fetcher it is given to cannot choose another one.
+type resolutionDs struct {
+	rrd.DataSourcer
+	step time.Duration
+}
+
+func (ds *resolutionDs) RRAs() []rrd.RoundRobinArchiver {
+	for _, rra := range ds.DataSourcer.RRAs() {
+		if rra.Step() == ds.step {
+			return []rrd.RoundRobinArchiver{rra}
+		}
+	}
+	return nil
+}
+
+func (ds *resolutionDs) BestRRA(start, end time.Time, points int64) rrd.RoundRobinArchiver {
+	if rras := ds.RRAs(); len(rras) > 0 {
+		return rras[0]
+	}
+	return nil
+}
+
+// Wraps ds in a resolutionDs keeping whatever the fetchers expect it
+// to be, i.e. a *watchedDs (sharing its lock) or a DbDataSourcer.
+func pinResolution(ds rrd.DataSourcer, step time.Duration) rrd.DataSourcer {
+	switch d := ds.(type) {
+	case *watchedDs:
+		return &watchedDs{DataSourcer: &resolutionDs{d, step}, RWMutex: d.RWMutex, ident: d.ident}
+	case serde.DbDataSourcer:
+		return serde.NewDbDataSource(d.Id(), d.Ident(), d.Seg(), d.Idx(), &resolutionDs{d, step})
+	}
+	return &resolutionDs{ds, step}
+}
+
+func rraSteps(ds rrd.DataSourcer) []time.Duration {
+	if wds, ok := ds.(*watchedDs); ok {
+		wds.RLock()
+		defer wds.RUnlock()
+	}
+	var result []time.Duration
+	for _, rra := range ds.RRAs() {
+		result = append(result, rra.Step())
+	}
+	return result
+}
+
+func hasStep(steps []time.Duration, step time.Duration) bool {
+	for _, s := range steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+func dslAtResolution(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	sspec, ok := args[0].(string)
+	if !ok {
+		// Like timeStack, we need the DSs, not the series.
+		return nil, fmt.Errorf("%v is not a string", args[0])
+	}
+	rspec := args[1].(string)
+	step, err := misc.BetterParseDuration(rspec)
+	if err != nil {
+		return nil, err
+	}
+
+	idents := dc.identsFromPattern(sspec)
+	if err := dc.countSeries(idents, len(idents)); err != nil {
+		return nil, err
+	}
+	series := make(SeriesMap)
+	for name, ident := range idents {
+		ds, err := dc.FetchOrCreateDataSource(ident, nil)
+		if err != nil {
+			return nil, fmt.Errorf("atResolution(): Error %v", err)
+		}
+		if ds == nil {
+			continue
+		}
+
+		if available := rraSteps(ds); !hasStep(available, step) {
+			sa := make([]string, len(available))
+			for n, s := range available {
+				sa[n] = s.String()
+			}
+			return nil, fmt.Errorf("no %v RRA for %s, available: %s", step, name, strings.Join(sa, ", "))
+		}
+
+		// No maxPoints, the point is to get the points of this RRA as is
+		dps, err := dc.FetchSeries(pinResolution(ds, step), dc.from, dc.to, 0)
+		if err != nil {
+			return nil, fmt.Errorf("atResolution(): Error %v", err)
+		}
+		dps.TimeRange(dc.from, dc.to)
+		series[name] = &aliasSeries{Series: dps}
+	}
+	return series, nil
+}
+
+// aberration()
+//
+// The deviation of every series of seriesList from refSeries, a
+// baseline such as the same series a week earlier: by how much it is
+// above (positive) or below (negative) the band of refSeries +/-
+// tolerance (a fraction of it, e.g. 0.1 for 10%), 0 within it. The
+// two are aligned to a common step. Where either value is missing the
+// result is NaN, a gap is not the absence of a deviation
+// (transformNull() the inputs to treat missing as zero).
+//
+// We cannot iterate over the same series from several places, so
+// refSeries as a path is fetched again for every series of
+// seriesList, as a function (e.g. timeShift()) it only works with a
+// single series.
+type seriesAberration struct {
+	*aliasSeriesSlice // the series and the reference
+	tolerance         float64
+}
+
+func (sl *seriesAberration) CurrentValue() float64 {
+	v, ref := sl.SeriesSlice[0].CurrentValue(), sl.SeriesSlice[1].CurrentValue()
+	if math.IsNaN(v) || math.IsNaN(ref) {
+		return math.NaN()
+	}
+	band := math.Abs(ref) * sl.tolerance
+	if v > ref+band {
+		return v - (ref + band)
+	}
+	if v < ref-band {
+		return v - (ref - band)
+	}
+	return 0
+}
+
+func dslAberration(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+	smap, err := dc.seriesFromSeriesOrIdent(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var tolerance float64
+	if len(args) > 2 {
+		tolerance, _ = argNumberValue(args[2])
+		if tolerance < 0 {
+			return nil, fmt.Errorf("tolerance must not be negative, got %v", tolerance)
+		}
+	}
+
+	rmap, isMap := args[1].(SeriesMap)
+	if isMap && len(smap) > 1 {
+		return nil, fmt.Errorf("a function as refSeries requires a single series, got %d, use a path instead", len(smap))
+	}
+
+	result := make(SeriesMap, len(smap))
+	for _, name := range smap.SortedKeys() {
+		if !isMap {
+			if rmap, err = dc.seriesFromSeriesOrIdent(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		if len(rmap) != 1 {
+			return nil, fmt.Errorf("refSeries must be exactly one series, got %d", len(rmap))
+		}
+		refName := rmap.SortedKeys()[0]
+
+		sl := &aliasSeriesSlice{SeriesSlice: series.SeriesSlice{smap[name], rmap[refName]}}
+		sl.Align()
+		sl.Alias(fmt.Sprintf("aberration(%s,%s)", name, refName))
+		result[name] = &seriesAberration{sl, tolerance}
+	}
+	return result, nil
+}
+
 // holtWintersForecast
 
 type seriesHoltWintersForecast struct {
@@ -2486,7 +3311,9 @@ func dslHoltWintersForecast(args map[string]interface{}) (SeriesMap, error) {
 		// If we went beyond "viewport", adjust the underlying Series and MaxPoints
 		if adjustedFrom.Before(from) {
 			s.TimeRange(adjustedFrom)
-			s.MaxPoints(to.Sub(adjustedFrom).Nanoseconds() / (to.Sub(from).Nanoseconds() / maxPoints))
+			if maxPoints > 0 { // otherwise there is no consolidation to keep the same
+				s.MaxPoints(to.Sub(adjustedFrom).Nanoseconds() / (to.Sub(from).Nanoseconds() / maxPoints))
+			}
 		} else {
 			// Set it back to be same as from, disregard seasonLimit when viewport has enough seasons
 			adjustedFrom = from
@@ -2620,3 +3447,68 @@ func dslHoltWintersAberration(args map[string]interface{}) (SeriesMap, error) {
 	args["show"] = "aberr"
 	return dslHoltWintersForecast(args)
 }
+
+// events()
+
+type eventFetcher interface {
+	FetchEvents(tags []string, from, to time.Time) ([]*serde.Event, error)
+}
+
+func dslEvents(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+
+	ef, ok := dc.ctxDSFetcher.(eventFetcher)
+	if !ok {
+		return nil, fmt.Errorf("Events are not supported by this storage")
+	}
+
+	tags := make([]string, 0, len(args))
+	for _, arg := range args {
+		tag, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a string", arg)
+		}
+		if tag != "*" { // Graphite uses "*" to mean all events
+			tags = append(tags, tag)
+		}
+	}
+
+	events, err := ef.FetchEvents(tags, dc.from, dc.to)
+	if err != nil {
+		return nil, err
+	}
+
+	maxPoints := dc.maxPoints
+	if maxPoints <= 0 {
+		maxPoints = 1
+	}
+	step := dc.to.Sub(dc.from) / time.Duration(maxPoints)
+	if step <= 0 {
+		step = time.Second
+	}
+
+	// The value is the count of events in the slot, or NaN when there
+	// aren't any, so that only the slots with events are drawn.
+	n := int(dc.to.Sub(dc.from) / step)
+	dps := make([]float64, n)
+	for i := range dps {
+		dps[i] = math.NaN()
+	}
+	for _, e := range events {
+		i := int(e.When.Sub(dc.from) / step)
+		if i >= n {
+			i = n - 1
+		}
+		if i < 0 {
+			continue
+		}
+		if math.IsNaN(dps[i]) {
+			dps[i] = 0
+		}
+		dps[i]++
+	}
+
+	ss := series.NewSliceSeries(dps, dc.from.Add(step), step) // because _from_ is end of slot, not beginning
+	name := fmt.Sprintf("events(%s)", argsAsString(args))
+	ss.Alias(name)
+	return SeriesMap{name: ss}, nil
+}
@@ -3,12 +3,15 @@ package dsl
 import (
 	"fmt"
 	"math"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
 )
 
 // TODO: These are happy path tests, need more edge-case testing
@@ -244,6 +247,73 @@ func Test_dsl_sumSeries(t *testing.T) {
 	}
 }
 
+// sumSeries with missing values
+func Test_dsl_sumSeriesNaN(t *testing.T) {
+	td := setupTestData()
+
+	for name, n := range map[string]int64{"foo.bar.sumnan.a": 5, "foo.bar.sumnan.b": 3} {
+		spec := &rrd.DSSpec{
+			Step: time.Second,
+			RRAs: []rrd.RRASpec{
+				rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: 10 * time.Minute, Latest: td.when},
+			},
+		}
+		spec.RRAs[0].DPs = make(map[int64]float64)
+		for i := int64(0); i < 10; i++ {
+			if i < n {
+				spec.RRAs[0].DPs[i] = float64(n)
+			} else {
+				spec.RRAs[0].DPs[i] = math.NaN()
+			}
+		}
+		if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Error(err)
+		}
+	}
+	td.rcache.(*namedDsFetcher).Preload()
+
+	// Graphite semantics: NaN is skipped, all NaN is NaN
+	sm, err := ParseDsl(td.rcache, `sumSeries("foo.bar.sumnan.*")`, td.from, td.to, 60)
+	if err != nil {
+		t.Error(err)
+	}
+	nans, values := 0, map[float64]int{}
+	for _, s := range sm {
+		for s.Next() {
+			if v := s.CurrentValue(); math.IsNaN(v) {
+				nans++
+			} else {
+				values[v]++
+			}
+		}
+	}
+	if nans == 0 {
+		t.Errorf("Expected NaN where all inputs are NaN")
+	}
+	if len(values) != 2 || values[8] == 0 || values[5] == 0 {
+		t.Errorf("Unexpected values: %v (expected only 8's and 5's)", values)
+	}
+
+	// Missing as zero
+	sm, err = ParseDsl(td.rcache, `sumSeries(transformNull("foo.bar.sumnan.*", 0))`, td.from, td.to, 60)
+	if err != nil {
+		t.Error(err)
+	}
+	nans, zeros := 0, 0
+	for _, s := range sm {
+		for s.Next() {
+			if v := s.CurrentValue(); math.IsNaN(v) {
+				nans++
+			} else if v == 0 {
+				zeros++
+			}
+		}
+	}
+	if nans != 0 || zeros == 0 {
+		t.Errorf("Expected zeros and no NaNs with transformNull(), got %d NaNs, %d zeros", nans, zeros)
+	}
+}
+
 // multiplySeries
 func Test_dsl_multiplySeries(t *testing.T) {
 	td := setupTestData()
@@ -291,6 +361,73 @@ func Test_dsl_derivative(t *testing.T) {
 	}
 }
 
+// derivative has no previous point to subtract from the first
+func Test_dsl_derivativeFirst(t *testing.T) {
+	td := setupTestData()
+	sm, err := ParseDsl(nil, `derivative(constantLine(10))`, td.from, td.to, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, s := range sm {
+		for i := 0; s.Next(); i++ {
+			if v := s.CurrentValue(); (i == 0) != math.IsNaN(v) || (i > 0 && v != 0) {
+				t.Errorf("Unexpected derivative at %d: %v", i, v)
+			}
+		}
+	}
+}
+
+// delay
+func Test_dsl_delay(t *testing.T) {
+	td := setupTestData()
+	for steps := 0; steps < 4; steps++ {
+		sm, err := ParseDsl(nil, fmt.Sprintf(`delay(sinusoid(), %d)`, steps), td.from, td.to, 10)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, s := range sm {
+			// twice to also check that Close() starts over
+			for pass := 0; pass < 2; pass++ {
+				i := 0
+				for s.Next() {
+					v := s.CurrentValue()
+					if i < steps {
+						if !math.IsNaN(v) {
+							t.Errorf("delay %d: expected NaN at %d, got %v", steps, i, v)
+						}
+					} else if gen := math.Sin(2 * math.Pi / float64(10) * float64(i-steps)); v != gen {
+						t.Errorf("delay %d: incorrect value at %d: %v (expected: %v)", steps, i, v, gen)
+					}
+					i++
+				}
+				s.Close()
+			}
+		}
+	}
+
+	if _, err := ParseDsl(nil, `delay(sinusoid(), -1)`, td.from, td.to, 10); err == nil {
+		t.Errorf("Expected an error for negative steps")
+	}
+
+	// More steps than points: all NaN, without a buffer of that many
+	sm, err := ParseDsl(nil, `delay(sinusoid(), 1e15)`, td.from, td.to, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sm {
+		n := 0
+		for s.Next() {
+			if v := s.CurrentValue(); !math.IsNaN(v) {
+				t.Errorf("delay 1e15: expected NaN at %d, got %v", n, v)
+			}
+			n++
+		}
+		if d := s.(*seriesDelay); n == 0 || len(d.buf) > n {
+			t.Errorf("delay 1e15: expected a buffer of at most %d points, got %d", n, len(d.buf))
+		}
+	}
+}
+
 // integral
 func Test_dsl_integral(t *testing.T) {
 	td := setupTestData()
@@ -329,6 +466,81 @@ func Test_dsl_logarithm(t *testing.T) {
 	}
 }
 
+func Test_dsl_logarithmDomain(t *testing.T) {
+	td := setupTestData()
+	for _, expr := range []string{"log(constantLine(0))", "log(constantLine(-10), 2)"} {
+		sm, err := ParseDsl(nil, expr, td.from, td.to, 10)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, s := range sm {
+			for s.Next() {
+				if v := s.CurrentValue(); !math.IsNaN(v) {
+					t.Errorf("%s: expected NaN, got %v", expr, v)
+				}
+			}
+		}
+	}
+	if _, err := ParseDsl(nil, "log(constantLine(10), 1)", td.from, td.to, 10); err == nil {
+		t.Errorf("Expected an error for base 1")
+	}
+}
+
+// pow
+func Test_dsl_pow(t *testing.T) {
+	td := setupTestData()
+	sm, err := ParseDsl(nil, "pow(constantLine(3), 2)", td.from, td.to, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok, unexpected := checkEveryValueIs(sm, 9); !ok {
+		t.Errorf("Unexpected value: %v", unexpected)
+	}
+
+	// a negative value to a fractional power and overflow
+	for _, expr := range []string{"pow(constantLine(-8), 0.5)", "pow(constantLine(10), 1000)"} {
+		sm, err = ParseDsl(nil, expr, td.from, td.to, 10)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, s := range sm {
+			for s.Next() {
+				if v := s.CurrentValue(); !math.IsNaN(v) {
+					t.Errorf("%s: expected NaN, got %v", expr, v)
+				}
+			}
+		}
+	}
+}
+
+// exp
+func Test_dsl_exp(t *testing.T) {
+	td := setupTestData()
+	sm, err := ParseDsl(nil, "exp(constantLine(0))", td.from, td.to, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok, unexpected := checkEveryValueIs(sm, 1); !ok {
+		t.Errorf("Unexpected value: %v", unexpected)
+	}
+
+	// composes with reducers and alias
+	sm, err = ParseDsl(nil, `alias(sumSeries(log(exp(constantLine(3)), 2.718281828459045), pow(constantLine(2), 3)), "foo")`, td.from, td.to, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, s := range sm {
+		if s.Alias() != "foo" {
+			t.Errorf("Unexpected alias: %v", s.Alias())
+		}
+		for s.Next() {
+			if v := s.CurrentValue(); math.Abs(v-11) > 1e-9 {
+				t.Errorf("Unexpected value: %v", v)
+			}
+		}
+	}
+}
+
 // nonNegativeDerivative
 func Test_dsl_nonNegativeDerivative(t *testing.T) {
 	td := setupTestData()
@@ -392,6 +604,71 @@ func Test_dsl_offsetToZero(t *testing.T) {
 	}
 }
 
+func Test_dsl_offsetToZeroNaN(t *testing.T) {
+	td := setupTestData()
+
+	// Negative values become NaN, which must be ignored by the min
+	// and stay NaN.
+	sm, err := ParseDsl(nil, `offsetToZero(offset(removeBelowValue(sinusoid(), 0), 5))`, td.from, td.to, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, s := range sm {
+		var nans, zeros int
+		for s.Next() {
+			v := s.CurrentValue()
+			if math.IsNaN(v) {
+				nans++
+			} else if v == 0 {
+				zeros++
+			} else if v < 0 {
+				t.Errorf("Unexpected negative value: %v", v)
+			}
+		}
+		if nans == 0 || zeros == 0 {
+			t.Errorf("Expected both NaNs and zeros, got %d NaNs and %d zeros", nans, zeros)
+		}
+	}
+
+	// No data at all must not loop forever
+	sm, err = ParseDsl(nil, `offsetToZero(removeAboveValue(constantLine(10), 0))`, td.from, td.to, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, s := range sm {
+		n := 0
+		for s.Next() {
+			if v := s.CurrentValue(); !math.IsNaN(v) {
+				t.Errorf("Unexpected value: %v", v)
+			}
+			if n++; n > 100 {
+				t.Errorf("Too many points")
+				break
+			}
+		}
+	}
+}
+
+func Test_dsl_offsetAbsoluteNaN(t *testing.T) {
+	td := setupTestData()
+	for _, expr := range []string{
+		`offset(removeAboveValue(constantLine(10), 0), 5)`,
+		`absolute(removeAboveValue(constantLine(-10), -20))`,
+	} {
+		sm, err := ParseDsl(nil, expr, td.from, td.to, 10)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, s := range sm {
+			for s.Next() {
+				if v := s.CurrentValue(); !math.IsNaN(v) {
+					t.Errorf("%s: unexpected value: %v", expr, v)
+				}
+			}
+		}
+	}
+}
+
 // scale
 func Test_dsl_scale(t *testing.T) {
 	td := setupTestData()
@@ -575,6 +852,32 @@ func Test_dsl_limit(t *testing.T) {
 	}
 }
 
+// limit takes the series in the same order as sortByName, from any
+// number of lists flattened with group
+func Test_dsl_limitSortByName(t *testing.T) {
+	td := setupTestData()
+	f := newGlobTestFetcher("web.cpu", "db1.cpu", "db2.cpu", "db3.mem")
+	for target, exp := range map[string][]string{
+		`limit(group(web.cpu, "db*.cpu"), 2)`:          {"db1.cpu", "db2.cpu"},
+		`limit(sortByName(group(web.cpu, db*.*)), 3)`:  {"db1.cpu", "db2.cpu", "db3.mem"},
+		`limit(group(web.cpu, db1.cpu, web.cpu), 5)`:   {"db1.cpu", "web.cpu"},
+		`sortByName(group(web.cpu, db3.mem)).limit(0)`: nil,
+	} {
+		sm, err := ParseDsl(f, target, td.from, td.to, 100)
+		if err != nil {
+			t.Errorf("%s: %v", target, err)
+			continue
+		}
+		var got []string
+		for _, name := range sm.SortedKeys() {
+			got = append(got, name)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: expected %v, got %v", target, exp, got)
+		}
+	}
+}
+
 // lowestAverage
 func Test_dsl_lowestAverage(t *testing.T) {
 	td := setupTestData()
@@ -647,6 +950,85 @@ func Test_dsl_minimumBelow(t *testing.T) {
 	}
 }
 
+// averageAbove
+func Test_dsl_averageAbove(t *testing.T) {
+	td := setupTestData()
+	sm, err := ParseDsl(nil, "averageAbove(group(constantLine(10), constantLine(20), constantLine(30)), 20)", td.from, td.to, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok, unexpected := checkEveryValueIs(sm, 30); !ok {
+		t.Errorf("Unexpected value: %v", unexpected)
+	}
+}
+
+// averageBelow
+func Test_dsl_averageBelow(t *testing.T) {
+	td := setupTestData()
+	sm, err := ParseDsl(nil, "averageBelow(group(constantLine(10), constantLine(20), constantLine(30)), 20)", td.from, td.to, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok, unexpected := checkEveryValueIs(sm, 10); !ok {
+		t.Errorf("Unexpected value: %v", unexpected)
+	}
+}
+
+// the filters by statistic with missing values
+func Test_dsl_filterByStatNaN(t *testing.T) {
+	td := setupTestData()
+
+	// a: 10 then NaN, b: 20 and 40 alternating, nan: all NaN
+	for name, value := range map[string]func(i int64) float64{
+		"foo.bar.statnan.a": func(i int64) float64 {
+			if i < 5 {
+				return 10
+			}
+			return math.NaN()
+		},
+		"foo.bar.statnan.b": func(i int64) float64 {
+			if i%2 == 0 {
+				return 20
+			}
+			return 40
+		},
+		"foo.bar.statnan.nan": func(int64) float64 { return math.NaN() },
+	} {
+		spec := &rrd.DSSpec{
+			Step: time.Second,
+			RRAs: []rrd.RRASpec{
+				rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: 10 * time.Minute, Latest: td.when},
+			},
+		}
+		spec.RRAs[0].DPs = make(map[int64]float64)
+		for i := int64(0); i < 10; i++ {
+			spec.RRAs[0].DPs[i] = value(i)
+		}
+		if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Error(err)
+		}
+	}
+	td.rcache.(*namedDsFetcher).Preload()
+
+	for target, exp := range map[string]string{
+		`averageAbove("foo.bar.statnan.*", 15)`: "foo.bar.statnan.b",
+		`averageBelow("foo.bar.statnan.*", 15)`: "foo.bar.statnan.a",
+		`maximumAbove("foo.bar.statnan.*", 35)`: "foo.bar.statnan.b",
+		`maximumBelow("foo.bar.statnan.*", 35)`: "foo.bar.statnan.a",
+		`minimumAbove("foo.bar.statnan.*", 15)`: "foo.bar.statnan.b",
+		`minimumBelow("foo.bar.statnan.*", 15)`: "foo.bar.statnan.a",
+	} {
+		sm, err := ParseDsl(td.rcache, target, td.from, td.to, 60)
+		if err != nil {
+			t.Errorf("%s: %v", target, err)
+			continue
+		}
+		if names := sm.SortedKeys(); len(names) != 1 || names[0] != exp {
+			t.Errorf("%s: expected only %s, got %v", target, exp, names)
+		}
+	}
+}
+
 // mostDeviant
 func Test_dsl_mostDeviant(t *testing.T) {
 	td := setupTestData()
@@ -682,6 +1064,49 @@ func Test_dsl_movingAverage(t *testing.T) {
 	}
 }
 
+func Test_dsl_movingAverageDuration(t *testing.T) {
+	td := setupTestData()
+
+	collect := func(expr string) []float64 {
+		sm, err := ParseDsl(nil, expr, td.from, td.to, 60) // 1min step
+		if err != nil {
+			t.Error(err)
+		}
+		var result []float64
+		for _, s := range sm {
+			for s.Next() {
+				result = append(result, s.CurrentValue())
+			}
+			s.Close()
+		}
+		return result
+	}
+
+	for _, c := range []struct {
+		window string
+		points int
+	}{
+		{`"10min"`, 10},
+		{`"620s"`, 10}, // rounds down
+		{`"630s"`, 11}, // halves round up
+		{`"30s"`, 1},   // step larger than the window
+		{`"1s"`, 1},
+	} {
+		got := collect(fmt.Sprintf("movingAverage(sinusoid(), %s)", c.window))
+		exp := collect(fmt.Sprintf("movingAverage(sinusoid(), %d)", c.points))
+		if len(got) == 0 || len(got) != len(exp) {
+			t.Errorf("%s: expected %d points, got %d", c.window, len(exp), len(got))
+			continue
+		}
+		for i := range got {
+			if got[i] != exp[i] {
+				t.Errorf("%s: point %d: expected %v, got %v", c.window, i, exp[i], got[i])
+				break
+			}
+		}
+	}
+}
+
 // movingMedian
 func Test_dsl_movingMedian(t *testing.T) {
 	td := setupTestData()
@@ -768,6 +1193,28 @@ func Test_dsl_removeBelowValue(t *testing.T) {
 	}
 }
 
+// removeEmptySeries
+func Test_dsl_removeEmptySeries(t *testing.T) {
+	td := setupTestData()
+	for _, c := range []struct {
+		query string
+		n     int
+	}{
+		{"removeEmptySeries(sinusoid())", 1},
+		{"removeEmptySeries(removeBelowValue(sinusoid(), 2))", 0},      // all NaN
+		{"removeEmptySeries(removeBelowValue(sinusoid(), 0), 0.6)", 1}, // 6 of 10 are known
+		{"removeEmptySeries(removeBelowValue(sinusoid(), 0), 0.7)", 0},
+	} {
+		sm, err := ParseDsl(nil, c.query, td.from, td.to, 10)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(sm) != c.n {
+			t.Errorf("%s: expected %d series, got %d", c.query, c.n, len(sm))
+		}
+	}
+}
+
 // stdev
 func Test_dsl_stdev(t *testing.T) {
 	td := setupTestData()
@@ -871,6 +1318,121 @@ func Test_dsl_aliasByNode(t *testing.T) {
 	}
 }
 
+// substr, aliasByTags and aliasByNode parse names the same way
+func Test_dsl_nameNodes(t *testing.T) {
+	td := setupTestData()
+	f := newGlobTestFetcher("a.b.c.d", "disk.used;dc=east;env=prod")
+	for target, exp := range map[string]string{
+		`substr(a.b.c.d, 1)`:                               "b.c.d",
+		`substr(a.b.c.d, 1, 3)`:                            "b.c",
+		`substr(a.b.c.d, -2)`:                              "c.d",
+		`substr(a.b.c.d, 1, -1)`:                           "b.c",
+		`substr(a.b.c.d, 10)`:                              "",
+		`substr(a.b.c.d, -10, 20)`:                         "a.b.c.d",
+		`substr(a.b.c.d, 3, 1)`:                            "",
+		`substr(scale(a.b.c.d, 2), 2)`:                     "c.d",
+		`aliasByNode(scale(a.b.c.d, 2), 1, -1)`:            "b.d",
+		`aliasByNode(a.b.c.d, 1, 7, -7)`:                   "b",
+		`aliasByTags(a.b.c.d, 0, "name")`:                  "a.a.b.c.d",
+		`aliasByTags(disk.*, "dc", 1, "missing")`:          "east.used",
+		`aliasByTags("disk.used;dc=east;env=prod", "env")`: "prod",
+		`aliasByTags(sumSeries(disk.*), "name")`:           "disk.*",
+	} {
+		sm, err := ParseDsl(f, target, td.from, td.to, 10)
+		if err != nil {
+			t.Errorf("%s: %v", target, err)
+			continue
+		}
+		if len(sm) != 1 {
+			t.Errorf("%s: expected 1 series, got %d", target, len(sm))
+		}
+		for _, s := range sm {
+			if s.Alias() != exp {
+				t.Errorf("%s: expected alias %q, got %q", target, exp, s.Alias())
+			}
+		}
+	}
+}
+
+// seriesByTag
+func Test_dsl_seriesByTag(t *testing.T) {
+	td := setupTestData()
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: td.when},
+		},
+	}
+	db := serde.NewMemSerDe()
+	for _, ident := range []serde.Ident{
+		{"name": "disk.used;dc=east;env=prod", "dc": "east", "env": "prod"},
+		{"name": "disk.used;dc=west;env=prod", "dc": "west", "env": "prod"},
+		{"name": "disk.used;dc=west", "dc": "west"},
+		{"name": "disk.free;dc=east;env=prod", "dc": "east", "env": "prod"},
+		{"name": "disk.used"},
+	} {
+		if _, err := db.FetchOrCreateDataSource(ident, spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := NewNamedDSFetcher(db, nil, 0)
+
+	for target, exp := range map[string][]string{
+		`seriesByTag("name=disk.used", "dc=east")`:                 {"disk.used;dc=east;env=prod"},
+		`seriesByTag("env=prod", "dc!=east")`:                      {"disk.used;dc=west;env=prod"},
+		`seriesByTag("name=disk.used", "env=")`:                    {"disk.used", "disk.used;dc=west"},
+		`seriesByTag("name=~disk.(us|fr)", "dc=~ea", "env!=~x.*")`: {"disk.free;dc=east;env=prod", "disk.used;dc=east;env=prod"},
+		`seriesByTag("dc=north")`:                                  {},
+		`aliasByTags(seriesByTag("dc=west", "env=prod"), "name")`:  {"disk.used"},
+	} {
+		sm, err := ParseDsl(f, target, td.from, td.to, 10)
+		if err != nil {
+			t.Errorf("%s: %v", target, err)
+			continue
+		}
+		var names []string
+		for name, s := range sm {
+			if strings.HasPrefix(target, "alias") {
+				name = s.Alias()
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if fmt.Sprint(names) != fmt.Sprint(exp) {
+			t.Errorf("%s: expected %v, got %v", target, exp, names)
+		}
+	}
+
+	for _, target := range []string{`seriesByTag("env!=prod")`, `seriesByTag("dc=~.*")`, `seriesByTag("dc")`, `seriesByTag("dc=~(")`} {
+		if _, err := ParseDsl(f, target, td.from, td.to, 10); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
+
+func Test_tagSearchQuery(t *testing.T) {
+	for exprs, exp := range map[string]serde.SearchQuery{
+		"name=disk.used,dc=east":    {"name": `^disk\.used(;|$)`, "dc": "^east$"},
+		"name=~disk.(us|fr),dc=~ea": {"name": "^disk", "dc": "^ea"},
+		"dc=~east|west,env=~(?i)p":  {},
+		"dc=~.*,env!=~x,dc!=west":   {},
+		"dc=~east.*,dc=west":        {"dc": "^west$"},
+		"name=~disk\\.used$,env=":   {"name": `^disk\.used`},
+	} {
+		var tes []*tagExpr
+		for _, s := range strings.Split(exprs, ",") {
+			te, err := parseTagExpr(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tes = append(tes, te)
+		}
+		if q := tagSearchQuery(tes); fmt.Sprint(q) != fmt.Sprint(exp) {
+			t.Errorf("%s: expected %v, got %v", exprs, exp, q)
+		}
+	}
+}
+
 // aliasSub
 func Test_dsl_aliasSub(t *testing.T) {
 	td := setupTestData()
@@ -975,6 +1537,86 @@ func Test_dsl_keepLastValue(t *testing.T) {
 	}
 }
 
+// randomWalk
+func Test_dsl_randomWalk(t *testing.T) {
+	td := setupTestData()
+	sm, err := ParseDsl(nil, "randomWalk('foo')", td.from, td.to, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	for name, s := range sm {
+		if name != "foo" || s.Alias() != "foo" {
+			t.Errorf("incorrect name/alias: %v %v", name, s.Alias())
+		}
+		n, prev := 0, 0.0
+		for s.Next() {
+			v := s.CurrentValue()
+			if n == 0 && v != 0 {
+				t.Errorf("randomWalk should start at 0, got %v", v)
+			}
+			if math.Abs(v-prev) > 0.5 {
+				t.Errorf("randomWalk step too large: %v -> %v", prev, v)
+			}
+			prev = v
+			n++
+		}
+		if n != 100 {
+			t.Errorf("Expected 100 points, got %v", n)
+		}
+	}
+}
+
+// sin
+func Test_dsl_sin(t *testing.T) {
+	td := setupTestData()
+	sm, err := ParseDsl(nil, "sin('foo', 5)", td.from, td.to, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, s := range sm {
+		if s.Alias() != "foo" {
+			t.Errorf("incorrect alias: %v", s.Alias())
+		}
+		n := 0
+		for s.Next() {
+			if math.Abs(s.CurrentValue()) > 5 {
+				t.Errorf("Value exceeds amplitude: %v", s.CurrentValue())
+			}
+			n++
+		}
+		if n != 100 {
+			t.Errorf("Expected 100 points, got %v", n)
+		}
+	}
+}
+
+// events
+func Test_dsl_events(t *testing.T) {
+	td := setupTestData()
+	es := td.db.(serde.EventStorer)
+	es.StoreEvent(&serde.Event{When: td.from.Add(10 * time.Minute), What: "deploy", Tags: []string{"deploy", "foo"}})
+	es.StoreEvent(&serde.Event{When: td.from.Add(10 * time.Minute), What: "deploy", Tags: []string{"deploy", "bar"}})
+	es.StoreEvent(&serde.Event{When: td.from.Add(20 * time.Minute), What: "other", Tags: []string{"other"}})
+
+	for tags, expected := range map[string]float64{`"deploy"`: 2, `"deploy", "foo"`: 1, `"*"`: 3} {
+		sm, err := ParseDsl(td.rcache, fmt.Sprintf("events(%s)", tags), td.from, td.to, 60)
+		if err != nil {
+			t.Error(err)
+		}
+		total := 0.0
+		for _, s := range sm {
+			for s.Next() {
+				if v := s.CurrentValue(); !math.IsNaN(v) {
+					total += v
+				}
+			}
+		}
+		if total != expected {
+			t.Errorf("events(%s): expected %v events, got %v", tags, expected, total)
+		}
+	}
+}
+
 // scaleToSeconds
 func Test_dsl_scaleToSeconds(t *testing.T) {
 	td := setupTestData()
@@ -1011,6 +1653,93 @@ func Test_dsl_consolidateBy(t *testing.T) {
 	}
 }
 
+// The slots of a SUM RRA are already totals, consolidateBy sum adds
+// them up without multiplying them by the step.
+func Test_dsl_consolidateBy_sumRRA(t *testing.T) {
+	td := setupTestData()
+
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.SUM, Step: time.Minute, Span: time.Hour, Latest: td.when},
+		},
+	}
+	spec.RRAs[0].DPs = make(map[int64]float64)
+	for i := int64(0); i < 60; i++ {
+		spec.RRAs[0].DPs[i] = 600 // 10 per second
+	}
+	if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": "foo.total"}, spec); err != nil {
+		t.Fatal(err)
+	}
+	td.rcache.(*namedDsFetcher).Preload()
+
+	// 6 points of 10 minutes
+	sm, err := ParseDsl(td.rcache, `consolidateBy("foo.total", "sum")`, td.from, td.to, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, unexpected := checkEveryValueIs(sm, 6000); !ok {
+		t.Errorf("Unexpected value: %v", unexpected)
+	}
+}
+
+// maxSeries / minSeries consolidate by max / min unless consolidateBy
+// says otherwise
+func Test_dsl_naturalConsolidation(t *testing.T) {
+	td := setupTestData()
+
+	for name, peak := range map[string]float64{"foo.peak.a": 100, "foo.peak.b": 1} {
+		spec := &rrd.DSSpec{
+			Step: time.Second,
+			RRAs: []rrd.RRASpec{
+				rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: td.when},
+			},
+		}
+		spec.RRAs[0].DPs = make(map[int64]float64)
+		for i := int64(0); i < 60; i++ {
+			spec.RRAs[0].DPs[i] = 10
+		}
+		spec.RRAs[0].DPs[25] = peak
+		if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Error(err)
+		}
+	}
+	td.rcache.(*namedDsFetcher).Preload()
+
+	// 6 points of 10 minutes, the peak and the dip are in one of them
+	extremes := func(expr string) (min, max float64) {
+		sm, err := ParseDsl(td.rcache, expr, td.from, td.to, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		min, max = math.Inf(1), math.Inf(-1)
+		for _, s := range sm {
+			for s.Next() {
+				if v := s.CurrentValue(); !math.IsNaN(v) {
+					min, max = math.Min(min, v), math.Max(max, v)
+				}
+			}
+		}
+		return min, max
+	}
+
+	for _, c := range []struct {
+		expr     string
+		min, max float64
+	}{
+		{`maxSeries("foo.peak.*")`, 10, 100},
+		{`minSeries("foo.peak.*")`, 1, 10},
+		{`consolidateBy(maxSeries("foo.peak.*"), "average")`, 10, 19},
+		{`maxSeries(consolidateBy("foo.peak.*", "average"))`, 10, 19},
+		{`maxSeries(consolidateBy("foo.peak.a", "min"), "foo.peak.b")`, 10, 10},
+		{`averageSeries("foo.peak.*")`, 10, (19 + 9.1) / 2},
+	} {
+		if min, max := extremes(c.expr); math.Abs(min-c.min) > 1e-9 || math.Abs(max-c.max) > 1e-9 {
+			t.Errorf("%s: expected points between %v and %v, got %v and %v", c.expr, c.min, c.max, min, max)
+		}
+	}
+}
+
 // summarize
 func Test_dsl_summarize(t *testing.T) {
 	td := setupTestData()
@@ -1022,3 +1751,252 @@ func Test_dsl_summarize(t *testing.T) {
 		t.Errorf("Unexpected value: %v", unexpected)
 	}
 }
+
+func Test_dsl_summarize_align(t *testing.T) {
+	zone := time.FixedZone("UTC-5", -5*3600)
+	start := time.Date(2017, 3, 16, 3, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		from        time.Time
+		alignToFrom bool
+		loc         *time.Location
+		times       []int // hour UTC
+		values      []float64
+	}{
+		{start, false, time.UTC, []int{3, 6, 9}, []float64{1, 3, 5.5}},
+		{start, false, zone, []int{5, 8}, []float64{2, 5}}, // 21:00 local
+		{start.Add(time.Hour), true, zone, []int{4, 7, 10}, []float64{1.5, 4, 6}},
+	} {
+		ss := series.NewSliceSeries([]float64{1, 2, 3, 4, 5, 6}, start, time.Hour)
+		sm, err := dslSummarize(map[string]interface{}{
+			"seriesList":     SeriesMap{"a": &aliasSeries{Series: ss}},
+			"intervalString": "3h",
+			"func":           "avg",
+			"alignToFrom":    c.alignToFrom,
+			"_from_":         c.from,
+			"_tz_":           c.loc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := sm["a"]
+		var times []int
+		var values []float64
+		for s.Next() {
+			times = append(times, s.CurrentTime().Hour())
+			values = append(values, s.CurrentValue())
+		}
+		if !reflect.DeepEqual(times, c.times) || !reflect.DeepEqual(values, c.values) {
+			t.Errorf("%v %v: expected %v %v, got %v %v", c.loc, c.alignToFrom, c.times, c.values, times, values)
+		}
+		if s.GroupBy() != 3*time.Hour {
+			t.Errorf("GroupBy() %v, expected the interval", s.GroupBy())
+		}
+	}
+}
+
+func Test_dsl_summarize_dst(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// hourly points from 2017-03-11 01:00 EST for 72 hours, DST
+	// began on 03-12 at 2:00 making that day 23 hours long
+	start := time.Date(2017, 3, 11, 1, 0, 0, 0, ny)
+	values := make([]float64, 72)
+	for i := range values {
+		values[i] = 1
+	}
+	ss := series.NewSliceSeries(values, start, time.Hour)
+	sm, err := dslSummarize(map[string]interface{}{
+		"seriesList":     SeriesMap{"a": &aliasSeries{Series: ss}},
+		"intervalString": "1d",
+		"func":           "sum",
+		"alignToFrom":    false,
+		"_from_":         start,
+		"_tz_":           ny,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []time.Time
+	for s := sm["a"]; s.Next(); {
+		ends = append(ends, s.CurrentTime())
+	}
+	exp := []time.Time{
+		time.Date(2017, 3, 12, 0, 0, 0, 0, ny),
+		time.Date(2017, 3, 13, 0, 0, 0, 0, ny),
+		time.Date(2017, 3, 14, 0, 0, 0, 0, ny),
+		time.Date(2017, 3, 15, 0, 0, 0, 0, ny),
+	}
+	if len(ends) != len(exp) {
+		t.Fatalf("Expected %d intervals, got %v", len(exp), ends)
+	}
+	for i := range exp {
+		if !ends[i].Equal(exp[i]) {
+			t.Errorf("Interval %d: expected it to end at the local midnight %v, got %v", i, exp[i], ends[i].In(ny))
+		}
+	}
+}
+
+// atResolution
+func Test_dsl_atResolution(t *testing.T) {
+	td := setupTestData()
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: td.when},
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Hour, Span: 24 * time.Hour, Latest: td.when},
+		},
+	}
+	if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar.atres"}, spec); err != nil {
+		t.Error(err)
+	}
+	td.rcache.(*namedDsFetcher).Preload()
+
+	for res, step := range map[string]time.Duration{"1h": time.Hour, "1m": time.Minute} {
+		sm, err := ParseDsl(td.rcache, fmt.Sprintf(`atResolution("foo.bar.atres", "%s")`, res), td.from, td.to, 10)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(sm) != 1 {
+			t.Errorf("%s: expected 1 series, got %d", res, len(sm))
+		}
+		for _, s := range sm {
+			if s.Step() != step {
+				t.Errorf("%s: expected step %v, got %v", res, step, s.Step())
+			}
+		}
+	}
+
+	_, err := ParseDsl(td.rcache, `atResolution("foo.bar.atres", "2h")`, td.from, td.to, 10)
+	if err == nil || !strings.Contains(err.Error(), "available: 1m0s, 1h0m0s") {
+		t.Errorf("Expected an error listing the available RRAs, got: %v", err)
+	}
+}
+
+// aberration
+func Test_dsl_aberration(t *testing.T) {
+	td := setupTestData()
+	rspec := rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: td.when}
+	size := rspec.Span.Nanoseconds() / rspec.Step.Nanoseconds()
+	for name, value := range map[string]float64{"foo.aber1.live": 10, "foo.aber2.live": 5, "foo.aber.ref": 8} {
+		spec := &rrd.DSSpec{Step: time.Second, RRAs: []rrd.RRASpec{rspec}}
+		spec.RRAs[0].DPs = make(map[int64]float64)
+		for i := int64(0); i < size; i++ {
+			if i != 5 || name != "foo.aber1.live" { // a gap
+				spec.RRAs[0].DPs[i] = value
+			}
+		}
+		if _, err := td.db.FetchOrCreateDataSource(serde.Ident{"name": name}, spec); err != nil {
+			t.Error(err)
+		}
+	}
+	td.rcache.(*namedDsFetcher).Preload()
+
+	sm, err := ParseDsl(td.rcache, `aberration("foo.aber*.live", "foo.aber.ref", 0.1)`, td.from, td.to, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sm) != 2 {
+		t.Fatalf("Expected 2 series, got %d", len(sm))
+	}
+	for name, expected := range map[string]float64{"foo.aber1.live": 1.2, "foo.aber2.live": -2.2} {
+		s := sm[name]
+		if s.Alias() != fmt.Sprintf("aberration(%s,foo.aber.ref)", name) {
+			t.Errorf("Unexpected alias: %q", s.Alias())
+		}
+		nans := 0
+		for s.Next() {
+			v := s.CurrentValue()
+			if math.IsNaN(v) {
+				nans++
+			} else if math.Abs(v-expected) > 1e-9 {
+				t.Errorf("%s: expected %v, got %v", name, expected, v)
+				break
+			}
+		}
+		if name == "foo.aber1.live" && nans != 1 {
+			t.Errorf("%s: expected 1 NaN for the gap, got %d", name, nans)
+		}
+	}
+
+	sm, err = ParseDsl(td.rcache, `aberration("foo.aber2.live", offset("foo.aber.ref", -3))`, td.from, td.to, 100)
+	if err != nil {
+		t.Error(err)
+	}
+	if ok, unexpected := checkEveryValueIs(sm, 0); !ok {
+		t.Errorf("Unexpected value: %v", unexpected)
+	}
+
+	if _, err = ParseDsl(td.rcache, `aberration("foo.aber*.live", offset("foo.aber.ref", -3))`, td.from, td.to, 100); err == nil {
+		t.Errorf("Expected an error for a function refSeries with more than one series")
+	}
+	if _, err = ParseDsl(td.rcache, `aberration("foo.aber2.live", "foo.aber*.live")`, td.from, td.to, 100); err == nil {
+		t.Errorf("Expected an error for more than one refSeries")
+	}
+}
+
+func Test_Functions(t *testing.T) {
+	funcs := Functions()
+	if len(funcs) != len(preprocessArgFuncs)+len(dslCtxFuncs) {
+		t.Errorf("Expected %d functions, got %d", len(preprocessArgFuncs)+len(dslCtxFuncs), len(funcs))
+	}
+	byName := make(map[string]*FuncInfo)
+	for n, fi := range funcs {
+		if n > 0 && funcs[n-1].Name >= fi.Name {
+			t.Errorf("Functions not sorted: %q >= %q", funcs[n-1].Name, fi.Name)
+		}
+		byName[fi.Name] = fi
+	}
+
+	sum := byName["sumSeries"]
+	if sum == nil || sum.Group != "Combine" || len(sum.Params) != 1 || !sum.Params[0].Multiple || sum.Params[0].Type != "seriesList" {
+		t.Errorf("Unexpected sumSeries: %#v", sum)
+	}
+	pct := byName["percentileOfSeries"]
+	if pct == nil || len(pct.Params) != 3 || !pct.Params[1].Required || pct.Params[2].Required || pct.Params[2].Default != false {
+		t.Errorf("Unexpected percentileOfSeries: %#v", pct)
+	}
+	// NaN default means none
+	nnd := byName["nonNegativeDerivative"]
+	if nnd == nil || nnd.Params[1].Required || nnd.Params[1].Default != nil {
+		t.Errorf("Unexpected nonNegativeDerivative: %#v", nnd)
+	}
+	if gbn := byName["groupByNode"]; gbn == nil || len(gbn.Params) != 3 || gbn.Group != "Special" {
+		t.Errorf("Unexpected groupByNode: %#v", gbn)
+	}
+}
+
+func Test_dsl_argErrors(t *testing.T) {
+	td := setupTestData()
+	for expr, exp := range map[string]string{
+		`highestMax(constantLine(1), "abc")`:             `highestMax: argument 2 expects integer, got "abc"`,
+		`highestMax(constantLine(1), 1.5)`:               `highestMax: argument 2 expects integer, got 1.5`,
+		`scale(constantLine(1), "abc")`:                  `scale: argument 2 expects float, got "abc"`,
+		`scale(10, 2)`:                                   `scale: argument 1 expects seriesList, got 10`,
+		`alias(constantLine(1), constantLine(2))`:        `alias: argument 2 expects string, got seriesList`,
+		`percentileOfSeries(constantLine(1), 50, "yes")`: `percentileOfSeries: argument 3 expects boolean, got "yes"`,
+		`scale(constantLine(1), 2, 3)`:                   `scale: expects at most 2 arguments, got 3`,
+		`scale(constantLine(1))`:                         `scale: argument 2 (factor) is required`,
+		`groupByNode(constantLine(1), "x", "sum")`:       `groupByNode: argument 2 expects float, got "x"`,
+		`groupByNode(constantLine(1), 1)`:                `groupByNode: expects 3 arguments, got 2`,
+	} {
+		_, err := ParseDsl(nil, expr, td.from, td.to, 100)
+		if err == nil || !strings.HasSuffix(err.Error(), exp) {
+			t.Errorf("%s: expected error %q, got: %v", expr, exp, err)
+		}
+	}
+
+	// defaults and keyword args still work
+	for _, expr := range []string{
+		`highestMax(constantLine(1))`,
+		`highestMax(constantLine(1), n=1)`,
+		`percentileOfSeries(constantLine(1), 50, interpolate=True)`,
+		`summarize(constantLine(1), "1h", "alignToFrom=true")`,
+	} {
+		if _, err := ParseDsl(nil, expr, td.from, td.to, 100); err != nil {
+			t.Errorf("%s: %v", expr, err)
+		}
+	}
+}
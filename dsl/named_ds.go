@@ -16,6 +16,8 @@
 package dsl
 
 import (
+	"fmt"
+	"log"
 	"sync"
 	"time"
 
@@ -30,6 +32,7 @@ import (
 type NamedDSFetcher interface {
 	dsFetcher
 	fsFinder
+	serde.EventStorer // ErrNoEvents if the db does not support events
 }
 
 type fsFinder interface {
@@ -69,6 +72,14 @@ type namedDsFetcher struct {
 	dsns       *fsFindCache
 	lastReload time.Time
 	minAge     time.Duration
+	refresher  bool                  // names are reloaded by StartFindIndexRefresher
+	stopCh     chan bool             // closed by StopFindIndexRefresher
+	events     serde.EventStorer     // nil if the db does not support events
+	loader     rraDataLoader         // nil if the db cannot load RRA data
+	attrs      serde.AttributeStorer // nil if the db does not support attributes
+	deleter    serde.PointDeleter    // nil if the db cannot delete points
+	filler     serde.RRAFillReporter // nil if the db cannot report RRA fill
+	versioner  serde.SchemaVersioner // nil if the db has no schema version
 }
 
 type watcher interface {
@@ -76,16 +87,133 @@ type watcher interface {
 	Unwatch(ident serde.Ident)
 }
 
+// A createNotifier (e.g. the receiver DS cache) tells about new DSs, so
+// that they can be found right away.
+type createNotifier interface {
+	NotifyCreate(f func(serde.Ident))
+}
+
 // Returns a new instance of a NamedDSFetcher. The current
 // implementation will re-fetch all series names any time a series
 // cannot be found. TODO: Make this better.
 func NewNamedDSFetcher(db dsFetcherSearcher, dsc watcher, lruCap int) *namedDsFetcher {
-	return &namedDsFetcher{
-		dsns:   newFsFindCache(db.(serde.DataSourceSearcher), "name"),
-		Mutex:  &sync.Mutex{},
-		minAge: time.Minute,
-		dsLRU:  newDsLRU(db.(dsFetcher), dsc, lruCap),
+	es, _ := db.(serde.EventStorer)
+	dl, _ := db.(rraDataLoader)
+	as, _ := db.(serde.AttributeStorer)
+	pd, _ := db.(serde.PointDeleter)
+	fr, _ := db.(serde.RRAFillReporter)
+	sv, _ := db.(serde.SchemaVersioner)
+	r := &namedDsFetcher{
+		dsns:      newFsFindCache(db.(serde.DataSourceSearcher), "name"),
+		Mutex:     &sync.Mutex{},
+		minAge:    time.Minute,
+		dsLRU:     newDsLRU(db.(dsFetcher), dsc, lruCap),
+		events:    es,
+		loader:    dl,
+		attrs:     as,
+		deleter:   pd,
+		filler:    fr,
+		versioner: sv,
+	}
+	if cn, ok := dsc.(createNotifier); ok {
+		cn.NotifyCreate(r.dsns.add)
+	}
+	return r
+}
+
+// ErrNoEvents is the error of the events methods of a NamedDSFetcher
+// of a db which does not support events.
+var ErrNoEvents = fmt.Errorf("Events are not supported by this storage")
+
+// StoreEvent passes the event on to the underlying db, if it supports
+// events.
+func (r *namedDsFetcher) StoreEvent(e *serde.Event) error {
+	if r.events == nil {
+		return ErrNoEvents
+	}
+	return r.events.StoreEvent(e)
+}
+
+// FetchEvents returns events from the underlying db, if it supports
+// events.
+func (r *namedDsFetcher) FetchEvents(tags []string, from, to time.Time) ([]*serde.Event, error) {
+	if r.events == nil {
+		return nil, ErrNoEvents
+	}
+	return r.events.FetchEvents(tags, from, to)
+}
+
+var errNoLoader = fmt.Errorf("Loading RRA data is not supported by this storage")
+
+// LoadRRAData returns a new RRA containing all the data points of
+// rra as stored in the underlying db.
+func (r *namedDsFetcher) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error) {
+	if r.loader == nil {
+		return nil, errNoLoader
 	}
+	return r.loader.LoadRRAData(rra)
+}
+
+var errNoAttributes = fmt.Errorf("DS attributes are not supported by this storage")
+
+// SetAttributes passes the DS attributes on to the underlying db, if
+// it supports attributes.
+func (r *namedDsFetcher) SetAttributes(id int64, attrs map[string]string) error {
+	if r.attrs == nil {
+		return errNoAttributes
+	}
+	return r.attrs.SetAttributes(id, attrs)
+}
+
+// GetAttributes returns the DS attributes from the underlying db, if
+// it supports attributes.
+func (r *namedDsFetcher) GetAttributes(id int64) (map[string]string, error) {
+	if r.attrs == nil {
+		return nil, errNoAttributes
+	}
+	return r.attrs.GetAttributes(id)
+}
+
+// FetchAttributes returns the attributes of many DSs by ident from
+// the underlying db, if it supports attributes.
+func (r *namedDsFetcher) FetchAttributes(idents []serde.Ident) (map[string]map[string]string, error) {
+	if r.attrs == nil {
+		return nil, errNoAttributes
+	}
+	return r.attrs.FetchAttributes(idents)
+}
+
+var errNoDeleter = fmt.Errorf("Deleting points is not supported by this storage")
+
+// DeletePoints passes the deletion on to the underlying db, if it
+// supports it.
+func (r *namedDsFetcher) DeletePoints(id int64, from, until time.Time) (int, error) {
+	if r.deleter == nil {
+		return 0, errNoDeleter
+	}
+	return r.deleter.DeletePoints(id, from, until)
+}
+
+var errNoFiller = fmt.Errorf("RRA fill stats are not supported by this storage")
+
+// RRAFillStats returns how full the RRAs of the DS are from the
+// underlying db, if it supports it.
+func (r *namedDsFetcher) RRAFillStats(id int64) ([]*serde.RRAFillStats, error) {
+	if r.filler == nil {
+		return nil, errNoFiller
+	}
+	return r.filler.RRAFillStats(id)
+}
+
+var errNoSchemaVersion = fmt.Errorf("The schema version is not supported by this storage")
+
+// DbSchemaVersion returns the schema version of the underlying db, if
+// it has one.
+func (r *namedDsFetcher) DbSchemaVersion() (int, error) {
+	if r.versioner == nil {
+		return 0, errNoSchemaVersion
+	}
+	return r.versioner.DbSchemaVersion()
 }
 
 func (r *namedDsFetcher) identsFromPattern(ident string) map[string]serde.Ident {
@@ -102,6 +230,62 @@ func (r *namedDsFetcher) Preload() {
 	r.Unlock()
 }
 
+// SetFindIndexMaxSize limits the number of series names kept in
+// memory to n (0 means no limit). With more names than that, every
+// FsFind searches the db instead. Takes effect on the next reload.
+func (r *namedDsFetcher) SetFindIndexMaxSize(n int) {
+	r.dsns.setMaxSize(n)
+}
+
+// StartFindIndexRefresher starts a goroutine re-reading all the series
+// names every interval, which replaces the reload FsFind otherwise
+// triggers once the names are older than a minute. It runs until
+// StopFindIndexRefresher is called. An interval of 0 or less does not
+// start anything.
+func (r *namedDsFetcher) StartFindIndexRefresher(interval time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	if r.stopCh != nil || interval <= 0 {
+		return // already running or nothing to run
+	}
+	r.refresher = true
+	r.stopCh = make(chan bool)
+	go r.findIndexRefresher(interval, r.stopCh)
+}
+
+// StopFindIndexRefresher stops the goroutine started by
+// StartFindIndexRefresher, FsFind then reloads the names again.
+func (r *namedDsFetcher) StopFindIndexRefresher() {
+	r.Lock()
+	defer r.Unlock()
+	if r.stopCh != nil {
+		close(r.stopCh)
+		r.stopCh = nil
+	}
+	r.refresher = false
+}
+
+func (r *namedDsFetcher) findIndexRefresher(interval time.Duration, stopCh chan bool) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-tick.C:
+			// The new trie is built without holding any lock and
+			// then swapped in by reload, finds carry on meanwhile.
+			if err := r.dsns.reload(); err != nil {
+				log.Printf("StartFindIndexRefresher(): error reloading names: %v", err)
+				continue
+			}
+			r.Lock()
+			r.lastReload = time.Now()
+			r.Unlock()
+		}
+	}
+}
+
 func (r *namedDsFetcher) Warmup() {
 	if r.dsLRU != nil {
 		r.dsLRU.loadState()
@@ -121,7 +305,7 @@ func (r *namedDsFetcher) FsFind(pattern string) []*FsFindNode {
 	result := r.dsns.fsFind(pattern)
 	go func() {
 		r.Lock()
-		if r.lastReload.Before(time.Now().Add(-r.minAge)) {
+		if !r.refresher && r.lastReload.Before(time.Now().Add(-r.minAge)) {
 			// TODO: This is better done with NOTIFY trigger on ds table changes
 			r.dsns.reload()
 			r.lastReload = time.Now()
@@ -132,23 +316,25 @@ func (r *namedDsFetcher) FsFind(pattern string) []*FsFindNode {
 }
 
 type NamedDsFetcherStats struct {
-	LruEvictions int
-	LruSize      int
-	LruHits      int
-	LruMisses    int
+	LruEvictions  int
+	LruSize       int
+	LruHits       int
+	LruMisses     int
+	FindIndexSize int
 }
 
 func (r *namedDsFetcher) Stats() NamedDsFetcherStats {
 	if r.dsLRU.Cache == nil {
-		return NamedDsFetcherStats{}
+		return NamedDsFetcherStats{FindIndexSize: r.dsns.len()}
 	}
 	r.dsLRU.Lock()
 	defer r.dsLRU.Unlock()
 	result := NamedDsFetcherStats{
-		LruEvictions: r.dsLRU.evictions,
-		LruSize:      r.dsLRU.Len(),
-		LruHits:      r.dsLRU.hits,
-		LruMisses:    r.dsLRU.misses,
+		LruEvictions:  r.dsLRU.evictions,
+		LruSize:       r.dsLRU.Len(),
+		LruHits:       r.dsLRU.hits,
+		LruMisses:     r.dsLRU.misses,
+		FindIndexSize: r.dsns.len(),
 	}
 	r.dsLRU.evictions = 0
 	r.dsLRU.hits = 0
@@ -0,0 +1,150 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"math"
+)
+
+// FuncHandler implements a function registered with
+// RegisterFunction(). args has a value for every parameter by name
+// (defaults filled in): a SeriesMap for a seriesList, a float64 for a
+// float or an integer, a string or a bool, and a []interface{} of
+// those for the last parameter if it is Multiple (all the seriesList
+// combined into one SeriesMap). There is also
+//
+//   _legend_     string, the name for a single series result, e.g. "foo(a.b,2)"
+//   _from_       time.Time
+//   _to_         time.Time
+//   _maxPoints_  int64
+//   _tz_         *time.Location, see Timezone
+//
+// The series in the SeriesMap can be modified (e.g. aliased) and
+// returned, or wrapped in a type embedding AliasSeries which
+// overrides CurrentValue() etc.
+type FuncHandler func(args map[string]interface{}) (SeriesMap, error)
+
+// RegisterFunction adds a function to the DSL. meta.Group and
+// meta.Params (meta.Name is ignored) describe it the same way as
+// Functions() does, and are used to process the arguments: their
+// number, types (seriesList, float, integer, string or boolean) and
+// defaults (a parameter which is not Required and has no Default is
+// NaN, "" or false). Only the last parameter can be Multiple.
+//
+// Functions are meant to be registered from the init() of a package
+// imported (for side effects) by the main package of a custom build
+// of tgres, e.g.:
+//
+//   import _ "example.com/tgres-funcs"
+//
+// RegisterFunction is not safe to call while the DSL is in use, and
+// a built-in function cannot be replaced.
+func RegisterFunction(name string, meta FuncInfo, handler FuncHandler) error {
+	if name == "" || handler == nil {
+		return fmt.Errorf("RegisterFunction: a name and a handler are required")
+	}
+	if _, ok := preprocessArgFuncs[name]; ok {
+		return fmt.Errorf("RegisterFunction: %s() already exists", name)
+	}
+	if _, ok := dslCtxFuncs[name]; ok {
+		return fmt.Errorf("RegisterFunction: %s() already exists", name)
+	}
+
+	fn := dslFuncType{call: handler, args: make([]argDef, 0, len(meta.Params))}
+	for n, p := range meta.Params {
+		arg, err := paramArgDef(p)
+		if err != nil {
+			return fmt.Errorf("RegisterFunction: %s(): %v", name, err)
+		}
+		if p.Multiple {
+			if n != len(meta.Params)-1 {
+				return fmt.Errorf("RegisterFunction: %s(): only the last parameter can be multiple", name)
+			}
+			fn.varArg = true
+		}
+		fn.args = append(fn.args, arg)
+	}
+
+	preprocessArgFuncs[name] = fn
+	if meta.Group != "" {
+		funcGroups[meta.Group] = append(funcGroups[meta.Group], name)
+	}
+	return nil
+}
+
+// The reverse of describeArg().
+func paramArgDef(p *FuncParam) (argDef, error) {
+	arg := argDef{name: p.Name}
+	if p.Name == "" {
+		return arg, fmt.Errorf("a parameter has no name")
+	}
+	switch p.Type {
+	case "seriesList":
+		arg.tp = argSeries
+	case "float":
+		arg.tp = argNumber
+	case "integer":
+		arg.tp = argInteger
+	case "string":
+		arg.tp = argString
+	case "boolean":
+		arg.tp = argBool
+	default:
+		return arg, fmt.Errorf("parameter %s: unsupported type %q", p.Name, p.Type)
+	}
+	if p.Required {
+		if p.Default != nil {
+			return arg, fmt.Errorf("parameter %s: required, but has a default", p.Name)
+		}
+		return arg, nil
+	}
+
+	// Defaults are in the form the arguments come in from the
+	// parser: numbers are float64, booleans "true" or "false".
+	dft := p.Default
+	switch arg.tp {
+	case argSeries:
+		return arg, fmt.Errorf("parameter %s: a seriesList cannot be optional", p.Name)
+	case argNumber, argInteger:
+		switch v := dft.(type) {
+		case nil:
+			dft = math.NaN()
+		case int:
+			dft = float64(v)
+		case float64:
+		default:
+			return arg, fmt.Errorf("parameter %s: invalid default %v", p.Name, dft)
+		}
+	case argString:
+		if dft == nil {
+			dft = ""
+		} else if _, ok := dft.(string); !ok {
+			return arg, fmt.Errorf("parameter %s: invalid default %v", p.Name, dft)
+		}
+	case argBool:
+		switch v := dft.(type) {
+		case nil:
+			dft = "false"
+		case bool:
+			dft = fmt.Sprintf("%v", v)
+		default:
+			return arg, fmt.Errorf("parameter %s: invalid default %v", p.Name, dft)
+		}
+	}
+	arg.dft = dft
+	return arg, nil
+}
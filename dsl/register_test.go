@@ -0,0 +1,117 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+// An example of a custom function: clamp(seriesList, min, max=None)
+// limits the values to [min, max].
+
+type seriesClamp struct {
+	AliasSeries
+	min, max float64
+}
+
+func (s *seriesClamp) CurrentValue() float64 {
+	v := s.AliasSeries.CurrentValue()
+	if v < s.min {
+		return s.min
+	}
+	if !math.IsNaN(s.max) && v > s.max {
+		return s.max
+	}
+	return v
+}
+
+func dslClamp(args map[string]interface{}) (SeriesMap, error) {
+	series := args["seriesList"].(SeriesMap)
+	min, max := args["min"].(float64), args["max"].(float64)
+	for name, s := range series {
+		s.Alias(fmt.Sprintf("clamp(%s,%v)", name, min))
+		series[name] = &seriesClamp{s, min, max}
+	}
+	return series, nil
+}
+
+func Test_RegisterFunction(t *testing.T) {
+	err := RegisterFunction("clamp", FuncInfo{
+		Group: "Transform",
+		Params: []*FuncParam{
+			{Name: "seriesList", Type: "seriesList", Required: true},
+			{Name: "min", Type: "float", Required: true},
+			{Name: "max", Type: "float"},
+		},
+	}, dslClamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(preprocessArgFuncs, "clamp")
+
+	td := setupTestData()
+	for expr, exp := range map[string]float64{
+		"clamp(constantLine(10), 20)":   20,
+		"clamp(constantLine(10), 5)":    10,
+		"clamp(constantLine(10), 5, 7)": 7,
+	} {
+		sm, err := ParseDsl(nil, expr, td.from, td.to, 100)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if ok, unexpected := checkEveryValueIs(sm, exp); !ok {
+			t.Errorf("%s: unexpected value: %v", expr, unexpected)
+		}
+	}
+
+	// The arguments are validated
+	if _, err := ParseDsl(nil, `clamp(constantLine(10), "abc")`, td.from, td.to, 100); err == nil || !strings.Contains(err.Error(), "argument 2 expects float") {
+		t.Errorf("Expected an argument error, got: %v", err)
+	}
+	if _, err := ParseDsl(nil, `clamp(constantLine(10))`, td.from, td.to, 100); err == nil || !strings.Contains(err.Error(), "is required") {
+		t.Errorf("Expected a missing argument error, got: %v", err)
+	}
+
+	// And it is introspected
+	var info *FuncInfo
+	for _, fi := range Functions() {
+		if fi.Name == "clamp" {
+			info = fi
+		}
+	}
+	if info == nil || info.Group != "Transform" || len(info.Params) != 3 || !info.Params[1].Required || info.Params[2].Required || info.Params[2].Default != nil {
+		t.Errorf("Unexpected clamp: %#v", info)
+	}
+
+	for name, meta := range map[string]FuncInfo{
+		"clamp":       {},
+		"scale":       {},
+		"groupByNode": {},
+		"foo":         {Params: []*FuncParam{{Name: "x", Type: "any"}}},
+		"bar":         {Params: []*FuncParam{{Name: "x", Type: "seriesList"}}},
+		"baz":         {Params: []*FuncParam{{Name: "x", Type: "float", Multiple: true}, {Name: "y", Type: "float"}}},
+		"qux":         {Params: []*FuncParam{{Name: "x", Type: "string", Default: 1.0}}},
+	} {
+		if err := RegisterFunction(name, meta, dslClamp); err == nil {
+			t.Errorf("%s: expected an error", name)
+			delete(preprocessArgFuncs, name)
+		}
+	}
+}
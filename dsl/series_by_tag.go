@@ -0,0 +1,214 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// A tag expression of seriesByTag(), as in Graphite:
+//
+//   tag=value    the tag is value
+//   tag!=value   the tag is not value
+//   tag=~regex   the tag matches regex (anchored at the start)
+//   tag!=~regex  the tag does not match regex
+//
+// A series without the tag is the same as one with a blank value.
+type tagExpr struct {
+	tag, value string // value is the regex of =~ and !=~
+	not        bool
+	re         *regexp.Regexp // nil unless =~ or !=~
+}
+
+func parseTagExpr(s string) (*tagExpr, error) {
+	i := strings.IndexAny(s, "!=")
+	if i < 1 {
+		return nil, fmt.Errorf("invalid tag expression: %q", s)
+	}
+	te := &tagExpr{tag: s[:i]}
+	op := s[i:]
+	if strings.HasPrefix(op, "!") {
+		te.not, op = true, op[1:]
+	}
+	if !strings.HasPrefix(op, "=") {
+		return nil, fmt.Errorf("invalid tag expression: %q", s)
+	}
+	op = op[1:]
+	if strings.HasPrefix(op, "~") {
+		re, err := regexp.Compile("^(?:" + op[1:] + ")")
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag expression: %q: %v", s, err)
+		}
+		te.re, op = re, op[1:]
+	}
+	te.value = op
+	return te, nil
+}
+
+func (te *tagExpr) match(tags map[string]string) bool {
+	v := tags[te.tag]
+	if te.re != nil {
+		return te.re.MatchString(v) != te.not
+	}
+	return (v == te.value) != te.not
+}
+
+// A positive expression requires the tag to have a value (no blank
+// value matches it), Graphite requires at least one so as not to
+// match everything.
+func (te *tagExpr) positive() bool {
+	if te.re != nil {
+		return !te.not && !te.re.MatchString("")
+	}
+	return !te.not && te.value != ""
+}
+
+// The tags seriesByTag() matches, i.e. the ident keys as well as the
+// name (without the tags of a tagged name).
+func identTags(ident serde.Ident) map[string]string {
+	tags := make(map[string]string, len(ident))
+	for k, v := range ident {
+		tags[k] = v
+	}
+	if i := strings.IndexByte(tags["name"], ';'); i > -1 {
+		tags["name"] = tags["name"][:i]
+	}
+	return tags
+}
+
+// The search for the tag=value and tag=~regex expressions, the db
+// may return more than what matches (or ignore the query altogether),
+// the results are always matched against all the expressions. Of a
+// regex only its literal prefix is searched, the regex dialect of the
+// db may differ, and the name in the db has the tags. A tag=value
+// takes precedence over a regex of the same tag.
+func tagSearchQuery(exprs []*tagExpr) serde.SearchQuery {
+	query := make(serde.SearchQuery)
+	for _, te := range exprs {
+		if te.not || te.value == "" || te.re != nil {
+			continue
+		}
+		if te.tag == "name" {
+			query["name"] = "^" + regexp.QuoteMeta(te.value) + "(;|$)"
+		} else {
+			query[te.tag] = "^" + regexp.QuoteMeta(te.value) + "$"
+		}
+	}
+	for _, te := range exprs {
+		if te.not || te.re == nil {
+			continue
+		}
+		if _, ok := query[te.tag]; ok {
+			continue
+		}
+		if prefix := literalPrefix(te.value); prefix != "" {
+			query[te.tag] = "^" + regexp.QuoteMeta(prefix)
+		}
+	}
+	return query
+}
+
+// The literal text any match of the regex expr (anchored at the
+// start) begins with, "" if there is none or expr is invalid.
+func literalPrefix(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	if re.Op == syntax.OpConcat && len(re.Sub) > 0 {
+		re = re.Sub[0]
+	}
+	if re.Op != syntax.OpLiteral || re.Flags&syntax.FoldCase != 0 {
+		return ""
+	}
+	return string(re.Rune)
+}
+
+// identsFromTags returns the idents (by name) of the DSs matching all
+// the exprs, which are searched in the db every time, they are not in
+// the fsFind cache.
+func (r *namedDsFetcher) identsFromTags(exprs []*tagExpr) (map[string]serde.Ident, error) {
+	sr, err := r.dsns.db.Search(tagSearchQuery(exprs))
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]serde.Ident)
+	if sr == nil {
+		return result, nil
+	}
+	defer sr.Close()
+
+	for sr.Next() {
+		ident := sr.Ident()
+		tags := identTags(ident)
+		matched := true
+		for _, te := range exprs {
+			if !te.match(tags) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			result[ident["name"]] = ident
+		}
+	}
+	return result, nil
+}
+
+type tagSearcher interface {
+	identsFromTags(exprs []*tagExpr) (map[string]serde.Ident, error)
+}
+
+// seriesByTag()
+func dslSeriesByTag(dc *dslCtx, args []interface{}) (SeriesMap, error) {
+
+	ts, ok := dc.ctxDSFetcher.(tagSearcher)
+	if !ok {
+		return nil, fmt.Errorf("seriesByTag() is not supported by this storage")
+	}
+
+	var (
+		exprs    []*tagExpr
+		positive bool
+	)
+	for _, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a string", arg)
+		}
+		te, err := parseTagExpr(s)
+		if err != nil {
+			return nil, err
+		}
+		positive = positive || te.positive()
+		exprs = append(exprs, te)
+	}
+	if !positive {
+		return nil, fmt.Errorf("seriesByTag() requires at least one expression which a blank value does not match")
+	}
+
+	idents, err := ts.identsFromTags(exprs)
+	if err != nil {
+		return nil, err
+	}
+	return dc.seriesFromIdents(idents, dc.from, dc.to)
+}
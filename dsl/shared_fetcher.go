@@ -0,0 +1,370 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// sharedFetcher is a NamedDSFetcher which makes sure that identical
+// reads (same DS, time range and resolution) are only performed once,
+// with the result shared by everyone who asked for it. It is meant
+// to be short lived, e.g. for the duration of a single render request
+// with multiple targets which often refer to the same series.
+type sharedFetcher struct {
+	NamedDSFetcher
+	*sync.Mutex
+	dss       map[string]rrd.DataSourcer
+	reads     map[sharedReadKey]*sharedRead
+	matched   map[string]bool // DSs (by ident) matched by all the queries so far
+	maxSeries int             // 0 is unlimited
+
+	// The series fetched and not yet read and closed, and the
+	// reads, by DS, see ReleaseReads()
+	users     map[rrd.DataSourcer]int
+	readKeys  map[rrd.DataSourcer][]sharedReadKey
+	releasing bool
+
+	// time spent parsing expressions, finding series and reading
+	// them from the db, see Timings()
+	parse, find, fetch time.Duration
+}
+
+// Returns a NamedDSFetcher which deduplicates reads performed by f.
+func NewSharedFetcher(f NamedDSFetcher) *sharedFetcher {
+	return &sharedFetcher{
+		NamedDSFetcher: f,
+		Mutex:          &sync.Mutex{},
+		dss:            make(map[string]rrd.DataSourcer),
+		reads:          make(map[sharedReadKey]*sharedRead),
+		matched:        make(map[string]bool),
+		users:          make(map[rrd.DataSourcer]int),
+		readKeys:       make(map[rrd.DataSourcer][]sharedReadKey),
+	}
+}
+
+// ReleaseReads tells f that nothing more will be fetched, e.g. once
+// all the targets of a request are evaluated. From then on the data
+// of the reads of a DS is dropped as soon as all of its series have
+// been read and closed, rather than kept for as long as f, so that
+// the points of series already written out can be garbage collected.
+// A series closed keeps its data, it can still be iterated again.
+func (f *sharedFetcher) ReleaseReads() {
+	f.Lock()
+	defer f.Unlock()
+	f.releasing = true
+	for ds := range f.readKeys {
+		if f.users[ds] == 0 {
+			f.dropReads(ds)
+		}
+	}
+}
+
+// Called with f locked.
+func (f *sharedFetcher) dropReads(ds rrd.DataSourcer) {
+	for _, key := range f.readKeys[ds] {
+		delete(f.reads, key)
+	}
+	delete(f.readKeys, ds)
+}
+
+// A sharedSeries of ds is read and closed.
+func (f *sharedFetcher) release(ds rrd.DataSourcer) {
+	f.Lock()
+	defer f.Unlock()
+	if f.users[ds]--; f.users[ds] <= 0 {
+		delete(f.users, ds)
+		if f.releasing {
+			f.dropReads(ds)
+		}
+	}
+}
+
+func (f *sharedFetcher) newSharedSeries(s series.Series, ds rrd.DataSourcer) *sharedSeries {
+	f.Lock()
+	f.users[ds]++
+	f.Unlock()
+	return &sharedSeries{Series: s, ds: ds, f: f, pos: -1}
+}
+
+// SetMaxSeries limits how many series the queries using f can match
+// together, a series matched by several of them is counted once. The
+// query exceeding it fails with a LimitError, as does any query after
+// it, see seriesCounter.
+func (f *sharedFetcher) SetMaxSeries(n int) {
+	f.Lock()
+	f.maxSeries = n
+	f.Unlock()
+}
+
+// Matched returns the number of distinct series matched by all the
+// queries so far, including those beyond the limit set by
+// SetMaxSeries().
+func (f *sharedFetcher) Matched() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.matched)
+}
+
+// seriesCounter
+func (f *sharedFetcher) countSeries(idents map[string]serde.Ident) error {
+	f.Lock()
+	defer f.Unlock()
+	for _, ident := range idents {
+		f.matched[ident.String()] = true
+	}
+	if f.maxSeries > 0 && len(f.matched) > f.maxSeries {
+		return &LimitError{fmt.Sprintf("the request matches more than %d series", f.maxSeries)}
+	}
+	return nil
+}
+
+// Timings returns the time spent so far parsing the expressions of
+// the queries, finding series (expanding patterns and tag searches)
+// and fetching them (looking up the DSs and reading their data).
+// Targets are evaluated concurrently, these are summed over all of
+// them and can exceed the time it took.
+func (f *sharedFetcher) Timings() (parse, find, fetch time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	return f.parse, f.find, f.fetch
+}
+
+// parseTimer
+func (f *sharedFetcher) parsedSince(start time.Time) {
+	f.since(&f.parse, start)
+}
+
+// Adds the time since start to d (f.find, f.fetch or f.parse).
+func (f *sharedFetcher) since(d *time.Duration, start time.Time) {
+	f.Lock()
+	*d += time.Now().Sub(start)
+	f.Unlock()
+}
+
+func (f *sharedFetcher) identsFromPattern(pattern string) map[string]serde.Ident {
+	start := time.Now()
+	idents := f.NamedDSFetcher.identsFromPattern(pattern)
+	f.since(&f.find, start)
+	return idents
+}
+
+func (f *sharedFetcher) identsFromTags(exprs []*tagExpr) (map[string]serde.Ident, error) {
+	ts, ok := f.NamedDSFetcher.(tagSearcher)
+	if !ok {
+		return nil, fmt.Errorf("seriesByTag() is not supported by this storage")
+	}
+	start := time.Now()
+	idents, err := ts.identsFromTags(exprs)
+	f.since(&f.find, start)
+	return idents, err
+}
+
+// Only lookups (nil dsSpec) are cached, this also guarantees that the
+// same ident results in the same DS, which we rely on in the read key.
+func (f *sharedFetcher) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	if dsSpec != nil {
+		return f.NamedDSFetcher.FetchOrCreateDataSource(ident, dsSpec)
+	}
+
+	key := ident.String()
+	f.Lock()
+	ds, ok := f.dss[key]
+	f.Unlock()
+	if ok {
+		return ds, nil
+	}
+
+	start := time.Now()
+	ds, err := f.NamedDSFetcher.FetchOrCreateDataSource(ident, nil)
+	f.since(&f.fetch, start)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	if cached, ok := f.dss[key]; ok {
+		ds = cached // someone beat us to it
+	} else {
+		f.dss[key] = ds
+	}
+	f.Unlock()
+	return ds, nil
+}
+
+func (f *sharedFetcher) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	start := time.Now()
+	s, err := f.NamedDSFetcher.FetchSeries(ds, from, to, maxPoints)
+	f.since(&f.fetch, start)
+	if err != nil {
+		return nil, err
+	}
+	return f.newSharedSeries(s, ds), nil
+}
+
+// FetchSeriesBulk uses the bulk fetch of the underlying fetcher if
+// it has one, the series are shared the same way as FetchSeries().
+func (f *sharedFetcher) FetchSeriesBulk(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+	bf, ok := f.NamedDSFetcher.(serde.BulkSeriesFetcher)
+	if !ok {
+		result := make([]series.Series, len(dss))
+		for n, ds := range dss {
+			s, err := f.FetchSeries(ds, from, to, maxPoints)
+			if err != nil {
+				return nil, err
+			}
+			result[n] = s
+		}
+		return result, nil
+	}
+
+	start := time.Now()
+	sl, err := bf.FetchSeriesBulk(dss, from, to, maxPoints)
+	f.since(&f.fetch, start)
+	if err != nil {
+		return nil, err
+	}
+	for n, s := range sl {
+		sl[n] = f.newSharedSeries(s, dss[n])
+	}
+	return sl, nil
+}
+
+// Returns the read for key and true if this caller is the one who
+// must perform it (and then close ready).
+func (f *sharedFetcher) read(key sharedReadKey) (*sharedRead, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if rd, ok := f.reads[key]; ok {
+		return rd, false
+	}
+	rd := &sharedRead{ready: make(chan bool)}
+	f.reads[key] = rd
+	f.readKeys[key.ds] = append(f.readKeys[key.ds], key)
+	return rd, true
+}
+
+// Reads are identical only if everything which affects the points
+// is, including the consolidation (e.g. after maxSeries() or
+// consolidateBy()). Aliases and transforms such as scale() wrap the
+// sharedSeries and do not affect the read, they are not part of it.
+type sharedReadKey struct {
+	ds        rrd.DataSourcer
+	from, to  int64
+	maxPoints int64
+	groupBy   time.Duration
+	cf        rrd.Consolidation
+}
+
+type sharedRead struct {
+	ready   chan bool // closed when times and values are populated
+	times   []time.Time
+	values  []float64
+	groupBy time.Duration
+}
+
+// sharedSeries behaves exactly like the series it wraps until the
+// first Next(), at which point the data is either read from the
+// underlying series or taken from an identical read done elsewhere.
+type sharedSeries struct {
+	series.Series
+	ds  rrd.DataSourcer
+	f   *sharedFetcher
+	rd  *sharedRead
+	pos int
+
+	released bool // see sharedFetcher.release()
+}
+
+func (s *sharedSeries) load() {
+	from, to := s.Series.TimeRange()
+	key := sharedReadKey{
+		ds:        s.ds,
+		from:      from.UnixNano(),
+		to:        to.UnixNano(),
+		maxPoints: s.Series.MaxPoints(),
+		groupBy:   s.Series.GroupBy(),
+		cf:        seriesConsolidation(s.Series),
+	}
+
+	rd, mine := s.f.read(key)
+	if mine {
+		start := time.Now()
+		for s.Series.Next() {
+			rd.times = append(rd.times, s.Series.CurrentTime())
+			rd.values = append(rd.values, s.Series.CurrentValue())
+		}
+		rd.groupBy = s.Series.GroupBy()
+		s.Series.Close() // releases any locks and cursors right away
+		s.f.since(&s.f.fetch, start)
+		close(rd.ready)
+	} else {
+		<-rd.ready
+	}
+	s.rd = rd
+}
+
+func (s *sharedSeries) Next() bool {
+	if s.rd == nil {
+		s.load()
+	}
+	if s.pos < len(s.rd.values) {
+		s.pos++
+	}
+	return s.pos < len(s.rd.values)
+}
+
+func (s *sharedSeries) CurrentValue() float64 {
+	if s.rd != nil && s.pos >= 0 && s.pos < len(s.rd.values) {
+		return s.rd.values[s.pos]
+	}
+	return math.NaN()
+}
+
+func (s *sharedSeries) CurrentTime() time.Time {
+	if s.rd != nil && s.pos >= 0 && s.pos < len(s.rd.times) {
+		return s.rd.times[s.pos]
+	}
+	return time.Time{}
+}
+
+func (s *sharedSeries) GroupBy(td ...time.Duration) time.Duration {
+	if s.rd != nil && len(td) == 0 {
+		return s.rd.groupBy
+	}
+	return s.Series.GroupBy(td...)
+}
+
+func (s *sharedSeries) Consolidation(cf ...rrd.Consolidation) rrd.Consolidation {
+	return seriesConsolidation(s.Series, cf...)
+}
+
+// The data stays around, iterating again does not cause another read.
+func (s *sharedSeries) Close() error {
+	s.pos = -1
+	if s.rd != nil && !s.released {
+		s.released = true
+		s.f.release(s.ds)
+	}
+	return nil
+}
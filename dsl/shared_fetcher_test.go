@@ -0,0 +1,219 @@
+package dsl
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+type countingSeries struct {
+	series.Series
+	nexts *int
+}
+
+func (s *countingSeries) Next() bool {
+	*s.nexts++
+	return s.Series.Next()
+}
+
+func (s *countingSeries) Consolidation(cf ...rrd.Consolidation) rrd.Consolidation {
+	return seriesConsolidation(s.Series, cf...)
+}
+
+type countingFetcher struct {
+	dsFetcherSearcher
+	nexts int
+}
+
+func (f *countingFetcher) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	s, err := f.dsFetcherSearcher.FetchSeries(ds, from, to, maxPoints)
+	return &countingSeries{s, &f.nexts}, err
+}
+
+func Test_sharedFetcher(t *testing.T) {
+	td := setupTestData()
+
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: td.when},
+		},
+	}
+	db := serde.NewMemSerDe()
+	if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar.shared"}, spec); err != nil {
+		t.Error(err)
+	}
+
+	cf := &countingFetcher{dsFetcherSearcher: db}
+	shared := NewSharedFetcher(NewNamedDSFetcher(cf, nil, 0))
+
+	targets := []string{`scale("foo.bar.shared", 2)`, `offset("foo.bar.shared", 1)`, `group("foo.bar.shared")`}
+	var points []int
+	for _, target := range targets {
+		sm, err := ParseDsl(shared, target, td.from, td.to, 60)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, s := range sm {
+			n := 0
+			for s.Next() {
+				n++
+			}
+			s.Close()
+			points = append(points, n)
+		}
+	}
+
+	if len(points) != len(targets) {
+		t.Errorf("Expected %d series, got %d", len(targets), len(points))
+	}
+	for _, n := range points {
+		if n != points[0] {
+			t.Errorf("All targets should have the same number of points: %v", points)
+		}
+	}
+	// One read only: n points plus the final Next() that returns false
+	if cf.nexts != points[0]+1 {
+		t.Errorf("Expected the underlying series to be read once (%d Next() calls), got %d", points[0]+1, cf.nexts)
+	}
+
+	if parse, find, fetch := shared.Timings(); parse <= 0 || find <= 0 || fetch <= 0 {
+		t.Errorf("Expected the time of parsing, finding and fetching, got %v %v %v", parse, find, fetch)
+	}
+}
+
+func Test_sharedFetcher_consolidation(t *testing.T) {
+	td := setupTestData()
+
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: td.when},
+		},
+	}
+	spec.RRAs[0].DPs = make(map[int64]float64)
+	for i := int64(0); i < 60; i++ {
+		spec.RRAs[0].DPs[i] = 10
+	}
+	spec.RRAs[0].DPs[25] = 100
+	db := serde.NewMemSerDe()
+	if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar.shared"}, spec); err != nil {
+		t.Error(err)
+	}
+
+	cf := &countingFetcher{dsFetcherSearcher: db}
+	shared := NewSharedFetcher(NewNamedDSFetcher(cf, nil, 0))
+
+	// In one request, the first two are the same read, so are the
+	// last two, but the max must not be the max of the averages.
+	targets := map[string]float64{
+		`averageSeries("foo.bar.shared")`:            19,
+		`alias("foo.bar.shared", "x")`:               19,
+		`maxSeries("foo.bar.shared")`:                100,
+		`consolidateBy("foo.bar.shared", "max")`:     100,
+		`scale(maxSeries("foo.bar.shared"), 1)`:      100,
+		`consolidateBy("foo.bar.shared", "average")`: 19,
+	}
+	points := 0
+	for target, exp := range targets {
+		sm, err := ParseDsl(shared, target, td.from, td.to, 6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range sm {
+			max := math.Inf(-1)
+			points = 0
+			for s.Next() {
+				if v := s.CurrentValue(); !math.IsNaN(v) {
+					max = math.Max(max, v)
+				}
+				points++
+			}
+			s.Close()
+			if math.Abs(max-exp) > 1e-9 {
+				t.Errorf("%s: expected a max of %v, got %v", target, exp, max)
+			}
+		}
+	}
+
+	// Two reads, one per consolidation
+	if cf.nexts != 2*(points+1) {
+		t.Errorf("Expected the underlying series to be read twice (%d Next() calls), got %d", 2*(points+1), cf.nexts)
+	}
+}
+
+func Test_sharedFetcher_maxSeries(t *testing.T) {
+	td := setupTestData()
+	shared := NewSharedFetcher(newGlobTestFetcher("web.cpu", "db1.cpu", "db2.cpu", "db3.cpu"))
+	shared.SetMaxSeries(3)
+
+	// The same series matched again are counted once
+	for _, target := range []string{`group("db*.cpu")`, `group("db1.cpu", "db*.cpu")`} {
+		if sm, err := ParseDsl(shared, target, td.from, td.to, 60); err != nil || len(sm) != 3 {
+			t.Errorf("%s: expected 3 series under the limit, got %d: %v", target, len(sm), err)
+		}
+	}
+	if _, err := ParseDsl(shared, `group("web.cpu")`, td.from, td.to, 60); err == nil {
+		t.Errorf("Expected an error over the limit")
+	} else if _, ok := err.(*LimitError); !ok {
+		t.Errorf("Expected a LimitError, got %v", err)
+	}
+	if _, err := ParseDsl(shared, `group("db1.cpu")`, td.from, td.to, 60); err == nil {
+		t.Errorf("Expected an error once over the limit, even for series counted already")
+	}
+	if n := shared.Matched(); n != 4 {
+		t.Errorf("Expected 4 series matched, got %d", n)
+	}
+}
+
+func Test_sharedFetcher_ReleaseReads(t *testing.T) {
+	td := setupTestData()
+
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: td.when},
+		},
+	}
+	db := serde.NewMemSerDe()
+	if _, err := db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar.shared"}, spec); err != nil {
+		t.Error(err)
+	}
+
+	cf := &countingFetcher{dsFetcherSearcher: db}
+	shared := NewSharedFetcher(NewNamedDSFetcher(cf, nil, 0))
+
+	// As a render request does: evaluate everything, then read
+	var sms []SeriesMap
+	for _, target := range []string{`scale("foo.bar.shared", 2)`, `group("foo.bar.shared")`} {
+		sm, err := ParseDsl(shared, target, td.from, td.to, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sms = append(sms, sm)
+	}
+	shared.ReleaseReads()
+
+	points := 0
+	for n, sm := range sms {
+		for _, s := range sm {
+			points = 0
+			for s.Next() {
+				points++
+			}
+			s.Close()
+		}
+		if reads := len(shared.reads); n == 0 && reads != 1 {
+			t.Errorf("Expected the read kept for the second target, got %d reads", reads)
+		} else if n == 1 && reads != 0 {
+			t.Errorf("Expected the read dropped once all series are closed, got %d reads", reads)
+		}
+	}
+	if cf.nexts != points+1 {
+		t.Errorf("Expected the underlying series to be read once (%d Next() calls), got %d", points+1, cf.nexts)
+	}
+}
@@ -0,0 +1,143 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	templateVar     = regexp.MustCompile(`\$(\w+)`)
+	templateKwarg   = regexp.MustCompile(`^(\w+)\s*=\s*(.*)$`)
+	templateCallPos = regexp.MustCompile(`(^|[^\w.])template\s*\(`)
+)
+
+// ExpandTemplates replaces every template() call in src by its first
+// argument with the $variables in it substituted, as Graphite does,
+// e.g. both of
+//
+//   template(foo.$host.cpu, host='web1')
+//   template(foo.$1.cpu, 'web1')
+//
+// become foo.web1.cpu. A variable in vars (the template[name] query
+// parameters of /render) takes precedence over the same one in the
+// call, which is merely its default. A variable which is not given
+// at all is an error. This is done on the text of the query before
+// it is parsed, because $ is not valid Go syntax.
+func ExpandTemplates(src string, vars map[string]string) (string, error) {
+	for {
+		loc := templateCallPos.FindStringSubmatchIndex(src)
+		if loc == nil {
+			return src, nil
+		}
+		begin, open := loc[3], loc[1]-1 // the "template" and its "("
+		args, end, err := splitCallArgs(src, open)
+		if err != nil {
+			return "", err
+		}
+		expr, err := expandTemplate(args, vars)
+		if err != nil {
+			return "", err
+		}
+		src = src[:begin] + expr + src[end+1:]
+	}
+}
+
+// Returns the arguments of the call the parenthesis of which is at
+// src[open], split on the commas which are not within parentheses,
+// braces, brackets or quotes, and the position of the closing one.
+func splitCallArgs(src string, open int) ([]string, int, error) {
+	var (
+		args  []string
+		depth int
+		quote byte
+	)
+	start := open + 1
+	for i := start; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '{' || c == '[':
+			depth++
+		case (c == ')' || c == '}' || c == ']') && depth > 0:
+			depth--
+		case c == ')':
+			args = append(args, strings.TrimSpace(src[start:i]))
+			return args, i, nil
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(src[start:i]))
+			start = i + 1
+		}
+	}
+	return nil, 0, fmt.Errorf("template: missing ) in %q", src[open:])
+}
+
+func expandTemplate(args []string, vars map[string]string) (string, error) {
+	if len(args) == 0 || args[0] == "" {
+		return "", fmt.Errorf("template: a series is required")
+	}
+
+	values := make(map[string]string, len(args)-1+len(vars))
+	for n, arg := range args[1:] {
+		name, value := strconv.Itoa(n+1), arg
+		if m := templateKwarg.FindStringSubmatch(arg); m != nil {
+			name, value = m[1], strings.TrimSpace(m[2])
+		}
+		values[name] = unquoteTemplateValue(value)
+	}
+	for name, value := range vars {
+		values[name] = value
+	}
+
+	var invalid []string
+	target := templateVar.ReplaceAllStringFunc(args[0], func(v string) string {
+		value, ok := values[v[1:]]
+		if !ok {
+			return v // maybe one of a nested template()
+		}
+		if strings.ContainsAny(value, `()'"`) {
+			invalid = append(invalid, fmt.Sprintf("%s=%q", v, value))
+		}
+		return value
+	})
+	if len(invalid) > 0 {
+		return "", fmt.Errorf("template: invalid value(s) %s, parentheses and quotes are not allowed", strings.Join(invalid, ", "))
+	}
+
+	target, err := ExpandTemplates(target, vars)
+	if err != nil {
+		return "", err
+	}
+	if missing := templateVar.FindAllString(target, -1); len(missing) > 0 {
+		return "", fmt.Errorf("template: unresolved variable(s) %s in %q", strings.Join(missing, ", "), args[0])
+	}
+	return target, nil
+}
+
+func unquoteTemplateValue(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,53 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsl
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_ExpandTemplates(t *testing.T) {
+	vars := map[string]string{"dc": "east"}
+	for src, exp := range map[string]string{
+		`template(metric.$host.cpu, host='web1')`:             `metric.web1.cpu`,
+		`template(metric.$1.$2, 'web1', "cpu")`:               `metric.web1.cpu`,
+		`scale(template("$dc.{a,b}.$x", x = 3), 2)`:           `scale("east.{a,b}.3", 2)`,
+		`template($dc.$host, host="web1", dc="west")`:         `east.web1`, // vars win
+		`sumSeries(template(a.$h, h=x), template(b.$h, h=y))`: `sumSeries(a.x, b.y)`,
+		`template(template(a.$h.$i, i=1), h=web)`:             `a.web.1`,
+		`mytemplate(a.b)`:   `mytemplate(a.b)`,
+		`foo.$notatemplate`: `foo.$notatemplate`,
+	} {
+		got, err := ExpandTemplates(src, vars)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+		} else if got != exp {
+			t.Errorf("%s: expected %s, got %s", src, exp, got)
+		}
+	}
+
+	for src, exp := range map[string]string{
+		`template(metric.$host.cpu)`:        "unresolved variable(s) $host",
+		`template(metric.$1.cpu, "a), b(")`: "invalid value",
+		`template(metric.$host.cpu, host=a`: "missing )",
+		`template()`:                        "a series is required",
+	} {
+		if _, err := ExpandTemplates(src, nil); err == nil || !strings.Contains(err.Error(), exp) {
+			t.Errorf("%s: expected an error containing %q, got %v", src, exp, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/tgres/tgres/receiver"
+	"github.com/tgres/tgres/serde"
+)
+
+type auditSource interface {
+	Audit(ident serde.Ident) ([]receiver.AuditEntry, bool)
+}
+
+type auditInfo struct {
+	Time         float64          `json:"t"`
+	Processed    float64          `json:"processed"`
+	Hops         int              `json:"hops,omitempty"`
+	Raw          *float64         `json:"raw"`
+	Value        *float64         `json:"v"`
+	Err          string           `json:"error,omitempty"`
+	PdpValue     *float64         `json:"pdp_value"`
+	PdpDuration  string           `json:"pdp_duration"`
+	Slots        []*auditSlotInfo `json:"slots"`
+	SlotsOmitted int              `json:"slots_omitted,omitempty"`
+}
+
+type auditSlotInfo struct {
+	RRA   int      `json:"rra"`
+	Step  string   `json:"step"`
+	Index int64    `json:"i"`
+	Time  int64    `json:"t"`
+	Value *float64 `json:"v"`
+}
+
+// InternalAuditHandler returns the data points most recently
+// processed by the DS given by the name parameter on this node, oldest
+// first, with the PDP and the RRA slots each of them completed, which
+// the DS only keeps if its [[ds]] rule has an audit, e.g.:
+//
+//   curl -H "Authorization: Bearer <token>" "http://host:8888/internal/audit?name=foo.bar&t=1500000000"
+//
+// With t (in the same format as from for /render), only the data
+// points which completed a slot containing it are returned. It
+// requires the same token as InternalCacheHandler.
+func InternalAuditHandler(src auditSource, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validBearer(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		name := r.FormValue("name")
+		if name == "" {
+			http.Error(w, "name parameter required", http.StatusBadRequest)
+			return
+		}
+		t, err := parseTime(r.FormValue("t"), Timezone)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		entries, ok := src.Audit(serde.Ident{"name": name})
+		if !ok {
+			http.Error(w, fmt.Sprintf("%q not in the cache or without audit", name), http.StatusNotFound)
+			return
+		}
+
+		result := make([]*auditInfo, 0, len(entries))
+		for _, e := range entries {
+			matched := t == nil
+			info := &auditInfo{
+				Time:         float64(e.Time.UnixNano()) / 1e9,
+				Processed:    float64(e.Processed.UnixNano()) / 1e9,
+				Hops:         e.Hops,
+				Raw:          jsonFloat(e.Raw),
+				Value:        jsonFloat(e.Value),
+				Err:          e.Err,
+				PdpValue:     jsonFloat(e.PdpValue),
+				PdpDuration:  e.PdpDuration.String(),
+				Slots:        make([]*auditSlotInfo, 0, len(e.Slots)),
+				SlotsOmitted: e.SlotsOmitted,
+			}
+			for _, s := range e.Slots {
+				if t != nil && s.Includes(*t) {
+					matched = true
+				}
+				info.Slots = append(info.Slots, &auditSlotInfo{
+					RRA:   s.RRA,
+					Step:  s.Step.String(),
+					Index: s.Slot,
+					Time:  s.End.Unix(),
+					Value: jsonFloat(s.Value),
+				})
+			}
+			if matched {
+				result = append(result, info)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("InternalAuditHandler(): %v", err)
+		}
+	}
+}
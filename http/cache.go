@@ -0,0 +1,232 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type unflushedGetter interface {
+	Unflushed(ident serde.Ident) rrd.DataSourcer
+}
+
+// InternalCacheHandler describes the DS given by the name parameter
+// as it is cached on this node, in the same JSON as /ds, except that
+// the points of the RRAs are all those not yet flushed to the
+// database, oldest first, e.g.:
+//
+//   curl -H "Authorization: Bearer <token>" http://host:8888/internal/cache?name=foo.bar
+//
+// It is meant for the other nodes of a cluster (and debugging), every
+// request must carry the token as above, if it is blank the handler
+// refuses all of them. A DS not cached on this node is a 404.
+func InternalCacheHandler(ug unflushedGetter, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validBearer(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		name := r.FormValue("name")
+		if name == "" {
+			http.Error(w, "name parameter required", http.StatusBadRequest)
+			return
+		}
+
+		ident := serde.Ident{"name": name}
+		ds := ug.Unflushed(ident)
+		if ds == nil {
+			http.Error(w, fmt.Sprintf("%q not in the cache", name), http.StatusNotFound)
+			return
+		}
+
+		info := &dsInfo{
+			Ident:      ident,
+			Step:       ds.Step().String(),
+			Heartbeat:  ds.Heartbeat().String(),
+			LastUpdate: ds.LastUpdate().Unix(),
+			Value:      jsonFloat(ds.Value()),
+			Duration:   ds.Duration().String(),
+			RRAs:       make([]*rraInfo, 0, len(ds.RRAs())),
+		}
+		if dbds, ok := ds.(serde.DbDataSourcer); ok {
+			info.Id = dbds.Id()
+			info.Ident = dbds.Ident()
+		}
+		for _, rra := range ds.RRAs() {
+			info.RRAs = append(info.RRAs, describeCachedRRA(rra))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			log.Printf("InternalCacheHandler(): %v", err)
+		}
+	}
+}
+
+type dataSourceFlusher interface {
+	FlushDataSource(name string) error
+}
+
+// InternalFlushHandler writes the cached data points of the DS given
+// by the name parameter to the database and responds once they are
+// written, so that what was sent to this node can be read back
+// deterministically, e.g. in a test:
+//
+//   curl -X POST -H "Authorization: Bearer <token>" http://host:8888/internal/flush?name=foo.bar
+//
+// It requires the same token as InternalCacheHandler.
+func InternalFlushHandler(dsf dataSourceFlusher, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validBearer(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.FormValue("name")
+		if name == "" {
+			http.Error(w, "name parameter required", http.StatusBadRequest)
+			return
+		}
+
+		if err := dsf.FlushDataSource(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "OK\n")
+	}
+}
+
+// InternalDeleteHandler clears the stored data points of the DS given
+// by the name parameter between from and until (inclusive, both
+// required, in the same format as for /render), e.g. to correct a bad
+// import without dropping the whole series:
+//
+//   curl -X POST -H "Authorization: Bearer <token>" "http://host:8888/internal/delete?name=foo.bar&from=1500000000&until=1500003600"
+//
+// It responds with the number of slots cleared (in all the RRAs) and
+// requires the same token as InternalCacheHandler. Points not yet
+// flushed are not deleted, /internal/flush the DS first.
+func InternalDeleteHandler(rcache dsl.NamedDSFetcher, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validBearer(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.FormValue("name")
+		if name == "" {
+			http.Error(w, "name parameter required", http.StatusBadRequest)
+			return
+		}
+		from, err := parseTime(r.FormValue("from"), Timezone)
+		if err == nil && from == nil {
+			err = fmt.Errorf("from parameter required")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		until, err := parseTime(r.FormValue("until"), Timezone)
+		if err == nil && until == nil {
+			err = fmt.Errorf("until parameter required")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if until.Before(*from) {
+			http.Error(w, "until is before from", http.StatusBadRequest)
+			return
+		}
+
+		pd, ok := rcache.(serde.PointDeleter)
+		if !ok {
+			http.Error(w, "deleting points is not supported", http.StatusNotImplemented)
+			return
+		}
+
+		ds, err := rcache.FetchOrCreateDataSource(serde.Ident{"name": name}, nil)
+		if err != nil {
+			log.Printf("InternalDeleteHandler(): %v", err)
+			http.Error(w, err.Error(), dbErrorStatus(err))
+			return
+		}
+		dbds, ok := ds.(serde.DbDataSourcer)
+		if !ok {
+			http.Error(w, fmt.Sprintf("%q not found", name), http.StatusNotFound)
+			return
+		}
+
+		n, err := pd.DeletePoints(dbds.Id(), *from, *until)
+		if err != nil {
+			log.Printf("InternalDeleteHandler(): %v", err)
+			http.Error(w, err.Error(), dbErrorStatus(err))
+			return
+		}
+		log.Printf("InternalDeleteHandler(): deleted %d slots of %q from %v until %v.", n, name, from.UTC(), until.UTC())
+		fmt.Fprintf(w, "{\"deleted\": %d}\n", n)
+	}
+}
+
+func describeCachedRRA(rra rrd.RoundRobinArchiver) *rraInfo {
+	info := describeRRA(rra, nil, 0)
+	latest := rra.Latest()
+	if latest.IsZero() || rra.Size() == 0 {
+		return info
+	}
+	for i, v := range rra.DPs() {
+		t := rrd.SlotTime(i, latest, rra.Step(), rra.Size())
+		info.Points = append(info.Points, &slotInfo{Index: i, Time: t.Unix(), Value: jsonFloat(v)})
+	}
+	sort.Slice(info.Points, func(i, j int) bool { return info.Points[i].Time < info.Points[j].Time })
+	return info
+}
+
+func validBearer(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
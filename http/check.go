@@ -0,0 +1,193 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/misc"
+)
+
+// Check states, from best to worst.
+var checkStates = []string{"OK", "UNKNOWN", "WARN", "CRIT"}
+
+var checkOps = map[string]func(v, threshold float64) bool{
+	"gt": func(v, t float64) bool { return v > t },
+	"ge": func(v, t float64) bool { return v >= t },
+	"lt": func(v, t float64) bool { return v < t },
+	"le": func(v, t float64) bool { return v <= t },
+	"eq": func(v, t float64) bool { return v == t },
+	"ne": func(v, t float64) bool { return v != t },
+}
+
+type checkResult struct {
+	State  string         `json:"state"`
+	Series []*checkSeries `json:"series"`
+}
+
+type checkSeries struct {
+	Target   string        `json:"target"`
+	State    string        `json:"state"`
+	Breaches []*checkPoint `json:"breaches"`
+}
+
+type checkPoint struct {
+	Time  int64   `json:"t"`
+	Value float64 `json:"v"`
+}
+
+// CheckHandler evaluates a target over a window (5m by default) and
+// compares it with a threshold, so that Tgres can back simple
+// alerting, e.g.:
+//
+//   /check?target=derivative(foo.bar)&op=gt&value=100&warn=50&for=5m
+//
+// A series is CRIT if every point in the window is op value, WARN if
+// every point is op warn (if given), UNKNOWN if there are no points
+// and OK otherwise. Op is one of gt (default), ge, lt, le, eq, ne. The
+// result is JSON with the worst state of all the series the target
+// produced, as well as the state and the points breaching either
+// threshold for each series.
+func CheckHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.FormValue("target")
+		if target == "" {
+			http.Error(w, "target parameter required", http.StatusBadRequest)
+			return
+		}
+
+		opName := r.FormValue("op")
+		if opName == "" {
+			opName = "gt"
+		}
+		op, ok := checkOps[opName]
+		if !ok {
+			http.Error(w, fmt.Sprintf("invalid op: %q", opName), http.StatusBadRequest)
+			return
+		}
+
+		crit, err := strconv.ParseFloat(r.FormValue("value"), 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid value: %q", r.FormValue("value")), http.StatusBadRequest)
+			return
+		}
+		var warn *float64
+		if s := r.FormValue("warn"); s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid warn: %q", s), http.StatusBadRequest)
+				return
+			}
+			warn = &v
+		}
+
+		window := 5 * time.Minute
+		if s := r.FormValue("for"); s != "" {
+			if window, err = misc.BetterParseDuration(s); err != nil || window <= 0 {
+				http.Error(w, fmt.Sprintf("invalid for: %q", s), http.StatusBadRequest)
+				return
+			}
+		}
+		loc, err := requestTimezone(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTime(r.FormValue("until"), loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if to == nil {
+			tmp := time.Now()
+			to = &tmp
+		}
+		from := to.Add(-window)
+
+		sm, err := processTarget(rcache, target, from.Unix(), to.Unix(), 512, loc)
+		if err != nil {
+			log.Printf("CheckHandler() %q: %v", target, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := &checkResult{State: checkStates[0], Series: make([]*checkSeries, 0, len(sm))}
+		for _, gs := range readDataPoints(sm) {
+			cs := evalCheck(gs, op, crit, warn)
+			result.Series = append(result.Series, cs)
+			if checkStateWorse(cs.State, result.State) {
+				result.State = cs.State
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("CheckHandler(): %v", err)
+		}
+	}
+}
+
+func evalCheck(gs *graphiteSeries, op func(v, threshold float64) bool, crit float64, warn *float64) *checkSeries {
+	cs := &checkSeries{Target: gs.name, Breaches: make([]*checkPoint, 0)}
+
+	var n, nCrit, nWarn int
+	for _, dp := range gs.dps {
+		if dp.t <= 0 || math.IsNaN(dp.v) || math.IsInf(dp.v, 0) { // same as null in /render
+			continue
+		}
+		n++
+		isCrit := op(dp.v, crit)
+		isWarn := warn != nil && op(dp.v, *warn)
+		if isCrit {
+			nCrit++
+		}
+		if isWarn || isCrit {
+			nWarn++
+			cs.Breaches = append(cs.Breaches, &checkPoint{Time: dp.t, Value: dp.v})
+		}
+	}
+
+	switch {
+	case n == 0:
+		cs.State = "UNKNOWN"
+	case nCrit == n:
+		cs.State = "CRIT"
+	case warn != nil && nWarn == n:
+		cs.State = "WARN"
+	default:
+		cs.State = "OK"
+	}
+	return cs
+}
+
+func checkStateWorse(a, b string) bool {
+	var ia, ib int
+	for i, s := range checkStates {
+		if s == a {
+			ia = i
+		}
+		if s == b {
+			ib = i
+		}
+	}
+	return ia > ib
+}
@@ -0,0 +1,263 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+type rraDataLoader interface {
+	LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiver, error)
+}
+
+type dsInfo struct {
+	Id         int64             `json:"id,omitempty"`
+	Ident      serde.Ident       `json:"ident"`
+	Step       string            `json:"step"`
+	Heartbeat  string            `json:"heartbeat"`
+	LastUpdate int64             `json:"lastUpdate"`
+	Value      *float64          `json:"value"`
+	Duration   string            `json:"duration"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	RRAs       []*rraInfo        `json:"rras"`
+}
+
+type rraInfo struct {
+	Id          int64        `json:"id,omitempty"`
+	CF          string       `json:"cf"`
+	Step        string       `json:"step"`
+	Size        int64        `json:"size"`
+	Xff         float32      `json:"xff"`
+	Latest      int64        `json:"latest"`
+	LatestIndex int64        `json:"latestIndex"`
+	Value       *float64     `json:"value"`
+	Duration    string       `json:"duration"`
+	Fill        *rraFillInfo `json:"fill,omitempty"`
+	Points      []*slotInfo  `json:"points"`
+}
+
+type rraFillInfo struct {
+	Populated int64   `json:"populated"`
+	Stale     int64   `json:"stale"`
+	Ratio     float64 `json:"ratio"`
+	Oldest    int64   `json:"oldest,omitempty"`
+}
+
+type slotInfo struct {
+	Index int64    `json:"i"`
+	Time  int64    `json:"t"`
+	Value *float64 `json:"v"`
+}
+
+// JSON cannot represent NaN, so it becomes null.
+func jsonFloat(f float64) *float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return &f
+}
+
+func cfName(cf rrd.Consolidation) string {
+	switch cf {
+	case rrd.WMEAN:
+		return "WMEAN"
+	case rrd.MAX:
+		return "MAX"
+	case rrd.MIN:
+		return "MIN"
+	case rrd.LAST:
+		return "LAST"
+	case rrd.SUM:
+		return "SUM"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", cf)
+}
+
+// DataSourceHandler describes the DS given by the name parameter as
+// JSON: its spec and, for every RRA, its latest, the index of the
+// latest slot and the values of the most recent slots (10 by
+// default, can be changed with the points parameter), e.g.:
+//
+//   /ds?name=foo.bar&points=20
+//
+// The slot values are loaded from the database if it supports it,
+// which means that data points not yet flushed are not visible. So
+// is the fill of every RRA: how many of its slots have data
+// (populated, and the ratio to its size), how many have stale data of
+// an earlier iteration, which reads as NaN, and the time of the
+// oldest populated one.
+//
+// A POST with a JSON object of strings as the body replaces the
+// attributes of the DS (e.g. {"units": "bytes"}), if the database
+// supports attributes.
+func DataSourceHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		if name == "" {
+			http.Error(w, "name parameter required", http.StatusBadRequest)
+			return
+		}
+
+		points := int64(10)
+		if p := r.FormValue("points"); p != "" {
+			n, err := strconv.ParseInt(p, 10, 64)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("invalid points: %q", p), http.StatusBadRequest)
+				return
+			}
+			points = n
+		}
+
+		ds, err := rcache.FetchOrCreateDataSource(serde.Ident{"name": name}, nil)
+		if err != nil {
+			log.Printf("DataSourceHandler(): %v", err)
+			http.Error(w, err.Error(), dbErrorStatus(err))
+			return
+		}
+		if ds == nil {
+			http.Error(w, fmt.Sprintf("%q not found", name), http.StatusNotFound)
+			return
+		}
+
+		info := &dsInfo{
+			Step:       ds.Step().String(),
+			Heartbeat:  ds.Heartbeat().String(),
+			LastUpdate: ds.LastUpdate().Unix(),
+			Value:      jsonFloat(ds.Value()),
+			Duration:   ds.Duration().String(),
+			RRAs:       make([]*rraInfo, 0, len(ds.RRAs())),
+		}
+		as, _ := rcache.(serde.AttributeStorer)
+		if dbds, ok := ds.(serde.DbDataSourcer); ok {
+			info.Id = dbds.Id()
+			info.Ident = dbds.Ident()
+		} else {
+			info.Ident = serde.Ident{"name": name}
+			as = nil // attributes are stored by DS id
+		}
+
+		if r.Method == "POST" {
+			if as == nil {
+				http.Error(w, "attributes are not supported", http.StatusNotImplemented)
+				return
+			}
+			var attrs map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&attrs); err != nil {
+				http.Error(w, fmt.Sprintf("invalid attributes: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := as.SetAttributes(info.Id, attrs); err != nil {
+				log.Printf("DataSourceHandler(): %v", err)
+				http.Error(w, err.Error(), dbErrorStatus(err))
+				return
+			}
+		}
+
+		if as != nil {
+			attrs, err := as.GetAttributes(info.Id)
+			if err != nil {
+				log.Printf("DataSourceHandler(): error getting attributes: %v", err)
+			}
+			info.Attributes = attrs
+		}
+
+		fills := make(map[int64]*serde.RRAFillStats)
+		if fr, ok := rcache.(serde.RRAFillReporter); ok && info.Id != 0 {
+			if stats, err := fr.RRAFillStats(info.Id); err == nil {
+				for _, fs := range stats {
+					if dbrra, ok := fs.RRA.(serde.DbRoundRobinArchiver); ok {
+						fills[dbrra.Id()] = fs
+					}
+				}
+			} else {
+				log.Printf("DataSourceHandler(): error getting RRA fill: %v", err)
+			}
+		}
+
+		dl, _ := rcache.(rraDataLoader)
+		for _, rra := range ds.RRAs() {
+			ri := describeRRA(rra, dl, points)
+			if fs := fills[ri.Id]; fs != nil {
+				ri.Fill = &rraFillInfo{Populated: fs.Populated, Stale: fs.Stale, Ratio: fs.Ratio()}
+				if !fs.Oldest.IsZero() {
+					ri.Fill.Oldest = fs.Oldest.Unix()
+				}
+			}
+			info.RRAs = append(info.RRAs, ri)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			log.Printf("DataSourceHandler(): %v", err)
+		}
+	}
+}
+
+func describeRRA(rra rrd.RoundRobinArchiver, dl rraDataLoader, points int64) *rraInfo {
+	spec := rra.Spec()
+	info := &rraInfo{
+		CF:       cfName(spec.Function),
+		Step:     rra.Step().String(),
+		Size:     rra.Size(),
+		Xff:      spec.Xff,
+		Value:    jsonFloat(rra.Value()),
+		Duration: rra.Duration().String(),
+		Points:   make([]*slotInfo, 0),
+	}
+	if dbrra, ok := rra.(serde.DbRoundRobinArchiver); ok {
+		info.Id = dbrra.Id()
+	}
+
+	latest := rra.Latest()
+	if latest.IsZero() || rra.Size() == 0 {
+		return info // nothing was ever stored
+	}
+	info.Latest = latest.Unix()
+	info.LatestIndex = rrd.SlotIndex(latest, rra.Step(), rra.Size())
+
+	dps := rra.DPs()
+	if dl != nil {
+		if loaded, err := dl.LoadRRAData(rra); err == nil {
+			dps = loaded.DPs()
+		} else {
+			log.Printf("DataSourceHandler(): error loading RRA data, using cached: %v", err)
+		}
+	}
+
+	if points > rra.Size() {
+		points = rra.Size()
+	}
+	for n := points - 1; n >= 0; n-- {
+		t := latest.Add(-rra.Step() * time.Duration(n))
+		i := rrd.SlotIndex(t, rra.Step(), rra.Size())
+		v, ok := dps[i]
+		if !ok {
+			v = math.NaN()
+		}
+		info.Points = append(info.Points, &slotInfo{Index: i, Time: t.Unix(), Value: jsonFloat(v)})
+	}
+	return info
+}
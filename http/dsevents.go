@@ -0,0 +1,106 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/receiver"
+)
+
+type dsEventSource interface {
+	DSEventsSince(id int64) ([]receiver.DSEvent, int64, <-chan struct{})
+}
+
+// How long a stream lasts, it must end before the WriteTimeout of
+// the server, the client reconnects and resumes from the last event
+// it got (the Last-Event-ID).
+var dsEventsStreamFor = 25 * time.Second
+
+// InternalDSEventsHandler streams the creation and deletion of DSs as
+// Server-Sent Events, e.g. for an admin UI to show the growth of the
+// number of series as it happens:
+//
+//   curl -N -H "Authorization: Bearer <token>" http://host:8888/internal/ds-events
+//
+// Every event is e.g.
+//
+//   id: 42
+//   event: created
+//   data: {"ident":{"name":"foo.bar"},"time":1500000000}
+//
+// and the events missed by a client too slow to keep up (only the
+// latest are kept, the oldest are dropped) are counted in a "dropped"
+// event, e.g. data: {"dropped":10}. It requires the same token as
+// InternalCacheHandler.
+func InternalDSEventsHandler(src dsEventSource, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validBearer(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		id := int64(-1)
+		if last := r.Header.Get("Last-Event-ID"); last != "" {
+			if n, err := strconv.ParseInt(last, 10, 64); err == nil {
+				id = n
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(w, "retry: 1000\n\n")
+		flusher.Flush()
+
+		end := time.After(dsEventsStreamFor)
+		for {
+			events, dropped, wake := src.DSEventsSince(id)
+			if dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			for _, e := range events {
+				data, err := json.Marshal(map[string]interface{}{"ident": e.Ident, "time": e.Time.Unix()})
+				if err != nil {
+					log.Printf("InternalDSEventsHandler(): %v", err)
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+				id = e.Id
+			}
+			if dropped > 0 || len(events) > 0 {
+				flusher.Flush()
+			}
+			select {
+			case <-wake:
+			case <-end:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/tgres/tgres/dsl"
+)
+
+type graphiteFunction struct {
+	Name        string           `json:"name"`
+	Function    string           `json:"function"`
+	Description string           `json:"description"`
+	Module      string           `json:"module"`
+	Group       string           `json:"group"`
+	Params      []*graphiteParam `json:"params"`
+}
+
+// Default is the JSON of the default, which is only omitted when
+// there is none, a default of false, 0 or "" is listed.
+type graphiteParam struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	Required bool            `json:"required,omitempty"`
+	Multiple bool            `json:"multiple,omitempty"`
+	Default  json.RawMessage `json:"default,omitempty"`
+}
+
+// GraphiteFunctionsHandler lists the functions the DSL supports in
+// the format of the Graphite /functions API, which Grafana uses to
+// know what the backend can do. /functions/<name> describes a single
+// function.
+func GraphiteFunctionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/functions"), "/")
+
+		funcs := make(map[string]*graphiteFunction)
+		for _, fi := range dsl.Functions() {
+			funcs[fi.Name] = describeFunction(fi)
+		}
+
+		var result interface{} = funcs
+		if name != "" {
+			fn, ok := funcs[name]
+			if !ok {
+				http.Error(w, fmt.Sprintf("function %q not found", name), http.StatusNotFound)
+				return
+			}
+			result = fn
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("GraphiteFunctionsHandler(): %v", err)
+		}
+	}
+}
+
+func describeFunction(fi *dsl.FuncInfo) *graphiteFunction {
+	fn := &graphiteFunction{
+		Name:   fi.Name,
+		Module: "tgres.dsl",
+		Group:  fi.Group,
+		Params: make([]*graphiteParam, 0, len(fi.Params)),
+	}
+	sig := make([]string, 0, len(fi.Params))
+	for _, p := range fi.Params {
+		gp := &graphiteParam{
+			Name:     p.Name,
+			Type:     p.Type,
+			Required: p.Required,
+			Multiple: p.Multiple,
+		}
+		if p.Default != nil {
+			if dft, err := json.Marshal(p.Default); err == nil {
+				gp.Default = dft
+			} else {
+				log.Printf("describeFunction(): %s default: %v", p.Name, err)
+			}
+		}
+		fn.Params = append(fn.Params, gp)
+		switch {
+		case p.Multiple:
+			sig = append(sig, "*"+p.Name)
+		case p.Default != nil:
+			sig = append(sig, fmt.Sprintf("%s=%v", p.Name, p.Default))
+		default:
+			sig = append(sig, p.Name)
+		}
+	}
+	fn.Function = fmt.Sprintf("%s(%s)", fi.Name, strings.Join(sig, ", "))
+	return fn
+}
@@ -0,0 +1,89 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tgres/tgres/dsl"
+)
+
+func Test_describeFunction_defaults(t *testing.T) {
+	fn := describeFunction(&dsl.FuncInfo{
+		Name:  "foo",
+		Group: "Transform",
+		Params: []*dsl.FuncParam{
+			{Name: "seriesList", Type: "seriesList", Required: true},
+			{Name: "b", Type: "boolean", Default: false},
+			{Name: "n", Type: "float", Default: 0.0},
+			{Name: "s", Type: "string", Default: ""},
+			{Name: "x", Type: "float"},
+		},
+	})
+	out, err := json.Marshal(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Params []map[string]interface{} `json:"params"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	for i, exp := range []interface{}{nil, false, 0.0, "", nil} {
+		dft, ok := got.Params[i]["default"]
+		if ok != (exp != nil) || dft != exp {
+			t.Errorf("%v: expected default %#v, got %#v (present: %v)", got.Params[i]["name"], exp, dft, ok)
+		}
+	}
+	if fn.Function != "foo(seriesList, b=false, n=0, s=, x)" {
+		t.Errorf("Unexpected signature: %s", fn.Function)
+	}
+}
+
+func Test_GraphiteFunctionsHandler(t *testing.T) {
+	h := GraphiteFunctionsHandler()
+
+	rw := httptest.NewRecorder()
+	h(rw, httptest.NewRequest("GET", "/functions/summarize", nil))
+	var fn struct {
+		Name   string
+		Params []struct {
+			Name    string
+			Default interface{}
+		}
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &fn); err != nil {
+		t.Fatalf("%v: %s", err, rw.Body.String())
+	}
+	var found bool
+	for _, p := range fn.Params {
+		if p.Name == "alignToFrom" {
+			found = p.Default == false
+		}
+	}
+	if fn.Name != "summarize" || !found {
+		t.Errorf("Expected summarize() with alignToFrom=false, got %s", rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	h(rw, httptest.NewRequest("GET", "/functions/nosuchfunction", nil))
+	if rw.Code != 404 {
+		t.Errorf("Expected 404 for an unknown function, got %d", rw.Code)
+	}
+}
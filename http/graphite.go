@@ -19,11 +19,13 @@ package http
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -32,13 +34,67 @@ import (
 
 	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/serde"
 )
 
 const BATCH_LIMIT = 64
 
+// MaxSeriesPerRequest is how many series the targets of a single
+// /render request can match together once the wildcards are
+// expanded, a series matched by several targets counts once, 0 is
+// unlimited. The targets fail as soon as there are more, the request
+// is then rejected with 413 and nothing is written.
+var MaxSeriesPerRequest = 0
+
+// ServerTiming, if true, adds a Server-Timing trailer to every
+// /render response, otherwise only to those requested with
+// debug=timing, see serverTiming().
+var ServerTiming = false
+
+// DefaultRenderRange is how far before until a /render request
+// without from begins, 24h like Graphite.
+var DefaultRenderRange = 24 * time.Hour
+
+// DefaultRenderMaxPoints is the maxDataPoints of a /render request
+// with neither maxDataPoints nor width. 0 means no consolidation,
+// the step is that of the RRA chosen for the range.
+var DefaultRenderMaxPoints = 0
+
+// Timezone is the location in which the times of a request without
+// tz (see parseTime()) are parsed and its targets evaluated (see
+// dsl.ParseDslIn()), e.g. where midnight is. The default is UTC.
+var Timezone = time.UTC
+
+// jsonp=<callback> wraps the JSON of /metrics/find and /render in a
+// call to callback, for browsers to load it from a <script> tag.
+var jsonpRe = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$.]*$`)
+
+// Returns the jsonp callback of the request, if any, and sets the
+// Content-Type for it.
+func jsonpCallback(w http.ResponseWriter, r *http.Request) (string, error) {
+	cb := r.FormValue("jsonp")
+	if cb == "" {
+		return "", nil
+	}
+	if len(cb) > 128 || !jsonpRe.MatchString(cb) {
+		return "", fmt.Errorf("invalid jsonp callback: %q", cb)
+	}
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	return cb, nil
+}
+
 func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		cb, err := jsonpCallback(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if cb != "" {
+			fmt.Fprintf(w, "/**/%s(", cb)
+		}
 		fmt.Fprintf(w, "[\n")
 		nodes := rcache.FsFind(r.FormValue("query"))
 		dupe := make(map[string]bool)
@@ -51,10 +107,19 @@ func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 			}
 			dupe[suffix] = true
 		}
+		attrs := leafAttributes(rcache, uniq)
 		for n, node := range uniq {
 			parts := strings.Split(node.Name, ".")
 			suffix := parts[len(parts)-1]
 
+			// The context of a leaf is its DS attributes, if any
+			context := []byte("{}")
+			if a := attrs[node.Ident().String()]; node.Leaf && len(a) > 0 {
+				if js, err := json.Marshal(a); err == nil {
+					context = js
+				}
+			}
+
 			var ileaf, iexp int
 			if node.Leaf {
 				ileaf = 1
@@ -63,17 +128,46 @@ func GraphiteMetricsFindHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				iexp = 1
 			}
 			// not very clear on how we can be expandable and not allow children...
-			fmt.Fprintf(w, `{"leaf": %d, "context": {}, "text": "%s", "expandable": %d, "id": "%s", "allowChildren": %d}`,
-				ileaf, suffix, iexp, node.Name, iexp)
+			fmt.Fprintf(w, `{"leaf": %d, "context": %s, "text": "%s", "expandable": %d, "id": "%s", "allowChildren": %d}`,
+				ileaf, context, suffix, iexp, node.Name, iexp)
 			if n < len(uniq)-1 {
 				fmt.Fprintf(w, ",\n")
 			}
 		}
-		fmt.Fprintf(w, "\n]\n")
+		fmt.Fprintf(w, "\n]")
+		if cb != "" {
+			fmt.Fprintf(w, ")")
+		}
+		fmt.Fprintf(w, "\n")
 		log.Printf("GraphiteMetricsFindHandler: finished in %v", time.Now().Sub(start))
 	}
 }
 
+// Returns the attributes of the leaf nodes, if the db supports them,
+// keyed by ident. They are looked up in a single query rather than by
+// loading every DS (which would also fill the DS LRU).
+func leafAttributes(rcache dsl.NamedDSFetcher, nodes []*dsl.FsFindNode) map[string]map[string]string {
+	as, ok := rcache.(serde.AttributeStorer)
+	if !ok {
+		return nil
+	}
+	var idents []serde.Ident
+	for _, node := range nodes {
+		if node.Leaf {
+			idents = append(idents, node.Ident())
+		}
+	}
+	if len(idents) == 0 {
+		return nil
+	}
+	attrs, err := as.FetchAttributes(idents)
+	if err != nil {
+		log.Printf("GraphiteMetricsFindHandler: error getting attributes: %v", err)
+		return nil
+	}
+	return attrs
+}
+
 func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 
 	return makeGzipHandler(
@@ -81,14 +175,27 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 			w.Header().Set("Content-Type", "application/json")
 
 			start := time.Now()
-			from, err := parseTime(r.FormValue("from"))
+			cb, err := jsonpCallback(w, r)
+			if err != nil {
+				log.Printf("RenderHandler(): %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			loc, err := requestTimezone(r)
+			if err != nil {
+				log.Printf("RenderHandler(): %v", err)
+				w.Header().Set("X-Tgres-DSL-Error", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			from, err := parseTime(r.FormValue("from"), loc)
 			if err != nil {
 				log.Printf("RenderHandler(): (from) %v", err)
 				w.Header().Set("X-Tgres-DSL-Error", fmt.Sprintf("from: %v", err))
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			to, err := parseTime(r.FormValue("until"))
+			to, err := parseTime(r.FormValue("until"), loc)
 			if err != nil {
 				log.Printf("RenderHandler(): (unitl) %v", err)
 				w.Header().Set("X-Tgres-DSL-Error", fmt.Sprintf("to: %v", err))
@@ -98,11 +205,31 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				tmp := time.Now()
 				to = &tmp
 			}
+			if from == nil {
+				tmp := to.Add(-DefaultRenderRange)
+				from = &tmp
+			}
 
-			points := 512
+			// Without maxDataPoints, the graph width (in pixels, as
+			// Graphite does) is the most points that can be shown,
+			// the RRA and the step are then chosen accordingly.
+			// maxDataPoints=0 (or the X-Tgres-Native-Resolution
+			// header) means no consolidation: every slot of the
+			// highest resolution RRA covering the range. Without
+			// either it is DefaultRenderMaxPoints.
+			points := DefaultRenderMaxPoints
 			mdp := r.FormValue("maxDataPoints")
+			if mdp == "" {
+				mdp = r.FormValue("width")
+			}
+			if mdp == "" && r.Header.Get("X-Tgres-Native-Resolution") != "" {
+				mdp = "0"
+			}
 			if mdp != "" {
 				points, err = strconv.Atoi(mdp)
+				if err == nil && points < 0 {
+					err = fmt.Errorf("negative: %d", points)
+				}
 				if err != nil {
 					log.Printf("RenderHandler(): (maxDataPoints) %v", err)
 					w.Header().Set("X-Tgres-DSL-Error", fmt.Sprintf("maxDataPoints: %v", err))
@@ -111,22 +238,57 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				}
 			}
 
+			// With trimTrailing=true, the points after the end of the
+			// data of a series are left out, rather than null.
+			var trim bool
+			if tt := r.FormValue("trimTrailing"); tt != "" {
+				if trim, err = strconv.ParseBool(tt); err != nil {
+					log.Printf("RenderHandler(): (trimTrailing) %v", err)
+					w.Header().Set("X-Tgres-DSL-Error", fmt.Sprintf("trimTrailing: %v", err))
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+
+			// template() calls are expanded before anything else, so
+			// that the template[name] parameters can apply to them.
+			vars := templateVars(r.Form)
+			exprs := make([]string, len(r.Form["target"]))
+			for n, target := range r.Form["target"] {
+				if exprs[n], err = dsl.ExpandTemplates(target, vars); err != nil {
+					log.Printf("RenderHandler() %q: %v", target, err)
+					w.Header().Set("X-Tgres-DSL-Error", err.Error())
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+
+			timing := ServerTiming || r.FormValue("debug") == "timing"
+			parsed := time.Now()
+
+			// Targets often refer to the same series, this makes
+			// sure each one is only read once per request.
+			shared := dsl.NewSharedFetcher(rcache)
+			shared.SetMaxSeries(MaxSeriesPerRequest)
+
 			var wg sync.WaitGroup
 
-			targets := make([][]*graphiteSeries, len(r.Form["target"]))
+			// The points are not read here but as they are written
+			// (see eachSeries), so that only a few series at a time
+			// are in memory however many the targets match.
+			targets := make([]dsl.SeriesMap, len(exprs))
+			limitErrs := make([]error, len(exprs))
 			batchSize := 0
-			for n, target := range r.Form["target"] {
+			for n, target := range exprs {
 				wg.Add(1)
 				batchSize++
-				go func(wg *sync.WaitGroup, target string, targets [][]*graphiteSeries, n int) {
-					if sm, err := processTarget(rcache, target, from.Unix(), to.Unix(), int64(points)); err == nil {
-						// sm may contain locked watched RRAs,
-						// readDataPoints unlocks them in
-						// series.Close() It's important to not do
-						// anything that could interrupt this, we MUST
-						// run readDataPoints.
-						targets[n] = readDataPoints(sm)
+				go func(wg *sync.WaitGroup, target string, targets []dsl.SeriesMap, n int) {
+					if sm, err := processTarget(shared, target, from.Unix(), to.Unix(), int64(points), loc); err == nil {
+						targets[n] = sm
 					} else {
+						if _, ok := err.(*dsl.LimitError); ok {
+							limitErrs[n] = err
+						}
 						w.Header().Set("X-Tgres-DSL-Error", fmt.Sprintf("%v", err))
 						log.Printf("RenderHandler() %q: %v", target, err)
 					}
@@ -138,86 +300,365 @@ func GraphiteRenderHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 				}
 			}
 			wg.Wait()
+			shared.ReleaseReads()
+			evaluated := time.Now()
 
-			fmt.Fprintf(w, "[")
+			if MaxSeriesPerRequest > 0 && shared.Matched() > MaxSeriesPerRequest {
+				http.Error(w, fmt.Sprintf("the request matches more than %d series", MaxSeriesPerRequest),
+					http.StatusRequestEntityTooLarge)
+				return
+			}
 
-			for tn, target := range targets {
+			// A query too expensive to evaluate is the client's fault
+			for _, err := range limitErrs {
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
 
-				// empty target, deal with it
-				if len(target) == 0 {
-					if tn < len(targets)-1 {
-						fmt.Fprintf(w, "\n{\"datapoints\":[]},\n")
-					} else {
-						fmt.Fprintf(w, "\n{\"datapoints\":[]}\n")
+			// The body is streamed, the timing (which includes the
+			// serialization) is therefore a trailer.
+			if timing {
+				w.Header().Set("Trailer", "Server-Timing")
+			}
+			out := w
+			flush := func() {
+				if timing {
+					parse, find, fetch := shared.Timings()
+					w.Header().Set("Server-Timing", serverTiming(parsed.Sub(start)+parse, find, fetch, evaluated.Sub(parsed), time.Now().Sub(evaluated)))
+				}
+				log.Printf("GraphiteRenderHandler: finished in %v", time.Now().Sub(start))
+			}
+
+			// The series of a target are read a batch at a time and
+			// written as they come (see eachSeries()).
+			each := func(sm dsl.SeriesMap, fn func(*graphiteSeries)) {
+				eachSeries(sm, func(gs *graphiteSeries) {
+					if trim {
+						gs.trimTrailing()
 					}
+					fn(gs)
+				})
+			}
+
+			if r.FormValue("format") == "raw" {
+				w.Header().Set("Content-Type", "text/plain")
+				for _, sm := range targets {
+					each(sm, func(gs *graphiteSeries) { writeRawSeries(out, gs) })
 				}
+				flush()
+				return
+			}
+
+			if cb != "" {
+				fmt.Fprintf(out, "/**/%s(", cb)
+			}
+			fmt.Fprintf(out, "[")
 
-				nn := 0
-				for _, series := range target {
-					fmt.Fprintf(w, "\n"+`{"target": "%s", "datapoints": [`+"\n", series.name)
+			// The elements are separated as they come, the last one
+			// is not known in advance.
+			sep := ""
+			for _, sm := range targets {
+
+				// empty target, deal with it
+				if len(sm) == 0 {
+					fmt.Fprintf(out, "%s\n{\"datapoints\":[]}", sep)
+					sep = ",\n"
+					continue
+				}
+
+				each(sm, func(series *graphiteSeries) {
+					latest := "null" // no data ever
+					if !series.latest.IsZero() {
+						latest = strconv.FormatInt(series.latest.Unix(), 10)
+					}
+					fmt.Fprintf(out, "%s\n"+`{"target": "%s", "latest": %s, "datapoints": [`+"\n", sep, series.name, latest)
 					n := 0
 					for _, dp := range series.dps {
 						if dp.t > 0 {
 							if n > 0 {
-								fmt.Fprintf(w, ",")
+								fmt.Fprintf(out, ",")
 							}
 							if math.IsNaN(dp.v) || math.IsInf(dp.v, 0) {
-								fmt.Fprintf(w, "[null, %v]", dp.t)
+								fmt.Fprintf(out, "[null, %v]", dp.t)
 							} else {
-								fmt.Fprintf(w, "[%v, %v]", dp.v, dp.t)
+								fmt.Fprintf(out, "[%v, %v]", dp.v, dp.t)
 							}
 							n++
 						}
 					}
-
-					if nn < len(target)-1 || tn < len(targets)-1 {
-						fmt.Fprintf(w, "]},\n")
-					} else {
-						fmt.Fprintf(w, "]}")
-					}
-					nn++
-				}
+					fmt.Fprintf(out, "]}")
+					sep = ",\n"
+				})
+			}
+			fmt.Fprintf(out, "]")
+			if cb != "" {
+				fmt.Fprintf(out, ")")
 			}
-			fmt.Fprintf(w, "]\n")
+			fmt.Fprintf(out, "\n")
 
-			log.Printf("GraphiteRenderHandler: finished in %v", time.Now().Sub(start))
+			flush()
 		},
 	)
 }
 
+// GraphiteAnnotationsHandler serves events in the Graphite
+// /events/get_data format, which Grafana uses for annotations. Tags
+// are space-separated, only events having all of them are returned.
 func GraphiteAnnotationsHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// w.Header().Set("Access-Control-Allow-Origin", "*") // TODO Make me configurable
+		loc, err := requestTimezone(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, err := parseTime(r.FormValue("from"), loc)
+		if err != nil {
+			log.Printf("GraphiteAnnotationsHandler(): (from) %v", err)
+			http.Error(w, fmt.Sprintf("from: %v", err), http.StatusBadRequest)
+			return
+		} else if from == nil {
+			tmp := time.Now().Add(-24 * time.Hour)
+			from = &tmp
+		}
+		to, err := parseTime(r.FormValue("until"), loc)
+		if err != nil {
+			log.Printf("GraphiteAnnotationsHandler(): (until) %v", err)
+			http.Error(w, fmt.Sprintf("until: %v", err), http.StatusBadRequest)
+			return
+		} else if to == nil {
+			tmp := time.Now()
+			to = &tmp
+		}
+
+		events, err := rcache.FetchEvents(strings.Fields(r.FormValue("tags")), *from, *to)
+		if err == dsl.ErrNoEvents {
+			fmt.Fprintf(w, "[]\n")
+			return
+		}
+		if err != nil {
+			log.Printf("GraphiteAnnotationsHandler(): %v", err)
+			http.Error(w, err.Error(), dbErrorStatus(err))
+			return
+		}
+
+		result := make([]*graphiteEvent, 0, len(events))
+		for _, e := range events {
+			result = append(result, &graphiteEvent{Id: e.Id, When: e.When.Unix(), What: e.What, Tags: e.Tags, Data: e.Data})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			log.Printf("GraphiteAnnotationsHandler(): %v", err)
+		}
+	}
+}
+
+// GraphiteEventsHandler records an event POSTed as JSON, e.g.:
+//
+//   {"what": "Deployed foo", "tags": ["deploy", "foo"], "data": "v1.2.3", "when": 1489657260}
+//
+// Tags can also be a space-separated string, when is optional and
+// defaults to now. A GET is the same as /events/get_data.
+func GraphiteEventsHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	get := GraphiteAnnotationsHandler(rcache)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			get(w, r)
+			return
+		}
+
+		var ev struct {
+			What string
+			Tags interface{}
+			Data string
+			When int64
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			log.Printf("GraphiteEventsHandler(): %v", err)
+			http.Error(w, fmt.Sprintf("Error parsing event: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		e := &serde.Event{What: ev.What, Data: ev.Data, Tags: []string{}}
+		switch tags := ev.Tags.(type) {
+		case string:
+			e.Tags = strings.Fields(tags)
+		case []interface{}:
+			for _, tag := range tags {
+				e.Tags = append(e.Tags, fmt.Sprintf("%v", tag))
+			}
+		case nil:
+		default:
+			http.Error(w, fmt.Sprintf("Invalid tags: %v", ev.Tags), http.StatusBadRequest)
+			return
+		}
+		if ev.When != 0 {
+			e.When = time.Unix(ev.When, 0)
+		} else {
+			e.When = time.Now()
+		}
+
+		if err := rcache.StoreEvent(e); err == dsl.ErrNoEvents {
+			http.Error(w, "Events are not supported", http.StatusNotImplemented)
+			return
+		} else if err != nil {
+			log.Printf("GraphiteEventsHandler(): %v", err)
+			http.Error(w, err.Error(), dbErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "{\"id\": %d}\n", e.Id)
+	}
+}
+
+type graphiteEvent struct {
+	Id   int64    `json:"id"`
+	When int64    `json:"when"`
+	What string   `json:"what"`
+	Tags []string `json:"tags"`
+	Data string   `json:"data"`
+}
 
-		// Annotations not implemented
-		fmt.Fprintf(w, "[]\n")
+// The timezone of a request, given by its tz parameter (e.g.
+// tz=Europe/Berlin), Timezone if there is none.
+func requestTimezone(r *http.Request) (*time.Location, error) {
+	tz := r.FormValue("tz")
+	if tz == "" {
+		return Timezone, nil
 	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tz %q: %v", tz, err)
+	}
+	return loc, nil
+}
+
+// parseTime parses from, until etc the way Graphite does: -<duration>
+// (before now), now, unix seconds, or midnight, noon, today,
+// yesterday, tomorrow, YYYYMMDD or HH:MM_YYYYMMDD in loc, optionally
+// followed by +<duration> or -<duration>, e.g. "midnight-7d". Days
+// and weeks ("7d", "2w") are calendar days in loc, so that midnight
+// remains midnight across a DST change, any other unit ("24h" too) is
+// an exact duration.
+func parseTime(s string, loc *time.Location) (*time.Time, error) {
+	return parseTimeAt(s, time.Now(), loc)
 }
 
-func parseTime(s string) (*time.Time, error) {
+// parseTime as of now.
+func parseTimeAt(s string, now time.Time, loc *time.Location) (*time.Time, error) {
 
 	if len(s) == 0 {
 		return nil, nil
 	}
 
+	now = now.In(loc)
 	if s[0] == '-' { // relative
-		if dur, err := misc.BetterParseDuration(s[1:len(s)]); err == nil {
-			t := time.Now().Add(-dur)
+		if days, dur, err := parseOffset(s[1:len(s)]); err == nil {
+			t := now.AddDate(0, 0, -days).Add(-dur)
 			return &t, nil
 		} else {
 			return nil, fmt.Errorf("parseTime(): Error parsing relative time %q: %v", s, err)
 		}
-	} else { // absolute
-		if s == "now" {
-			t := time.Now()
-			return &t, nil
-		} else if i, err := strconv.ParseInt(s, 10, 64); err == nil {
-			t := time.Unix(i, 0)
-			return &t, nil
+	}
+
+	// absolute, with an optional offset
+	base, days, offset := s, 0, time.Duration(0)
+	if i := strings.IndexAny(s, "+-"); i > 0 {
+		dd, dur, err := parseOffset(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("parseTime(): Error parsing offset of %q: %v", s, err)
+		}
+		if base, days, offset = s[:i], dd, dur; s[i] == '-' {
+			days, offset = -dd, -dur
+		}
+	}
+
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	var t time.Time
+	switch base {
+	case "now":
+		t = now
+	case "midnight", "today":
+		t = midnight
+	case "noon":
+		t = midnight.Add(12 * time.Hour)
+	case "yesterday":
+		t = midnight.AddDate(0, 0, -1)
+	case "tomorrow":
+		t = midnight.AddDate(0, 0, 1)
+	default:
+		if len(base) == 8 && base[0] != '0' {
+			if date, err := time.ParseInLocation("20060102", base, loc); err == nil {
+				t = date
+				break
+			}
+		}
+		if date, err := time.ParseInLocation("15:04_20060102", base, loc); err == nil {
+			t = date
+		} else if i, err := strconv.ParseInt(base, 10, 64); err == nil {
+			t = time.Unix(i, 0).In(loc)
 		} else {
 			return nil, fmt.Errorf("parseTime(): Error parsing absolute time %q: %v", s, err)
 		}
 	}
+	t = t.AddDate(0, 0, days).Add(offset)
+	return &t, nil
+}
+
+// Parses a duration of parseTime(), returning days and weeks as a
+// number of (calendar) days, anything else as a duration.
+func parseOffset(s string) (days int, d time.Duration, err error) {
+	num, perUnit := s, 0
+	switch {
+	case strings.HasSuffix(s, "weeks"):
+		num, perUnit = s[:len(s)-5], 7
+	case strings.HasSuffix(s, "week"):
+		num, perUnit = s[:len(s)-4], 7
+	case strings.HasSuffix(s, "w"):
+		num, perUnit = s[:len(s)-1], 7
+	case strings.HasSuffix(s, "d"):
+		num, perUnit = s[:len(s)-1], 1
+	}
+	if perUnit > 0 {
+		if n, err := strconv.Atoi(num); err == nil {
+			return n * perUnit, 0, nil
+		}
+	}
+	d, err = misc.BetterParseDuration(s)
+	return 0, d, err
+}
+
+// The template[name]=value parameters of a render request, as
+// Graphite has them, keyed by name.
+func templateVars(form url.Values) map[string]string {
+	var vars map[string]string
+	for k, v := range form {
+		if strings.HasPrefix(k, "template[") && strings.HasSuffix(k, "]") && len(v) > 0 {
+			if vars == nil {
+				vars = make(map[string]string)
+			}
+			vars[k[len("template["):len(k)-1]] = v[0]
+		}
+	}
+	return vars
+}
+
+// The HTTP status for an error returned by the database.
+func dbErrorStatus(err error) int {
+	switch serde.ErrorKind(err) {
+	case serde.ErrNotFound:
+		return http.StatusNotFound
+	case serde.ErrConflict:
+		return http.StatusConflict
+	case serde.ErrInvalid:
+		return http.StatusBadRequest
+	case serde.ErrUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
 }
 
 // This is not perfect, but it's better than nothing. It seeks
@@ -256,11 +697,38 @@ func quoteIdentifiers(target string) string {
 	return result
 }
 
-func processTarget(rcache dsl.NamedDSFetcher, target string, from, to, maxPoints int64) (dsl.SeriesMap, error) {
+// The Server-Timing trailer of a render response, in milliseconds:
+//
+//   parse;dur=0.052, find;dur=1.210, fetch;dur=35.107, eval;dur=40.322, serialize;dur=2.415
+//
+// parse is that of the request and of the target expressions. eval is
+// the time it took to evaluate all the targets, which includes parsing
+// them and finding and fetching the series, but since the targets are
+// evaluated concurrently, the times of the expressions, find and fetch
+// are summed over all of them and can exceed it. The points are read
+// as they are written, which is therefore part of serialize.
+func serverTiming(parse, find, fetch, eval, serialize time.Duration) string {
+	var parts []string
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"parse", parse},
+		{"find", find},
+		{"fetch", fetch},
+		{"eval", eval},
+		{"serialize", serialize},
+	} {
+		parts = append(parts, fmt.Sprintf("%s;dur=%.3f", t.name, t.d.Seconds()*1000))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func processTarget(rcache dsl.NamedDSFetcher, target string, from, to, maxPoints int64, loc *time.Location) (dsl.SeriesMap, error) {
 	target = quoteIdentifiers(target)
 	// In our DSL everything must be a function call, so we wrap everything in group()
 	query := fmt.Sprintf("group(%s)", target)
-	return dsl.ParseDsl(rcache, query, time.Unix(from, 0), time.Unix(to, 0), maxPoints)
+	return dsl.ParseDslIn(rcache, query, time.Unix(from, 0), time.Unix(to, 0), maxPoints, loc)
 }
 
 // Graphite data points
@@ -269,41 +737,123 @@ type dataPoint struct {
 	v float64
 }
 type graphiteSeries struct {
-	dps  []*dataPoint
-	name string
+	dps    []*dataPoint
+	name   string
+	step   time.Duration // after any consolidation
+	latest time.Time     // where the data ends, zero if there never was any
+}
+
+// Removes the points after the latest, i.e. the slots which begin
+// after the data ends, which are NaN only because the range extends
+// beyond it. A series which never had data is left as is.
+func (gs *graphiteSeries) trimTrailing() {
+	if gs.latest.IsZero() {
+		return
+	}
+	latest := gs.latest.Unix()
+	for len(gs.dps) > 0 {
+		dp := gs.dps[len(gs.dps)-1]
+		if dp.t-int64(gs.step.Seconds()) < latest {
+			break
+		}
+		gs.dps = gs.dps[:len(gs.dps)-1]
+	}
 }
 
 func readDataPoints(sm dsl.SeriesMap) []*graphiteSeries {
+	result := make([]*graphiteSeries, 0, len(sm))
+	eachSeries(sm, func(gs *graphiteSeries) {
+		result = append(result, gs)
+	})
+	return result
+}
+
+// Reads the points of the series of sm and calls fn with each of
+// them, in the order of the names, closing the series and removing
+// them from sm. Up to BATCH_LIMIT series are read concurrently, fn is
+// called once all of a batch is read and nothing is kept after, so
+// that the points of a huge sm need not be in memory at once.
+func eachSeries(sm dsl.SeriesMap, fn func(*graphiteSeries)) {
 	names := sm.SortedKeys()
-	result := make([]*graphiteSeries, len(names))
-	var (
-		wg        sync.WaitGroup
-		batchSize int
-	)
-	for n, name := range sm.SortedKeys() {
-		series := sm[name]
-		alias := series.Alias()
-		if alias != "" {
-			name = alias
-		}
-		wg.Add(1)
-		batchSize++
-		go func(wg *sync.WaitGroup, result []*graphiteSeries, n int, name string) {
-			gs := &graphiteSeries{make([]*dataPoint, 0), name}
-			for series.Next() {
-				gs.dps = append(gs.dps, &dataPoint{series.CurrentTime().Unix(), series.CurrentValue()})
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > BATCH_LIMIT {
+			batch = batch[:BATCH_LIMIT]
+		}
+		names = names[len(batch):]
+
+		result := make([]*graphiteSeries, len(batch))
+		var wg sync.WaitGroup
+		for n, name := range batch {
+			series := sm[name]
+			delete(sm, name)
+			alias := series.Alias()
+			if alias != "" {
+				name = alias
 			}
-			result[n] = gs
-			series.Close()
-			wg.Done()
-		}(&wg, result, n, name)
-		if batchSize > BATCH_LIMIT {
-			wg.Wait()
-			batchSize = 0
+			wg.Add(1)
+			go func(wg *sync.WaitGroup, result []*graphiteSeries, n int, name string) {
+				gs := &graphiteSeries{dps: make([]*dataPoint, 0), name: name}
+				for series.Next() {
+					gs.dps = append(gs.dps, &dataPoint{series.CurrentTime().Unix(), series.CurrentValue()})
+				}
+				// NB: GroupBy() must be called after Next() because
+				// the series may only know its final consolidation
+				// interval once the data has been read.
+				gs.step = series.GroupBy()
+				gs.latest = series.Latest()
+				result[n] = gs
+				series.Close()
+				wg.Done()
+			}(&wg, result, n, name)
+		}
+		wg.Wait()
+
+		for n, gs := range result {
+			fn(gs)
+			result[n] = nil
 		}
 	}
-	wg.Wait()
-	return result
+}
+
+// Write a series in the Graphite rawData format, one series per line:
+//
+//   name,start,end,step|v1,v2,...
+//
+// Timestamps are in seconds, the point at position i is at start +
+// i*step and end is exclusive, i.e. start + len(values)*step. Null
+// values are written as None.
+func writeRawSeries(w io.Writer, series *graphiteSeries) {
+	dps := make([]*dataPoint, 0, len(series.dps))
+	for _, dp := range series.dps {
+		if dp.t > 0 {
+			dps = append(dps, dp)
+		}
+	}
+
+	step := int64(series.step.Seconds())
+	if step == 0 && len(dps) > 1 {
+		step = dps[1].t - dps[0].t
+	}
+
+	var start, end int64
+	if len(dps) > 0 {
+		start = dps[0].t
+		end = start + int64(len(dps))*step
+	}
+
+	fmt.Fprintf(w, "%s,%d,%d,%d|", series.name, start, end, step)
+	for n, dp := range dps {
+		if n > 0 {
+			fmt.Fprintf(w, ",")
+		}
+		if math.IsNaN(dp.v) || math.IsInf(dp.v, 0) {
+			fmt.Fprintf(w, "None")
+		} else {
+			fmt.Fprintf(w, "%v", dp.v)
+		}
+	}
+	fmt.Fprintf(w, "\n")
 }
 
 // Gzip Compression
@@ -0,0 +1,458 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"github.com/tgres/tgres/series"
+)
+
+// What the tests need of the memory db.
+type testDb interface {
+	FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error)
+	serde.AttributeStorer
+}
+
+// Returns a memory db with the DSs of names, which have a minutely
+// RRA of a day, and a fetcher of it.
+func testFetcher(names ...string) (testDb, dsl.NamedDSFetcher) {
+	db := serde.NewMemSerDe()
+	for _, name := range names {
+		db.FetchOrCreateDataSource(serde.Ident{"name": name}, &rrd.DSSpec{
+			Step:      time.Minute,
+			Heartbeat: time.Hour,
+			RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: time.Minute, Span: 24 * time.Hour}},
+		})
+	}
+	rcache := dsl.NewNamedDSFetcher(db, nil, 0)
+	rcache.Preload()
+	return db, rcache
+}
+
+func Test_GraphiteMetricsFindHandler(t *testing.T) {
+	db, rcache := testFetcher("foo.bar", "foo.baz", "foo.sub.qux")
+	ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar"}, nil)
+	db.SetAttributes(ds.(serde.DbDataSourcer).Id(), map[string]string{"units": "bytes"})
+
+	w := httptest.NewRecorder()
+	GraphiteMetricsFindHandler(rcache)(w, httptest.NewRequest("GET", "/metrics/find?query=foo.*", nil))
+	var nodes []struct {
+		Leaf, Expandable int
+		Text, Id         string
+		Context          map[string]string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &nodes); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	byId := make(map[string]int)
+	for n, node := range nodes {
+		byId[node.Id] = n
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("Expected 3 nodes, got %s", w.Body.String())
+	}
+	if n := nodes[byId["foo.bar"]]; n.Leaf != 1 || n.Text != "bar" || len(n.Context) != 1 || n.Context["units"] != "bytes" {
+		t.Errorf("Expected foo.bar to be a leaf with its units, got %+v", n)
+	}
+	if n := nodes[byId["foo.baz"]]; n.Leaf != 1 || len(n.Context) != 0 {
+		t.Errorf("Expected foo.baz to be a leaf without attributes, got %+v", n)
+	}
+	if n := nodes[byId["foo.sub"]]; n.Leaf != 0 || n.Expandable != 1 || len(n.Context) != 0 {
+		t.Errorf("Expected foo.sub to be expandable, got %+v", n)
+	}
+}
+
+func Test_serverTiming(t *testing.T) {
+	ms := time.Millisecond
+	exp := "parse;dur=0.052, find;dur=1.000, fetch;dur=35.107, eval;dur=40.000, serialize;dur=0.000"
+	if st := serverTiming(52*time.Microsecond, ms, 35107*time.Microsecond, 40*ms, 0); st != exp {
+		t.Errorf("Expected %q, got %q", exp, st)
+	}
+}
+
+func Test_GraphiteRenderHandler_timing(t *testing.T) {
+	_, rcache := testFetcher("foo.bar")
+	for _, c := range []struct {
+		query  string
+		timing bool
+	}{
+		{"target=foo.bar&from=-1h", false},
+		{"target=foo.bar&from=-1h&debug=timing", true},
+		{"target=foo.bar&from=-1h&debug=timing&format=raw", true},
+	} {
+		w := httptest.NewRecorder()
+		GraphiteRenderHandler(rcache)(w, httptest.NewRequest("GET", "/render?"+c.query, nil))
+		res := w.Result()
+		if res.StatusCode != 200 {
+			t.Fatalf("%s: status %d: %s", c.query, res.StatusCode, w.Body.String())
+		}
+		if res.Header.Get("Server-Timing") != "" {
+			t.Errorf("%s: expected the timing as a trailer, not a header", c.query)
+		}
+		st := res.Trailer.Get("Server-Timing")
+		if c.timing != strings.HasPrefix(st, "parse;dur=") || c.timing != strings.Contains(st, "serialize;dur=") {
+			t.Errorf("%s: unexpected Server-Timing trailer %q", c.query, st)
+		}
+		if !strings.Contains(w.Body.String(), "foo.bar") {
+			t.Errorf("%s: expected the series in the body, got %s", c.query, w.Body.String())
+		}
+	}
+}
+
+func Test_graphiteSeries_trimTrailing(t *testing.T) {
+	gs := func(latest int64, ts ...int64) *graphiteSeries {
+		result := &graphiteSeries{step: time.Minute, latest: time.Unix(latest, 0)}
+		if latest == 0 {
+			result.latest = time.Time{}
+		}
+		for _, t := range ts {
+			result.dps = append(result.dps, &dataPoint{t: t})
+		}
+		return result
+	}
+	for _, c := range []struct {
+		gs  *graphiteSeries
+		exp int
+	}{
+		{gs(1000, 940, 1000, 1030, 1060, 1120), 3}, // the slot of 1030 begins before latest
+		{gs(1000, 1060, 1120), 0},                  // all after the data
+		{gs(2000, 940, 1000), 2},                   // nothing after the data
+		{gs(0, 940, 1000), 2},                      // never any data
+		{gs(1000), 0},
+	} {
+		c.gs.trimTrailing()
+		if len(c.gs.dps) != c.exp {
+			t.Errorf("latest %v: expected %d points, got %d", c.gs.latest, c.exp, len(c.gs.dps))
+		}
+	}
+}
+
+func Test_GraphiteRenderHandler_trimTrailing(t *testing.T) {
+	db, rcache := testFetcher("foo.bar")
+	ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar"}, nil)
+	now := time.Now()
+	for n := 40; n >= 30; n-- {
+		ds.ProcessDataPoint(float64(n), now.Add(-time.Duration(n)*time.Minute))
+	}
+	latest := ds.RRAs()[0].Latest().Unix()
+
+	render := func(query string) (int, [][2]*float64) {
+		w := httptest.NewRecorder()
+		GraphiteRenderHandler(rcache)(w, httptest.NewRequest("GET", "/render?target=foo.bar&from=-1h&"+query, nil))
+		var result []struct{ Datapoints [][2]*float64 }
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result) != 1 {
+				t.Fatalf("%s: unexpected body %s: %v", query, w.Body.String(), err)
+			}
+			return w.Code, result[0].Datapoints
+		}
+		return w.Code, nil
+	}
+
+	_, all := render("trimTrailing=false")
+	if last := all[len(all)-1]; last[0] != nil || int64(*last[1]) < now.Unix()-60 {
+		t.Errorf("Expected null points up to now without trimming, got %v at %v", last[0], *last[1])
+	}
+	_, trimmed := render("trimTrailing=true")
+	if len(trimmed) == 0 || len(trimmed) >= len(all) {
+		t.Fatalf("Expected fewer points with trimTrailing, got %d of %d", len(trimmed), len(all))
+	}
+	if last := trimmed[len(trimmed)-1]; last[0] == nil || int64(*last[1])-60 >= latest {
+		t.Errorf("Expected the last point to be the one of the latest data, got %v at %v (latest %v)", last[0], *last[1], latest)
+	}
+	if code, _ := render("trimTrailing=maybe"); code != 400 {
+		t.Errorf("Expected a 400 for an invalid trimTrailing, got %d", code)
+	}
+}
+
+func Test_GraphiteRenderHandler_maxSeries(t *testing.T) {
+	_, rcache := testFetcher("foo.bar", "foo.baz", "qux")
+	defer func(n int) { MaxSeriesPerRequest = n }(MaxSeriesPerRequest)
+	MaxSeriesPerRequest = 2
+
+	for query, code := range map[string]int{
+		"target=foo.*&target=foo.bar":        200, // foo.bar counted once
+		"target=foo.*&target=qux":            413,
+		"target=foo.*&target=sumSeries(qux)": 413,
+	} {
+		w := httptest.NewRecorder()
+		GraphiteRenderHandler(rcache)(w, httptest.NewRequest("GET", "/render?from=-1h&"+query, nil))
+		if w.Code != code {
+			t.Errorf("%s: expected %d, got %d: %s", query, code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func Test_writeRawSeries(t *testing.T) {
+	for _, c := range []struct {
+		gs  *graphiteSeries
+		exp string
+	}{
+		{&graphiteSeries{name: "foo", step: time.Minute, dps: []*dataPoint{{1020, 1.5}, {1080, math.NaN()}, {1140, math.Inf(1)}, {1200, 3}}},
+			"foo,1020,1260,60|1.5,None,None,3\n"},
+		// without a step, it is that of the points
+		{&graphiteSeries{name: "foo", dps: []*dataPoint{{1000, 1}, {1010, 2}}},
+			"foo,1000,1020,10|1,2\n"},
+		// points without a time are skipped
+		{&graphiteSeries{name: "foo", step: time.Minute, dps: []*dataPoint{{0, 1}, {1020, 2}}},
+			"foo,1020,1080,60|2\n"},
+		{&graphiteSeries{name: "foo", step: time.Minute}, "foo,0,0,60|\n"},
+	} {
+		var buf bytes.Buffer
+		writeRawSeries(&buf, c.gs)
+		if buf.String() != c.exp {
+			t.Errorf("Expected %q, got %q", c.exp, buf.String())
+		}
+	}
+}
+
+func Test_GraphiteRenderHandler_raw(t *testing.T) {
+	db, rcache := testFetcher("foo.bar")
+	ds, _ := db.FetchOrCreateDataSource(serde.Ident{"name": "foo.bar"}, nil)
+	for n := int64(0); n <= 10; n++ {
+		ds.ProcessDataPoint(float64(n), time.Unix(1500001200+n*60, 0))
+	}
+
+	for _, c := range []struct {
+		query, exp string
+	}{
+		// the first point only sets the last update of the DS
+		{"from=1500001200&until=1500001500&trimTrailing=true",
+			"foo.bar,1500001200,1500001560,60|None,1,2,3,4,5\n"},
+		// 12 minute groups, the step is that of the groups
+		{"from=1500001200&until=1500004800&maxDataPoints=5",
+			"foo.bar,1500001860,1500005460,720|5.5,None,None,None,None\n"},
+	} {
+		w := httptest.NewRecorder()
+		GraphiteRenderHandler(rcache)(w, httptest.NewRequest("GET", "/render?target=foo.bar&format=raw&"+c.query, nil))
+		if w.Body.String() != c.exp {
+			t.Errorf("%s: expected %q, got %q", c.query, c.exp, w.Body.String())
+		}
+	}
+}
+
+func Test_GraphiteRenderHandler_defaults(t *testing.T) {
+	_, rcache := testFetcher("foo.bar")
+	defer func(r time.Duration, n int) { DefaultRenderRange, DefaultRenderMaxPoints = r, n }(DefaultRenderRange, DefaultRenderMaxPoints)
+
+	points := func(query string) int {
+		w := httptest.NewRecorder()
+		GraphiteRenderHandler(rcache)(w, httptest.NewRequest("GET", "/render?target=foo.bar&"+query, nil))
+		var result []struct{ Datapoints [][2]*float64 }
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result) != 1 {
+			t.Fatalf("%s: unexpected body %s: %v", query, w.Body.String(), err)
+		}
+		return len(result[0].Datapoints)
+	}
+
+	// Neither maxDataPoints nor width: the native (minutely) resolution
+	if n := points("from=-2h"); n < 119 || n > 121 {
+		t.Errorf("Expected every minute of 2h without maxDataPoints, got %d points", n)
+	}
+	// Neither from: DefaultRenderRange
+	if n := points(""); n < 1439 || n > 1441 {
+		t.Errorf("Expected every minute of the default 24h, got %d points", n)
+	}
+	DefaultRenderRange = time.Hour
+	if n := points(""); n < 59 || n > 61 {
+		t.Errorf("Expected every minute of a 1h default range, got %d points", n)
+	}
+	DefaultRenderMaxPoints = 10
+	if n := points("from=-2h"); n > 10 {
+		t.Errorf("Expected at most DefaultRenderMaxPoints, got %d points", n)
+	}
+	if n := points("from=-2h&width=20"); n > 20 || n <= 10 {
+		t.Errorf("Expected width to override DefaultRenderMaxPoints, got %d points", n)
+	}
+	if n := points("from=-2h&maxDataPoints=0"); n < 119 {
+		t.Errorf("Expected maxDataPoints=0 to be the native resolution, got %d points", n)
+	}
+}
+
+func Test_parseTimeAt(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// DST began on 2017-03-12 at 2:00, the day before now
+	now := time.Date(2017, 3, 13, 1, 30, 0, 0, ny)
+	for _, c := range []struct {
+		s   string
+		loc *time.Location
+		exp time.Time
+	}{
+		{"now", ny, now},
+		{"midnight", ny, time.Date(2017, 3, 13, 0, 0, 0, 0, ny)},
+		{"today", ny, time.Date(2017, 3, 13, 0, 0, 0, 0, ny)},
+		{"noon", ny, time.Date(2017, 3, 13, 12, 0, 0, 0, ny)},
+		{"yesterday", ny, time.Date(2017, 3, 12, 0, 0, 0, 0, ny)},
+		{"tomorrow", ny, time.Date(2017, 3, 14, 0, 0, 0, 0, ny)},
+		{"20170310", ny, time.Date(2017, 3, 10, 0, 0, 0, 0, ny)},
+		{"13:45_20170310", ny, time.Date(2017, 3, 10, 13, 45, 0, 0, ny)},
+		{"1489657260", ny, time.Unix(1489657260, 0)},
+		{"midnight-1d", ny, time.Date(2017, 3, 12, 0, 0, 0, 0, ny)},
+		{"midnight-24h", ny, time.Date(2017, 3, 11, 23, 0, 0, 0, ny)},
+		{"midnight-1w", ny, time.Date(2017, 3, 6, 0, 0, 0, 0, ny)},
+		{"midnight+90min", ny, time.Date(2017, 3, 13, 1, 30, 0, 0, ny)},
+		{"noon+1d", ny, time.Date(2017, 3, 14, 12, 0, 0, 0, ny)},
+		{"20170311+2d", ny, time.Date(2017, 3, 13, 0, 0, 0, 0, ny)},
+		{"-1d", ny, time.Date(2017, 3, 12, 1, 30, 0, 0, ny)},
+		{"-24h", ny, now.Add(-24 * time.Hour)},
+		{"-2weeks", ny, time.Date(2017, 2, 27, 1, 30, 0, 0, ny)},
+		{"-2h", ny, now.Add(-2 * time.Hour)},
+		// the same now in UTC
+		{"midnight", time.UTC, time.Date(2017, 3, 13, 0, 0, 0, 0, time.UTC)},
+		{"yesterday", time.UTC, time.Date(2017, 3, 12, 0, 0, 0, 0, time.UTC)},
+		{"20170310", time.UTC, time.Date(2017, 3, 10, 0, 0, 0, 0, time.UTC)},
+	} {
+		got, err := parseTimeAt(c.s, now, c.loc)
+		if err != nil || !got.Equal(c.exp) {
+			t.Errorf("%q in %v: expected %v, got %v (err: %v)", c.s, c.loc, c.exp, got, err)
+		}
+	}
+
+	for _, s := range []string{"bogus", "midnight+foo", "-foo"} {
+		if _, err := parseTimeAt(s, now, ny); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+	if got, err := parseTimeAt("", now, ny); got != nil || err != nil {
+		t.Errorf("Expected nil for an empty time, got %v (err: %v)", got, err)
+	}
+}
+
+func Test_parseOffset(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		days int
+		d    time.Duration
+	}{
+		{"7d", 7, 0},
+		{"2w", 14, 0},
+		{"1week", 7, 0},
+		{"3weeks", 21, 0},
+		{"24h", 0, 24 * time.Hour},
+		{"48hours", 0, 48 * time.Hour},
+		{"90min", 0, 90 * time.Minute},
+		{"1y", 0, 8760 * time.Hour},
+	} {
+		days, d, err := parseOffset(c.s)
+		if err != nil || days != c.days || d != c.d {
+			t.Errorf("%q: expected %d days %v, got %d %v (err: %v)", c.s, c.days, c.d, days, d, err)
+		}
+	}
+}
+
+func Test_jsonp(t *testing.T) {
+	_, rcache := testFetcher("foo.bar")
+
+	for _, c := range []struct {
+		handler func(w http.ResponseWriter, r *http.Request)
+		path    string
+	}{
+		{GraphiteMetricsFindHandler(rcache), "/metrics/find?query=foo.*"},
+		{GraphiteRenderHandler(rcache), "/render?target=foo.bar&from=-1h"},
+	} {
+		w := httptest.NewRecorder()
+		c.handler(w, httptest.NewRequest("GET", c.path, nil))
+		plain := w.Body.String()
+		if w.Code != 200 || strings.HasPrefix(plain, "/**/") {
+			t.Fatalf("%s: unexpected response %d %s", c.path, w.Code, plain)
+		}
+
+		w = httptest.NewRecorder()
+		c.handler(w, httptest.NewRequest("GET", c.path+"&jsonp=cb.$done_1", nil))
+		body := w.Body.String()
+		if w.Code != 200 || !strings.HasPrefix(body, "/**/cb.$done_1(") || !strings.HasSuffix(strings.TrimSpace(body), ")") {
+			t.Errorf("%s: expected the JSON wrapped in the callback, got %s", c.path, body)
+		}
+		inner := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(body), "/**/cb.$done_1("), ")")
+		var v interface{}
+		if err := json.Unmarshal([]byte(inner), &v); err != nil {
+			t.Errorf("%s: expected valid JSON in the callback, got %s: %v", c.path, inner, err)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/javascript" {
+			t.Errorf("%s: expected application/javascript, got %q", c.path, ct)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: expected X-Content-Type-Options: nosniff", c.path)
+		}
+
+		for _, cb := range []string{"alert(1)", "1cb", "cb%3Bx", "a%20b", strings.Repeat("a", 129)} {
+			w = httptest.NewRecorder()
+			c.handler(w, httptest.NewRequest("GET", c.path+"&jsonp="+cb, nil))
+			if w.Code != 400 || strings.Contains(w.Body.String(), "/**/") {
+				t.Errorf("%s: expected a 400 for callback %q, got %d %s", c.path, cb, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+// A db without events.
+type noEventsDb struct {
+	serde.DataSourceSearcher
+	testDb
+}
+
+func (db *noEventsDb) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func Test_GraphiteEventsHandler(t *testing.T) {
+	db, rcache := testFetcher()
+
+	w := httptest.NewRecorder()
+	GraphiteEventsHandler(rcache)(w, httptest.NewRequest("POST", "/events",
+		strings.NewReader(`{"what": "Deployed foo", "tags": "deploy foo", "data": "v1.2.3", "when": 1500000000}`)))
+	if w.Code != 200 {
+		t.Fatalf("Expected a 200, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	GraphiteAnnotationsHandler(rcache)(w, httptest.NewRequest("GET", "/events/get_data?from=1499990000&until=1500010000&tags=foo", nil))
+	var events []graphiteEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatalf("%v: %s", err, w.Body.String())
+	}
+	if len(events) != 1 || events[0].What != "Deployed foo" || events[0].When != 1500000000 || len(events[0].Tags) != 2 {
+		t.Errorf("Expected the event posted, got %s", w.Body.String())
+	}
+
+	// Without events in the db, there are none and they cannot be posted
+	rcache = dsl.NewNamedDSFetcher(&noEventsDb{db.(serde.DataSourceSearcher), db}, nil, 0)
+	w = httptest.NewRecorder()
+	GraphiteAnnotationsHandler(rcache)(w, httptest.NewRequest("GET", "/events/get_data", nil))
+	if w.Code != 200 || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected no events, got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	GraphiteEventsHandler(rcache)(w, httptest.NewRequest("POST", "/events", strings.NewReader(`{"what": "foo"}`)))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected a 501, got %d %s", w.Code, w.Body.String())
+	}
+}
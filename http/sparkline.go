@@ -0,0 +1,175 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/tgres/tgres/dsl"
+)
+
+// Colors are written into the SVG as is, so only allow names and hex.
+var sparklineColor = regexp.MustCompile(`^(#[0-9a-fA-F]{3,8}|[a-zA-Z]+)$`)
+
+// SparklineHandler renders a target as a tiny SVG line with no labels
+// or axes, e.g. for embedding in a web page:
+//
+//   /sparkline?target=foo.bar&from=-1h&width=100&height=20&minmax=true
+//
+// From defaults to DefaultRenderRange ago, width and height (in
+// pixels) to 100 and 20. With minmax=true the lowest and highest
+// points are marked. The color of the line can be set with color (a
+// name or #hex). The target must result in a single series.
+func SparklineHandler(rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.FormValue("target")
+		if target == "" {
+			http.Error(w, "target parameter required", http.StatusBadRequest)
+			return
+		}
+
+		loc, err := requestTimezone(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, err := parseTime(r.FormValue("from"), loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if from == nil {
+			tmp := time.Now().Add(-DefaultRenderRange)
+			from = &tmp
+		}
+		to, err := parseTime(r.FormValue("until"), loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if to == nil {
+			tmp := time.Now()
+			to = &tmp
+		}
+		if !to.After(*from) {
+			http.Error(w, "until must be after from", http.StatusBadRequest)
+			return
+		}
+
+		size := map[string]int{"width": 100, "height": 20}
+		for _, param := range []string{"width", "height"} {
+			if s := r.FormValue(param); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n <= 0 || n > 4096 {
+					http.Error(w, fmt.Sprintf("invalid %s: %q", param, s), http.StatusBadRequest)
+					return
+				}
+				size[param] = n
+			}
+		}
+
+		color := "#000"
+		if s := r.FormValue("color"); s != "" {
+			if !sparklineColor.MatchString(s) {
+				http.Error(w, fmt.Sprintf("invalid color: %q", s), http.StatusBadRequest)
+				return
+			}
+			color = s
+		}
+
+		sm, err := processTarget(rcache, target, from.Unix(), to.Unix(), int64(size["width"]), loc)
+		if err != nil {
+			log.Printf("SparklineHandler() %q: %v", target, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gss := readDataPoints(sm) // must always be called, it closes the series
+		if len(gss) != 1 {
+			http.Error(w, fmt.Sprintf("target must result in a single series, got %d", len(gss)), http.StatusBadRequest)
+			return
+		}
+
+		svg := renderSparkline(gss[0], from.Unix(), to.Unix(), size["width"], size["height"], color, r.FormValue("minmax") == "true")
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(svg)
+	}
+}
+
+func renderSparkline(gs *graphiteSeries, from, to int64, width, height int, color string, minmax bool) []byte {
+	min, max := math.Inf(1), math.Inf(-1)
+	var minDp, maxDp *dataPoint
+	for _, dp := range gs.dps {
+		if math.IsNaN(dp.v) || math.IsInf(dp.v, 0) {
+			continue
+		}
+		if dp.v < min {
+			min, minDp = dp.v, dp
+		}
+		if dp.v > max {
+			max, maxDp = dp.v, dp
+		}
+	}
+
+	// one pixel of padding so that the line is not cut in half by
+	// the edges
+	fw, fh := float64(width), float64(height)
+	x := func(t int64) float64 {
+		return float64(t-from) / float64(to-from) * fw
+	}
+	y := func(v float64) float64 {
+		if max == min {
+			return fh / 2
+		}
+		return 1 + (max-v)/(max-min)*(fh-2)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+
+	// a gap (NaN) starts a new segment of the path
+	var path bytes.Buffer
+	cmd := "M"
+	for _, dp := range gs.dps {
+		if math.IsNaN(dp.v) || math.IsInf(dp.v, 0) {
+			cmd = "M"
+			continue
+		}
+		fmt.Fprintf(&path, "%s%.1f %.1f", cmd, x(dp.t), y(dp.v))
+		cmd = "L"
+	}
+	if path.Len() > 0 {
+		fmt.Fprintf(&buf, `<path d="%s" fill="none" stroke="%s" stroke-width="1"/>`, path.String(), color)
+	}
+
+	if minmax && minDp != nil {
+		for _, m := range []struct {
+			name  string
+			dp    *dataPoint
+			color string
+		}{{"min", minDp, "blue"}, {"max", maxDp, "red"}} {
+			fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="1.5" fill="%s"><title>%s: %v</title></circle>`,
+				x(m.dp.t), y(m.dp.v), m.color, m.name, m.dp.v)
+		}
+	}
+
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
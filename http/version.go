@@ -0,0 +1,67 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/tgres/tgres/dsl"
+	"github.com/tgres/tgres/serde"
+)
+
+// BuildInfo describes this Tgres. Version, GitRevision and BuildTime
+// come from the variables of the main package set by the linker (see
+// the Makefile), they are blank if it was built without them.
+// SchemaVersion is that of the database, read on every request, it is
+// null if it cannot be read, ExpectedSchemaVersion is the one this
+// Tgres expects (they differ if migrations are disabled).
+type BuildInfo struct {
+	Version               string `json:"version"`
+	GitRevision           string `json:"git_revision"`
+	BuildTime             string `json:"build_time"`
+	GoVersion             string `json:"go_version"`
+	SchemaVersion         *int   `json:"schema_version"`
+	ExpectedSchemaVersion int    `json:"expected_schema_version"`
+	Backend               string `json:"backend"`
+}
+
+// VersionHandler returns the BuildInfo as JSON, e.g. to include in a
+// bug report:
+//
+//   curl http://host:8888/version
+//
+// The schema version is read from rcache, if it is a
+// serde.SchemaVersioner.
+func VersionHandler(info BuildInfo, rcache dsl.NamedDSFetcher) http.HandlerFunc {
+	sv, _ := rcache.(serde.SchemaVersioner)
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := info
+		info.SchemaVersion = nil
+		if sv != nil {
+			if v, err := sv.DbSchemaVersion(); err == nil {
+				info.SchemaVersion = &v
+			} else {
+				log.Printf("VersionHandler(): %v", err)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			log.Printf("VersionHandler(): %v", err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tgres/tgres/dsl"
+)
+
+// A fetcher with the schema version of its db.
+type versionedFetcher struct {
+	dsl.NamedDSFetcher
+	version int
+	err     error
+}
+
+func (f *versionedFetcher) DbSchemaVersion() (int, error) { return f.version, f.err }
+
+func Test_VersionHandler(t *testing.T) {
+	_, rcache := testFetcher()
+	info := BuildInfo{Version: "1.2.3", ExpectedSchemaVersion: 3, Backend: "postgres"}
+
+	get := func(rcache dsl.NamedDSFetcher) map[string]interface{} {
+		w := httptest.NewRecorder()
+		VersionHandler(info, rcache)(w, httptest.NewRequest("GET", "/version", nil))
+		var result map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%v: %s", err, w.Body.String())
+		}
+		return result
+	}
+
+	f := &versionedFetcher{NamedDSFetcher: rcache, version: 2}
+	result := get(f)
+	if result["version"] != "1.2.3" || result["expected_schema_version"] != 3.0 || result["schema_version"] != 2.0 {
+		t.Errorf("Expected the schema version of the db and the expected one, got %v", result)
+	}
+
+	// read on every request
+	f.version = 3
+	if result = get(f); result["schema_version"] != 3.0 {
+		t.Errorf("Expected the current schema version, got %v", result["schema_version"])
+	}
+
+	f.err = fmt.Errorf("fake error")
+	if result = get(f); result["schema_version"] != nil || result["expected_schema_version"] != 3.0 {
+		t.Errorf("Expected a null schema_version on error, got %v", result)
+	}
+
+	// the memory db has no schema
+	if result = get(rcache); result["schema_version"] != nil {
+		t.Errorf("Expected a null schema_version without one, got %v", result["schema_version"])
+	}
+	if _, ok := result["schema_version"]; !ok {
+		t.Errorf("Expected schema_version to be present (null), got %v", result)
+	}
+}
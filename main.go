@@ -27,13 +27,14 @@ import (
 	"syscall"
 
 	"github.com/tgres/tgres/daemon"
+	"github.com/tgres/tgres/serde"
 )
 
 var (
 	buildTime, gitRevision string
 )
 
-func parseFlags() (textCfgPath, gracefulProtos, join string, bg bool, version bool) {
+func parseFlags() (textCfgPath, gracefulProtos, join string, bg, version, noMigrate bool) {
 
 	// Parse the flags, if any
 	flag.StringVar(&textCfgPath, "c", "./etc/tgres.conf", "path to config file")
@@ -41,6 +42,7 @@ func parseFlags() (textCfgPath, gracefulProtos, join string, bg bool, version bo
 	flag.StringVar(&gracefulProtos, "graceful", "", "list of fds (DEPRECATED)") // TODO Remove me
 	flag.BoolVar(&bg, "bg", false, "Immediately background itself")
 	flag.BoolVar(&version, "version", false, "Print version and exit")
+	flag.BoolVar(&noMigrate, "no-migrate", false, "Do not create or migrate the database schema (when it is managed externally)")
 	flag.Parse()
 
 	return
@@ -59,7 +61,7 @@ func printVersion() {
 
 func main() {
 
-	textCfgPath, gracefulProtos, join, bg, version := parseFlags() // TODO remove gracefulProtos from this line
+	textCfgPath, gracefulProtos, join, bg, version, noMigrate := parseFlags() // TODO remove gracefulProtos from this line
 	if gp := os.Getenv("TGRES_PROTOS"); gp != "" {
 		gracefulProtos = gp
 	}
@@ -69,6 +71,9 @@ func main() {
 		return
 	}
 
+	serde.PgMigrate = !noMigrate
+	daemon.Version, daemon.BuildTime, daemon.GitRevision = Version, buildTime, gitRevision
+
 	if bg {
 		if !filepath.IsAbs(textCfgPath) {
 			log.Fatalf("ERROR: Background only possible when config path is absolute (cfg path: %q).", textCfgPath)
@@ -96,6 +101,9 @@ func background(cp, join string) {
 	if join != "" {
 		args = append(args, "-join", join)
 	}
+	if !serde.PgMigrate {
+		args = append(args, "-no-migrate")
+	}
 	cmd := exec.Command(mypath, args...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
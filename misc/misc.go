@@ -19,6 +19,7 @@ package misc
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +37,42 @@ func SanitizeName(name string) string {
 	return sanitizeRegexNonAlphaNum.ReplaceAllString(name, "")
 }
 
+// SplitTaggedName splits a Graphite tagged series name such as
+// a.b;dc=east;env=prod into the name (a.b) and the tags (dc and
+// env). Tags without an = are ignored.
+func SplitTaggedName(name string) (string, map[string]string) {
+	parts := strings.Split(name, ";")
+	var tags map[string]string
+	for _, tag := range parts[1:] {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[kv[0]] = kv[1]
+		}
+	}
+	return parts[0], tags
+}
+
+// SanitizeTaggedName is SanitizeName of the name and of every tag
+// key and value of a tagged name, the tags are sorted by key, as
+// Graphite does.
+func SanitizeTaggedName(name string) string {
+	name, tags := SplitTaggedName(name)
+	name = SanitizeName(name)
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if sk, sv := SanitizeName(k), SanitizeName(tags[k]); sk != "" && sv != "" {
+			name += ";" + sk + "=" + sv
+		}
+	}
+	return name
+}
+
 func BetterParseDuration(s string) (time.Duration, error) {
 
 	if strings.HasSuffix(s, "min") {
@@ -61,12 +98,14 @@ func BetterParseDuration(s string) (time.Duration, error) {
 	}
 	if d, err := time.ParseDuration(s); err != nil {
 		if strings.HasPrefix(err.Error(), "time: unknown unit ") {
+			// (newer Go quotes the unit in the error, check s instead)
 			d, _ := strconv.ParseInt(s[0:len(s)-1], 10, 64)
-			if strings.HasPrefix(err.Error(), "time: unknown unit d in") {
+			switch s[len(s)-1] {
+			case 'd':
 				return time.Duration(d*24) * time.Hour, nil
-			} else if strings.HasPrefix(err.Error(), "time: unknown unit w in") {
+			case 'w':
 				return time.Duration(d*168) * time.Hour, nil
-			} else if strings.HasPrefix(err.Error(), "time: unknown unit y in") {
+			case 'y':
 				return time.Duration(d*8760) * time.Hour, nil
 			}
 		}
@@ -51,7 +51,7 @@ var aggWorkerIncomingAggCmds = func(ident string, rcv chan *cluster.Msg, aggCh c
 	}
 }
 
-var aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, dur time.Duration) {
+var aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, dur, align time.Duration) {
 	defer func() { recover() }() // if we're writing to a closed channel below
 	for {
 		// NB: We do not use a time.Ticker here because my simple
@@ -59,7 +59,7 @@ var aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, du
 		// multiple of duration if the system clock is
 		// adjusted. This thing will mostly remain aligned.
 		clock := time.Now()
-		time.Sleep(clock.Truncate(dur).Add(dur).Sub(clock))
+		time.Sleep(nextFlush(clock, dur, align).Sub(clock))
 		if len(flushCh) == 0 {
 			flushCh <- time.Now()
 		} else {
@@ -68,6 +68,23 @@ var aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, du
 	}
 }
 
+// The time of the first flush after now. Flushes happen every dur
+// counting from the last multiple of align, i.e. with dur of 15s and
+// align of 1m at :00, :15, :30 and :45 of every minute, and with dur
+// of 7s the last one of the minute is at :56 followed by :00. Zero
+// align means multiples of dur.
+func nextFlush(now time.Time, dur, align time.Duration) time.Time {
+	if align == 0 {
+		return now.Truncate(dur).Add(dur)
+	}
+	base := now.Truncate(align)
+	next := base.Add((now.Sub(base)/dur + 1) * dur)
+	if end := base.Add(align); next.After(end) {
+		return end
+	}
+	return next
+}
+
 var aggWorkerForwardACToNode = func(ac *aggregator.Command, node *cluster.Node, snd chan *cluster.Msg) error {
 	if ac.Hops == 0 { // we do not forward more than once
 		if node.Ready() {
@@ -96,7 +113,7 @@ var aggWorkerProcessOrForward = func(ac *aggregator.Command, aggDd *distDatumAgg
 	return forwarded
 }
 
-var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clusterer, statFlushDuration time.Duration, statsNamePrefix string, sr statReporter, dpq *Receiver) {
+var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clusterer, statFlushDuration, statFlushAlign time.Duration, statsNamePrefix string, sr statReporter, dpq *Receiver) {
 
 	wc.onEnter()
 	defer wc.onExit()
@@ -112,7 +129,7 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 	}
 
 	flushCh := make(chan time.Time, 1)
-	go aggWorkerPeriodicFlushSignal(wc.ident(), flushCh, statFlushDuration)
+	go aggWorkerPeriodicFlushSignal(wc.ident(), flushCh, statFlushDuration, statFlushAlign)
 
 	log.Printf("%s: started.", wc.ident())
 	wc.onStarted()
@@ -129,19 +146,26 @@ var aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clust
 		})
 	}
 
+	flush := func(now time.Time) {
+		agg.Flush(now)
+		if n := agg.Negatives(); n > 0 {
+			sr.reportStatCount("receiver.aggworker.agg.negatives", float64(n))
+		}
+	}
+
 	for {
 		// It's nice to flush stats at as precise time as
 		// possible. This non-blocking select trick guarantees that we
 		// always process flushCh even if there is stuff in the stCh.
 		select {
 		case now := <-flushCh:
-			agg.Flush(now)
+			flush(now)
 		default:
 		}
 
 		select {
 		case now := <-flushCh:
-			agg.Flush(now)
+			flush(now)
 		case ac, ok := <-aggCh:
 			if !ok {
 				log.Printf("%s: channel closed, performing last flush", wc.ident())
@@ -111,7 +111,7 @@ func Test_aggworkerPeriodicFlushSignal(t *testing.T) {
 		log.SetOutput(os.Stderr) // restore default output
 	}()
 
-	go aggWorkerPeriodicFlushSignal("IDENT", flushCh, 5*time.Millisecond)
+	go aggWorkerPeriodicFlushSignal("IDENT", flushCh, 5*time.Millisecond, 0)
 
 	time.Sleep(15 * time.Millisecond)
 
@@ -137,6 +137,26 @@ func Test_aggworkerPeriodicFlushSignal(t *testing.T) {
 	}
 }
 
+func Test_aggworker_nextFlush(t *testing.T) {
+	minute := time.Unix(1500000000, 0).Truncate(time.Minute)
+	for _, c := range []struct {
+		now        time.Duration // after minute
+		dur, align time.Duration
+		expect     time.Duration
+	}{
+		{3 * time.Second, 10 * time.Second, 0, 10 * time.Second},
+		{10 * time.Second, 10 * time.Second, 0, 20 * time.Second},
+		{16 * time.Second, 15 * time.Second, time.Minute, 30 * time.Second},
+		{50 * time.Second, 7 * time.Second, time.Minute, 56 * time.Second},
+		{57 * time.Second, 7 * time.Second, time.Minute, time.Minute},
+		{time.Minute, 7 * time.Second, time.Minute, time.Minute + 7*time.Second},
+	} {
+		if got := nextFlush(minute.Add(c.now), c.dur, c.align); !got.Equal(minute.Add(c.expect)) {
+			t.Errorf("nextFlush(:%v, %v, %v): expected :%v, got :%v", c.now, c.dur, c.align, c.expect, got.Sub(minute))
+		}
+	}
+}
+
 func Test_aggworkerForwardACToNode(t *testing.T) {
 	ac := aggregator.NewCommand(aggregator.CmdAdd, serde.Ident{"name": "foo"}, 123)
 	md := make([]byte, 20)
@@ -282,7 +302,7 @@ func Test_aggworker_theAggworker(t *testing.T) {
 	}
 
 	apfsCalled := 0
-	aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, dur time.Duration) {
+	aggWorkerPeriodicFlushSignal = func(ident string, flushCh chan time.Time, dur, align time.Duration) {
 		defer func() { recover() }()
 		apfsCalled++
 		for {
@@ -298,7 +318,7 @@ func Test_aggworker_theAggworker(t *testing.T) {
 	}
 
 	wc.startWg.Add(1)
-	go aggWorker(wc, aggCh, clstr, 5*time.Millisecond, "prefix", scr, r)
+	go aggWorker(wc, aggCh, clstr, 5*time.Millisecond, 0, "prefix", scr, r)
 	wc.startWg.Wait()
 
 	time.Sleep(5 * time.Millisecond)
@@ -332,7 +352,7 @@ func Test_aggworker_theAggworker(t *testing.T) {
 	awpofCalled = 0
 
 	wc.startWg.Add(1)
-	go aggWorker(wc, aggCh, nil, 5*time.Millisecond, "prefix", scr, r)
+	go aggWorker(wc, aggCh, nil, 5*time.Millisecond, 0, "prefix", scr, r)
 	wc.startWg.Wait()
 
 	// send some data
@@ -0,0 +1,156 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"math"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+// The most slots recorded for a single data point, the most recent
+// ones, e.g. when a point after a long gap fills it with NaN.
+const auditMaxSlots = 16
+
+// An AuditEntry is a data point as it was processed by a DS with
+// audit enabled (see rrd.DSSpec.Audit) and what became of it.
+type AuditEntry struct {
+	Time      time.Time // of the data point
+	Processed time.Time // when it was processed
+	Hops      int       // > 0 if it was forwarded by another node
+	Raw       float64   // the value as received
+	Value     float64   // after the rounding, if any
+	Err       string    // if the DS rejected it
+	// The DS PDP after the data point
+	PdpValue    float64
+	PdpDuration time.Duration
+	// The RRA slots the data point completed, with their values,
+	// which are NaN if unknown. SlotsOmitted are the older ones
+	// beyond auditMaxSlots.
+	Slots        []AuditSlot
+	SlotsOmitted int
+}
+
+// An AuditSlot is an RRA slot completed by a data point.
+type AuditSlot struct {
+	RRA   int // the index in RRAs()
+	Step  time.Duration
+	Slot  int64 // the index in DPs()
+	End   time.Time
+	Value float64
+}
+
+// Includes tells whether the slot contains t.
+func (s *AuditSlot) Includes(t time.Time) bool {
+	return t.After(s.End.Add(-s.Step)) && !t.After(s.End)
+}
+
+// dsAudit is the ring of the most recent AuditEntry of a DS, it is
+// protected by the mutex of the cachedDs.
+type dsAudit struct {
+	ring []AuditEntry
+	next int64 // total entries added
+}
+
+func newDsAudit(size int) *dsAudit {
+	if size <= 0 {
+		return nil
+	}
+	return &dsAudit{ring: make([]AuditEntry, size)}
+}
+
+func (a *dsAudit) add(e AuditEntry) {
+	a.ring[a.next%int64(len(a.ring))] = e
+	a.next++
+}
+
+// The entries oldest first.
+func (a *dsAudit) entries() []AuditEntry {
+	n := int64(len(a.ring))
+	start := a.next - n
+	if start < 0 {
+		start = 0
+	}
+	result := make([]AuditEntry, 0, a.next-start)
+	for i := start; i < a.next; i++ {
+		result = append(result, a.ring[i%n])
+	}
+	return result
+}
+
+// Records the data point processed by ds, the last update of which
+// was lastUpdate before.
+func (a *dsAudit) record(ds rrd.DataSourcer, dp *incomingDP, value float64, err error, lastUpdate time.Time) {
+	e := AuditEntry{
+		Time:        dp.timeStamp,
+		Processed:   time.Now(),
+		Hops:        dp.Hops,
+		Raw:         dp.value,
+		Value:       value,
+		PdpValue:    ds.Value(),
+		PdpDuration: ds.Duration(),
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+
+	for n, rra := range ds.RRAs() {
+		// The slots ending after the previous last update, most
+		// recent first. (Beyond the size of the RRA they have
+		// wrapped around and been overwritten.)
+		var count int64
+		if d := rra.Latest().Sub(lastUpdate); d > 0 {
+			count = int64((d + rra.Step() - 1) / rra.Step())
+		}
+		if count > rra.Size() {
+			count = rra.Size()
+		}
+		dps := rra.DPs()
+		for k := int64(0); k < count; k++ {
+			if len(e.Slots) >= auditMaxSlots {
+				e.SlotsOmitted += int(count - k)
+				break
+			}
+			end := rra.Latest().Add(-time.Duration(k) * rra.Step())
+			i := rrd.SlotIndex(end, rra.Step(), rra.Size())
+			v, ok := dps[i]
+			if !ok {
+				v = math.NaN()
+			}
+			e.Slots = append(e.Slots, AuditSlot{RRA: n, Step: rra.Step(), Slot: i, End: end, Value: v})
+		}
+	}
+	a.add(e)
+}
+
+// Audit returns the AuditEntry of the data points most recently
+// processed by the DS given by ident, oldest first, up to the audit
+// of its spec (see rrd.DSSpec.Audit). It returns false if the DS is
+// not in the cache of this node or has no audit.
+func (r *Receiver) Audit(ident serde.Ident) ([]AuditEntry, bool) {
+	cds := r.dsc.getByIdent(newCachedIdent(mungeIdent(r.NameMunger, ident)))
+	if cds == nil {
+		return nil, false
+	}
+	cds.mu.Lock()
+	defer cds.mu.Unlock()
+	if cds.audit == nil {
+		return nil, false
+	}
+	return cds.audit.entries(), true
+}
@@ -0,0 +1,141 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_dsAudit(t *testing.T) {
+	if newDsAudit(0) != nil {
+		t.Errorf("Expected no audit")
+	}
+	a := newDsAudit(3)
+	if len(a.entries()) != 0 {
+		t.Errorf("Expected no entries")
+	}
+	for i := 1; i <= 5; i++ {
+		a.add(AuditEntry{Value: float64(i)})
+		exp := i
+		if exp > 3 {
+			exp = 3
+		}
+		entries := a.entries()
+		if len(entries) != exp || entries[len(entries)-1].Value != float64(i) || entries[0].Value != float64(i-exp+1) {
+			t.Errorf("%d: unexpected entries %v", i, entries)
+		}
+	}
+}
+
+func Test_Receiver_Audit(t *testing.T) {
+	db := &fakeSerde{}
+	spec := rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour}},
+		Round:     &rrd.Rounding{Digits: 1},
+		Audit:     4,
+	}
+	r := &Receiver{dsc: newDsCache(db, &SimpleDSFinder{&spec}, nil)}
+
+	foo, bar := serde.Ident{"name": "foo"}, serde.Ident{"name": "bar"}
+	db.returnDss = []rrd.DataSourcer{serde.NewDbDataSource(1, foo, 0, 0, rrd.NewDataSource(spec))}
+	if err := r.dsc.preLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Audit(bar); ok {
+		t.Errorf("Expected no audit of a DS not in the cache")
+	}
+
+	cds := r.dsc.getByIdent(newCachedIdent(foo))
+	for _, dp := range []struct {
+		ts int64
+		v  float64
+	}{
+		{1000, 1}, // the first data point only sets the last update
+		{1010, 2.04},
+		{1015, 3},
+		{1040, 4},
+		{1050, math.Inf(1)},
+	} {
+		cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(foo), timeStamp: time.Unix(dp.ts, 0), value: dp.v})
+	}
+	cds.lastProcess = time.Time{}
+	cds.processIncoming()
+
+	entries, ok := r.Audit(foo)
+	if !ok || len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %v", entries)
+	}
+	if e := entries[0]; e.Raw != 2.04 || e.Value != 2 || len(e.Slots) != 1 || e.Slots[0].Value != 2 || !e.Slots[0].End.Equal(time.Unix(1010, 0)) {
+		t.Errorf("Unexpected entry for 1010: %+v", e)
+	}
+	if e := entries[1]; len(e.Slots) != 0 || e.PdpValue != 3 || e.PdpDuration != 5*time.Second {
+		t.Errorf("Unexpected entry for 1015: %+v", e)
+	}
+	e := entries[2]
+	if len(e.Slots) != 3 {
+		t.Fatalf("Expected 3 slots for 1040, got %+v", e.Slots)
+	}
+	for n, exp := range []struct {
+		end int64
+		v   float64
+	}{{1040, 4}, {1030, 4}, {1020, 3.5}} {
+		if s := e.Slots[n]; !s.End.Equal(time.Unix(exp.end, 0)) || s.Value != exp.v || s.Slot != rrd.SlotIndex(s.End, s.Step, 360) {
+			t.Errorf("Unexpected slot %d: %+v", n, s)
+		}
+	}
+	if !e.Slots[2].Includes(time.Unix(1015, 0)) || e.Slots[2].Includes(time.Unix(1010, 0)) {
+		t.Errorf("Unexpected Includes()")
+	}
+	if e := entries[3]; e.Err == "" || len(e.Slots) != 0 {
+		t.Errorf("Expected the error of the Inf, got %+v", e)
+	}
+
+	// Without audit in the spec
+	spec.Audit = 0
+	r = &Receiver{dsc: newDsCache(db, &SimpleDSFinder{&spec}, nil)}
+	if err := r.dsc.preLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Audit(foo); ok {
+		t.Errorf("Expected no audit")
+	}
+}
+
+func Test_dsAudit_slotsOmitted(t *testing.T) {
+	spec := rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: 24 * time.Hour,
+		RRAs:      []rrd.RRASpec{{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour}},
+	}
+	ds := rrd.NewDataSource(spec)
+	a := newDsAudit(1)
+	for _, ts := range []int64{1000, 1010, 1010 + 1000*10} {
+		dp := &incomingDP{timeStamp: time.Unix(ts, 0), value: 1}
+		lastUpdate := ds.LastUpdate()
+		a.record(ds, dp, dp.value, ds.ProcessDataPoint(dp.value, dp.timeStamp), lastUpdate)
+	}
+	// 1000 steps, but the RRA only has 360 slots
+	if e := a.entries()[0]; len(e.Slots) != auditMaxSlots || e.SlotsOmitted != 360-auditMaxSlots {
+		t.Errorf("Unexpected %d slots, %d omitted", len(e.Slots), e.SlotsOmitted)
+	}
+}
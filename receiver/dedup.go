@@ -0,0 +1,77 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import "time"
+
+// dpDedup remembers the data points received in the last window, by
+// DS and timestamp, so that an exact duplicate (same DS, timestamp
+// and value, as some agents resend) can be dropped before it goes
+// through the DS again. It holds at most max points, evicting the
+// oldest. It is only used by the director and is not safe for
+// concurrent use.
+type dpDedup struct {
+	window time.Duration
+	seen   map[dedupKey]dedupEntry
+	ring   []dedupKey // in the order seen, for eviction
+	next   int        // in ring
+}
+
+type dedupKey struct {
+	ident string
+	ts    int64
+}
+
+type dedupEntry struct {
+	value float64
+	at    time.Time
+}
+
+// Returns nil (no deduplication) if window is not positive.
+func newDpDedup(window time.Duration, max int) *dpDedup {
+	if window <= 0 || max <= 0 {
+		return nil
+	}
+	return &dpDedup{
+		window: window,
+		seen:   make(map[dedupKey]dedupEntry),
+		ring:   make([]dedupKey, 0, max),
+	}
+}
+
+// duplicate tells whether dp is the same as one received less than
+// the window before now, otherwise it remembers it.
+func (d *dpDedup) duplicate(dp *incomingDP, now time.Time) bool {
+	key := dedupKey{dp.cachedIdent.String(), dp.timeStamp.UnixNano()}
+	if e, ok := d.seen[key]; ok {
+		if e.value == dp.value && now.Sub(e.at) < d.window {
+			return true
+		}
+		// A new value (or too late), it is remembered from now on
+		d.seen[key] = dedupEntry{dp.value, now}
+		return false
+	}
+
+	if len(d.ring) < cap(d.ring) {
+		d.ring = append(d.ring, key)
+	} else {
+		delete(d.seen, d.ring[d.next])
+		d.ring[d.next] = key
+		d.next = (d.next + 1) % len(d.ring)
+	}
+	d.seen[key] = dedupEntry{dp.value, now}
+	return false
+}
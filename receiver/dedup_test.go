@@ -0,0 +1,58 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_dpDedup(t *testing.T) {
+	if newDpDedup(0, 10) != nil {
+		t.Errorf("Expected no dedup without a window")
+	}
+
+	d := newDpDedup(time.Minute, 2)
+	now := time.Unix(1500000000, 0)
+	foo, bar := newCachedIdent(serde.Ident{"name": "foo"}), newCachedIdent(serde.Ident{"name": "bar"})
+	dp := func(ident *cachedIdent, ts int64, v float64) *incomingDP {
+		return &incomingDP{cachedIdent: ident, timeStamp: time.Unix(ts, 0), value: v}
+	}
+
+	for n, c := range []struct {
+		dp     *incomingDP
+		at     time.Duration
+		expect bool
+	}{
+		{dp(foo, 100, 1), 0, false},
+		{dp(foo, 100, 1), time.Second, true},      // resent
+		{dp(bar, 100, 1), time.Second, false},     // another DS
+		{dp(foo, 100, 2), 2 * time.Second, false}, // another value
+		{dp(foo, 100, 2), 3 * time.Second, true},  // which is remembered
+		{dp(foo, 100, 2), 2 * time.Minute, false}, // beyond the window
+		{dp(foo, 200, 1), 2 * time.Minute, false}, // full, foo 100 is evicted
+		{dp(foo, 100, 2), 2 * time.Minute, false},
+	} {
+		if got := d.duplicate(c.dp, now.Add(c.at)); got != c.expect {
+			t.Errorf("%d: expected %v, got %v", n, c.expect, got)
+		}
+	}
+	if len(d.seen) != 2 || len(d.ring) != 2 {
+		t.Errorf("Expected at most 2 points remembered, got %d (ring %d)", len(d.seen), len(d.ring))
+	}
+}
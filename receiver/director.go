@@ -77,12 +77,21 @@ var directorProcessDataPoint = func(cds *cachedDs, dsf dsFlusherBlocking) (int,
 	cds.mu.Lock()
 	// Flush only if there are points. Note that cnt is an accepted
 	// datapoint, it can still result in ds.PointCount() of 0, but
-	// lastupdate/value/dur of the DS may have changed.
-	if (cnt > 0 || cds.PointCount() > 0) && cds.lastFlush.Before(time.Now().Add(-cds.Step())) {
+	// lastupdate/value/dur of the DS may have changed. A
+	// write-through DS is flushed every time, and written through to
+	// the database before the next point is processed.
+	writeThrough := cds.writeThrough && cnt > 0
+	if (cnt > 0 || cds.PointCount() > 0) && (writeThrough || cds.lastFlush.Before(time.Now().Add(-cds.Step()))) {
 		dsf.flushToVCache(cds.DbDataSourcer)
 		cds.lastFlush = time.Now()
 	}
 	cds.mu.Unlock()
+
+	if fs, ok := dsf.(dsFlusherSync); ok && writeThrough {
+		if err := fs.flushDs(cds.DbDataSourcer); err != nil {
+			log.Printf("directorProcessDataPoint [%v] write-through error: %v", cds.Ident(), err)
+		}
+	}
 	return cnt, blk
 }
 
@@ -135,6 +144,11 @@ var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan
 		return
 	}
 
+	if cds.rejected != "" {
+		directorRejectName(dsc, cds, 1, stats)
+		return
+	}
+
 	cds.appendIncoming(dp)
 
 	if cds.Id() == 0 { // this DS needs to be loaded.
@@ -147,6 +161,20 @@ var directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan
 	}
 }
 
+// The loader rejected the name of a new DS (see
+// dsCache.fetchOrCreateByIdent), its n data points are discarded. The
+// cds stays in the cache so that further points are rejected without
+// asking the database again.
+func directorRejectName(dsc *dsCache, cds *cachedDs, n int, stats *dpStats) {
+	switch cds.rejected {
+	case "length":
+		stats.rejectedLength += n
+	case "chars":
+		stats.rejectedChars += n
+	}
+	dsc.names.reject(cds.Ident()["name"], cds.rejected, time.Now())
+}
+
 func reportOverrunQueueSize(queue *fifoQueue, sr statReporter, nap time.Duration) {
 	for {
 		time.Sleep(nap) // TODO this should be a ticker really
@@ -200,12 +228,44 @@ var loader = func(loaderCh chan interface{}, dpCh chan<- interface{}, dsc *dsCac
 
 type dpStats struct {
 	total, forwarded, unknown, dropped int
+	backlogged                         int // dropped because of the flush backlog
+	future, futureDropped              int // timestamped in the future, dropped because of max skew
+	deduped                            int // exact duplicates, see dpDedup
+	rejectedLength, rejectedChars      int // the name of a new DS rejected by the NameValidator
 	forwarded_to                       map[string]int
 	last                               time.Time
+
+	// now - timestamp of incoming points, in seconds, negative
+	// means in the future.
+	skewN                     int
+	skewSum, skewMin, skewMax float64
+}
+
+// Record the difference between now and the timestamp of a data
+// point and return it.
+func (s *dpStats) clockSkew(now, ts time.Time) time.Duration {
+	if ts.IsZero() {
+		return 0
+	}
+	skew := now.Sub(ts)
+	secs := skew.Seconds()
+	if s.skewN == 0 || secs < s.skewMin {
+		s.skewMin = secs
+	}
+	if s.skewN == 0 || secs > s.skewMax {
+		s.skewMax = secs
+	}
+	s.skewN++
+	s.skewSum += secs
+	if skew < 0 {
+		s.future++
+	}
+	return skew
 }
 
 var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan interface{}, nWorkers int, clstr clusterer,
-	sr statReporter, dsc *dsCache, dsf dsFlusherBlocking, queue *fifoQueue, maxQLen int, maxMem uint64) {
+	sr statReporter, dsc *dsCache, dsf dsFlusherBlocking, queue *fifoQueue, maxQLen int, maxMem uint64, maxBacklog int, maxFuture time.Duration,
+	dedup *dpDedup) {
 	wc.onEnter()
 	defer wc.onExit()
 
@@ -244,6 +304,7 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 
 	var currentMemory uint64 = runtimeMemory()
 	var memoryChecked time.Time = time.Now()
+	var overBacklog bool // for logging only when it changes
 
 	stats := dpStats{forwarded_to: make(map[string]int), last: time.Now()}
 
@@ -283,15 +344,37 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 
 		if dp != nil {
 			stats.total++
+			skew := stats.clockSkew(time.Now(), dp.timeStamp)
 
 			if maxMem > 0 && memoryChecked.Before(time.Now().Add(-100*time.Millisecond)) {
 				currentMemory = runtimeMemory()
 				memoryChecked = time.Now()
 			}
 
+			backlog := 0
+			if maxBacklog > 0 && dsf != nil {
+				backlog = dsf.backlog()
+				if over := backlog > maxBacklog; over != overBacklog {
+					if over {
+						log.Printf("director: flush backlog (%d points) exceeds max-flush-backlog (%d), dropping data points.", backlog, maxBacklog)
+					} else {
+						log.Printf("director: flush backlog (%d points) is back under max-flush-backlog (%d).", backlog, maxBacklog)
+					}
+					overBacklog = over
+				}
+			}
+
 			if (maxMem > 0 && currentMemory > maxMem) || (queue != nil && maxQLen > 0 && queue.size() > maxQLen) {
 				stats.dropped++
 				// this data poind goes to /dev/null
+			} else if maxBacklog > 0 && backlog > maxBacklog {
+				stats.dropped++
+				stats.backlogged++
+			} else if maxFuture > 0 && -skew > maxFuture {
+				stats.dropped++
+				stats.futureDropped++
+			} else if dedup != nil && dedup.duplicate(dp, time.Now()) {
+				stats.deduped++
 			} else {
 				// if the dp ident is not found, it will be submitted to
 				// the loader, which will return it to us through the dpCh
@@ -300,7 +383,15 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 			}
 		} else if cds != nil {
 			// this came from the loader, we do not need to look it up
-			directorProcessOrForward(dsc, cds, workerCh, clstr, snd, &stats)
+			if cds.rejected != "" {
+				cds.mu.Lock()
+				n := len(cds.incoming)
+				cds.incoming = nil
+				cds.mu.Unlock()
+				directorRejectName(dsc, cds, n, &stats)
+			} else {
+				directorProcessOrForward(dsc, cds, workerCh, clstr, snd, &stats)
+			}
 		} else {
 			// wait for worker and loader channels to empty
 			log.Printf("director: channel closed, waiting for loader and workers to empty...")
@@ -328,8 +419,21 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 		if stats.last.Before(time.Now().Add(-time.Second)) {
 			sr.reportStatCount("receiver.datapoints.total", float64(stats.total))
 			sr.reportStatCount("receiver.datapoints.dropped", float64(stats.dropped)) // this too might be dropped...
+			sr.reportStatCount("receiver.datapoints.dropped_backlog", float64(stats.backlogged))
 			sr.reportStatCount("receiver.datapoints.unknown", float64(stats.unknown))
 			sr.reportStatCount("receiver.datapoints.forwarded", float64(stats.forwarded))
+			sr.reportStatCount("receiver.datapoints.future", float64(stats.future))
+			sr.reportStatCount("receiver.datapoints.dropped_future", float64(stats.futureDropped))
+			if dedup != nil {
+				sr.reportStatCount("receiver.datapoints.deduped", float64(stats.deduped))
+			}
+			sr.reportStatCount("receiver.datapoints.rejected_name_length", float64(stats.rejectedLength))
+			sr.reportStatCount("receiver.datapoints.rejected_name_chars", float64(stats.rejectedChars))
+			if stats.skewN > 0 {
+				sr.reportStatGauge("receiver.clock_skew.min", stats.skewMin)
+				sr.reportStatGauge("receiver.clock_skew.max", stats.skewMax)
+				sr.reportStatGauge("receiver.clock_skew.mean", stats.skewSum/float64(stats.skewN))
+			}
 			for dest, cnt := range stats.forwarded_to {
 				sr.reportStatCount(fmt.Sprintf("receiver.forwarded_to.%s", dest), float64(cnt))
 			}
@@ -339,6 +443,9 @@ var director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan in
 			st := dsc.stats()
 			sr.reportStatGauge("receiver.cache.ds_count", float64(st.dsCount))
 			sr.reportStatGauge("receiver.cache.rra_count", float64(st.rraCount))
+			if dsf != nil {
+				sr.reportStatGauge("receiver.flush_backlog", float64(dsf.backlog()))
+			}
 		}
 	}
 }
@@ -22,6 +22,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -325,6 +326,23 @@ func Test_directorProcessIncomingDP(t *testing.T) {
 		t.Errorf("directorProcessIncomingDP: With a blank name, directorProcessOrForward should not be called")
 	}
 
+	// A new name goes to the loader regardless of the NameValidator,
+	// which only checks it when the DS is about to be created. Once
+	// rejected, further points are counted and discarded.
+	dsc.names, _ = NewNameValidator(5, "a-z", false)
+	dp.cachedIdent = newCachedIdent(serde.Ident{"name": "toolong"})
+	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, nil, st)
+	cds := dsc.getByIdent(dp.cachedIdent)
+	if cds == nil || !cds.sentToLoader || st.rejectedLength != 0 {
+		t.Fatalf("directorProcessIncomingDP: a new name should be sent to the loader unchecked, rejected: %d", st.rejectedLength)
+	}
+	cds.rejected = "length" // as the loader would
+	directorProcessIncomingDP(dp, dsc, loaderCh, workerCh, clstr, nil, st)
+	if st.rejectedLength != 1 || len(cds.incoming) != 1 {
+		t.Errorf("directorProcessIncomingDP: a rejected name should be counted and neither loaded nor kept")
+	}
+	dsc.names = nil
+
 	// fake a db error
 	dp.cachedIdent = newCachedIdent(serde.Ident{"name": "blah"})
 	db.fakeErr = true
@@ -375,7 +393,7 @@ func Test_the_director(t *testing.T) {
 	dsc := newDsCache(db, df, dsf)
 
 	wc.startWg.Add(1)
-	go director(wc, dpCh, dpCh, 1, clstr, sr, dsc, nil, nil, 0, 0)
+	go director(wc, dpCh, dpCh, 1, clstr, sr, dsc, nil, nil, 0, 0, 0, 0, nil)
 	wc.startWg.Wait()
 
 	if clstr.nReady == 0 {
@@ -438,7 +456,7 @@ func Test_the_director(t *testing.T) {
 	dpCh <- dp
 
 	wc.startWg.Add(1)
-	go director(wc, dpCh, dpCh, 1, clstr, sr, dsc, nil, nil, 0, 0)
+	go director(wc, dpCh, dpCh, 1, clstr, sr, dsc, nil, nil, 0, 0, 0, 0, nil)
 	wc.startWg.Wait()
 
 	time.Sleep(100 * time.Millisecond)
@@ -449,6 +467,248 @@ func Test_the_director(t *testing.T) {
 	directorProcessIncomingDP = saveFn2
 }
 
+func Test_director_flushBacklog(t *testing.T) {
+
+	saveFn1 := directorIncomingDPMessages
+	saveFn2 := directorProcessIncomingDP
+	directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan<- interface{}) {}
+	dpidpCalled := 0
+	directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+		dpidpCalled++
+	}
+	defer func() {
+		directorIncomingDPMessages = saveFn1
+		directorProcessIncomingDP = saveFn2
+	}()
+
+	log.SetOutput(&fakeLogger{})
+	defer func() {
+		// restore default output
+		log.SetOutput(os.Stderr)
+	}()
+
+	db := &fakeSerde{}
+	sr := &fakeSr{}
+	dsc := newDsCache(db, &SimpleDSFinder{DftDSSPec}, &dsFlusher{db: db.Flusher(), sr: sr})
+	dp := &incomingDP{cachedIdent: newCachedIdent(serde.Ident{"name": "foo"}), timeStamp: time.Unix(1000, 0), value: 123}
+
+	for _, c := range []struct {
+		backlog, max, expect int
+	}{
+		{10, 5, 0}, // over the limit, everything is dropped
+		{5, 5, 3},  // at the limit is fine
+		{10, 0, 3}, // unlimited
+	} {
+		dpidpCalled = 0
+		wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "FOO"}
+		dpCh := make(chan interface{})
+		dsf := &fakeDsFlusher{sr: sr, bl: c.backlog}
+
+		wc.startWg.Add(1)
+		go director(wc, dpCh, dpCh, 1, nil, sr, dsc, dsf, nil, 0, 0, c.max, 0, nil)
+		wc.startWg.Wait()
+
+		dpCh <- dp
+		dpCh <- dp
+		dpCh <- dp
+		close(dpCh)
+		wc.wg.Wait()
+
+		if dpidpCalled != c.expect {
+			t.Errorf("director: backlog %d max %d: expected %d points processed, got %d", c.backlog, c.max, c.expect, dpidpCalled)
+		}
+	}
+
+}
+
+func Test_director_maxFutureSkew(t *testing.T) {
+
+	saveFn1 := directorIncomingDPMessages
+	saveFn2 := directorProcessIncomingDP
+	directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan<- interface{}) {}
+	dpidpCalled := 0
+	directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+		dpidpCalled++
+	}
+	defer func() {
+		directorIncomingDPMessages = saveFn1
+		directorProcessIncomingDP = saveFn2
+	}()
+
+	log.SetOutput(&fakeLogger{})
+	defer func() {
+		// restore default output
+		log.SetOutput(os.Stderr)
+	}()
+
+	db := &fakeSerde{}
+	sr := &fakeSr{}
+	dsc := newDsCache(db, &SimpleDSFinder{DftDSSPec}, &dsFlusher{db: db.Flusher(), sr: sr})
+	ident := newCachedIdent(serde.Ident{"name": "foo"})
+
+	for _, c := range []struct {
+		maxFuture time.Duration
+		expect    int
+	}{
+		{time.Minute, 2}, // the one an hour ahead is dropped
+		{0, 3},           // unlimited
+	} {
+		dpidpCalled = 0
+		wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "FOO"}
+		dpCh := make(chan interface{})
+
+		wc.startWg.Add(1)
+		go director(wc, dpCh, dpCh, 1, nil, sr, dsc, nil, nil, 0, 0, 0, c.maxFuture, nil)
+		wc.startWg.Wait()
+
+		now := time.Now()
+		dpCh <- &incomingDP{cachedIdent: ident, timeStamp: now.Add(-time.Minute), value: 1}
+		dpCh <- &incomingDP{cachedIdent: ident, timeStamp: now.Add(time.Second), value: 1}
+		dpCh <- &incomingDP{cachedIdent: ident, timeStamp: now.Add(time.Hour), value: 1}
+		close(dpCh)
+		wc.wg.Wait()
+
+		if dpidpCalled != c.expect {
+			t.Errorf("director: max future skew %v: expected %d points processed, got %d", c.maxFuture, c.expect, dpidpCalled)
+		}
+	}
+}
+
+func Test_director_dedup(t *testing.T) {
+
+	saveFn1 := directorIncomingDPMessages
+	saveFn2 := directorProcessIncomingDP
+	directorIncomingDPMessages = func(rcv chan *cluster.Msg, dpCh chan<- interface{}) {}
+	dpidpCalled := 0
+	directorProcessIncomingDP = func(dp *incomingDP, dsc *dsCache, loaderCh chan interface{}, workerCh chan *cachedDs, clstr clusterer, snd chan *cluster.Msg, stats *dpStats) {
+		dpidpCalled++
+	}
+	defer func() {
+		directorIncomingDPMessages = saveFn1
+		directorProcessIncomingDP = saveFn2
+	}()
+
+	log.SetOutput(&fakeLogger{})
+	defer func() {
+		// restore default output
+		log.SetOutput(os.Stderr)
+	}()
+
+	db := &fakeSerde{}
+	sr := &fakeSr{}
+	dsc := newDsCache(db, &SimpleDSFinder{DftDSSPec}, &dsFlusher{db: db.Flusher(), sr: sr})
+	ident := newCachedIdent(serde.Ident{"name": "foo"})
+
+	wc := &wrkCtl{wg: &sync.WaitGroup{}, startWg: &sync.WaitGroup{}, id: "FOO"}
+	dpCh := make(chan interface{})
+
+	wc.startWg.Add(1)
+	go director(wc, dpCh, dpCh, 1, nil, sr, dsc, nil, nil, 0, 0, 0, 0, newDpDedup(time.Minute, 10))
+	wc.startWg.Wait()
+
+	ts := time.Now().Truncate(time.Second)
+	dpCh <- &incomingDP{cachedIdent: ident, timeStamp: ts, value: 1}
+	dpCh <- &incomingDP{cachedIdent: ident, timeStamp: ts, value: 1}
+	dpCh <- &incomingDP{cachedIdent: ident, timeStamp: ts.Add(time.Second), value: 1}
+	close(dpCh)
+	wc.wg.Wait()
+
+	if dpidpCalled != 2 {
+		t.Errorf("director: expected the duplicate dropped and 2 points processed, got %d", dpidpCalled)
+	}
+}
+
+func Test_directorProcessDataPoint_writeThrough(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	spec := rrd.DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour, Latest: start},
+		},
+	}
+	ds := rrd.NewDataSource(spec)
+	bds := &benchDs{DataSourcer: ds, rras: []rrd.RoundRobinArchiver{&benchRRA{ds.RRAs()[0], 0, 3}}}
+	ident := serde.Ident{"name": "foo"}
+	// Neither processed (lastProcess) nor flushed (lastFlush) yet
+	// without write-through
+	cds := &cachedDs{
+		DbDataSourcer: serde.NewDbDataSource(7, ident, 0, 3, bds),
+		mu:            &sync.Mutex{},
+		lastProcess:   time.Now(),
+		lastFlush:     time.Now(),
+	}
+
+	db := &slowFlusher{}
+	dsf := &dsFlusher{db: db, sr: &fakeSr{}}
+	var flusherWg, startWg sync.WaitGroup
+	dsf.start(&flusherWg, &startWg, time.Hour, 2)
+	startWg.Wait()
+
+	cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: start.Add(10 * time.Second), value: 1})
+	if cnt, _ := directorProcessDataPoint(cds, dsf); cnt != 0 || atomic.LoadInt64(&db.flushed) != 0 {
+		t.Errorf("Expected nothing processed or flushed yet, got %d, %d", cnt, atomic.LoadInt64(&db.flushed))
+	}
+
+	cds.writeThrough = true
+	cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: start.Add(20 * time.Second), value: 2})
+	if cnt, _ := directorProcessDataPoint(cds, dsf); cnt != 2 {
+		t.Errorf("Expected 2 points processed, got %d", cnt)
+	}
+	// a row of data points per slot, the RRA state and the DS state,
+	// all written by the time directorProcessDataPoint returns
+	if n := atomic.LoadInt64(&db.flushed); n != 2+2 {
+		t.Errorf("Expected 4 flushes done, got %d", n)
+	}
+
+	close(dsf.dbCh)
+	flusherWg.Wait()
+}
+
+func Test_dpStats_clockSkew(t *testing.T) {
+	var stats dpStats
+	now := time.Unix(1000, 0)
+	for _, ts := range []time.Time{now.Add(-10 * time.Second), now.Add(20 * time.Second), now, time.Time{}} {
+		stats.clockSkew(now, ts)
+	}
+	if stats.skewN != 3 {
+		t.Errorf("Expected 3 samples (zero time ignored), got %d", stats.skewN)
+	}
+	if stats.skewMin != -20 || stats.skewMax != 10 {
+		t.Errorf("Expected min -20, max 10, got %v, %v", stats.skewMin, stats.skewMax)
+	}
+	if mean := stats.skewSum / float64(stats.skewN); mean != -10.0/3 {
+		t.Errorf("Expected mean %v, got %v", -10.0/3, mean)
+	}
+	if stats.future != 1 {
+		t.Errorf("Expected 1 point in the future, got %d", stats.future)
+	}
+}
+
+func Test_vcache_backlog(t *testing.T) {
+	vc := &verticalCache{
+		Mutex:   &sync.Mutex{},
+		dps:     make(map[bundleKey]*verticalCacheSegment),
+		dss:     make(map[int64]*dsStateSegment),
+		minStep: time.Hour, // nothing is old enough to be flushed
+	}
+	vc.dps[bundleKey{1, 0}] = &verticalCacheSegment{
+		Mutex:       &sync.Mutex{},
+		rows:        map[int64]crossRRAPoints{0: {0: 1, 1: 2}, 1: {0: 3}},
+		latests:     make(map[int64]time.Time),
+		value:       make(map[int64]float64),
+		duration:    make(map[int64]int64),
+		lastFlushRT: time.Now(),
+	}
+
+	if vc.backlog() != 0 {
+		t.Errorf("backlog should be 0 before the first flush")
+	}
+	vc.flush(make(chan *vDpFlushRequest, 1), false)
+	if vc.backlog() != 3 {
+		t.Errorf("backlog should be 3, got %d", vc.backlog())
+	}
+}
+
 func Test_director_fifoQueue(t *testing.T) {
 	queue := &fifoQueue{}
 	dp := &incomingDP{}
@@ -464,3 +724,122 @@ func Test_director_fifoQueue(t *testing.T) {
 		t.Errorf("queue: size != 1")
 	}
 }
+
+const benchWidth = 200
+
+// A DbRoundRobinArchiver for benchmarks, serde only makes them
+// from the database.
+type benchRRA struct {
+	rrd.RoundRobinArchiver
+	seg, idx int64
+}
+
+func (r *benchRRA) Id() int64                { return r.seg*benchWidth + r.idx }
+func (r *benchRRA) Width() int64             { return benchWidth }
+func (r *benchRRA) SlotRow(slot int64) int64 { return slot / benchWidth }
+func (r *benchRRA) Seg() int64               { return r.seg }
+func (r *benchRRA) Idx() int64               { return r.idx }
+func (r *benchRRA) BundleId() int64          { return 1 }
+
+type benchDs struct {
+	rrd.DataSourcer
+	rras []rrd.RoundRobinArchiver
+}
+
+func (ds *benchDs) RRAs() []rrd.RoundRobinArchiver { return ds.rras }
+
+func (ds *benchDs) Copy() rrd.DataSourcer {
+	result := &benchDs{DataSourcer: ds.DataSourcer.Copy()}
+	for n, rra := range result.DataSourcer.RRAs() {
+		r := ds.rras[n].(*benchRRA)
+		result.rras = append(result.rras, &benchRRA{rra, r.seg, r.idx})
+	}
+	return result
+}
+
+// flushToVCache() needs a serde.Flusher, which is never called.
+type benchFlusher struct{}
+
+func (*benchFlusher) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return 0, nil
+}
+func (*benchFlusher) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error) {
+	return 0, nil
+}
+func (*benchFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return 0, nil
+}
+
+// How the number of workers processing the same data points affects
+// the throughput. Every DS is only processed by one worker at a time,
+// but they all share the vertical cache (and its segments), e.g.:
+//
+//   go test -run none -bench Benchmark_workers -cpu 4 ./receiver
+func Benchmark_workers(b *testing.B) {
+	const nDss = 1000
+	start := time.Unix(1500000000, 0)
+	spec := rrd.DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour, Latest: start},
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: 24 * time.Hour, Latest: start},
+		},
+	}
+
+	for _, nWorkers := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("workers=%d", nWorkers), func(b *testing.B) {
+			dsf := &dsFlusher{db: &benchFlusher{}, sr: &fakeSr{}}
+			dsf.vcache = &verticalCache{
+				Mutex:   &sync.Mutex{},
+				dps:     make(map[bundleKey]*verticalCacheSegment),
+				dss:     make(map[int64]*dsStateSegment),
+				minStep: time.Hour,
+			}
+
+			cdss := make([]*cachedDs, nDss)
+			for n := range cdss {
+				seg, idx := int64(n)/benchWidth, int64(n)%benchWidth
+				ds := rrd.NewDataSource(spec)
+				bds := &benchDs{DataSourcer: ds}
+				for _, rra := range ds.RRAs() {
+					bds.rras = append(bds.rras, &benchRRA{rra, seg, idx})
+				}
+				cdss[n] = &cachedDs{
+					DbDataSourcer: serde.NewDbDataSource(int64(n), serde.Ident{"name": fmt.Sprintf("foo.%d", n)}, seg, idx, bds),
+					mu:            &sync.Mutex{},
+				}
+			}
+
+			type work struct {
+				cds *cachedDs
+				t   time.Time
+			}
+			workCh := make(chan work, 128)
+			var wg sync.WaitGroup
+			for i := 0; i < nWorkers; i++ {
+				go func() {
+					for w := range workCh {
+						// what directorProcessDataPoint() does, minus the timing
+						w.cds.mu.Lock()
+						w.cds.ProcessDataPoint(1, w.t)
+						dsf.flushToVCache(w.cds.DbDataSourcer)
+						w.cds.mu.Unlock()
+						wg.Done()
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				t := start.Add(time.Duration(i+1) * spec.Step)
+				wg.Add(nDss)
+				for _, cds := range cdss {
+					workCh <- work{cds, t}
+				}
+				wg.Wait()
+			}
+			b.StopTimer()
+			close(workCh)
+		})
+	}
+}
@@ -36,6 +36,9 @@ type dsCache struct {
 	finder   MatchingDSSpecFinder
 	clstr    clusterer
 	rraCount int
+	created  []func(serde.Ident) // called when a DS is loaded or created
+	names    *NameValidator      // nil accepts any name
+	events   *dsEvents           // of DSs created and deleted
 }
 
 // Returns a new dsCache object.
@@ -46,6 +49,7 @@ func newDsCache(db serde.Fetcher, finder MatchingDSSpecFinder, dsf dsFlusherBloc
 		db:      db,
 		finder:  finder,
 		dsf:     dsf,
+		events:  newDsEvents(dsEventsSize),
 	}
 }
 
@@ -68,7 +72,8 @@ func (d *dsCache) insert(cds *cachedDs) {
 	d.byIdent[cds.Ident().String()] = cds
 }
 
-// Delete a DS
+// Delete a DS from the cache, e.g. when it is handed off to another
+// node, it is not an event.
 func (d *dsCache) delete(ident serde.Ident) {
 	d.Lock()
 	defer d.Unlock()
@@ -79,6 +84,13 @@ func (d *dsCache) delete(ident serde.Ident) {
 	}
 }
 
+// Delete a DS which was deleted from the database, which is a
+// "deleted" event.
+func (d *dsCache) deleted(ident serde.Ident) {
+	d.delete(ident)
+	d.events.add("deleted", ident)
+}
+
 func (d *dsCache) preLoad() error {
 	dss, err := d.db.FetchDataSources()
 	if err != nil {
@@ -90,7 +102,17 @@ func (d *dsCache) preLoad() error {
 		if !ok {
 			return fmt.Errorf("preLoad: ds must be a serde.DbDataSourcer")
 		}
-		d.insert(&cachedDs{DbDataSourcer: dbds, mu: &sync.Mutex{}, lastProcess: time.Now()})
+		cds := &cachedDs{DbDataSourcer: dbds, mu: &sync.Mutex{}, lastProcess: time.Now()}
+		if d.finder != nil {
+			// the rounding, coalescing, audit and write-through are not stored with the DS
+			if spec := d.finder.FindMatchingDSSpec(dbds.Ident()); spec != nil {
+				cds.round = spec.Round
+				cds.audit = newDsAudit(spec.Audit)
+				cds.writeThrough = spec.WriteThrough
+				dbds.SetCoalescing(spec.Coalesce)
+			}
+		}
+		d.insert(cds)
 		d.register(dbds)
 	}
 
@@ -104,7 +126,7 @@ func (d *dsCache) getByIdentOrCreateEmpty(ident *cachedIdent) *cachedDs {
 		if spec := d.finder.FindMatchingDSSpec(ident.Ident); spec != nil {
 			// return a cachedDs with nil DataSourcer
 			dbds := serde.NewDbDataSource(0, ident.Ident, 0, 0, nil)
-			result = &cachedDs{DbDataSourcer: dbds, spec: spec, mu: &sync.Mutex{}, lastProcess: time.Now()}
+			result = &cachedDs{DbDataSourcer: dbds, spec: spec, round: spec.Round, audit: newDsAudit(spec.Audit), writeThrough: spec.WriteThrough, mu: &sync.Mutex{}, lastProcess: time.Now()}
 			d.insert(result)
 		}
 	}
@@ -113,20 +135,65 @@ func (d *dsCache) getByIdentOrCreateEmpty(ident *cachedIdent) *cachedDs {
 
 // load (or create) via the SerDe given an empty cachedDs with ident and spec
 func (d *dsCache) fetchOrCreateByIdent(cds *cachedDs) error {
-	ds, err := d.db.FetchOrCreateDataSource(cds.Ident(), cds.spec)
-	if err != nil {
-		return err
+	var (
+		ds  rrd.DataSourcer
+		err error
+	)
+	if d.names != nil {
+		// Only the name of a DS about to be created must be valid,
+		// existing DSs are accepted whatever their name.
+		if ds, err = d.db.FetchOrCreateDataSource(cds.Ident(), nil); err != nil {
+			return err
+		}
+		if ds == nil {
+			if cds.rejected = d.names.check(cds.Ident()["name"]); cds.rejected != "" {
+				return nil
+			}
+		}
+	}
+	if ds == nil {
+		ds, err = d.db.FetchOrCreateDataSource(cds.Ident(), cds.spec)
+		if serde.IsConflict(err) {
+			// Someone else (e.g. another node) created it at the same
+			// time, which means it should be there now.
+			ds, err = d.db.FetchOrCreateDataSource(cds.Ident(), cds.spec)
+		}
+		if err != nil {
+			return err
+		}
 	}
 	dbds, ok := ds.(serde.DbDataSourcer)
 	if !ok {
 		return fmt.Errorf("fetchOrCreateByIdent: ds must be a serde.DbDataSourcer")
 	}
+	if cds.spec != nil {
+		dbds.SetCoalescing(cds.spec.Coalesce) // not stored with the DS
+	}
 	cds.DbDataSourcer = dbds
 	cds.spec = nil
 	d.register(dbds)
+	if dbds.Created() {
+		d.events.add("created", dbds.Ident())
+	}
+	d.RLock()
+	created := d.created
+	d.RUnlock()
+	for _, f := range created {
+		f(dbds.Ident())
+	}
 	return nil
 }
 
+// NotifyCreate arranges for f to be called with the ident of every DS
+// the cache loads or creates when the first data point for it
+// arrives, e.g. so that the DSL can find new series without
+// re-reading all the names from the database.
+func (d *dsCache) NotifyCreate(f func(serde.Ident)) {
+	d.Lock()
+	defer d.Unlock()
+	d.created = append(d.created, f)
+}
+
 // register the rds as a DistDatum with the cluster
 func (d *dsCache) register(ds serde.DbDataSourcer) {
 	if d.clstr != nil {
@@ -201,7 +268,11 @@ type cachedDs struct {
 	serde.DbDataSourcer
 	incoming     sortableIncomingDPs
 	spec         *rrd.DSSpec // for when DS needs to be created
+	round        *rrd.Rounding
+	audit        *dsAudit // nil unless spec.Audit
+	writeThrough bool     // see rrd.DSSpec.WriteThrough
 	sentToLoader bool
+	rejected     string // why the NameValidator rejected the name of this new DS
 	lastProcess  time.Time
 	lastFlush    time.Time
 	watchCh      chan dsl.DataPoint
@@ -230,8 +301,9 @@ func (cds *cachedDs) processIncoming() (int, int, error) {
 	// delay processing by 1/10 of a step, in a clustered situation it
 	// is possible for forwarded data points to arrive slightly late,
 	// this (along with the Sort() just below) addresses it.  Unless
-	// there are already a bunch of points queued up
-	if !(cds.lastProcess.Before(time.Now().Add(-cds.Step()/10)) || count > BIG) {
+	// there are already a bunch of points queued up, or the DS is
+	// write-through, which does not wait.
+	if !(cds.writeThrough || cds.lastProcess.Before(time.Now().Add(-cds.Step()/10)) || count > BIG) {
 		return 0, 0, nil
 	}
 
@@ -239,12 +311,23 @@ func (cds *cachedDs) processIncoming() (int, int, error) {
 
 	blocked := 0 // watched ch blocked
 	for _, dp := range cds.incoming {
+		value := dp.value
+		if cds.round != nil {
+			value = cds.round.Round(value)
+		}
+
+		lastUpdate := cds.LastUpdate()
+
 		// continue on errors
-		err = cds.ProcessDataPoint(dp.value, dp.timeStamp)
+		err = cds.ProcessDataPoint(value, dp.timeStamp)
+
+		if cds.audit != nil {
+			cds.audit.record(cds.DbDataSourcer, dp, value, err, lastUpdate)
+		}
 
 		if cds.watchCh != nil {
 			select {
-			case cds.watchCh <- dsl.DataPoint{Ident: cds.Ident(), T: dp.timeStamp, V: dp.value}:
+			case cds.watchCh <- dsl.DataPoint{Ident: cds.Ident(), T: dp.timeStamp, V: value}:
 			default:
 				// TODO: This means the in-memory series never gets
 				// this data point. There should be a better solution
@@ -329,6 +412,9 @@ func (ds *distDs) Id() int64       { return ds.DbDataSourcer.Id() }
 func (ds *distDs) Type() string    { return "DataSource" }
 func (ds *distDs) GetName() string { return ds.DbDataSourcer.Ident().String() }
 
+// cluster.PinnableDistDatum, pins match the name
+func (ds *distDs) PinName() string { return ds.DbDataSourcer.Ident()["name"] }
+
 // end cluster.DistDatum interface
 
 type statster interface {
@@ -346,5 +432,6 @@ func ReportRcacheStats(ndsf dsl.NamedDSFetcher, sr statReporter) {
 		sr.reportStatCount("dsl.lru_hits", float64(st.LruHits))
 		sr.reportStatCount("dsl.lru_misses", float64(st.LruMisses))
 		sr.reportStatGauge("dsl.lru_size", float64(st.LruSize))
+		sr.reportStatGauge("dsl.find_index_size", float64(st.FindIndexSize))
 	}
 }
@@ -19,6 +19,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 	"github.com/tgres/tgres/series"
@@ -106,8 +107,10 @@ func Test_dscache_preLoad(t *testing.T) {
 type fakeSerde struct {
 	flushCalled, createCalled, fetchCalled int
 	fakeErr                                bool
+	conflicts                              int // return a serde.ErrConflict this many times
 	returnDss                              []rrd.DataSourcer
 	nondb                                  bool
+	missing                                bool // nothing exists yet, a fetch only (nil dsSpec) finds nothing
 }
 
 func (m *fakeSerde) Fetcher() serde.Fetcher                                { return m }
@@ -140,6 +143,13 @@ func (f *fakeSerde) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpe
 	if f.fakeErr {
 		return nil, fmt.Errorf("some error")
 	}
+	if f.conflicts > 0 {
+		f.conflicts--
+		return nil, &serde.Error{Op: "FetchOrCreateDataSource", Kind: serde.ErrConflict}
+	}
+	if f.missing && dsSpec == nil {
+		return nil, nil
+	}
 	if f.nondb {
 		return rrd.NewDataSource(*DftDSSPec), nil
 	} else {
@@ -173,6 +183,63 @@ func Test_dscache_fetchOrCreateByIdent(t *testing.T) {
 		t.Errorf("fetchOrCreateByIdent: db error should error")
 	}
 
+	// a conflict is retried once
+	db.fakeErr = false
+	for _, c := range []struct {
+		conflicts, calls int
+		fail             bool
+	}{{1, 2, false}, {2, 2, true}} {
+		db.createCalled, db.conflicts = 0, c.conflicts
+		d = newDsCache(db, df, dsf)
+		cds = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"}))
+		err := d.fetchOrCreateByIdent(cds)
+		if (err != nil) != c.fail || db.createCalled != c.calls {
+			t.Errorf("fetchOrCreateByIdent: %d conflicts: expected %d calls (fail: %v), got %d (err: %v)", c.conflicts, c.calls, c.fail, db.createCalled, err)
+		}
+	}
+	db.conflicts = 0
+
+	// With a NameValidator, the name is only checked if the DS does
+	// not exist and would be created
+	names, _ := NewNameValidator(5, "a-z", false)
+	for _, c := range []struct {
+		missing  bool
+		name     string
+		rejected string
+		calls    int
+	}{
+		{false, "toolong", "", 1}, // exists
+		{true, "toolong", "length", 1},
+		{true, "f.b", "chars", 1},
+		{true, "foo", "", 2}, // created
+	} {
+		db.createCalled, db.missing = 0, c.missing
+		d = newDsCache(db, df, dsf)
+		d.names = names
+		cds = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": c.name}))
+		if err := d.fetchOrCreateByIdent(cds); err != nil || cds.rejected != c.rejected || db.createCalled != c.calls {
+			t.Errorf("fetchOrCreateByIdent: %q (missing: %v): expected rejected %q in %d calls, got %q in %d (err: %v)", c.name, c.missing, c.rejected, c.calls, cds.rejected, db.createCalled, err)
+		}
+		if c.rejected != "" && (cds.Id() != 0 || cds.spec == nil) {
+			t.Errorf("fetchOrCreateByIdent: %q: a rejected DS should not be loaded", c.name)
+		}
+	}
+	db.missing = false
+
+	// create listeners get the ident, but not on error
+	var created []serde.Ident
+	d = newDsCache(db, df, dsf)
+	d.NotifyCreate(func(ident serde.Ident) { created = append(created, ident) })
+	cds = d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"}))
+	if err := d.fetchOrCreateByIdent(cds); err != nil || len(created) != 1 || created[0]["name"] != "foo" {
+		t.Errorf("fetchOrCreateByIdent: expected the create listener to be called with foo, got: %v (err: %v)", created, err)
+	}
+	db.fakeErr = true
+	d.fetchOrCreateByIdent(d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "bar"})))
+	if len(created) != 1 {
+		t.Errorf("fetchOrCreateByIdent: the create listener should not be called on error")
+	}
+
 	// non-DbDataSource should error
 	nds := rrd.NewDataSource(*DftDSSPec)
 	db.fakeErr = false
@@ -231,6 +298,11 @@ func Test_dscache_cachedDs_Relinquish(t *testing.T) {
 		t.Errorf("Acquire: should not call flush")
 	}
 
+	// a handoff is not a deletion
+	if events, _, _ := dsc.events.since(0); len(events) != 0 {
+		t.Errorf("Relinquish and Acquire should not be events, got %v", events)
+	}
+
 	// receiverDs methods
 	if rds.Type() != "DataSource" {
 		t.Errorf(`rds.Type() != "DataSource"`)
@@ -244,3 +316,35 @@ func Test_dscache_cachedDs_Relinquish(t *testing.T) {
 		t.Errorf("id should be 0")
 	}
 }
+
+func Test_dscache_cachedDs_round(t *testing.T) {
+	db := &fakeSerde{}
+	spec := *DftDSSPec
+	spec.Round = &rrd.Rounding{Digits: 2}
+	d := newDsCache(db, &SimpleDSFinder{&spec}, nil)
+
+	foo := serde.Ident{"name": "foo"}
+	db.returnDss = []rrd.DataSourcer{serde.NewDbDataSource(0, foo, 0, 0, rrd.NewDataSource(*DftDSSPec))}
+	if err := d.preLoad(); err != nil {
+		t.Fatal(err)
+	}
+	cds := d.getByIdent(newCachedIdent(foo))
+	if cds == nil || cds.round != spec.Round {
+		t.Fatalf("preLoad: expected the rounding of the matching spec, got %v", cds)
+	}
+	bar := d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "bar"}))
+	if bar == nil || bar.round != spec.Round {
+		t.Errorf("getByIdentOrCreateEmpty: expected the rounding of the matching spec, got %v", bar)
+	}
+
+	ch := make(chan dsl.DataPoint, 1)
+	cds.watchCh = ch
+	cds.lastProcess = time.Time{}
+	cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(foo), timeStamp: time.Unix(1000, 0), value: 3.14159})
+	if _, _, err := cds.processIncoming(); err != nil {
+		t.Fatal(err)
+	}
+	if dp := <-ch; dp.V != 3.14 {
+		t.Errorf("processIncoming: expected 3.14, got %v", dp.V)
+	}
+}
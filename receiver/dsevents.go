@@ -0,0 +1,90 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// The number of DS events kept, see dsEvents.
+const dsEventsSize = 1024
+
+// A DSEvent is the creation of a DS (in the database, by the first
+// data point for it) or its deletion.
+type DSEvent struct {
+	Id    int64  // increasing from 1
+	Type  string // "created" or "deleted"
+	Ident serde.Ident
+	Time  time.Time
+}
+
+// dsEvents keeps the latest dsEventsSize DS events in a ring, the
+// oldest are dropped as new ones come in, however far behind the
+// readers are: a reader which is slower than that skips the ones it
+// missed (and is told how many).
+type dsEvents struct {
+	sync.Mutex
+	ring []DSEvent
+	next int64         // the id of the next event
+	wake chan struct{} // closed on every new event
+}
+
+func newDsEvents(size int) *dsEvents {
+	return &dsEvents{ring: make([]DSEvent, size), next: 1, wake: make(chan struct{})}
+}
+
+func (e *dsEvents) add(typ string, ident serde.Ident) {
+	if e == nil {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.ring[e.next%int64(len(e.ring))] = DSEvent{Id: e.next, Type: typ, Ident: ident, Time: time.Now()}
+	e.next++
+	close(e.wake)
+	e.wake = make(chan struct{})
+}
+
+// since returns the events after id, the number of those which were
+// dropped, and a channel which is closed when there are more.
+func (e *dsEvents) since(id int64) ([]DSEvent, int64, <-chan struct{}) {
+	e.Lock()
+	defer e.Unlock()
+	if id < 0 || id >= e.next {
+		id = e.next - 1 // only the ones to come
+	}
+	var dropped int64
+	if oldest := e.next - int64(len(e.ring)); id+1 < oldest {
+		dropped, id = oldest-id-1, oldest-1
+	}
+	result := make([]DSEvent, 0, e.next-id-1)
+	for i := id + 1; i < e.next; i++ {
+		result = append(result, e.ring[i%int64(len(e.ring))])
+	}
+	return result, dropped, e.wake
+}
+
+// DSEventsSince returns the DS events after the one with the given id
+// (which is not the id of a future event, -1 is none), the number of
+// those no longer kept and a channel which is closed when there are
+// more, e.g. for a stream of them. Only the DSs this node creates
+// (and all the DSs deleted from the database) are in it.
+func (r *Receiver) DSEventsSince(id int64) ([]DSEvent, int64, <-chan struct{}) {
+	return r.dsc.events.since(id)
+}
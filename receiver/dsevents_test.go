@@ -0,0 +1,92 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_dsEvents(t *testing.T) {
+	e := newDsEvents(4)
+
+	events, dropped, wake := e.since(-1)
+	if len(events) != 0 || dropped != 0 {
+		t.Errorf("Expected no events, got %v, %d", events, dropped)
+	}
+	e.add("created", serde.Ident{"name": "foo"})
+	select {
+	case <-wake:
+	default:
+		t.Errorf("Expected a wake up on a new event")
+	}
+
+	if events, _, _ := e.since(0); len(events) != 1 || events[0].Id != 1 || events[0].Type != "created" || events[0].Ident["name"] != "foo" {
+		t.Errorf("Expected the created foo, got %v", events)
+	}
+	if events, _, _ := e.since(-1); len(events) != 0 {
+		t.Errorf("Expected only the events to come, got %v", events)
+	}
+
+	// A reader too far behind misses the oldest
+	for i := 0; i < 5; i++ {
+		e.add("deleted", serde.Ident{"name": fmt.Sprintf("bar%d", i)})
+	}
+	events, dropped, _ = e.since(0)
+	if len(events) != 4 || dropped != 2 || events[0].Id != 3 || events[3].Id != 6 {
+		t.Errorf("Expected events 3 to 6 and 2 dropped, got %v, %d", events, dropped)
+	}
+	if events, dropped, _ := e.since(5); len(events) != 1 || dropped != 0 || events[0].Ident["name"] != "bar4" {
+		t.Errorf("Expected the last event, got %v, %d", events, dropped)
+	}
+	// e.g. the Last-Event-ID from before a restart
+	if events, _, _ := e.since(100); len(events) != 0 {
+		t.Errorf("Expected no events for a future id, got %v", events)
+	}
+}
+
+type createdDs struct{ *serde.DbDataSource }
+
+func (createdDs) Created() bool { return true }
+
+type creatingSerde struct{ fakeSerde }
+
+func (f *creatingSerde) Fetcher() serde.Fetcher { return f }
+func (f *creatingSerde) FetchOrCreateDataSource(ident serde.Ident, dsSpec *rrd.DSSpec) (rrd.DataSourcer, error) {
+	return createdDs{serde.NewDbDataSource(1, ident, 0, 1, rrd.NewDataSource(*DftDSSPec))}, nil
+}
+
+func Test_dsCache_events(t *testing.T) {
+	df := &SimpleDSFinder{DftDSSPec}
+
+	// Only the DSs created in the db are an event, not those loaded
+	d := newDsCache(&fakeSerde{}, df, &dsFlusher{sr: &fakeSr{}})
+	d.fetchOrCreateByIdent(d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"})))
+	if events, _, _ := d.events.since(0); len(events) != 0 {
+		t.Errorf("Expected no events for a loaded DS, got %v", events)
+	}
+
+	d = newDsCache(&creatingSerde{}, df, &dsFlusher{sr: &fakeSr{}})
+	d.fetchOrCreateByIdent(d.getByIdentOrCreateEmpty(newCachedIdent(serde.Ident{"name": "foo"})))
+	d.deleted(serde.Ident{"name": "foo"})
+	events, _, _ := d.events.since(0)
+	if len(events) != 2 || events[0].Type != "created" || events[1].Type != "deleted" || events[1].Ident["name"] != "foo" {
+		t.Errorf("Expected foo created and deleted, got %v", events)
+	}
+}
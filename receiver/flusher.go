@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/serde"
@@ -29,6 +30,9 @@ type dsFlusher struct {
 	vcache *verticalCache
 	sr     statReporter
 	dbCh   chan *vDpFlushRequest
+	n      int   // number of dbFlushers
+	failed int64 // flushes which returned an error, atomic
+	syncMu sync.Mutex
 }
 
 // There are 3 types of flush requests:
@@ -41,6 +45,7 @@ type vDpFlushRequest struct {
 	ivers                       map[int64]*iVer       // DPS (versions)
 	latests                     map[int64]interface{} // Latests
 	lastupdate, duration, value map[int64]interface{} // DSS
+	barrier                     *sync.WaitGroup       // see sync()
 }
 
 func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n int) {
@@ -58,9 +63,10 @@ func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Durat
 	}
 
 	log.Printf(" -- vertical db flusher...")
+	f.n = n
 	for i := 0; i < n; i++ {
 		startWg.Add(1)
-		go dbFlusher(&wrkCtl{wg: flusherWg, startWg: startWg, id: fmt.Sprintf("vdbflusher_%d", i)}, f.db, f.dbCh, f.sr)
+		go dbFlusher(&wrkCtl{wg: flusherWg, startWg: startWg, id: fmt.Sprintf("vdbflusher_%d", i)}, f.db, f.dbCh, f.sr, &f.failed)
 	}
 	// TODO Consider making this nap time configurable?
 	go vcacheFlusher(f.vcache, f.dbCh, 100*time.Millisecond, f.sr)
@@ -69,6 +75,10 @@ func (f *dsFlusher) start(flusherWg, startWg *sync.WaitGroup, minStep time.Durat
 		log.Printf(" -- ts table size reporter")
 		go reportTsTableSize(tdb, f.sr)
 	}
+	if tdb, ok := f.db.(tableStatser); ok {
+		log.Printf(" -- dead tuples reporter")
+		go reportTableStats(tdb, f.sr)
+	}
 }
 
 func (f *dsFlusher) stop() {
@@ -81,19 +91,64 @@ func (f *dsFlusher) stop() {
 	}
 }
 
-func (f *dsFlusher) verticalFlush(ds serde.DbDataSourcer) {
+// Waits until the flush requests queued so far have been written to
+// the database (or failed, see failures()). Every dbFlusher gets a
+// barrier request and waits for the others to get theirs, which,
+// since the channel is FIFO, means that all the requests before the
+// barriers are done. Only one sync() can be waiting at a time,
+// otherwise the dbFlushers could each be holding a barrier of a
+// different one.
+func (f *dsFlusher) sync() {
+	if f.db == nil || f.n == 0 {
+		return
+	}
+	f.syncMu.Lock()
+	defer f.syncMu.Unlock()
+	barrier := &sync.WaitGroup{}
+	barrier.Add(f.n)
+	for i := 0; i < f.n; i++ {
+		f.dbCh <- &vDpFlushRequest{barrier: barrier}
+	}
+	barrier.Wait()
+}
 
-	if _ds, ok := ds.(*serde.DbDataSource); ok {
-		f.vcache.updateDss(_ds)
-	} else {
-		log.Printf("verticalFlush: ERROR: ds not a *serde.DbDataSource!")
+// Writes what the vertical cache has of ds (i.e. after
+// flushToVCache()) to the database and waits for it to be done. The
+// error only says that some flush failed meanwhile, which may have
+// been of another DS.
+func (f *dsFlusher) flushDs(ds serde.DbDataSourcer) error {
+	if f.db == nil || f.vcache == nil {
+		return nil
 	}
+	segs := make(map[bundleKey]bool, len(ds.RRAs()))
+	for _, rra := range ds.RRAs() {
+		if dbrra, ok := rra.(serde.DbRoundRobinArchiver); ok {
+			segs[bundleKey{dbrra.BundleId(), dbrra.Seg()}] = true
+		}
+	}
+	failed := f.failures()
+	f.vcache.flushOnly(f.dbCh, true, segs, map[int64]bool{ds.Seg(): true})
+	f.sync()
+	if n := f.failures() - failed; n > 0 {
+		return fmt.Errorf("%d flush(es) failed, see the log", n)
+	}
+	return nil
+}
+
+// The number of flushes which failed so far.
+func (f *dsFlusher) failures() int64 {
+	return atomic.LoadInt64(&f.failed)
+}
+
+func (f *dsFlusher) verticalFlush(ds serde.DbDataSourcer) {
+
+	f.vcache.updateDss(ds)
 
 	for _, rra := range ds.RRAs() {
-		if _rra, ok := rra.(*serde.DbRoundRobinArchive); ok {
+		if _rra, ok := rra.(serde.DbRoundRobinArchiver); ok {
 			f.vcache.updateDps(_rra)
 		} else {
-			log.Printf("verticalFlush: ERROR: rra not a *serde.DbRoundRobinArchive!")
+			log.Printf("verticalFlush: ERROR: rra not a serde.DbRoundRobinArchiver!")
 		}
 	}
 }
@@ -101,25 +156,43 @@ func (f *dsFlusher) verticalFlush(ds serde.DbDataSourcer) {
 func (f *dsFlusher) flushToVCache(ds serde.DbDataSourcer) {
 	if f.db != nil {
 		// These operations do not write to the db, but only move
-		// stuff to another cache.
+		// stuff to another cache. The roll-up RRAs are updated here
+		// rather than with every data point, see rrd.DataSource.RollUp().
+		ds.RollUp()
 		f.verticalFlush(ds)
 		ds.ClearRRAs()
 	}
 	return
 }
 
+// The data points of rra which are in the vertical cache.
+func (f *dsFlusher) cachedDps(rra serde.DbRoundRobinArchiver) map[int64]float64 {
+	if f.vcache == nil {
+		return nil
+	}
+	return f.vcache.rraDps(rra)
+}
+
 func (f *dsFlusher) statReporter() statReporter {
 	return f.sr
 }
 
+func (f *dsFlusher) backlog() int {
+	if f.vcache == nil {
+		return 0
+	}
+	return f.vcache.backlog()
+}
+
 type dsFlusherBlocking interface {
 	flushToVCache(serde.DbDataSourcer)
 	statReporter() statReporter
+	backlog() int
 	start(flusherWg, startWg *sync.WaitGroup, minStep time.Duration, n int)
 	stop()
 }
 
-var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest, sr statReporter) {
+var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest, sr statReporter, failed *int64) {
 	wc.onEnter()
 	defer wc.onExit()
 
@@ -144,6 +217,12 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			return
 		}
 
+		if dpr.barrier != nil {
+			dpr.barrier.Done()
+			dpr.barrier.Wait()
+			continue
+		}
+
 		st.chGets += 1
 		if l := len(ch); st.chMaxLen < l {
 			st.chMaxLen = l
@@ -155,6 +234,7 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			sqlOps, err := db.FlushDSStates(dpr.seg, dpr.lastupdate, dpr.value, dpr.duration)
 			if err != nil {
 				log.Printf("vdbflusher: ERROR in VerticalFlushDSs: %v", err)
+				atomic.AddInt64(failed, 1)
 			}
 			st.dsDur += time.Now().Sub(start)
 			st.dsCount += len(dpr.lastupdate)
@@ -168,6 +248,7 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			sqlOps, err := db.FlushDataPoints(dpr.bundleId, dpr.seg, dpr.i, idps, vers)
 			if err != nil {
 				log.Printf("vdbflusher: ERROR in VerticalFlushDps: %v", err)
+				atomic.AddInt64(failed, 1)
 			}
 			st.dpsDur += time.Now().Sub(start)
 			st.dpsCount += len(dpr.dps)
@@ -180,6 +261,7 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			sqlOps, err := db.FlushRRAStates(dpr.bundleId, dpr.seg, dpr.latests, dpr.value, dpr.duration)
 			if err != nil {
 				log.Printf("verticalCache: ERROR in VerticalFlushRRAs: %v", err)
+				atomic.AddInt64(failed, 1)
 			}
 			st.rraDur += time.Now().Sub(start)
 			st.rraCount += len(dpr.latests)
@@ -203,6 +285,9 @@ var dbFlusher = func(wc wController, db serde.Flusher, ch chan *vDpFlushRequest,
 			sr.reportStatGauge("serde.flush_rra_state.speed", float64(st.rraCount)/rraDur)
 			sr.reportStatCount("serde.flush_rra_state.count", float64(st.rraCount))
 			sr.reportStatCount("serde.flush_rra_state.sql_ops", float64(st.rraSqlOps))
+			if vcc, ok := db.(serde.VersionCollisionCounter); ok {
+				sr.reportStatCount("serde.flush_rra_state.version_collisions", float64(vcc.VersionCollisions()))
+			}
 
 			dsDur := st.dsDur.Seconds()
 			if st.dsFlushes > 0 {
@@ -245,6 +330,7 @@ var vcacheFlusher = func(vcache *verticalCache, dbCh chan *vDpFlushRequest, nap
 
 type tsTableSizer interface {
 	TsTableSize() (size, count int64, err error)
+	TsRowWidth() (float64, error)
 }
 
 func reportTsTableSize(ts tsTableSizer, sr statReporter) {
@@ -253,8 +339,41 @@ func reportTsTableSize(ts tsTableSizer, sr statReporter) {
 		sz, cnt, _ := ts.TsTableSize()
 		sr.reportStatGauge("serde.ts_table.bytes", float64(sz))
 		sr.reportStatGauge("serde.ts_table.rows", float64(cnt))
-		// 447 bytes overhead per row was determined by way of experimentation, it's probably wrong
-		bloat := float64(sz)/(float64(cnt)*float64(serde.PgSegmentWidth*8+447)) - 1.0
-		sr.reportStatGauge("serde.ts_table.bloat_factor", bloat)
+		if width, err := ts.TsRowWidth(); err == nil {
+			sr.reportStatGauge("serde.ts_table.bloat_factor", tsBloatFactor(sz, cnt, width))
+		}
+	}
+}
+
+// How much larger than expected a ts table of size bytes and count
+// rows of (on average) width data points is, 0 is no bloat.
+func tsBloatFactor(size, count int64, width float64) float64 {
+	if count == 0 {
+		return 0
+	}
+	// 447 bytes overhead per row was determined by way of experimentation, it's probably wrong
+	return float64(size)/(float64(count)*(width*8+447)) - 1.0
+}
+
+// Periodically report the dead tuples of the tables the flushers
+// write to, as estimated by PostgreSQL, a dead_ratio which keeps
+// growing means that autovacuum is not keeping up (see the vacuum
+// command of tgres-admin).
+
+type tableStatser interface {
+	TableStats() ([]*serde.TableStats, error)
+}
+
+func reportTableStats(ts tableStatser, sr statReporter) {
+	for {
+		time.Sleep(15 * time.Second)
+		stats, err := ts.TableStats()
+		if err != nil {
+			continue
+		}
+		for _, st := range stats {
+			sr.reportStatGauge("serde."+st.Name+"_table.dead_tuples", float64(st.DeadTuples))
+			sr.reportStatGauge("serde."+st.Name+"_table.dead_ratio", st.DeadRatio())
+		}
 	}
 }
@@ -28,12 +28,14 @@ import (
 type fakeDsFlusher struct {
 	called int
 	sr     statReporter
+	bl     int
 }
 
 func (f *fakeDsFlusher) flushDS(ds serde.DbDataSourcer, block bool)         { f.called++ }
 func (f *fakeDsFlusher) flushToVCache(serde.DbDataSourcer)                  {}
 func (f *fakeDsFlusher) flusher() serde.Flusher                             { return f }
 func (f *fakeDsFlusher) statReporter() statReporter                         { return f.sr }
+func (f *fakeDsFlusher) backlog() int                                       { return f.bl }
 func (f *fakeDsFlusher) start(_, _ *sync.WaitGroup, _ time.Duration, n int) {}
 func (f *fakeDsFlusher) stop()                                              {}
 func (f *fakeDsFlusher) FlushDataPoints(bunlde_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
@@ -74,3 +76,21 @@ func Test_flusher_methods(t *testing.T) {
 		t.Errorf("sr != f.statReporter()")
 	}
 }
+
+func Test_tsBloatFactor(t *testing.T) {
+	// 1000 rows of width 100 with no bloat, as estimated
+	size := int64(1000 * (100*8 + 447))
+	if b := tsBloatFactor(size, 1000, 100); b != 0 {
+		t.Errorf("Expected no bloat, got %v", b)
+	}
+	if b := tsBloatFactor(2*size, 1000, 100); b != 1 {
+		t.Errorf("Expected a bloat factor of 1, got %v", b)
+	}
+	// the same table assumed to have rows of 200 would look smaller
+	if b := tsBloatFactor(size, 1000, 200); b >= 0 {
+		t.Errorf("Expected a negative bloat factor at a greater width, got %v", b)
+	}
+	if b := tsBloatFactor(0, 0, 100); b != 0 {
+		t.Errorf("Expected 0 for an empty table, got %v", b)
+	}
+}
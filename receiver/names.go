@@ -0,0 +1,160 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/serde"
+)
+
+// A NameMunger normalizes the name of an incoming data point before
+// the DS is looked up (or created), so that e.g. "Host.CPU" and
+// "host.cpu" do not end up as two different series.
+type NameMunger func(string) string
+
+// NameMungers are the built-in name mungers, by name. This is the
+// place to add more.
+var NameMungers = map[string]NameMunger{
+	"lowercase":     strings.ToLower,
+	"sanitize":      misc.SanitizeTaggedName,
+	"collapse-dots": collapseDots,
+}
+
+// NameMungerChain returns a NameMunger which applies the named
+// built-in mungers in the order given. With no names, it returns nil.
+func NameMungerChain(names ...string) (NameMunger, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	chain := make([]NameMunger, 0, len(names))
+	for _, name := range names {
+		nm, ok := NameMungers[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown name munger: %q", name)
+		}
+		chain = append(chain, nm)
+	}
+	return func(s string) string {
+		for _, nm := range chain {
+			s = nm(s)
+		}
+		return s
+	}, nil
+}
+
+// Removes empty elements, i.e. "foo..bar." becomes "foo.bar".
+func collapseDots(s string) string {
+	parts := strings.Split(s, ".")
+	result := parts[:0]
+	for _, part := range parts {
+		if part != "" {
+			result = append(result, part)
+		}
+	}
+	return strings.Join(result, ".")
+}
+
+// Apply the munger to the name in the ident. The ident is copied, it
+// may be in use elsewhere (e.g. in the aggregator).
+func mungeIdent(nm NameMunger, ident serde.Ident) serde.Ident {
+	name, ok := ident["name"]
+	if nm == nil || !ok {
+		return ident
+	}
+	result := make(serde.Ident, len(ident))
+	for k, v := range ident {
+		result[k] = v
+	}
+	result["name"] = nm(name)
+	return result
+}
+
+// The default name validation, which accepts whatever Graphite
+// does in practice: any printable ASCII character other than the
+// space (which separates the fields of the plaintext protocol), as
+// well as Unicode letters and digits, and names much longer than
+// anyone would reasonably use.
+const (
+	DftNameMaxLength = 1024
+	DftNameChars     = `!-~\pL\pN`
+)
+
+// A NameValidator rejects the names of new DSs which are too long or
+// have characters other than those allowed, e.g. so that a
+// misbehaving client cannot fill the database with junk. It is
+// checked before a DS is created, the data points of an existing DS
+// are never rejected. The rejected points are counted (as
+// receiver.datapoints.rejected_name_length and _chars), and, if Log is
+// true, a sample of the names is logged at most once a minute.
+type NameValidator struct {
+	MaxLength int            // 0 is unlimited
+	Chars     *regexp.Regexp // nil allows any
+	Log       bool
+
+	// used by the director only
+	rejected int
+	sample   string
+	logged   time.Time
+}
+
+// NewNameValidator returns a NameValidator allowing names of up to
+// maxLength (0 is unlimited) of the characters chars, which is the
+// inside of a regular expression character class, e.g. DftNameChars
+// (blank allows any).
+func NewNameValidator(maxLength int, chars string, logRejected bool) (*NameValidator, error) {
+	v := &NameValidator{MaxLength: maxLength, Log: logRejected}
+	if chars != "" {
+		var err error
+		if v.Chars, err = regexp.Compile("^[" + chars + "]*$"); err != nil {
+			return nil, fmt.Errorf("invalid name characters %q: %v", chars, err)
+		}
+	}
+	return v, nil
+}
+
+// Returns why name is rejected ("length" or "chars"), blank if it is
+// not.
+func (v *NameValidator) check(name string) string {
+	if v.MaxLength > 0 && len(name) > v.MaxLength {
+		return "length"
+	}
+	if v.Chars != nil && !v.Chars.MatchString(name) {
+		return "chars"
+	}
+	return ""
+}
+
+// Records a rejected name, logging the first one since the last time
+// along with how many there were, if a minute has passed.
+func (v *NameValidator) reject(name, reason string, now time.Time) {
+	if !v.Log {
+		return
+	}
+	if v.rejected == 0 {
+		v.sample = fmt.Sprintf("%q (%s)", name, reason)
+	}
+	v.rejected++
+	if now.Sub(v.logged) >= time.Minute {
+		log.Printf("NameValidator: rejected %d data points of new DSs with invalid names, e.g. %s.", v.rejected, v.sample)
+		v.rejected, v.logged = 0, now
+	}
+}
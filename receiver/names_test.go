@@ -0,0 +1,84 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_names_NameMungerChain(t *testing.T) {
+	nm, err := NameMungerChain()
+	if nm != nil || err != nil {
+		t.Errorf("NameMungerChain() with no names should return nil, nil")
+	}
+
+	if _, err = NameMungerChain("lowercase", "bogus"); err == nil {
+		t.Errorf("NameMungerChain: expected an error for an unknown munger")
+	}
+
+	nm, err = NameMungerChain("lowercase", "collapse-dots")
+	if err != nil {
+		t.Error(err)
+	}
+	if s := nm("Host..CPU.User."); s != "host.cpu.user" {
+		t.Errorf("NameMungerChain: unexpected result: %q", s)
+	}
+}
+
+func Test_names_mungeIdent(t *testing.T) {
+	ident := serde.Ident{"name": "Host.CPU", "foo": "Bar"}
+	if mungeIdent(nil, ident)["name"] != "Host.CPU" {
+		t.Errorf("mungeIdent: nil munger should not change the name")
+	}
+	result := mungeIdent(NameMungers["lowercase"], ident)
+	if result["name"] != "host.cpu" || result["foo"] != "Bar" {
+		t.Errorf("mungeIdent: unexpected result: %v", result)
+	}
+	if ident["name"] != "Host.CPU" {
+		t.Errorf("mungeIdent: original ident must not be modified")
+	}
+}
+
+func Test_names_NameValidator(t *testing.T) {
+	v, err := NewNameValidator(DftNameMaxLength, DftNameChars, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, exp := range map[string]string{
+		"foo.bar-baz_1":                         "",
+		"foo.bar;dc=east":                       "",
+		"foo.b@r:[x]":                           "",
+		"température.salle":                     "",
+		"foo bar":                               "chars",
+		"foo\x00bar":                            "chars",
+		strings.Repeat("x", DftNameMaxLength):   "",
+		strings.Repeat("x", DftNameMaxLength+1): "length",
+	} {
+		if reason := v.check(name); reason != exp {
+			t.Errorf("check(%.20q): expected %q, got %q", name, exp, reason)
+		}
+	}
+
+	if v, _ = NewNameValidator(0, "", false); v.check(strings.Repeat("x y", 1000)) != "" {
+		t.Errorf("A NameValidator without limits should accept anything")
+	}
+	if _, err = NewNameValidator(0, "z-a", false); err == nil {
+		t.Errorf("Expected an error for invalid characters")
+	}
+}
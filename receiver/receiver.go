@@ -21,6 +21,8 @@ package receiver
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
+	"log"
 	"os"
 	"sync"
 	"time"
@@ -28,6 +30,7 @@ import (
 	"github.com/tgres/tgres/aggregator"
 	"github.com/tgres/tgres/blaster"
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
 
@@ -75,14 +78,66 @@ type Receiver struct {
 	// and approximate, but better than nothing.
 	MaxMemoryBytes uint64
 
+	// MaxFlushBacklog is the limit on the number of data points
+	// waiting in the cache to be flushed to the database. It grows
+	// when the database cannot keep up, and once it is exceeded
+	// incoming points are discarded rather than buffered in memory
+	// indefinitely. Zero or a negative value means unlimited.
+	MaxFlushBacklog int
+
+	// MaxFutureSkew, if greater than zero, is how far into the
+	// future the timestamp of an incoming data point can be, points
+	// beyond it are discarded. Such points are usually the result of
+	// a wrong clock on the sender and would otherwise move the RRA
+	// latest ahead of the wall time. The difference between the wall
+	// time and incoming timestamps is reported as the
+	// receiver.clock_skew stats regardless.
+	MaxFutureSkew time.Duration
+
+	// DedupWindow, if greater than zero, is how long an incoming
+	// data point is remembered so that an exact duplicate (same DS,
+	// timestamp and value) received within it is dropped, up to
+	// DedupMaxPoints points. The duplicates are counted as the
+	// receiver.datapoints.deduped stat.
+	DedupWindow    time.Duration
+	DedupMaxPoints int
+
 	StatFlushDuration time.Duration // Period after which stats are flushed
+	StatFlushAlign    time.Duration // Flushes restart at multiples of this, 0 is StatFlushDuration
 	StatsNamePrefix   string        // Stat names are prefixed with this
 
 	ReportStats       bool   // report internal stats?
 	ReportStatsPrefix string // prefix for internal stats
 
-	// Number of workers and flushers
-	NWorkers int
+	// Number of workers, which process incoming data points, and of
+	// flushers, which write to the database. Zero NFlushers means
+	// NWorkers * 2.
+	NWorkers  int
+	NFlushers int
+
+	// NameMunger, if not nil, is applied to the name of every
+	// incoming data point, see NameMungers.
+	NameMunger NameMunger
+
+	// NameValidator, if not nil, rejects the (munged) names of new
+	// DSs, see NameValidator.
+	NameValidator *NameValidator
+
+	// WALDir, if not blank, is where incoming data points are
+	// recorded before they are cached, to be replayed on the next
+	// start after a crash, see wal. A new WAL segment is started
+	// every WALCheckpointInterval, the segments are removed after
+	// WALRetain, which should exceed how long a point can stay in
+	// memory before it is flushed.
+	WALDir                string
+	WALCheckpointInterval time.Duration
+	WALRetain             time.Duration
+
+	// TeeAddr, if not blank, is the host:port of a Graphite (Carbon
+	// plaintext) to which every incoming data point is also
+	// forwarded, with up to TeeBufferSize points buffered, see tee.
+	TeeAddr       string
+	TeeBufferSize int
 
 	Blaster *blaster.Blaster
 
@@ -107,6 +162,13 @@ type Receiver struct {
 	directorWg    sync.WaitGroup
 	pacedMetricWg sync.WaitGroup
 
+	wal       *wal // nil if disabled
+	walStopCh chan bool
+	walWg     sync.WaitGroup
+
+	tee   *tee // nil if disabled
+	teeWg sync.WaitGroup
+
 	stopped bool
 }
 
@@ -147,6 +209,11 @@ func NewWithMaxQueue(db serde.SerDe, finder MatchingDSSpecFinder, maxQueue int)
 		ReportStats:       false,
 		ReportStatsPrefix: "tgres",
 		NWorkers:          1,
+
+		WALCheckpointInterval: time.Minute,
+		WALRetain:             5 * time.Minute,
+		TeeBufferSize:         100000,
+		DedupMaxPoints:        100000,
 	}
 
 	//r.flusher = &dsFlusher{db: db.Flusher(), vdb: db.VerticalFlusher(), sr: r}
@@ -156,7 +223,7 @@ func NewWithMaxQueue(db serde.SerDe, finder MatchingDSSpecFinder, maxQueue int)
 	// Register DS delete listener
 	if el := db.EventListener(); el != nil {
 		el.RegisterDeleteListener(func(ident serde.Ident) {
-			r.dsc.delete(ident)
+			r.dsc.deleted(ident)
 		})
 	}
 
@@ -212,6 +279,85 @@ func (r *Receiver) DsCache() *dsCache {
 	return r.dsc
 }
 
+type vcacheReader interface {
+	cachedDps(serde.DbRoundRobinArchiver) map[int64]float64
+}
+
+// Unflushed returns a copy of the DS given by ident as it is cached
+// on this node, the RRAs of which contain only the data points not
+// yet flushed to the database, or nil if it is not in the cache
+// (e.g. because it belongs to another node of the cluster). Points
+// already on their way to the database may be in neither.
+func (r *Receiver) Unflushed(ident serde.Ident) rrd.DataSourcer {
+	cds := r.dsc.getByIdent(newCachedIdent(mungeIdent(r.NameMunger, ident)))
+	if cds == nil {
+		return nil
+	}
+
+	cds.mu.Lock()
+	defer cds.mu.Unlock()
+
+	if cds.Id() == 0 { // not loaded yet
+		return nil
+	}
+
+	ds := cds.DbDataSourcer.Copy()
+	vr, _ := r.flusher.(vcacheReader)
+	for _, rra := range ds.RRAs() {
+		dbrra, ok := rra.(serde.DbRoundRobinArchiver)
+		if vr == nil || !ok {
+			continue
+		}
+		// What is in memory is more recent than the vcache.
+		dps := rra.DPs()
+		for i, v := range vr.cachedDps(dbrra) {
+			if _, ok := dps[i]; !ok {
+				dps[i] = v
+			}
+		}
+	}
+	return ds
+}
+
+type dsFlusherSync interface {
+	flushDs(serde.DbDataSourcer) error
+}
+
+// FlushDataSource processes the data points queued for the DS named
+// name and writes it to the database, returning once it is written
+// rather than at the next flush, e.g. so that a test can read back
+// what it just sent. An error is returned if the DS is not in the
+// cache of this node (yet).
+func (r *Receiver) FlushDataSource(name string) error {
+	ident := mungeIdent(r.NameMunger, serde.Ident{"name": name})
+	cds := r.dsc.getByIdent(newCachedIdent(ident))
+	if cds == nil {
+		return fmt.Errorf("FlushDataSource: %q is not in the cache", name)
+	}
+
+	cds.mu.Lock()
+	if cds.Id() == 0 {
+		cds.mu.Unlock()
+		return fmt.Errorf("FlushDataSource: %q is not loaded yet", name)
+	}
+	cds.lastProcess = time.Time{} // do not delay, see processIncoming()
+	cds.mu.Unlock()
+
+	if _, _, err := cds.processIncoming(); err != nil && debug {
+		log.Printf("FlushDataSource [%v] error: %v", ident, err)
+	}
+
+	cds.mu.Lock()
+	r.flusher.flushToVCache(cds.DbDataSourcer)
+	cds.lastFlush = time.Now()
+	cds.mu.Unlock()
+
+	if fs, ok := r.flusher.(dsFlusherSync); ok {
+		return fs.flushDs(cds.DbDataSourcer)
+	}
+	return nil
+}
+
 // Sends a data point to the receiver channel. A Data Source PDP
 // always treats incoming data as a rate, it is the responsibility of
 // the caller to present non-rate values such as counters as a
@@ -219,6 +365,13 @@ func (r *Receiver) DsCache() *dsCache {
 // paced metrics (QueueSum/QueueGauge) for non-rate data.
 func (r *Receiver) QueueDataPoint(ident serde.Ident, ts time.Time, v float64) {
 	if !r.stopped {
+		if r.tee != nil {
+			r.tee.send(ident, ts, v)
+		}
+		ident = mungeIdent(r.NameMunger, ident)
+		if r.wal != nil {
+			r.wal.append(ident, ts, v)
+		}
 		r.dpChIn <- &incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: ts, value: v}
 	}
 }
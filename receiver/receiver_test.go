@@ -23,12 +23,15 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/memberlist"
 	"github.com/tgres/tgres/aggregator"
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 )
 
@@ -110,6 +113,113 @@ func Test_Receiver_QueueDataPoint(t *testing.T) {
 	}
 }
 
+func Test_Receiver_Unflushed(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	spec := rrd.DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour, Latest: start},
+		},
+	}
+	ds := rrd.NewDataSource(spec)
+	bds := &benchDs{DataSourcer: ds, rras: []rrd.RoundRobinArchiver{&benchRRA{ds.RRAs()[0], 0, 3}}}
+	cds := &cachedDs{
+		DbDataSourcer: serde.NewDbDataSource(7, serde.Ident{"name": "foo"}, 0, 3, bds),
+		mu:            &sync.Mutex{},
+	}
+
+	dsf := &dsFlusher{db: &benchFlusher{}, sr: &fakeSr{}}
+	dsf.vcache = &verticalCache{
+		Mutex:   &sync.Mutex{},
+		dps:     make(map[bundleKey]*verticalCacheSegment),
+		dss:     make(map[int64]*dsStateSegment),
+		minStep: time.Hour,
+	}
+	r := &Receiver{dsc: newDsCache(nil, nil, dsf), flusher: dsf}
+
+	if r.Unflushed(serde.Ident{"name": "foo"}) != nil {
+		t.Errorf("Unflushed: expected nil for a DS not in the cache")
+	}
+	r.dsc.insert(cds)
+
+	// 3 slots in the vcache, then 2 more in memory
+	for i := 1; i <= 5; i++ {
+		cds.ProcessDataPoint(float64(i), start.Add(time.Duration(i)*10*time.Second))
+		if i == 3 {
+			dsf.flushToVCache(cds.DbDataSourcer)
+		}
+	}
+
+	uds := r.Unflushed(serde.Ident{"name": "foo"})
+	if uds == nil {
+		t.Fatalf("Unflushed: expected a DS")
+	}
+	rra := uds.RRAs()[0]
+	got := make(map[float64]bool)
+	for _, v := range rra.DPs() {
+		got[v] = true
+	}
+	if len(rra.DPs()) != 5 || len(got) != 5 || !got[1] || !got[5] {
+		t.Errorf("Unflushed: expected points 1 through 5, got %v", rra.DPs())
+	}
+	if len(cds.RRAs()[0].DPs()) != 2 {
+		t.Errorf("Unflushed: the cached DS must not be modified, got %v", cds.RRAs()[0].DPs())
+	}
+}
+
+func Test_Receiver_FlushDataSource(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	spec := rrd.DSSpec{
+		Step: 10 * time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: 10 * time.Second, Span: time.Hour, Latest: start},
+		},
+	}
+	ds := rrd.NewDataSource(spec)
+	bds := &benchDs{DataSourcer: ds, rras: []rrd.RoundRobinArchiver{&benchRRA{ds.RRAs()[0], 0, 3}}}
+	ident := serde.Ident{"name": "foo"}
+	cds := &cachedDs{
+		DbDataSourcer: serde.NewDbDataSource(7, ident, 0, 3, bds),
+		mu:            &sync.Mutex{},
+		lastProcess:   time.Now(), // processIncoming() would wait
+	}
+
+	db := &slowFlusher{}
+	dsf := &dsFlusher{db: db, sr: &fakeSr{}}
+	var flusherWg, startWg sync.WaitGroup
+	dsf.start(&flusherWg, &startWg, time.Hour, 2)
+	startWg.Wait()
+	r := &Receiver{dsc: newDsCache(nil, nil, dsf), flusher: dsf}
+
+	if err := r.FlushDataSource("foo"); err == nil {
+		t.Errorf("FlushDataSource: expected an error for a DS not in the cache")
+	}
+	r.dsc.insert(cds)
+
+	for i := 1; i <= 3; i++ {
+		cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: start.Add(time.Duration(i) * 10 * time.Second), value: float64(i)})
+	}
+	if err := r.FlushDataSource("foo"); err != nil {
+		t.Errorf("FlushDataSource: %v", err)
+	}
+	// a row of data points per slot, the RRA state and the DS state
+	if n := atomic.LoadInt64(&db.flushed); n != 3+2 {
+		t.Errorf("FlushDataSource: expected 5 flushes done, got %d", n)
+	}
+	if uds := r.Unflushed(ident); len(uds.RRAs()[0].DPs()) != 0 {
+		t.Errorf("FlushDataSource: expected nothing left unflushed, got %v", uds.RRAs()[0].DPs())
+	}
+
+	db.fail = true
+	cds.appendIncoming(&incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: start.Add(40 * time.Second), value: 4})
+	if err := r.FlushDataSource("foo"); err == nil {
+		t.Errorf("FlushDataSource: expected an error when the flush fails")
+	}
+
+	close(dsf.dbCh)
+	flusherWg.Wait()
+}
+
 func Test_Receiver_QueueAggregatorCommand(t *testing.T) {
 	r := &Receiver{aggCh: make(chan *aggregator.Command)}
 	called := 0
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/serde"
 )
 
 type wrkCtl struct {
@@ -47,6 +48,19 @@ var startAllWorkers = func(r *Receiver, startWg *sync.WaitGroup) {
 }
 
 var doStart = func(r *Receiver) {
+	if r.WALDir != "" {
+		var err error
+		if r.wal, err = openWAL(r.WALDir); err != nil {
+			log.Printf("Receiver: error opening the WAL in %q, running without it: %v", r.WALDir, err)
+		}
+	}
+
+	if r.TeeAddr != "" {
+		startTee(r)
+	}
+
+	r.dsc.names = r.NameValidator
+
 	log.Printf("Receiver: Caching data source definitions...")
 	start := time.Now()
 	if err := r.dsc.preLoad(); err != nil {
@@ -67,15 +81,65 @@ var doStart = func(r *Receiver) {
 	startWg.Add(1)
 	go director(&wrkCtl{wg: &r.directorWg, startWg: &startWg, id: "director"}, r.dpChIn,
 		r.dpChOut, r.NWorkers, r.cluster, r, r.dsc, r.flusher, r.queue,
-		r.MaxReceiverQueueSize, r.MaxMemoryBytes)
+		r.MaxReceiverQueueSize, r.MaxMemoryBytes, r.MaxFlushBacklog, r.MaxFutureSkew, newDpDedup(r.DedupWindow, r.DedupMaxPoints))
 	startWg.Wait()
 
+	if r.wal != nil {
+		startWAL(r)
+	}
+
 	log.Printf("Receiver: Starting runtime cpu/mem reporter.")
 	go reportRuntime(r)
 
 	log.Printf("Receiver: Ready.")
 }
 
+// Replays the WAL left by the previous run, if any, and starts the
+// walWorker.
+var startWAL = func(r *Receiver) {
+	log.Printf("Receiver: replaying the WAL in %q...", r.WALDir)
+	n, err := r.wal.replayAll(func(ident serde.Ident, ts time.Time, v float64) {
+		r.dpChIn <- &incomingDP{cachedIdent: newCachedIdent(ident), timeStamp: ts, value: v}
+	})
+	if err != nil {
+		log.Printf("Receiver: error replaying the WAL: %v", err)
+	}
+	log.Printf("Receiver: replayed %d data points from the WAL.", n)
+
+	fs, _ := r.flusher.(flushSyncer)
+	r.walStopCh = make(chan bool)
+	r.walWg.Add(1)
+	go walWorker(r.wal, fs, r, r.WALCheckpointInterval, r.WALRetain, r.walStopCh, &r.walWg)
+}
+
+// The segments are left in place, they are only replayed, which
+// rejects what was flushed already, once they age out they are
+// removed.
+var stopWAL = func(r *Receiver) {
+	log.Printf("stopWAL(): stopping the WAL worker...")
+	close(r.walStopCh)
+	r.walWg.Wait()
+	if err := r.wal.close(); err != nil {
+		log.Printf("stopWAL(): error closing the WAL: %v", err)
+	}
+	log.Printf("stopWAL(): WAL closed.")
+}
+
+var startTee = func(r *Receiver) {
+	log.Printf("Receiver: forwarding incoming data points to %s (up to %d buffered).", r.TeeAddr, r.TeeBufferSize)
+	t := newTee(r.TeeAddr, r.TeeBufferSize)
+	r.teeWg.Add(1)
+	go teeWorker(t, r, &r.teeWg)
+	r.tee = t
+}
+
+var stopTee = func(r *Receiver) {
+	log.Printf("stopTee(): waiting for the tee to finish...")
+	r.tee.stop()
+	r.teeWg.Wait()
+	log.Printf("stopTee(): tee finished.")
+}
+
 var stopDirector = func(r *Receiver) {
 	log.Printf("Closing director channel...")
 	r.dpChIn <- nil // signal to close
@@ -85,9 +149,15 @@ var stopDirector = func(r *Receiver) {
 
 var doStop = func(r *Receiver, clstr clusterer) {
 	// Order matters here
+	if r.wal != nil && r.walStopCh != nil {
+		stopWAL(r) // uses the flushers
+	}
 	stopPacedMetricWorker(r.pacedMetricCh, &r.pacedMetricWg)
 	stopAggWorker(r.aggCh, &r.aggWg)
 	stopDirector(r)
+	if r.tee != nil {
+		stopTee(r) // after the last aggregator flush
+	}
 	stopFlushers(r.flusher, &r.flusherWg)
 	log.Printf("Leaving cluster...")
 	clstr.Leave(1 * time.Second)
@@ -126,13 +196,17 @@ var startFlushers = func(r *Receiver, startWg *sync.WaitGroup) {
 	// }
 
 	log.Printf("Starting flusher(s)...")
-	r.flusher.start(&r.flusherWg, startWg, r.MinStep, r.NWorkers*2)
+	n := r.NFlushers
+	if n == 0 {
+		n = r.NWorkers * 2
+	}
+	r.flusher.start(&r.flusherWg, startWg, r.MinStep, n)
 }
 
 var startAggWorker = func(r *Receiver, startWg *sync.WaitGroup) {
 	log.Printf("Starting aggWorker...")
 	startWg.Add(1)
-	go aggWorker(&wrkCtl{wg: &r.aggWg, startWg: startWg, id: "aggWorker"}, r.aggCh, r.cluster, r.StatFlushDuration, r.StatsNamePrefix, r, r)
+	go aggWorker(&wrkCtl{wg: &r.aggWg, startWg: startWg, id: "aggWorker"}, r.aggCh, r.cluster, r.StatFlushDuration, r.StatFlushAlign, r.StatsNamePrefix, r, r)
 }
 
 var startPacedMetricWorker = func(r *Receiver, startWg *sync.WaitGroup) {
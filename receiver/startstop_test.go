@@ -62,7 +62,7 @@ func Test_startstop_doStart(t *testing.T) {
 	called := 0
 	stopped := false
 	director = func(wc wController, dpChIn chan<- interface{}, dpChOut <-chan interface{}, nWorkers int, clstr clusterer, sr statReporter, dsc *dsCache,
-		dsf dsFlusherBlocking, queue *fifoQueue, maxQLen int, maxMem uint64) {
+		dsf dsFlusherBlocking, queue *fifoQueue, maxQLen int, maxMem uint64, maxBacklog int, maxFuture time.Duration, dedup *dpDedup) {
 		wc.onEnter()
 		defer wc.onExit()
 		called++
@@ -184,7 +184,7 @@ func Test_startstop_stopAggWorker(t *testing.T) {
 func Test_startstop_startAggWorker(t *testing.T) {
 	started := 0
 	saveAW := aggWorker
-	aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clusterer, statFlushDuration time.Duration, statsNamePrefix string, scr statReporter, dpq *Receiver) {
+	aggWorker = func(wc wController, aggCh chan *aggregator.Command, clstr clusterer, statFlushDuration, statFlushAlign time.Duration, statsNamePrefix string, scr statReporter, dpq *Receiver) {
 		wc.onEnter()
 		defer wc.onExit()
 		started++
@@ -0,0 +1,176 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// The tee forwards every incoming data point, as received (before
+// the NameMunger), to another Graphite (Carbon) in the plaintext
+// protocol, e.g. to write to both while migrating:
+//
+//   foo.bar 1.5 1500000000
+//
+// The points are buffered in memory up to a limit, while the
+// upstream cannot keep up or is down (it is reconnected to with a
+// backoff), beyond it they are dropped, as are those which were being
+// written when the connection failed. Dropped points are reported as
+// receiver.tee.dropped.
+type tee struct {
+	addr    string
+	ch      chan string
+	dropped int64 // atomic
+	dial    func(addr string) (net.Conn, error)
+	stopCh  chan bool
+}
+
+func newTee(addr string, size int) *tee {
+	return &tee{
+		addr:   addr,
+		ch:     make(chan string, size),
+		stopCh: make(chan bool),
+		dial: func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, 5*time.Second)
+		},
+	}
+}
+
+// Never blocks, a point which does not fit in the buffer is dropped.
+func (t *tee) send(ident serde.Ident, ts time.Time, v float64) {
+	name, ok := ident["name"]
+	if !ok {
+		return
+	}
+	line := name + " " + strconv.FormatFloat(v, 'f', -1, 64) + " " + strconv.FormatInt(ts.Unix(), 10) + "\n"
+	select {
+	case t.ch <- line:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *tee) stop() {
+	close(t.stopCh)
+}
+
+const (
+	teeMinRetry = time.Second
+	teeMaxRetry = 30 * time.Second
+)
+
+// teeWorker writes the points to the upstream until the tee is
+// stopped, at which point whatever is buffered is written if the
+// upstream is connected, and dropped otherwise.
+var teeWorker = func(t *tee, sr statReporter, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var (
+		conn    net.Conn
+		w       *bufio.Writer
+		pending int64 // written to w since the last successful flush
+		retry   time.Duration
+	)
+
+	report := func() {
+		if n := atomic.SwapInt64(&t.dropped, 0); n > 0 {
+			sr.reportStatCount("receiver.tee.dropped", float64(n))
+		}
+	}
+
+	flush := func() {
+		if err := w.Flush(); err != nil {
+			log.Printf("teeWorker: error writing to %s, dropping %d points: %v", t.addr, pending, err)
+			atomic.AddInt64(&t.dropped, pending)
+			conn.Close()
+			conn = nil
+		}
+		pending = 0
+	}
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		if conn == nil {
+			var err error
+			if conn, err = t.dial(t.addr); err != nil {
+				if retry == 0 {
+					log.Printf("teeWorker: cannot connect to %s, buffering points: %v", t.addr, err)
+					retry = teeMinRetry
+				} else {
+					retry *= 2
+					if retry > teeMaxRetry {
+						retry = teeMaxRetry
+					}
+				}
+				timer := time.NewTimer(retry)
+			wait:
+				for {
+					select {
+					case <-t.stopCh:
+						timer.Stop()
+						log.Printf("teeWorker: stopped, %d points not sent to %s.", len(t.ch), t.addr)
+						return
+					case <-tick.C:
+						report()
+					case <-timer.C:
+						break wait
+					}
+				}
+				continue
+			}
+			if retry > 0 {
+				log.Printf("teeWorker: connected to %s.", t.addr)
+			}
+			retry = 0
+			w = bufio.NewWriter(conn)
+		}
+
+		select {
+		case <-t.stopCh:
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			for n := len(t.ch); n > 0; n-- {
+				w.WriteString(<-t.ch)
+				pending++
+			}
+			flush()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		case <-tick.C:
+			report()
+			if w.Buffered() > 0 {
+				flush()
+			}
+		case line := <-t.ch:
+			w.WriteString(line)
+			pending++
+			if len(t.ch) == 0 {
+				flush()
+			}
+		}
+	}
+}
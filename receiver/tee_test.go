@@ -0,0 +1,108 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func Test_tee_send(t *testing.T) {
+	tee := newTee("localhost:2003", 2)
+	ts := time.Unix(1500000000, 0)
+	tee.send(serde.Ident{"name": "foo.bar"}, ts, 1.5)
+	tee.send(serde.Ident{"host": "x"}, ts, 1) // no name, ignored
+	tee.send(serde.Ident{"name": "foo.baz;dc=east", "dc": "east"}, ts, -2)
+	tee.send(serde.Ident{"name": "foo.full"}, ts, 3)
+
+	if line := <-tee.ch; line != "foo.bar 1.5 1500000000\n" {
+		t.Errorf("Unexpected line: %q", line)
+	}
+	if line := <-tee.ch; line != "foo.baz;dc=east -2 1500000000\n" {
+		t.Errorf("Unexpected line: %q", line)
+	}
+	if tee.dropped != 1 {
+		t.Errorf("Expected 1 point dropped for the buffer being full, got %d", tee.dropped)
+	}
+}
+
+func Test_teeWorker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			received <- sc.Text()
+		}
+	}()
+
+	// The first dial fails, the points are buffered meanwhile
+	tee := newTee(ln.Addr().String(), 10)
+	var dials int32
+	dial := tee.dial
+	tee.dial = func(addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, fmt.Errorf("refused")
+		}
+		return dial(addr)
+	}
+
+	ts := time.Unix(1500000000, 0)
+	for i := 0; i < 3; i++ {
+		tee.send(serde.Ident{"name": "foo.bar"}, ts.Add(time.Duration(i)*time.Second), float64(i))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go teeWorker(tee, &fakeSr{}, &wg)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case line := <-received:
+			if exp := fmt.Sprintf("foo.bar %d %d", i, 1500000000+i); line != exp {
+				t.Errorf("Expected %q, got %q", exp, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for point %d", i)
+		}
+	}
+
+	tee.stop()
+	wg.Wait()
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("Expected 2 dials, got %d", n)
+	}
+	if tee.dropped != 0 {
+		t.Errorf("Expected nothing dropped, got %d", tee.dropped)
+	}
+}
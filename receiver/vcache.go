@@ -18,6 +18,7 @@ package receiver
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tgres/tgres/rrd"
@@ -70,9 +71,16 @@ type verticalCache struct {
 	dps     map[bundleKey]*verticalCacheSegment
 	dss     map[int64]*dsStateSegment // keyed on seg
 	minStep time.Duration
+	points  int64 // as of last flush, use backlog() (atomic)
 	*sync.Mutex
 }
 
+// Number of data points in the cache after the most recent flush,
+// i.e. those the db flushers could not take yet.
+func (vc *verticalCache) backlog() int {
+	return int(atomic.LoadInt64(&vc.points))
+}
+
 // Insert new data into the cache
 func (vc *verticalCache) updateDps(rra serde.DbRoundRobinArchiver) {
 
@@ -102,7 +110,7 @@ func (vc *verticalCache) updateDps(rra serde.DbRoundRobinArchiver) {
 
 	for i, v := range rra.DPs() {
 		if len(segment.rows[i]) == 0 {
-			segment.rows[i] = make(map[int64]float64, serde.PgSegmentWidth)
+			segment.rows[i] = make(map[int64]float64, rra.Width())
 		}
 		if !math.IsNaN(v) { // With versions NaNs can be ignored.
 			segment.rows[i][idx] = v
@@ -121,6 +129,30 @@ func (vc *verticalCache) updateDps(rra serde.DbRoundRobinArchiver) {
 	segment.Unlock()
 }
 
+// Returns a copy of the data points of rra which are in the cache,
+// i.e. not yet flushed to the database, keyed by slot index.
+func (vc *verticalCache) rraDps(rra serde.DbRoundRobinArchiver) map[int64]float64 {
+
+	vc.Lock()
+	segment := vc.dps[bundleKey{rra.BundleId(), rra.Seg()}]
+	vc.Unlock()
+
+	result := make(map[int64]float64)
+	if segment == nil {
+		return result
+	}
+
+	segment.Lock()
+	defer segment.Unlock()
+	idx := rra.Idx()
+	for i, dps := range segment.rows {
+		if v, ok := dps[idx]; ok {
+			result[i] = v
+		}
+	}
+	return result
+}
+
 // Update DS state data
 func (vc *verticalCache) updateDss(ds serde.DbDataSourcer) {
 
@@ -184,12 +216,21 @@ func (vc *verticalCache) stats() *vcStats {
 // When full is false (most of the time), all this does is queue up
 // a bunch of flush requests. No actual DB requests happen here.
 func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
+	return vc.flushOnly(ch, full, nil, nil)
+}
+
+// Same as flush(), but if segs or dsSegs are not nil, only the RRA
+// segments in segs and the DS state segments in dsSegs.
+func (vc *verticalCache) flushOnly(ch chan *vDpFlushRequest, full bool, segs map[bundleKey]bool, dsSegs map[int64]bool) *vcStats {
 
 	dpFlushes, dpFlushedPoints, dpFlushBlocked, dsFlushes, rsFlushes := 0, 0, 0, 0, 0
-	toFlush := make(map[bundleKey]*verticalCacheSegment, len(vc.dps))
 
 	vc.Lock()
+	toFlush := make(map[bundleKey]*verticalCacheSegment, len(vc.dps))
 	for key, segment := range vc.dps {
+		if segs != nil && !segs[key] {
+			continue
+		}
 		now := time.Now()
 		if !full && (now.Sub(segment.lastFlushRT) < vc.minStep) {
 			continue
@@ -252,7 +293,7 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 				continue
 			}
 
-			dfr := &vDpFlushRequest{key.bundleId, key.seg, i, dps, flushIVers, nil, nil, nil, nil}
+			dfr := &vDpFlushRequest{key.bundleId, key.seg, i, dps, flushIVers, nil, nil, nil, nil, nil}
 
 			if full { // insist, even if we block
 				ch <- dfr
@@ -294,7 +335,7 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 		}
 		if (len(flushLatests) + len(segment.duration) + len(segment.value)) > 0 {
 			// unlike dps, insist on a blocking operation
-			ch <- &vDpFlushRequest{key.bundleId, key.seg, 0, nil, nil, lat, nil, dur, val}
+			ch <- &vDpFlushRequest{key.bundleId, key.seg, 0, nil, nil, lat, nil, dur, val, nil}
 			rsFlushes += 1
 		}
 
@@ -310,6 +351,9 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 
 	vc.Lock()
 	for seg, segment := range vc.dss {
+		if dsSegs != nil && !dsSegs[seg] {
+			continue
+		}
 		now := time.Now()
 		if !full && (now.Sub(segment.lastFlushRT) < (vc.minStep * 2)) {
 			continue
@@ -336,7 +380,7 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 			for k, v := range segment.value {
 				val[k] = interface{}(v)
 			}
-			ch <- &vDpFlushRequest{0, seg, 0, nil, nil, nil, lu, dur, val}
+			ch <- &vDpFlushRequest{0, seg, 0, nil, nil, nil, lu, dur, val, nil}
 			dsFlushes += 1
 
 			// Clear out the segment
@@ -351,6 +395,7 @@ func (vc *verticalCache) flush(ch chan *vDpFlushRequest, full bool) *vcStats {
 	}
 
 	st := vc.stats()
+	atomic.StoreInt64(&vc.points, int64(st.dpPoints))
 	st.dpFlushes = dpFlushes
 	st.dpFlushedPoints = dpFlushedPoints
 	st.dpFlushBlocked = dpFlushBlocked
@@ -370,23 +415,13 @@ type iVer struct {
 }
 
 func (iv *iVer) version(i int64) int {
-	version := iv.ver
-	if i > iv.i {
-		version--
-		if version < 0 {
-			version = 32767
-		}
-	}
-	return version
+	return serde.SlotVersion(i, iv.i, iv.ver)
 }
 
 func latestIVers(latests map[int64]time.Time, step time.Duration, size int64) map[int64]*iVer {
 	result := make(map[int64]*iVer, len(latests))
 	for idx, latest := range latests {
-		i := rrd.SlotIndex(latest, step, size)
-		span_ms := (step.Nanoseconds() / 1e6) * size
-		latest_ms := latest.UnixNano() / 1e6
-		ver := int((latest_ms / span_ms) % 32767)
+		i, ver := serde.LatestVersion(latest, step, size)
 		result[idx] = &iVer{i: i, ver: ver}
 	}
 	return result
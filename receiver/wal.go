@@ -0,0 +1,369 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+// The WAL (write-ahead log) records every incoming data point in a
+// file before it is cached, so that the points which have not been
+// flushed to the database yet can be replayed after a crash. It is a
+// series of segment files in a directory, only the last one of which
+// is written to. Periodically (checkpoint) a new segment is started
+// and the segments which are certain to have been flushed are
+// removed.
+//
+// Every line of a segment is a data point: the time stamp in
+// nanoseconds, the value and the ident as JSON, e.g.:
+//
+//   1500000000000000000 1.5 {"name":"foo.bar"}
+//
+// Replaying points which have been flushed already does no harm,
+// they are older than the last update of the DS and are rejected.
+type wal struct {
+	dir string
+
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	seq    int64
+	closed []*walSegment // oldest first
+	replay []*walSegment // found by openWAL()
+	errors int
+	// appended while no segment was open, see rotate()
+	dropped int64
+	stopped bool // by close()
+}
+
+type walSegment struct {
+	path     string
+	closedAt time.Time
+	pinned   bool // not to be removed by this process
+}
+
+const walPrefix = "wal."
+
+func walPath(dir string, seq int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d", walPrefix, seq))
+}
+
+// Opens the WAL in dir, creating it if needed, and starts a new
+// segment. The segments already present are to be replayed.
+func openWAL(dir string) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{dir: dir}
+	var seqs []int64
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), walPrefix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimPrefix(fi.Name(), walPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	now := time.Now()
+	for _, seq := range seqs {
+		seg := &walSegment{path: walPath(dir, seq), closedAt: now}
+		w.closed = append(w.closed, seg)
+		w.replay = append(w.replay, seg)
+		w.seq = seq
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.openSegment(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Must be called with the lock held.
+func (w *wal) openSegment() error {
+	w.seq++
+	f, err := os.OpenFile(walPath(w.dir, w.seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.f, w.w = f, bufio.NewWriterSize(f, 64*1024)
+	return nil
+}
+
+func (w *wal) append(ident serde.Ident, ts time.Time, v float64) {
+	js, _ := json.Marshal(ident) // map[string]string cannot fail
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.w == nil {
+		if !w.stopped {
+			w.dropped++
+		}
+		return
+	}
+	w.w.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	w.w.WriteByte(' ')
+	w.w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	w.w.WriteByte(' ')
+	w.w.Write(js)
+	if err := w.w.WriteByte('\n'); err != nil {
+		if w.errors == 0 {
+			log.Printf("wal: error writing to %s: %v", w.f.Name(), err)
+		}
+		w.errors++
+	}
+}
+
+// Writes out the buffer and fsyncs the current segment.
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *wal) syncLocked() error {
+	if w.w == nil {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Closes the current segment and starts a new one. A new one is
+// started even if closing the current one failed. If starting it
+// failed (there is no current segment), it is tried again on every
+// rotate, in the meantime append() drops the points.
+func (w *wal) rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return nil
+	}
+	var err error
+	if w.w != nil {
+		err = w.closeLocked()
+	}
+	if oerr := w.openSegment(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// Returns the number of points dropped by append() since the last
+// call.
+func (w *wal) takeDropped() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := w.dropped
+	w.dropped = 0
+	return n
+}
+
+func (w *wal) closeLocked() error {
+	err := w.syncLocked()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.closed = append(w.closed, &walSegment{path: w.f.Name(), closedAt: time.Now()})
+	w.f, w.w = nil, nil
+	return err
+}
+
+// Closes the WAL, after which append() does nothing.
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.w == nil {
+		return nil
+	}
+	return w.closeLocked()
+}
+
+// Marks all the closed segments as not to be removed, e.g. because
+// a flush failed and their points may not be in the database.
+func (w *wal) pin() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, seg := range w.closed {
+		seg.pinned = true
+	}
+}
+
+// Removes the segments closed before t, unless pinned, and returns
+// how many.
+func (w *wal) remove(t time.Time) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var keep []*walSegment
+	var n int
+	for _, seg := range w.closed {
+		if seg.pinned || !seg.closedAt.Before(t) {
+			keep = append(keep, seg)
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("wal: error removing %s: %v", seg.path, err)
+			keep = append(keep, seg)
+			continue
+		}
+		n++
+	}
+	w.closed = keep
+	return n
+}
+
+// Passes every data point of the segments found by openWAL() to
+// queue in the order they were written, and returns their number.
+// Lines which cannot be parsed, such as the last one if it was cut
+// short by the crash, are skipped.
+func (w *wal) replayAll(queue func(serde.Ident, time.Time, float64)) (int, error) {
+	var total, bad int
+	for _, seg := range w.replay {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return total, err
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			ident, ts, v, err := parseWALLine(sc.Bytes())
+			if err != nil {
+				bad++
+				continue
+			}
+			queue(ident, ts, v)
+			total++
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return total, fmt.Errorf("%s: %v", seg.path, err)
+		}
+	}
+	if bad > 0 {
+		log.Printf("wal: skipped %d unparseable lines.", bad)
+	}
+	w.replay = nil
+	return total, nil
+}
+
+func parseWALLine(line []byte) (serde.Ident, time.Time, float64, error) {
+	parts := bytes.SplitN(line, []byte(" "), 3)
+	if len(parts) != 3 {
+		return nil, time.Time{}, 0, fmt.Errorf("invalid wal line: %q", line)
+	}
+	ns, err := strconv.ParseInt(string(parts[0]), 10, 64)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	v, err := strconv.ParseFloat(string(parts[1]), 64)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	var ident serde.Ident
+	if err := json.Unmarshal(parts[2], &ident); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	return ident, time.Unix(0, ns), v, nil
+}
+
+// A flushSyncer can wait for all flushes queued so far to be done,
+// see dsFlusher.sync().
+type flushSyncer interface {
+	sync()
+	failures() int64
+}
+
+// Fsyncs the WAL every second. Every interval it starts a new segment,
+// waits for the flushers to write everything queued so far, and
+// removes the segments closed more than retain before that, which is
+// how long a point may stay in memory before it is flushed. If any
+// flush failed since the last checkpoint, the segments closed so far
+// are kept until the next start, when they are replayed. The points
+// not written because a new segment could not be started are
+// reported as receiver.wal.dropped.
+var walWorker = func(w *wal, fs flushSyncer, sr statReporter, interval, retain time.Duration, stopCh chan bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var failures int64
+	if fs != nil {
+		failures = fs.failures()
+	}
+
+	syncTick := time.NewTicker(time.Second)
+	defer syncTick.Stop()
+	checkpoint := time.NewTicker(interval)
+	defer checkpoint.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-syncTick.C:
+			if err := w.sync(); err != nil {
+				log.Printf("wal: sync error: %v", err)
+			}
+		case <-checkpoint.C:
+			if n := w.takeDropped(); n > 0 {
+				log.Printf("wal: dropped %d data points, no segment was open.", n)
+				sr.reportStatCount("receiver.wal.dropped", float64(n))
+			}
+			if err := w.rotate(); err != nil {
+				log.Printf("wal: error starting a new segment: %v", err)
+				continue
+			}
+			if fs == nil {
+				continue
+			}
+			start := time.Now()
+			fs.sync()
+			if f := fs.failures(); f != failures {
+				log.Printf("wal: flushes failed since the last checkpoint, keeping the wal for replay on the next start.")
+				w.pin()
+				failures = f
+				continue
+			}
+			if n := w.remove(start.Add(-retain)); n > 0 && debug {
+				log.Printf("wal: removed %d segments.", n)
+			}
+		}
+	}
+}
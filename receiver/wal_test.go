@@ -0,0 +1,270 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package receiver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/serde"
+)
+
+func walFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, walPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func Test_wal_replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Unix(1500000000, 123)
+	w.append(serde.Ident{"name": "foo"}, when, 1)
+	w.append(serde.Ident{"name": "bar", "tag": `a "quoted" one`}, when.Add(time.Second), 2.5)
+	if err := w.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	w.append(serde.Ident{"name": "foo"}, when.Add(2*time.Second), math.NaN())
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+	w.append(serde.Ident{"name": "foo"}, when.Add(3*time.Second), 3) // ignored after close
+
+	files := walFiles(t, dir)
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 segments, got %v", files)
+	}
+	// a line cut short by a crash
+	f, _ := os.OpenFile(files[1], os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("1500000003000000000 4 {\"na")
+	f.Close()
+
+	w, err = openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	var got []string
+	n, err := w.replayAll(func(ident serde.Ident, ts time.Time, v float64) {
+		got = append(got, fmt.Sprintf("%v %v %v", ident, ts.Sub(when), v))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		`{"name": "foo"} 0s 1`,
+		`{"name": "bar","tag": "a \"quoted\" one"} 1s 2.5`,
+		`{"name": "foo"} 2s NaN`,
+	}
+	if n != len(expect) || fmt.Sprint(got) != fmt.Sprint(expect) {
+		t.Errorf("Expected %d points %v, got %d %v", len(expect), expect, n, got)
+	}
+	if files := walFiles(t, dir); len(files) != 3 {
+		t.Errorf("Expected a new (third) segment, got %v", files)
+	}
+}
+
+func Test_wal_remove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	w.rotate()
+	w.pin()
+	w.rotate()
+	if n := w.remove(time.Now().Add(time.Second)); n != 1 {
+		t.Errorf("Expected 1 segment (of 2 closed, 1 pinned) removed, got %d", n)
+	}
+	if n := w.remove(time.Now().Add(-time.Minute)); n != 0 {
+		t.Errorf("Expected no segments closed a minute ago, got %d", n)
+	}
+	if files := walFiles(t, dir); len(files) != 2 {
+		t.Errorf("Expected the pinned and the current segments to remain, got %v", files)
+	}
+}
+
+// A serde.Flusher whose flushes take a while and fail when asked to.
+type slowFlusher struct {
+	flushed int64
+	fail    bool
+}
+
+func (f *slowFlusher) flush() (int, error) {
+	time.Sleep(time.Millisecond)
+	atomic.AddInt64(&f.flushed, 1)
+	if f.fail {
+		return 0, fmt.Errorf("failed")
+	}
+	return 1, nil
+}
+
+func (f *slowFlusher) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return f.flush()
+}
+func (f *slowFlusher) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error) {
+	return f.flush()
+}
+func (f *slowFlusher) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return f.flush()
+}
+
+// A failed rotate leaves no segment open, the next one starts one.
+func Test_wal_rotateRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	// the next segment exists already, opening it fails
+	if err := ioutil.WriteFile(walPath(dir, w.seq+1), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.rotate(); err == nil {
+		t.Fatal("Expected an error starting a new segment")
+	}
+	w.append(serde.Ident{"name": "dropped"}, time.Unix(1000, 0), 1)
+	if n := w.takeDropped(); n != 1 {
+		t.Errorf("Expected 1 dropped point, got %d", n)
+	}
+
+	if err := w.rotate(); err != nil {
+		t.Fatalf("Expected a new segment, got %v", err)
+	}
+	w.append(serde.Ident{"name": "kept"}, time.Unix(1001, 0), 2)
+	if err := w.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.takeDropped(); n != 0 {
+		t.Errorf("Expected no dropped points, got %d", n)
+	}
+	if data, err := ioutil.ReadFile(walPath(dir, w.seq)); err != nil || len(data) == 0 {
+		t.Errorf("Expected the point in %s, got %q (%v)", walPath(dir, w.seq), data, err)
+	}
+
+	w.close()
+	w.append(serde.Ident{"name": "closed"}, time.Unix(1002, 0), 3)
+	if err := w.rotate(); err != nil || w.w != nil || w.takeDropped() != 0 {
+		t.Errorf("Expected a closed WAL to stay closed and not count points, got %v", err)
+	}
+}
+
+func Test_dsFlusher_sync(t *testing.T) {
+	db := &slowFlusher{}
+	f := &dsFlusher{db: db, sr: &fakeSr{}}
+	var flusherWg, startWg sync.WaitGroup
+	f.start(&flusherWg, &startWg, time.Hour, 3)
+	startWg.Wait()
+
+	for i := 0; i < 20; i++ {
+		f.dbCh <- &vDpFlushRequest{seg: 1, lastupdate: map[int64]interface{}{1: time.Now()}}
+	}
+	f.sync()
+	if n := atomic.LoadInt64(&db.flushed); n != 20 {
+		t.Errorf("Expected all 20 flushes done after sync(), got %d", n)
+	}
+	if f.failures() != 0 {
+		t.Errorf("Expected no failures, got %d", f.failures())
+	}
+
+	db.fail = true
+	f.dbCh <- &vDpFlushRequest{seg: 1, lastupdate: map[int64]interface{}{1: time.Now()}}
+	f.sync()
+	if f.failures() != 1 {
+		t.Errorf("Expected 1 failure, got %d", f.failures())
+	}
+
+	close(f.dbCh)
+	flusherWg.Wait()
+}
+
+type fakeFlushSyncer struct {
+	syncs, failed int64
+}
+
+func (f *fakeFlushSyncer) sync()           { atomic.AddInt64(&f.syncs, 1) }
+func (f *fakeFlushSyncer) failures() int64 { return atomic.LoadInt64(&f.failed) }
+
+func Test_walWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := openWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	fs := &fakeFlushSyncer{}
+	stopCh := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go walWorker(w, fs, &fakeSr{}, 10*time.Millisecond, 0, stopCh, &wg)
+
+	time.Sleep(55 * time.Millisecond)
+	atomic.StoreInt64(&fs.failed, 1) // the segments closed by now must stay
+	time.Sleep(55 * time.Millisecond)
+	close(stopCh)
+	wg.Wait()
+
+	if atomic.LoadInt64(&fs.syncs) < 2 {
+		t.Errorf("Expected the flushers synced at every checkpoint, got %d", fs.syncs)
+	}
+	var pinned int
+	for _, seg := range w.closed {
+		if seg.pinned {
+			pinned++
+		}
+	}
+	if pinned == 0 || pinned != len(walFiles(t, dir))-1 {
+		t.Errorf("Expected only the pinned and current segments to remain, got %d pinned of %v", pinned, walFiles(t, dir))
+	}
+}
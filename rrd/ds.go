@@ -18,23 +18,27 @@ package rrd
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 	"time"
 )
 
 // DataSource contains a time series and its parameters, RRAs and
 // intermediate state (PDP). The DS PDP is the smallest unit of
 // accumulation for this series, all RRAs should have PDPs that are a
-// multiple of the DS PDP. The DS PDP supports only weighted mean as
-// its consolidation function. The reason for not supporting
-// min/max/last/avg (at least initially) is that additional state is
-// required to maintain those, while it seems like that is better done
-// in other places, e.g. the Aggregator anyhow.
+// multiple of the DS PDP. The data points within a DS PDP are
+// consolidated using weighted mean, unless the coalescing (see
+// SetCoalescing()) is MAX, MIN or LAST. An (unweighted) average is
+// not supported because additional state (the count) is required to
+// maintain it, while it seems like that is better done in other
+// places, e.g. the Aggregator anyhow.
 type DataSource struct {
 	Pdp
 	step       time.Duration        // Step (PDP) size
 	heartbeat  time.Duration        // Heartbeat is inactivity period longer than this causes NaN values. 0 -> no heartbeat.
 	lastUpdate time.Time            // Last time we received an update (series time - can be in the past or future)
 	rras       []RoundRobinArchiver // Array of Round Robin Archives
+	coalesce   Consolidation        // How data points within a PDP are consolidated
 }
 
 // DataSourcer is a DataSource as an interface.
@@ -49,7 +53,10 @@ type DataSourcer interface {
 	BestRRA(start, end time.Time, points int64) RoundRobinArchiver
 	PointCount() int
 	ClearRRAs()
+	RollUp()
 	ProcessDataPoint(value float64, ts time.Time) error
+	Coalescing() Consolidation
+	SetCoalescing(cf Consolidation) error
 	Spec() DSSpec
 }
 
@@ -65,6 +72,7 @@ func NewDataSource(spec DSSpec) *DataSource {
 			duration: spec.Duration,
 		},
 	}
+	result.SetCoalescing(spec.Coalesce) // an invalid one is WMEAN
 
 	for _, rspec := range spec.RRAs {
 		rra := NewRoundRobinArchive(rspec)
@@ -107,6 +115,29 @@ func (ds *DataSource) Heartbeat() time.Duration { return ds.heartbeat }
 // LastUpdate returns the timestamp of the last Data Point processed
 func (ds *DataSource) LastUpdate() time.Time { return ds.lastUpdate }
 
+// Coalescing returns the consolidation of the data points within a
+// PDP, see SetCoalescing().
+func (ds *DataSource) Coalescing() Consolidation { return ds.coalesce }
+
+// SetCoalescing sets how the data points within a PDP (i.e.
+// arriving within the same step) are consolidated into it before it
+// is sent to the RRAs. WMEAN (the default) is the time-weighted mean,
+// a point counting for the time since the previous one. MAX, MIN and
+// LAST are the maximum, minimum and last of the points, e.g. for
+// gauges updated many times per step. Unlike WMEAN, these also take
+// into account further points at the same time as the previous one,
+// as long as the PDP has not yet been completed (by a point at the
+// end of the step). SUM is not valid, the DS PDP is a rate. The
+// coalescing does not matter when the heartbeat is 0.
+func (ds *DataSource) SetCoalescing(cf Consolidation) error {
+	switch cf {
+	case WMEAN, MAX, MIN, LAST:
+		ds.coalesce = cf
+		return nil
+	}
+	return fmt.Errorf("Invalid coalescing: %v, must be WMEAN, MAX, MIN or LAST", cf)
+}
+
 // List of Round Robin Archives this Data Source has
 func (ds *DataSource) RRAs() []RoundRobinArchiver { return ds.rras }
 
@@ -124,6 +155,7 @@ func (ds *DataSource) Copy() DataSourcer {
 		heartbeat:  ds.heartbeat,
 		lastUpdate: ds.lastUpdate,
 		rras:       make([]RoundRobinArchiver, len(ds.rras)),
+		coalesce:   ds.coalesce,
 	}
 	for n, rra := range ds.rras {
 		newDs.rras[n] = rra.Copy()
@@ -248,7 +280,7 @@ func (ds *DataSource) updateRange(begin, end time.Time, value float64) {
 			periodBegin := begin
 			periodEnd := begin.Truncate(ds.step).Add(ds.step)
 			offset := periodEnd.Sub(begin)
-			ds.AddValue(value, offset)
+			ds.addValue(value, offset)
 
 			// Update the RRAs
 			ds.updateRRAs(periodBegin, periodEnd)
@@ -288,7 +320,42 @@ func (ds *DataSource) updateRange(begin, end time.Time, value float64) {
 	// If there is still a small part of an incomlete PDP between
 	// begin and end, update the PDP value.
 	if begin.Before(end) {
-		ds.AddValue(value, end.Sub(begin))
+		ds.addValue(value, end.Sub(begin))
+	}
+}
+
+// Adds value of duration dur to the PDP according to the
+// coalescing. A point of no duration (at the same time as the
+// previous one) only counts if the PDP is not empty and the
+// coalescing is not WMEAN.
+func (ds *DataSource) addValue(value float64, dur time.Duration) {
+	if dur == 0 {
+		if ds.duration == 0 || math.IsNaN(value) {
+			return
+		}
+		switch ds.coalesce {
+		case MAX:
+			if value > ds.value {
+				ds.value = value
+			}
+		case MIN:
+			if value < ds.value {
+				ds.value = value
+			}
+		case LAST:
+			ds.value = value
+		}
+		return
+	}
+	switch ds.coalesce {
+	case MAX:
+		ds.AddValueMax(value, dur)
+	case MIN:
+		ds.AddValueMin(value, dur)
+	case LAST:
+		ds.AddValueLast(value, dur)
+	default:
+		ds.AddValue(value, dur)
 	}
 }
 
@@ -324,7 +391,9 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 			value = math.NaN()
 		}
 
-		if !ds.lastUpdate.IsZero() { // Do not update a never-before-updated DS
+		if ts.Equal(ds.lastUpdate) {
+			ds.addValue(value, 0) // see SetCoalescing()
+		} else if !ds.lastUpdate.IsZero() { // Do not update a never-before-updated DS
 			ds.updateRange(ds.lastUpdate, ts, value)
 		}
 	}
@@ -336,6 +405,9 @@ func (ds *DataSource) ProcessDataPoint(value float64, ts time.Time) error {
 
 func (ds *DataSource) updateRRAs(periodBegin, periodEnd time.Time) {
 	for _, rra := range ds.rras {
+		if rra.RollsUp() {
+			continue // see RollUp()
+		}
 		// If this is a multi ds.step update and the step of the RRA
 		// exceeds the interval, we cheat and send a larger duration
 		// once instead of iterating and updating in ds.step
@@ -349,6 +421,69 @@ func (ds *DataSource) updateRRAs(periodBegin, periodEnd time.Time) {
 	}
 }
 
+// RollUp updates the roll-up RRAs (those with RollUp in their spec)
+// with the data points of the RRA with the smallest step of those
+// which are not, the source. Since incoming data points only update
+// the other RRAs, ingestion has less to do, and nothing is counted
+// twice: a roll-up RRA consolidates (using its own consolidation
+// function and XFF) the source data points, themselves already
+// consolidated, rather than the DS PDPs (a SUM of a SUM source adds
+// up its totals). The step of a roll-up RRA should be a multiple of
+// that of the source.
+//
+// The source data points are all taken to be new, i.e. this is
+// meant to be called immediately before ClearRRAs(), once per flush,
+// so that every one of them is rolled up exactly once. Missing source
+// data points are unknown. Only the complete slots of the source are
+// rolled up, its PDP will be at the next flush.
+func (ds *DataSource) RollUp() {
+	var src RoundRobinArchiver
+	for _, rra := range ds.rras {
+		if !rra.RollsUp() && (src == nil || rra.Step() < src.Step()) {
+			src = rra
+		}
+	}
+	if src == nil || src.Latest().IsZero() {
+		return
+	}
+
+	// the source slots in time order
+	ends := make([]time.Time, 0, len(src.DPs()))
+	for i := range src.DPs() {
+		ends = append(ends, SlotTime(i, src.Latest(), src.Step(), src.Size()))
+	}
+	sort.Slice(ends, func(i, j int) bool { return ends[i].Before(ends[j]) })
+
+	for _, rra := range ds.rras {
+		if !rra.RollsUp() || rra.Step() <= src.Step() {
+			continue
+		}
+		// a SUM source value is a total, not a rate
+		scale := 1.0
+		if rra.Spec().Function == SUM && src.Spec().Function == SUM {
+			scale = 1 / src.Step().Seconds()
+		}
+		cursor := rra.Latest()
+		for _, end := range ends {
+			begin := end.Add(-src.Step())
+			if begin.Before(cursor) {
+				continue // already rolled up
+			}
+			if cursor.IsZero() {
+				cursor = begin
+			}
+			if cursor.Before(begin) {
+				rra.update(cursor, begin, math.NaN(), 0)
+			}
+			rra.update(begin, end, src.DPs()[SlotIndex(end, src.Step(), src.Size())]*scale, src.Step())
+			cursor = end
+		}
+		if !cursor.IsZero() && cursor.Before(src.Latest()) {
+			rra.update(cursor, src.Latest(), math.NaN(), 0)
+		}
+	}
+}
+
 // ClearRRAs clears the data in all RRAs. It is meant to be called
 // immedately after flushing the DS to permanent storage.
 func (ds *DataSource) ClearRRAs() {
@@ -375,6 +510,7 @@ func (ds *DataSource) Spec() DSSpec {
 		Step:      ds.step,
 		Heartbeat: ds.heartbeat,
 		RRAs:      make([]RRASpec, len(ds.rras)),
+		Coalesce:  ds.coalesce,
 	}
 	for i, rra := range ds.rras {
 		spec.RRAs[i] = rra.Spec()
@@ -395,4 +531,62 @@ type DSSpec struct {
 	LastUpdate time.Time
 	Value      float64
 	Duration   time.Duration
+
+	// If not nil, incoming values are rounded before they are
+	// processed. Unlike the rest of the spec this is not stored
+	// with the DS, the receiver looks it up every time the DS is
+	// loaded.
+	Round *Rounding
+
+	// The consolidation of the data points within a PDP, see
+	// SetCoalescing(). Like Round, it is not stored with the DS.
+	Coalesce Consolidation
+
+	// If not 0, the receiver keeps this many of the most recent data
+	// points processed by the DS, along with the RRA slots each of
+	// them completed, for debugging. This is expensive, it is meant
+	// for a few DSs at a time. Like Round, it is not stored with the
+	// DS.
+	Audit int
+
+	// If true, the receiver writes the data points processed by the
+	// DS to the database right away and waits for it, rather than at
+	// the next flush (every step at most), so that little is lost if
+	// Tgres crashes. This costs a round trip per batch of points and
+	// holds up the other DSs of the worker meanwhile, it is meant for
+	// a few critical series. Like Round, it is not stored with the DS.
+	WriteThrough bool
+}
+
+// Rounding of incoming values to Digits decimal places or, if
+// Significant is true, to Digits significant figures. Sensors often
+// report far more digits than they are accurate to, rounding them
+// away before consolidation reduces the noise that gets stored.
+type Rounding struct {
+	Digits      int
+	Significant bool
+}
+
+// Round returns v rounded, NaN and Inf are returned as is.
+func (r *Rounding) Round(v float64) float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	var s string
+	if r.Significant {
+		if r.Digits < 1 {
+			return v
+		}
+		s = strconv.FormatFloat(v, 'e', r.Digits-1, 64)
+	} else {
+		s = strconv.FormatFloat(v, 'f', r.Digits, 64)
+	}
+	// going through the decimal representation results in the
+	// float closest to the rounded value, e.g. 0.3 and not
+	// 0.30000000000000004
+	rv, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return v
+	}
+	return rv
 }
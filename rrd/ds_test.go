@@ -384,6 +384,47 @@ func Test_DataSource_ProcessDataPoint_HB0(t *testing.T) {
 	}
 }
 
+func Test_DataSource_ProcessDataPoint_coalesce(t *testing.T) {
+	for cf, exp := range map[Consolidation]float64{
+		WMEAN: 3.4, // 5*0.2 + 1*0.2 + 3*0.2 + 4*0.4, the second point at 104 does not count
+		MAX:   9,
+		MIN:   1,
+		LAST:  4,
+	} {
+		ds := NewDataSource(DSSpec{
+			Step:      10 * time.Second,
+			Heartbeat: 60 * time.Second,
+			RRAs:      []RRASpec{{Step: 20 * time.Second, Span: 200 * time.Second}},
+			Coalesce:  cf,
+		})
+		for _, dp := range []struct {
+			v float64
+			t int64
+		}{{100, 100}, {5, 102}, {1, 104}, {9, 104}, {math.NaN(), 104}, {3, 106}, {4, 110}, {20, 110}} {
+			if err := ds.ProcessDataPoint(dp.v, time.Unix(dp.t, 0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The PDP is complete at 110 and was sent to the RRA, the
+		// second point at 110 is too late.
+		rra := ds.RRAs()[0]
+		if v := rra.Value(); math.Abs(v-exp) > 1e-9 || rra.Duration() != 10*time.Second || ds.Duration() != 0 {
+			t.Errorf("%v: expected %v, got %v (duration %v)", cf, exp, v, rra.Duration())
+		}
+		if ds.Coalescing() != cf || ds.Spec().Coalesce != cf || ds.Copy().Coalescing() != cf {
+			t.Errorf("%v: coalescing not kept", cf)
+		}
+	}
+
+	ds := NewDataSource(DSSpec{Step: 10 * time.Second, Coalesce: SUM})
+	if ds.Coalescing() != WMEAN {
+		t.Errorf("Expected the invalid SUM to be WMEAN, got %v", ds.Coalescing())
+	}
+	if err := ds.SetCoalescing(SUM); err == nil {
+		t.Errorf("Expected an error for SUM")
+	}
+}
+
 func Test_DataSource_ClearRRAs(t *testing.T) {
 
 	ds := &DataSource{step: 10 * time.Second}
@@ -409,6 +450,103 @@ func Test_DataSource_ClearRRAs(t *testing.T) {
 	}
 }
 
+func Test_DataSource_RollUp(t *testing.T) {
+
+	start := time.Unix(1500000000, 0).Truncate(time.Minute)
+	ds := NewDataSource(DSSpec{
+		Step:       10 * time.Second,
+		Heartbeat:  time.Hour,
+		LastUpdate: start,
+		RRAs: []RRASpec{
+			RRASpec{Function: WMEAN, Step: 10 * time.Second, Span: time.Hour},
+			RRASpec{Function: WMEAN, Step: time.Minute, Span: time.Hour},
+			RRASpec{Function: WMEAN, Step: time.Minute, Span: time.Hour, RollUp: true},
+			RRASpec{Function: MAX, Step: time.Minute, Span: time.Hour, RollUp: true},
+		},
+	})
+
+	// four minutes of points, flushed every 50s, i.e. not on the
+	// roll-up slot boundaries
+	perPoint, mean, max := map[int64]float64{}, map[int64]float64{}, map[int64]float64{}
+	flush := func() {
+		ds.RollUp()
+		for k, v := range ds.RRAs()[1].DPs() {
+			perPoint[k] = v
+		}
+		for k, v := range ds.RRAs()[2].DPs() {
+			mean[k] = v
+		}
+		for k, v := range ds.RRAs()[3].DPs() {
+			max[k] = v
+		}
+		ds.ClearRRAs()
+	}
+	for i := 1; i <= 24; i++ {
+		if err := ds.ProcessDataPoint(float64(i), start.Add(time.Duration(i)*10*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if i < 5 && (ds.RRAs()[2].PointCount() > 0 || ds.RRAs()[2].Duration() > 0) {
+			t.Fatalf("RollUp: a roll-up RRA must not be updated by data points")
+		}
+		if i%5 == 0 {
+			flush()
+		}
+	}
+	flush()
+
+	if len(perPoint) != 4 || !reflect.DeepEqual(mean, perPoint) {
+		t.Errorf("RollUp: expected the WMEAN roll-up %v to equal the per-point %v", mean, perPoint)
+	}
+	for n := int64(1); n <= 4; n++ {
+		slot := SlotIndex(start.Add(time.Duration(n)*time.Minute), time.Minute, 60)
+		if max[slot] != float64(n*6) {
+			t.Errorf("RollUp: expected %v max in minute %d, got %v", n*6, n, max[slot])
+		}
+	}
+}
+
+func Test_DataSource_subSecond(t *testing.T) {
+
+	step := 100 * time.Millisecond
+	start := time.Unix(1500000000, 0)
+	ds := NewDataSource(DSSpec{
+		Step:       step,
+		Heartbeat:  time.Minute,
+		LastUpdate: start,
+		RRAs: []RRASpec{
+			RRASpec{Function: WMEAN, Step: step, Span: time.Second},
+			RRASpec{Function: WMEAN, Step: 5 * step, Span: 5 * time.Second},
+		},
+	})
+
+	for i := 1; i <= 10; i++ {
+		if err := ds.ProcessDataPoint(float64(i), start.Add(time.Duration(i)*step)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dps := ds.RRAs()[0].DPs()
+	if len(dps) != 10 {
+		t.Errorf("subSecond: expected 10 distinct slots, got %v", dps)
+	}
+	for i := 1; i <= 10; i++ {
+		if n := SlotIndex(start.Add(time.Duration(i)*step), step, 10); dps[n] != float64(i) {
+			t.Errorf("subSecond: expected %d in slot %d, got %v", i, n, dps[n])
+		}
+	}
+	dps = ds.RRAs()[1].DPs()
+	for i, exp := range []float64{3, 8} {
+		if n := SlotIndex(start.Add(time.Duration(i+1)*5*step), 5*step, 10); dps[n] != exp {
+			t.Errorf("subSecond: expected %v in slot %d, got %v", exp, n, dps[n])
+		}
+	}
+
+	// a step which is not a whole number of milliseconds
+	if n := SlotIndex(time.Unix(0, 3000000), 1500*time.Microsecond, 10); n != 2 {
+		t.Errorf("SlotIndex: expected 2, got %d", n)
+	}
+}
+
 func Test_DataSource_Copy(t *testing.T) {
 
 	ds := &DataSource{
@@ -429,3 +567,28 @@ func Test_DataSource_Copy(t *testing.T) {
 		t.Errorf("Copy: !reflect.DeepEqual(ds, cpy)")
 	}
 }
+
+func Test_Rounding_Round(t *testing.T) {
+	for _, c := range []struct {
+		r      Rounding
+		v, exp float64
+	}{
+		{Rounding{Digits: 2}, 3.14159265358979, 3.14},
+		{Rounding{Digits: 2}, -2.675000001, -2.68},
+		{Rounding{Digits: 0}, 41.6, 42},
+		{Rounding{Digits: 1}, 0.29999999999999, 0.3},
+		{Rounding{Digits: 3, Significant: true}, 123456.789, 123000},
+		{Rounding{Digits: 3, Significant: true}, 0.000123456, 0.000123},
+		{Rounding{Digits: 2, Significant: true}, -98.76, -99},
+		{Rounding{Digits: 2, Significant: true}, 0, 0},
+		{Rounding{Digits: 0, Significant: true}, 1.2345, 1.2345},
+	} {
+		if got := c.r.Round(c.v); got != c.exp {
+			t.Errorf("%+v: Round(%v): expected %v, got %v", c.r, c.v, c.exp, got)
+		}
+	}
+	r := &Rounding{Digits: 2}
+	if !math.IsNaN(r.Round(math.NaN())) || !math.IsInf(r.Round(math.Inf(-1)), -1) {
+		t.Errorf("Round: NaN and Inf must be returned as is")
+	}
+}
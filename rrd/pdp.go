@@ -140,6 +140,19 @@ func (p *Pdp) AddValueLast(val float64, dur time.Duration) {
 	}
 }
 
+// AddValueSum adds val multiplied by the duration in seconds. Since
+// values are rates (per second), the result is the total, e.g. the
+// number of events in the PDP duration for a counter.
+func (p *Pdp) AddValueSum(val float64, dur time.Duration) {
+	if !math.IsNaN(val) && dur > 0 {
+		if math.IsNaN(p.value) || p.duration == 0 {
+			p.value = 0
+		}
+		p.value += val * dur.Seconds()
+		p.duration = p.duration + dur
+	}
+}
+
 // Reset sets the value to zero value and returns the value of
 // the PDP before Reset.
 func (p *Pdp) Reset() float64 {
@@ -27,6 +27,7 @@ const (
 	MAX                        // Max
 	MIN                        // Min
 	LAST                       // Last
+	SUM                        // Sum, i.e. value * seconds, see Pdp.AddValueSum()
 )
 
 // A Round Robin Archive and all its parameters.
@@ -38,7 +39,7 @@ type RoundRobinArchive struct {
 	Pdp
 	// Consolidation function (CF). How data points from a
 	// higher-resolution RRA are aggregated into a lower-resolution
-	// one. Must be WMEAN, MAX, MIN, LAST. Note that since the DS PDP
+	// one. Must be WMEAN, MAX, MIN, LAST or SUM. Note that since the DS PDP
 	// is always WMEAN, the RRA CF is limited to that value. E.g. MAX
 	// is not a true maximum, but the maximum of the DS PDPs, which in
 	// turn, are WMEAN.
@@ -64,6 +65,10 @@ type RoundRobinArchive struct {
 	// then NaN a 0 weight, and thus simply ignores it, not
 	// contradicting any rules.
 	xff float32
+	// A roll-up RRA is not updated by incoming data points like the
+	// others, but from the data points of the finest (non-roll-up)
+	// RRA of the DS, see DataSource.RollUp().
+	rollUp bool
 
 	// The list of data points (as a map so that it's sparse). Slots in
 	// dps are time-aligned starting at zero time. This means that if
@@ -84,6 +89,7 @@ type RoundRobinArchiver interface {
 	Copy() RoundRobinArchiver
 	Begins(now time.Time) time.Time
 	Spec() RRASpec
+	RollsUp() bool
 
 	// A side benefit from these being unexported is that you can only
 	// satisfy this interface by including this implementation
@@ -101,6 +107,10 @@ func (rra *RoundRobinArchive) Step() time.Duration { return rra.step }
 // Number of data points in this RRA
 func (rra *RoundRobinArchive) Size() int64 { return rra.size }
 
+// RollsUp tells whether this RRA is consolidated from the finest RRA
+// of the DS rather than from the DS PDP.
+func (rra *RoundRobinArchive) RollsUp() bool { return rra.rollUp }
+
 // Dps returns data points as a map of floats. It's a map rather than
 // a slice to be more space-efficient for sparse series.
 func (rra *RoundRobinArchive) DPs() map[int64]float64 { return rra.dps }
@@ -112,6 +122,7 @@ func NewRoundRobinArchive(spec RRASpec) *RoundRobinArchive {
 		step:   spec.Step,
 		size:   spec.Span.Nanoseconds() / spec.Step.Nanoseconds(),
 		xff:    spec.Xff,
+		rollUp: spec.RollUp,
 		latest: spec.Latest,
 		Pdp: Pdp{
 			value:    spec.Value,
@@ -134,6 +145,7 @@ func (rra *RoundRobinArchive) Copy() RoundRobinArchiver {
 		size:   rra.size,
 		latest: rra.latest,
 		xff:    rra.xff,
+		rollUp: rra.rollUp,
 		dps:    make(map[int64]float64, len(rra.dps)),
 	}
 	for k, v := range rra.dps {
@@ -166,6 +178,7 @@ func (rra *RoundRobinArchive) Spec() RRASpec {
 		Step:     rra.step,
 		Span:     time.Duration(rra.size) * rra.step,
 		Xff:      rra.xff,
+		RollUp:   rra.rollUp,
 	}
 }
 
@@ -215,6 +228,8 @@ func (rra *RoundRobinArchive) update(periodBegin, periodEnd time.Time, value flo
 			rra.AddValueMin(value, duration)
 		case LAST:
 			rra.AddValueLast(value, duration)
+		case SUM:
+			rra.AddValueSum(value, duration)
 		}
 
 		// if end of slot, move PDP into its place in dps.
@@ -261,9 +276,10 @@ func (rra *RoundRobinArchive) clear() {
 
 // Given a slot timestamp, RRA step and size, return the slot's
 // (0-based) index in the data points array. Size of zero causes a
-// division by zero panic.
+// division by zero panic. The math is in nanoseconds so that steps
+// of less than a second (or a millisecond) index correctly.
 func SlotIndex(slotEnd time.Time, step time.Duration, size int64) int64 {
-	return ((slotEnd.UnixNano() / 1e6) / (step.Nanoseconds() / 1e6)) % size
+	return (slotEnd.UnixNano() / step.Nanoseconds()) % size
 }
 
 // Distance between i and j indexes in an RRA. If i > j (the RRA wraps
@@ -287,6 +303,7 @@ type RRASpec struct {
 	Step     time.Duration // duration of a single step
 	Span     time.Duration // duration of the whole series (should be multiple of step)
 	Xff      float32
+	RollUp   bool // consolidated from the finest RRA, see DataSource.RollUp()
 
 	// These can be used to fill the initial value
 	Latest   time.Time
@@ -128,6 +128,8 @@ func Test_RoundRobinArchive_update(t *testing.T) {
 	// 16:                      +---UU-+ 30, 40, 6  => {0:NaN},          NaN, 0s // xff 0.7
 	// 17:               +-----+  v: NaN 20, 30, 9  => {0:0},            NaN, 0s // partial NaN == NOOP
 	// 18:               +------+ v: NaN 20, 30, 10 => {0:NaN},          NaN, 0s // full NaN == NaN
+	// 19:  SUM          +--+     val 5  20, 24, 4  =>     {},            20, 4s
+	// 20:                  +---+ keep   24, 30, 6  => {3:320},          NaN, 0s
 	//     |------|------|------|------|
 
 	step := 10 * time.Second
@@ -306,6 +308,24 @@ func Test_RoundRobinArchive_update(t *testing.T) {
 			rraDps: map[int64]float64{}, //{3: math.NaN()},
 			rraVal: 0,
 			rraDur: 0},
+		19: { // SUM
+			cf:     SUM,
+			begin:  time.Unix(20, 0),
+			end:    time.Unix(24, 0),
+			dsVal:  5,
+			dsDur:  4 * time.Second,
+			rraDps: map[int64]float64{},
+			rraVal: 20,
+			rraDur: 4 * time.Second},
+		20: {
+			keep:   true,
+			begin:  time.Unix(24, 0),
+			end:    time.Unix(30, 0),
+			dsVal:  50,
+			dsDur:  6 * time.Second,
+			rraDps: map[int64]float64{3: 320},
+			rraVal: 0,
+			rraDur: 0},
 	}
 
 	var rra *RoundRobinArchive
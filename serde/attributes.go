@@ -0,0 +1,158 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+func (p *pgvSerDe) SetAttributes(id int64, attrs map[string]string) error {
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	js, err := json.Marshal(attrs)
+	if err != nil {
+		return dbError("SetAttributes", err)
+	}
+
+	stmt := fmt.Sprintf("UPDATE %[1]sds SET attrs = $1 WHERE id = $2", p.prefix)
+	res, err := p.dbConn.Exec(stmt, js, id)
+	if err != nil {
+		log.Printf("SetAttributes(): %v", err)
+		return dbError("SetAttributes", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return newError("SetAttributes", ErrNotFound, "no DS with id %d", id)
+	}
+	return nil
+}
+
+func (p *pgvSerDe) GetAttributes(id int64) (map[string]string, error) {
+
+	var js []byte
+	stmt := fmt.Sprintf("SELECT attrs FROM %[1]sds WHERE id = $1", p.prefix)
+	if err := p.dbConn.QueryRow(stmt, id).Scan(&js); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newError("GetAttributes", ErrNotFound, "no DS with id %d", id)
+		}
+		log.Printf("GetAttributes(): %v", err)
+		return nil, dbError("GetAttributes", err)
+	}
+
+	attrs := make(map[string]string)
+	if err := json.Unmarshal(js, &attrs); err != nil {
+		return nil, dbError("GetAttributes", err)
+	}
+	return attrs, nil
+}
+
+// FetchAttributes returns the attributes of the DSs by ident (keyed
+// by Ident.String()) in a single query, DSs without any attributes
+// (or which do not exist) are omitted.
+func (p *pgvSerDe) FetchAttributes(idents []Ident) (map[string]map[string]string, error) {
+	result := make(map[string]map[string]string)
+	if len(idents) == 0 {
+		return result, nil
+	}
+	ijs, err := json.Marshal(idents)
+	if err != nil {
+		return nil, dbError("FetchAttributes", err)
+	}
+
+	stmt := fmt.Sprintf(`
+  SELECT ident, attrs
+    FROM %[1]sds
+   WHERE ident IN (SELECT jsonb_array_elements($1::jsonb)) AND attrs <> '{}'`, p.prefix)
+	rows, err := p.dbConn.Query(stmt, string(ijs))
+	if err != nil {
+		log.Printf("FetchAttributes(): %v", err)
+		return nil, dbError("FetchAttributes", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ijs, ajs []byte
+		if err := rows.Scan(&ijs, &ajs); err != nil {
+			log.Printf("FetchAttributes(): %v", err)
+			return nil, dbError("FetchAttributes", err)
+		}
+		var ident Ident
+		attrs := make(map[string]string)
+		if err := json.Unmarshal(ijs, &ident); err != nil {
+			return nil, dbError("FetchAttributes", err)
+		}
+		if err := json.Unmarshal(ajs, &attrs); err != nil {
+			return nil, dbError("FetchAttributes", err)
+		}
+		result[ident.String()] = attrs
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("FetchAttributes", err)
+	}
+	return result, nil
+}
+
+func (m *memSerDe) SetAttributes(id int64, attrs map[string]string) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, ds := range m.byIdent {
+		if ds.Id() == id {
+			cp := make(map[string]string, len(attrs))
+			for k, v := range attrs {
+				cp[k] = v
+			}
+			m.attrs[id] = cp
+			return nil
+		}
+	}
+	return newError("SetAttributes", ErrNotFound, "no DS with id %d", id)
+}
+
+func (m *memSerDe) GetAttributes(id int64) (map[string]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, ds := range m.byIdent {
+		if ds.Id() == id {
+			result := make(map[string]string, len(m.attrs[id]))
+			for k, v := range m.attrs[id] {
+				result[k] = v
+			}
+			return result, nil
+		}
+	}
+	return nil, newError("GetAttributes", ErrNotFound, "no DS with id %d", id)
+}
+
+func (m *memSerDe) FetchAttributes(idents []Ident) (map[string]map[string]string, error) {
+	m.RLock()
+	defer m.RUnlock()
+	result := make(map[string]map[string]string)
+	for _, ident := range idents {
+		ds := m.byIdent[ident.String()]
+		if ds == nil || len(m.attrs[ds.Id()]) == 0 {
+			continue
+		}
+		attrs := make(map[string]string, len(m.attrs[ds.Id()]))
+		for k, v := range m.attrs[ds.Id()] {
+			attrs[k] = v
+		}
+		result[ident.String()] = attrs
+	}
+	return result, nil
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_pgvSerDe_Attributes(t *testing.T) {
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+	foo, bar := Ident{"name": "foo"}, Ident{"name": "bar"}
+	bundles.idents = map[int64]Ident{1: foo, 2: bar}
+	bundles.attrs = map[int64][]byte{1: []byte("{}"), 2: []byte("{}")}
+	bundles.queries = make(map[string]int)
+
+	if err := p.SetAttributes(1, map[string]string{"units": "bytes"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetAttributes(3, nil); !IsNotFound(err) {
+		t.Errorf("Expected not found for an unknown DS, got %v", err)
+	}
+	attrs, err := p.GetAttributes(1)
+	if err != nil || len(attrs) != 1 || attrs["units"] != "bytes" {
+		t.Errorf("Expected the units, got %v: %v", attrs, err)
+	}
+	if attrs, err := p.GetAttributes(2); err != nil || attrs == nil || len(attrs) != 0 {
+		t.Errorf("Expected empty attributes, got %v: %v", attrs, err)
+	}
+	if _, err := p.GetAttributes(3); !IsNotFound(err) {
+		t.Errorf("Expected not found for an unknown DS, got %v", err)
+	}
+
+	all, err := p.FetchAttributes([]Ident{foo, bar, {"name": "baz"}})
+	if err != nil || bundles.queries["attrs"] != 1 {
+		t.Fatalf("Expected a single query, got %v: %v", bundles.queries, err)
+	}
+	if len(all) != 1 || all[foo.String()]["units"] != "bytes" {
+		t.Errorf("Expected only the attributes of foo, got %v", all)
+	}
+	if all, err := p.FetchAttributes(nil); err != nil || len(all) != 0 || bundles.queries["attrs"] != 1 {
+		t.Errorf("Expected no query for no idents, got %v %v: %v", all, bundles.queries, err)
+	}
+}
+
+func Test_memSerDe_Attributes(t *testing.T) {
+	db := NewMemSerDe()
+	spec := &rrd.DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour}
+	foo, bar := Ident{"name": "foo"}, Ident{"name": "bar"}
+	ds, _ := db.FetchOrCreateDataSource(foo, spec)
+	db.FetchOrCreateDataSource(bar, spec)
+	id := ds.(DbDataSourcer).Id()
+
+	in := map[string]string{"units": "bytes"}
+	if err := db.SetAttributes(id, in); err != nil {
+		t.Fatal(err)
+	}
+	in["units"] = "bits" // a copy is stored
+	if attrs, err := db.GetAttributes(id); err != nil || attrs["units"] != "bytes" {
+		t.Errorf("Expected the units, got %v: %v", attrs, err)
+	}
+	if err := db.SetAttributes(123, in); !IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+	if _, err := db.GetAttributes(123); !IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+
+	all, err := db.FetchAttributes([]Ident{foo, bar, {"name": "baz"}})
+	if err != nil || len(all) != 1 || all[foo.String()]["units"] != "bytes" {
+		t.Errorf("Expected only the attributes of foo, got %v: %v", all, err)
+	}
+}
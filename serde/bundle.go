@@ -0,0 +1,252 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// QueryBundle returns the data points between from and until of all
+// the RRAs in the segment seg of the bundle bundleId, keyed by their
+// idx and then slot, as in rrd.RRASpec.DPs. The versions of the slots
+// are checked against the latest of every RRA as stored in
+// rra_state.
+func (p *pgvSerDe) QueryBundle(bundleId, seg int64, from, until time.Time) (map[int64]map[int64]float64, error) {
+	stmt := `
+  SELECT rb.step_ms, rb.size, l.idx, l.latest
+    FROM %[1]srra_bundle rb
+    JOIN %[1]srra_state rs ON rs.rra_bundle_id = rb.id
+   CROSS JOIN LATERAL unnest(rs.latest) WITH ORDINALITY AS l(latest, idx)
+   WHERE rb.id = $1 AND rs.seg = $2 AND l.latest IS NOT NULL
+`
+	rows, err := p.readQuery("QueryBundle", p.dbConn, fmt.Sprintf(stmt, p.prefix), bundleId, seg)
+	if err != nil {
+		log.Printf("QueryBundle: error %v", err)
+		return nil, dbError("QueryBundle", err)
+	}
+	defer rows.Close()
+
+	var (
+		stepMs, size, idx int64
+		latest, maxLatest time.Time
+		vers              = make(map[int64]slotVersion)
+		result            = make(map[int64]map[int64]float64)
+	)
+	for rows.Next() {
+		if err := rows.Scan(&stepMs, &size, &idx, &latest); err != nil {
+			log.Printf("QueryBundle: error scanning %v", err)
+			return nil, dbError("QueryBundle", err)
+		}
+		if latest.IsZero() { // no data
+			continue
+		}
+		step := time.Duration(stepMs) * time.Millisecond
+		latestI, latestVer := LatestVersion(latest, step, size)
+		vers[idx] = slotVersion{latestI, latestVer}
+		result[idx] = make(map[int64]float64)
+		if latest.After(maxLatest) {
+			maxLatest = latest
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, dbError("QueryBundle", err)
+	}
+	rows.Close()
+
+	slots := slotsInRange(maxLatest, time.Duration(stepMs)*time.Millisecond, size, from, until)
+	if len(slots) == 0 {
+		return result, nil
+	}
+	err = p.queryBundleRows("QueryBundle", bundleId, seg, slots, nil, func(i, idx int64, val *float64, ver *int64) {
+		if v, ok := vers[idx]; ok {
+			addVersionedDP(result[idx], i, val, ver, v.latestI, v.latestVer)
+		}
+	})
+	if err != nil {
+		return nil, dbError("QueryBundle", err)
+	}
+	return result, nil
+}
+
+// The latest slot index and version of an RRA, see LatestVersion().
+type slotVersion struct {
+	latestI   int64
+	latestVer int
+}
+
+// Reads every non-empty data point in the rows slots of the segment,
+// of only the RRAs at idxs unless it is nil. Each row of ts is read
+// once, however many of the RRAs there are.
+func (p *pgvSerDe) queryBundleRows(op string, bundleId, seg int64, slots, idxs []int64, fn func(i, idx int64, val *float64, ver *int64)) error {
+	stmt := `
+  SELECT ts.i, d.idx, d.dp, ts.ver[d.idx]
+    FROM %[1]sts ts
+   CROSS JOIN LATERAL unnest(ts.dp) WITH ORDINALITY AS d(dp, idx)
+   WHERE ts.rra_bundle_id = $1 AND ts.seg = $2 AND ts.i = ANY($3::int[])
+     AND ($4::int[] IS NULL OR d.idx = ANY($4::int[]))
+     AND d.dp IS NOT NULL AND d.dp <> 'NaN'
+`
+	rows, err := p.readQuery(op, p.dbConn, fmt.Sprintf(stmt, p.prefix), bundleId, seg, pq.Array(slots), pq.Array(idxs))
+	if err != nil {
+		log.Printf("%s: error %v", op, err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			i, idx int64
+			val    *float64
+			ver    *int64
+		)
+		if err = rows.Scan(&i, &idx, &val, &ver); err != nil {
+			log.Printf("%s: error scanning %v", op, err)
+			return err
+		}
+		fn(i, idx, val, ver)
+	}
+	return rows.Err()
+}
+
+// The time range of the data points to read for the RRAs at ns (of
+// rras) from to to: it is widened by a step, and by the group by of
+// maxPoints after to, as an RRASeries consolidating a group can read
+// past it. A zero to is the latest of the RRAs.
+func dpsWindow(rras []*DbRoundRobinArchive, ns []int64, from, to time.Time, maxPoints int64) (time.Time, time.Time) {
+	step := rras[ns[0]].Step()
+	until := to
+	if until.IsZero() {
+		for _, n := range ns {
+			if latest := rras[n].Latest(); latest.After(until) {
+				until = latest
+			}
+		}
+	}
+	if !from.IsZero() {
+		if maxPoints > 0 {
+			until = until.Add(until.Sub(from) / time.Duration(maxPoints))
+		}
+		from = from.Add(-step)
+	}
+	return from, until.Add(step)
+}
+
+// Splits slots (as returned by slotsBetween(), which wrap at most
+// once) into ranges of consecutive indexes, first and last inclusive.
+func slotRanges(slots []int64) [][2]int64 {
+	var result [][2]int64
+	for n, i := range slots {
+		if n == 0 || i != slots[n-1]+1 {
+			result = append(result, [2]int64{i, i})
+			continue
+		}
+		result[len(result)-1][1] = i
+	}
+	return result
+}
+
+// loadBundleDps is loadBulkDps for the RRAs at ns (of rras and dps)
+// which share a bundle and segment: only the rows of the time range
+// (see dpsWindow()) are read, with QueryBundle's query, each once.
+func (p *pgvSerDe) loadBundleDps(rras []*DbRoundRobinArchive, dps []map[int64]float64, ns []int64, from, to time.Time, maxPoints int64) error {
+	first := rras[ns[0]]
+	from, until := dpsWindow(rras, ns, from, to, maxPoints)
+
+	var (
+		slots []int64
+		seen  = make(map[int64]bool)
+		idxs  = make([]int64, 0, len(ns))
+		byIdx = make(map[int64][]int64, len(ns)) // the same DS can be in dss more than once
+		vers  = make(map[int64]slotVersion, len(ns))
+	)
+	for _, n := range ns {
+		rra := rras[n]
+		for _, i := range slotsBetween(rra, from, until) {
+			if !seen[i] {
+				seen[i] = true
+				slots = append(slots, i)
+			}
+		}
+		if byIdx[rra.Idx()] == nil {
+			idxs = append(idxs, rra.Idx())
+		}
+		byIdx[rra.Idx()] = append(byIdx[rra.Idx()], n)
+		latestI, latestVer := LatestVersion(rra.Latest(), rra.Step(), rra.Size())
+		vers[n] = slotVersion{latestI, latestVer}
+	}
+	if len(slots) == 0 {
+		return nil
+	}
+	sort.Slice(slots, func(a, b int) bool { return slots[a] < slots[b] })
+
+	return p.queryBundleRows("FetchSeriesBulk", first.BundleId(), first.Seg(), slots, idxs, func(i, idx int64, val *float64, ver *int64) {
+		for _, n := range byIdx[idx] {
+			v := vers[n]
+			addVersionedDP(dps[n], i, val, ver, v.latestI, v.latestVer)
+		}
+	})
+}
+
+type bundleSeg struct {
+	bundleId, seg int64
+}
+
+// The most DSs FetchSeriesBulk loads at once, beyond it the data is
+// loaded in chunks of as many, each when one of its series is first
+// read (see lazyBulkRRA), so that the points of a pattern matching a
+// huge number of series need not all be in memory at the same time.
+// 0 is unlimited.
+var PgBulkChunk = 256
+
+// A chunk of the RRAs of a FetchSeriesBulk, loaded once.
+type bulkChunk struct {
+	p         *pgvSerDe
+	rras      []*DbRoundRobinArchive
+	from, to  time.Time
+	maxPoints int64
+	once      sync.Once
+	dps       []map[int64]float64
+}
+
+func (c *bulkChunk) load() {
+	dps, err := c.p.loadDps(c.rras, c.from, c.to, c.maxPoints)
+	if err != nil {
+		// Like a dbSeries, the series reads as all NaN
+		log.Printf("FetchSeriesBulk: error loading %d RRAs: %v", len(c.rras), err)
+		dps = make([]map[int64]float64, len(c.rras))
+	}
+	c.dps = dps
+	c.rras = nil
+}
+
+// An RRA of a bulkChunk, its data points are loaded (with those of
+// the rest of the chunk) on the first DPs().
+type lazyBulkRRA struct {
+	*DbRoundRobinArchive
+	c *bulkChunk
+	n int // in c.rras
+}
+
+func (rra *lazyBulkRRA) DPs() map[int64]float64 {
+	rra.c.once.Do(rra.c.load)
+	return rra.c.dps[rra.n]
+}
@@ -0,0 +1,492 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// bundleDriver is a ts and rra_state of one bundle in memory, which
+// answers the queries of FetchSeriesBulk and QueryBundle the way
+// Postgres would, counting the rows of ts each has to read.
+type bundleDriver struct {
+	sync.Mutex
+	step     time.Duration
+	size     int64
+	latests  map[bundleSeg]map[int64]time.Time // by idx
+	ts       map[bundleSeg]map[int64][][2]interface{}
+	queries  map[string]int
+	rowsRead int
+	// The ds table, for the attribute queries
+	idents map[int64]Ident
+	attrs  map[int64][]byte
+	// The rra_bundle table for the compaction queries, the statements
+	// executed in a transaction and how it ended, a statement
+	// containing failStmt fails.
+	usage      []*RRABundleUsage
+	compacting *RRABundleUsage
+	stmts      []string
+	failStmt   string
+}
+
+type bundleConn struct{ d *bundleDriver }
+
+type bundleRows struct {
+	rows [][]driver.Value
+	pos  int
+}
+
+func (r *bundleRows) Columns() []string {
+	if len(r.rows) > 0 {
+		return make([]string, len(r.rows[0]))
+	}
+	return make([]string, 4)
+}
+func (r *bundleRows) Close() error { return nil }
+func (r *bundleRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+func (d *bundleDriver) Open(string) (driver.Conn, error) { return &bundleConn{d: d}, nil }
+
+type bundleResult int64
+
+func (r bundleResult) LastInsertId() (int64, error) { return 0, nil }
+func (r bundleResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func (c *bundleConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	d := c.d
+	d.Lock()
+	defer d.Unlock()
+	switch {
+	case strings.Contains(query, "SET attrs"): // SetAttributes
+		id := args[1].(int64)
+		if _, ok := d.idents[id]; !ok {
+			return bundleResult(0), nil
+		}
+		d.attrs[id] = args[0].([]byte)
+		return bundleResult(1), nil
+	case d.compacting != nil: // CompactRRABundle
+		if d.failStmt != "" && strings.Contains(query, d.failStmt) {
+			return nil, fmt.Errorf("failed: %s", query)
+		}
+		if args[0].(int64) != d.compacting.Id {
+			return nil, fmt.Errorf("wrong bundle %v: %s", args[0], query)
+		}
+		if strings.Contains(query, "SET width") {
+			d.compacting.Width = args[1].(int64)
+		}
+		d.stmts = append(d.stmts, strings.Join(strings.Fields(query), " "))
+		return bundleResult(0), nil
+	}
+	return nil, fmt.Errorf("unexpected statement: %s", query)
+}
+
+type bundleTx struct{ d *bundleDriver }
+
+func (tx *bundleTx) end(how string) error {
+	tx.d.Lock()
+	defer tx.d.Unlock()
+	tx.d.stmts = append(tx.d.stmts, how)
+	tx.d.compacting = nil
+	return nil
+}
+
+func (tx *bundleTx) Commit() error   { return tx.end("COMMIT") }
+func (tx *bundleTx) Rollback() error { return tx.end("ROLLBACK") }
+
+func (c *bundleConn) Prepare(string) (driver.Stmt, error) { return nil, fmt.Errorf("not supported") }
+func (c *bundleConn) Close() error                        { return nil }
+func (c *bundleConn) Begin() (driver.Tx, error)           { return &bundleTx{d: c.d}, nil }
+
+// Parses a pq.Array() of ints, nil is nil.
+func intArray(v driver.Value) []int64 {
+	if v == nil {
+		return nil
+	}
+	var result []int64
+	for _, s := range strings.Split(strings.Trim(v.(string), "{}"), ",") {
+		n, _ := strconv.ParseInt(s, 10, 64)
+		result = append(result, n)
+	}
+	return result
+}
+
+func (c *bundleConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	d := c.d
+	d.Lock()
+	defer d.Unlock()
+	var rows [][]driver.Value
+	dp := func(row [][2]interface{}, idx int64) (driver.Value, driver.Value, bool) {
+		if idx > int64(len(row)) || row[idx-1][0] == nil || math.IsNaN(row[idx-1][0].(float64)) {
+			return nil, nil, false
+		}
+		return row[idx-1][0], row[idx-1][1], true
+	}
+	switch {
+	case strings.Contains(query, "rra_bundle rb"): // QueryBundle's rra_state
+		for idx, latest := range d.latests[bundleSeg{args[0].(int64), args[1].(int64)}] {
+			rows = append(rows, []driver.Value{int64(d.step / time.Millisecond), d.size, idx, latest})
+		}
+		d.queries["state"]++
+	case strings.Contains(query, "unnest(ts.dp)"): // queryBundleRows
+		key, idxs := bundleSeg{args[0].(int64), args[1].(int64)}, intArray(args[3])
+		for _, i := range intArray(args[2]) {
+			row, ok := d.ts[key][i]
+			if !ok {
+				continue
+			}
+			d.rowsRead++
+			for idx := int64(1); idx <= int64(len(row)); idx++ {
+				match := idxs == nil
+				for _, x := range idxs {
+					match = match || x == idx
+				}
+				if v, ver, ok := dp(row, idx); ok && match {
+					rows = append(rows, []driver.Value{i, idx, v, ver})
+				}
+			}
+		}
+		d.queries["bundle"]++
+	case strings.Contains(query, "unnest($1::int[]"): // loadBulkDps
+		bundleIds, segs, idxs, ns := intArray(args[0]), intArray(args[1]), intArray(args[2]), intArray(args[3])
+		los, his := intArray(args[4]), intArray(args[5])
+		for k := range ns {
+			for i, row := range d.ts[bundleSeg{bundleIds[k], segs[k]}] {
+				if i < los[k] || i > his[k] {
+					continue
+				}
+				d.rowsRead++
+				if v, ver, ok := dp(row, idxs[k]); ok {
+					rows = append(rows, []driver.Value{ns[k], i, v, ver})
+				}
+			}
+		}
+		d.queries["bulk"]++
+	case strings.Contains(query, "SELECT i, dp[$1], ver[$1]"): // rraFillStats
+		idx := args[0].(int64)
+		for i, row := range d.ts[bundleSeg{args[1].(int64), args[2].(int64)}] {
+			d.rowsRead++
+			if v, ver, ok := dp(row, idx); ok {
+				rows = append(rows, []driver.Value{i, v, ver})
+			}
+		}
+		d.queries["fill"]++
+	case strings.Contains(query, "SELECT i, ver[$1]"): // LatestFromData
+		idx := args[0].(int64)
+		for i, row := range d.ts[bundleSeg{args[1].(int64), args[2].(int64)}] {
+			if _, ver, ok := dp(row, idx); ok && ver != nil {
+				rows = append(rows, []driver.Value{i, ver})
+			}
+		}
+	case strings.Contains(query, "SELECT attrs FROM"): // GetAttributes
+		if _, ok := d.idents[args[0].(int64)]; ok {
+			rows = append(rows, []driver.Value{d.attrs[args[0].(int64)]})
+		}
+	case strings.Contains(query, "jsonb_array_elements"): // FetchAttributes
+		var idents []Ident
+		if err := json.Unmarshal([]byte(args[0].(string)), &idents); err != nil {
+			return nil, err
+		}
+		for _, ident := range idents {
+			for id, dsIdent := range d.idents {
+				if dsIdent.String() == ident.String() && string(d.attrs[id]) != "{}" {
+					rows = append(rows, []driver.Value{[]byte(dsIdent.String()), d.attrs[id]})
+				}
+			}
+		}
+		d.queries["attrs"]++
+	case strings.Contains(query, "GROUP BY b.id"): // RRABundleUsage
+		for _, u := range d.usage {
+			rows = append(rows, []driver.Value{u.Id, u.StepMs, u.Size, u.Width, u.RRAs, u.Segments})
+		}
+	case strings.Contains(query, "last_pos FROM"): // TsRowWidth, as if compacted
+		for _, u := range d.usage {
+			rows = append(rows, []driver.Value{u.Size, u.Width, u.RRAs})
+		}
+	case strings.Contains(query, "FOR UPDATE"): // CompactRRABundle
+		for _, u := range d.usage {
+			if u.Id == args[0].(int64) {
+				d.compacting = u
+				rows = append(rows, []driver.Value{u.Width})
+			}
+		}
+	case strings.Contains(query, "FROM compact_map"):
+		rows = append(rows, []driver.Value{d.compacting.RRAs})
+	default:
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+	return &bundleRows{rows: rows}, nil
+}
+
+var bundles = &bundleDriver{}
+
+func init() {
+	sql.Register("tgres-bundle", bundles)
+}
+
+// Fills the bundles "database" with a day of minutely data of nSeries
+// series in segment 0 of bundle 1 and one in segment 1, the value of
+// a slot is its idx. Returns the DSs, the segment 1 one last.
+func bundleSetup(nSeries int, latest time.Time) []rrd.DataSourcer {
+	const width = 200
+	step, size := time.Minute, int64(1440)
+	bundles.step, bundles.size = step, size
+	bundles.latests = make(map[bundleSeg]map[int64]time.Time)
+	bundles.ts = make(map[bundleSeg]map[int64][][2]interface{})
+	bundles.queries, bundles.rowsRead = make(map[string]int), 0
+
+	var dss []rrd.DataSourcer
+	for n := 1; n <= nSeries+1; n++ {
+		pos := int64(n)
+		if n > nSeries {
+			pos = width + 1
+		}
+		spec := rrd.RRASpec{Function: rrd.WMEAN, Step: step, Span: step * time.Duration(size), Latest: latest}
+		rra, _ := newDbRoundRobinArchive(pos, width, 1, pos, spec)
+		ds := rrd.NewDataSource(rrd.DSSpec{Step: step, Heartbeat: time.Hour})
+		ds.SetRRAs([]rrd.RoundRobinArchiver{rra})
+		dss = append(dss, NewDbDataSource(pos, Ident{"name": fmt.Sprintf("foo.%d", n)}, rra.Seg(), rra.Idx(), ds))
+
+		key := bundleSeg{1, rra.Seg()}
+		if bundles.latests[key] == nil {
+			bundles.latests[key] = make(map[int64]time.Time)
+			bundles.ts[key] = make(map[int64][][2]interface{})
+		}
+		bundles.latests[key][rra.Idx()] = latest
+		latestI, latestVer := LatestVersion(latest, step, size)
+		for i := int64(0); i < size; i++ {
+			row := bundles.ts[key][i]
+			for int64(len(row)) < rra.Idx() {
+				row = append(row, [2]interface{}{})
+			}
+			row[rra.Idx()-1] = [2]interface{}{float64(rra.Idx()), int64(SlotVersion(i, latestI, latestVer))}
+			bundles.ts[key][i] = row
+		}
+	}
+	return dss
+}
+
+func Test_pgvSerDe_QueryBundle(t *testing.T) {
+	latest := time.Unix(1500000000, 0).Truncate(time.Minute)
+	dss := bundleSetup(50, latest)
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+
+	// A stale slot, left over from an earlier iteration
+	stale, ver := LatestVersion(latest, time.Minute, 1440)
+	bundles.ts[bundleSeg{1, 0}][stale][2][1] = int64((ver + 1) % (MaxVersion + 1))
+
+	from := latest.Add(-10 * time.Minute)
+	result, err := p.QueryBundle(1, 0, from, latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 50 || bundles.rowsRead != 11 {
+		t.Fatalf("Expected 50 RRAs and 11 rows read, got %d and %d", len(result), bundles.rowsRead)
+	}
+	for idx, dps := range result {
+		exp := 11
+		if idx == 3 {
+			exp = 10
+		}
+		if len(dps) != exp {
+			t.Errorf("idx %d: expected %d points, got %d: %v", idx, exp, len(dps), dps)
+		}
+		for _, v := range dps {
+			if v != float64(idx) {
+				t.Errorf("idx %d: unexpected value %v", idx, v)
+			}
+		}
+	}
+
+	// A wildcard: one query for the 50 series in segment 0, one for
+	// the series in segment 1, both only reading the rows of the range
+	bundles.queries, bundles.rowsRead = make(map[string]int), 0
+	sl, err := p.FetchSeriesBulk(dss, from, latest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundles.queries["bundle"] != 1 || bundles.queries["bulk"] != 1 || bundles.rowsRead != 12+12 {
+		t.Errorf("Expected one bundle and one bulk query reading %d rows, got %v reading %d", 12+12, bundles.queries, bundles.rowsRead)
+	}
+	for n, s := range sl {
+		idx := dss[n].(DbDataSourcer).RRAs()[0].(*DbRoundRobinArchive).Idx()
+		points := 0
+		for s.Next() {
+			if v := s.CurrentValue(); !math.IsNaN(v) {
+				if v != float64(idx) {
+					t.Errorf("%d: unexpected value %v", n, v)
+				}
+				points++
+			}
+		}
+		exp := 11
+		if idx == 3 && n < 50 {
+			exp = 10
+		}
+		if points != exp {
+			t.Errorf("%d: expected %d points, got %d", n, exp, points)
+		}
+	}
+}
+
+func Test_slotRanges(t *testing.T) {
+	for _, c := range []struct {
+		slots []int64
+		exp   string
+	}{
+		{nil, "[]"},
+		{[]int64{3}, "[[3 3]]"},
+		{[]int64{0, 1, 2}, "[[0 2]]"},
+		{[]int64{8, 9, 0, 1}, "[[8 9] [0 1]]"},
+	} {
+		if r := fmt.Sprint(slotRanges(c.slots)); r != c.exp {
+			t.Errorf("%v: expected %s, got %s", c.slots, c.exp, r)
+		}
+	}
+}
+
+func Test_pgvSerDe_loadBulkDps_wrap(t *testing.T) {
+	// The latest is in slot 5, the range wraps around the end of the RRA
+	latest := time.Unix((25000000-155)*60, 0)
+	dss := bundleSetup(1, latest)
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+	if i := rrd.SlotIndex(latest, time.Minute, 1440); i != 5 {
+		t.Fatalf("Expected the latest in slot 5, got %d", i)
+	}
+
+	sl, err := p.FetchSeriesBulk(dss[1:], latest.Add(-10*time.Minute), latest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := 0
+	for sl[0].Next() {
+		if !math.IsNaN(sl[0].CurrentValue()) {
+			points++
+		}
+	}
+	if points != 11 || bundles.queries["bulk"] != 1 || bundles.rowsRead != 12 {
+		t.Errorf("Expected 11 points from 12 rows in one query, got %d from %d in %v", points, bundles.rowsRead, bundles.queries)
+	}
+}
+
+func Test_pgvSerDe_FetchSeriesBulk_chunks(t *testing.T) {
+	latest := time.Unix(1500000000, 0).Truncate(time.Minute)
+	dss := bundleSetup(50, latest)
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+
+	save := PgBulkChunk
+	PgBulkChunk = 20
+	defer func() { PgBulkChunk = save }()
+
+	from := latest.Add(-10 * time.Minute)
+	sl, err := p.FetchSeriesBulk(dss, from, latest, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sl) != len(dss) || len(bundles.queries) != 0 {
+		t.Fatalf("Expected %d series and no queries yet, got %d and %v", len(dss), len(sl), bundles.queries)
+	}
+
+	for n, s := range sl {
+		idx := dss[n].(DbDataSourcer).RRAs()[0].(*DbRoundRobinArchive).Idx()
+		points := 0
+		for s.Next() {
+			if v := s.CurrentValue(); !math.IsNaN(v) {
+				if v != float64(idx) {
+					t.Errorf("%d: unexpected value %v", n, v)
+				}
+				points++
+			}
+		}
+		if points != 11 {
+			t.Errorf("%d: expected 11 points, got %d", n, points)
+		}
+		if n == 0 && bundles.queries["bundle"] != 1 {
+			t.Errorf("Expected only the first chunk to be loaded, got %v", bundles.queries)
+		}
+	}
+	// The last chunk has 10 series of segment 0 and the one of segment 1
+	if bundles.queries["bundle"] != 3 || bundles.queries["bulk"] != 1 {
+		t.Errorf("Expected 3 bundle and 1 bulk queries, got %v", bundles.queries)
+	}
+}
+
+// Compares the reading of a wildcard matching many series in the same
+// segment of a bundle for an hour, by the segment (with the query of
+// QueryBundle) and by joining on all the (bundle, seg, idx), run with
+// e.g.:
+//
+//   go test -run none -bench Benchmark_FetchSeriesBulk ./serde
+func Benchmark_FetchSeriesBulk(b *testing.B) {
+	latest := time.Unix(1500000000, 0).Truncate(time.Minute)
+	dss := bundleSetup(100, latest)[:100]
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+	from := latest.Add(-time.Hour)
+
+	load := func(b *testing.B, bundled bool) {
+		rras := make([]*DbRoundRobinArchive, len(dss))
+		var ns []int64
+		for n, ds := range dss {
+			rras[n] = ds.(DbDataSourcer).RRAs()[0].(*DbRoundRobinArchive)
+			ns = append(ns, int64(n))
+		}
+		bundles.rowsRead = 0
+		for i := 0; i < b.N; i++ {
+			dps := make([]map[int64]float64, len(dss))
+			for n := range dps {
+				dps[n] = make(map[int64]float64)
+			}
+			var err error
+			if bundled {
+				err = p.loadBundleDps(rras, dps, ns, from, latest, 0)
+			} else {
+				err = p.loadBulkDps(rras, dps, ns, from, latest, 0)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(bundles.rowsRead)/float64(b.N), "rows/op")
+	}
+	b.Run("bundle", func(b *testing.B) { load(b, true) })
+	b.Run("join", func(b *testing.B) { load(b, false) })
+}
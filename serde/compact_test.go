@@ -0,0 +1,134 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_RRABundleUsage_MinSegments(t *testing.T) {
+	u := &RRABundleUsage{Width: 200, RRAs: 401, Segments: 5}
+	for width, exp := range map[int64]int64{0: 3, 200: 3, 100: 5, 401: 1, 1000: 1} {
+		if n := u.MinSegments(width); n != exp {
+			t.Errorf("width %d: expected %d segments, got %d", width, exp, n)
+		}
+	}
+}
+
+func Test_pgvSerDe_RRABundleUsage(t *testing.T) {
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+
+	bundles.usage = []*RRABundleUsage{
+		{Id: 1, StepMs: 60000, Size: 1440, Width: 200, RRAs: 10, Segments: 3},
+		{Id: 2, StepMs: 3600000, Size: 720, Width: 200, RRAs: 0, Segments: 0},
+	}
+	defer func() { bundles.usage = nil }()
+
+	usage, err := p.RRABundleUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || !reflect.DeepEqual(usage[0], bundles.usage[0]) || !reflect.DeepEqual(usage[1], bundles.usage[1]) {
+		t.Errorf("Expected the usage of both bundles, got %v", usage)
+	}
+}
+
+func Test_pgvSerDe_TsRowWidth(t *testing.T) {
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+
+	defer func() { bundles.usage = nil }()
+	if w, err := p.TsRowWidth(); err != nil || w != float64(PgSegmentWidth) {
+		t.Errorf("Expected PgSegmentWidth without bundles, got %v (err: %v)", w, err)
+	}
+
+	// 1440 rows of width 200, 2 * 720 of width 50, 100 rows of an
+	// empty bundle do not exist
+	bundles.usage = []*RRABundleUsage{
+		{Id: 1, Size: 1440, Width: 200, RRAs: 10},
+		{Id: 2, Size: 720, Width: 50, RRAs: 60},
+		{Id: 3, Size: 100, Width: 1000, RRAs: 0},
+	}
+	exp := float64(1440*200+2*720*50) / float64(1440+2*720)
+	if w, err := p.TsRowWidth(); err != nil || w != exp {
+		t.Errorf("Expected %v, got %v (err: %v)", exp, w, err)
+	}
+}
+
+func Test_pgvSerDe_CompactRRABundle(t *testing.T) {
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+
+	defer func() { bundles.usage, bundles.stmts, bundles.failStmt = nil, nil, "" }()
+	reset := func() {
+		bundles.usage = []*RRABundleUsage{{Id: 1, StepMs: 60000, Size: 1440, Width: 200, RRAs: 10, Segments: 3}}
+		bundles.stmts, bundles.failStmt = nil, ""
+	}
+
+	// The mapping, the rebuilt ts and rra_state and the new rra and
+	// rra_bundle positions, all in one transaction
+	for _, c := range []struct{ width, exp int64 }{{0, 200}, {5, 5}} {
+		reset()
+		if err := p.CompactRRABundle(1, c.width); err != nil {
+			t.Fatal(err)
+		}
+		stmts := bundles.stmts
+		if len(stmts) != 10 || stmts[len(stmts)-1] != "COMMIT" {
+			t.Fatalf("width %d: expected 9 statements and a commit, got %d: %v", c.width, len(stmts), stmts)
+		}
+		if !strings.Contains(stmts[0], "compact_map") || !strings.Contains(stmts[0], fmt.Sprintf("mod(new_pos - 1, %d)", c.exp)) {
+			t.Errorf("width %d: expected the mapping at width %d first, got %s", c.width, c.exp, stmts[0])
+		}
+		for n, prefix := range []string{
+			"CREATE TEMP TABLE compact_ts", "CREATE TEMP TABLE compact_rra_state",
+			"DELETE FROM ts", "INSERT INTO ts", "DELETE FROM rra_state", "INSERT INTO rra_state",
+			"UPDATE rra AS rra", "UPDATE rra_bundle SET width",
+		} {
+			if !strings.HasPrefix(stmts[n+1], prefix) {
+				t.Errorf("width %d: statement %d: expected %q, got %s", c.width, n+1, prefix, stmts[n+1])
+			}
+		}
+		if bundles.usage[0].Width != c.exp {
+			t.Errorf("width %d: expected the bundle width set to %d, got %d", c.width, c.exp, bundles.usage[0].Width)
+		}
+	}
+
+	// A failure part way leaves everything as it was
+	reset()
+	bundles.failStmt = "INSERT INTO ts"
+	if err := p.CompactRRABundle(1, 5); err == nil {
+		t.Errorf("Expected an error")
+	}
+	if stmts := bundles.stmts; stmts[len(stmts)-1] != "ROLLBACK" || bundles.usage[0].Width != 200 {
+		t.Errorf("Expected a rollback with the width unchanged, got %v", stmts)
+	}
+
+	reset()
+	if err := p.CompactRRABundle(3, 0); !IsNotFound(err) {
+		t.Errorf("Expected not found for a missing bundle, got %v", err)
+	}
+	if stmts := bundles.stmts; len(stmts) != 1 || stmts[0] != "ROLLBACK" {
+		t.Errorf("Expected nothing but a rollback, got %v", stmts)
+	}
+}
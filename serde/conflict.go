@@ -0,0 +1,91 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+func (p *pgvSerDe) FlushDataPointsConflict(bundle_id, seg, i int64, dps, vers map[int64]interface{}, strategy ConflictStrategy) (int, error) {
+	if strategy != ConflictSkip {
+		return p.FlushDataPoints(bundle_id, seg, i, dps, vers)
+	}
+	return withFlushRetry("FlushDataPoints", func() (int, error) {
+		return p.flushDataPointsSkip(bundle_id, seg, i, dps, vers)
+	})
+}
+
+// A slot has a data point if it is of the version being written and
+// it is not NULL (or NaN or NaNSentinel), in which case it is left
+// alone. Every slot is assigned separately, which cannot be
+// prepared, but backfills are rare.
+func (p *pgvSerDe) flushDataPointsSkip(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (sqlOps int, err error) {
+	if dps, err = encodeDps("FlushDataPoints", dps); err != nil {
+		return 0, err
+	}
+	stmt, args := skipUpdateStmt(p.prefix, []interface{}{bundle_id, seg, i}, dps, vers)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		res, err := p.dbConn.Exec(stmt, args...)
+		if err != nil {
+			return 0, dbError("FlushDataPoints", err)
+		}
+		sqlOps++
+		if affected, _ := res.RowsAffected(); affected > 0 {
+			return sqlOps, nil
+		}
+		if attempt == 0 { // Insert and try again.
+			if _, err = p.sqlInsertTs.Exec(bundle_id, seg, i); err != nil {
+				return 0, dbError("FlushDataPoints", err)
+			}
+		}
+	}
+	return 0, newError("FlushDataPoints", ErrDatabase, "Unable to update row?")
+}
+
+// Returns the UPDATE of the ts row keeping the existing data points,
+// prefix is the bundle_id, seg and i.
+func skipUpdateStmt(prefix string, args []interface{}, dps, vers map[int64]interface{}) (string, []interface{}) {
+	var sentinel interface{}
+	if NaNSentinel != nil {
+		sentinel = *NaNSentinel
+	}
+	args = append(args, sentinel)
+
+	idxs := make([]int64, 0, len(dps))
+	for idx := range dps {
+		idxs = append(idxs, idx)
+	}
+	sort.Slice(idxs, func(a, b int) bool { return idxs[a] < idxs[b] })
+
+	dests := make([]string, 0, 2*len(idxs))
+	for _, idx := range idxs {
+		n := len(args) + 1 // $n is the index, $n+1 the data point, $n+2 the version
+		dests = append(dests,
+			fmt.Sprintf("dp[$%[1]d] = CASE WHEN ts.ver[$%[1]d] = $%[3]d AND NULLIF(NULLIF(ts.dp[$%[1]d], 'NaN'), $4) IS NOT NULL "+
+				"THEN ts.dp[$%[1]d] ELSE $%[2]d::float8 END", n, n+1, n+2),
+			fmt.Sprintf("ver[$%d] = $%d", n, n+2))
+		args = append(args, idx, dps[idx], vers[idx])
+	}
+	if len(dests) == 0 {
+		dests = append(dests, "dp[0:0]=NULL")
+	}
+
+	stmt := fmt.Sprintf("UPDATE %[1]sts AS ts SET %s WHERE rra_bundle_id = $1 AND seg = $2 AND i = $3", prefix, strings.Join(dests, ", "))
+	return stmt, args
+}
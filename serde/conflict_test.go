@@ -0,0 +1,88 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ParseConflictStrategy(t *testing.T) {
+	for s, exp := range map[string]ConflictStrategy{"overwrite": ConflictOverwrite, "skip": ConflictSkip} {
+		if cs, err := ParseConflictStrategy(s); err != nil || cs != exp || cs.String() != s {
+			t.Errorf("%s: unexpected %v: %v", s, cs, err)
+		}
+	}
+	if _, err := ParseConflictStrategy("keep"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func Test_skipUpdateStmt(t *testing.T) {
+	dps := map[int64]interface{}{3: 3.0, 1: nil}
+	vers := map[int64]interface{}{3: 7, 1: 6}
+	stmt, args := skipUpdateStmt("tgres_", []interface{}{1, 2, 3}, dps, vers)
+
+	exp := "UPDATE tgres_ts AS ts SET " +
+		"dp[$5] = CASE WHEN ts.ver[$5] = $7 AND NULLIF(NULLIF(ts.dp[$5], 'NaN'), $4) IS NOT NULL THEN ts.dp[$5] ELSE $6::float8 END, ver[$5] = $7, " +
+		"dp[$8] = CASE WHEN ts.ver[$8] = $10 AND NULLIF(NULLIF(ts.dp[$8], 'NaN'), $4) IS NOT NULL THEN ts.dp[$8] ELSE $9::float8 END, ver[$8] = $10 " +
+		"WHERE rra_bundle_id = $1 AND seg = $2 AND i = $3"
+	if stmt != exp {
+		t.Errorf("Unexpected statement:\n%s", stmt)
+	}
+	if expArgs := []interface{}{1, 2, 3, nil, int64(1), nil, 6, int64(3), 3.0, 7}; !reflect.DeepEqual(args, expArgs) {
+		t.Errorf("Unexpected args: %v", args)
+	}
+
+	defer func() { NaNSentinel = nil }()
+	sentinel := -1.0
+	NaNSentinel = &sentinel
+	if _, args := skipUpdateStmt("tgres_", nil, dps, vers); args[0] != -1.0 {
+		t.Errorf("Expected the sentinel, got %v", args[0])
+	}
+}
+
+func Test_pgvSerDe_FlushDataPointsConflict(t *testing.T) {
+	db, err := sql.Open("tgres-killing", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db, prefix: "tgres_"}
+
+	// Two chunks, so that overwriting is a single statement too
+	dps := map[int64]interface{}{1: 1.0, 3: math.NaN()}
+	vers := map[int64]interface{}{1: 0, 3: 0}
+
+	for _, c := range []struct {
+		strategy ConflictStrategy
+		keeps    bool
+	}{
+		{ConflictOverwrite, false},
+		{ConflictSkip, true},
+	} {
+		killing.execs, killing.kill, killing.stmts = 0, 0, nil
+		if ops, err := p.FlushDataPointsConflict(1, 0, 0, dps, vers, c.strategy); err != nil || ops != 1 {
+			t.Errorf("%v: unexpected %d ops: %v", c.strategy, ops, err)
+		}
+		if len(killing.stmts) != 1 || strings.Contains(killing.stmts[0], "THEN ts.dp[") != c.keeps {
+			t.Errorf("%v: unexpected statements %v", c.strategy, killing.stmts)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"log"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
+)
+
+// The part of *sql.Rows we need, so that reading rows can be tested
+// without a database.
+type rowScanner interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
+}
+
+// dbDataPoints iterates over (t, r) rows, NULL (and NaNSentinel) is
+// NaN.
+type dbDataPoints struct {
+	rows rowScanner
+	dp   DataPoint
+	r    *float64 // reused by every Scan()
+	err  error
+}
+
+func (d *dbDataPoints) Next() bool {
+	if d.err != nil || !d.rows.Next() {
+		return false
+	}
+	if d.err = d.rows.Scan(&d.dp.Time, &d.r); d.err != nil {
+		log.Printf("dbDataPoints.Next(): error scanning %v", d.err)
+		return false
+	}
+	d.dp.Value = decodeDp(d.r)
+	return true
+}
+
+func (d *dbDataPoints) DataPoint() DataPoint { return d.dp }
+
+func (d *dbDataPoints) Err() error {
+	if d.err != nil {
+		return d.err
+	}
+	return d.rows.Err()
+}
+
+func (d *dbDataPoints) Close() error { return d.rows.Close() }
+
+func rraByStep(rras []rrd.RoundRobinArchiver, step time.Duration) rrd.RoundRobinArchiver {
+	for _, rra := range rras {
+		if rra.Step() == step {
+			return rra
+		}
+	}
+	return nil
+}
+
+// QueryDataPoints reads the data points as FetchSeries() does (it is
+// the same query), but of the RRA of step and without consolidation,
+// only NaN where a slot is empty.
+func (p *pgvSerDe) QueryDataPoints(id int64, from, until time.Time, step time.Duration) (DataPoints, error) {
+	rras, err := p.DataSourceRRAs(id)
+	if err != nil {
+		return nil, err
+	}
+	rra, ok := rraByStep(rras, step).(DbRoundRobinArchiver)
+	if !ok {
+		return nil, newError("QueryDataPoints", ErrNotFound, "no RRA of step %v for DS id: %v", step, id)
+	}
+	if earliest := rra.Begins(rra.Latest()); from.IsZero() || earliest.After(from) {
+		from = earliest
+	}
+
+	ds := NewDbDataSource(id, nil, 0, 0, nil)
+	dps := &dbSeries{db: p, ds: ds, rra: rra, from: from, to: until, groupBy: step}
+	points, err := dps.dataPoints()
+	if err != nil {
+		log.Printf("QueryDataPoints: error %v", err)
+		return nil, dbError("QueryDataPoints", err)
+	}
+	return points, nil
+}
+
+// seriesDataPoints presents a series.Series as DataPoints.
+type seriesDataPoints struct {
+	series.Series
+}
+
+func (s *seriesDataPoints) DataPoint() DataPoint {
+	return DataPoint{Time: s.CurrentTime(), Value: s.CurrentValue()}
+}
+
+func (s *seriesDataPoints) Err() error { return nil }
+
+func (m *memSerDe) QueryDataPoints(id int64, from, until time.Time, step time.Duration) (DataPoints, error) {
+	rras, _ := m.DataSourceRRAs(id)
+	rra := rraByStep(rras, step)
+	if rra == nil {
+		return nil, newError("QueryDataPoints", ErrNotFound, "no RRA of step %v for DS id: %v", step, id)
+	}
+	s := series.NewRRASeries(rra)
+	s.TimeRange(from, until)
+	return &seriesDataPoints{s}, nil
+}
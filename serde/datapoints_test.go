@@ -0,0 +1,183 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/series"
+)
+
+// fakeRows pretends to be *sql.Rows.
+type fakeRows struct {
+	rows [][]interface{}
+	pos  int
+}
+
+func (r *fakeRows) Next() bool {
+	r.pos++
+	return r.pos <= len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	row := r.rows[r.pos-1]
+	for n, d := range dest {
+		switch d := d.(type) {
+		case *int64:
+			*d = row[n].(int64)
+		case **int64:
+			*d = row[n].(*int64)
+		case **float64:
+			*d = row[n].(*float64)
+		case *time.Time:
+			*d = row[n].(time.Time)
+		}
+	}
+	return nil
+}
+
+func (r *fakeRows) Err() error   { return nil }
+func (r *fakeRows) Close() error { return nil }
+
+func Test_dbDataPoints(t *testing.T) {
+	v := 1.5
+	start := time.Unix(1000, 0)
+	dps := &dbDataPoints{rows: &fakeRows{rows: [][]interface{}{
+		{start, &v},
+		{start.Add(time.Minute), (*float64)(nil)},
+	}}}
+
+	var got []DataPoint
+	for dps.Next() {
+		got = append(got, dps.DataPoint())
+	}
+	if err := dps.Err(); err != nil {
+		t.Error(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 data points, got %v", got)
+	}
+	if !got[0].Time.Equal(start) || got[0].Value != 1.5 {
+		t.Errorf("Unexpected first data point: %v", got[0])
+	}
+	if !math.IsNaN(got[1].Value) {
+		t.Errorf("Expected NULL to be NaN, got %v", got[1].Value)
+	}
+}
+
+func Test_memSerDe_QueryDataPoints(t *testing.T) {
+	latest := time.Unix(3600, 0)
+	spec := &rrd.DSSpec{
+		Step: time.Second,
+		RRAs: []rrd.RRASpec{
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Second, Span: time.Minute, Latest: latest},
+			rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour, Latest: latest,
+				DPs: map[int64]float64{0: 1, 59: 2}},
+		},
+	}
+	db := NewMemSerDe()
+	ds, _ := db.FetchOrCreateDataSource(Ident{"name": "foo"}, spec)
+	id := ds.(DbDataSourcer).Id()
+
+	dps, err := db.QueryDataPoints(id, latest.Add(-2*time.Minute), latest, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dps.Close()
+	var last DataPoint
+	for dps.Next() {
+		dp := dps.DataPoint()
+		if !dp.Time.After(last.Time) {
+			t.Errorf("Data points out of order: %v after %v", dp.Time, last.Time)
+		}
+		last = dp
+	}
+	if !last.Time.Equal(latest) || last.Value != 1 {
+		t.Errorf("Expected the last data point to be 1 at %v, got %v", latest, last)
+	}
+
+	if _, err := db.QueryDataPoints(id, latest.Add(-time.Hour), latest, time.Hour); err == nil {
+		t.Errorf("Expected an error for a step with no RRA")
+	}
+}
+
+// A year of 1 minute data points as the database would return them,
+// (i, r, v) rows of the ts table for the map and (t, r) of the series
+// query for FetchSeries and QueryDataPoints.
+func yearOfRows(latest time.Time) (rrd.RRASpec, *fakeRows, *fakeRows) {
+	spec := rrd.RRASpec{Function: rrd.WMEAN, Step: time.Minute, Span: 365 * 24 * time.Hour, Latest: latest}
+	size := int64(spec.Span / spec.Step)
+	latestI, latestVer := LatestVersion(latest, spec.Step, size)
+
+	tsRows := &fakeRows{rows: make([][]interface{}, 0, size)}
+	tvRows := &fakeRows{rows: make([][]interface{}, 0, size)}
+	for n := size - 1; n >= 0; n-- {
+		t := latest.Add(-spec.Step * time.Duration(n))
+		i := rrd.SlotIndex(t, spec.Step, size)
+		v, ver := float64(n), int64(SlotVersion(i, latestI, latestVer))
+		tsRows.rows = append(tsRows.rows, []interface{}{i, &v, &ver})
+		tvRows.rows = append(tvRows.rows, []interface{}{t, &v})
+	}
+	return spec, tsRows, tvRows
+}
+
+// Compares reading a year of data points into a map and iterating
+// over it as LoadRRAData() and FetchSeriesBulk() do with the
+// DataPoints of QueryDataPoints(), run with -benchmem.
+func Benchmark_QueryDataPoints(b *testing.B) {
+	latest := time.Unix(1500000000, 0).Truncate(time.Minute)
+	spec, tsRows, tvRows := yearOfRows(latest)
+	from := latest.Add(-spec.Span)
+
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		latestI, latestVer := LatestVersion(latest, spec.Step, int64(spec.Span/spec.Step))
+		for i := 0; i < b.N; i++ {
+			tsRows.pos = 0
+			dps, err := scanVersionedDps(tsRows, latestI, latestVer)
+			if err != nil {
+				b.Fatal(err)
+			}
+			spec.DPs = dps
+			rra, err := newDbRoundRobinArchive(1, 1, 1, 1, spec)
+			if err != nil {
+				b.Fatal(err)
+			}
+			s := series.NewRRASeries(rra)
+			s.TimeRange(from, latest)
+			for s.Next() {
+				_, _ = s.CurrentTime(), s.CurrentValue()
+			}
+		}
+	})
+
+	b.Run("struct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tvRows.pos = 0
+			dps := &dbDataPoints{rows: tvRows}
+			for dps.Next() {
+				_ = dps.DataPoint()
+			}
+			if err := dps.Err(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
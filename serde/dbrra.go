@@ -63,10 +63,10 @@ func newDbRoundRobinArchive(id, width, bundleId, pos int64, spec rrd.RRASpec) (*
 	if spec.Span == 0 {
 		return nil, fmt.Errorf("Invalid span: Span cannot be 0.")
 	}
-	// Steps are aligned on milliseconds, so a step of less than a
-	// millisecond would result in a division by zero (see rra.update())
-	if spec.Step < time.Millisecond {
-		return nil, fmt.Errorf("Invalid step: Step: %v cannot be less than 1 millisecond.", spec.Step)
+	// Steps are stored in milliseconds, a step can be less than a
+	// second, but must be a whole number of milliseconds.
+	if spec.Step < time.Millisecond || spec.Step%time.Millisecond != 0 {
+		return nil, fmt.Errorf("Invalid step: Step: %v must be a multiple of 1 millisecond.", spec.Step)
 	}
 	if (spec.Span % spec.Step) != 0 {
 		return nil, fmt.Errorf("Invalid Step and/or Size: Size (%v) must be a multiple of Step (%v).", spec.Span, spec.Step)
@@ -84,6 +84,49 @@ func newDbRoundRobinArchive(id, width, bundleId, pos int64, spec rrd.RRASpec) (*
 	return rra, nil
 }
 
+// Versions are stored as SMALLINT and wrap around, the version
+// following MaxVersion is 0.
+const MaxVersion = 32766
+
+// LatestVersion returns the index of the latest slot and the version
+// of the current iteration of the round-robin given the latest of
+// an RRA, i.e. the version data points written now get.
+func LatestVersion(latest time.Time, step time.Duration, size int64) (int64, int) {
+	i := rrd.SlotIndex(latest, step, size)
+	span := step.Nanoseconds() * size
+	return i, int((latest.UnixNano() / span) % (MaxVersion + 1))
+}
+
+// SlotVersion returns the version a data point in slot i must have
+// to be current given the latest slot index and version (see
+// LatestVersion()). Slots up to and including the latest slot belong
+// to the current iteration, those after it to the previous one. A
+// data point with any other version is stale, i.e. left over from an
+// earlier iteration, and must read as NaN.
+func SlotVersion(i, latestI int64, latestVer int) int {
+	if i > latestI {
+		if latestVer == 0 {
+			return MaxVersion
+		}
+		return latestVer - 1
+	}
+	return latestVer
+}
+
+// SlotVersionsWrapped returns true if between the latest prev and
+// latest of an RRA so many iterations of the round-robin passed that
+// the versions wrapped around. The slots are not timestamped, only
+// versioned, and this is when the version of a slot not written since
+// prev can be the same as the current one, i.e. stale data can read
+// as current. A zero prev means there was no data.
+func SlotVersionsWrapped(prev, latest time.Time, step time.Duration, size int64) bool {
+	if prev.IsZero() {
+		return false
+	}
+	span := step.Nanoseconds() * size
+	return latest.UnixNano()/span-prev.UnixNano()/span > MaxVersion
+}
+
 // SlotRow returns the row number given a slot number. This is mostly
 // useful in serde implementations.
 func (rra *DbRoundRobinArchive) SlotRow(slot int64) int64 {
@@ -137,6 +180,7 @@ type rraRecord struct {
 	idx      int64
 	cf       string
 	xff      float32
+	rollUp   bool
 }
 
 type rraStateRecord struct {
@@ -15,6 +15,121 @@
 
 package serde
 
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_addVersionedDP_staleSlots(t *testing.T) {
+	step, size := 10*time.Second, int64(6)
+
+	// What is in the ts table: slot -> value, version
+	vals := make(map[int64]*float64)
+	vers := make(map[int64]*int64)
+	write := func(latest time.Time, v float64) {
+		latestI, latestVer := LatestVersion(latest, step, size)
+		ver := int64(SlotVersion(latestI, latestI, latestVer))
+		vals[latestI], vers[latestI] = &v, &ver
+	}
+	read := func(latest time.Time) map[int64]float64 {
+		latestI, latestVer := LatestVersion(latest, step, size)
+		dps := make(map[int64]float64)
+		for i := range vals {
+			addVersionedDP(dps, i, vals[i], vers[i], latestI, latestVer)
+		}
+		return dps
+	}
+
+	// One full round
+	start := time.Unix(6000, 0)
+	for n := 0; n < int(size); n++ {
+		write(start.Add(step*time.Duration(n)), float64(n))
+	}
+	latest := start.Add(step * time.Duration(size-1))
+	if dps := read(latest); len(dps) != int(size) {
+		t.Errorf("Expected all %d slots to be current, got %v", size, dps)
+	}
+
+	// Roll over by 3 slots, but only write the last one, which
+	// leaves 2 slots from the previous round behind.
+	latest = latest.Add(3 * step)
+	write(latest, 100)
+	dps := read(latest)
+	for n := int64(1); n <= 2; n++ {
+		i := rrd.SlotIndex(latest.Add(-step*time.Duration(n)), step, size)
+		if v, ok := dps[i]; ok {
+			t.Errorf("Stale slot %d should read as NaN, got %v", i, v)
+		}
+	}
+	if v := dps[rrd.SlotIndex(latest, step, size)]; v != 100 {
+		t.Errorf("Expected the latest slot to be 100, got %v", v)
+	}
+	if len(dps) != int(size)-2 {
+		t.Errorf("Expected %d current slots, got %d: %v", size-2, len(dps), dps)
+	}
+
+	// Once the whole window has rolled over, nothing is current
+	if dps := read(latest.Add(step * time.Duration(size))); len(dps) != 0 {
+		t.Errorf("Expected all slots to be stale, got %v", dps)
+	}
+}
+
+func Test_SlotVersion_wrap(t *testing.T) {
+	// Slots after the latest belong to the previous round
+	if v := SlotVersion(5, 2, 7); v != 6 {
+		t.Errorf("Expected 6, got %d", v)
+	}
+	if v := SlotVersion(2, 2, 7); v != 7 {
+		t.Errorf("Expected 7, got %d", v)
+	}
+	// The round before version 0 is MaxVersion
+	if v := SlotVersion(5, 2, 0); v != MaxVersion {
+		t.Errorf("Expected %d, got %d", MaxVersion, v)
+	}
+
+	// The last round before the wrap has MaxVersion
+	step, size := time.Second, int64(10)
+	span := step * time.Duration(size)
+	if _, v := LatestVersion(time.Unix(0, 0).Add(span*(MaxVersion+1)-step), step, size); v != MaxVersion {
+		t.Errorf("Expected %d, got %d", MaxVersion, v)
+	}
+	if _, v := LatestVersion(time.Unix(0, 0).Add(span*(MaxVersion+1)), step, size); v != 0 {
+		t.Errorf("Expected 0, got %d", v)
+	}
+}
+
+func Test_LatestVersion_subSecond(t *testing.T) {
+	step, size := 100*time.Millisecond, int64(10)
+
+	// Every slot of every round has a distinct index within the
+	// round and the version changes once per round
+	seen := make(map[int64]bool)
+	start := time.Unix(1000, 0)
+	for n := 0; n < 3*int(size); n++ {
+		latest := start.Add(step * time.Duration(n))
+		i, ver := LatestVersion(latest, step, size)
+		if i != int64(n)%size {
+			t.Errorf("%v: expected index %d, got %d", latest, int64(n)%size, i)
+		}
+		if exp := int((1000 + int64(n)/size) % (MaxVersion + 1)); ver != exp {
+			t.Errorf("%v: expected version %d, got %d", latest, exp, ver)
+		}
+		seen[int64(ver)*size+i] = true
+	}
+	if len(seen) != 3*int(size) {
+		t.Errorf("Expected %d distinct slots, got %d", 3*size, len(seen))
+	}
+
+	if _, err := newDbRoundRobinArchive(0, 10, 0, 1, rrd.RRASpec{Step: step, Span: step * 10}); err != nil {
+		t.Errorf("Expected a 100ms step to be valid, got %v", err)
+	}
+	if _, err := newDbRoundRobinArchive(0, 10, 0, 1, rrd.RRASpec{Step: 1500 * time.Microsecond, Span: 15 * time.Millisecond}); err == nil {
+		t.Errorf("Expected an error for a step which is not a whole number of milliseconds")
+	}
+}
+
 // // SlotRow()
 // var slot int64
 // rra.width, slot = 10, 20
@@ -31,3 +146,27 @@ package serde
 // if rra.DpsAsPGString(1, 2) != expect {
 // 	t.Errorf("DpsAsPGString() didn't return %q", expect)
 // }
+
+func Test_SlotVersionsWrapped(t *testing.T) {
+	step, size := time.Second, int64(60)
+	span := step * time.Duration(size)
+	prev := time.Unix(1500000000, 0)
+	for _, c := range []struct {
+		latest time.Time
+		exp    bool
+	}{
+		{prev.Add(step), false},
+		{prev.Add(span), false},
+		{prev.Add(span * MaxVersion), false},        // the version before prev's
+		{prev.Add(span * (MaxVersion + 1)), true},   // prev's version again
+		{prev.Add(span * (2*MaxVersion + 5)), true}, // any longer
+		{prev.Add(-span * (MaxVersion + 1)), false}, // backwards is not a wrap
+	} {
+		if got := SlotVersionsWrapped(prev, c.latest, step, size); got != c.exp {
+			t.Errorf("%v after %v: expected %v, got %v", c.latest.Sub(prev), prev, c.exp, got)
+		}
+	}
+	if SlotVersionsWrapped(time.Time{}, prev, step, size) {
+		t.Errorf("Expected no wrap without a previous latest")
+	}
+}
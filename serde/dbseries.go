@@ -19,8 +19,9 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"math"
 	"time"
+
+	"github.com/tgres/tgres/rrd"
 )
 
 type dbSeries struct {
@@ -37,12 +38,13 @@ type dbSeries struct {
 	to   time.Time
 
 	// Db stuff
-	db   *pgvSerDe
-	rows *sql.Rows
+	db     *pgvSerDe
+	points *dbDataPoints // the rows of the query, nil until the first Next()
 
 	// These are not the same:
 	maxPoints int64         // max points we want
 	groupBy   time.Duration // requested alignment
+	cf        rrd.Consolidation
 
 	latest time.Time
 
@@ -84,6 +86,13 @@ func (dps *dbSeries) MaxPoints(n ...int64) int64 {
 	return dps.maxPoints // getter
 }
 
+func (dps *dbSeries) Consolidation(cf ...rrd.Consolidation) rrd.Consolidation {
+	if len(cf) > 0 {
+		defer func() { dps.cf = cf[0] }()
+	}
+	return dps.cf
+}
+
 func (dps *dbSeries) Align() {}
 
 func (dps *dbSeries) Alias(s ...string) string {
@@ -105,12 +114,12 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 		rraStepMs      = dps.rra.Step().Nanoseconds() / 1e6
 	)
 
-	if dps.groupBy != 0 {
+	if groupByMs != 0 {
 		// Specific granularity was requested for alignment, we ignore maxPoints
 		finalGroupByMs = finalGroupByMs/groupByMs*groupByMs + groupByMs
 	} else if dps.maxPoints != 0 {
 		// If maxPoints was specified, then calculate group by interval
-		finalGroupByMs = (dps.to.Unix() - dps.from.Unix()) * 1000 / dps.maxPoints
+		finalGroupByMs = (dps.to.UnixNano() - dps.from.UnixNano()) / 1e6 / dps.maxPoints
 		finalGroupByMs = finalGroupByMs/rraStepMs*rraStepMs + rraStepMs
 	} else {
 		// Otherwise, group by will equal the rrastep
@@ -142,7 +151,24 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 			finalGroupByMs)
 		log.Printf("seriesQuerySqlUsingViewAndSeries() sqlSelectSeries -- " + sqlStatement)
 	}
-	rows, err = dps.db.sqlSelectSeries.Query(aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs)
+	// NaN (and NaNSentinel, $9) must not be averaged, nor be the max
+	// etc., they are NULL.
+	var sentinel interface{}
+	if NaNSentinel != nil {
+		sentinel = *NaNSentinel
+	}
+	args := []interface{}{aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id(), dps.rra.Id(), dps.from, dps.to, finalGroupByMs, sentinel}
+	if agg := seriesAggregate(dps.cf, dps.rra.Spec().Function, rraStepMs); agg == "" {
+		rows, err = dps.db.readStmt("FetchSeries", dps.db.sqlSelectSeries, dps.db.sqlSelectSeriesReplica, args...)
+	} else {
+		// Not prepared, these are rare.
+		stmt := fmt.Sprintf(
+			"SELECT max(tg) mt, %[2]s ar FROM generate_series($1, $2, ($3)::interval) AS tg "+
+				"LEFT OUTER JOIN (SELECT t, NULLIF(NULLIF(r, 'NaN'), $9) AS r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 "+
+				" AND t >= $6 AND t <= $7) s ON tg = s.t GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/$8 ORDER BY mt",
+			dps.db.prefix, agg)
+		rows, err = dps.db.readQuery("FetchSeries", dps.db.dbQConn, stmt, args...)
+	}
 
 	if err != nil {
 		log.Printf("seriesQuery(): error %v", err)
@@ -152,30 +178,38 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 	return rows, nil
 }
 
+// Runs the query of the series and returns its rows as DataPoints.
+func (dps *dbSeries) dataPoints() (*dbDataPoints, error) {
+	rows, err := dps.seriesQuerySqlUsingViewAndSeries()
+	if err != nil {
+		return nil, err
+	}
+	return &dbDataPoints{rows: rows}, nil
+}
+
 func (dps *dbSeries) Next() bool {
 
-	if dps.rows == nil { // First Next()
-		rows, err := dps.seriesQuerySqlUsingViewAndSeries()
+	if dps.points == nil { // First Next()
+		points, err := dps.dataPoints()
 		if err == nil {
-			dps.rows = rows
+			dps.points = points
 		} else {
 			log.Printf("dbSeries.Next(): database error: %v", err)
 			return false
 		}
 	}
 
-	if dps.rows.Next() {
-		if ts, value, err := timeValueFromRow(dps.rows); err != nil {
-			log.Printf("dbSeries.Next(): database error: %v", err)
-			return false
-		} else {
-			dps.posBegin = dps.latest
-			dps.posEnd = ts
-			dps.value = value
-			dps.latest = dps.posEnd
-		}
+	if dps.points.Next() {
+		dp := dps.points.DataPoint()
+		dps.posBegin = dps.latest
+		dps.posEnd = dp.Time
+		dps.value = dp.Value
+		dps.latest = dps.posEnd
 		return true
 	}
+	if err := dps.points.Err(); err != nil {
+		log.Printf("dbSeries.Next(): database error: %v", err)
+	}
 	return false
 }
 
@@ -188,26 +222,31 @@ func (dps *dbSeries) CurrentTime() time.Time {
 }
 
 func (dps *dbSeries) Close() error {
-	if dps.rows == nil {
+	if dps.points == nil {
 		return fmt.Errorf("Close() on dbSeries that isn not open.")
 	}
-	result := dps.rows.Close()
-	dps.rows = nil // next Next() will re-open
+	result := dps.points.Close()
+	dps.points = nil // next Next() will re-open
 	return result
 }
 
-func timeValueFromRow(rows *sql.Rows) (time.Time, float64, error) {
-	var (
-		value sql.NullFloat64
-		ts    time.Time
-	)
-	if err := rows.Scan(&ts, &value); err == nil {
-		if value.Valid {
-			return ts, value.Float64, nil
-		} else {
-			return ts, math.NaN(), nil
+// The SQL aggregate of the group by for cf, blank for the average,
+// which is sqlSelectSeries. See series.Consolidator. The slots of a
+// SUM RRA (rraCf) are already totals, they are not multiplied by the
+// step.
+func seriesAggregate(cf, rraCf rrd.Consolidation, stepMs int64) string {
+	switch cf {
+	case rrd.MAX:
+		return "max(r)"
+	case rrd.MIN:
+		return "min(r)"
+	case rrd.LAST:
+		return "(array_agg(r ORDER BY tg DESC) FILTER (WHERE r IS NOT NULL))[1]"
+	case rrd.SUM:
+		if rraCf == rrd.SUM {
+			return "sum(r)"
 		}
-	} else {
-		return time.Time{}, math.NaN(), err
+		return fmt.Sprintf("sum(r) * %g", float64(stepMs)/1000)
 	}
+	return ""
 }
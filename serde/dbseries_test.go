@@ -0,0 +1,188 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// recordingDriver remembers the last query (prepared or not) and its
+// arguments, returning rows (of two columns).
+type recordingDriver struct {
+	sync.Mutex
+	query string
+	args  []driver.Value
+	rows  [][]driver.Value
+}
+
+type recordingConn struct{ d *recordingDriver }
+
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+
+type recordingRows struct{ rows [][]driver.Value }
+
+func (r *recordingRows) Columns() []string { return []string{"mt", "ar"} }
+func (r *recordingRows) Close() error      { return nil }
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func (d *recordingDriver) Open(string) (driver.Conn, error) { return &recordingConn{d: d}, nil }
+
+func (d *recordingDriver) record(query string, args []driver.Value) (driver.Rows, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.query, d.args = query, args
+	return &recordingRows{rows: d.rows}, nil
+}
+
+func (c *recordingConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return c.d.record(query, args)
+}
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{d: c.d, query: query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.d.record(s.query, args)
+}
+
+var recording = &recordingDriver{}
+
+func init() {
+	sql.Register("tgres-recording", recording)
+}
+
+func Test_dbSeries_NaNSentinel(t *testing.T) {
+	db, _ := sql.Open("tgres-recording", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db, dbQConn: db, prefix: "tgres_"}
+	if err := p.prepareSqlStatements(); err != nil {
+		t.Fatal(err)
+	}
+
+	sentinel := -1e300
+	NaNSentinel = &sentinel
+	defer func() { NaNSentinel = nil }()
+	recording.rows = nil
+
+	latest := time.Unix(1500000000, 0)
+	rra, _ := newDbRoundRobinArchive(2, 200, 1, 1, rrd.RRASpec{Step: time.Minute, Span: time.Hour, Latest: latest})
+	ds := NewDbDataSource(1, Ident{"name": "foo"}, 0, 1, rrd.NewDataSource(rrd.DSSpec{Step: time.Minute}))
+
+	// WMEAN is the prepared statement, the others are not
+	for _, cf := range []rrd.Consolidation{rrd.WMEAN, rrd.MAX, rrd.SUM} {
+		dps := &dbSeries{db: p, ds: ds, rra: rra, from: latest.Add(-time.Hour), to: latest, cf: cf}
+		rows, err := dps.seriesQuerySqlUsingViewAndSeries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+		if !strings.Contains(recording.query, "NULLIF(NULLIF(r, 'NaN'), $9)") {
+			t.Errorf("%v: expected NaN and NaNSentinel to be NULL, got %s", cf, recording.query)
+		}
+		if len(recording.args) != 9 || recording.args[8] != sentinel {
+			t.Errorf("%v: expected the sentinel as the 9th argument, got %v", cf, recording.args)
+		}
+	}
+}
+
+// The slots of a SUM RRA are already totals, a sum of them is not
+// multiplied by the step.
+func Test_dbSeries_sumRRA(t *testing.T) {
+	db, _ := sql.Open("tgres-recording", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db, dbQConn: db, prefix: "tgres_"}
+	if err := p.prepareSqlStatements(); err != nil {
+		t.Fatal(err)
+	}
+	recording.rows = nil
+
+	latest := time.Unix(1500000000, 0)
+	ds := NewDbDataSource(1, Ident{"name": "foo"}, 0, 1, rrd.NewDataSource(rrd.DSSpec{Step: time.Minute}))
+	for _, c := range []struct {
+		rraCf  rrd.Consolidation
+		expect string
+	}{
+		{rrd.WMEAN, "sum(r) * 60 ar"},
+		{rrd.SUM, "sum(r) ar"},
+	} {
+		rra, _ := newDbRoundRobinArchive(2, 200, 1, 1, rrd.RRASpec{Function: c.rraCf, Step: time.Minute, Span: time.Hour, Latest: latest})
+		dps := &dbSeries{db: p, ds: ds, rra: rra, from: latest.Add(-time.Hour), to: latest, cf: rrd.SUM}
+		rows, err := dps.seriesQuerySqlUsingViewAndSeries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+		if !strings.Contains(recording.query, c.expect) {
+			t.Errorf("%v RRA: expected %q, got %s", c.rraCf, c.expect, recording.query)
+		}
+	}
+}
+
+func Test_dbSeries_Next(t *testing.T) {
+	db, _ := sql.Open("tgres-recording", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db, dbQConn: db, prefix: "tgres_"}
+	if err := p.prepareSqlStatements(); err != nil {
+		t.Fatal(err)
+	}
+
+	latest := time.Unix(1500000000, 0)
+	rra, _ := newDbRoundRobinArchive(2, 200, 1, 1, rrd.RRASpec{Step: time.Minute, Span: time.Hour, Latest: latest})
+	ds := NewDbDataSource(1, Ident{"name": "foo"}, 0, 1, rrd.NewDataSource(rrd.DSSpec{Step: time.Minute}))
+	recording.rows = [][]driver.Value{
+		{latest.Add(-time.Minute), 1.5},
+		{latest, nil},
+	}
+	defer func() { recording.rows = nil }()
+
+	dps := &dbSeries{db: p, ds: ds, rra: rra, from: latest.Add(-2 * time.Minute), to: latest}
+	var times []time.Time
+	var values []float64
+	for dps.Next() {
+		times, values = append(times, dps.CurrentTime()), append(values, dps.CurrentValue())
+	}
+	dps.Close()
+	if len(values) != 2 || values[0] != 1.5 || !math.IsNaN(values[1]) || !times[1].Equal(latest) {
+		t.Errorf("Expected 1.5 and NaN (NULL) at %v, got %v at %v", latest, values, times)
+	}
+}
@@ -0,0 +1,114 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/tgres/tgres/rrd"
+)
+
+// slotsBetween returns the indexes of the slots of rra ending between
+// from and until (inclusive), of those it currently holds, i.e. the
+// size slots up to its latest.
+func slotsBetween(rra rrd.RoundRobinArchiver, from, until time.Time) []int64 {
+	return slotsInRange(rra.Latest(), rra.Step(), rra.Size(), from, until)
+}
+
+// slotsInRange is slotsBetween for an RRA of step and size ending at
+// latest.
+func slotsInRange(latest time.Time, step time.Duration, size int64, from, until time.Time) []int64 {
+	if latest.IsZero() || size == 0 {
+		return nil
+	}
+	if earliest := latest.Add(-step * time.Duration(size-1)); from.Before(earliest) {
+		from = earliest
+	}
+	if until.After(latest) {
+		until = latest
+	}
+	// The end of the first slot at or after from
+	stepNs := step.Nanoseconds()
+	first := from.UnixNano() / stepNs * stepNs
+	if first < from.UnixNano() {
+		first += stepNs
+	}
+	var slots []int64
+	for t := first; t <= until.UnixNano(); t += stepNs {
+		slots = append(slots, rrd.SlotIndex(time.Unix(0, t), step, size))
+	}
+	return slots
+}
+
+// DeletePoints sets both the value and the version of the slots to
+// NULL, a NULL version never matches the one expected (see
+// SlotVersion()), so a slot reads as empty even if a stale value were
+// left behind.
+func (p *pgvSerDe) DeletePoints(id int64, from, until time.Time) (int, error) {
+	rras, err := p.DataSourceRRAs(id)
+	if err != nil {
+		return 0, dbError("DeletePoints", err)
+	}
+	if len(rras) == 0 {
+		return 0, newError("DeletePoints", ErrNotFound, "no DS with id %d", id)
+	}
+	return p.deletePoints(rras, from, until)
+}
+
+func (p *pgvSerDe) deletePoints(rras []rrd.RoundRobinArchiver, from, until time.Time) (int, error) {
+	stmt := fmt.Sprintf("UPDATE %[1]sts AS ts SET dp[$1] = NULL, ver[$1] = NULL WHERE rra_bundle_id = $2 AND seg = $3 AND i = ANY($4::int[])", p.prefix)
+
+	deleted := 0
+	for _, rra := range rras {
+		dbrra, ok := rra.(DbRoundRobinArchiver)
+		if !ok {
+			return deleted, newError("DeletePoints", ErrInvalid, "rra must be a DbRoundRobinArchiver")
+		}
+		slots := slotsBetween(dbrra, from, until)
+		if len(slots) == 0 {
+			continue
+		}
+		if _, err := p.dbConn.Exec(stmt, dbrra.Idx(), dbrra.BundleId(), dbrra.Seg(), pq.Array(slots)); err != nil {
+			log.Printf("DeletePoints: error %v", err)
+			return deleted, dbError("DeletePoints", err)
+		}
+		deleted += len(slots)
+	}
+	return deleted, nil
+}
+
+func (m *memSerDe) DeletePoints(id int64, from, until time.Time) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, ds := range m.byIdent {
+		if ds.Id() != id {
+			continue
+		}
+		deleted := 0
+		for _, rra := range ds.RRAs() {
+			dps := rra.DPs()
+			for _, i := range slotsBetween(rra, from, until) {
+				delete(dps, i)
+				deleted++
+			}
+		}
+		return deleted, nil
+	}
+	return 0, newError("DeletePoints", ErrNotFound, "no DS with id %d", id)
+}
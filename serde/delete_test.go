@@ -0,0 +1,109 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_slotsBetween(t *testing.T) {
+	rra, _ := newDbRoundRobinArchive(1, 10, 1, 1, rrd.RRASpec{Step: 10 * time.Second, Span: time.Minute, Latest: time.Unix(1000, 0)})
+	for _, c := range []struct {
+		from, until int64
+		exp         string
+	}{
+		{955, 985, "[0 1 2]"},      // the slots ending at 960, 970 and 980
+		{960, 980, "[0 1 2]"},      // inclusive
+		{0, 2000, "[5 0 1 2 3 4]"}, // only what the RRA holds, 950 to 1000
+		{1001, 2000, "[]"},
+		{500, 900, "[]"},
+	} {
+		if slots := fmt.Sprint(slotsBetween(rra, time.Unix(c.from, 0), time.Unix(c.until, 0))); slots != c.exp {
+			t.Errorf("%d to %d: expected %s, got %s", c.from, c.until, c.exp, slots)
+		}
+	}
+
+	empty, _ := newDbRoundRobinArchive(1, 10, 1, 1, rrd.RRASpec{Step: 10 * time.Second, Span: time.Minute})
+	if slots := slotsBetween(empty, time.Unix(0, 0), time.Unix(2000, 0)); slots != nil {
+		t.Errorf("Expected no slots of an RRA without data, got %v", slots)
+	}
+}
+
+func Test_pgvSerDe_deletePoints(t *testing.T) {
+	db, err := sql.Open("tgres-killing", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db, prefix: "tgres_"}
+
+	rra1, _ := newDbRoundRobinArchive(1, 10, 1, 3, rrd.RRASpec{Step: 10 * time.Second, Span: time.Minute, Latest: time.Unix(1000, 0)})
+	rra2, _ := newDbRoundRobinArchive(2, 10, 2, 3, rrd.RRASpec{Step: time.Minute, Span: time.Hour})
+	killing.execs, killing.kill, killing.stmts = 0, 0, nil
+	n, err := p.deletePoints([]rrd.RoundRobinArchiver{rra1, rra2}, time.Unix(955, 0), time.Unix(985, 0))
+	if err != nil || n != 3 {
+		t.Errorf("Expected 3 slots deleted, got %d: %v", n, err)
+	}
+	// rra2 has no data, nothing to do
+	if len(killing.stmts) != 1 || !strings.Contains(killing.stmts[0], "dp[$1] = NULL, ver[$1] = NULL") {
+		t.Errorf("Expected a single update setting dp and ver to NULL, got %v", killing.stmts)
+	}
+
+	// A NULL version reads as empty whatever the value
+	dps := make(map[int64]float64)
+	val := 1.0
+	latestI, latestVer := LatestVersion(rra1.Latest(), rra1.Step(), rra1.Size())
+	addVersionedDP(dps, 1, &val, nil, latestI, latestVer)
+	if len(dps) != 0 {
+		t.Errorf("Expected a slot with a NULL version to read as empty, got %v", dps)
+	}
+}
+
+func Test_memSerDe_DeletePoints(t *testing.T) {
+	db := NewMemSerDe()
+	ds, _ := db.FetchOrCreateDataSource(Ident{"name": "foo"}, &rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      []rrd.RRASpec{{Step: 10 * time.Second, Span: 10 * time.Minute}},
+	})
+	for n := int64(0); n <= 10; n++ {
+		ds.ProcessDataPoint(float64(n), time.Unix(1000+n*10, 0))
+	}
+
+	n, err := db.DeletePoints(ds.(DbDataSourcer).Id(), time.Unix(1030, 0), time.Unix(1050, 0))
+	if err != nil || n != 3 {
+		t.Errorf("Expected 3 slots deleted, got %d: %v", n, err)
+	}
+	s, _ := db.FetchSeries(ds, time.Unix(1010, 0), time.Unix(1100, 0), 0)
+	var got []float64
+	for s.Next() {
+		got = append(got, s.CurrentValue())
+	}
+	if len(got) != 10 || got[1] != 2 || !math.IsNaN(got[2]) || !math.IsNaN(got[4]) || got[5] != 6 {
+		t.Errorf("Expected the points ending at 1030 to 1050 to be NaN, got %v", got)
+	}
+
+	if _, err := db.DeletePoints(123, time.Unix(0, 0), time.Unix(1, 0)); !IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+}
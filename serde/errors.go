@@ -0,0 +1,128 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// These are the kinds of errors a SerDe returns, an *Error has one
+// of them as its Kind, use ErrorKind() or the Is*() functions to
+// tell them apart.
+var (
+	// The thing asked for (e.g. a DS by id) does not exist. Note
+	// that FetchOrCreateDataSource() with a nil spec returns nil, nil
+	// rather than this when the DS does not exist.
+	ErrNotFound = errors.New("not found")
+	// A constraint was violated, e.g. the DS was created by someone
+	// else at the same time. Retrying may succeed.
+	ErrConflict = errors.New("conflict")
+	// The database cannot be reached or is not accepting requests
+	// (connection errors, shutting down, out of resources).
+	ErrUnavailable = errors.New("database unavailable")
+	// The arguments or data are not valid, retrying will not help.
+	ErrInvalid = errors.New("invalid")
+	// Any other database error.
+	ErrDatabase = errors.New("database error")
+)
+
+// Error is an error returned by a SerDe, it wraps the underlying
+// (e.g. driver) error, if any.
+type Error struct {
+	Op   string // the method, e.g. "FetchSeries"
+	Kind error  // one of the Err* values above
+	Err  error  // the underlying error, can be nil
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %v", e.Op, e.Kind)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.Op, e.Kind, e.Err)
+}
+
+// Unwrap and Is make errors.Is(err, serde.ErrNotFound) work on Go
+// 1.13 and later.
+func (e *Error) Unwrap() error        { return e.Err }
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+// ErrorKind returns the kind (one of the Err* values) of err if it
+// is an *Error, otherwise nil.
+func ErrorKind(err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return nil
+}
+
+func IsNotFound(err error) bool    { return ErrorKind(err) == ErrNotFound }
+func IsConflict(err error) bool    { return ErrorKind(err) == ErrConflict }
+func IsUnavailable(err error) bool { return ErrorKind(err) == ErrUnavailable }
+func IsInvalid(err error) bool     { return ErrorKind(err) == ErrInvalid }
+
+func newError(op string, kind error, format string, a ...interface{}) error {
+	return &Error{Op: op, Kind: kind, Err: fmt.Errorf(format, a...)}
+}
+
+// dbError classifies an error which came from database/sql or the
+// PostgreSQL driver. It returns nil if err is nil and err itself if
+// it is already an *Error.
+func dbError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return &Error{Op: op, Kind: dbErrorKind(err), Err: err}
+}
+
+func dbErrorKind(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrUnavailable // the connection is gone
+	}
+	if _, ok := err.(net.Error); ok {
+		return ErrUnavailable
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		// https://www.postgresql.org/docs/current/static/errcodes-appendix.html
+		code := string(pqErr.Code)
+		if len(code) < 2 {
+			return ErrDatabase
+		}
+		switch code[:2] {
+		case "23": // integrity_constraint_violation
+			return ErrConflict
+		case "08", // connection_exception
+			"53", // insufficient_resources
+			"57": // operator_intervention (e.g. admin_shutdown)
+			return ErrUnavailable
+		case "22": // data_exception
+			return ErrInvalid
+		}
+	}
+	return ErrDatabase
+}
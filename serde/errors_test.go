@@ -0,0 +1,69 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func Test_dbError(t *testing.T) {
+	if dbError("Foo", nil) != nil {
+		t.Errorf("dbError(nil) should be nil")
+	}
+
+	for _, c := range []struct {
+		err  error
+		kind error
+	}{
+		{sql.ErrNoRows, ErrNotFound},
+		{driver.ErrBadConn, ErrUnavailable},
+		{io.EOF, ErrUnavailable},
+		{&pq.Error{Code: "23505"}, ErrConflict},    // unique_violation
+		{&pq.Error{Code: "57P01"}, ErrUnavailable}, // admin_shutdown
+		{&pq.Error{Code: "22003"}, ErrInvalid},     // numeric_value_out_of_range
+		{&pq.Error{Code: "XX000"}, ErrDatabase},    // internal_error
+		{fmt.Errorf("foo"), ErrDatabase},
+	} {
+		err := dbError("Foo", c.err)
+		if ErrorKind(err) != c.kind {
+			t.Errorf("dbError(%v): expected kind %v, got %v", c.err, c.kind, ErrorKind(err))
+		}
+		if e, ok := err.(*Error); !ok || e.Err != c.err {
+			t.Errorf("dbError(%v): the underlying error should be preserved", c.err)
+		}
+		// already classified errors are left alone
+		if dbError("Bar", err) != err {
+			t.Errorf("dbError(%v): should not wrap an *Error again", err)
+		}
+	}
+
+	err := newError("Foo", ErrNotFound, "no DS with id %d", 7)
+	if !IsNotFound(err) || IsConflict(err) || IsUnavailable(err) || IsInvalid(err) {
+		t.Errorf("newError: wrong kind: %v", err)
+	}
+	if err.Error() != "Foo: not found: no DS with id 7" {
+		t.Errorf("Unexpected error string: %q", err.Error())
+	}
+	if ErrorKind(fmt.Errorf("foo")) != nil {
+		t.Errorf("ErrorKind of a plain error should be nil")
+	}
+}
@@ -0,0 +1,149 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// RRAFillStats tell how much of the window of an RRA (its size slots
+// up to its latest) has data, e.g. an RRA which is never more than
+// half full keeps twice the span it needs.
+type RRAFillStats struct {
+	RRA       rrd.RoundRobinArchiver // the metadata only
+	Populated int64                  // slots with a current data point
+	Stale     int64                  // slots with data of an earlier iteration, which reads as NaN
+	Oldest    time.Time              // the end of the oldest populated slot, zero if none
+}
+
+// The fraction of the slots which are populated.
+func (f *RRAFillStats) Ratio() float64 {
+	if f.RRA.Size() <= 0 {
+		return 0
+	}
+	return float64(f.Populated) / float64(f.RRA.Size())
+}
+
+// Counts the data point in slot i, which is not NaN, using its
+// version to tell a current one from a stale one.
+func (f *RRAFillStats) add(i int64, ver *int64, latestI int64, latestVer int) {
+	if ver == nil || int(*ver) != SlotVersion(i, latestI, latestVer) {
+		f.Stale++
+		return
+	}
+	f.Populated++
+	step, size := f.RRA.Step(), f.RRA.Size()
+	t := f.RRA.Latest().Add(-step * time.Duration((size+latestI-i)%size))
+	if f.Oldest.IsZero() || t.Before(f.Oldest) {
+		f.Oldest = t
+	}
+}
+
+// RRAFillStats reads the data points of every RRA of the DS by id,
+// only the slot numbers and versions of those which are not NULL or
+// NaN are returned by the database.
+func (p *pgvSerDe) RRAFillStats(id int64) ([]*RRAFillStats, error) {
+	rras, err := p.DataSourceRRAs(id)
+	if err != nil {
+		return nil, dbError("RRAFillStats", err)
+	}
+	if len(rras) == 0 {
+		return nil, newError("RRAFillStats", ErrNotFound, "no DS with id %d", id)
+	}
+	return p.rraFillStats(rras)
+}
+
+func (p *pgvSerDe) rraFillStats(rras []rrd.RoundRobinArchiver) ([]*RRAFillStats, error) {
+	stmt := `
+  SELECT i, dp[$1], ver[$1]
+    FROM %[1]sts ts
+   WHERE rra_bundle_id = $2 AND seg = $3 AND dp[$1] IS NOT NULL AND dp[$1] <> 'NaN'
+`
+	stmt = fmt.Sprintf(stmt, p.prefix)
+
+	result := make([]*RRAFillStats, 0, len(rras))
+	for _, rra := range rras {
+		dbrra, ok := rra.(DbRoundRobinArchiver)
+		if !ok {
+			return nil, newError("RRAFillStats", ErrInvalid, "rra must be a DbRoundRobinArchiver")
+		}
+		fs := &RRAFillStats{RRA: rra}
+		result = append(result, fs)
+		if rra.Latest().IsZero() || rra.Size() == 0 {
+			continue // nothing was ever stored
+		}
+
+		rows, err := p.dbConn.Query(stmt, dbrra.Idx(), dbrra.BundleId(), dbrra.Seg())
+		if err != nil {
+			log.Printf("RRAFillStats: error %v", err)
+			return nil, dbError("RRAFillStats", err)
+		}
+		latestI, latestVer := LatestVersion(rra.Latest(), rra.Step(), rra.Size())
+		for rows.Next() {
+			var (
+				i   int64
+				val *float64
+				ver *int64
+			)
+			if err := rows.Scan(&i, &val, &ver); err != nil {
+				rows.Close()
+				log.Printf("RRAFillStats: error scanning %v", err)
+				return nil, dbError("RRAFillStats", err)
+			}
+			if !math.IsNaN(decodeDp(val)) {
+				fs.add(i, ver, latestI, latestVer)
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, dbError("RRAFillStats", err)
+		}
+	}
+	return result, nil
+}
+
+// In memory there are no stale slots, only the current ones are kept.
+func (m *memSerDe) RRAFillStats(id int64) ([]*RRAFillStats, error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, ds := range m.byIdent {
+		if ds.Id() != id {
+			continue
+		}
+		var result []*RRAFillStats
+		for _, rra := range ds.RRAs() {
+			fs := &RRAFillStats{RRA: rra}
+			if !rra.Latest().IsZero() && rra.Size() > 0 {
+				latestI, latestVer := LatestVersion(rra.Latest(), rra.Step(), rra.Size())
+				for i, v := range rra.DPs() {
+					if !math.IsNaN(v) {
+						ver := int64(SlotVersion(i, latestI, latestVer))
+						fs.add(i, &ver, latestI, latestVer)
+					}
+				}
+			}
+			result = append(result, fs)
+		}
+		return result, nil
+	}
+	return nil, newError("RRAFillStats", ErrNotFound, "no DS with id %d", id)
+}
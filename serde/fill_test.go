@@ -0,0 +1,85 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_pgvSerDe_rraFillStats(t *testing.T) {
+	latest := time.Unix(1500000000, 0).Truncate(time.Minute)
+	dss := bundleSetup(3, latest)
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+
+	// idx 2: a stale slot, one NaN and the oldest 1000 slots empty
+	key := bundleSeg{1, 0}
+	latestI, ver := LatestVersion(latest, time.Minute, 1440)
+	bundles.ts[key][latestI][1][1] = int64((ver + 1) % (MaxVersion + 1))
+	bundles.ts[key][(latestI+1439)%1440][1][0] = math.NaN()
+	for n := int64(1); n <= 1000; n++ {
+		bundles.ts[key][(latestI+n)%1440][1] = [2]interface{}{}
+	}
+
+	empty, _ := newDbRoundRobinArchive(9, 200, 2, 1, rrd.RRASpec{Step: time.Hour, Span: 24 * time.Hour})
+	rras := append(dss[1].RRAs(), dss[0].RRAs()[0], empty)
+	stats, err := p.rraFillStats(rras)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 || bundles.queries["fill"] != 2 {
+		t.Fatalf("Expected 3 stats in 2 queries (none for the empty RRA), got %d in %v", len(stats), bundles.queries)
+	}
+	if s := stats[0]; s.Populated != 438 || s.Stale != 1 || !s.Oldest.Equal(latest.Add(-439*time.Minute)) {
+		t.Errorf("Expected 438 populated, 1 stale, oldest 439m before latest, got %d %d %v", s.Populated, s.Stale, s.Oldest)
+	}
+	if s := stats[1]; s.Populated != 1440 || s.Stale != 0 || s.Ratio() != 1 || !s.Oldest.Equal(latest.Add(-1439*time.Minute)) {
+		t.Errorf("Expected a full RRA, got %d %d %v %v", s.Populated, s.Stale, s.Ratio(), s.Oldest)
+	}
+	if s := stats[2]; s.Populated != 0 || s.Ratio() != 0 || !s.Oldest.IsZero() {
+		t.Errorf("Expected an empty RRA, got %d %v %v", s.Populated, s.Ratio(), s.Oldest)
+	}
+}
+
+func Test_memSerDe_RRAFillStats(t *testing.T) {
+	db := NewMemSerDe()
+	ds, _ := db.FetchOrCreateDataSource(Ident{"name": "foo"}, &rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      []rrd.RRASpec{{Step: 10 * time.Second, Span: 10 * time.Minute}},
+	})
+	for n := int64(0); n <= 15; n++ {
+		ds.ProcessDataPoint(float64(n), time.Unix(1000+n*10, 0))
+	}
+
+	stats, err := db.RRAFillStats(ds.(DbDataSourcer).Id())
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("Expected 1 RRA, got %v: %v", stats, err)
+	}
+	if s := stats[0]; s.Populated != 15 || s.Stale != 0 || s.Ratio() != 0.25 || !s.Oldest.Equal(time.Unix(1010, 0)) {
+		t.Errorf("Expected 15 of 60 slots populated from 1010, got %d %d %v %v", s.Populated, s.Stale, s.Ratio(), s.Oldest)
+	}
+
+	if _, err := db.RRAFillStats(123); !IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// The RRA of the smallest step, or nil if there are none.
+func finestRRA(rras []rrd.RoundRobinArchiver) rrd.RoundRobinArchiver {
+	var finest rrd.RoundRobinArchiver
+	for _, rra := range rras {
+		if finest == nil || rra.Step() < finest.Step() {
+			finest = rra
+		}
+	}
+	return finest
+}
+
+// The count slot indexes starting skip slots back from latest, most
+// recent first.
+func latestSlots(latest time.Time, step time.Duration, size, skip, count int64) []int64 {
+	slots := make([]int64, 0, count)
+	for k := skip; k < skip+count && k < size; k++ {
+		slots = append(slots, rrd.SlotIndex(latest.Add(-time.Duration(k)*step), step, size))
+	}
+	return slots
+}
+
+// The (at most) n most recent of dps that are not NaN as DataPoints,
+// oldest first.
+func latestDataPoints(dps map[int64]float64, latest time.Time, step time.Duration, size int64, n int) []DataPoint {
+	result := make([]DataPoint, 0, len(dps))
+	for i, v := range dps {
+		if !math.IsNaN(v) {
+			result = append(result, DataPoint{Time: rrd.SlotTime(i, latest, step, size), Value: v})
+		}
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].Time.Before(result[b].Time) })
+	if len(result) > n {
+		result = result[len(result)-n:]
+	}
+	return result
+}
+
+// LatestPoints reads the slots of the finest RRA back from its latest
+// (as stored in rra_state), n of them at first and twice as many as
+// the time before while fewer than n points were found, until the
+// whole RRA is read. Usually the first query is all it takes.
+func (p *pgvSerDe) LatestPoints(id int64, n int) ([]DataPoint, error) {
+	rras, err := p.DataSourceRRAs(id)
+	if err != nil {
+		return nil, err
+	}
+	rra, ok := finestRRA(rras).(DbRoundRobinArchiver)
+	if !ok {
+		return nil, newError("LatestPoints", ErrNotFound, "no DS with id %d", id)
+	}
+	if n <= 0 || rra.Latest().IsZero() {
+		return []DataPoint{}, nil
+	}
+
+	latestI, latestVer := LatestVersion(rra.Latest(), rra.Step(), rra.Size())
+	dps := make(map[int64]float64)
+	count := int64(n)
+	for skip := int64(0); skip < rra.Size() && len(dps) < n; skip += count {
+		if skip > 0 {
+			count *= 2
+		}
+		slots := latestSlots(rra.Latest(), rra.Step(), rra.Size(), skip, count)
+		err := p.queryBundleRows("LatestPoints", rra.BundleId(), rra.Seg(), slots, []int64{rra.Idx()}, func(i, idx int64, val *float64, ver *int64) {
+			addVersionedDP(dps, i, val, ver, latestI, latestVer)
+		})
+		if err != nil {
+			return nil, dbError("LatestPoints", err)
+		}
+	}
+	return latestDataPoints(dps, rra.Latest(), rra.Step(), rra.Size(), n), nil
+}
+
+func (m *memSerDe) LatestPoints(id int64, n int) ([]DataPoint, error) {
+	rras, _ := m.DataSourceRRAs(id)
+	rra := finestRRA(rras)
+	if rra == nil {
+		return nil, newError("LatestPoints", ErrNotFound, "no DS with id %d", id)
+	}
+	if n <= 0 || rra.Latest().IsZero() {
+		return []DataPoint{}, nil
+	}
+	m.RLock()
+	defer m.RUnlock()
+	return latestDataPoints(rra.DPs(), rra.Latest(), rra.Step(), rra.Size(), n), nil
+}
@@ -0,0 +1,131 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_latestSlots(t *testing.T) {
+	latest := time.Unix(120, 0) // slot 2 of 10 x 10s
+	if got := latestSlots(latest, 10*time.Second, 10, 0, 4); !reflect.DeepEqual(got, []int64{2, 1, 0, 9}) {
+		t.Errorf("Expected [2 1 0 9], got %v", got)
+	}
+	if got := latestSlots(latest, 10*time.Second, 10, 8, 4); !reflect.DeepEqual(got, []int64{4, 3}) {
+		t.Errorf("Expected [4 3] (not past the size), got %v", got)
+	}
+}
+
+func Test_latestDataPoints(t *testing.T) {
+	latest := time.Unix(120, 0)
+	dps := map[int64]float64{2: 20, 1: math.NaN(), 9: 9, 8: 8}
+	got := latestDataPoints(dps, latest, 10*time.Second, 10, 2)
+	exp := []DataPoint{{time.Unix(90, 0), 9}, {time.Unix(120, 0), 20}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func Test_memSerDe_LatestPoints(t *testing.T) {
+	db := NewMemSerDe()
+	ds, _ := db.FetchOrCreateDataSource(Ident{"name": "foo"}, &rrd.DSSpec{
+		Step:      10 * time.Second,
+		Heartbeat: time.Hour,
+		RRAs: []rrd.RRASpec{
+			{Function: rrd.WMEAN, Step: time.Minute, Span: time.Hour},
+			{Function: rrd.WMEAN, Step: 10 * time.Second, Span: 10 * time.Minute},
+		},
+	})
+	id := ds.(DbDataSourcer).Id()
+
+	if got, err := db.LatestPoints(id, 3); err != nil || len(got) != 0 {
+		t.Errorf("Expected no points yet, got %v: %v", got, err)
+	}
+
+	for n := int64(0); n <= 10; n++ {
+		ds.ProcessDataPoint(float64(n), time.Unix(1000+n*10, 0))
+	}
+	got, err := db.LatestPoints(id, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []DataPoint{{time.Unix(1080, 0), 8}, {time.Unix(1090, 0), 9}, {time.Unix(1100, 0), 10}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected the finest RRA's %v, got %v", exp, got)
+	}
+
+	if got, _ := db.LatestPoints(id, 100); len(got) != 10 {
+		t.Errorf("Expected all 10 points, got %d", len(got))
+	}
+
+	if _, err := db.LatestPoints(123, 1); !IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+}
+
+func Test_pgvSerDe_LatestFromData(t *testing.T) {
+	// The first slot of round MaxVersion+1, i.e. the version is 0
+	// again and the slots after the latest are of version MaxVersion.
+	round := int64(MaxVersion+1) * 1440
+	latest := time.Unix((round+100)*60, 0)
+	dss := bundleSetup(1, latest)
+	db, _ := sql.Open("tgres-bundle", "")
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db}
+	rra := dss[0].RRAs()[0].(DbRoundRobinArchiver)
+	key := bundleSeg{1, 0}
+	now := latest.Add(30 * time.Second)
+
+	if _, ver := LatestVersion(latest, time.Minute, 1440); ver != 0 || bundles.ts[key][101][0][1] != int64(MaxVersion) {
+		t.Fatalf("Expected version 0 at latest and %d after it, got %d and %v", MaxVersion, ver, bundles.ts[key][101][0][1])
+	}
+
+	for _, c := range []struct {
+		desc   string
+		modify func()
+		exp    time.Time
+	}{
+		{"wrapped round", func() {}, latest},
+		{"a slot after latest of the current version is in the future", func() {
+			bundles.ts[key][101][0][1] = int64(0)
+		}, latest},
+		{"latest is NaN", func() {
+			bundles.ts[key][100][0][0] = math.NaN()
+		}, latest.Add(-time.Minute)},
+		{"only the previous round wrapped", func() {
+			for i := int64(0); i <= 101; i++ {
+				bundles.ts[key][i][0] = [2]interface{}{}
+			}
+		}, time.Unix((round-1)*60, 0)},
+		{"no data", func() {
+			for i := int64(0); i < 1440; i++ {
+				bundles.ts[key][i][0] = [2]interface{}{}
+			}
+		}, time.Time{}},
+	} {
+		c.modify()
+		got, err := p.LatestFromData(rra, now)
+		if err != nil || !got.Equal(c.exp) {
+			t.Errorf("%s: expected %v, got %v (%v)", c.desc, c.exp, got, err)
+		}
+	}
+}
@@ -16,6 +16,7 @@
 package serde
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -27,6 +28,8 @@ type memSerDe struct {
 	*sync.RWMutex
 	byIdent map[string]*DbDataSource
 	lastId  int64
+	events  []*Event
+	attrs   map[int64]map[string]string
 }
 
 // Returns a SerDe which keeps everything in memory.
@@ -34,6 +37,7 @@ func NewMemSerDe() *memSerDe {
 	return &memSerDe{
 		RWMutex: &sync.RWMutex{},
 		byIdent: make(map[string]*DbDataSource),
+		attrs:   make(map[int64]map[string]string),
 	}
 }
 
@@ -69,7 +73,14 @@ func (m *memSerDe) Search(_ SearchQuery) (SearchResult, error) {
 }
 
 func (*memSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error) {
-	return series.NewRRASeries(ds.RRAs()[0]), nil
+	rra := ds.BestRRA(from, to, maxPoints)
+	if rra == nil {
+		return nil, newError("FetchSeries", ErrNotFound, "No adequate RRA found for DS from: %v to: %v maxPoints: %v", from, to, maxPoints)
+	}
+	s := series.NewRRASeries(rra)
+	s.TimeRange(from, to)
+	s.MaxPoints(maxPoints)
+	return s, nil
 }
 
 func (m *memSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
@@ -89,8 +100,68 @@ func (m *memSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	if ds, ok := m.byIdent[ident.String()]; ok {
 		return ds, nil
 	}
+	if dsSpec == nil {
+		return nil, nil // fetch only
+	}
 	m.lastId++
 	ds := NewDbDataSource(m.lastId, ident, 0, 0, rrd.NewDataSource(*dsSpec))
 	m.byIdent[ident.String()] = ds
 	return ds, nil
 }
+
+func (m *memSerDe) DataSourceRRAs(id int64) ([]rrd.RoundRobinArchiver, error) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, ds := range m.byIdent {
+		if ds.Id() == id {
+			return ds.RRAs(), nil
+		}
+	}
+	return nil, nil // not found
+}
+
+func (m *memSerDe) StoreEvent(e *Event) error {
+	m.Lock()
+	defer m.Unlock()
+	e.Id = int64(len(m.events) + 1)
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *memSerDe) FetchEvents(tags []string, from, to time.Time) ([]*Event, error) {
+	m.RLock()
+	defer m.RUnlock()
+	result := []*Event{}
+	for _, e := range m.events {
+		if e.When.Before(from) || e.When.After(to) {
+			continue
+		}
+		if hasAllTags(e.Tags, tags) {
+			result = append(result, e)
+		}
+	}
+	sort.Stable(eventsByTime(result))
+	return result, nil
+}
+
+type eventsByTime []*Event
+
+func (e eventsByTime) Len() int           { return len(e) }
+func (e eventsByTime) Less(i, j int) bool { return e[i].When.Before(e[j].When) }
+func (e eventsByTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+func hasAllTags(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// If false, InitDb does not create or migrate the schema, it only
+// warns if the schema_version table says it is not current. For
+// operators who manage the schema themselves.
+var PgMigrate = true
+
+// A schema change, the SQL is formatted with the prefix and
+// PgSegmentWidth. createTablesIfNotExist creates the current schema,
+// but their schema_version is empty, therefore every migration must
+// be safe to run against a schema which already has it (i.e. check
+// before it alters).
+type pgMigration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// In order of version, which must be consecutive from 1. Never change
+// or remove a migration once released, add a new one.
+var pgMigrations = []pgMigration{
+	{1, "ds_state and rra_state", `
+DO $$
+  DECLARE r RECORD;
+  DECLARE q TEXT;
+BEGIN
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sds' and column_name='created_at') > 0 THEN
+    -- migration done already, nothing to do
+    RETURN;
+  END IF;
+
+  -- DS STATE
+
+  -- set seg and idx
+  ALTER TABLE %[1]sds ADD COLUMN seg INT NOT NULL DEFAULT 0;
+  ALTER TABLE %[1]sds ADD COLUMN idx INT NOT NULL DEFAULT 0;
+  UPDATE %[1]sds SET seg = (id - 1) / %[2]d;
+  UPDATE %[1]sds SET idx = mod(id - 1, %[2]d) + 1;
+  ALTER TABLE %[1]sds ALTER COLUMN seg SET DEFAULT (lastval()-1) / %[2]d;
+  ALTER TABLE %[1]sds ALTER COLUMN idx SET DEFAULT mod(lastval()-1, %[2]d)+1;
+
+  -- good to have
+  ALTER TABLE %[1]sds ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+  -- populate the data in ds_state
+  INSERT INTO %[1]sds_state(seg) SELECT DISTINCT(seg) AS seg FROM %[1]sds;
+
+  FOR r IN SELECT id, seg, idx, lastupdate, duration_ms, value FROM %[1]sds ORDER BY id
+  LOOP
+    q := 'UPDATE %[1]sds_state SET'
+         || ' lastupdate[' || r.idx || '] = ' || quote_nullable(r.lastupdate)
+         || ',duration_ms[' || r.idx || '] = ' || r.duration_ms
+         || ',value[' || r.idx || '] = ' || quote_nullable(r.value::TEXT) || '::DOUBLE PRECISION'
+         || ' WHERE seg = ' || r.seg;
+    EXECUTE q;
+  END LOOP;
+
+  -- drop the columns
+  ALTER TABLE %[1]sds DROP COLUMN lastupdate;
+  ALTER TABLE %[1]sds DROP COLUMN duration_ms;
+  ALTER TABLE %[1]sds DROP COLUMN value;
+
+  -- RRA STATE
+
+  -- drop the newly-created rra_state and use the already existing rra_latest
+  DROP TABLE IF EXISTS %[1]srra_state;
+  ALTER TABLE %[1]srra_latest RENAME TO %[1]srra_state;
+  ALTER INDEX %[1]sidx_rra_latest_bundle_id_seg RENAME TO %[1]sidx_rra_state_bundle_id_seg;
+  ALTER TABLE %[1]srra_state RENAME CONSTRAINT %[1]srra_latest_rra_bundle_id_fkey TO %[1]srra_state_rra_bundle_id_fkey;
+
+  -- add columns for duration and value
+  ALTER TABLE %[1]srra_state ADD COLUMN duration_ms BIGINT[] NOT NULL DEFAULT '{}';
+  ALTER TABLE %[1]srra_state ADD COLUMN value DOUBLE PRECISION[] NOT NULL DEFAULT '{}';
+
+  -- populate duration and value in rra_state
+  FOR r IN SELECT id, rra_bundle_id, seg, idx, duration_ms, value FROM %[1]srra WHERE duration_ms > 0 ORDER BY id
+  LOOP
+    q := 'UPDATE %[1]srra_state SET'
+         || ' duration_ms[' || r.idx || '] = ' || r.duration_ms
+         || ',value[' || r.idx || '] = ' || quote_nullable(r.value::TEXT) || '::DOUBLE PRECISION'
+         || ' WHERE rra_bundle_id = ' || r.rra_bundle_id || ' AND seg = ' || r.seg;
+    EXECUTE q;
+  END LOOP;
+
+  -- drop the columns
+  ALTER TABLE %[1]srra DROP COLUMN duration_ms;
+  ALTER TABLE %[1]srra DROP COLUMN value;
+
+END
+$$;
+`},
+	{2, "ds.attrs", `
+DO $$
+BEGIN
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sds' and column_name='attrs') = 0 THEN
+    ALTER TABLE %[1]sds ADD COLUMN attrs JSONB NOT NULL DEFAULT '{}';
+  END IF;
+END
+$$;
+`},
+	{3, "rra.rollup", `
+DO $$
+BEGIN
+  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]srra' and column_name='rollup') = 0 THEN
+    ALTER TABLE %[1]srra ADD COLUMN rollup BOOL NOT NULL DEFAULT false;
+  END IF;
+END
+$$;
+`},
+}
+
+// The version of the schema this code expects.
+func pgSchemaVersion() int {
+	return pgMigrations[len(pgMigrations)-1].version
+}
+
+// SchemaVersion returns the version of the database schema this
+// Tgres expects, that of the last migration.
+func SchemaVersion() int {
+	return pgSchemaVersion()
+}
+
+// The migrations after version current, in order.
+func pendingMigrations(current int) []pgMigration {
+	for i, m := range pgMigrations {
+		if m.version > current {
+			return pgMigrations[i:]
+		}
+	}
+	return nil
+}
+
+// migrate applies the pending migrations and records them in
+// schema_version, all in one transaction, so that a failed migration
+// leaves the schema as it was. Other nodes starting at the same time
+// wait on the advisory lock and then find nothing to do.
+func (p *pgvSerDe) migrate() error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // does nothing after Commit()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", p.prefix+"schema_version"); err != nil {
+		return err
+	}
+
+	stmt := `
+CREATE TABLE IF NOT EXISTS %[1]sschema_version (
+  version INT NOT NULL PRIMARY KEY,
+  name TEXT NOT NULL DEFAULT '',
+  applied_at TIMESTAMPTZ NOT NULL DEFAULT now());
+`
+	if _, err := tx.Exec(fmt.Sprintf(stmt, p.prefix)); err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(tx, p.prefix)
+	if err != nil {
+		return err
+	}
+	if current > pgSchemaVersion() {
+		log.Printf("WARNING: database schema version %d is newer than %d of this Tgres.", current, pgSchemaVersion())
+	}
+
+	for _, m := range pendingMigrations(current) {
+		log.Printf("Applying schema migration %d (%s).", m.version, m.name)
+		if _, err := tx.Exec(fmt.Sprintf(m.sql, p.prefix, PgSegmentWidth)); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.name, err)
+		}
+		stmt := fmt.Sprintf("INSERT INTO %[1]sschema_version (version, name) VALUES ($1, $2)", p.prefix)
+		if _, err := tx.Exec(stmt, m.version, m.name); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkSchemaVersion is what InitDb does instead of migrate() when
+// PgMigrate is false.
+func (p *pgvSerDe) checkSchemaVersion() {
+	current, err := schemaVersion(p.dbConn, p.prefix)
+	if err != nil {
+		log.Printf("WARNING: schema migrations are disabled, cannot read the schema version: %v", err)
+	} else if current != pgSchemaVersion() {
+		log.Printf("WARNING: schema migrations are disabled, database schema version %d, expected %d.", current, pgSchemaVersion())
+	}
+}
+
+// DbSchemaVersion returns the version recorded in schema_version.
+func (p *pgvSerDe) DbSchemaVersion() (int, error) {
+	v, err := schemaVersion(p.dbConn, p.prefix)
+	return v, dbError("DbSchemaVersion", err)
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// The highest version in schema_version, 0 if none.
+func schemaVersion(db queryRower, prefix string) (int, error) {
+	var version int
+	err := db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %[1]sschema_version", prefix)).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,187 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// migratingDriver keeps schema_version in memory: the versions
+// inserted in a transaction only become visible when it commits.
+// Statements containing fail fail.
+type migratingDriver struct {
+	sync.Mutex
+	versions []int
+	stmts    []string // executed successfully
+	fail     string
+}
+
+type migratingConn struct {
+	d       *migratingDriver
+	pending []int
+}
+
+func (d *migratingDriver) Open(string) (driver.Conn, error) { return &migratingConn{d: d}, nil }
+
+func (c *migratingConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	c.d.Lock()
+	defer c.d.Unlock()
+	if c.d.fail != "" && strings.Contains(query, c.d.fail) {
+		return nil, fmt.Errorf("failed: %s", c.d.fail)
+	}
+	if strings.HasPrefix(query, "INSERT INTO tgres_schema_version") {
+		c.pending = append(c.pending, int(args[0].(int64)))
+	}
+	c.d.stmts = append(c.d.stmts, query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *migratingConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	c.d.Lock()
+	defer c.d.Unlock()
+	max := 0
+	for _, v := range c.d.versions {
+		if v > max {
+			max = v
+		}
+	}
+	return &versionRows{version: int64(max)}, nil
+}
+
+func (c *migratingConn) Prepare(string) (driver.Stmt, error) { return nil, fmt.Errorf("not supported") }
+func (c *migratingConn) Close() error                        { return nil }
+func (c *migratingConn) Begin() (driver.Tx, error)           { return c, nil }
+
+func (c *migratingConn) Commit() error {
+	c.d.Lock()
+	defer c.d.Unlock()
+	c.d.versions = append(c.d.versions, c.pending...)
+	c.pending = nil
+	return nil
+}
+
+func (c *migratingConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+
+type versionRows struct {
+	version int64
+	done    bool
+}
+
+func (r *versionRows) Columns() []string { return []string{"version"} }
+func (r *versionRows) Close() error      { return nil }
+func (r *versionRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	dest[0], r.done = r.version, true
+	return nil
+}
+
+var migrating = &migratingDriver{}
+
+func init() {
+	sql.Register("tgres-migrating", migrating)
+}
+
+func Test_pgMigrations(t *testing.T) {
+	for i, m := range pgMigrations {
+		if m.version != i+1 {
+			t.Errorf("Expected migration %d to be version %d, got %d", i, i+1, m.version)
+		}
+	}
+	if ms := pendingMigrations(1); len(ms) != len(pgMigrations)-1 || ms[0].version != 2 {
+		t.Errorf("Expected the migrations after 1, got %v", ms)
+	}
+	if ms := pendingMigrations(pgSchemaVersion()); len(ms) != 0 {
+		t.Errorf("Expected no migrations pending, got %v", ms)
+	}
+}
+
+func Test_pgvSerDe_migrate(t *testing.T) {
+	db, err := sql.Open("tgres-migrating", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db, prefix: "tgres_"}
+
+	applied := func() (n int) {
+		for _, stmt := range migrating.stmts {
+			if strings.Contains(stmt, "DO $$") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// A failed migration is not recorded, nor are the ones before it
+	// in the same transaction.
+	migrating.versions, migrating.stmts, migrating.fail = []int{1}, nil, "rollup"
+	if err := p.migrate(); err == nil || !strings.Contains(err.Error(), "migration 3") {
+		t.Errorf("Expected migration 3 to fail, got: %v", err)
+	}
+	if len(migrating.versions) != 1 {
+		t.Errorf("Expected no versions recorded after a failure, got %v", migrating.versions)
+	}
+
+	migrating.stmts, migrating.fail = nil, ""
+	if err := p.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := applied(); n != 2 {
+		t.Errorf("Expected 2 migrations applied, got %d", n)
+	}
+	if len(migrating.versions) != 3 || migrating.versions[2] != 3 {
+		t.Errorf("Expected versions 1 to 3 recorded, got %v", migrating.versions)
+	}
+	for _, stmt := range migrating.stmts {
+		if strings.Contains(stmt, "%!") || strings.Contains(stmt, "%[") {
+			t.Errorf("Badly formatted statement: %s", stmt)
+		}
+	}
+
+	// Running it again does nothing
+	migrating.stmts = nil
+	if err := p.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if n := applied(); n != 0 || len(migrating.versions) != 3 {
+		t.Errorf("Expected nothing applied the second time, got %d (versions %v)", n, migrating.versions)
+	}
+}
+
+func Test_pgvSerDe_DbSchemaVersion(t *testing.T) {
+	db, err := sql.Open("tgres-migrating", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db, prefix: "tgres_"}
+
+	migrating.versions = []int{1, 2}
+	if v, err := p.DbSchemaVersion(); err != nil || v != 2 {
+		t.Errorf("Expected version 2, got %d (err: %v)", v, err)
+	}
+}
@@ -0,0 +1,79 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import "math"
+
+// NaN is what a missing data point reads as, but some tools reading
+// the ts table or the tv view directly cannot deal with NaN (nor
+// ±Inf, which older PostgreSQL versions do not even accept in the
+// form the driver sends it in). Therefore NaN and ±Inf data points
+// are written as NULL, or as NaNSentinel if it is not nil, and both
+// read back as NaN. If RejectInf is true, flushing an ±Inf data
+// point (or DS or RRA state value) fails with ErrInvalid instead.
+//
+// The DS and RRA state values are not data points and are written
+// as NaN, except ±Inf which also becomes NaN.
+var (
+	NaNSentinel *float64
+	RejectInf   bool
+)
+
+// Returns the copy of dps (the values of which are float64) as they
+// should be written to the database.
+func encodeDps(op string, dps map[int64]interface{}) (map[int64]interface{}, error) {
+	result := make(map[int64]interface{}, len(dps))
+	for k, v := range dps {
+		f, ok := v.(float64)
+		if !ok || !(math.IsNaN(f) || math.IsInf(f, 0)) {
+			result[k] = v
+			continue
+		}
+		if RejectInf && math.IsInf(f, 0) {
+			return nil, newError(op, ErrInvalid, "%v data point at %d", f, k)
+		}
+		if NaNSentinel != nil {
+			result[k] = *NaNSentinel
+		} else {
+			result[k] = nil // NULL
+		}
+	}
+	return result, nil
+}
+
+// Same as encodeDps, but for state values, which stay NaN.
+func encodeStateValues(op string, values map[int64]interface{}) (map[int64]interface{}, error) {
+	result := make(map[int64]interface{}, len(values))
+	for k, v := range values {
+		if f, ok := v.(float64); ok && math.IsInf(f, 0) {
+			if RejectInf {
+				return nil, newError(op, ErrInvalid, "%v value at %d", f, k)
+			}
+			v = math.NaN()
+		}
+		result[k] = v
+	}
+	return result, nil
+}
+
+// Returns the value of a data point read from the database, val is
+// nil if it was NULL.
+func decodeDp(val *float64) float64 {
+	if val == nil || (NaNSentinel != nil && *val == *NaNSentinel) {
+		return math.NaN()
+	}
+	return *val
+}
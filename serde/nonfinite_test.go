@@ -0,0 +1,101 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// Encodes dps as for a flush, then reads them back as from the tv
+// view.
+func roundTripDps(t *testing.T, dps []float64) []float64 {
+	m := make(map[int64]interface{}, len(dps))
+	for i, v := range dps {
+		m[int64(i)] = v
+	}
+	enc, err := encodeDps("test", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1000, 0)
+	rows := &fakeRows{}
+	for i := range dps {
+		var r *float64
+		if v, ok := enc[int64(i)].(float64); ok {
+			r = &v
+		} else if enc[int64(i)] != nil {
+			t.Fatalf("Unexpected encoded value: %#v", enc[int64(i)])
+		}
+		rows.rows = append(rows.rows, []interface{}{start.Add(time.Duration(i) * time.Minute), r})
+	}
+	var result []float64
+	for d := (&dbDataPoints{rows: rows}); d.Next(); {
+		result = append(result, d.DataPoint().Value)
+	}
+	return result
+}
+
+func Test_encodeDps_NaN(t *testing.T) {
+	defer func() { NaNSentinel, RejectInf = nil, false }()
+
+	in := []float64{1.5, math.NaN(), math.Inf(1), math.Inf(-1)}
+
+	m := map[int64]interface{}{0: in[0], 1: in[1]}
+	if enc, _ := encodeDps("test", m); enc[0] != 1.5 || enc[1] != nil {
+		t.Errorf("Expected NaN to be written as NULL by default, got %v", enc)
+	}
+	if !math.IsNaN(m[1].(float64)) {
+		t.Errorf("encodeDps must not change its argument")
+	}
+
+	for _, sentinel := range []*float64{nil, new(float64)} {
+		NaNSentinel = sentinel
+		got := roundTripDps(t, in)
+		if len(got) != len(in) || got[0] != 1.5 {
+			t.Fatalf("Unexpected round trip result (sentinel %v): %v", sentinel, got)
+		}
+		for _, v := range got[1:] {
+			if !math.IsNaN(v) {
+				t.Errorf("Expected NaN and Inf to read back as NaN (sentinel %v), got %v", sentinel, got)
+			}
+		}
+	}
+
+	sentinel := -1.0
+	NaNSentinel = &sentinel
+	if enc, _ := encodeDps("test", map[int64]interface{}{0: math.NaN()}); enc[0] != -1.0 {
+		t.Errorf("Expected NaN written as the sentinel, got %v", enc)
+	}
+
+	RejectInf = true
+	if _, err := encodeDps("test", map[int64]interface{}{0: math.Inf(1)}); !IsInvalid(err) {
+		t.Errorf("Expected Inf to be rejected as invalid, got %v", err)
+	}
+	if _, err := encodeDps("test", map[int64]interface{}{0: math.NaN()}); err != nil {
+		t.Errorf("Expected NaN to be accepted with RejectInf, got %v", err)
+	}
+	if _, err := encodeStateValues("test", map[int64]interface{}{0: math.Inf(-1)}); !IsInvalid(err) {
+		t.Errorf("Expected an Inf state value to be rejected as invalid, got %v", err)
+	}
+
+	RejectInf = false
+	if enc, _ := encodeStateValues("test", map[int64]interface{}{0: math.Inf(-1), 1: math.NaN()}); !math.IsNaN(enc[0].(float64)) || !math.IsNaN(enc[1].(float64)) {
+		t.Errorf("Expected state values to stay (or become) NaN, got %v", enc)
+	}
+}
@@ -0,0 +1,182 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+)
+
+// A Placement decides the position (and thereby the segment and the
+// index within it) of the RRA of a new DS in its bundle. The RRAs in
+// the same segment are stored in the same rows of the ts table, which
+// is what a flush writes and a bulk read reads.
+type Placement int
+
+const (
+	// Each new RRA goes in the next position, i.e. DSs created
+	// together share segments, which are filled one at a time.
+	PlaceSequential Placement = iota
+	// New RRAs go in the least filled of the PgPlacementSegments
+	// first segments, spreading the writes evenly.
+	PlaceRoundRobin
+	// New RRAs go in the segment (of the PgPlacementSegments first)
+	// chosen by the hash of the name without its last node, so that
+	// e.g. all of foo.bar.* end up in the same segment.
+	PlaceHash
+)
+
+var placementNames = map[string]Placement{
+	"sequential":  PlaceSequential,
+	"round-robin": PlaceRoundRobin,
+	"hash":        PlaceHash,
+}
+
+// ParsePlacement returns the Placement by its name: sequential,
+// round-robin or hash.
+func ParsePlacement(s string) (Placement, error) {
+	if p, ok := placementNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("Invalid placement: %q, must be one of sequential, round-robin or hash", s)
+}
+
+var (
+	PgPlacement               = PlaceSequential
+	PgPlacementSegments int64 = 16
+)
+
+// The segment a new RRA of the DS identified by ident should go in,
+// if it is not full.
+func placementSegment(placement Placement, ident Ident, nsegs int64, counts map[int64]int64) int64 {
+	switch placement {
+	case PlaceRoundRobin:
+		best := int64(0)
+		for seg := int64(1); seg < nsegs; seg++ {
+			if counts[seg] < counts[best] {
+				best = seg
+			}
+		}
+		return best
+	case PlaceHash:
+		name := ident["name"]
+		if name == "" {
+			name = ident.String()
+		} else if i := strings.LastIndex(name, "."); i > 0 {
+			name = name[:i]
+		}
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		return int64(h.Sum32()) % nsegs
+	}
+	return 0
+}
+
+// Starting with seg, the first segment which isn't full, trying the
+// nsegs first ones before moving on to those beyond.
+func firstFreeSegment(seg, nsegs, width int64, counts map[int64]int64) int64 {
+	for n := int64(0); n < nsegs; n++ {
+		if s := (seg + n) % nsegs; counts[s] < width {
+			return s
+		}
+	}
+	for s := nsegs; ; s++ {
+		if counts[s] < width {
+			return s
+		}
+	}
+}
+
+// The lowest idx (1-based) not in used.
+func firstFreeIdx(used map[int64]bool) int64 {
+	idx := int64(1)
+	for used[idx] {
+		idx++
+	}
+	return idx
+}
+
+// Returns the position for a new RRA in bundle according to
+// PgPlacement. Positions freed by deleted DSs are reused, and
+// last_pos is kept past the highest one so that PlaceSequential can
+// be switched back to at any time.
+func (p *pgvSerDe) rraBundlePos(tx *sql.Tx, bundle *rraBundleRecord, ident Ident) (int64, error) {
+	if PgPlacement == PlaceSequential {
+		return p.rraBundleIncrPos(tx, bundle.id)
+	}
+
+	// Lock the bundle so that no one else picks the same position
+	stmt := fmt.Sprintf("SELECT last_pos FROM %[1]srra_bundle WHERE id = $1 FOR UPDATE", p.prefix)
+	if _, err := tx.Exec(stmt, bundle.id); err != nil {
+		log.Printf("rraBundlePos(): error locking bundle: %v", err)
+		return 0, err
+	}
+
+	counts := make(map[int64]int64)
+	stmt = fmt.Sprintf("SELECT seg, count(*) FROM %[1]srra WHERE rra_bundle_id = $1 GROUP BY seg", p.prefix)
+	rows, err := tx.Query(stmt, bundle.id)
+	if err != nil {
+		log.Printf("rraBundlePos(): error counting: %v", err)
+		return 0, err
+	}
+	for rows.Next() {
+		var seg, n int64
+		if err := rows.Scan(&seg, &n); err != nil {
+			rows.Close()
+			log.Printf("rraBundlePos(): error scanning row: %v", err)
+			return 0, err
+		}
+		counts[seg] = n
+	}
+	rows.Close()
+
+	nsegs := PgPlacementSegments
+	if nsegs < 1 {
+		nsegs = 1
+	}
+	seg := placementSegment(PgPlacement, ident, nsegs, counts)
+	seg = firstFreeSegment(seg, nsegs, bundle.width, counts)
+
+	used := make(map[int64]bool)
+	stmt = fmt.Sprintf("SELECT idx FROM %[1]srra WHERE rra_bundle_id = $1 AND seg = $2", p.prefix)
+	if rows, err = tx.Query(stmt, bundle.id, seg); err != nil {
+		log.Printf("rraBundlePos(): error querying database: %v", err)
+		return 0, err
+	}
+	for rows.Next() {
+		var idx int64
+		if err := rows.Scan(&idx); err != nil {
+			rows.Close()
+			log.Printf("rraBundlePos(): error scanning row: %v", err)
+			return 0, err
+		}
+		used[idx] = true
+	}
+	rows.Close()
+
+	// the inverse of segIdxFromPosWidth()
+	pos := seg*bundle.width + firstFreeIdx(used)
+
+	stmt = fmt.Sprintf("UPDATE %[1]srra_bundle SET last_pos = GREATEST(last_pos, $2) WHERE id = $1", p.prefix)
+	if _, err := tx.Exec(stmt, bundle.id, pos); err != nil {
+		log.Printf("rraBundlePos(): error updating last_pos: %v", err)
+		return 0, err
+	}
+	return pos, nil
+}
@@ -0,0 +1,84 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import "testing"
+
+func Test_placementSegment(t *testing.T) {
+	counts := map[int64]int64{0: 3, 1: 1, 2: 2}
+	if seg := placementSegment(PlaceRoundRobin, Ident{"name": "foo"}, 3, counts); seg != 1 {
+		t.Errorf("Expected the least filled segment 1, got %d", seg)
+	}
+	if seg := placementSegment(PlaceRoundRobin, Ident{"name": "foo"}, 4, counts); seg != 3 {
+		t.Errorf("Expected the empty segment 3, got %d", seg)
+	}
+
+	a := placementSegment(PlaceHash, Ident{"name": "foo.bar.a"}, 16, nil)
+	b := placementSegment(PlaceHash, Ident{"name": "foo.bar.b"}, 16, nil)
+	if a != b {
+		t.Errorf("Expected siblings in the same segment, got %d and %d", a, b)
+	}
+	if a < 0 || a >= 16 {
+		t.Errorf("Segment out of range: %d", a)
+	}
+
+	if seg := placementSegment(PlaceSequential, Ident{"name": "foo"}, 16, counts); seg != 0 {
+		t.Errorf("Expected segment 0, got %d", seg)
+	}
+}
+
+func Test_firstFreeSegment(t *testing.T) {
+	counts := map[int64]int64{0: 2, 1: 2, 2: 1}
+	for _, c := range []struct{ seg, nsegs, exp int64 }{
+		{2, 3, 2},
+		{0, 3, 2}, // wraps around
+		{0, 2, 2}, // all full, beyond nsegs
+	} {
+		if seg := firstFreeSegment(c.seg, c.nsegs, 2, counts); seg != c.exp {
+			t.Errorf("firstFreeSegment(%d, %d): expected %d, got %d", c.seg, c.nsegs, c.exp, seg)
+		}
+	}
+	counts[2] = 2
+	if seg := firstFreeSegment(0, 3, 2, counts); seg != 3 {
+		t.Errorf("Expected segment 3, got %d", seg)
+	}
+}
+
+func Test_firstFreeIdx(t *testing.T) {
+	if idx := firstFreeIdx(map[int64]bool{1: true, 2: true, 4: true}); idx != 3 {
+		t.Errorf("Expected 3, got %d", idx)
+	}
+	if idx := firstFreeIdx(nil); idx != 1 {
+		t.Errorf("Expected 1, got %d", idx)
+	}
+	for pos := int64(1); pos <= 10; pos++ {
+		seg, idx := segIdxFromPosWidth(pos, 4)
+		if seg*4+idx != pos {
+			t.Errorf("pos %d: seg %d idx %d do not invert", pos, seg, idx)
+		}
+	}
+}
+
+func Test_ParsePlacement(t *testing.T) {
+	for s, exp := range map[string]Placement{"sequential": PlaceSequential, "round-robin": PlaceRoundRobin, "hash": PlaceHash} {
+		if p, err := ParsePlacement(s); err != nil || p != exp {
+			t.Errorf("%s: expected %v, got %v (%v)", s, exp, p, err)
+		}
+	}
+	if _, err := ParsePlacement("random"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
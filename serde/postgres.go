@@ -40,6 +40,7 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/lib/pq"
@@ -48,12 +49,17 @@ import (
 )
 
 type pgvSerDe struct {
+	versionCollisions int64 // first for 64-bit alignment, see VersionCollisions()
+	replicaDownUntil  int64 // unix nanos, see PgReadReplica
+
 	dbConn  *sql.DB
 	dbQConn *sql.DB // a separate connection for querying
+	dbRConn *sql.DB // the read replica, nil if none
 	prefix  string
 	listen  *pq.Listener
 
 	sqlSelectSeries              *sql.Stmt
+	sqlSelectSeriesReplica       *sql.Stmt
 	sqlSelectDSByIdent           *sql.Stmt
 	sqlInsertDS                  *sql.Stmt
 	sqlInsertDSState             *sql.Stmt
@@ -83,8 +89,15 @@ func InitDb(connect_string, prefix string) (*pgvSerDe, error) {
 		if err := p.dbConn.Ping(); err != nil {
 			return nil, err
 		}
-		if err := p.createTablesIfNotExist(); err != nil {
-			return nil, fmt.Errorf("createTablesIfNotExist: %v", err)
+		if PgReadReplica != "" {
+			p.dbRConn = openReadReplica(PgReadReplica)
+		}
+		if PgMigrate {
+			if err := p.createTablesIfNotExist(); err != nil {
+				return nil, fmt.Errorf("createTablesIfNotExist: %v", err)
+			}
+		} else {
+			p.checkSchemaVersion()
 		}
 		if err := p.prepareSqlStatements(); err != nil {
 			return nil, fmt.Errorf("prepareSqlStatements: %v", err)
@@ -105,7 +118,7 @@ func (p *pgvSerDe) ListDbClientIps() ([]string, error) {
 	rows, err := p.dbConn.Query(sql)
 	if err != nil {
 		log.Printf("ListDbClientIps(): error querying database: %v", err)
-		return nil, err
+		return nil, dbError("ListDbClientIps", err)
 	}
 	defer rows.Close()
 
@@ -114,7 +127,7 @@ func (p *pgvSerDe) ListDbClientIps() ([]string, error) {
 		var addr *string
 		if err := rows.Scan(&addr); err != nil {
 			log.Printf("ListDbClientIps(): error scanning row: %v", err)
-			return nil, err
+			return nil, dbError("ListDbClientIps", err)
 		}
 		if addr != nil {
 			result = append(result, *addr)
@@ -130,7 +143,7 @@ func (p *pgvSerDe) MyDbAddr() (*string, error) {
 	rows, err := p.dbConn.Query(sql)
 	if err != nil {
 		log.Printf("myPostgresAddr(): error querying database: %v", err)
-		return nil, err
+		return nil, dbError("MyDbAddr", err)
 	}
 	defer rows.Close()
 
@@ -138,7 +151,7 @@ func (p *pgvSerDe) MyDbAddr() (*string, error) {
 		var addr *string
 		if err := rows.Scan(&addr); err != nil {
 			log.Printf("myPostgresAddr(): error scanning row: %v", err)
-			return nil, err
+			return nil, dbError("MyDbAddr", err)
 		}
 		if addr != nil {
 			log.Printf("myPostgresAddr(): %s", *addr)
@@ -168,14 +181,23 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		p.prefix)); err != nil {
 		return err
 	}
-	// NB: dbQConn used here
-	if p.sqlSelectSeries, err = p.dbQConn.Prepare(fmt.Sprintf(
+	// NB: dbQConn used here. NaN and NaNSentinel ($9) are not
+	// averaged, see seriesQuerySqlUsingViewAndSeries().
+	selectSeries := fmt.Sprintf(
 		"SELECT max(tg) mt, avg(r) ar FROM generate_series($1, $2, ($3)::interval) AS tg "+
-			"LEFT OUTER JOIN (SELECT t, r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 "+
+			"LEFT OUTER JOIN (SELECT t, NULLIF(NULLIF(r, 'NaN'), $9) AS r FROM %[1]stv tv WHERE ds_id = $4 AND rra_id = $5 "+
 			" AND t >= $6 AND t <= $7) s ON tg = s.t GROUP BY trunc((extract(epoch from tg)*1000-1))::bigint/$8 ORDER BY mt",
-		p.prefix)); err != nil {
+		p.prefix)
+	if p.sqlSelectSeries, err = p.dbQConn.Prepare(selectSeries); err != nil {
 		return err
 	}
+	if p.dbRConn != nil {
+		if p.sqlSelectSeriesReplica, err = p.dbRConn.Prepare(selectSeries); err != nil {
+			log.Printf("prepareSqlStatements: cannot prepare on the read replica, querying the primary only: %v", err)
+			p.dbRConn.Close()
+			p.dbRConn = nil
+		}
+	}
 	if p.sqlSelectDSByIdent, err = p.dbConn.Prepare(fmt.Sprintf(
 		"SELECT id, ident, step_ms, heartbeat_ms, ds.seg, ds.idx, "+
 			"dsst.lastupdate[ds.idx] AS lastupdate, dsst.value[ds.idx] AS value, dsst.duration_ms[ds.idx] AS duration_ms, "+
@@ -200,13 +222,13 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		return err
 	}
 	if p.sqlInsertRRA, err = p.dbConn.Prepare(fmt.Sprintf(
-		"INSERT INTO %[1]srra AS rra (ds_id, rra_bundle_id, pos, seg, idx, cf, xff) VALUES ($1, $2, $3, $4, $5, $6, $7) "+
+		"INSERT INTO %[1]srra AS rra (ds_id, rra_bundle_id, pos, seg, idx, cf, xff, rollup) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) "+
 			"ON CONFLICT (ds_id, rra_bundle_id, cf) DO UPDATE SET ds_id = rra.ds_id "+
-			"RETURNING id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff", p.prefix)); err != nil {
+			"RETURNING id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff, rollup", p.prefix)); err != nil {
 		return err
 	}
 	if p.sqlSelectRRAsByDsId, err = p.dbConn.Prepare(fmt.Sprintf(
-		"SELECT id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff FROM %[1]srra rra WHERE ds_id = $1 ",
+		"SELECT id, ds_id, rra_bundle_id, pos, seg, idx, cf, xff, rollup FROM %[1]srra rra WHERE ds_id = $1 ",
 		p.prefix)); err != nil {
 		return err
 	}
@@ -216,7 +238,7 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 		return err
 	}
 	if p.sqlInsertRRABundle, err = p.dbConn.Prepare(fmt.Sprintf(
-		"INSERT INTO %[1]srra_bundle AS rra_bundle (step_ms, size) VALUES ($1, $2) "+
+		"INSERT INTO %[1]srra_bundle AS rra_bundle (step_ms, size, width) VALUES ($1, $2, $3) "+
 			"ON CONFLICT (step_ms, size) DO UPDATE SET size = rra_bundle.size "+
 			"RETURNING id, step_ms, size, width", p.prefix)); err != nil {
 		return err
@@ -239,6 +261,9 @@ func (p *pgvSerDe) prepareSqlStatements() error {
 	return nil
 }
 
+// The width (number of RRAs in a segment) of RRA bundles created
+// from now on, it is also the default of the width column when the
+// tables are created.
 var PgSegmentWidth int = 200
 
 func (p *pgvSerDe) createTablesIfNotExist() error {
@@ -252,7 +277,8 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        seg INT NOT NULL DEFAULT (lastval()-1) / %[2]d,
        idx INT NOT NULL DEFAULT mod(lastval()-1, %[2]d)+1,
        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
-       created BOOL NOT NULL DEFAULT true);
+       created BOOL NOT NULL DEFAULT true,
+       attrs JSONB NOT NULL DEFAULT '{}');
 
        CREATE UNIQUE INDEX IF NOT EXISTS %[1]sidx_ds_ident_uniq ON %[1]sds (ident);
        CREATE INDEX IF NOT EXISTS %[1]sidx_ds_ident ON %[1]sds USING gin(ident);
@@ -290,6 +316,7 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
        seg INT NOT NULL,
        idx INT NOT NULL,
        xff REAL NOT NULL DEFAULT 0,
+       rollup BOOL NOT NULL DEFAULT false,
        value DOUBLE PRECISION NOT NULL DEFAULT 'NaN',
        duration_ms BIGINT NOT NULL DEFAULT 0);
 
@@ -306,86 +333,26 @@ func (p *pgvSerDe) createTablesIfNotExist() error {
 
        CREATE TABLE IF NOT EXISTS %[1]sdsl_cache (
        ident JSONB NOT NULL DEFAULT '{}'
-       )
+       );
+
+       CREATE TABLE IF NOT EXISTS %[1]sevents (
+       id SERIAL NOT NULL PRIMARY KEY,
+       t TIMESTAMPTZ NOT NULL DEFAULT now(),
+       what TEXT NOT NULL DEFAULT '',
+       tags TEXT[] NOT NULL DEFAULT '{}',
+       data TEXT NOT NULL DEFAULT '');
+
+       CREATE INDEX IF NOT EXISTS %[1]sidx_events_t ON %[1]sevents (t);
+       CREATE INDEX IF NOT EXISTS %[1]sidx_events_tags ON %[1]sevents USING gin(tags);
     `
 	if _, err := p.dbConn.Exec(fmt.Sprintf(create_sql, p.prefix, PgSegmentWidth)); err != nil {
 		log.Printf("ERROR: initial CREATE TABLE failed: %v", err)
 		return err
 	}
 
-	// TODO: Remove this later. And we should consider a better migration mechanism.
-	migrate_sql := `
-DO $$
-  DECLARE r RECORD;
-  DECLARE q TEXT;
-BEGIN
-  IF (SELECT COUNT(1) FROM information_schema.columns WHERE table_name='%[1]sds' and column_name='created_at') > 0 THEN
-    -- migration done already, nothing to do
-    RETURN;
-  END IF;
-
-  -- DS STATE
-
-  -- set seg and idx
-  ALTER TABLE %[1]sds ADD COLUMN seg INT NOT NULL DEFAULT 0;
-  ALTER TABLE %[1]sds ADD COLUMN idx INT NOT NULL DEFAULT 0;
-  UPDATE %[1]sds SET seg = (id - 1) / %[2]d;
-  UPDATE %[1]sds SET idx = mod(id - 1, %[2]d) + 1;
-  ALTER TABLE %[1]sds ALTER COLUMN seg SET DEFAULT (lastval()-1) / %[2]d;
-  ALTER TABLE %[1]sds ALTER COLUMN idx SET DEFAULT mod(lastval()-1, %[2]d)+1;
-
-  -- good to have
-  ALTER TABLE %[1]sds ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
-
-  -- populate the data in ds_state
-  INSERT INTO %[1]sds_state(seg) SELECT DISTINCT(seg) AS seg FROM %[1]sds;
-
-  FOR r IN SELECT id, seg, idx, lastupdate, duration_ms, value FROM %[1]sds ORDER BY id
-  LOOP
-    q := 'UPDATE %[1]sds_state SET'
-         || ' lastupdate[' || r.idx || '] = ' || quote_nullable(r.lastupdate)
-         || ',duration_ms[' || r.idx || '] = ' || r.duration_ms
-         || ',value[' || r.idx || '] = ' || quote_nullable(r.value::TEXT) || '::DOUBLE PRECISION'
-         || ' WHERE seg = ' || r.seg;
-    EXECUTE q;
-  END LOOP;
-
-  -- drop the columns
-  ALTER TABLE %[1]sds DROP COLUMN lastupdate;
-  ALTER TABLE %[1]sds DROP COLUMN duration_ms;
-  ALTER TABLE %[1]sds DROP COLUMN value;
-
-  -- RRA STATE
-
-  -- drop the newly-created rra_state and use the already existing rra_latest
-  DROP TABLE IF EXISTS %[1]srra_state;
-  ALTER TABLE %[1]srra_latest RENAME TO %[1]srra_state;
-  ALTER INDEX %[1]sidx_rra_latest_bundle_id_seg RENAME TO %[1]sidx_rra_state_bundle_id_seg;
-  ALTER TABLE %[1]srra_state RENAME CONSTRAINT %[1]srra_latest_rra_bundle_id_fkey TO %[1]srra_state_rra_bundle_id_fkey;
-
-  -- add columns for duration and value
-  ALTER TABLE %[1]srra_state ADD COLUMN duration_ms BIGINT[] NOT NULL DEFAULT '{}';
-  ALTER TABLE %[1]srra_state ADD COLUMN value DOUBLE PRECISION[] NOT NULL DEFAULT '{}';
-
-  -- populate duration and value in rra_state
-  FOR r IN SELECT id, rra_bundle_id, seg, idx, duration_ms, value FROM %[1]srra WHERE duration_ms > 0 ORDER BY id
-  LOOP
-    q := 'UPDATE %[1]srra_state SET'
-         || ' duration_ms[' || r.idx || '] = ' || r.duration_ms
-         || ',value[' || r.idx || '] = ' || quote_nullable(r.value::TEXT) || '::DOUBLE PRECISION'
-         || ' WHERE rra_bundle_id = ' || r.rra_bundle_id || ' AND seg = ' || r.seg;
-    EXECUTE q;
-  END LOOP;
-
-  -- drop the columns
-  ALTER TABLE %[1]srra DROP COLUMN duration_ms;
-  ALTER TABLE %[1]srra DROP COLUMN value;
-
-END
-$$;
-`
-	if _, err := p.dbConn.Exec(fmt.Sprintf(migrate_sql, p.prefix, PgSegmentWidth)); err != nil {
-		log.Printf("ERROR: migrate failed: %v", err)
+	// Older schemas are brought up to date, see migrate.go.
+	if err := p.migrate(); err != nil {
+		log.Printf("ERROR: schema migration failed: %v", err)
 		return err
 	}
 
@@ -398,7 +365,7 @@ BEGIN;
 -- a view do simplify looking at DSs
 DROP VIEW IF EXISTS %[1]sdsv;
 CREATE VIEW %[1]sdsv AS
-  SELECT id, ident, step_ms, heartbeat_ms, created_at,
+  SELECT id, ident, step_ms, heartbeat_ms, created_at, attrs,
          dss.lastupdate[ds.idx] AS lastupdate,
          dss.value[ds.idx] AS value,
          dss.duration_ms[ds.idx] AS duration_ms,
@@ -410,7 +377,7 @@ CREATE VIEW %[1]sdsv AS
 -- a view to simplify looking at RRAs
 DROP VIEW IF EXISTS %[1]srrav;
 CREATE VIEW %[1]srrav AS
-  SELECT rra.id, ds_id, cf, xff, size,
+  SELECT rra.id, ds_id, cf, xff, rollup, size,
          '00:00:00.001'::interval * step_ms AS step,
          '00:00:00.001'::interval * step_ms * size AS span,
          rs.latest[rra.idx] AS latest,
@@ -431,17 +398,19 @@ CREATE VIEW %[1]stv AS
       SELECT ds_id, rra_id, step_ms, r
            , latest - '00:00:00.001'::interval * step_ms * mod(size + latest_i - i, size) AS t
            , ver
-           , latest_ver - (i > latest_i)::INT AS expected_version
+           , CASE WHEN i <= latest_i THEN latest_ver
+                  WHEN latest_ver = 0 THEN %[2]d
+                  ELSE latest_ver - 1 END AS expected_version
         FROM (
         SELECT ds_id, rra_id, step_ms, r
              , size, i, latest, ver
              , mod(latest_ms/step_ms, size) AS latest_i
-             , mod(latest_ms / (step_ms::bigint * size), 32767)::smallint AS latest_ver
+             , mod(latest_ms / (step_ms::bigint * size), %[2]d + 1)::smallint AS latest_ver
           FROM (
           SELECT rra.ds_id AS ds_id
                , rra.id AS rra_id
                , rra_bundle.step_ms AS step_ms
-               , date_part('epoch'::text, rra_state.latest[rra.idx])::bigint * 1000 AS latest_ms
+               , (date_part('epoch'::text, rra_state.latest[rra.idx]) * 1000)::bigint AS latest_ms
                , rra_state.latest[rra.idx] AS latest
                , rra_bundle.size AS size
                , ts.i AS i
@@ -454,7 +423,7 @@ CREATE VIEW %[1]stv AS
           ) a
         ) b
       ) c
-WHERE expected_version = coalesce(ver, expected_version);
+WHERE expected_version = ver;
 
 -- debug view
 -- TODO add version stuff to it
@@ -478,14 +447,14 @@ CREATE VIEW %[1]stvd AS
         rra.ds_id AS ds_id
        ,rra.id AS rra_id
        ,rra_state.latest[rra.idx] - '00:00:00.001'::interval * rra_bundle.step_ms::double precision *
-          mod(rra_bundle.size + mod(date_part('epoch'::text, rra_state.latest[rra.idx])::bigint * 1000 / rra_bundle.step_ms, rra_bundle.size::bigint) -
+          mod(rra_bundle.size + mod((date_part('epoch'::text, rra_state.latest[rra.idx]) * 1000)::bigint / rra_bundle.step_ms, rra_bundle.size::bigint) -
           ts.i, rra_bundle.size::bigint)::double precision AS t
        ,ts.dp[rra.idx] AS r
        ,'00:00:00.001'::interval * rra_bundle.step_ms::double precision AS step
        ,i AS i
-       ,mod(date_part('epoch'::text, rra_state.latest[rra.idx])::bigint * 1000 / rra_bundle.step_ms, rra_bundle.size::bigint) AS last_i
-       ,date_part('epoch'::text, rra_state.latest[rra.idx])::bigint * 1000 AS last_t
-       ,mod(rra_bundle.size + mod(date_part('epoch'::text, rra_state.latest[rra.idx])::bigint * 1000 / rra_bundle.step_ms, rra_bundle.size::bigint) -
+       ,mod((date_part('epoch'::text, rra_state.latest[rra.idx]) * 1000)::bigint / rra_bundle.step_ms, rra_bundle.size::bigint) AS last_i
+       ,(date_part('epoch'::text, rra_state.latest[rra.idx]) * 1000)::bigint AS last_t
+       ,mod(rra_bundle.size + mod((date_part('epoch'::text, rra_state.latest[rra.idx]) * 1000)::bigint / rra_bundle.step_ms, rra_bundle.size::bigint) -
                    ts.i, rra_bundle.size::bigint)::double precision AS slot_distance
        ,rra.seg AS seg
        ,rra.idx AS idx
@@ -498,7 +467,7 @@ CREATE VIEW %[1]stvd AS
 
 COMMIT;
 `
-	if _, err := p.dbConn.Exec(fmt.Sprintf(create_sql, p.prefix)); err != nil {
+	if _, err := p.dbConn.Exec(fmt.Sprintf(create_sql, p.prefix, MaxVersion)); err != nil {
 		//if !strings.Contains(err.Error(), "already exists") {
 		log.Printf("ERROR: initial CREATE VIEW failed: %v", err)
 		return err
@@ -546,7 +515,7 @@ func rraBundleRecordFromRow(rows *sql.Rows) (*rraBundleRecord, error) {
 func rraRecordFromRow(rows *sql.Rows) (*rraRecord, error) {
 
 	var rra rraRecord
-	err := rows.Scan(&rra.id, &rra.dsId, &rra.bundleId, &rra.pos, &rra.seg, &rra.idx, &rra.cf, &rra.xff)
+	err := rows.Scan(&rra.id, &rra.dsId, &rra.bundleId, &rra.pos, &rra.seg, &rra.idx, &rra.cf, &rra.xff, &rra.rollUp)
 	if err != nil {
 		log.Printf("rraRecordFromRow(): error scanning row: %v", err)
 		return nil, err
@@ -574,6 +543,7 @@ func rraFromRRARecordStateAndBundle(rraRec *rraRecord, stateRec *rraStateRecord,
 		Step:     time.Duration(bundle.stepMs) * time.Millisecond,
 		Span:     time.Duration(bundle.stepMs*bundle.size) * time.Millisecond,
 		Xff:      rraRec.xff,
+		RollUp:   rraRec.rollUp,
 		Latest:   *stateRec.latest,
 		Value:    *stateRec.value,
 		Duration: time.Duration(*stateRec.durationMs) * time.Millisecond,
@@ -588,8 +558,10 @@ func rraFromRRARecordStateAndBundle(rraRec *rraRecord, stateRec *rraStateRecord,
 		spec.Function = rrd.MAX
 	case "LAST":
 		spec.Function = rrd.LAST
+	case "SUM":
+		spec.Function = rrd.SUM
 	default:
-		return nil, fmt.Errorf("rraFromRRARecordAndBundle(): Invalid cf: %q (valid funcs: wmean, min, max, last)", rraRec.cf)
+		return nil, fmt.Errorf("rraFromRRARecordAndBundle(): Invalid cf: %q (valid funcs: wmean, min, max, last, sum)", rraRec.cf)
 	}
 
 	rra, err := newDbRoundRobinArchive(rraRec.id, bundle.width, bundle.id, rraRec.pos, spec)
@@ -614,10 +586,10 @@ func (p *pgvSerDe) Search(query SearchQuery) (SearchResult, error) {
 		sql += fmt.Sprintf(" WHERE %s", where)
 	}
 
-	rows, err := p.dbConn.Query(fmt.Sprintf(sql, p.prefix), args...)
+	rows, err := p.readQuery("Search", p.dbConn, fmt.Sprintf(sql, p.prefix), args...)
 	if err != nil {
 		log.Printf("Search(): error querying database: %v", err)
-		return nil, err
+		return nil, dbError("Search", err)
 	}
 
 	return &pgSearchResult{rows: rows}, nil
@@ -629,7 +601,7 @@ func (p *pgvSerDe) FetchDataSources() ([]rrd.DataSourcer, error) {
 	// I'm not exactly sure why.
 	const sql = `
 WITH rra AS (
-  SELECT rra.id, rra.ds_id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff,
+  SELECT rra.id, rra.ds_id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff, rra.rollup,
          rs.latest[rra.idx] AS latest, rs.value[rra.idx] AS value, rs.duration_ms[rra.idx] AS duration_ms,
          b.step_ms, b.size, b.width
     FROM %[1]srra
@@ -649,7 +621,7 @@ SELECT ds.id, ds.ident, ds.step_ms,
            ds.lastupdate,
            ds.ds_value,
            ds.ds_duration_ms,
-           rra.id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff,
+           rra.id, rra.rra_bundle_id, rra.pos, rra.seg, rra.idx, rra.cf, rra.xff, rra.rollup,
            rra.step_ms, rra.size, rra.width,
            rra.latest,
            rra.value,
@@ -662,7 +634,7 @@ SELECT ds.id, ds.ident, ds.step_ms,
 	rows, err := p.dbConn.Query(fmt.Sprintf(sql, p.prefix))
 	if err != nil {
 		log.Printf("FetchDataSources(): error querying database: %v", err)
-		return nil, err
+		return nil, dbError("FetchDataSources", err)
 	}
 	defer rows.Close()
 
@@ -688,11 +660,11 @@ SELECT ds.id, ds.ident, ds.step_ms,
 
 		err = rows.Scan(
 			&dsr.id, &dsr.identJson, &dsr.stepMs, &dsr.hbMs, &dsr.seg, &dsr.idx, &dsr.lastupdate, &dsr.value, &dsr.durationMs, // DS
-			&rrar.id, &rrar.bundleId, &rrar.pos, &rrar.seg, &rrar.idx, &rrar.cf, &rrar.xff, // RRA
+			&rrar.id, &rrar.bundleId, &rrar.pos, &rrar.seg, &rrar.idx, &rrar.cf, &rrar.xff, &rrar.rollUp, // RRA
 			&bundle.stepMs, &bundle.size, &bundle.width, // Bundle
 			&state.latest, &state.value, &state.durationMs) // RRA State
 		if err != nil {
-			return nil, fmt.Errorf("error scanning: %v", err)
+			return nil, newError("FetchDataSources", ErrDatabase, "error scanning: %v", err)
 		}
 
 		rrar.dsId = dsr.id
@@ -724,7 +696,7 @@ SELECT ds.id, ds.ident, ds.step_ms,
 		var rra *DbRoundRobinArchive
 		rra, err = rraFromRRARecordStateAndBundle(&rrar, &state, &bundle)
 		if err != nil {
-			return nil, err
+			return nil, dbError("FetchDataSources", err)
 		}
 
 		rras = append(rras, rra)
@@ -748,7 +720,7 @@ SELECT ds.id, ds.ident, ds.step_ms,
 	for i := 0; i < len(dss); i++ {
 		ds, err := dataSourceFromDsRec(dss[i].dsr)
 		if err != nil {
-			return nil, fmt.Errorf("error scanning: %v", err)
+			return nil, newError("FetchDataSources", ErrDatabase, "error scanning: %v", err)
 		}
 		ds.SetRRAs(dss[i].rras)
 		result = append(result, ds)
@@ -763,7 +735,9 @@ func (p *pgvSerDe) fetchOrCreateRRABundle(tx *sql.Tx, stepMs, size int64) (*rraB
 		return nil, err
 	}
 	if !rows.Next() { // Needs to be created
-		rows, err = tx.Stmt(p.sqlInsertRRABundle).Query(stepMs, size)
+		// New bundles get the current PgSegmentWidth, existing ones
+		// keep theirs until changed with CompactRRABundle().
+		rows, err = tx.Stmt(p.sqlInsertRRABundle).Query(stepMs, size, PgSegmentWidth)
 		if err != nil {
 			log.Printf("fetchOrCreateRRABundle(): error inserting: %v", err)
 			return nil, err
@@ -863,7 +837,16 @@ func (p *pgvSerDe) fetchRoundRobinArchives(ds *DbDataSource) ([]rrd.RoundRobinAr
 	return rras, nil
 }
 
-func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (sqlOps int, err error) {
+func (p *pgvSerDe) DataSourceRRAs(id int64) ([]rrd.RoundRobinArchiver, error) {
+	rras, err := p.fetchRoundRobinArchives(&DbDataSource{id: id})
+	return rras, dbError("DataSourceRRAs", err)
+}
+
+func (p *pgvSerDe) flushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (sqlOps int, err error) {
+
+	if value, err = encodeStateValues("FlushDSStates", value); err != nil {
+		return 0, err
+	}
 
 	luChunks := arrayUpdateChunks(lastupdate)
 	durChunks := arrayUpdateChunks(duration)
@@ -879,26 +862,26 @@ func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int6
 	stmt := fmt.Sprintf("UPDATE %[1]sds_state AS dss SET %s, %s, %s WHERE seg = $1", p.prefix, dest1, dest2, dest3)
 	res, err := p.dbConn.Exec(stmt, args...)
 	if err != nil {
-		return 0, err
+		return 0, dbError("FlushDSStates", err)
 	}
 	sqlOps++
 
 	if affected, _ := res.RowsAffected(); affected == 0 { // Insert and try again.
 		insert := fmt.Sprintf("INSERT INTO %[1]sds_state AS dss (seg) VALUES ($1) ON CONFLICT(seg) DO NOTHING", p.prefix)
 		if _, err = p.dbConn.Exec(insert, seg); err != nil {
-			return 0, err
+			return 0, dbError("FlushDSStates", err)
 		}
 		if res, err := p.dbConn.Exec(stmt, args...); err != nil {
-			return 0, err
+			return 0, dbError("FlushDSStates", err)
 		} else if affected, _ := res.RowsAffected(); affected == 0 {
-			return 0, fmt.Errorf("Unable to update row?")
+			return 0, newError("FlushDSStates", ErrDatabase, "Unable to update row?")
 		}
 		sqlOps++
 	}
 	return sqlOps, nil
 }
 
-func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (sqlOps int, err error) {
+func (p *pgvSerDe) flushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (sqlOps int, err error) {
 	// Due to the way PG array syntax works, we use two different
 	// methods of updating data points. When the data points updated
 	// are *one* contiguous chunk, we can use the form array[a:b] =
@@ -919,6 +902,9 @@ func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]
 	//   1 chunk  => multi-stmt
 	//   N chunks => single-stmt
 
+	if dps, err = encodeDps("FlushDataPoints", dps); err != nil {
+		return 0, err
+	}
 	chunks := arrayUpdateChunks(dps)
 	vchunks := arrayUpdateChunks(vers)
 
@@ -933,18 +919,18 @@ func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]
 
 		res, err := p.dbConn.Exec(stmt, args...)
 		if err != nil {
-			return 0, err
+			return 0, dbError("FlushDataPoints", err)
 		}
 		sqlOps++
 
 		if affected, _ := res.RowsAffected(); affected == 0 { // Insert and try again.
 			if _, err = p.sqlInsertTs.Exec(bundle_id, seg, i); err != nil {
-				return 0, err
+				return 0, dbError("FlushDataPoints", err)
 			}
 			if res, err := p.dbConn.Exec(stmt, args...); err != nil {
-				return 0, err
+				return 0, dbError("FlushDataPoints", err)
 			} else if affected, _ := res.RowsAffected(); affected == 0 {
-				return 0, fmt.Errorf("Unable to update row?")
+				return 0, newError("FlushDataPoints", ErrDatabase, "Unable to update row?")
 			}
 			sqlOps++
 		}
@@ -959,27 +945,27 @@ func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]
 
 				tx, err := p.dbConn.Begin()
 				if err != nil {
-					return 0, err
+					return 0, dbError("FlushDataPoints", err)
 				}
 
 				res, err := tx.Stmt(p.sqlUpdateTs).Exec(args...)
 				if err != nil {
 					tx.Rollback()
-					return 0, err
+					return 0, dbError("FlushDataPoints", err)
 				}
 				sqlOps++
 
 				if affected, _ := res.RowsAffected(); affected == 0 { // Insert and try again.
 					if _, err = tx.Stmt(p.sqlInsertTs).Exec(bundle_id, seg, i); err != nil {
 						tx.Rollback()
-						return 0, err
+						return 0, dbError("FlushDataPoints", err)
 					}
 					if res, err := tx.Stmt(p.sqlUpdateTs).Exec(args...); err != nil {
 						tx.Rollback()
-						return 0, err
+						return 0, dbError("FlushDataPoints", err)
 					} else if affected, _ := res.RowsAffected(); affected == 0 {
 						tx.Rollback()
-						return 0, fmt.Errorf("Unable to update row?")
+						return 0, newError("FlushDataPoints", ErrDatabase, "Unable to update row?")
 					}
 					sqlOps++
 				}
@@ -990,40 +976,99 @@ func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]
 	}
 }
 
-func (p *pgvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (sqlOps int, err error) {
+func (p *pgvSerDe) flushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (sqlOps int, err error) {
+
+	if value, err = encodeStateValues("FlushRRAStates", value); err != nil {
+		return 0, err
+	}
 
 	latChunks := arrayUpdateChunks(latests)
 	valChunks := arrayUpdateChunks(value)
 	durChunks := arrayUpdateChunks(duration)
 
-	offset := 3
-	dest1, args := singleStmtUpdateArgs(latChunks, "latest", offset, []interface{}{bundle_id, seg})
+	idxs := make([]int64, 0, len(latests))
+	for idx := range latests {
+		idxs = append(idxs, idx)
+	}
+
+	offset := 4
+	dest1, args := singleStmtUpdateArgs(latChunks, "latest", offset, []interface{}{bundle_id, seg, pq.Array(idxs)})
 	offset += 3 * len(latChunks)
 	dest2, args := singleStmtUpdateArgs(valChunks, "value", offset, args)
 	offset += 3 * len(valChunks)
 	dest3, args := singleStmtUpdateArgs(durChunks, "duration_ms", offset, args)
 
-	stmt := fmt.Sprintf("UPDATE %[1]srra_state AS rra_state SET %s, %s, %s WHERE rra_bundle_id = $1 AND seg = $2", p.prefix, dest1, dest2, dest3)
-	res, err := p.dbConn.Exec(stmt, args...)
+	// The self-join returns the latests as they were before the
+	// update, so that wrapped versions can be detected without
+	// another round trip, see SlotVersionsWrapped().
+	stmt := fmt.Sprintf(`
+UPDATE %[1]srra_state AS rra_state SET %s, %s, %s
+  FROM %[1]srra_state AS old, %[1]srra_bundle AS rb
+ WHERE rra_state.rra_bundle_id = $1 AND rra_state.seg = $2
+   AND old.rra_bundle_id = $1 AND old.seg = $2 AND rb.id = $1
+RETURNING rb.step_ms, rb.size,
+  ARRAY(SELECT COALESCE((date_part('epoch', old.latest[u.idx]) * 1000)::bigint, 0)
+          FROM unnest($3::int[]) WITH ORDINALITY AS u(idx, n) ORDER BY u.n)`, p.prefix, dest1, dest2, dest3)
+
+	found, err := p.updateRRAStates(bundle_id, seg, stmt, args, idxs, latests)
 	if err != nil {
-		return 0, err
+		return 0, dbError("FlushRRAStates", err)
 	}
 	sqlOps++
 
-	if affected, _ := res.RowsAffected(); affected == 0 { // Insert and try again.
+	if !found { // Insert and try again.
 		if _, err = p.sqlInsertRRAState.Exec(bundle_id, seg); err != nil {
-			return 0, err
+			return 0, dbError("FlushRRAStates", err)
 		}
-		if res, err := p.dbConn.Exec(stmt, args...); err != nil {
-			return 0, err
-		} else if affected, _ := res.RowsAffected(); affected == 0 {
-			return 0, fmt.Errorf("Unable to update row?")
+		if found, err := p.updateRRAStates(bundle_id, seg, stmt, args, idxs, latests); err != nil {
+			return 0, dbError("FlushRRAStates", err)
+		} else if !found {
+			return 0, newError("FlushRRAStates", ErrDatabase, "Unable to update row?")
 		}
 		sqlOps++
 	}
 	return sqlOps, nil
 }
 
+// Runs the flushRRAStates update, returns false if there was no row
+// to update. The RRAs whose versions wrapped around are logged and
+// counted.
+func (p *pgvSerDe) updateRRAStates(bundle_id, seg int64, stmt string, args []interface{}, idxs []int64, latests map[int64]interface{}) (bool, error) {
+	rows, err := p.dbConn.Query(stmt, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	var stepMs, size int64
+	var prevMs pq.Int64Array
+	if err := rows.Scan(&stepMs, &size, &prevMs); err != nil {
+		return true, err
+	}
+	for n, idx := range idxs {
+		latest, ok := latests[idx].(time.Time)
+		if !ok || n >= len(prevMs) || prevMs[n] == 0 {
+			continue
+		}
+		prev := time.Unix(0, prevMs[n]*1e6)
+		if SlotVersionsWrapped(prev, latest, time.Duration(stepMs)*time.Millisecond, size) {
+			log.Printf("WARNING: FlushRRAStates: slot versions wrapped around (bundle %d seg %d idx %d latest %v, previous %v), stale data may read as current.",
+				bundle_id, seg, idx, latest, prev)
+			atomic.AddInt64(&p.versionCollisions, 1)
+		}
+	}
+	return true, rows.Err()
+}
+
+// VersionCollisions returns the number of RRAs whose versions wrapped
+// around since the last call, see SlotVersionsWrapped().
+func (p *pgvSerDe) VersionCollisions() int64 {
+	return atomic.SwapInt64(&p.versionCollisions, 0)
+}
+
 func (p *pgvSerDe) fetchDataSource(ident Ident) (*DbDataSource, error) {
 
 	rows, err := p.sqlSelectDSByIdent.Query(ident.String())
@@ -1066,28 +1111,33 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	// Try SELECT first
 	ds, err := p.fetchDataSource(ident)
 	if err != nil {
-		return nil, err
+		return nil, dbError("FetchOrCreateDataSource", err)
 	}
 	if ds != nil || dsSpec == nil {
 		return ds, err
 	}
 
+	// Steps are stored in milliseconds
+	if dsSpec.Step < time.Millisecond || dsSpec.Step%time.Millisecond != 0 {
+		return nil, newError("FetchOrCreateDataSource", ErrInvalid, "step %v is not a whole number of milliseconds", dsSpec.Step)
+	}
+
 	// Now try INSERT
 	rows, err = p.sqlInsertDS.Query(ident.String(), dsSpec.Step.Nanoseconds()/1000000, dsSpec.Heartbeat.Nanoseconds()/1000000)
 	if err != nil {
 		log.Printf("FetchOrCreateDataSource(): error querying database: %v", err)
-		return nil, err
+		return nil, dbError("FetchOrCreateDataSource", err)
 	}
 	if !rows.Next() {
 		log.Printf("FetchOrCreateDataSource(): unable to lookup/create")
-		return nil, fmt.Errorf("unable to lookup/create")
+		return nil, newError("FetchOrCreateDataSource", ErrDatabase, "unable to lookup/create")
 	}
 	defer rows.Close()
 
 	ds, err = dataSourceFromRow(rows)
 	if err != nil {
 		log.Printf("FetchOrCreateDataSource(): error 1: %v", err)
-		return nil, err
+		return nil, dbError("FetchOrCreateDataSource", err)
 	}
 	if !ds.Created() { // UPSERT did not INSERT, nothing more to do here
 		return ds, nil
@@ -1097,13 +1147,13 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 	// executed in parallel, do this in a transaction.
 	tx, err := p.dbConn.Begin()
 	if err != nil {
-		return nil, err
+		return nil, dbError("FetchOrCreateDataSource", err)
 	}
 
 	// Create DS State
 	if _, err = tx.Stmt(p.sqlInsertDSState).Exec(ds.Seg()); err != nil {
 		tx.Rollback()
-		return nil, err
+		return nil, dbError("FetchOrCreateDataSource", err)
 	}
 
 	// RRAs
@@ -1121,6 +1171,8 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 			cf = "MAX"
 		case rrd.LAST:
 			cf = "LAST"
+		case rrd.SUM:
+			cf = "SUM"
 		}
 
 		// rra_bundle
@@ -1129,28 +1181,28 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 		if err != nil {
 			log.Printf("FetchOrCreateDataSource(): error creating RRA bundle: %v", err)
 			tx.Rollback()
-			return nil, err
+			return nil, dbError("FetchOrCreateDataSource", err)
 		}
 
 		// Get the next position for this bundle TODO: If the DS was
 		// not created (upsert), there is a possibity that we're
 		// incrementing this in vain, the position will be wasted if
 		// the rra already exists.
-		pos, err := p.rraBundleIncrPos(tx, bundle.id)
+		pos, err := p.rraBundlePos(tx, bundle, ident)
 		if err != nil {
 			log.Printf("FetchOrCreateDataSource(): error incrementing last_pos in RRA bundle: %v", err)
 			tx.Rollback()
-			return nil, err
+			return nil, dbError("FetchOrCreateDataSource", err)
 		}
 
 		// rra
 		var rraRows *sql.Rows
 		seg, idx := segIdxFromPosWidth(pos, bundle.width)
-		rraRows, err = tx.Stmt(p.sqlInsertRRA).Query(ds.Id(), bundle.id, pos, seg, idx, cf, rraSpec.Xff)
+		rraRows, err = tx.Stmt(p.sqlInsertRRA).Query(ds.Id(), bundle.id, pos, seg, idx, cf, rraSpec.Xff, rraSpec.RollUp)
 		if err != nil {
 			log.Printf("FetchOrCreateDataSource(): error creating RRAs: %v", err)
 			tx.Rollback()
-			return nil, err
+			return nil, dbError("FetchOrCreateDataSource", err)
 		}
 		rraRows.Next()
 
@@ -1160,7 +1212,7 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 		if err != nil {
 			log.Printf("FetchOrCreateDataSource(): error2: %v", err)
 			tx.Rollback()
-			return nil, err
+			return nil, dbError("FetchOrCreateDataSource", err)
 		}
 
 		dur := rraSpec.Duration.Nanoseconds() / 1e6
@@ -1175,7 +1227,7 @@ func (p *pgvSerDe) FetchOrCreateDataSource(ident Ident, dsSpec *rrd.DSSpec) (rrd
 		if err != nil {
 			log.Printf("FetchOrCreateDataSource(): error3: %v", err)
 			tx.Rollback()
-			return nil, err
+			return nil, dbError("FetchOrCreateDataSource", err)
 		}
 
 		rras = append(rras, rra)
@@ -1194,12 +1246,12 @@ func (p *pgvSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints
 
 	dbds, ok := ds.(DbDataSourcer)
 	if !ok {
-		return nil, fmt.Errorf("FetchSeries: ds must be a DbDataSourcer")
+		return nil, newError("FetchSeries", ErrInvalid, "ds must be a DbDataSourcer")
 	}
 
 	rra := dbds.BestRRA(from, to, maxPoints)
 	if rra == nil {
-		return nil, fmt.Errorf("FetchSeries: No adequate RRA found for DS id: %v from: %v to: %v maxPoints: %v", dbds.Id(), from, to, maxPoints)
+		return nil, newError("FetchSeries", ErrNotFound, "No adequate RRA found for DS id: %v from: %v to: %v maxPoints: %v", dbds.Id(), from, to, maxPoints)
 	}
 
 	// If from/to are nil - assign the rra boundaries
@@ -1211,55 +1263,287 @@ func (p *pgvSerDe) FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints
 
 	dbrra, ok := rra.(DbRoundRobinArchiver)
 	if !ok {
-		return nil, fmt.Errorf("FetchSeries: rra must be a DbRoundRobinArchive")
+		return nil, newError("FetchSeries", ErrInvalid, "rra must be a DbRoundRobinArchive")
 	}
 
 	dps := &dbSeries{db: p, ds: dbds, rra: dbrra, from: from, to: to, maxPoints: maxPoints}
 	return dps, nil
 }
 
+// FetchSeriesBulk loads the data of the best RRA of every DS in dss
+// with as few queries as possible: the RRAs which share a segment of
+// a bundle (as series matching a pattern often do) with one query
+// for the segment, the rest with a single query, joining ts on the
+// list of (bundle, segment, idx) needed, so that each row of ts is
+// read once no matter how many of the RRAs it holds. Unlike
+// FetchSeries the series returned are in memory and hold no database
+// cursor. Beyond PgBulkChunk DSs, the data is loaded in chunks of as
+// many, each when one of its series is first read.
+func (p *pgvSerDe) FetchSeriesBulk(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error) {
+
+	rras := make([]*DbRoundRobinArchive, len(dss))
+	for n, ds := range dss {
+		dbds, ok := ds.(DbDataSourcer)
+		if !ok {
+			return nil, newError("FetchSeriesBulk", ErrInvalid, "ds must be a DbDataSourcer")
+		}
+		rra := dbds.BestRRA(from, to, maxPoints)
+		if rra == nil {
+			return nil, newError("FetchSeriesBulk", ErrNotFound, "No adequate RRA found for DS id: %v from: %v to: %v maxPoints: %v", dbds.Id(), from, to, maxPoints)
+		}
+		dbrra, ok := rra.(*DbRoundRobinArchive)
+		if !ok {
+			return nil, newError("FetchSeriesBulk", ErrInvalid, "rra must be a *DbRoundRobinArchive")
+		}
+		rras[n] = dbrra
+	}
+
+	if PgBulkChunk <= 0 || len(rras) <= PgBulkChunk {
+		dps, err := p.loadDps(rras, from, to, maxPoints)
+		if err != nil {
+			return nil, dbError("FetchSeriesBulk", err)
+		}
+		result := make([]series.Series, len(rras))
+		for n, rra := range rras {
+			newrra, err := bulkRRA(rra, dps[n])
+			if err != nil {
+				return nil, dbError("FetchSeriesBulk", err)
+			}
+			result[n] = bulkSeries(newrra, from, to, maxPoints)
+		}
+		return result, nil
+	}
+
+	result := make([]series.Series, 0, len(rras))
+	for len(rras) > 0 {
+		c := &bulkChunk{p: p, rras: rras, from: from, to: to, maxPoints: maxPoints}
+		if len(c.rras) > PgBulkChunk {
+			c.rras = c.rras[:PgBulkChunk]
+		}
+		rras = rras[len(c.rras):]
+		for n, rra := range c.rras {
+			newrra, err := bulkRRA(rra, nil)
+			if err != nil {
+				return nil, dbError("FetchSeriesBulk", err)
+			}
+			result = append(result, bulkSeries(&lazyBulkRRA{newrra, c, n}, from, to, maxPoints))
+		}
+	}
+	return result, nil
+}
+
+// Loads the data points of rras (in the same order) for
+// FetchSeriesBulk.
+func (p *pgvSerDe) loadDps(rras []*DbRoundRobinArchive, from, to time.Time, maxPoints int64) ([]map[int64]float64, error) {
+	dps := make([]map[int64]float64, len(rras))
+	var (
+		bundles  []bundleSeg // in the order of rras
+		byBundle = make(map[bundleSeg][]int64)
+	)
+	for n, rra := range rras {
+		if !rra.Latest().IsZero() { // otherwise there is no data
+			dps[n] = make(map[int64]float64)
+			key := bundleSeg{rra.BundleId(), rra.Seg()}
+			if byBundle[key] == nil {
+				bundles = append(bundles, key)
+			}
+			byBundle[key] = append(byBundle[key], int64(n))
+		}
+	}
+
+	// The RRAs sharing a segment of a bundle are read together (see
+	// loadBundleDps), the rest all with one query.
+	var ns []int64
+	for _, key := range bundles {
+		if group := byBundle[key]; len(group) > 1 {
+			if err := p.loadBundleDps(rras, dps, group, from, to, maxPoints); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ns = append(ns, byBundle[key][0])
+	}
+
+	if len(ns) > 0 {
+		if err := p.loadBulkDps(rras, dps, ns, from, to, maxPoints); err != nil {
+			return nil, err
+		}
+	}
+	return dps, nil
+}
+
+// A copy of rra (its state as read) with dps as the data points.
+func bulkRRA(rra *DbRoundRobinArchive, dps map[int64]float64) (*DbRoundRobinArchive, error) {
+	spec := rra.Spec()
+	spec.Latest = rra.Latest()
+	spec.Value = rra.Value()
+	spec.Duration = rra.Duration()
+	spec.DPs = dps
+	return newDbRoundRobinArchive(rra.id, rra.width, rra.bundleId, rra.pos, spec)
+}
+
+func bulkSeries(rra rrd.RoundRobinArchiver, from, to time.Time, maxPoints int64) series.Series {
+	s := series.NewRRASeries(rra)
+	s.TimeRange(from, to)
+	s.MaxPoints(maxPoints)
+	return s
+}
+
+// Loads the data points of the RRAs at ns (of rras and dps) in one
+// query, only the rows of the time range of each (see dpsWindow()).
+// The slots of an RRA are one or (where they wrap) two ranges of i,
+// each is a row of k, n being the position of the RRA in rras.
+func (p *pgvSerDe) loadBulkDps(rras []*DbRoundRobinArchive, dps []map[int64]float64, ns []int64, from, to time.Time, maxPoints int64) error {
+	var bundleIds, segs, idxs, kns, los, his []int64
+	for _, n := range ns {
+		rra := rras[n]
+		wfrom, wuntil := dpsWindow(rras, []int64{n}, from, to, maxPoints)
+		for _, r := range slotRanges(slotsBetween(rra, wfrom, wuntil)) {
+			bundleIds = append(bundleIds, rra.BundleId())
+			segs = append(segs, rra.Seg())
+			idxs = append(idxs, rra.Idx())
+			kns = append(kns, n)
+			los = append(los, r[0])
+			his = append(his, r[1])
+		}
+	}
+	if len(kns) == 0 {
+		return nil
+	}
+
+	stmt := `
+  SELECT k.n, ts.i, ts.dp[k.idx], ts.ver[k.idx]
+    FROM unnest($1::int[], $2::int[], $3::int[], $4::int[], $5::int[], $6::int[]) AS k(rra_bundle_id, seg, idx, n, lo, hi)
+    JOIN %[1]sts ts ON ts.rra_bundle_id = k.rra_bundle_id AND ts.seg = k.seg AND ts.i BETWEEN k.lo AND k.hi
+   WHERE ts.dp[k.idx] IS NOT NULL AND ts.dp[k.idx] <> 'NaN'
+`
+	rows, err := p.readQuery("FetchSeriesBulk", p.dbConn, fmt.Sprintf(stmt, p.prefix), pq.Array(bundleIds), pq.Array(segs), pq.Array(idxs), pq.Array(kns), pq.Array(los), pq.Array(his))
+	if err != nil {
+		log.Printf("FetchSeriesBulk: error %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	vers := make(map[int64]slotVersion, len(ns))
+	for _, n := range ns {
+		latestI, latestVer := LatestVersion(rras[n].Latest(), rras[n].Step(), rras[n].Size())
+		vers[n] = slotVersion{latestI, latestVer}
+	}
+
+	for rows.Next() {
+		var (
+			n, i int64
+			val  *float64
+			ver  *int64
+		)
+		if err = rows.Scan(&n, &i, &val, &ver); err != nil {
+			log.Printf("FetchSeriesBulk: error scanning %v", err)
+			return err
+		}
+		v := vers[n]
+		addVersionedDP(dps[n], i, val, ver, v.latestI, v.latestVer)
+	}
+	return rows.Err()
+}
+
 func (p *pgvSerDe) loadRRADps(rra *DbRoundRobinArchive) (map[int64]float64, error) {
 	// the subselect apparently encourages index scan
 	stmt := `
-  SELECT i, r
+  SELECT i, r, v
     FROM (SELECT i, dp[$1] AS r, ver[$1] AS v
             FROM %[1]sts ts
            WHERE rra_bundle_id = $2 AND seg = $3 AND dp[$1] IS NOT NULL AND dp[$1] <> 'NaN') x
-    WHERE (i <= $4) AND v = $5 OR (i > $4) AND v = $6
 `
-	// TODO There should be a centralized place for version calculation
-	latest_i := rrd.SlotIndex(rra.Latest(), rra.Step(), rra.Size())
-	span_ms := (rra.Step().Nanoseconds() / 1e6) * rra.Size()
-	latest_ms := rra.Latest().UnixNano() / 1e6
-	latestVer := int((latest_ms / span_ms) % 32767)
-	prevVer := latestVer - 1
-	if prevVer == -1 {
-		prevVer = 32767
-	}
-
-	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix), rra.Idx(), rra.BundleId(), rra.Seg(), latest_i, latestVer, prevVer)
+	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix), rra.Idx(), rra.BundleId(), rra.Seg())
 	if err != nil {
 		log.Printf("LoadRRAData: error %v", err)
 		return nil, err
 	}
 	defer rows.Close()
 
+	latestI, latestVer := LatestVersion(rra.Latest(), rra.Step(), rra.Size())
+	return scanVersionedDps(rows, latestI, latestVer)
+}
+
+// Reads the (i, r, v) rows of loadRRADps into a map of slot to value.
+func scanVersionedDps(rows rowScanner, latestI int64, latestVer int) (map[int64]float64, error) {
 	dps := make(map[int64]float64)
 	for rows.Next() {
 		var (
 			i   int64
 			val *float64
+			ver *int64
 		)
-		err = rows.Scan(&i, &val)
-		if err != nil {
+		if err := rows.Scan(&i, &val, &ver); err != nil {
 			log.Printf("LoadRRAData: error scanning %v", err)
 			return nil, err
 		}
-		if val != nil && !math.IsNaN(*val) {
-			dps[i] = *val
+		addVersionedDP(dps, i, val, ver, latestI, latestVer)
+	}
+	return dps, rows.Err()
+}
+
+// Adds the data point in slot i to dps, unless it is NULL, NaN (or
+// NaNSentinel) or stale (its version does not match), which is the same as adding
+// NaN, since that is what a missing slot reads as.
+func addVersionedDP(dps map[int64]float64, i int64, val *float64, ver *int64, latestI int64, latestVer int) {
+	v := decodeDp(val)
+	if math.IsNaN(v) {
+		return
+	}
+	if ver == nil || int(*ver) != SlotVersion(i, latestI, latestVer) {
+		return
+	}
+	dps[i] = v
+}
+
+// LatestFromData computes what the latest of the RRA should be based
+// on the data points and their versions actually stored, ignoring the
+// latest in the rra_state table. This is useful when the latest got
+// out of sync with the data, e.g. after a crash in the middle of a
+// flush. Since versions wrap around, the most recent version not in
+// the future relative to now is assumed. A zero time is returned if
+// there is no data.
+func (p *pgvSerDe) LatestFromData(rra DbRoundRobinArchiver, now time.Time) (time.Time, error) {
+	stmt := `
+  SELECT i, ver[$1]
+    FROM %[1]sts ts
+   WHERE rra_bundle_id = $2 AND seg = $3 AND dp[$1] IS NOT NULL AND dp[$1] <> 'NaN' AND ver[$1] IS NOT NULL
+`
+	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix), rra.Idx(), rra.BundleId(), rra.Seg())
+	if err != nil {
+		log.Printf("LatestFromData: error %v", err)
+		return time.Time{}, dbError("LatestFromData", err)
+	}
+	defer rows.Close()
+
+	// The absolute slot number n (time since epoch in steps) is
+	// ver*size + i, where ver is not wrapped around, see the tv view.
+	step := rra.Step().Nanoseconds()
+	size := rra.Size()
+	nowN := now.UnixNano() / step
+	nowVer := nowN / size
+
+	var maxN int64 = -1
+	for rows.Next() {
+		var i, ver int64
+		if err = rows.Scan(&i, &ver); err != nil {
+			log.Printf("LatestFromData: error scanning %v", err)
+			return time.Time{}, dbError("LatestFromData", err)
+		}
+		fullVer := nowVer - (nowVer%(MaxVersion+1)-ver+MaxVersion+1)%(MaxVersion+1)
+		n := fullVer*size + i
+		if n > nowN {
+			continue // in the future, must be garbage
+		}
+		if n > maxN {
+			maxN = n
 		}
 	}
-	return dps, nil
+	if maxN == -1 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, maxN*step), nil
 }
 
 // Returns a *new* RRA based on the one passed in, containing all the data.
@@ -1273,13 +1557,13 @@ func (p *pgvSerDe) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiv
 
 	dbrra, ok := rra.(*DbRoundRobinArchive)
 	if !ok {
-		return nil, fmt.Errorf("LoadRRAData: Not a *DbRoundRobinArchive")
+		return nil, newError("LoadRRAData", ErrInvalid, "Not a *DbRoundRobinArchive")
 	}
 
 	if !rra.Latest().IsZero() {
 		if dps, err = p.loadRRADps(dbrra); err != nil {
 			log.Printf("LoadRRAData: error loading data points %v", err)
-			return nil, err
+			return nil, dbError("LoadRRAData", err)
 		}
 	}
 
@@ -1292,7 +1576,7 @@ func (p *pgvSerDe) LoadRRAData(rra rrd.RoundRobinArchiver) (rrd.RoundRobinArchiv
 	newrra, err := newDbRoundRobinArchive(dbrra.id, dbrra.width, dbrra.bundleId, dbrra.pos, spec)
 	if err != nil {
 		log.Printf("LoadRRAData: error creating rra %v", err)
-		return nil, err
+		return nil, dbError("LoadRRAData", err)
 	}
 
 	return newrra, nil
@@ -1307,20 +1591,57 @@ func (p *pgvSerDe) TsTableSize() (size, count int64, err error) {
   WHERE relname = '%[1]sts';`
 	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix))
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, dbError("TsTableSize", err)
 	}
 	defer rows.Close()
 	if rows.Next() {
 		var fcnt float64
 		err = rows.Scan(&size, &fcnt)
 		if err != nil {
-			return 0, 0, err
+			return 0, 0, dbError("TsTableSize", err)
 		}
 		return size, int64(fcnt), nil
 	}
 	return 0, 0, nil
 }
 
+// TsRowWidth returns the average width (data points per row) of the
+// rows of the ts table, weighted by how many rows each bundle has,
+// i.e. its size times the number of segments its positions span.
+// Bundles can have different widths (see CompactRRABundle), this is
+// what the size of the table should be estimated with. Without any
+// bundles it is PgSegmentWidth.
+func (p *pgvSerDe) TsRowWidth() (float64, error) {
+	stmt := fmt.Sprintf("SELECT size, width, last_pos FROM %[1]srra_bundle", p.prefix)
+	rows, err := p.dbConn.Query(stmt)
+	if err != nil {
+		log.Printf("TsRowWidth(): error querying database: %v", err)
+		return 0, dbError("TsRowWidth", err)
+	}
+	defer rows.Close()
+
+	var nRows, sum int64
+	for rows.Next() {
+		var size, width, lastPos int64
+		if err := rows.Scan(&size, &width, &lastPos); err != nil {
+			log.Printf("TsRowWidth(): error scanning row: %v", err)
+			return 0, dbError("TsRowWidth", err)
+		}
+		if width > 0 {
+			n := size * ((lastPos + width - 1) / width)
+			nRows += n
+			sum += n * width
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, dbError("TsRowWidth", err)
+	}
+	if nRows == 0 {
+		return float64(PgSegmentWidth), nil
+	}
+	return float64(sum) / float64(nRows), nil
+}
+
 func (p *pgvSerDe) rraBundleIncrPos(tx *sql.Tx, id int64) (int64, error) {
 	stmt := fmt.Sprintf("UPDATE %[1]srra_bundle SET last_pos = last_pos + 1 WHERE id = $1 RETURNING last_pos", p.prefix)
 	rows, err := tx.Query(stmt, id)
@@ -1346,7 +1667,7 @@ func (p *pgvSerDe) rraBundleIncrPos(tx *sql.Tx, id int64) (int64, error) {
 func (p *pgvSerDe) RegisterDeleteListener(handler func(Ident)) error {
 	err := p.listen.Listen(fmt.Sprintf("%[1]sds_delete_event", p.prefix))
 	if err != nil {
-		return err
+		return dbError("RegisterDeleteListener", err)
 	}
 
 	go handleDeleteNotifications(p.listen, handler)
@@ -1385,7 +1706,7 @@ func (p *pgvSerDe) SaveDSLCacheKeys(idents []Ident) error {
 	_, err := p.dbConn.Exec(fmt.Sprintf("TRUNCATE %[1]sdsl_cache", p.prefix))
 	if err != nil {
 		log.Printf("SaveDSLCacheKeys(): %v", err)
-		return err
+		return dbError("SaveDSLCacheKeys", err)
 	}
 
 	// Dump them.
@@ -1398,7 +1719,7 @@ func (p *pgvSerDe) SaveDSLCacheKeys(idents []Ident) error {
 	_, err = p.dbConn.Exec(stmt)
 	if err != nil {
 		log.Printf("SaveDSLCacheKeys(): %v", err)
-		return err
+		return dbError("SaveDSLCacheKeys", err)
 	}
 
 	return nil
@@ -1411,7 +1732,7 @@ func (p *pgvSerDe) LoadDSLCacheKeys() ([]Ident, error) {
 	rows, err := p.dbConn.Query(stmt)
 	if err != nil {
 		log.Printf("LoadDSLCacheKeys(): %v", err)
-		return nil, err
+		return nil, dbError("LoadDSLCacheKeys", err)
 	}
 	defer rows.Close()
 
@@ -1420,7 +1741,7 @@ func (p *pgvSerDe) LoadDSLCacheKeys() ([]Ident, error) {
 		var istr string
 		if err := rows.Scan(&istr); err != nil {
 			log.Printf("LoadDSLCacheKeys(): %v", err)
-			return nil, err
+			return nil, dbError("LoadDSLCacheKeys", err)
 		}
 
 		var ident Ident
@@ -1435,3 +1756,189 @@ func (p *pgvSerDe) LoadDSLCacheKeys() ([]Ident, error) {
 
 	return result, nil
 }
+
+// Events
+
+func (p *pgvSerDe) StoreEvent(e *Event) error {
+	if e.When.IsZero() {
+		e.When = time.Now()
+	}
+	if e.Tags == nil {
+		e.Tags = []string{}
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO %[1]sevents (t, what, tags, data) VALUES ($1, $2, $3, $4) RETURNING id", p.prefix)
+	if err := p.dbConn.QueryRow(stmt, e.When, e.What, pq.Array(e.Tags), e.Data).Scan(&e.Id); err != nil {
+		log.Printf("StoreEvent(): %v", err)
+		return dbError("StoreEvent", err)
+	}
+	return nil
+}
+
+func (p *pgvSerDe) FetchEvents(tags []string, from, to time.Time) ([]*Event, error) {
+
+	stmt := fmt.Sprintf("SELECT id, t, what, tags, data FROM %[1]sevents WHERE t >= $1 AND t <= $2", p.prefix)
+	args := []interface{}{from, to}
+	if len(tags) > 0 {
+		stmt += " AND tags @> $3"
+		args = append(args, pq.Array(tags))
+	}
+	stmt += " ORDER BY t"
+
+	rows, err := p.dbConn.Query(stmt, args...)
+	if err != nil {
+		log.Printf("FetchEvents(): %v", err)
+		return nil, dbError("FetchEvents", err)
+	}
+	defer rows.Close()
+
+	result := []*Event{}
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Id, &e.When, &e.What, pq.Array(&e.Tags), &e.Data); err != nil {
+			log.Printf("FetchEvents(): %v", err)
+			return nil, dbError("FetchEvents", err)
+		}
+		result = append(result, &e)
+	}
+	return result, dbError("FetchEvents", rows.Err())
+}
+
+// RRABundleUsage describes how densely an RRA bundle is
+// populated. Segments is the number of segments its RRAs occupy,
+// when RRAs are removed (e.g. a DS is deleted) the segments become
+// sparse and this is greater than what RRAs would need at Width per
+// segment.
+type RRABundleUsage struct {
+	Id, StepMs, Size, Width int64
+	RRAs, Segments          int64
+}
+
+// The minimum number of segments needed at width.
+func (u *RRABundleUsage) MinSegments(width int64) int64 {
+	if width <= 0 {
+		width = u.Width
+	}
+	return (u.RRAs + width - 1) / width
+}
+
+func (p *pgvSerDe) RRABundleUsage() ([]*RRABundleUsage, error) {
+	stmt := `
+  SELECT b.id, b.step_ms, b.size, b.width, count(rra.id), count(DISTINCT rra.seg)
+    FROM %[1]srra_bundle b
+    LEFT JOIN %[1]srra rra ON rra.rra_bundle_id = b.id
+   GROUP BY b.id, b.step_ms, b.size, b.width
+   ORDER BY b.id`
+	rows, err := p.dbConn.Query(fmt.Sprintf(stmt, p.prefix))
+	if err != nil {
+		log.Printf("RRABundleUsage(): error querying database: %v", err)
+		return nil, dbError("RRABundleUsage", err)
+	}
+	defer rows.Close()
+
+	var result []*RRABundleUsage
+	for rows.Next() {
+		var u RRABundleUsage
+		if err := rows.Scan(&u.Id, &u.StepMs, &u.Size, &u.Width, &u.RRAs, &u.Segments); err != nil {
+			log.Printf("RRABundleUsage(): error scanning row: %v", err)
+			return nil, dbError("RRABundleUsage", err)
+		}
+		result = append(result, &u)
+	}
+	return result, dbError("RRABundleUsage", rows.Err())
+}
+
+// CompactRRABundle re-packs the RRAs of a bundle into consecutive
+// positions (in their original order), and, if width is greater
+// than zero, changes the bundle width, i.e. how many RRAs share a
+// segment. The data points and RRA states are moved along with the
+// new seg and idx mapping of every RRA, all in a single
+// transaction. Positions freed up at the end are reused by RRAs
+// created later.
+//
+// The Tgres daemon keeps seg and idx of every RRA in memory, which
+// means it must not be running while this happens.
+func (p *pgvSerDe) CompactRRABundle(bundleId, width int64) error {
+
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return dbError("CompactRRABundle", err)
+	}
+	defer tx.Rollback() // no-op after Commit()
+
+	// This also blocks RRA creation in this bundle, see rraBundleIncrPos()
+	var curWidth int64
+	stmt := fmt.Sprintf("SELECT width FROM %[1]srra_bundle WHERE id = $1 FOR UPDATE", p.prefix)
+	if err := tx.QueryRow(stmt, bundleId).Scan(&curWidth); err != nil {
+		if err == sql.ErrNoRows {
+			return newError("CompactRRABundle", ErrNotFound, "no RRA bundle with id %d", bundleId)
+		}
+		return dbError("CompactRRABundle", err)
+	}
+	if width <= 0 {
+		width = curWidth
+	}
+
+	// New positions are the rank of the current position, which
+	// makes segments full and idx within a segment contiguous,
+	// the latter is what makes array_agg() below correct.
+	stmt = `
+  CREATE TEMP TABLE compact_map ON COMMIT DROP AS
+  SELECT rra_id, old_seg, old_idx, new_pos,
+         (new_pos - 1) / %[2]d AS new_seg,
+         mod(new_pos - 1, %[2]d) + 1 AS new_idx
+    FROM (SELECT id AS rra_id, seg AS old_seg, idx AS old_idx,
+                 row_number() OVER (ORDER BY pos) AS new_pos
+            FROM %[1]srra WHERE rra_bundle_id = $1) r`
+	if _, err := tx.Exec(fmt.Sprintf(stmt, p.prefix, width), bundleId); err != nil {
+		log.Printf("CompactRRABundle(): error creating mapping: %v", err)
+		return dbError("CompactRRABundle", err)
+	}
+
+	var n int64
+	if err := tx.QueryRow("SELECT count(1) FROM compact_map").Scan(&n); err != nil {
+		return dbError("CompactRRABundle", err)
+	}
+
+	// Rows of ts and rra_state are rebuilt from scratch for the new
+	// segments, slots never written and missing rows become NULL,
+	// which is the same as a fresh row.
+	for _, stmt := range []string{`
+  CREATE TEMP TABLE compact_ts ON COMMIT DROP AS
+  SELECT m.new_seg AS seg, s.i,
+         array_agg(ts.dp[m.old_idx] ORDER BY m.new_idx) AS dp,
+         array_agg(ts.ver[m.old_idx] ORDER BY m.new_idx) AS ver
+    FROM compact_map m
+   CROSS JOIN (SELECT DISTINCT i FROM %[1]sts WHERE rra_bundle_id = $1) s
+    LEFT JOIN %[1]sts ts ON ts.rra_bundle_id = $1 AND ts.seg = m.old_seg AND ts.i = s.i
+   GROUP BY m.new_seg, s.i`, `
+  CREATE TEMP TABLE compact_rra_state ON COMMIT DROP AS
+  SELECT m.new_seg AS seg,
+         array_agg(rs.latest[m.old_idx] ORDER BY m.new_idx) AS latest,
+         array_agg(rs.duration_ms[m.old_idx] ORDER BY m.new_idx) AS duration_ms,
+         array_agg(rs.value[m.old_idx] ORDER BY m.new_idx) AS value
+    FROM compact_map m
+    LEFT JOIN %[1]srra_state rs ON rs.rra_bundle_id = $1 AND rs.seg = m.old_seg
+   GROUP BY m.new_seg`,
+		`DELETE FROM %[1]sts WHERE rra_bundle_id = $1`,
+		`INSERT INTO %[1]sts (rra_bundle_id, seg, i, dp, ver) SELECT $1, seg, i, dp, ver FROM compact_ts`,
+		`DELETE FROM %[1]srra_state WHERE rra_bundle_id = $1`,
+		`INSERT INTO %[1]srra_state (rra_bundle_id, seg, latest, duration_ms, value)
+           SELECT $1, seg, latest, duration_ms, value FROM compact_rra_state`,
+		`UPDATE %[1]srra AS rra SET pos = m.new_pos, seg = m.new_seg, idx = m.new_idx
+           FROM compact_map m WHERE rra.id = m.rra_id`,
+	} {
+		if _, err := tx.Exec(fmt.Sprintf(stmt, p.prefix), bundleId); err != nil {
+			log.Printf("CompactRRABundle(): %v", err)
+			return dbError("CompactRRABundle", err)
+		}
+	}
+
+	stmt = fmt.Sprintf("UPDATE %[1]srra_bundle SET width = $2, last_pos = $3 WHERE id = $1", p.prefix)
+	if _, err := tx.Exec(stmt, bundleId, width, n); err != nil {
+		log.Printf("CompactRRABundle(): error updating bundle: %v", err)
+		return dbError("CompactRRABundle", err)
+	}
+
+	return dbError("CompactRRABundle", tx.Commit())
+}
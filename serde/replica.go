@@ -0,0 +1,104 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// If PgReadReplica is not blank, it is the connect string of a
+// read-only replica (e.g. a streaming replication hot standby) of the
+// database, which is then used for the queries of the data of the
+// series (FetchSeries, FetchSeriesBulk, QueryBundle,
+// QueryDataPoints) and Search. Everything else, including all the writes and the DS and
+// RRA state, stays on the primary.
+//
+// The replica lags behind the primary, and the in-memory state of a
+// series (e.g. its Latest()) is that of the primary, so the most
+// recently flushed points may be missing or appear as NaN until they
+// are replicated: there is no reading of your own writes.
+//
+// If the replica cannot be connected to on InitDb it is not used at
+// all. When a query on it fails because it is unavailable (or
+// because of a conflict with the recovery), the query is run on the
+// primary instead, as are all the queries for PgReadReplicaRetry
+// after that.
+var (
+	PgReadReplica      string
+	PgReadReplicaRetry = 30 * time.Second
+)
+
+// Opens the replica, returns nil if it cannot be connected to.
+func openReadReplica(connect_string string) *sql.DB {
+	// See the NB on enable_material in InitDb.
+	db, err := sql.Open("postgres", connect_string+" enable_material=off")
+	if err == nil {
+		if err = db.Ping(); err != nil {
+			db.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("InitDb: cannot connect to the read replica, querying the primary only: %v", err)
+		return nil
+	}
+	return db
+}
+
+// Whether queries should go to the replica.
+func (p *pgvSerDe) replicaUp() bool {
+	return p.dbRConn != nil && atomic.LoadInt64(&p.replicaDownUntil) <= time.Now().UnixNano()
+}
+
+// Returns true if err means the query should be run on the primary,
+// in which case the replica is not used for a while.
+func (p *pgvSerDe) replicaFailed(op string, err error) bool {
+	if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != "40001" { // serialization_failure, a recovery conflict
+		if dbErrorKind(err) != ErrUnavailable {
+			return false
+		}
+	}
+	log.Printf("%s: read replica error, querying the primary for %v: %v", op, PgReadReplicaRetry, err)
+	atomic.StoreInt64(&p.replicaDownUntil, time.Now().Add(PgReadReplicaRetry).UnixNano())
+	return true
+}
+
+// readQuery runs the query on the replica if it is up, otherwise (or
+// if it fails) on primary.
+func (p *pgvSerDe) readQuery(op string, primary *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	if p.replicaUp() {
+		rows, err := p.dbRConn.Query(query, args...)
+		if err == nil || !p.replicaFailed(op, err) {
+			return rows, err
+		}
+	}
+	return primary.Query(query, args...)
+}
+
+// readStmt is readQuery for a statement prepared on both.
+func (p *pgvSerDe) readStmt(op string, primary, replica *sql.Stmt, args ...interface{}) (*sql.Rows, error) {
+	if replica != nil && p.replicaUp() {
+		rows, err := replica.Query(args...)
+		if err == nil || !p.replicaFailed(op, err) {
+			return rows, err
+		}
+	}
+	return primary.Query(args...)
+}
@@ -0,0 +1,114 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// replicaDriver counts the queries of every "database" (the connect
+// string), which fail with the error in errs, if any.
+type replicaDriver struct {
+	sync.Mutex
+	queries map[string]int
+	errs    map[string]error
+}
+
+type replicaConn struct {
+	d    *replicaDriver
+	name string
+}
+
+type replicaRows struct{}
+
+func (replicaRows) Columns() []string              { return []string{"n"} }
+func (replicaRows) Close() error                   { return nil }
+func (replicaRows) Next(dest []driver.Value) error { return io.EOF }
+
+func (d *replicaDriver) Open(name string) (driver.Conn, error) {
+	return &replicaConn{d: d, name: name}, nil
+}
+
+func (c *replicaConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	c.d.Lock()
+	defer c.d.Unlock()
+	c.d.queries[c.name]++
+	if err := c.d.errs[c.name]; err != nil {
+		return nil, err
+	}
+	return replicaRows{}, nil
+}
+
+func (c *replicaConn) Prepare(string) (driver.Stmt, error) { return nil, fmt.Errorf("not supported") }
+func (c *replicaConn) Close() error                        { return nil }
+func (c *replicaConn) Begin() (driver.Tx, error)           { return nil, fmt.Errorf("not supported") }
+
+var replicas = &replicaDriver{}
+
+func init() {
+	sql.Register("tgres-replica", replicas)
+}
+
+func Test_pgvSerDe_readQuery(t *testing.T) {
+	primary, _ := sql.Open("tgres-replica", "primary")
+	replica, _ := sql.Open("tgres-replica", "replica")
+	defer primary.Close()
+	defer replica.Close()
+	p := &pgvSerDe{dbConn: primary, dbRConn: replica}
+
+	query := func() error {
+		rows, err := p.readQuery("Foo", p.dbConn, "SELECT 1")
+		if err == nil {
+			rows.Close()
+		}
+		return err
+	}
+
+	replicas.queries, replicas.errs = map[string]int{}, map[string]error{}
+	if err := query(); err != nil || replicas.queries["replica"] != 1 || replicas.queries["primary"] != 0 {
+		t.Errorf("Expected the query on the replica, got %v: %v", replicas.queries, err)
+	}
+
+	// The replica goes away, the primary is used for a while
+	replicas.errs["replica"] = io.EOF
+	for i := 0; i < 2; i++ {
+		if err := query(); err != nil {
+			t.Errorf("Expected a fallback to the primary, got: %v", err)
+		}
+	}
+	if replicas.queries["replica"] != 2 || replicas.queries["primary"] != 2 {
+		t.Errorf("Expected the replica to be skipped after failing, got %v", replicas.queries)
+	}
+
+	// Back up after PgReadReplicaRetry, other errors are returned
+	p.replicaDownUntil = 0
+	invalid := fmt.Errorf("syntax error")
+	replicas.errs["replica"] = invalid
+	if err := query(); err != invalid || replicas.queries["replica"] != 3 || replicas.queries["primary"] != 2 {
+		t.Errorf("Expected the error from the replica, got %v: %v", replicas.queries, err)
+	}
+
+	// No replica
+	p.dbRConn = nil
+	if err := query(); err != nil || replicas.queries["primary"] != 3 {
+		t.Errorf("Expected the query on the primary, got %v: %v", replicas.queries, err)
+	}
+}
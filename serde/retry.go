@@ -0,0 +1,69 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"log"
+	"time"
+)
+
+// A flush failing because the database is unavailable, e.g. the
+// connection dropped in the middle of it, is retried up to
+// PgFlushRetries times, waiting PgFlushRetryDelay before the first
+// retry and twice as long before every next one. database/sql throws
+// away a broken connection and opens a new one, so by the time of the
+// retry the connection is re-established (or the retry fails the same
+// way). The flushes only set values and are safe to repeat.
+var (
+	PgFlushRetries    = 5
+	PgFlushRetryDelay = time.Second
+)
+
+// Calls flush until it succeeds, fails for any other reason than
+// unavailability or the retries are exhausted. The SQL ops of all
+// the attempts are counted.
+func withFlushRetry(op string, flush func() (int, error)) (int, error) {
+	var sqlOps int
+	delay := PgFlushRetryDelay
+	for attempt := 0; ; attempt++ {
+		ops, err := flush()
+		sqlOps += ops
+		if err == nil || !IsUnavailable(err) || attempt >= PgFlushRetries {
+			return sqlOps, err
+		}
+		log.Printf("%s: %v, retrying in %v (%d of %d)", op, err, delay, attempt+1, PgFlushRetries)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (p *pgvSerDe) FlushDSStates(seg int64, lastupdate, value, duration map[int64]interface{}) (int, error) {
+	return withFlushRetry("FlushDSStates", func() (int, error) {
+		return p.flushDSStates(seg, lastupdate, value, duration)
+	})
+}
+
+func (p *pgvSerDe) FlushDataPoints(bundle_id, seg, i int64, dps, vers map[int64]interface{}) (int, error) {
+	return withFlushRetry("FlushDataPoints", func() (int, error) {
+		return p.flushDataPoints(bundle_id, seg, i, dps, vers)
+	})
+}
+
+func (p *pgvSerDe) FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error) {
+	return withFlushRetry("FlushRRAStates", func() (int, error) {
+		return p.flushRRAStates(bundle_id, seg, latests, value, duration)
+	})
+}
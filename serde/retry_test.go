@@ -0,0 +1,143 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// killingDriver stands between database/sql and the "database" the
+// way a proxy would, and kills the connection on the kill-th
+// Exec. Like a real driver, it only notices a dead connection by
+// failing the statement in flight with io.EOF, after that the
+// connection returns driver.ErrBadConn.
+type killingDriver struct {
+	sync.Mutex
+	execs, kill, conns int
+	stmts              []string // executed successfully
+}
+
+type killingConn struct {
+	d    *killingDriver
+	dead bool
+}
+
+type killingResult struct{}
+
+func (killingResult) LastInsertId() (int64, error) { return 0, nil }
+func (killingResult) RowsAffected() (int64, error) { return 1, nil }
+
+func (d *killingDriver) Open(string) (driver.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.conns++
+	return &killingConn{d: d}, nil
+}
+
+func (c *killingConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	if c.dead {
+		return nil, driver.ErrBadConn
+	}
+	c.d.Lock()
+	defer c.d.Unlock()
+	c.d.execs++
+	if c.d.execs == c.d.kill {
+		c.dead = true
+		return nil, io.EOF
+	}
+	c.d.stmts = append(c.d.stmts, query)
+	return killingResult{}, nil
+}
+
+func (c *killingConn) Prepare(string) (driver.Stmt, error) { return nil, fmt.Errorf("not supported") }
+func (c *killingConn) Close() error                        { return nil }
+func (c *killingConn) Begin() (driver.Tx, error)           { return nil, fmt.Errorf("not supported") }
+
+var killing = &killingDriver{}
+
+func init() {
+	sql.Register("tgres-killing", killing)
+}
+
+func Test_pgvSerDe_flushReconnect(t *testing.T) {
+	defer func(retries int, delay time.Duration) {
+		PgFlushRetries, PgFlushRetryDelay = retries, delay
+	}(PgFlushRetries, PgFlushRetryDelay)
+	PgFlushRetryDelay = time.Millisecond
+
+	db, err := sql.Open("tgres-killing", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	p := &pgvSerDe{dbConn: db, prefix: "tgres_"}
+
+	// Two chunks (idx 1 and 3) use a single unprepared statement
+	// per row, the connection dies in the middle of the segment.
+	dps := map[int64]interface{}{1: 1.0, 3: 3.0}
+	vers := map[int64]interface{}{1: 0, 3: 0}
+	flush := func() error {
+		for i := int64(0); i < 3; i++ {
+			if _, err := p.FlushDataPoints(1, 0, i, dps, vers); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	killing.execs, killing.kill, killing.conns, killing.stmts = 0, 2, 0, nil
+	if err := flush(); err != nil {
+		t.Errorf("Expected the flush to recover, got: %v", err)
+	}
+	if len(killing.stmts) != 3 {
+		t.Errorf("Expected all 3 rows to be written, got %d", len(killing.stmts))
+	}
+	if killing.conns != 2 {
+		t.Errorf("Expected a new connection after the kill, got %d connections", killing.conns)
+	}
+
+	// Without retries the segment fails
+	PgFlushRetries = 0
+	killing.execs, killing.kill, killing.stmts = 0, 2, nil
+	if err := flush(); !IsUnavailable(err) {
+		t.Errorf("Expected an unavailable error, got: %v", err)
+	}
+}
+
+func Test_withFlushRetry(t *testing.T) {
+	defer func(retries int, delay time.Duration) {
+		PgFlushRetries, PgFlushRetryDelay = retries, delay
+	}(PgFlushRetries, PgFlushRetryDelay)
+	PgFlushRetries, PgFlushRetryDelay = 2, time.Millisecond
+
+	calls := 0
+	invalid := newError("Foo", ErrInvalid, "bad data")
+	if _, err := withFlushRetry("Foo", func() (int, error) { calls++; return 0, invalid }); err != invalid || calls != 1 {
+		t.Errorf("Expected no retries of an invalid error, got %d calls: %v", calls, err)
+	}
+
+	calls = 0
+	gone := dbError("Foo", io.EOF)
+	if ops, err := withFlushRetry("Foo", func() (int, error) { calls++; return 1, gone }); err != gone || calls != 3 || ops != 3 {
+		t.Errorf("Expected 3 attempts and 3 ops, got %d calls, %d ops: %v", calls, ops, err)
+	}
+}
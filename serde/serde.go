@@ -66,6 +66,64 @@ type Fetcher interface {
 	FetchSeries(ds rrd.DataSourcer, from, to time.Time, maxPoints int64) (series.Series, error)
 }
 
+// An RRALister returns the RRAs of a DS by its id. The RRAs contain
+// only the metadata (step, size, latest, etc) and no data, which is
+// what is needed to decide which RRA should be used to satisfy a
+// query.
+type RRALister interface {
+	DataSourceRRAs(id int64) ([]rrd.RoundRobinArchiver, error)
+}
+
+// A BulkSeriesFetcher is like FetchSeries() for many DSs at once,
+// e.g. all the DSs matching a pattern, loading the data in as few
+// round trips to the database as possible instead of one per DS. The
+// series returned are in the same order as dss. It is optional, a
+// SerDe may or may not implement it.
+type BulkSeriesFetcher interface {
+	FetchSeriesBulk(dss []rrd.DataSourcer, from, to time.Time, maxPoints int64) ([]series.Series, error)
+}
+
+// A BundleQuerier can read the data points of all the RRAs in a
+// segment of an RRA bundle (which all have the same step and size and
+// are stored side by side) in one round trip, keyed by idx and then
+// slot. It is optional, a SerDe may or may not implement it.
+type BundleQuerier interface {
+	QueryBundle(bundleId, seg int64, from, until time.Time) (map[int64]map[int64]float64, error)
+}
+
+// A DataPoint is the value of a series at a point in time.
+type DataPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// DataPoints is an iterator over data points in time order, similar
+// to sql.Rows. Err() returns the error, if any, which ended the
+// iteration. Remember to Close() it in the end.
+type DataPoints interface {
+	Next() bool
+	DataPoint() DataPoint
+	Err() error
+	Close() error
+}
+
+// A DataPointQuerier reads the data points of the RRA of the given
+// step of the DS by id between from and until one at a time, without
+// loading all of them in memory first, which makes a difference for
+// long ranges. It is optional, a SerDe may or may not implement it.
+type DataPointQuerier interface {
+	QueryDataPoints(id int64, from, until time.Time, step time.Duration) (DataPoints, error)
+}
+
+// A LatestPointsQuerier reads the n most recent data points of the DS
+// by id which are not NaN, oldest first, e.g. for a "current value"
+// widget. They come from the finest RRA, reading back from its latest
+// only as far as needed, which is much cheaper than a range query. It
+// is optional, a SerDe may or may not implement it.
+type LatestPointsQuerier interface {
+	LatestPoints(id int64, n int) ([]DataPoint, error)
+}
+
 type EventListener interface {
 	RegisterDeleteListener(func(Ident)) error
 }
@@ -76,6 +134,120 @@ type Flusher interface {
 	FlushRRAStates(bundle_id, seg int64, latests, value, duration map[int64]interface{}) (int, error)
 }
 
+// A ConflictStrategy decides what happens to a slot which already
+// has a data point (of the same version, i.e. the same iteration of
+// the round-robin) when another one is flushed into it.
+type ConflictStrategy int
+
+const (
+	ConflictOverwrite ConflictStrategy = iota // the new data point replaces it (the default)
+	ConflictSkip                              // the existing data point is kept
+)
+
+func (s ConflictStrategy) String() string {
+	if s == ConflictSkip {
+		return "skip"
+	}
+	return "overwrite"
+}
+
+// ParseConflictStrategy returns the ConflictStrategy by its name,
+// "overwrite" or "skip".
+func ParseConflictStrategy(s string) (ConflictStrategy, error) {
+	switch s {
+	case "overwrite":
+		return ConflictOverwrite, nil
+	case "skip":
+		return ConflictSkip, nil
+	}
+	return ConflictOverwrite, fmt.Errorf("invalid conflict strategy %q, must be overwrite or skip", s)
+}
+
+// A ConflictFlusher is a Flusher which can also flush data points
+// without overwriting the ones already there, e.g. to backfill only
+// the missing data. FlushDataPoints is the same as
+// FlushDataPointsConflict with ConflictOverwrite. It is optional, a
+// Flusher may or may not implement it.
+type ConflictFlusher interface {
+	FlushDataPointsConflict(bundle_id, seg, i int64, dps, vers map[int64]interface{}, strategy ConflictStrategy) (int, error)
+}
+
+// A VersionCollisionCounter counts the RRAs whose latest moved ahead
+// by so many iterations of the round-robin at once that the slot
+// versions wrapped around (see SlotVersionsWrapped()), since the last
+// call. It is optional, a Flusher may or may not implement it.
+type VersionCollisionCounter interface {
+	VersionCollisions() int64
+}
+
+// An Event is something that happened at a point in time, such as a
+// deploy, which can be overlaid on graphs. Events are not related to
+// data sources and are stored separately.
+type Event struct {
+	Id   int64
+	When time.Time
+	What string
+	Tags []string
+	Data string
+}
+
+// An EventStorer stores and retrieves events. It is optional, a SerDe
+// may or may not implement it.
+type EventStorer interface {
+	StoreEvent(e *Event) error
+	// Fetch events between from and to which have all of the tags
+	// specified. Empty tags means all events.
+	FetchEvents(tags []string, from, to time.Time) ([]*Event, error)
+}
+
+// An AttributeStorer stores arbitrary attributes of a DS, such as
+// its units or a description, by DS id. It is optional, a SerDe may
+// or may not implement it.
+type AttributeStorer interface {
+	// Replaces all attributes of the DS.
+	SetAttributes(id int64, attrs map[string]string) error
+	// Returns the attributes of the DS, which is an empty map if
+	// there are none.
+	GetAttributes(id int64) (map[string]string, error)
+	// Returns the attributes of many DSs at once by ident, keyed by
+	// Ident.String(), those without any are omitted.
+	FetchAttributes(idents []Ident) (map[string]map[string]string, error)
+}
+
+// A PointDeleter clears the data points of the DS by id in the slots
+// ending between from and until (inclusive) of all its RRAs, e.g. to
+// correct a bad import, after which they read as empty (NaN), and
+// returns the number of slots cleared. Data points not yet flushed
+// are not affected. It is optional, a SerDe may or may not implement
+// it.
+type PointDeleter interface {
+	DeletePoints(id int64, from, until time.Time) (int, error)
+}
+
+// A Vacuumer can report the bloat of the tables which the data
+// points are written to and vacuum them, after which the space of
+// the dead tuples is reused. It is optional, a SerDe may or may not
+// implement it.
+type Vacuumer interface {
+	TableStats() ([]*TableStats, error)
+	// Also rebuilds the indexes if reindex.
+	VacuumTables(reindex bool) error
+}
+
+// An RRAFillReporter tells how full the RRAs of the DS by id are, in
+// the order of its RRAs, e.g. for right-sizing their spans. It is
+// optional, a SerDe may or may not implement it.
+type RRAFillReporter interface {
+	RRAFillStats(id int64) ([]*RRAFillStats, error)
+}
+
+// A SchemaVersioner reads the schema version of the database, which
+// may differ from SchemaVersion() when migrations are disabled. It is
+// optional, a SerDe may or may not implement it.
+type SchemaVersioner interface {
+	DbSchemaVersion() (int, error)
+}
+
 type SerDe interface {
 	Fetcher() Fetcher
 	Flusher() Flusher
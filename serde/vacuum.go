@@ -0,0 +1,106 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The tables which the flushers update all the time, and which
+// therefore accumulate dead tuples (without the prefix).
+var pgVacuumTables = []string{"ts", "rra_state", "ds_state"}
+
+// TableStats are the PostgreSQL statistics of a table
+// (pg_stat_user_tables), which tell how bloated it is.
+type TableStats struct {
+	Name                       string // without the prefix
+	LiveTuples, DeadTuples     int64  // estimates
+	LastVacuum, LastAutoVacuum time.Time
+}
+
+// The fraction of the tuples which are dead, 0 if there are none.
+func (t *TableStats) DeadRatio() float64 {
+	if t.LiveTuples+t.DeadTuples <= 0 {
+		return 0
+	}
+	return float64(t.DeadTuples) / float64(t.LiveTuples+t.DeadTuples)
+}
+
+func (p *pgvSerDe) TableStats() ([]*TableStats, error) {
+	const stmt = `
+  SELECT relname, n_live_tup, n_dead_tup, last_vacuum, last_autovacuum
+    FROM pg_stat_user_tables
+   WHERE relname = ANY($1)
+   ORDER BY relname`
+	names := make([]string, len(pgVacuumTables))
+	for i, name := range pgVacuumTables {
+		names[i] = p.prefix + name
+	}
+	rows, err := p.dbConn.Query(stmt, pq.Array(names))
+	if err != nil {
+		log.Printf("TableStats(): error querying database: %v", err)
+		return nil, dbError("TableStats", err)
+	}
+	defer rows.Close()
+
+	var result []*TableStats
+	for rows.Next() {
+		var (
+			ts                 TableStats
+			vacuum, autoVacuum *time.Time
+		)
+		if err := rows.Scan(&ts.Name, &ts.LiveTuples, &ts.DeadTuples, &vacuum, &autoVacuum); err != nil {
+			log.Printf("TableStats(): error scanning row: %v", err)
+			return nil, dbError("TableStats", err)
+		}
+		ts.Name = ts.Name[len(p.prefix):]
+		if vacuum != nil {
+			ts.LastVacuum = *vacuum
+		}
+		if autoVacuum != nil {
+			ts.LastAutoVacuum = *autoVacuum
+		}
+		result = append(result, &ts)
+	}
+	return result, dbError("TableStats", rows.Err())
+}
+
+// VacuumTables runs VACUUM (ANALYZE) and, if reindex, REINDEX on
+// every table in turn. Unlike VACUUM FULL, neither blocks the
+// flushers for long (REINDEX blocks writes to the table while it
+// runs), so Tgres can keep running.
+func (p *pgvSerDe) VacuumTables(reindex bool) error {
+	for _, name := range pgVacuumTables {
+		stmts := []string{"VACUUM (ANALYZE) %[1]s%[2]s"}
+		if reindex {
+			stmts = append(stmts, "REINDEX TABLE %[1]s%[2]s")
+		}
+		for _, stmt := range stmts {
+			stmt = fmt.Sprintf(stmt, p.prefix, name)
+			start := time.Now()
+			if _, err := p.dbConn.Exec(stmt); err != nil {
+				log.Printf("VacuumTables(): %s: %v", stmt, err)
+				return dbError("VacuumTables", err)
+			}
+			log.Printf("VacuumTables(): %s took %v.", stmt, time.Since(start))
+		}
+	}
+	return nil
+}
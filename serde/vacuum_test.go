@@ -0,0 +1,30 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import "testing"
+
+func Test_TableStats_DeadRatio(t *testing.T) {
+	for _, tc := range []struct {
+		live, dead int64
+		exp        float64
+	}{{0, 0, 0}, {300, 100, 0.25}, {0, 10, 1}} {
+		ts := &TableStats{LiveTuples: tc.live, DeadTuples: tc.dead}
+		if got := ts.DeadRatio(); got != tc.exp {
+			t.Errorf("%d live %d dead: expected %v, got %v", tc.live, tc.dead, tc.exp, got)
+		}
+	}
+}
@@ -40,7 +40,9 @@ type RRASeries struct {
 	from, to  time.Time
 	groupBy   time.Duration
 	maxPoints int64
-	grpVal    float64 // if there is a group by
+	grpVal    float64           // if there is a group by
+	cf        rrd.Consolidation // of the group by
+	rraCf     rrd.Consolidation // of the RRA slots
 }
 
 func NewRRASeries(rra rrd.RoundRobinArchiver) *RRASeries {
@@ -53,6 +55,7 @@ func NewRRASeries(rra rrd.RoundRobinArchiver) *RRASeries {
 		latest: rra.Latest(),
 		step:   rra.Step(),
 		size:   rra.Size(),
+		rraCf:  rra.Spec().Function,
 	}
 	if srra, ok := rra.(RLocker); ok {
 		result.lck = srra
@@ -84,8 +87,8 @@ func (s *RRASeries) Next() bool {
 		moves = int(groupBy.Seconds()/s.step.Seconds() + 0.5)
 	}
 
-	// Compute agerage if we are grouping
-	sum, cnt := float64(0), 0
+	// Consolidate if we are grouping
+	vals := make([]float64, 0, moves)
 	for i := 0; i < moves; i++ {
 		if !s.advance() {
 			s.grpVal = math.NaN()
@@ -93,14 +96,47 @@ func (s *RRASeries) Next() bool {
 		}
 		val := s.curVal()
 		if !math.IsNaN(val) && !math.IsInf(val, 0) {
-			sum += val
-			cnt++
+			vals = append(vals, val)
 		}
 	}
-	s.grpVal = sum / float64(cnt)
+	s.grpVal = consolidate(s.cf, s.rraCf, vals, s.step)
 	return true
 }
 
+// Consolidates the (non-NaN) values of a group, see Consolidator.
+// The slots of a SUM RRA (rraCf) are already totals, a SUM of them
+// is not multiplied by the step.
+func consolidate(cf, rraCf rrd.Consolidation, vals []float64, step time.Duration) float64 {
+	if len(vals) == 0 {
+		return math.NaN()
+	}
+	result := vals[0]
+	switch cf {
+	case rrd.MAX:
+		for _, v := range vals[1:] {
+			result = math.Max(result, v)
+		}
+	case rrd.MIN:
+		for _, v := range vals[1:] {
+			result = math.Min(result, v)
+		}
+	case rrd.LAST:
+		result = vals[len(vals)-1]
+	default: // WMEAN and SUM
+		for _, v := range vals[1:] {
+			result += v
+		}
+		if cf == rrd.SUM {
+			if rraCf != rrd.SUM {
+				result *= step.Seconds()
+			}
+		} else {
+			result /= float64(len(vals))
+		}
+	}
+	return result
+}
+
 func (s *RRASeries) advance() bool {
 	if s.to.Before(s.from) {
 		s.tim = time.Time{}
@@ -186,10 +222,9 @@ func (s *RRASeries) TimeRange(t ...time.Time) (time.Time, time.Time) {
 	return s.from, s.to
 }
 
+// Latest returns the latest of the RRA, i.e. where its data ends
+// regardless of the time range, which may extend beyond it.
 func (s *RRASeries) Latest() time.Time {
-	if !s.to.IsZero() {
-		return s.to
-	}
 	return s.latest
 }
 
@@ -207,6 +242,13 @@ func (s *RRASeries) MaxPoints(n ...int64) int64 {
 	return s.maxPoints
 }
 
+func (s *RRASeries) Consolidation(cf ...rrd.Consolidation) rrd.Consolidation {
+	if len(cf) > 0 {
+		defer func() { s.cf = cf[0] }()
+	}
+	return s.cf
+}
+
 func (s *RRASeries) Alias(a ...string) string {
 	if len(a) > 0 {
 		s.alias = a[0]
@@ -20,7 +20,11 @@
 // database or some other storage.
 package series
 
-import "time"
+import (
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
 
 type Series interface {
 	// Advance to the next data point in the series. Returns false if
@@ -57,8 +61,9 @@ type Series interface {
 	// NaN, but Next returns true over the entire range.
 	TimeRange(...time.Time) (time.Time, time.Time)
 
-	// Timestamp of the last data point in the series.
-	// TODO is series.Latest() necessary even?
+	// Timestamp of the last data point in the series, i.e. where the
+	// stored data ends, which can be before the end of TimeRange().
+	// Zero if there never was any.
 	Latest() time.Time
 
 	// Alternative to GroupBy(), with a similar effect but based on
@@ -68,3 +73,17 @@ type Series interface {
 	// returns the previous value.
 	MaxPoints(...int64) int64
 }
+
+// A Consolidator is a Series which can aggregate the data points it
+// groups (see GroupBy() and MaxPoints()) with a function other than
+// the average: rrd.MAX, rrd.MIN, rrd.LAST (the last one which is not
+// NaN) or rrd.SUM, which, since data points are rates (per second),
+// is the total, i.e. the values are multiplied by the step (unless
+// they already are totals, i.e. the RRA is rrd.SUM). The
+// default is rrd.WMEAN, the average. It is optional, a Series may or
+// may not implement it.
+// Without arguments returns the value, with an argument sets and
+// returns the previous value.
+type Consolidator interface {
+	Consolidation(...rrd.Consolidation) rrd.Consolidation
+}
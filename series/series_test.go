@@ -0,0 +1,52 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package series
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+func Test_Latest(t *testing.T) {
+	latest := time.Unix(1500000000, 0).Truncate(time.Minute)
+	rraSeries := func(latest time.Time) *RRASeries {
+		return NewRRASeries(rrd.NewRoundRobinArchive(rrd.RRASpec{Step: time.Minute, Span: time.Hour, Latest: latest}))
+	}
+
+	// Where the data ends, whatever the time range
+	s := rraSeries(latest)
+	if !s.Latest().Equal(latest) {
+		t.Errorf("Expected the latest of the RRA %v, got %v", latest, s.Latest())
+	}
+	s.TimeRange(latest.Add(-2*time.Hour), latest.Add(time.Hour))
+	if !s.Latest().Equal(latest) {
+		t.Errorf("Expected a time range past the data not to change Latest(), got %v", s.Latest())
+	}
+	if !rraSeries(time.Time{}).Latest().IsZero() {
+		t.Errorf("Expected zero without any data")
+	}
+
+	// The latest of all of them
+	sl := SeriesSlice{rraSeries(latest.Add(-time.Hour)), rraSeries(time.Time{}), rraSeries(latest), rraSeries(latest.Add(-time.Minute))}
+	if !sl.Latest().Equal(latest) {
+		t.Errorf("Expected the latest of the slice %v, got %v", latest, sl.Latest())
+	}
+	if !(SeriesSlice{}).Latest().IsZero() {
+		t.Errorf("Expected zero for an empty slice")
+	}
+}
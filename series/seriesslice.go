@@ -19,6 +19,8 @@ import (
 	"math"
 	"sort"
 	"time"
+
+	"github.com/tgres/tgres/rrd"
 )
 
 // A slice of series which implements the Series interface (almost).
@@ -86,6 +88,24 @@ func (sl SeriesSlice) GroupBy(ms ...time.Duration) time.Duration {
 	return 0
 }
 
+// Sets the consolidation of every series in the slice which is a
+// Consolidator. Returns that of the first series, WMEAN if it is not
+// a Consolidator or the slice is empty.
+func (sl SeriesSlice) Consolidation(cf ...rrd.Consolidation) rrd.Consolidation {
+	var result rrd.Consolidation
+	for i, s := range sl {
+		if c, ok := s.(Consolidator); ok {
+			if i == 0 {
+				result = c.Consolidation()
+			}
+			if len(cf) > 0 {
+				c.Consolidation(cf[0])
+			}
+		}
+	}
+	return result
+}
+
 func (sl SeriesSlice) TimeRange(t ...time.Time) (time.Time, time.Time) {
 	if len(t) == 1 { // setter 1 arg
 		defer func() {
@@ -107,13 +127,16 @@ func (sl SeriesSlice) TimeRange(t ...time.Time) (time.Time, time.Time) {
 	return time.Time{}, time.Time{}
 }
 
-// Returns Latest() for the first series in the slice or zero time if
-// slice is empty.
+// Returns the latest Latest() of the series in the slice or zero time
+// if slice is empty.
 func (sl SeriesSlice) Latest() time.Time {
-	if len(sl) > 0 {
-		return sl[0].Latest()
+	var latest time.Time
+	for _, s := range sl {
+		if l := s.Latest(); l.After(latest) {
+			latest = l
+		}
 	}
-	return time.Time{}
+	return latest
 }
 
 // With argument sets MaxPoints on all series in the slice, without
@@ -151,19 +174,27 @@ func lcm(x, y int64) int64 {
 // in the slice and calls GroupBy with this value thereby causing all
 // series to be of matching resolution (i.e. aligned on data point
 // timestamps). Generally you should always Align() the series slice
-// before iterting over it.
+// before iterting over it. If all the steps are the same, the series
+// are aligned already and GroupBy is left alone, so as not to undo
+// the grouping of MaxPoints.
 func (sl SeriesSlice) Align() {
 	if len(sl) < 2 {
 		return
 	}
 
 	var result int64 = -1
+	same := true
 	for _, series := range sl {
 		if result == -1 {
 			result = series.Step().Nanoseconds() / 1e6
 			continue
 		}
-		result = lcm(result, series.Step().Nanoseconds()/1e6)
+		step := series.Step().Nanoseconds() / 1e6
+		same = same && step == result
+		result = lcm(result, step)
+	}
+	if same {
+		return
 	}
 
 	for _, series := range sl {
@@ -172,11 +203,17 @@ func (sl SeriesSlice) Align() {
 }
 
 // Returns the arithmetic sum of all the current values in the series
-// in the slice.
+// in the slice. Like in Graphite, NaNs are skipped, unless all the
+// values are NaN, in which case the result is NaN. (To treat missing
+// values as zero, transformNull() the series first).
 func (sl SeriesSlice) Sum() (result float64) {
+	result = math.NaN()
 	for _, series := range sl {
-		if val := series.CurrentValue(); !math.IsNaN(val) { // Graphite treats NaN like 0
-			result += series.CurrentValue()
+		if val := series.CurrentValue(); !math.IsNaN(val) {
+			if math.IsNaN(result) {
+				result = 0
+			}
+			result += val
 		}
 	}
 	return
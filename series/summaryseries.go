@@ -51,15 +51,22 @@ func (f *SummarySeries) Min() (min float64) {
 	return
 }
 
-// Returns the simple average of all the values in the series.
+// Returns the simple average of all the values in the series. NaNs
+// are skipped, like in Max() and Min(), the average of no values is
+// NaN.
 func (f *SummarySeries) Avg() float64 {
 	count := 0
 	sum := float64(0)
 	for f.Series.Next() {
-		sum += f.Series.CurrentValue()
-		count++
+		if value := f.Series.CurrentValue(); !math.IsNaN(value) {
+			sum += value
+			count++
+		}
 	}
 	f.Series.Close()
+	if count == 0 {
+		return math.NaN()
+	}
 	return sum / float64(count)
 }
 
@@ -75,6 +82,24 @@ func (f *SummarySeries) StdDev(avg float64) float64 {
 	return math.Sqrt(sum / float64(count-1))
 }
 
+// Returns the fraction of the values in the series which are not
+// NaN, the same as the "known" of an RRA slot which is compared with
+// its XFF. Zero if the series has no values at all.
+func (f *SummarySeries) Known() float64 {
+	count, known := 0, 0
+	for f.Series.Next() {
+		if !math.IsNaN(f.Series.CurrentValue()) {
+			known++
+		}
+		count++
+	}
+	f.Series.Close()
+	if count == 0 {
+		return 0
+	}
+	return float64(known) / float64(count)
+}
+
 // Returns the last value in the series.
 func (f *SummarySeries) Last() (last float64) {
 	for f.Series.Next() {
@@ -52,6 +52,10 @@ func (st *Stat) AggregatorCmd() *aggregator.Command {
 			aggregator.CmdAppend,
 			serde.Ident{"name": Prefix + ".timers." + st.Name},
 			st.Value)
+	} else if st.Metric == "s" {
+		return aggregator.NewSetCommand(
+			serde.Ident{"name": Prefix + ".sets." + st.Name},
+			st.Member)
 	}
 	return nil
 }
@@ -62,6 +66,7 @@ type Stat struct {
 	Metric string
 	Sample float64
 	Delta  bool
+	Member string // the (unparsed) value of a set
 }
 
 // ParseStatsdPacket parses a statsd packet e.g: gorets:1|c|@0.1. See
@@ -94,6 +99,14 @@ func ParseStatsdPacket(packet string) (*Stat, error) {
 		return nil, fmt.Errorf("invalid packet: %q", packet)
 	}
 
+	if parts[1] == "s" {
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid packet (empty set member): %q", packet)
+		}
+		result.Member, result.Metric = parts[0], "s"
+		return result, nil
+	}
+
 	if n, err := fmt.Sscanf(parts[0], "%f", &result.Value); n != 1 || err != nil {
 		return nil, fmt.Errorf("error %v scanning input (cannot parse value|metric): %q", err, packet)
 	}
@@ -0,0 +1,60 @@
+//
+// Copyright 2017 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tgres/tgres/aggregator"
+	"github.com/tgres/tgres/serde"
+)
+
+type dpMap map[string]float64
+
+func (m dpMap) QueueDataPoint(ident serde.Ident, _ time.Time, v float64) {
+	m[ident["name"]] = v
+}
+
+func Test_ParseStatsdPacket_set(t *testing.T) {
+	st, err := ParseStatsdPacket("users:alice|s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Name != "users" || st.Metric != "s" || st.Member != "alice" {
+		t.Errorf("Unexpected set stat: %+v", st)
+	}
+	// the member is not a number
+	if st, err := ParseStatsdPacket("users:1.5e3|s"); err != nil || st.Member != "1.5e3" || st.Value != 0 {
+		t.Errorf("Expected the member as is, got %+v: %v", st, err)
+	}
+	if _, err := ParseStatsdPacket("users:|s"); err == nil {
+		t.Errorf("Expected an error for an empty member")
+	}
+
+	// all the members of a set end up in one count
+	dps := make(dpMap)
+	a := aggregator.NewAggregator(dps)
+	a.AppendAttr = "name"
+	for _, p := range []string{"users:alice|s", "users:bob|s", "users:alice|s"} {
+		st, _ := ParseStatsdPacket(p)
+		a.ProcessCmd(st.AggregatorCmd())
+	}
+	a.Flush(time.Now().Add(time.Second))
+	if len(dps) != 1 || dps[Prefix+".sets.users.distinct"] != 2 {
+		t.Errorf("Expected 2 distinct users, got %v", dps)
+	}
+}